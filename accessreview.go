@@ -0,0 +1,247 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name and version of the access review layout, bump the version whenever a field changes meaning or goes away
+// Adding fields is no breaking change, readers ignore the ones they do not know
+const accessReviewSchema = "portknob-access-review/1"
+
+// Who can reach what, for auditing tools
+type accessReview struct {
+	Schema		string	`json:"schema"`
+	Generated	string	`json:"generated"`
+	Anonymized	bool	`json:"anonymized"`
+	// Every firewall rule of the configuration, whether anyone may reach it or not
+	Resources	[]accessReviewResource	`json:"resources"`
+	// Live whitelist entries
+	Grants		[]accessReviewGrant	`json:"grants"`
+	// Revocations still in force
+	Tombstones	[]accessReviewTombstone	`json:"tombstones"`
+}
+
+type accessReviewResource struct {
+	// Name of the rule as in logs, e.g. "#2 pgsql"
+	Name		string	`json:"name"`
+	// "tcp", "udp" or "any"
+	Proto		string	`json:"proto"`
+	// Destination address, or "any"
+	Dest		string	`json:"dest"`
+	Ports		string	`json:"ports"`
+	Group		string	`json:"group,omitempty"`
+	// "lockdown" for rules which deny everyone else while anyone is whitelisted
+	Action		string	`json:"action,omitempty"`
+}
+
+type accessReviewSubject struct {
+	// Empty for whoever opened a share link and for devices
+	User		string	`json:"user,omitempty"`
+	Subnet		string	`json:"subnet"`
+}
+
+type accessReviewValidity struct {
+	// Empty for entries written before schema version 12 of the cache database
+	From		string	`json:"from,omitempty"`
+	// "never" for entries which do not expire
+	Until		string	`json:"until"`
+}
+
+type accessReviewProvenance struct {
+	// "login", "admin", "share" or "device"
+	Kind		string	`json:"kind"`
+	// The admin or control socket user who granted it, the user who shared the link or the name of the device
+	By			string	`json:"by,omitempty"`
+}
+
+type accessReviewGrant struct {
+	Subject		accessReviewSubject	`json:"subject"`
+	// Names of the resources the entry opens
+	Resources	[]string	`json:"resources"`
+	Validity	accessReviewValidity	`json:"validity"`
+	Provenance	accessReviewProvenance	`json:"provenance"`
+}
+
+type accessReviewTombstone struct {
+	// "revoked-subnet" for a subnet whose login cookies no longer log in, "revoked-user" for a user whose cookies were voided
+	Kind		string	`json:"kind"`
+	Subnet		string	`json:"subnet,omitempty"`
+	User		string	`json:"user,omitempty"`
+	At			string	`json:"at,omitempty"`
+	// Times the cookies of the user were voided
+	Revocations	uint64	`json:"revocations,omitempty"`
+}
+
+// Serve GET /access-review, with ?anonymize=true hashing the subnets
+func (s *server) serveAccessReview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.writeJSON(w, 405, map[string]string { "error": "method not allowed" })
+		return
+	}
+	anonymize := false
+	if v := r.URL.Query().Get("anonymize"); v != "" {
+		var err error
+		anonymize, err = strconv.ParseBool(v)
+		if err != nil {
+			s.writeJSON(w, 400, map[string]string { "error": "cannot parse anonymize" })
+			return
+		}
+	}
+	review, err := s.accessReview(anonymize, time.Now())
+	if err != nil {
+		log.Println(err)
+		s.writeJSON(w, 500, map[string]string { "error": "cannot read cache database" })
+		return
+	}
+	// Read by people as much as by tools
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(review)
+}
+
+// Return who can reach what at now, anonymize replacing the subnets by keyed hashes
+// Portknob has no static whitelist, every grant comes from the cache database
+func (s *server) accessReview(anonymize bool, now time.Time) (*accessReview, error) {
+	review := &accessReview {
+		Schema:		accessReviewSchema,
+		Generated:	now.UTC().Format(time.RFC3339),
+		Anonymized:	anonymize,
+		Resources:	[]accessReviewResource {},
+		Grants:		[]accessReviewGrant {},
+		Tombstones:	[]accessReviewTombstone {},
+	}
+	subject := func (subnet string) string { return subnet }
+	if anonymize {
+		key, err := s.fw.cache.AnonymizeKey()
+		if err != nil {
+			return nil, err
+		}
+		subject = func (subnet string) string { return anonymizeSubnet(key, subnet) }
+	}
+
+	for i, rule := range s.conf.Firewall {
+		v := accessReviewResource {
+			Name:		s.conf.ruleName(i),
+			Proto:		rule.Proto,
+			Dest:		rule.Dest,
+			Ports:		rule.DestPort,
+			Group:		rule.Group,
+		}
+		if v.Proto == "" {
+			v.Proto = "any"
+		}
+		if v.Dest == "" {
+			v.Dest = "any"
+		}
+		if s.conf.groupLockdown(rule.Group) {
+			v.Action = "lockdown"
+		}
+		review.Resources = append(review.Resources, v)
+	}
+
+	cached, err := s.fw.cache.Entries()
+	if err != nil {
+		return nil, err
+	}
+	grantedBy, err := s.fw.cache.GrantedBy()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range cached {
+		if !entry.live(now) {
+			continue
+		}
+		v := accessReviewGrant {
+			Subject:	accessReviewSubject { entry.user, subject(s.fw.Subnet(entry.addr).String()) },
+			Resources:	s.conf.groupRuleNames([]string {entry.group}),
+			Validity:	accessReviewValidity { Until: formatExpiry(entry.expires) },
+			Provenance:	accessReviewProvenance { Kind: "login" },
+		}
+		if v.Resources == nil {
+			v.Resources = []string {}
+		}
+		if !entry.created.IsZero() {
+			v.Validity.From = entry.created.UTC().Format(time.RFC3339)
+		}
+		if by, ok := grantedBy[entry.key()]; ok {
+			v.Provenance = accessReviewProvenance { "admin", by }
+		} else if strings.HasPrefix(entry.user, shareUserPrefix) {
+			v.Subject.User = ""
+			v.Provenance = accessReviewProvenance { "share", strings.TrimPrefix(entry.user, shareUserPrefix) }
+		} else if strings.HasPrefix(entry.user, deviceUserPrefix) {
+			v.Subject.User = ""
+			v.Provenance = accessReviewProvenance { "device", strings.TrimPrefix(entry.user, deviceUserPrefix) }
+		}
+		review.Grants = append(review.Grants, v)
+	}
+	sort.SliceStable(review.Grants, func (i, j int) bool {
+		a, b := review.Grants[i], review.Grants[j]
+		if a.Subject.Subnet != b.Subject.Subnet {
+			return a.Subject.Subnet < b.Subject.Subnet
+		}
+		if a.Subject.User != b.Subject.User {
+			return a.Subject.User < b.Subject.User
+		}
+		return strings.Join(a.Resources, "\n") < strings.Join(b.Resources, "\n")
+	})
+
+	revoked, err := s.fw.cache.RevokedSubnets()
+	if err != nil {
+		return nil, err
+	}
+	for subnet, at := range revoked {
+		review.Tombstones = append(review.Tombstones, accessReviewTombstone { Kind: "revoked-subnet", Subnet: subject(subnet), At: at.UTC().Format(time.RFC3339) })
+	}
+	epochs, err := s.fw.cache.Epochs()
+	if err != nil {
+		return nil, err
+	}
+	for user, epoch := range epochs {
+		review.Tombstones = append(review.Tombstones, accessReviewTombstone { Kind: "revoked-user", User: user, Revocations: epoch })
+	}
+	sort.Slice(review.Tombstones, func (i, j int) bool {
+		a, b := review.Tombstones[i], review.Tombstones[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Subnet + a.User < b.Subnet + b.User
+	})
+	return review, nil
+}
+
+// Replace subnet by a keyed hash, the same for every review of the cache database and useless without its key
+func anonymizeSubnet(key []byte, subnet string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(subnet))
+	return "anon:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
@@ -0,0 +1,119 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// The layout is locked by the golden files, a change there needs a new accessReviewSchema unless it only adds fields
+func TestAccessReview(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	tests := []struct {
+		name		string
+		query		string
+		golden		string
+	}{
+		{ "plain", "", "access-review.txt" },
+		{ "anonymized", "?anonymize=true", "access-review-anonymized.txt" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			s, _ := newTestServer(t, "admin-path = \"/admin\"\nadmin-allow = [\"192.0.2.0/24\"]\ncontrol-socket = \"/nonexistent/portknob.sock\"\n[[firewall]]\ncomment = \"ssh\"\nproto = \"tcp\"\ndport = \"22\"\n[[firewall]]\ncomment = \"pgsql\"\ndest = \"10.0.0.5\"\ndport = \"5432\"\ngroup = \"db\"\n[[secrets]]\nusername = \"alice\"\npassword = \"hunter2\"\ngroups = [\"db\"]\n")
+			err := s.fw.cache.store.Update(func (tx cacheTx) error {
+				return tx.Put("portknob-meta", "anonymize-key", "000102030405060708090a0b0c0d0e0f")
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w := testLogin(s, "203.0.113.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil); w.Code != 200 {
+				t.Fatalf("login replied %d: %s", w.Code, w.Body.String())
+			}
+			w := testGrantPost(s.controlHandlerFunc, "/grant", url.Values { "address": {"198.51.100.9"}, "user": {"deploy"}, "duration": {"3600"}, "by": {"root"} })
+			if w.Code != 200 {
+				t.Fatalf("grant replied %d: %s", w.Code, w.Body.String())
+			}
+			_, err = s.fw.InsertTimeout(net.ParseIP("192.0.2.44"), shareUserPrefix + "alice", []string {""}, time.Hour, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.fw.cache.SetRevoked("233.252.0.0/24", true)
+			s.fw.cache.BumpEpochs([]string {"bob"})
+
+			r := httptest.NewRequest("GET", "/admin/access-review" + tt.query, nil)
+			w = httptest.NewRecorder()
+			s.adminHandlerFunc(w, r)
+			checkGolden(t, tt.golden, w)
+
+			// The control socket serves the same, which portknob export prints
+			r = httptest.NewRequest("GET", "/access-review" + tt.query, nil)
+			control := httptest.NewRecorder()
+			s.controlHandlerFunc(control, r)
+			var fromAdmin, fromControl accessReview
+			json.Unmarshal(w.Body.Bytes(), &fromAdmin)
+			json.Unmarshal(control.Body.Bytes(), &fromControl)
+			if len(fromControl.Grants) != 4 || len(fromControl.Grants) != len(fromAdmin.Grants) || fromControl.Schema != accessReviewSchema {
+				t.Errorf("control socket replied %d: %s", control.Code, control.Body.String())
+			}
+		})
+	}
+}
+
+// A login from the address of an admin grant replaces the entry, which is then the login's
+func TestAccessReviewProvenance(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, _ := newTestServer(t, "control-socket = \"/nonexistent/portknob.sock\"\n[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\n")
+	provenance := func () accessReviewProvenance {
+		review, err := s.accessReview(false, time.Now())
+		if err != nil || len(review.Grants) != 1 {
+			t.Fatalf("review %+v: %v", review, err)
+		}
+		return review.Grants[0].Provenance
+	}
+	w := testGrantPost(s.controlHandlerFunc, "/grant", url.Values { "address": {"203.0.113.7"}, "user": {"alice"}, "by": {"root"} })
+	if w.Code != 200 {
+		t.Fatalf("grant replied %d: %s", w.Code, w.Body.String())
+	}
+	if p := provenance(); p != (accessReviewProvenance { "admin", "control-socket root" }) {
+		t.Errorf("after the grant, provenance %+v", p)
+	}
+	if w := testLogin(s, "203.0.113.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil); w.Code != 200 {
+		t.Fatalf("login replied %d: %s", w.Code, w.Body.String())
+	}
+	if p := provenance(); p != (accessReviewProvenance { Kind: "login" }) {
+		t.Errorf("after the login, provenance %+v", p)
+	}
+	s.fw.cache.Iter(func (entry cacheEntry) bool { return true })
+	s.fw.cache.SetGrantedBy([]cacheEntry {{ addr: net.ParseIP("203.0.113.7") }}, "admin gone")
+	s.fw.cache.CleanupGrantedBy()
+	if grantedBy, _ := s.fw.cache.GrantedBy(); len(grantedBy) != 0 {
+		t.Errorf("records of removed entries left: %v", grantedBy)
+	}
+}
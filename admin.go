@@ -0,0 +1,675 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type adminEntry struct {
+	Address		string	`json:"address"`
+	Subnet		string	`json:"subnet"`
+	User		string	`json:"user,omitempty"`
+	Group		string	`json:"group,omitempty"`
+	// Rules the entry opens, which all expire with it
+	Rules		[]string	`json:"rules,omitempty"`
+	// "lockdown" for entries of lockdown rules, which deny everyone else meanwhile
+	Action		string	`json:"action,omitempty"`
+	Created		string	`json:"created,omitempty"`
+	Expires		string	`json:"expires"`
+	// Number of the first of the rules, for the revoke buttons of the admin page
+	Rule		int	`json:"-"`
+}
+
+// Serve the admin page at <admin-path>/ and POST <admin-path>/revoke, /preview-grant, /confirm-grant, /acknowledge-panic, /confirm-travel and /dismiss-travel for its forms
+// Serve GET <admin-path>/entries, DELETE <admin-path>/entries/<subnet>[?rule=RULE], GET <admin-path>/access-review, <admin-path>/devices, POST <admin-path>/grant, <admin-path>/maintenance and <admin-path>/panic for scripts
+func (s *server) adminHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+
+	// Before the credentials are checked, so guessing them is limited too
+	key := "unix"
+	if !overUnixSocket(r) {
+		clientIP, _ := s.adminClientIP(r)
+		key = clientIP.String()
+	}
+	if s.rateLimited(w, s.adminLimiter, key) {
+		return
+	}
+
+	if !s.adminAuthorized(r) {
+		if len(s.conf.AdminSecrets) != 0 {
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"Portknob admin\"")
+		}
+		s.writeJSON(w, 401, map[string]string { "error": "unauthorized" })
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, s.conf.Daemon.AdminPath)
+	if s.readOnlyRefuses(w, r, rest, "/", "/capabilities", "/entries", "/access-review", "/devices", "/maintenance", "/panic") {
+		return
+	}
+	switch {
+	case rest == "/":
+		if r.Method != "GET" {
+			http.Error(w, "Method Not Allowed", 405)
+			return
+		}
+		s.adminPage(w)
+	case rest == "/revoke":
+		if r.Method != "POST" {
+			http.Error(w, "Method Not Allowed", 405)
+			return
+		}
+		// Browsers send the admin credentials along with requests made by other sites
+		if !sameOrigin(r) {
+			http.Error(w, "Forbidden: cross-site request", 403)
+			return
+		}
+		var code int
+		var message string
+		if rule := r.PostFormValue("rule"); rule != "" {
+			_, _, code, message = s.revokeRule(r.PostFormValue("subnet"), rule)
+		} else {
+			_, code, message = s.revokeSubnet(r.PostFormValue("subnet"))
+		}
+		if code != 200 {
+			http.Error(w, message, code)
+			return
+		}
+		http.Redirect(w, r, s.conf.Daemon.AdminPath + "/", 303)
+	case rest == "/preview-grant" || rest == "/confirm-grant":
+		if r.Method != "POST" {
+			http.Error(w, "Method Not Allowed", 405)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "Forbidden: cross-site request", 403)
+			return
+		}
+		s.adminGrantForm(w, r, rest == "/confirm-grant")
+	case rest == "/grant":
+		if r.Method != "POST" {
+			s.writeJSON(w, 405, map[string]string { "error": "method not allowed" })
+			return
+		}
+		// A request made by another site with the credentials of the browser cannot read the token of its dry run
+		s.serveGrant(w, r, true, s.adminActor(r))
+	case rest == "/maintenance":
+		s.serveMaintenance(w, r, s.adminActor(r))
+	case rest == "/panic":
+		// A scope of its own: admin credentials which may revoke one subnet may not revoke all of them
+		if user, _, _ := r.BasicAuth(); len(s.conf.AdminSecrets) == 0 || !containsString(s.conf.Daemon.AdminPanicUsers, user) {
+			s.writeJSON(w, 403, map[string]string { "error": "panic needs a user of admin-panic-users" })
+			return
+		}
+		if r.Method != "GET" && r.Header.Get("Origin") + r.Header.Get("Referer") != "" && !sameOrigin(r) {
+			s.writeJSON(w, 403, map[string]string { "error": "cross-site request" })
+			return
+		}
+		s.servePanic(w, r, s.adminActor(r))
+	case rest == "/confirm-travel" || rest == "/dismiss-travel":
+		if r.Method != "POST" {
+			http.Error(w, "Method Not Allowed", 405)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "Forbidden: cross-site request", 403)
+			return
+		}
+		code, message := s.releaseTravel(r.PostFormValue("user"), rest == "/confirm-travel", s.adminActor(r))
+		if code != 200 {
+			http.Error(w, message, code)
+			return
+		}
+		http.Redirect(w, r, s.conf.Daemon.AdminPath + "/", 303)
+	case rest == "/acknowledge-panic":
+		if r.Method != "POST" {
+			http.Error(w, "Method Not Allowed", 405)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "Forbidden: cross-site request", 403)
+			return
+		}
+		code, message := s.acknowledgePanic(s.adminActor(r))
+		if code != 200 {
+			http.Error(w, message, code)
+			return
+		}
+		http.Redirect(w, r, s.conf.Daemon.AdminPath + "/", 303)
+	case rest == "/capabilities":
+		if r.Method != "GET" {
+			s.writeJSON(w, 405, map[string]string { "error": "method not allowed" })
+			return
+		}
+		s.writeJSON(w, 200, newCapabilities(s.conf))
+	case rest == "/entries":
+		if r.Method != "GET" {
+			s.writeJSON(w, 405, map[string]string { "error": "method not allowed" })
+			return
+		}
+		s.adminListEntries(w)
+	case strings.HasPrefix(rest, "/entries/"):
+		if r.Method != "DELETE" {
+			s.writeJSON(w, 405, map[string]string { "error": "method not allowed" })
+			return
+		}
+		s.adminRevoke(w, strings.TrimPrefix(rest, "/entries/"), r.URL.Query().Get("rule"))
+	case rest == "/access-review":
+		s.serveAccessReview(w, r)
+	case rest == "/api/v1/explain":
+		s.serveExplain(w, r)
+	case rest == "/devices" || strings.HasPrefix(rest, "/devices/"):
+		if r.Method != "GET" && r.Header.Get("Origin") + r.Header.Get("Referer") != "" && !sameOrigin(r) {
+			s.writeJSON(w, 403, map[string]string { "error": "cross-site request" })
+			return
+		}
+		s.serveDeviceKeys(w, r, strings.TrimPrefix(strings.TrimPrefix(rest, "/devices"), "/"), s.adminActor(r))
+	default:
+		s.writeJSON(w, 404, map[string]string { "error": "not found" })
+	}
+}
+
+// Return the address admin-allow is checked against
+// Anyone can send the client-ip header, so only X-Forwarded-For from trusted-proxies may replace the peer address
+func (s *server) adminClientIP(r *http.Request) (net.IP, error) {
+	if !s.conf.Daemon.trustedNets.Empty() {
+		return s.clientIP(r)
+	}
+	return peerIP(r), nil
+}
+
+// Whether r came in on a unix socket of admin-listen, whose peers have no address
+func overUnixSocket(r *http.Request) bool {
+	_, unix := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+	return unix
+}
+
+// Require both the source subnet and the credentials, whichever are configured
+// On a unix socket the file permissions stand in for the subnet
+func (s *server) adminAuthorized(r *http.Request) bool {
+	if len(s.conf.Daemon.adminNets) != 0 && !overUnixSocket(r) {
+		clientIP, err := s.adminClientIP(r)
+		if err != nil {
+			return false
+		}
+		allowed := false
+		for _, ipnet := range s.conf.Daemon.adminNets {
+			allowed = allowed || (clientIP != nil && ipnet.Contains(clientIP))
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if len(s.conf.AdminSecrets) != 0 {
+		user, pass, _ := r.BasicAuth()
+		secret, found := s.conf.AdminSecrets[user]
+		if !found || !checkSecret(secret, pass) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return who is using the admin API, for the audit log
+func (s *server) adminActor(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && len(s.conf.AdminSecrets) != 0 {
+		return "admin " + user
+	}
+	clientIP, _ := s.adminClientIP(r)
+	return "admin from " + clientIP.String()
+}
+
+func (s *server) adminListEntries(w http.ResponseWriter) {
+	entries, err := s.adminEntries()
+	if err != nil {
+		s.writeJSON(w, 500, map[string]string { "error": "cannot read cache database" })
+		return
+	}
+	s.writeJSON(w, 200, map[string][]adminEntry { "entries": entries })
+}
+
+// Return the whitelist entries which have not expired
+func (s *server) adminEntries() ([]adminEntry, error) {
+	cached, err := s.fw.cache.Entries()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	entries := []adminEntry {}
+	for _, entry := range cached {
+		if !entry.live(now) {
+			continue
+		}
+		v := adminEntry {
+			Address:	entry.addr.String(),
+			Subnet:		s.fw.Subnet(entry.addr).String(),
+			User:		entry.user,
+			Group:		entry.group,
+			Rules:		s.conf.groupRuleNames([]string {entry.group}),
+			Expires:	formatExpiry(entry.expires),
+		}
+		if s.conf.groupLockdown(entry.group) {
+			v.Action = "lockdown"
+		}
+		for i, rule := range s.conf.Firewall {
+			if rule.Group == entry.group {
+				v.Rule = i + 1
+				break
+			}
+		}
+		if !entry.created.IsZero() {
+			v.Created = entry.created.UTC().Format(time.RFC3339)
+		}
+		entries = append(entries, v)
+	}
+	return entries, nil
+}
+
+// Revoke a whitelisted subnet, or only the rule group of rule if it is not empty
+func (s *server) adminRevoke(w http.ResponseWriter, subnet, rule string) {
+	if rule != "" {
+		subnet, rules, code, message := s.revokeRule(subnet, rule)
+		if code != 200 {
+			s.writeJSON(w, code, map[string]string { "error": message })
+			return
+		}
+		s.writeJSON(w, 200, map[string]interface{} { "revoked": subnet, "rules": rules })
+		return
+	}
+	subnet, code, message := s.revokeSubnet(subnet)
+	if code != 200 {
+		s.writeJSON(w, code, map[string]string { "error": message })
+		return
+	}
+	s.writeJSON(w, 200, map[string]string { "revoked": subnet })
+}
+
+// Return the whitelisted subnet given as "addr/prefix" or any address in it, or the HTTP status and message of the failure
+func (s *server) parseSubnet(subnet string) (string, int, string) {
+	if ip, ipnet, err := net.ParseCIDR(subnet); err == nil {
+		if ones, _ := ipnet.Mask.Size(); ones != int(s.subnetPrefix(ip)) {
+			return "", 400, "subnet does not match ipv4-prefix or ipv6-prefix"
+		}
+		return ipnet.String(), 200, ""
+	} else if ip := net.ParseIP(subnet); ip != nil {
+		return s.fw.Subnet(ip).String(), 200, ""
+	}
+	return "", 400, "cannot parse subnet"
+}
+
+// Revoke every entry in a whitelisted subnet, given as "addr/prefix" or any address in it
+// Returns the subnet, or the HTTP status and message of the failure
+func (s *server) revokeSubnet(subnet string) (string, int, string) {
+	subnet, code, message := s.parseSubnet(subnet)
+	if code != 200 {
+		return "", code, message
+	}
+
+	cached, err := s.fw.cache.Entries()
+	if err != nil {
+		return "", 500, "cannot read cache database"
+	}
+	found := false
+	var users []string
+	for _, entry := range cached {
+		if s.fw.Subnet(entry.addr).String() != subnet {
+			continue
+		}
+		found = true
+		if entry.user != "" && !containsString(users, entry.user) {
+			users = append(users, entry.user)
+		}
+		err = s.fw.Revoke(entry.addr)
+		if err != nil {
+			return "", 500, "cannot update firewall"
+		}
+	}
+	if !found {
+		return "", 404, "subnet is not whitelisted"
+	}
+	err = s.fw.cache.SetRevoked(subnet, true)
+	if err != nil {
+		return "", 500, "cannot update cache database"
+	}
+	// The cookies of the users may have been copied elsewhere, wherever they log in from they type their password again
+	err = s.fw.cache.BumpEpochs(users)
+	if err != nil {
+		return "", 500, "cannot update cache database"
+	}
+	return subnet, 200, ""
+}
+
+// Revoke the entries of a whitelisted subnet for rule, given by its number or comment, leaving its other rules open
+// The whole group of the rule closes, as one entry opens all of it, returns the subnet and the rules closed
+func (s *server) revokeRule(subnet, rule string) (string, []string, int, string) {
+	i, found := s.conf.findRule(rule)
+	if !found {
+		return "", nil, 400, "unknown rule, give its number or a comment no other rule has"
+	}
+	subnet, code, message := s.parseSubnet(subnet)
+	if code != 200 {
+		return "", nil, code, message
+	}
+	group := s.conf.Firewall[i].Group
+
+	cached, err := s.fw.cache.Entries()
+	if err != nil {
+		return "", nil, 500, "cannot read cache database"
+	}
+	var addrs []net.IP
+	for _, entry := range cached {
+		if entry.group == group && s.fw.Subnet(entry.addr).String() == subnet {
+			addrs = append(addrs, entry.addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return "", nil, 404, "subnet is not whitelisted for this rule"
+	}
+	err = s.fw.RevokeGroup(group, addrs...)
+	if err != nil {
+		return "", nil, 500, "cannot update firewall"
+	}
+	return subnet, s.conf.groupRuleNames([]string {group}), 200, ""
+}
+
+func (s *server) adminPage(w http.ResponseWriter) {
+	entries, err := s.adminEntries()
+	if err != nil {
+		http.Error(w, "cannot read cache database", 500)
+		return
+	}
+	now := time.Now()
+	counts, err := s.fw.cache.Denied(now)
+	if err != nil {
+		http.Error(w, "cannot read cache database", 500)
+		return
+	}
+	denied := make([]adminDenied, len(counts))
+	for i, count := range counts {
+		denied[i] = adminDenied { count.label, count.total, count.hourly[len(count.hourly) - 1], sparkline(count.hourly) }
+	}
+	holds, err := s.fw.cache.TravelHolds()
+	if err != nil {
+		http.Error(w, "cannot read cache database", 500)
+		return
+	}
+	var travel []adminTravel
+	for user, login := range holds {
+		travel = append(travel, adminTravel { user, login.addr.String(), login.country, login.at.Format(time.RFC3339) })
+	}
+	sort.Slice(travel, func (i, j int) bool { return travel[i].User < travel[j].User })
+	var peers []adminPeer
+	max := time.Duration(s.conf.Daemon.MaxPeerClockSkew) * time.Second
+	for peer, clock := range s.fw.PeerClocks() {
+		peers = append(peers, adminPeer { peer, clock.skew.Round(time.Second).String(), clock.seen.Format(time.RFC3339), clock.skew.Abs() > max })
+	}
+	sort.Slice(peers, func (i, j int) bool { return peers[i].Peer < peers[j].Peer })
+	var commands []adminCommand
+	for command, p95 := range s.fw.metrics.FirewallP95() {
+		commands = append(commands, adminCommand { command.op, command.family, p95.Round(time.Millisecond).String() })
+	}
+	sort.Slice(commands, func (i, j int) bool {
+		if commands[i].Op != commands[j].Op {
+			return commands[i].Op < commands[j].Op
+		}
+		return commands[i].Family < commands[j].Family
+	})
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	// The revoke buttons must not work from inside another site's frame
+	w.Header().Set("X-Frame-Options", "DENY")
+	adminPage.Execute(w, adminPageData { s.conf.Daemon.AdminPath, entries, s.maintenanceState(now), s.panicState(), denied, travel, peers, commands, newCapabilities(s.conf), s.defensePosture(now) })
+}
+
+// Draw counts as a row of block characters as high as count relative to the largest one, empty ones as the lowest
+func sparkline(counts []uint64) string {
+	const levels = "▁▂▃▄▅▆▇█"
+	blocks := []rune(levels)
+	var max uint64
+	for _, count := range counts {
+		if count > max {
+			max = count
+		}
+	}
+	line := make([]rune, len(counts))
+	for i, count := range counts {
+		level := 0
+		if count != 0 {
+			level = 1 + int(count * uint64(len(blocks) - 2) / max)
+		}
+		line[i] = blocks[level]
+	}
+	return string(line)
+}
+
+// Show the confirmation page of the grant form, or commit the grant it confirms
+func (s *server) adminGrantForm(w http.ResponseWriter, r *http.Request, confirm bool) {
+	req, err := s.parseGrantRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if confirm {
+		err = s.checkGrantToken(req, r.PostFormValue("token"), time.Now())
+		if err != nil {
+			code, message := grantTokenFailure(err)
+			http.Error(w, message, code)
+			return
+		}
+		_, _, err = s.commitGrant(req, s.adminActor(r))
+		if err != nil {
+			code, message := grantFailure(err)
+			http.Error(w, message, code)
+			return
+		}
+		http.Redirect(w, r, s.conf.Daemon.AdminPath + "/", 303)
+		return
+	}
+	preview, err := s.previewGrant(req, time.Now())
+	if err != nil {
+		http.Error(w, "cannot read cache database", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Frame-Options", "DENY")
+	adminGrantPage.Execute(w, adminGrantData { s.conf.Daemon.AdminPath, r.PostFormValue("address"), req.user, req.group, r.PostFormValue("duration"), preview })
+}
+
+type adminGrantData struct {
+	AdminPath	string
+	Address		string
+	User		string
+	Group		string
+	Duration	string
+	Preview		*grantPreview
+}
+
+var adminGrantPage = template.Must(template.New("grant").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Portknob admin</title>
+</head>
+<body>
+<main>
+<h1>Confirm the grant of {{.Address}}</h1>
+{{if .Preview.Entries}}<table>
+<thead><tr><th scope="col">Subnet</th><th scope="col">Group</th><th scope="col">Set</th><th scope="col">Expires</th></tr></thead>
+<tbody>
+{{range .Preview.Entries}}<tr><td>{{.Subnet}}</td><td>{{.Group}}</td><td>{{.Set}}</td><td>{{.Expires}}</td></tr>
+{{end}}</tbody>
+</table>
+<pre>{{range .Preview.Commands}}{{.}}
+{{end}}</pre>
+{{end}}{{if .Preview.Warnings}}<ul>
+{{range .Preview.Warnings}}<li>Warning: {{.}}</li>
+{{end}}</ul>
+{{end}}<form method="post" action="{{.AdminPath}}/confirm-grant">
+<input type="hidden" name="address" value="{{.Address}}">
+<input type="hidden" name="user" value="{{.User}}">
+<input type="hidden" name="group" value="{{.Group}}">
+<input type="hidden" name="duration" value="{{.Duration}}">
+<input type="hidden" name="token" value="{{.Preview.Token}}">
+<button type="submit">Grant before {{.Preview.TokenExpires}}</button>
+</form>
+<p><a href="{{.AdminPath}}/">Cancel</a></p>
+</main>
+</body>
+</html>
+`))
+
+type adminPageData struct {
+	AdminPath	string
+	Entries		[]adminEntry
+	Maintenance	maintenanceReply
+	Panic		panicReply
+	Denied		[]adminDenied
+	Travel		[]adminTravel
+	Peers		[]adminPeer
+	Commands	[]adminCommand
+	Capabilities	capabilities
+	Defense		defenseReply
+}
+
+// The 95th percentile duration of the recent firewall commands of one op and family
+type adminCommand struct {
+	Op			string
+	Family		string
+	P95			string
+}
+
+// The estimated clock of another instance sharing the cache database, Corrected once it is off by more than max-peer-clock-skew
+type adminPeer struct {
+	Peer		string
+	Skew		string
+	Seen		string
+	Corrected	bool
+}
+
+// A login held for impossible travel
+type adminTravel struct {
+	User		string
+	Client		string
+	Country		string
+	At			string
+}
+
+// Packets stopped by the deny rules of one protected destination, History being the last 24 hours
+type adminDenied struct {
+	Rule		string
+	Total		uint64
+	LastHour	uint64
+	History		string
+}
+
+var adminPage = template.Must(template.New("admin").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Portknob admin</title>
+</head>
+<body>
+<main>
+{{if .Maintenance.Maintenance}}<p role="status">Maintenance mode until {{.Maintenance.Until}}, turned on by {{.Maintenance.By}} at {{.Maintenance.Since}}{{if .Maintenance.Message}}: {{.Maintenance.Message}}{{end}}. New logins are refused.</p>
+{{end}}{{if .Defense.Enabled}}<p role="status">Defense posture {{.Defense.Posture}}{{if .Defense.Since}} since {{.Defense.Since}}{{end}}, {{.Defense.Failures}} failed logins in the last minute.</p>
+{{end}}{{if .Panic.Panic}}<form method="post" action="{{.AdminPath}}/acknowledge-panic" role="alert">Panic {{.Panic.State}} at {{.Panic.At}} by {{.Panic.By}}, {{.Panic.Revoked}} subnets revoked. <button type="submit">Acknowledge</button></form>
+{{end}}{{if .Travel}}<h1>Logins held for impossible travel</h1>
+<table>
+<thead><tr><th scope="col">User</th><th scope="col">Address</th><th scope="col">Country</th><th scope="col">Time</th><th scope="col"></th></tr></thead>
+<tbody>
+{{range .Travel}}<tr><td>{{.User}}</td><td>{{.Client}}</td><td>{{.Country}}</td><td>{{.At}}</td><td><form method="post" action="{{$.AdminPath}}/confirm-travel"><input type="hidden" name="user" value="{{.User}}"><button type="submit">Confirm</button></form> <form method="post" action="{{$.AdminPath}}/dismiss-travel"><input type="hidden" name="user" value="{{.User}}"><button type="submit">Dismiss</button></form></td></tr>
+{{end}}</tbody>
+</table>
+{{end}}<h1>Whitelist entries</h1>
+{{if .Entries}}<table>
+<thead><tr><th scope="col">Address</th><th scope="col">Subnet</th><th scope="col">User</th><th scope="col">Group</th><th scope="col">Rules</th><th scope="col">Created</th><th scope="col">Expires</th><th scope="col"></th></tr></thead>
+<tbody>
+{{range .Entries}}<tr><td>{{.Address}}</td><td>{{.Subnet}}</td><td>{{.User}}</td><td>{{.Group}}</td><td>{{range $i, $rule := .Rules}}{{if $i}}, {{end}}{{$rule}}{{end}}{{if .Action}} ({{.Action}}){{end}}</td><td>{{.Created}}</td><td>{{.Expires}}</td><td><form method="post" action="{{$.AdminPath}}/revoke"><input type="hidden" name="subnet" value="{{.Subnet}}"><button type="submit">Revoke {{.Subnet}}</button></form>{{if .Rule}} <form method="post" action="{{$.AdminPath}}/revoke"><input type="hidden" name="subnet" value="{{.Subnet}}"><input type="hidden" name="rule" value="{{.Rule}}"><button type="submit">Close only these rules for {{.Subnet}}</button></form>{{end}}</td></tr>
+{{end}}</tbody>
+</table>
+{{else}}<p>No client is whitelisted.</p>
+{{end}}{{if .Denied}}<h2>Denied packets</h2>
+<table>
+<thead><tr><th scope="col">Rule</th><th scope="col">Total</th><th scope="col">Last hour</th><th scope="col">Last 24 hours</th></tr></thead>
+<tbody>
+{{range .Denied}}<tr><td>{{.Rule}}</td><td>{{.Total}}</td><td>{{.LastHour}}</td><td>{{.History}}</td></tr>
+{{end}}</tbody>
+</table>
+{{end}}{{if .Peers}}<h2>Peer clocks</h2>
+<table>
+<thead><tr><th scope="col">Host</th><th scope="col">Skew</th><th scope="col">Last seen</th><th scope="col">Entries</th></tr></thead>
+<tbody>
+{{range .Peers}}<tr><td>{{.Peer}}</td><td>{{.Skew}}</td><td>{{.Seen}}</td><td>{{if .Corrected}}corrected{{else}}as written{{end}}</td></tr>
+{{end}}</tbody>
+</table>
+{{end}}{{if .Commands}}<h2>Firewall commands</h2>
+<table>
+<thead><tr><th scope="col">Operation</th><th scope="col">Family</th><th scope="col">95th percentile of the last 100</th></tr></thead>
+<tbody>
+{{range .Commands}}<tr><td>{{.Op}}</td><td>{{.Family}}</td><td>{{.P95}}</td></tr>
+{{end}}</tbody>
+</table>
+{{end}}<h2>Grant</h2>
+<form method="post" action="{{.AdminPath}}/preview-grant">
+<label>Address <input name="address" required></label>
+<label>User <input name="user"></label>
+<label>Group <input name="group"></label>
+<label>Duration in seconds <input name="duration" inputmode="numeric" placeholder="like a login"></label>
+<button type="submit">Preview</button>
+</form>
+<h2>About</h2>
+<pre>{{.Capabilities}}</pre>
+</main>
+</body>
+</html>
+`))
+
+// Check that a request comes from a page of this server, by its Origin or, from older browsers, its Referer
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(origin)
+	return err == nil && origin != "" && u.Host == r.Host
+}
+
+func (s *server) subnetPrefix(ip net.IP) uint {
+	ones, _ := s.fw.Subnet(ip).Mask.Size()
+	return uint(ones)
+}
+
+func (s *server) writeJSON(w http.ResponseWriter, code int, v interface {}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,203 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logins, whitelist changes and firewall command failures, one line per event for SIEMs and fail2ban
+// A nil auditLog discards everything
+type auditLog struct {
+	mutex		sync.Mutex
+	path		string
+	format		string
+	out			io.WriteCloser
+	// With audit-hash-chain, the sequence number and hex SHA-256 of the last line written
+	chain		bool
+	seq			uint64
+	prev		string
+	// Signs checkpoints at most every checkpointInterval, nil for none
+	key				ed25519.PrivateKey
+	checkpointInterval	time.Duration
+	lastCheckpoint	time.Time
+}
+
+func newAuditLog(conf *config) (*auditLog, error) {
+	if conf.Daemon.AuditLog == "" {
+		return nil, nil
+	}
+	a := &auditLog {
+		path:			conf.Daemon.AuditLog,
+		format:			conf.Daemon.LogFormat,
+		chain:			conf.Daemon.AuditHashChain,
+		key:			conf.Daemon.auditKey,
+		checkpointInterval:	time.Duration(conf.Daemon.AuditCheckpointInterval) * time.Second,
+		lastCheckpoint:	time.Now(),
+	}
+	if a.chain && a.path != "syslog" {
+		a.seq, a.prev = resumeAuditChain(a.path)
+	}
+	err := a.Reopen()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Open the file again after it was rotated
+// With audit-hash-chain, the old file ends with a checkpoint and the new one starts with a "chain-start" line carrying on its chain
+func (a *auditLog) Reopen() error {
+	if a == nil {
+		return nil
+	}
+	var out io.WriteCloser
+	var err error
+	if a.path == "syslog" {
+		out, err = syslog.New(syslog.LOG_AUTHPRIV | syslog.LOG_INFO, "portknob")
+	} else {
+		out, err = os.OpenFile(a.path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.out != nil {
+		if a.chain && a.key != nil {
+			a.checkpoint()
+		}
+		a.out.Close()
+	}
+	a.out = out
+	if a.chain {
+		a.write("chain-start")
+	}
+	return nil
+}
+
+// Record event with fields given as key, value pairs
+func (a *auditLog) Event(event string, keyvals ...interface{}) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.write(event, keyvals...)
+	if a.chain && a.key != nil && time.Since(a.lastCheckpoint) >= a.checkpointInterval {
+		a.checkpoint()
+	}
+}
+
+// Write one line, a.mutex being held
+// A line which cannot be written still advances the chain, so the gap shows
+func (a *auditLog) write(event string, keyvals ...interface{}) {
+	var line bytes.Buffer
+	if a.format == "json" {
+		line.WriteString("{")
+	}
+	a.writeField(&line, "time", time.Now().UTC().Format(time.RFC3339Nano), true)
+	a.writeField(&line, "event", event, false)
+	for i := 0; i + 1 < len(keyvals); i += 2 {
+		a.writeField(&line, fmt.Sprint(keyvals[i]), keyvals[i + 1], false)
+	}
+	if a.chain {
+		a.seq++
+		a.writeField(&line, "seq", a.seq, false)
+		a.writeField(&line, "prev", a.prev, false)
+	}
+	if a.format == "json" {
+		line.WriteString("}")
+	}
+	if a.chain {
+		a.prev = auditLineHash(line.Bytes())
+	}
+	line.WriteString("\n")
+
+	_, err := a.out.Write(line.Bytes())
+	if err != nil {
+		log.Printf("Cannot write audit log %q: %s\n", a.path, err)
+	}
+}
+
+// Sign the chain up to the next line and write it as a checkpoint, a.mutex being held
+func (a *auditLog) checkpoint() {
+	signature := ed25519.Sign(a.key, auditCheckpointMessage(a.seq + 1, a.prev))
+	a.write("checkpoint", "signature", base64.StdEncoding.EncodeToString(signature))
+	a.lastCheckpoint = time.Now()
+}
+
+// Turn the field values of an event into strings and numbers
+func eventValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case net.IP:
+		return v.String()
+	case *net.IPNet:
+		return v.String()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	case time.Duration:
+		return int64(v / time.Second)
+	case error:
+		return v.Error()
+	}
+	return value
+}
+
+func (a *auditLog) writeField(line *bytes.Buffer, key string, value interface{}, first bool) {
+	value = eventValue(value)
+	if a.format == "json" {
+		if !first {
+			line.WriteString(",")
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		line.Write(k)
+		line.WriteString(":")
+		line.Write(v)
+		return
+	}
+	if !first {
+		line.WriteString(" ")
+	}
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=\\") || !strconv.CanBackquote(s) {
+		s = strconv.Quote(s)
+	}
+	line.WriteString(key)
+	line.WriteString("=")
+	line.WriteString(s)
+}
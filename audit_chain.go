@@ -0,0 +1,305 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// With audit-hash-chain, each audit line ends with seq, one more than the line before, and prev, the hex SHA-256 of the line before without its newline
+// Each file opened starts with a "chain-start" line, whose prev links it to the end of the file before it
+// Checkpoint lines sign their own seq and prev with audit-signing-key, so removing the lines after one would have to stop at the next one
+
+// Longest audit line looked for at the end of a file
+const maxAuditLine = 64 * 1024
+
+var errAuditUsage = errors.New(`Usage:
+  portknob audit verify [-public-key FILE] <file>...
+Files are checked oldest first, the key defaults to the one of audit-signing-key`)
+
+func auditLineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+func auditCheckpointMessage(seq uint64, prev string) []byte {
+	return []byte("portknob-audit-checkpoint " + strconv.FormatUint(seq, 10) + " " + prev)
+}
+
+// Return where the chain of the audit log at path stopped, from its last line or, after a rotation, that of path.1
+// A log which has none starts a new chain
+func resumeAuditChain(path string) (seq uint64, prev string) {
+	for _, name := range []string {path, path + ".1"} {
+		line := lastAuditLine(name)
+		if line == nil {
+			continue
+		}
+		fields, err := parseAuditLine(line)
+		if err != nil {
+			return 0, ""
+		}
+		seq, err = strconv.ParseUint(fields["seq"], 10, 64)
+		if err != nil {
+			// Written without audit-hash-chain
+			return 0, ""
+		}
+		return seq, auditLineHash(line)
+	}
+	return 0, ""
+}
+
+// Return the last line of the file at path without its newline, nil if there is none
+func lastAuditLine(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return nil
+	}
+	size := info.Size()
+	if size > maxAuditLine {
+		size = maxAuditLine
+	}
+	buf := make([]byte, size)
+	_, err = f.ReadAt(buf, info.Size() - size)
+	if err != nil && err != io.EOF {
+		return nil
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	i := bytes.LastIndexByte(buf, '\n')
+	if i < 0 && size < info.Size() {
+		return nil
+	}
+	return buf[i + 1:]
+}
+
+// Return the fields of a JSON or key=value audit line as strings
+func parseAuditLine(line []byte) (map[string]string, error) {
+	fields := make(map[string]string)
+	if bytes.HasPrefix(line, []byte("{")) {
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+		var values map[string]interface{}
+		err := decoder.Decode(&values)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range values {
+			fields[k] = fmt.Sprint(v)
+		}
+		return fields, nil
+	}
+	s := string(line)
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("expected key=value at %q", s)
+		}
+		key := s[:eq]
+		s = s[eq + 1:]
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			quoted, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			value, _ = strconv.Unquote(quoted)
+			s = s[len(quoted):]
+		} else {
+			end := strings.IndexByte(s, ' ')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+		fields[key] = value
+		s = strings.TrimPrefix(s, " ")
+	}
+	return fields, nil
+}
+
+type auditVerifyReport struct {
+	lines		int
+	checkpoints	int
+	// Lines after the last checkpoint, which could be cut off unnoticed
+	unsigned	int
+	// The first line carries on the chain of a file which was not checked
+	continued	bool
+}
+
+// Check the chain of audit log files, oldest first, and the signatures of their checkpoints unless key is nil
+// The error names the first line which breaks the chain
+func verifyAuditLog(paths []string, key ed25519.PublicKey) (report auditVerifyReport, err error) {
+	var seq uint64
+	var prev, prevLine string
+	for _, path := range paths {
+		err = verifyAuditFile(path, key, &report, &seq, &prev, &prevLine)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func verifyAuditFile(path string, key ed25519.PublicKey, report *auditVerifyReport, seq *uint64, prev, prevLine *string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, maxAuditLine), 16 * maxAuditLine)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		where := fmt.Sprintf("%s:%d", path, n)
+		fields, err := parseAuditLine(line)
+		if err != nil {
+			return fmt.Errorf("%s: cannot parse line: %s", where, err)
+		}
+		lineSeq, err := strconv.ParseUint(fields["seq"], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: no sequence number, the line was not written with audit-hash-chain", where)
+		}
+		if report.lines == 0 {
+			report.continued = fields["prev"] != ""
+		} else if fields["prev"] == "" && fields["event"] == "chain-start" {
+			return fmt.Errorf("%s: a new chain starts, the log before it was missing when portknob started", where)
+		} else if lineSeq != *seq + 1 {
+			return fmt.Errorf("%s: sequence number %d after %d, lines are missing or out of order", where, lineSeq, *seq)
+		} else if fields["prev"] != *prev {
+			return fmt.Errorf("%s: hash of the line before does not match, %s was changed", where, *prevLine)
+		}
+		if fields["event"] == "checkpoint" && key != nil {
+			signature, err := base64.StdEncoding.DecodeString(fields["signature"])
+			if err != nil || !ed25519.Verify(key, auditCheckpointMessage(lineSeq, fields["prev"]), signature) {
+				return fmt.Errorf("%s: checkpoint signature does not verify", where)
+			}
+			report.checkpoints++
+			report.unsigned = -1
+		}
+		*seq, *prev, *prevLine = lineSeq, auditLineHash(line), where
+		report.lines++
+		report.unsigned++
+	}
+	return scanner.Err()
+}
+
+// Read the private key of audit-signing-key, a PKCS #8 PEM file
+func readAuditKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := key.(ed25519.PrivateKey); ok {
+		return key, nil
+	}
+	return nil, errors.New("not an Ed25519 key")
+}
+
+// Read a PEM public key, or the public half of a private key file
+func readAuditPublicKey(path string) (ed25519.PublicKey, error) {
+	if private, err := readAuditKey(path); err == nil {
+		return private.Public().(ed25519.PublicKey), nil
+	}
+	block, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := key.(ed25519.PublicKey); ok {
+		return key, nil
+	}
+	return nil, errors.New("not an Ed25519 key")
+}
+
+func readPEM(path, blockType string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("no %s PEM block", blockType)
+	}
+	return block, nil
+}
+
+// Run "portknob audit verify", taking the key from the configuration at confPath without -public-key
+func runAuditCommand(confPath string, args []string) error {
+	if len(args) < 2 || args[1] != "verify" {
+		return errAuditUsage
+	}
+	flags := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	publicKey := flags.String("public-key", "", "PEM Ed25519 key checking the checkpoints")
+	err := flags.Parse(args[2:])
+	if err != nil || flags.NArg() == 0 {
+		return errAuditUsage
+	}
+	var key ed25519.PublicKey
+	if *publicKey != "" {
+		key, err = readAuditPublicKey(*publicKey)
+		if err != nil {
+			return fmt.Errorf("cannot read %q: %s", *publicKey, err)
+		}
+	} else if conf, err := loadConfig(confPath); err == nil && conf.Daemon.auditKey != nil {
+		key = conf.Daemon.auditKey.Public().(ed25519.PublicKey)
+	}
+	report, err := verifyAuditLog(flags.Args(), key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d lines, the chain is intact\n", report.lines)
+	if report.continued {
+		fmt.Println("The first line carries on from an older file, give it first to check the link")
+	}
+	switch {
+	case key == nil:
+		fmt.Println("Checkpoint signatures not checked, no key given")
+	case report.checkpoints == 0:
+		fmt.Println("No checkpoint, lines could have been cut off the end unnoticed")
+	default:
+		fmt.Printf("%d checkpoints verified, %d lines after the last one\n", report.checkpoints, report.unsigned)
+	}
+	return nil
+}
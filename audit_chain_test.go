@@ -0,0 +1,280 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestAuditLog(t testing.TB, path, format string, key ed25519.PrivateKey) *auditLog {
+	conf := &config {
+		Daemon: configDaemon {
+			AuditLog:		path,
+			LogFormat:		format,
+			AuditHashChain:	true,
+			auditKey:		key,
+			AuditCheckpointInterval:	3600,
+		},
+	}
+	a, err := newAuditLog(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func writeTestAuditEvents(a *auditLog) {
+	a.Event("login", "result", "success", "user", "user1", "client", "203.0.113.7")
+	a.Event("whitelist-add", "subnet", "203.0.113.0/24", "by", "user1")
+	a.Event("ban", "client", "198.51.100.9", "reason", "too many failures")
+	a.Event("whitelist-expire", "subnet", "203.0.113.0/24")
+}
+
+func readTestAuditLines(t *testing.T, path string) [][]byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.SplitAfter(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+}
+
+func writeTestAuditLines(t *testing.T, path string, lines [][]byte) {
+	err := os.WriteFile(path, bytes.Join(lines, nil), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string {"json", "text"} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "audit.log")
+		a := newTestAuditLog(t, path, format, key)
+		writeTestAuditEvents(a)
+		a.mutex.Lock()
+		a.checkpoint()
+		a.mutex.Unlock()
+		a.Event("login", "result", "failure", "user", "user2", "client", "192.0.2.1")
+		a.out.Close()
+		lines := readTestAuditLines(t, path)
+		if len(lines) != 7 {
+			t.Fatalf("%s: %d lines, want 7:\n%s", format, len(lines), bytes.Join(lines, nil))
+		}
+
+		tests := []struct {
+			name	string
+			edit	func([][]byte) [][]byte
+			key		ed25519.PublicKey
+			err		string
+		} {
+			{"intact", nil, public, ""},
+			{"no key", nil, nil, ""},
+			{"edited", func(l [][]byte) [][]byte {
+				l[2] = bytes.Replace(l[2], []byte("user1"), []byte("user9"), 1)
+				return l
+			}, public, "edited:4: hash of the line before does not match, " + filepath.Join(dir, "edited") + ":3 was changed"},
+			{"deleted", func(l [][]byte) [][]byte {
+				return append(l[:3:3], l[4:]...)
+			}, public, ":4: sequence number 5 after 3"},
+			{"reordered", func(l [][]byte) [][]byte {
+				l[1], l[2] = l[2], l[1]
+				return l
+			}, public, ":2: sequence number 3 after 1"},
+			{"wrong key", nil, otherPublic, ":6: checkpoint signature does not verify"},
+			{"forged checkpoint", func(l [][]byte) [][]byte {
+				l[4] = bytes.Replace(l[4], []byte("user1"), []byte("user9"), 1)
+				l[5] = bytes.Replace(l[5], []byte("prev"), []byte("prev-old"), 1)
+				return l
+			}, public, ":6: hash of the line before does not match"},
+		}
+		for _, test := range tests {
+			t.Run(format + "/" + test.name, func(t *testing.T) {
+				checked := filepath.Join(dir, test.name)
+				edited := append([][]byte(nil), lines...)
+				for i := range edited {
+					edited[i] = append([]byte(nil), edited[i]...)
+				}
+				if test.edit != nil {
+					edited = test.edit(edited)
+				}
+				writeTestAuditLines(t, checked, edited)
+				report, err := verifyAuditLog([]string {checked}, test.key)
+				if test.err == "" {
+					if err != nil {
+						t.Fatal(err)
+					}
+					if report.lines != 7 || report.continued {
+						t.Errorf("report %+v, want 7 lines starting a chain", report)
+					}
+					if test.key != nil && (report.checkpoints != 1 || report.unsigned != 1) {
+						t.Errorf("report %+v, want 1 checkpoint and 1 line after it", report)
+					}
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+			})
+		}
+	}
+}
+
+func TestAuditChainRotation(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	a := newTestAuditLog(t, path, "json", key)
+	writeTestAuditEvents(a)
+
+	// As logrotate with a postrotate sending SIGHUP
+	err = os.Rename(path, path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Event("login", "result", "success", "user", "user2", "client", "192.0.2.1")
+	a.out.Close()
+
+	// A restart carries on from the last line
+	a = newTestAuditLog(t, path, "json", key)
+	a.Event("login", "result", "success", "user", "user3", "client", "192.0.2.2")
+	a.out.Close()
+
+	// The rotated file ends on a checkpoint, then chain-start, login, chain-start, login
+	report, err := verifyAuditLog([]string {path + ".1", path}, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.lines != 10 || report.checkpoints != 1 || report.unsigned != 4 || report.continued {
+		t.Errorf("report %+v, want 10 lines, 1 checkpoint, 4 lines after it", report)
+	}
+	report, err = verifyAuditLog([]string {path}, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.continued {
+		t.Errorf("report %+v, want the chain carried on from an older file", report)
+	}
+
+	// A line cut off the end of the rotated file breaks the link
+	lines := readTestAuditLines(t, path + ".1")
+	writeTestAuditLines(t, path + ".1", lines[:len(lines) - 1])
+	_, err = verifyAuditLog([]string {path + ".1", path}, public)
+	if err == nil || !strings.Contains(err.Error(), path + ":1: sequence number") {
+		t.Errorf("got error %v, want a gap at the start of %s", err, path)
+	}
+
+	// With the rotated file gone at startup, a new chain starts
+	os.Remove(path + ".1")
+	os.Remove(path)
+	a = newTestAuditLog(t, path, "json", key)
+	a.out.Close()
+	report, err = verifyAuditLog([]string {path}, public)
+	if err != nil || report.lines != 1 || report.continued {
+		t.Errorf("got report %+v and error %v, want a new chain", report, err)
+	}
+}
+
+func TestReadAuditKey(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePath := filepath.Join(dir, "audit.key")
+	os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block { Type: "PRIVATE KEY", Bytes: der }), 0600)
+	der, err = x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPath := filepath.Join(dir, "audit.pub")
+	os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block { Type: "PUBLIC KEY", Bytes: der }), 0644)
+
+	read, err := readAuditKey(privatePath)
+	if err != nil || !read.Equal(key) {
+		t.Errorf("readAuditKey: got error %v", err)
+	}
+	for _, path := range []string {privatePath, publicPath} {
+		read, err := readAuditPublicKey(path)
+		if err != nil || !read.Equal(public) {
+			t.Errorf("readAuditPublicKey(%q): got error %v", path, err)
+		}
+	}
+	_, err = readAuditKey(publicPath)
+	if err == nil {
+		t.Error("readAuditKey read a public key")
+	}
+}
+
+func BenchmarkAuditEvent(b *testing.B) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, bench := range []struct {
+		name	string
+		chain	bool
+	} {
+		{"plain", false},
+		{"hash-chain", true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			a := newTestAuditLog(b, filepath.Join(b.TempDir(), "audit.log"), "json", key)
+			a.chain = bench.chain
+			defer a.out.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				a.Event("login", "result", "success", "user", "user1", "client", "203.0.113.7")
+			}
+		})
+	}
+}
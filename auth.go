@@ -0,0 +1,277 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// A source of users logging in with a password
+type authProvider interface {
+	// Check the password of user, groups are the rule groups to open besides rules without a group
+	// err is set when the provider cannot tell, the login is then neither accepted nor counted as a failure
+	Authenticate(user, password string) (groups []string, ok bool, err error)
+	// Check that user may still log in, for a login cookie which carries no password
+	Lookup(user string) (groups []string, ok bool, err error)
+}
+
+// Find the provider of user, nil if none knows the user
+// Users in [secrets] are never looked up anywhere else, names of single sign-on users cannot log in with a password
+func (conf *config) authProvider(user string) authProvider {
+	if user == "" || strings.HasPrefix(user, oidcUserPrefix) {
+		return nil
+	}
+	if _, ok := conf.Secrets[user]; ok {
+		return secretsAuth { conf }
+	}
+	if conf.Auth.LDAP != nil {
+		return conf.Auth.LDAP
+	}
+	return nil
+}
+
+type configAuth struct {
+	// Users of an LDAP directory, checked by binding as them
+	LDAP		*configLDAP	`toml:"ldap"`
+
+	// An OpenID Connect provider, signing in there whitelists the client
+	OIDC		*configOIDC	`toml:"oidc"`
+}
+
+func (auth *configAuth) parse(conf *config) error {
+	if auth.LDAP != nil {
+		err := auth.LDAP.parse(conf)
+		if err != nil {
+			return err
+		}
+	}
+	if auth.OIDC != nil {
+		err := auth.OIDC.parse(conf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Path serving the OpenID Connect sign in, "" without one
+func (auth *configAuth) oidcPath() string {
+	if auth.OIDC == nil {
+		return ""
+	}
+	return auth.OIDC.redirectPath
+}
+
+// The default provider, users and passwords from [secrets]
+// Its login cookies carry the password, so changing it in the configuration logs out the user
+type secretsAuth struct {
+	conf		*config
+}
+
+func (p secretsAuth) Authenticate(user, password string) ([]string, bool, error) {
+	secret, ok := p.conf.Secrets[user]
+	if !ok || !checkSecret(secret, password) {
+		return nil, false, nil
+	}
+	return p.conf.SecretsGroups[user], true, nil
+}
+
+func (p secretsAuth) Lookup(user string) ([]string, bool, error) {
+	if _, ok := p.conf.Secrets[user]; !ok {
+		return nil, false, nil
+	}
+	return p.conf.SecretsGroups[user], true, nil
+}
+
+type configLDAP struct {
+	// URL of the directory server, "ldap://host" or "ldaps://host"
+	// This is a mandatory option
+	Server			string		`toml:"server"`
+
+	// Upgrade an "ldap://" connection with StartTLS
+	// Default: false
+	StartTLS		bool		`toml:"start-tls"`
+
+	// PEM file of the certificate authorities to verify the server with
+	// Default: "" (the system's certificate authorities)
+	CAFile			string		`toml:"ca-file"`
+
+	// DN and password to search the directory with
+	// Default: "" (search anonymously)
+	BindDN			string		`toml:"bind-dn"`
+	BindPassword	string		`toml:"bind-password"`
+
+	// Where to search for users
+	// This is a mandatory option
+	BaseDN			string		`toml:"base-dn"`
+
+	// Filter finding the entry of a user, "%s" is replaced by the escaped username
+	// Default: "(uid=%s)"
+	UserFilter		string		`toml:"user-filter"`
+
+	// Rule groups opened for users of the directory, in addition to rules without a group
+	// Default: []
+	Groups			[]string	`toml:"groups"`
+
+	// Seconds to wait for the directory server
+	// Default: 10
+	Timeout			uint64		`toml:"timeout"`
+
+	tlsConfig		*tls.Config
+}
+
+func (l *configLDAP) parse(conf *config) error {
+	if l.Server == "" {
+		return &configError { "option \"server\" not specified in [auth.ldap]\n" }
+	}
+	serverURL, err := url.Parse(l.Server)
+	if err != nil || (serverURL.Scheme != "ldap" && serverURL.Scheme != "ldaps") || serverURL.Hostname() == "" {
+		return conf.reportConfigError("server", l.Server)
+	}
+	if l.StartTLS && serverURL.Scheme == "ldaps" {
+		return &configError { "option \"start-tls\" cannot be combined with an \"ldaps://\" server\n" }
+	}
+	if l.BaseDN == "" {
+		return &configError { "option \"base-dn\" not specified in [auth.ldap]\n" }
+	}
+	if l.UserFilter == "" {
+		l.UserFilter = "(uid=%s)"
+	}
+	if !strings.Contains(l.UserFilter, "%s") {
+		return conf.reportConfigError("user-filter", l.UserFilter)
+	}
+	if l.BindDN == "" && l.BindPassword != "" {
+		return &configError { "option \"bind-password\" requires \"bind-dn\"\n" }
+	}
+	if l.Timeout == 0 {
+		l.Timeout = 10
+	}
+	l.tlsConfig = &tls.Config { ServerName: serverURL.Hostname(), MinVersion: tls.VersionTLS12 }
+	if l.CAFile != "" {
+		pem, err := ioutil.ReadFile(l.CAFile)
+		if err != nil {
+			return err
+		}
+		l.tlsConfig.RootCAs = x509.NewCertPool()
+		if !l.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return &configError { fmt.Sprintf("no certificates found in %q\n", l.CAFile) }
+		}
+	}
+	for _, group := range l.Groups {
+		err = conf.checkGroupName(group)
+		if err != nil {
+			return err
+		}
+		if !conf.hasGroup(group) {
+			log.Printf("Warning: [auth.ldap] has group %q, but no firewall rule uses it\n", group)
+		}
+	}
+	return nil
+}
+
+// Connect to the directory server, bound as bind-dn if set
+func (l *configLDAP) connect() (*ldap.Conn, error) {
+	timeout := time.Duration(l.Timeout) * time.Second
+	conn, err := ldap.DialURL(l.Server, ldap.DialWithDialer(&net.Dialer { Timeout: timeout }), ldap.DialWithTLSConfig(l.tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("LDAP: %s", err)
+	}
+	conn.SetTimeout(timeout)
+	if l.StartTLS {
+		err = conn.StartTLS(l.tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP: %s", err)
+		}
+	}
+	if l.BindDN != "" {
+		err = conn.Bind(l.BindDN, l.BindPassword)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP: cannot bind as %q: %s", l.BindDN, err)
+		}
+	}
+	return conn, nil
+}
+
+// Return the DN of the only entry of user, "" if there is none or more than one
+func (l *configLDAP) search(conn *ldap.Conn, user string) (string, error) {
+	filter := strings.ReplaceAll(l.UserFilter, "%s", ldap.EscapeFilter(user))
+	result, err := conn.Search(ldap.NewSearchRequest(l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(l.Timeout), false, filter, []string { "dn" }, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return "", fmt.Errorf("LDAP: cannot search %q: %s", filter, err)
+	}
+	if len(result.Entries) != 1 {
+		if len(result.Entries) > 1 {
+			log.Printf("LDAP: %q matches more than one entry, refusing to log in user %q\n", filter, user)
+		}
+		return "", nil
+	}
+	return result.Entries[0].DN, nil
+}
+
+// Search the entry of user, then bind as it with password
+func (l *configLDAP) Authenticate(user, password string) ([]string, bool, error) {
+	if password == "" {
+		// An empty password would be an unauthenticated bind, which servers accept
+		return nil, false, nil
+	}
+	conn, err := l.connect()
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	dn, err := l.search(conn, user)
+	if err != nil || dn == "" {
+		return nil, false, err
+	}
+
+	err = conn.Bind(dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("LDAP: cannot bind as %q: %s", dn, err)
+	}
+	return l.Groups, true, nil
+}
+
+// Search the entry of user, so users removed from the directory or no longer matching user-filter lose access at their next visit
+func (l *configLDAP) Lookup(user string) ([]string, bool, error) {
+	conn, err := l.connect()
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	dn, err := l.search(conn, user)
+	if err != nil || dn == "" {
+		return nil, false, err
+	}
+	return l.Groups, true, nil
+}
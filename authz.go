@@ -0,0 +1,301 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// With [authz], an external service decides which rules each login opens, portknob only authenticates and enforces
+// The rules a login would open are POSTed to url, the reply names those allowed, their lifespans and why the others were denied
+// A rule shares its whitelist set with the other rules of its group, so a group only opens when all of its rules are allowed
+type configAuthz struct {
+	// URL to POST the rules of each login to
+	// This is a mandatory option
+	URL			string		`toml:"url"`
+
+	// Seconds to wait for the authorizer
+	// Default: 5
+	Timeout		uint64		`toml:"timeout"`
+
+	// Seconds a verdict on a rule for a user is cached, logins within it do not ask the authorizer again
+	// Default: 300
+	CacheTTL	uint64		`toml:"cache-ttl"`
+
+	// Shared secret signing requests and replies with HMAC-SHA256, in the X-Portknob-Signature header
+	// This is a mandatory option
+	SigningKey	string		`toml:"signing-key"`
+}
+
+func (a *configAuthz) parse(conf *config) error {
+	if a.URL == "" {
+		return &configError { "[authz] requires \"url\"\n" }
+	}
+	authzURL, err := url.Parse(a.URL)
+	if err != nil || (authzURL.Scheme != "http" && authzURL.Scheme != "https") || authzURL.Host == "" {
+		return conf.reportConfigError("url", a.URL)
+	}
+	if a.SigningKey == "" {
+		return &configError { "[authz] requires \"signing-key\"\n" }
+	}
+	if a.Timeout == 0 {
+		a.Timeout = 5
+	}
+	if a.CacheTTL == 0 {
+		a.CacheTTL = 300
+	}
+	return nil
+}
+
+const authzSignatureHeader = "X-Portknob-Signature"
+
+// Replies larger than this are refused
+const authzMaxReply = 1 << 20
+
+var errAuthzDenied = errors.New("the authorizer allowed none of the rules of the login")
+var errAuthzUnavailable = errors.New("cannot reach the authorizer, and authz-fail-mode keeps the rules of the login closed")
+
+type authzRequest struct {
+	Username	string		`json:"username"`
+	Subnet		string		`json:"subnet"`
+	Client		string		`json:"client"`
+	Rules		[]authzRule	`json:"rules"`
+	// Echoed in the reply, so a signed reply cannot be replayed for another login
+	Nonce		string		`json:"nonce"`
+}
+
+type authzRule struct {
+	// As on the success page, "#2 ssh" or "#2 port 22"
+	Name		string		`json:"name"`
+	Proto		string		`json:"proto,omitempty"`
+	DestPort	string		`json:"dport"`
+	Group		string		`json:"group,omitempty"`
+}
+
+type authzReply struct {
+	Nonce		string		`json:"nonce"`
+	// Names of the rules which may open, any other is denied
+	Allowed		[]string	`json:"allowed"`
+	// Lifespans in seconds of allowed rules, replacing theirs
+	Lifespans	map[string]uint64	`json:"lifespans"`
+	// Reasons by name of the denied rules
+	Denied		map[string]string	`json:"denied"`
+}
+
+// What a login may open after asking the authorizer
+type authzDecision struct {
+	// The groups left closed, those of require-totp rules included
+	skip		[]string
+	// Lifespans by group set by the authorizer
+	lifespans	map[string]time.Duration
+	// Why rules were not opened, for the success page
+	notes		[]string
+}
+
+func authzSignature(key string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Decide which groups of a login by user opens, the groups in skip already stay closed
+// Rules with a fresh cached verdict are not asked about, those the authorizer cannot decide on follow authz-fail-mode
+// errAuthzDenied or errAuthzUnavailable when no group is left to open
+func (s *server) authorize(user string, clientIP net.IP, groups, skip []string, now time.Time) (*authzDecision, error) {
+	decision := &authzDecision { skip: skip }
+	if s.conf.Authz == nil {
+		return decision, nil
+	}
+	opened := s.conf.expandGroups(append([]string {""}, groups...))
+	var rules []int
+	for i, rule := range s.conf.Firewall {
+		if containsString(opened, rule.Group) && !containsString(skip, rule.Group) {
+			rules = append(rules, i)
+		}
+	}
+	if len(rules) == 0 {
+		return decision, nil
+	}
+
+	keys := make([]string, len(rules))
+	for n, i := range rules {
+		keys[n] = s.conf.Firewall[i].key()
+	}
+	verdicts := s.fw.cache.AuthzVerdicts(user, keys, now)
+	var ask []int
+	for _, i := range rules {
+		if _, ok := verdicts[s.conf.Firewall[i].key()]; !ok {
+			ask = append(ask, i)
+		}
+	}
+	unavailable := false
+	if len(ask) != 0 {
+		replied, err := s.askAuthorizer(user, clientIP, ask)
+		if err != nil {
+			log.Printf("Authz: cannot ask about the login of user %q from %s: %s\n", user, clientIP, err)
+			s.fw.audit.Event("authz", "result", "unavailable", "user", user, "client", clientIP, "subnet", s.fw.Subnet(clientIP), "error", err.Error())
+			unavailable = true
+			for _, i := range ask {
+				verdicts[s.conf.Firewall[i].key()] = authzVerdict {
+					allowed:	s.conf.Daemon.AuthzFailMode == "open",
+					reason:		"the authorization service is unavailable",
+				}
+			}
+		} else {
+			err := s.fw.cache.SetAuthzVerdicts(user, replied, now.Add(time.Duration(s.conf.Authz.CacheTTL) * time.Second))
+			if err != nil {
+				log.Println(err)
+			}
+			for key, verdict := range replied {
+				verdicts[key] = verdict
+			}
+		}
+	}
+
+	var allowed, denied, closed []string
+	decision.skip = append([]string(nil), skip...)
+	for _, i := range rules {
+		if !verdicts[s.conf.Firewall[i].key()].allowed && !containsString(decision.skip, s.conf.Firewall[i].Group) {
+			decision.skip = append(decision.skip, s.conf.Firewall[i].Group)
+		}
+	}
+	for _, i := range rules {
+		rule := s.conf.Firewall[i]
+		verdict := verdicts[rule.key()]
+		switch {
+		case !verdict.allowed:
+			denied = append(denied, s.conf.ruleName(i))
+			note := fmt.Sprintf("Rule %s was denied, it was not opened", s.conf.ruleName(i))
+			if verdict.reason != "" {
+				note = fmt.Sprintf("Rule %s was denied: %s", s.conf.ruleName(i), verdict.reason)
+			}
+			decision.notes = append(decision.notes, note)
+		case containsString(decision.skip, rule.Group):
+			closed = append(closed, s.conf.ruleName(i))
+			decision.notes = append(decision.notes, fmt.Sprintf("Rule %s shares its whitelist with a denied rule, it was not opened", s.conf.ruleName(i)))
+		default:
+			allowed = append(allowed, s.conf.ruleName(i))
+			if verdict.lifespan == 0 {
+				continue
+			}
+			if decision.lifespans == nil {
+				decision.lifespans = make(map[string]time.Duration)
+			}
+			// The shortest lifespan of the rules of a group
+			lifespan := time.Duration(verdict.lifespan) * time.Second
+			if prev, ok := decision.lifespans[rule.Group]; !ok || lifespan < prev {
+				decision.lifespans[rule.Group] = lifespan
+			}
+		}
+	}
+	s.fw.audit.Event("authz", "result", "decided", "user", user, "client", clientIP, "subnet", s.fw.Subnet(clientIP), "allowed", allowed, "denied", denied, "closed", closed, "cached", len(rules) - len(ask))
+	if len(allowed) == 0 {
+		if unavailable && s.conf.Daemon.AuthzFailMode != "open" {
+			return decision, errAuthzUnavailable
+		}
+		return decision, errAuthzDenied
+	}
+	return decision, nil
+}
+
+// POST the rules to the authorizer, returning its verdicts by rule key
+func (s *server) askAuthorizer(user string, clientIP net.IP, rules []int) (map[string]authzVerdict, error) {
+	request := authzRequest {
+		Username:	user,
+		Subnet:		s.fw.Subnet(clientIP).String(),
+		Client:		clientIP.String(),
+		Nonce:		randomToken(),
+	}
+	for _, i := range rules {
+		rule := s.conf.Firewall[i]
+		request.Rules = append(request.Rules, authzRule {
+			Name:		s.conf.ruleName(i),
+			Proto:		rule.Proto,
+			DestPort:	rule.DestPort,
+			Group:		rule.Group,
+		})
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", s.conf.Authz.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(authzSignatureHeader, authzSignature(s.conf.Authz.SigningKey, body))
+	client := &http.Client {
+		Timeout:	time.Duration(s.conf.Authz.Timeout) * time.Second,
+		// A redirected POST would lose its body
+		CheckRedirect:	func (*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("the authorizer replied %s", resp.Status)
+	}
+	replyBody, err := io.ReadAll(io.LimitReader(resp.Body, authzMaxReply + 1))
+	if err != nil {
+		return nil, err
+	}
+	if len(replyBody) > authzMaxReply {
+		return nil, errors.New("the reply of the authorizer is too large")
+	}
+	if !hmac.Equal([]byte(strings.ToLower(resp.Header.Get(authzSignatureHeader))), []byte(authzSignature(s.conf.Authz.SigningKey, replyBody))) {
+		return nil, errors.New("the reply of the authorizer has no valid signature")
+	}
+	var reply authzReply
+	err = json.Unmarshal(replyBody, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the reply of the authorizer: %s", err)
+	}
+	if reply.Nonce != request.Nonce {
+		return nil, errors.New("the reply of the authorizer is for another request")
+	}
+
+	verdicts := make(map[string]authzVerdict)
+	for _, i := range rules {
+		name := s.conf.ruleName(i)
+		verdict := authzVerdict { reason: reply.Denied[name] }
+		if _, denied := reply.Denied[name]; !denied && containsString(reply.Allowed, name) {
+			verdict = authzVerdict { allowed: true, lifespan: reply.Lifespans[name] }
+		}
+		verdicts[s.conf.Firewall[i].key()] = verdict
+	}
+	return verdicts, nil
+}
+
@@ -0,0 +1,216 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const authzTestConfig = `firewall-lifespan = 3600
+[[firewall]]
+comment = "ssh"
+dport = "22"
+[[firewall]]
+comment = "db"
+dport = "5432"
+group = "ops"
+[[firewall]]
+comment = "metrics"
+dport = "9100"
+group = "ops"
+[[secrets]]
+username = "alice"
+password = "hunter2"
+groups = ["ops"]
+`
+
+func TestAuthz(t *testing.T) {
+	allowAll := authzReply { Allowed: []string {"#1 ssh", "#2 db", "#3 metrics"} }
+	tests := []struct {
+		name		string
+		failMode	string
+		reply		authzReply
+		// Sign replies with another key, or answer after the timeout
+		badSignature	bool
+		slow		bool
+		wantCode	int
+		// Groups whitelisted, "" for the rules without one
+		wantOpen	[]string
+		wantBody	[]string
+		wantSSHTimeout	time.Duration
+	}{
+		{ "allow", "closed", authzReply { Allowed: allowAll.Allowed, Lifespans: map[string]uint64 {"#1 ssh": 600} }, false, false, 200, []string {"", "ops"}, nil, 600 * time.Second },
+		{ "partial", "closed", authzReply { Allowed: []string {"#1 ssh", "#2 db"}, Denied: map[string]string {"#3 metrics": "not on call"} }, false, false, 200, []string {""}, []string {"Rule #3 metrics was denied: not on call", "Rule #2 db shares its whitelist with a denied rule"}, 3600 * time.Second },
+		{ "unnamed rules are denied", "closed", authzReply { Allowed: []string {"#2 db", "#3 metrics"} }, false, false, 200, []string {"ops"}, []string {"Rule #1 ssh was denied, it was not opened"}, 0 },
+		{ "deny", "closed", authzReply { Denied: map[string]string {"#1 ssh": "revoked", "#2 db": "revoked", "#3 metrics": "revoked"} }, false, false, 403, nil, []string {"ERROR authz-denied"}, 0 },
+		{ "timeout, closed", "closed", allowAll, false, true, 503, nil, []string {"ERROR unavailable"}, 0 },
+		{ "timeout, open", "open", authzReply {}, false, true, 200, []string {"", "ops"}, nil, 3600 * time.Second },
+		{ "bad signature", "closed", allowAll, true, false, 503, nil, nil, 0 },
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			release := make(chan struct{})
+			authorizer := httptest.NewServer(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if r.Header.Get(authzSignatureHeader) != authzSignature("s3cret", body) {
+					t.Errorf("request signature %q does not match", r.Header.Get(authzSignatureHeader))
+				}
+				var request authzRequest
+				err := json.Unmarshal(body, &request)
+				if err != nil {
+					t.Error(err)
+				}
+				if request.Username != "alice" || request.Subnet != "192.0.2.0/24" || len(request.Rules) != 3 || request.Rules[1].Name != "#2 db" || request.Rules[1].DestPort != "5432" || request.Rules[1].Group != "ops" {
+					t.Errorf("unexpected request %+v", request)
+				}
+				if tt.slow {
+					<-release
+				}
+				reply := tt.reply
+				reply.Nonce = request.Nonce
+				payload, _ := json.Marshal(reply)
+				key := "s3cret"
+				if tt.badSignature {
+					key = "guess"
+				}
+				w.Header().Set(authzSignatureHeader, authzSignature(key, payload))
+				w.Write(payload)
+			}))
+			defer authorizer.Close()
+			defer close(release)
+			s, backend := newTestServer(t, "authz-fail-mode = " + strconv.Quote(tt.failMode) + "\n" + authzTestConfig + "[authz]\nurl = " + strconv.Quote(authorizer.URL) + "\ntimeout = 1\nsigning-key = \"s3cret\"\n")
+			backend.timeouts = make(map[string]time.Duration)
+
+			w := testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("login replied %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("reply %q lacks %q", w.Body.String(), want)
+				}
+			}
+			for _, group := range []string {"", "ops"} {
+				setName, _ := s.fw.setFor(net.ParseIP("192.0.2.7"), group)
+				if open := backend.elements[setName + " 192.0.2.7"]; open != containsString(tt.wantOpen, group) {
+					t.Errorf("group %q whitelisted = %t, want %t", group, open, !open)
+				}
+			}
+			setName, _ := s.fw.setFor(net.ParseIP("192.0.2.7"), "")
+			if got := backend.timeouts[setName + " 192.0.2.7"]; got != tt.wantSSHTimeout {
+				t.Errorf("ssh got a timeout of %s, want %s", got, tt.wantSSHTimeout)
+			}
+		})
+	}
+}
+
+func TestAuthzCache(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	var mutex sync.Mutex
+	calls := 0
+	down := false
+	authorizer := httptest.NewServer(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls++
+		if down {
+			http.Error(w, "down", 502)
+			return
+		}
+		var request authzRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		payload, _ := json.Marshal(authzReply { Nonce: request.Nonce, Allowed: []string {"#1 ssh"}, Denied: map[string]string {"#2 db": "not on call"} })
+		w.Header().Set(authzSignatureHeader, authzSignature("s3cret", payload))
+		w.Write(payload)
+	}))
+	defer authorizer.Close()
+	s, backend := newTestServer(t, authzTestConfig + "[authz]\nurl = " + strconv.Quote(authorizer.URL) + "\nsigning-key = \"s3cret\"\ncache-ttl = 60\n")
+	login := func (addr string) *httptest.ResponseRecorder {
+		return testLogin(s, addr, url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+	}
+
+	if w := login("192.0.2.7"); w.Code != 200 {
+		t.Fatalf("first login replied %d: %s", w.Code, w.Body.String())
+	}
+	mutex.Lock()
+	down = true
+	mutex.Unlock()
+	w := login("198.51.100.7")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "Rule #2 db was denied: not on call") {
+		t.Fatalf("login with cached verdicts replied %d: %s", w.Code, w.Body.String())
+	}
+	if calls != 1 {
+		t.Errorf("authorizer asked %d times, want 1", calls)
+	}
+	if setName, _ := s.fw.setFor(net.ParseIP("198.51.100.7"), ""); !backend.elements[setName + " 198.51.100.7"] {
+		t.Error("cached allowed rule was not whitelisted")
+	}
+
+	// Past cache-ttl the verdicts are asked for again, the outage then keeps the rules closed
+	err := s.fw.cache.CleanupAuthzVerdicts(time.Now().Add(61 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := login("203.0.113.7"); w.Code != 503 {
+		t.Errorf("login with expired verdicts and the authorizer down replied %d: %s", w.Code, w.Body.String())
+	}
+	if calls != 2 {
+		t.Errorf("authorizer asked %d times, want 2", calls)
+	}
+}
+
+func TestAuthzOptions(t *testing.T) {
+	tests := []struct {
+		name		string
+		text		string
+		wantErr		bool
+	}{
+		{ "complete", "[authz]\nurl = \"https://authz.example.com/portknob\"\nsigning-key = \"s3cret\"\n", false },
+		{ "no url", "[authz]\nsigning-key = \"s3cret\"\n", true },
+		{ "bad url", "[authz]\nurl = \"authz.example.com\"\nsigning-key = \"s3cret\"\n", true },
+		{ "no signing key", "[authz]\nurl = \"https://authz.example.com/portknob\"\n", true },
+		{ "bad fail mode", "[daemon]\nauthz-fail-mode = \"maybe\"\n", true },
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, tt.text + "[[firewall]]\ndport = \"22\"\n"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadConfig() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	errNoBundles		= errors.New("select at least one of your bundles")
+	errUnknownBundle	= errors.New("unknown bundle")
+)
+
+// Check the bundles of the rules and the default-bundles of users, after the rules were parsed
+func (conf *config) parseBundles() error {
+	folded := make(map[string]string)
+	for _, bundle := range conf.bundles() {
+		// Checkboxes differing only in case would look the same
+		if other, ok := folded[strings.ToLower(bundle)]; ok {
+			return &configError { fmt.Sprintf("bundles %q and %q differ only in case\n", other, bundle) }
+		}
+		folded[strings.ToLower(bundle)] = bundle
+	}
+	for user, bundles := range conf.SecretsDefaultBundles {
+		for i, bundle := range bundles {
+			if !containsString(conf.bundles(), bundle) {
+				return &configError { fmt.Sprintf("user %q lists unknown bundle %q in option \"default-bundles\"\n", user, bundle) }
+			}
+			if containsString(bundles[:i], bundle) {
+				return &configError { fmt.Sprintf("user %q lists bundle %q twice in option \"default-bundles\"\n", user, bundle) }
+			}
+		}
+		if len(bundles) == 0 {
+			return &configError { fmt.Sprintf("option \"default-bundles\" of user %q must list at least one bundle\n", user) }
+		}
+	}
+	return nil
+}
+
+// Bundle names are form values and cookie contents, the comma separates them
+func (conf *config) checkBundleName(bundle string) error {
+	for _, c := range bundle {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return conf.reportConfigError("bundle", bundle)
+		}
+	}
+	return nil
+}
+
+// Names of the bundles of all rules, in the order of the configuration
+func (conf *config) bundles() (bundles []string) {
+	for _, rule := range conf.Firewall {
+		if rule.Bundle != "" && !containsString(bundles, rule.Bundle) {
+			bundles = append(bundles, rule.Bundle)
+		}
+	}
+	return
+}
+
+// Names of the bundles among the rules opened for a user with groups, and how many rules those are
+func (conf *config) userBundles(groups []string) (bundles []string, rules int) {
+	opened := conf.expandGroups(append([]string {""}, groups...))
+	for _, rule := range conf.Firewall {
+		if !containsString(opened, rule.Group) {
+			continue
+		}
+		rules++
+		if rule.Bundle != "" && !containsString(bundles, rule.Bundle) {
+			bundles = append(bundles, rule.Bundle)
+		}
+	}
+	return
+}
+
+// Rule names of bundle, for its checkbox
+func (conf *config) bundleRuleNames(bundle string) (names []string) {
+	for i, rule := range conf.Firewall {
+		if rule.Bundle == bundle {
+			names = append(names, conf.ruleName(i))
+		}
+	}
+	return
+}
+
+// Return the groups of the rules in bundles which are not selected, a login does not open them
+func (conf *config) unselectedGroups(selected []string) (skip []string) {
+	for _, rule := range conf.Firewall {
+		if rule.Bundle != "" && !containsString(selected, rule.Bundle) && !containsString(skip, rule.Group) {
+			skip = append(skip, rule.Group)
+		}
+	}
+	return
+}
+
+// Bundles selected by the login form, or else those remembered for the user
+// fromForm is true when the request made the selection, errNoBundles when it selected none of the bundles of the user
+func (s *server) loginBundles(r *http.Request, user string, groups []string) (selected []string, fromForm bool, err error) {
+	if r.Method == "POST" && (r.PostFormValue("bundle-choice") != "" || len(r.PostForm["bundles"]) != 0) {
+		selected = r.PostForm["bundles"]
+		for _, bundle := range selected {
+			if !containsString(s.conf.bundles(), bundle) {
+				return nil, true, errUnknownBundle
+			}
+		}
+		if own, _ := s.conf.userBundles(groups); len(own) != 0 && len(intersectStrings(own, selected)) == 0 {
+			return nil, true, errNoBundles
+		}
+		return selected, true, nil
+	}
+	return s.rememberedBundles(r, user), false, nil
+}
+
+// The user's last selection kept in a cookie, or the user's default-bundles, or else all bundles
+func (s *server) rememberedBundles(r *http.Request, user string) []string {
+	// Bundles removed from the configuration since are dropped
+	if cookie, err := s.cookieString(r, "portknob_bundles"); err == nil {
+		cookie, _ = url.QueryUnescape(cookie)
+		if selected := intersectStrings(strings.Split(cookie, ","), s.conf.bundles()); len(selected) != 0 {
+			return selected
+		}
+	}
+	if defaults, ok := s.conf.SecretsDefaultBundles[user]; ok {
+		return defaults
+	}
+	return s.conf.bundles()
+}
+
+// Remember the bundles selected by a login for the cookie logins which follow it
+func (s *server) setBundlesCookie(w http.ResponseWriter, r *http.Request, selected []string) {
+	http.SetCookie(w, &http.Cookie {
+		Name:		"portknob_bundles",
+		Value:		url.QueryEscape(strings.Join(selected, ",")),
+		Path:		s.conf.Daemon.HTTPPath,
+		MaxAge:		365 * 24 * 3600,
+		HttpOnly:	true,
+		Secure:		s.secureRequest(r),
+	})
+}
+
+// Checkboxes of the login form, for the user if known, or else for every bundle
+func (s *server) loginPageBundles(r *http.Request, user string) (bundles []loginPageBundle) {
+	names, rules := s.conf.bundles(), len(s.conf.Firewall)
+	if _, ok := s.conf.Secrets[user]; ok {
+		names, rules = s.conf.userBundles(s.conf.SecretsGroups[user])
+	}
+	// Nothing to choose from
+	if len(names) == 0 || rules < 2 {
+		return nil
+	}
+	checked := s.rememberedBundles(r, user)
+	if r.Method == "POST" && r.PostFormValue("bundle-choice") != "" {
+		checked = r.PostForm["bundles"]
+	}
+	for _, name := range names {
+		bundles = append(bundles, loginPageBundle { name, strings.Join(s.conf.bundleRuleNames(name), ", "), containsString(checked, name) })
+	}
+	return
+}
+
+type loginPageBundle struct {
+	Name		string
+	Rules		string
+	Checked		bool
+}
+
+// Elements of a that are also in b, in the order of a
+func intersectStrings(a, b []string) (both []string) {
+	for _, s := range a {
+		if containsString(b, s) && !containsString(both, s) {
+			both = append(both, s)
+		}
+	}
+	return
+}
@@ -0,0 +1,169 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+const bundleTestConfig = `[[firewall]]
+comment = "web"
+dport = "443"
+[[firewall]]
+comment = "ssh"
+dport = "22"
+group = "admins"
+bundle = "remote-admin"
+[[firewall]]
+comment = "jellyfin"
+dport = "8096"
+group = "media"
+bundle = "media"
+[[secrets]]
+username = "alice"
+password = "hunter2"
+groups = ["admins", "media"]
+[[secrets]]
+username = "bob"
+password = "swordfish"
+groups = ["admins", "media"]
+default-bundles = ["media"]
+`
+
+func TestBundles(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	tests := []struct {
+		name		string
+		addr		string
+		form		url.Values
+		// Log in with the cookies of the previous login
+		cookies		bool
+		wantCode	int
+		wantOpened	[]string
+	}{
+		{ "default", "192.0.2.1", url.Values { "username": {"alice"}, "password": {"hunter2"} }, false, 200, []string {"admins", "media"} },
+		{ "default-bundles", "192.0.2.2", url.Values { "username": {"bob"}, "password": {"swordfish"} }, false, 200, []string {"media"} },
+		{ "selected", "192.0.2.3", url.Values { "username": {"alice"}, "password": {"hunter2"}, "bundle-choice": {"1"}, "bundles": {"remote-admin"} }, false, 200, []string {"admins"} },
+		{ "cookie remembers", "192.0.2.4", nil, true, 200, []string {"admins"} },
+		{ "selects over the default", "192.0.2.5", url.Values { "username": {"bob"}, "password": {"swordfish"}, "bundles": {"remote-admin", "media"} }, false, 200, []string {"admins", "media"} },
+		{ "nothing selected", "192.0.2.6", url.Values { "username": {"alice"}, "password": {"hunter2"}, "bundle-choice": {"1"} }, false, 400, nil },
+		{ "unknown bundle", "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"}, "bundles": {"games"} }, false, 400, nil },
+	}
+	s, backend := newTestServer(t, bundleTestConfig)
+	var cookies []*http.Cookie
+	for _, tt := range tests {
+		var sent []*http.Cookie
+		if tt.cookies {
+			sent = cookies
+		}
+		w := testLogin(s, tt.addr, tt.form, sent)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: login replied %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body.String())
+			continue
+		}
+		cookies = w.Result().Cookies()
+		if tt.wantCode != 200 {
+			if backend.elements["portknob-net4 " + tt.addr] {
+				t.Errorf("%s: failed login opened the rules without a bundle", tt.name)
+			}
+			continue
+		}
+		if !backend.elements["portknob-net4 " + tt.addr] {
+			t.Errorf("%s: rules without a bundle not opened", tt.name)
+		}
+		for _, group := range []string {"admins", "media"} {
+			if opened, want := backend.elements["portknob-" + group + "-net4 " + tt.addr], containsString(tt.wantOpened, group); opened != want {
+				t.Errorf("%s: group %s opened %v, want %v", tt.name, group, opened, want)
+			}
+		}
+	}
+}
+
+func TestBundlesLoginPage(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, _ := newTestServer(t, bundleTestConfig)
+	tests := []struct {
+		name		string
+		form		url.Values
+		want		[]string
+	}{
+		{ "anyone", nil, []string {`value="remote-admin" checked> remote-admin</label> (#2 ssh)`, `value="media" checked> media</label> (#3 jellyfin)`} },
+		{ "default-bundles", url.Values { "username": {"bob"}, "password": {"wrong"} }, []string {`value="remote-admin"> remote-admin`, `value="media" checked> media`} },
+		{ "failed selection", url.Values { "username": {"alice"}, "password": {"wrong"}, "bundle-choice": {"1"}, "bundles": {"media"} }, []string {`value="remote-admin"> remote-admin`, `value="media" checked> media`} },
+	}
+	for _, tt := range tests {
+		method := "GET"
+		if tt.form != nil {
+			method = "POST"
+		}
+		r := httptest.NewRequest(method, "/", strings.NewReader(tt.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Real-IP", "192.0.2.1")
+		w := httptest.NewRecorder()
+		s.handlerFunc(w, r)
+		for _, want := range tt.want {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%s: login page lacks %q:\n%s", tt.name, want, w.Body.String())
+			}
+		}
+	}
+
+	// Nothing to choose from without bundles
+	s, _ = newTestServer(t, "[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\n")
+	w := httptest.NewRecorder()
+	s.handlerFunc(w, httptest.NewRequest("GET", "/", nil))
+	if strings.Contains(w.Body.String(), "bundle") {
+		t.Errorf("login page without bundles has checkboxes:\n%s", w.Body.String())
+	}
+}
+
+func TestBundleOptions(t *testing.T) {
+	tests := []struct {
+		name		string
+		text		string
+		wantErr		bool
+	}{
+		{ "valid", bundleTestConfig, false },
+		{ "no group", "[[firewall]]\ndport = \"22\"\nbundle = \"ssh\"\n", true },
+		{ "own lifespan", "[[firewall]]\ndport = \"22\"\ngroup = \"admins\"\n[[firewall]]\ndport = \"8443\"\ngroup = \"admins\"\nlifespan = 600\nbundle = \"web\"\n[secrets]\nalice = { password = \"hunter2\", groups = [\"admins\"] }\n", false },
+		{ "shared group", "[[firewall]]\ndport = \"22\"\ngroup = \"admins\"\nbundle = \"ssh\"\n[[firewall]]\ndport = \"8443\"\ngroup = \"admins\"\nbundle = \"web\"\n", true },
+		{ "case", "[[firewall]]\ndport = \"22\"\ngroup = \"admins\"\nbundle = \"SSH\"\n[[firewall]]\ndport = \"8443\"\ngroup = \"web\"\nbundle = \"ssh\"\n", true },
+		{ "name", "[[firewall]]\ndport = \"22\"\ngroup = \"admins\"\nbundle = \"ssh,web\"\n", true },
+		{ "unknown default", strings.Replace(bundleTestConfig, `default-bundles = ["media"]`, `default-bundles = ["games"]`, 1), true },
+		{ "repeated default", strings.Replace(bundleTestConfig, `default-bundles = ["media"]`, `default-bundles = ["media", "media"]`, 1), true },
+		{ "empty default", strings.Replace(bundleTestConfig, `default-bundles = ["media"]`, `default-bundles = []`, 1), true },
+	}
+	for _, tt := range tests {
+		_, err := loadConfig(writeTestConfig(t, tt.text))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: loadConfig returned %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -19,67 +19,1754 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
-	"github.com/boltdb/bolt"
 )
 
 type cache struct {
 	conf	*config
-	db		*bolt.DB
+	store	cacheStore
+	// Prefix of the journal records of this host, the firewall of each host sharing the database is its own
+	journalOwner	string
+}
+
+// Storage of the cache database, selected by cache-backend
+// Buckets are flat key-value namespaces, made of the names in cacheBuckets
+type cacheStore interface {
+	Start() error
+	Stop()
+	// Run fn in a read-only transaction
+	View(fn func (tx cacheTx) error) error
+	// Run fn in a read-write transaction, it may be run again if another instance wrote the same keys meanwhile
+	Update(fn func (tx cacheTx) error) error
+	// Return the size of the database in bytes
+	Size() (int64, error)
+	// Print the schema version and entry counts of the database without modifying it
+	PrintInfo(w io.Writer) error
+}
+
+type cacheTx interface {
+	Get(bucket, key string) (value string, ok bool)
+	Put(bucket, key, value string) error
+	Delete(bucket, key string) error
+	// Call cb with every entry of bucket, removing the entries it returns true for
+	ForEach(bucket string, cb func (key, value string) bool) error
 }
 
 func newCache(conf *config) *cache {
 	c := &cache {
 		conf:	conf,
+		journalOwner:	"localhost",
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && !strings.ContainsAny(hostname, " \t") {
+		c.journalOwner = hostname
+	}
+	switch conf.Daemon.CacheBackend {
+	case "sqlite":
+		c.store = &sqliteStore { conf: conf }
+	case "redis":
+		c.store = &redisStore { conf: conf }
+	default:
+		c.store = &boltStore { conf: conf }
+	}
+	if conf.readOnly {
+		c.store = readOnlyStore { c.store }
 	}
 	return c
 }
 
+var errCacheReadOnly = errors.New("cache database is open read-only")
+
+// Refuses every write for -read-only, besides the backend opening the database read-only
+type readOnlyStore struct {
+	cacheStore
+}
+
+func (s readOnlyStore) Update(fn func (tx cacheTx) error) error {
+	return errCacheReadOnly
+}
+
+type cacheReadOnlyError struct {
+	path		string
+	version		uint64
+}
+
+func (e *cacheReadOnlyError) Error() string {
+	return fmt.Sprintf("cache database %q has schema version %d, but this binary needs version %d and cannot migrate it with -read-only, upgrade the daemon writing it first", e.path, e.version, cacheSchemaVersion)
+}
+
+// Version of the database layout written by this binary
+// Bump it and append to cacheMigrations whenever the layout changes
+const cacheSchemaVersion = 20
+
+// Buckets known to this binary, anything else is dropped by a forced downgrade
+var cacheBuckets = []string {"portknob", "portknob-meta", "portknob-bans", "portknob-auth", "portknob-revoked", "portknob-failures", "portknob-totp", "portknob-epochs", "portknob-journal", "portknob-denied", "portknob-travel", "portknob-shares", "portknob-pending", "portknob-keys", "portknob-challenges", "portknob-probation", "portknob-probation-passed", "portknob-authz", "portknob-known-subnets", "portknob-granted-by", "portknob-device-keys"}
+
+type cacheVersionError struct {
+	path		string
+	version		uint64
+}
+
+func (e *cacheVersionError) Error() string {
+	return fmt.Sprintf("cache database %q has schema version %d, but this binary only supports up to version %d, upgrade portknob or start it once with -force-downgrade to drop the newer data", e.path, e.version, cacheSchemaVersion)
+}
+
+// Check and record the schema version of a database without buckets of its own, which never needed migrating
+func checkSchemaVersion(conf *config, store cacheStore) error {
+	if conf.readOnly {
+		return store.View(func (tx cacheTx) error {
+			v, _ := tx.Get("portknob-meta", "schema-version")
+			version, _ := strconv.ParseUint(v, 10, 64)
+			if version != cacheSchemaVersion {
+				return &cacheReadOnlyError { conf.Daemon.CacheDatabase, version }
+			}
+			return nil
+		})
+	}
+	return store.Update(func (tx cacheTx) error {
+		v, ok := tx.Get("portknob-meta", "schema-version")
+		version, err := strconv.ParseUint(v, 10, 64)
+		if ok && err == nil && version > cacheSchemaVersion {
+			if !conf.forceDowngrade {
+				return &cacheVersionError { conf.Daemon.CacheDatabase, version }
+			}
+			// Every bucket lives in the same namespace, newer data is simply never read
+		}
+		return tx.Put("portknob-meta", "schema-version", strconv.FormatUint(cacheSchemaVersion, 10))
+	})
+}
+
 func (c *cache) Start() error {
-	var err error
-	c.db, err = bolt.Open(c.conf.Daemon.CacheDatabase, 0600, nil)
+	return c.store.Start()
+}
+
+func (c *cache) PrintInfo(w io.Writer) error {
+	return c.store.PrintInfo(w)
+}
+
+// Return the size of the database in bytes
+func (c *cache) Size() (int64, error) {
+	return c.store.Size()
+}
+
+func (c *cache) Stop() {
+	c.store.Stop()
+}
+
+// Whether other instances may write to the database, so the firewall must follow it
+func (c *cache) Shared() bool {
+	store := c.store
+	if ro, ok := store.(readOnlyStore); ok {
+		store = ro.cacheStore
+	}
+	_, local := store.(*boltStore)
+	return !local
+}
+
+// A whitelist entry, user and created are unknown for entries written before schema version 5
+type cacheEntry struct {
+	addr		net.IP
+	group		string
+	user		string
+	created		time.Time
+	// Host of the instance which wrote created, empty before schema version 12
+	node		string
+	// Zero for entries which never expire
+	expires		time.Time
+}
+
+func (entry *cacheEntry) live(now time.Time) bool {
+	return entry.expires.IsZero() || entry.expires.After(now)
+}
+
+// Whitelist entries are keyed by "addr" for rules without a group, or "addr group"
+func (entry *cacheEntry) key() string {
+	if entry.group != "" {
+		return entry.addr.String() + " " + entry.group
+	}
+	return entry.addr.String()
+}
+
+// Values are "expires created@host user", expires being "never" for a zero time
+// The entries are written in one transaction, created is set to now by the clock of this host, and their journal records are cleared
+// Whoever granted the previous entries is forgotten, SetGrantedBy records it again for admin grants
+func (c *cache) Set(entries []cacheEntry) error {
+	created := time.Now().UTC().Format(time.RFC3339Nano) + "@" + c.journalOwner
+	err := c.store.Update(func (tx cacheTx) error {
+		for _, entry := range entries {
+			e := "never"
+			if !entry.expires.IsZero() {
+				e = entry.expires.UTC().Format(time.RFC3339Nano)
+			}
+			err := tx.Put("portknob", entry.key(), e + " " + created + " " + entry.user)
+			if err != nil {
+				return err
+			}
+			err = tx.Delete("portknob-journal", c.journalOwner + " " + entry.key())
+			if err != nil {
+				return err
+			}
+			err = tx.Delete("portknob-granted-by", entry.key())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Record that by granted the whitelist entries through the admin API or the control socket, keyed like them
+func (c *cache) SetGrantedBy(entries []cacheEntry, by string) error {
+	return c.store.Update(func (tx cacheTx) error {
+		for _, entry := range entries {
+			err := tx.Put("portknob-granted-by", entry.key(), by)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Return who granted the whitelist entries which did not come from a login or a share link, by the key of the entry
+func (c *cache) GrantedBy() (grantedBy map[string]string, err error) {
+	grantedBy = make(map[string]string)
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob-granted-by", func (k, v string) bool {
+			grantedBy[k] = v
+			return false
+		})
+	})
+	return
+}
+
+// Forget who granted the whitelist entries which are gone
+func (c *cache) CleanupGrantedBy() error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.ForEach("portknob-granted-by", func (k, v string) bool {
+			_, found := tx.Get("portknob", k)
+			return !found
+		})
+	})
+}
+
+// A grant which may have changed the firewall without its whitelist entry being stored
+type journalRecord struct {
+	// Only addr and group are known
+	entry		cacheEntry
+	// "pending" while the grant runs, "failed" once its rollback failed
+	state		string
+	started		time.Time
+}
+
+// Record that the grants of entries are about to change the firewall, keyed by "host " and the key of the whitelist entry
+// Values are "state started"
+func (c *cache) SetJournal(entries []cacheEntry, state string) error {
+	started := time.Now().UTC().Format(time.RFC3339Nano)
+	err := c.store.Update(func (tx cacheTx) error {
+		for _, entry := range entries {
+			err := tx.Put("portknob-journal", c.journalOwner + " " + entry.key(), state + " " + started)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Forget the journal records of entries, once the firewall matches the cache again
+func (c *cache) ClearJournal(entries []cacheEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	err := c.store.Update(func (tx cacheTx) error {
+		for _, entry := range entries {
+			err := tx.Delete("portknob-journal", c.journalOwner + " " + entry.key())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Return the journal records of this host for grants neither completed nor rolled back
+func (c *cache) Journal() (records []journalRecord, err error) {
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob-journal", func (k, v string) bool {
+			if !strings.HasPrefix(k, c.journalOwner + " ") {
+				return false
+			}
+			entry, ok := parseEntry(strings.TrimPrefix(k, c.journalOwner + " "), "never")
+			fields := strings.Fields(v)
+			if !ok || len(fields) != 2 {
+				return false
+			}
+			started, _ := time.Parse(time.RFC3339Nano, fields[1])
+			records = append(records, journalRecord { entry: entry, state: fields[0], started: started })
+			return false
+		})
+	})
+	return
+}
+
+// Remove the whitelist entries for which cb returns true, returning them once the removal is committed
+// cb may run again for the same entry when another instance changed the database meanwhile, so act on the result instead
+func (c *cache) Iter(cb func (entry cacheEntry) bool) (removed []cacheEntry, err error) {
+	err = c.store.Update(func (tx cacheTx) error {
+		removed = nil
+		return tx.ForEach("portknob", func (k, v string) bool {
+			entry, ok := parseEntry(k, v)
+			if !ok {
+				return true
+			}
+			if !cb(entry) {
+				return false
+			}
+			removed = append(removed, entry)
+			return true
+		})
+	})
 	if err != nil {
-		return err
+		removed = nil
 	}
-	err = c.db.Update(func (tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("portknob"))
-		return err
+	return
+}
+
+// Return all whitelist entries
+func (c *cache) Entries() (entries []cacheEntry, err error) {
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob", func (k, v string) bool {
+			if entry, ok := parseEntry(k, v); ok {
+				entries = append(entries, entry)
+			}
+			return false
+		})
 	})
-	return nil
+	return
 }
 
-func (c *cache) Stop() {
-	c.db.Close()
+func parseEntry(key, v string) (entry cacheEntry, ok bool) {
+	if space := strings.IndexByte(key, ' '); space >= 0 {
+		key, entry.group = key[:space], key[space + 1:]
+	}
+	entry.addr = net.ParseIP(key)
+	if entry.addr == nil {
+		return
+	}
+	fields := strings.SplitN(v, " ", 3)
+	if fields[0] != "never" {
+		var err error
+		entry.expires, err = time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return
+		}
+	}
+	if len(fields) == 3 {
+		created, node, _ := strings.Cut(fields[1], "@")
+		entry.created, _ = time.Parse(time.RFC3339Nano, created)
+		entry.node = node
+		entry.user = fields[2]
+	}
+	return entry, true
+}
+
+// Return the earliest expiry among whitelist entries, as expiry tells it
+func (c *cache) NextExpiry(expiry func (entry cacheEntry) time.Time) (earliest time.Time, ok bool) {
+	c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob", func (k, v string) bool {
+			entry, valid := parseEntry(k, v)
+			if !valid || entry.expires.IsZero() {
+				return false
+			}
+			if expires := expiry(entry); !ok || expires.Before(earliest) {
+				earliest, ok = expires, true
+			}
+			return false
+		})
+	})
+	return
+}
+
+// Return the time user last logged in with a password
+func (c *cache) AuthTime(user string) (authTime time.Time, ok bool) {
+	c.store.View(func (tx cacheTx) error {
+		v, _ := tx.Get("portknob-auth", user)
+		var err error
+		authTime, err = time.Parse(time.RFC3339Nano, v)
+		ok = err == nil
+		return nil
+	})
+	return
+}
+
+func (c *cache) SetAuthTime(user string, authTime time.Time) error {
+	err := c.store.Update(func (tx cacheTx) error {
+		return tx.Put("portknob-auth", user, authTime.UTC().Format(time.RFC3339Nano))
+	})
+	return err
+}
+
+// Forget password login times older than keep, and those of users
+// Records written before they were keyed by user are keyed by subnet, no user matches them and they age out
+func (c *cache) CleanupAuthTimes(keep time.Duration, users []string) error {
+	now := time.Now().UTC()
+	err := c.store.Update(func (tx cacheTx) error {
+		return tx.ForEach("portknob-auth", func (k, v string) bool {
+			authTime, err := time.Parse(time.RFC3339Nano, v)
+			return err != nil || now.Sub(authTime) >= keep || containsString(users, k)
+		})
+	})
+	return err
+}
+
+// Remember that the admin API revoked subnet, so its cookies no longer log in
+func (c *cache) SetRevoked(subnet string, revoked bool) error {
+	err := c.store.Update(func (tx cacheTx) error {
+		if !revoked {
+			return tx.Delete("portknob-revoked", subnet)
+		}
+		return tx.Put("portknob-revoked", subnet, time.Now().UTC().Format(time.RFC3339Nano))
+	})
+	return err
 }
 
-func (c *cache) Set(addr net.IP, expires time.Time) error {
-	k := []byte(addr.String())
-	v := []byte(expires.UTC().Format(time.RFC3339Nano))
-	err := c.db.Update(func (tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("portknob"))
-		err := b.Put(k, v)
-		return err
+// Return when the admin API revoked each subnet
+func (c *cache) RevokedSubnets() (revoked map[string]time.Time, err error) {
+	revoked = make(map[string]time.Time)
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob-revoked", func (k, v string) bool {
+			if at, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				revoked[k] = at
+			}
+			return false
+		})
+	})
+	return
+}
+
+func (c *cache) Revoked(subnet string) (revoked bool) {
+	c.store.View(func (tx cacheTx) error {
+		_, revoked = tx.Get("portknob-revoked", subnet)
+		return nil
+	})
+	return
+}
+
+// Forget revocations older than keep, by then the cookies have expired
+func (c *cache) CleanupRevoked(keep time.Duration) error {
+	now := time.Now().UTC()
+	err := c.store.Update(func (tx cacheTx) error {
+		return tx.ForEach("portknob-revoked", func (k, v string) bool {
+			revokedTime, err := time.Parse(time.RFC3339Nano, v)
+			return err != nil || now.Sub(revokedTime) >= keep
+		})
+	})
+	return err
+}
+
+// Return the credential epoch of user, login cookies signed for another epoch no longer log in
+// It is the epoch of the user plus the global one, both only ever grow so any bump changes the sum
+func (c *cache) Epoch(user string) (epoch uint64) {
+	c.store.View(func (tx cacheTx) error {
+		v, _ := tx.Get("portknob-epochs", user)
+		epoch, _ = strconv.ParseUint(v, 10, 64)
+		v, _ = tx.Get("portknob-meta", "epoch")
+		global, _ := strconv.ParseUint(v, 10, 64)
+		epoch += global
+		return nil
+	})
+	return
+}
+
+// Return the global credential epoch, which a panic advances for every user at once
+func (c *cache) GlobalEpoch() (epoch uint64) {
+	c.store.View(func (tx cacheTx) error {
+		v, _ := tx.Get("portknob-meta", "epoch")
+		epoch, _ = strconv.ParseUint(v, 10, 64)
+		return nil
+	})
+	return
+}
+
+func (c *cache) BumpGlobalEpoch() error {
+	return c.store.Update(func (tx cacheTx) error {
+		v, _ := tx.Get("portknob-meta", "epoch")
+		epoch, _ := strconv.ParseUint(v, 10, 64)
+		return tx.Put("portknob-meta", "epoch", strconv.FormatUint(epoch + 1, 10))
+	})
+}
+
+// Return the users whose credential epoch was advanced, with their own epoch without the global one
+func (c *cache) Epochs() (epochs map[string]uint64, err error) {
+	epochs = make(map[string]uint64)
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob-epochs", func (k, v string) bool {
+			if epoch, err := strconv.ParseUint(v, 10, 64); err == nil && epoch != 0 {
+				epochs[k] = epoch
+			}
+			return false
+		})
+	})
+	return
+}
+
+// Advance the credential epoch of users, so the login cookies they already have stop working
+func (c *cache) BumpEpochs(users []string) error {
+	err := c.store.Update(func (tx cacheTx) error {
+		for _, user := range users {
+			v, _ := tx.Get("portknob-epochs", user)
+			epoch, _ := strconv.ParseUint(v, 10, 64)
+			err := tx.Put("portknob-epochs", user, strconv.FormatUint(epoch + 1, 10))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 	return err
 }
 
-func (c *cache) Iter(cb func (addr net.IP, expires time.Time) bool) error {
-	err := c.db.Update(func (tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("portknob"))
-		cur := b.Cursor()
-		for k, v := cur.First(); k != nil; k, v = cur.Next() {
-			addr := net.ParseIP(string(k))
-			expires, err := time.Parse(time.RFC3339Nano, string(v))
-			willDelete := true
-			if addr != nil && err == nil {
-				willDelete = cb(addr, expires)
+// Return the key signing login cookies, created on first use and replaced by RotateCookieKey
+// Instances sharing the cache database share the key, so each accepts the cookies of the others
+func (c *cache) CookieKey() (key []byte, err error) {
+	return c.metaKey("cookie-key")
+}
+
+// Return the key hashing the subnets of an anonymized access review, created on first use and never replaced
+// Reviews exported at different times hash a subnet alike, so they can be compared
+func (c *cache) AnonymizeKey() (key []byte, err error) {
+	return c.metaKey("anonymize-key")
+}
+
+// Return the random key kept in portknob-meta under name, creating it if it is missing
+func (c *cache) metaKey(name string) (key []byte, err error) {
+	c.store.View(func (tx cacheTx) error {
+		v, _ := tx.Get("portknob-meta", name)
+		key, _ = hex.DecodeString(v)
+		return nil
+	})
+	if len(key) != 0 {
+		return key, nil
+	}
+	err = c.store.Update(func (tx cacheTx) error {
+		// Another instance may have created it meanwhile
+		v, _ := tx.Get("portknob-meta", name)
+		key, _ = hex.DecodeString(v)
+		if len(key) != 0 {
+			return nil
+		}
+		key = make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			return err
+		}
+		return tx.Put("portknob-meta", name, hex.EncodeToString(key))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Keys replaced by RotateCookieKey kept at most, newest first
+const cookieKeyHistory = 4
+
+// A key replaced by RotateCookieKey, still accepted for what it signed until then plus the lifespan of that
+type retiredCookieKey struct {
+	key			[]byte
+	retired		time.Time
+}
+
+// "cookie-key-history" holds "hex@retired" separated by spaces, newest first
+func parseCookieKeyHistory(v string) (history []retiredCookieKey) {
+	for _, field := range strings.Fields(v) {
+		k, retired, _ := strings.Cut(field, "@")
+		key, err := hex.DecodeString(k)
+		if err != nil || len(key) == 0 {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339Nano, retired)
+		if err != nil {
+			continue
+		}
+		history = append(history, retiredCookieKey { key, at })
+	}
+	return
+}
+
+// Return the current cookie key followed by the ones retired less than keep before now, 0 keeping every one in the history
+// MACs are checked against each, so cookies and tokens signed before a rotation stay valid until they expire
+func (c *cache) CookieKeys(keep time.Duration, now time.Time) (keys [][]byte, err error) {
+	key, err := c.CookieKey()
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, key)
+	c.store.View(func (tx cacheTx) error {
+		v, _ := tx.Get("portknob-meta", "cookie-key-history")
+		for _, old := range parseCookieKeyHistory(v) {
+			if keep == 0 || now.Sub(old.retired) < keep {
+				keys = append(keys, old.key)
 			}
-			if willDelete {
-				cur.Delete()
+		}
+		return nil
+	})
+	return keys, nil
+}
+
+// Replace the cookie key with a new random one for every instance sharing the cache database
+// The old key joins the history, keys retired keep or longer before now are dropped, returning how many previous keys remain
+func (c *cache) RotateCookieKey(keep time.Duration, now time.Time) (previous int, err error) {
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return 0, err
+	}
+	err = c.store.Update(func (tx cacheTx) error {
+		var history []string
+		v, _ := tx.Get("portknob-meta", "cookie-key")
+		if old, _ := hex.DecodeString(v); len(old) != 0 {
+			history = append(history, v + "@" + now.UTC().Format(time.RFC3339Nano))
+		}
+		h, _ := tx.Get("portknob-meta", "cookie-key-history")
+		for _, old := range parseCookieKeyHistory(h) {
+			if len(history) < cookieKeyHistory && (keep == 0 || now.Sub(old.retired) < keep) {
+				history = append(history, hex.EncodeToString(old.key) + "@" + old.retired.UTC().Format(time.RFC3339Nano))
 			}
 		}
+		err := tx.Put("portknob-meta", "cookie-key-history", strings.Join(history, " "))
+		if err != nil {
+			return err
+		}
+		previous = len(history)
+		return tx.Put("portknob-meta", "cookie-key", hex.EncodeToString(key))
+	})
+	return
+}
+
+// Maintenance mode, refusing new grants from since until until
+type maintenance struct {
+	since		time.Time
+	until		time.Time
+	// Who turned it on, and what the login page says
+	by			string
+	message		string
+}
+
+// Turn on maintenance mode, replacing the current one
+// Kept in the cache database, so it survives restarts and applies to every instance sharing it
+func (c *cache) SetMaintenance(m maintenance) error {
+	v := strings.Join([]string {m.since.UTC().Format(time.RFC3339), m.until.UTC().Format(time.RFC3339), m.by, m.message}, "\n")
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.Put("portknob-meta", "maintenance", v)
+	})
+}
+
+// Return the maintenance mode, false if there is none
+// Ended ones are returned too until EndMaintenance removes them, compare until with the time
+func (c *cache) Maintenance() (m maintenance, ok bool) {
+	c.store.View(func (tx cacheTx) error {
+		var v string
+		v, ok = tx.Get("portknob-meta", "maintenance")
+		if ok {
+			m, ok = parseMaintenance(v)
+		}
+		return nil
+	})
+	return
+}
+
+func parseMaintenance(v string) (m maintenance, ok bool) {
+	fields := strings.SplitN(v, "\n", 4)
+	if len(fields) != 4 {
+		return m, false
+	}
+	var err1, err2 error
+	m.since, err1 = time.Parse(time.RFC3339, fields[0])
+	m.until, err2 = time.Parse(time.RFC3339, fields[1])
+	m.by, m.message = fields[2], fields[3]
+	return m, err1 == nil && err2 == nil
+}
+
+// Turn off maintenance mode, if it ended by now unless force, returning the mode removed
+func (c *cache) EndMaintenance(now time.Time, force bool) (m maintenance, ended bool, err error) {
+	err = c.store.Update(func (tx cacheTx) error {
+		v, found := tx.Get("portknob-meta", "maintenance")
+		if !found {
+			ended = false
+			return nil
+		}
+		m, ended = parseMaintenance(v)
+		if ended && !force && now.Before(m.until) {
+			ended = false
+			return nil
+		}
+		// A record which does not parse is removed too
+		ended = true
+		return tx.Delete("portknob-meta", "maintenance")
+	})
+	if err != nil {
+		ended = false
+	}
+	return
+}
+
+// The record of a panic, "pending" until every entry is revoked, then "executed" until acknowledged
+type panicRecord struct {
+	state		string
+	at			time.Time
+	by			string
+	// Number of subnets revoked
+	revoked		int
+}
+
+func (c *cache) SetPanic(p panicRecord) error {
+	v := strings.Join([]string {p.state, p.at.UTC().Format(time.RFC3339), strconv.Itoa(p.revoked), p.by}, " ")
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.Put("portknob-meta", "panic", v)
+	})
+}
+
+// Return the record of the last panic, false if there is none or it was acknowledged
+func (c *cache) Panic() (p panicRecord, ok bool) {
+	c.store.View(func (tx cacheTx) error {
+		v, found := tx.Get("portknob-meta", "panic")
+		fields := strings.SplitN(v, " ", 4)
+		if !found || len(fields) != 4 {
+			return nil
+		}
+		at, err1 := time.Parse(time.RFC3339, fields[1])
+		revoked, err2 := strconv.Atoi(fields[2])
+		p, ok = panicRecord { fields[0], at, fields[3], revoked }, err1 == nil && err2 == nil
+		return nil
+	})
+	return
+}
+
+func (c *cache) ClearPanic() error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.Delete("portknob-meta", "panic")
+	})
+}
+
+// Record user logging in with the TOTP code of time step counter, refusing steps not newer than the last one used
+func (c *cache) UseTOTP(user string, counter uint64) (fresh bool, err error) {
+	err = c.store.Update(func (tx cacheTx) error {
+		v, _ := tx.Get("portknob-totp", user)
+		last, err := strconv.ParseUint(v, 10, 64)
+		fresh = err != nil || counter > last
+		if !fresh {
+			return nil
+		}
+		return tx.Put("portknob-totp", user, strconv.FormatUint(counter, 10))
+	})
+	return
+}
+
+// Longest ban, the largest timeout of an ipset element, which nftables accepts too
+const maxBanDuration = 2147483 * time.Second
+
+// Ban a subnet for duration, doubling it for every earlier ban that ended less than duration ago, up to maxBanDuration
+func (c *cache) Ban(subnet string, duration time.Duration) (expires time.Time, hits uint64, err error) {
+	now := time.Now().UTC()
+	err = c.store.Update(func (tx cacheTx) error {
+		v, _ := tx.Get("portknob-bans", subnet)
+		hits = 1
+		if prevExpires, prevHits, ok := parseBan(v); ok && now.Sub(prevExpires) < duration {
+			hits = prevHits + 1
+		}
+		// Doubling stops at the cap, so the length cannot overflow
+		length := duration
+		if length <= 0 || length > maxBanDuration {
+			length = maxBanDuration
+		}
+		for i := uint64(1); i < hits && i <= 10 && length < maxBanDuration; i++ {
+			length *= 2
+		}
+		if length > maxBanDuration {
+			length = maxBanDuration
+		}
+		expires = now.Add(length)
+		return tx.Put("portknob-bans", subnet, expires.Format(time.RFC3339Nano) + " " + strconv.FormatUint(hits, 10))
+	})
+	return
+}
+
+func (c *cache) Banned(subnet string) (expires time.Time, banned bool) {
+	now := time.Now().UTC()
+	c.store.View(func (tx cacheTx) error {
+		v, _ := tx.Get("portknob-bans", subnet)
+		var ok bool
+		expires, _, ok = parseBan(v)
+		banned = ok && expires.After(now)
 		return nil
 	})
+	return
+}
+
+// Forget bans which ended more than keep ago
+func (c *cache) CleanupBans(keep time.Duration) error {
+	now := time.Now().UTC()
+	err := c.store.Update(func (tx cacheTx) error {
+		return tx.ForEach("portknob-bans", func (k, v string) bool {
+			expires, _, ok := parseBan(v)
+			return !ok || now.Sub(expires) >= keep
+		})
+	})
 	return err
 }
+
+// What AddFailure counted
+type failureResult struct {
+	// The subnet, or the wider one it was counted with once ratelimit-max-entries was reached
+	key			string
+	count		uint64
+	// Zero unless the failure led to a ban
+	bannedUntil	time.Time
+	// Records dropped to make room
+	evicted		int
+	// Not counted at all, every record being banned
+	dropped		bool
+}
+
+// The number of failure records is kept in "portknob-meta" "failure-records", so AddFailure need not count them
+func failureRecords(tx cacheTx) uint64 {
+	v, _ := tx.Get("portknob-meta", "failure-records")
+	n, _ := strconv.ParseUint(v, 10, 64)
+	return n
+}
+
+func setFailureRecords(tx cacheTx, n uint64) error {
+	return tx.Put("portknob-meta", "failure-records", strconv.FormatUint(n, 10))
+}
+
+// Count a failed login of subnet, banning it for ban once maxFailures happened within window
+// Once maxEntries subnets have records, failures of new ones are counted with others of the wider aggregate, like during a flood of spoofed addresses
+// If even that needs a new record, the unbanned ones which started longest ago are evicted, their clients starting afresh
+// Values are "first count banned-until", banned-until being "-" while not banned
+func (c *cache) AddFailure(subnet, aggregate string, window, ban time.Duration, maxFailures, maxEntries uint64) (r failureResult, err error) {
+	now := time.Now().UTC()
+	err = c.store.Update(func (tx cacheTx) error {
+		r = failureResult { key: subnet }
+		records := failureRecords(tx)
+		v, found := tx.Get("portknob-failures", subnet)
+		if !found && maxEntries != 0 && records >= maxEntries {
+			r.key = aggregate
+			v, found = tx.Get("portknob-failures", aggregate)
+			if !found {
+				evicted, err := evictFailures(tx, maxEntries, now)
+				if err != nil {
+					return err
+				}
+				r.evicted = evicted
+				records -= min(uint64(evicted), records)
+				if evicted == 0 {
+					r.dropped = true
+					return nil
+				}
+			}
+		}
+		first, prevCount, prevBannedUntil, ok := parseFailures(v)
+		if !ok || now.Sub(first) >= window || !prevBannedUntil.IsZero() {
+			first, prevCount = now, 0
+		}
+		r.count = prevCount + 1
+		until := "-"
+		if r.count >= maxFailures {
+			r.bannedUntil = now.Add(ban)
+			until = r.bannedUntil.Format(time.RFC3339Nano)
+		}
+		if !found {
+			records++
+		}
+		err := setFailureRecords(tx, records)
+		if err != nil {
+			return err
+		}
+		return tx.Put("portknob-failures", r.key, first.Format(time.RFC3339Nano) + " " + strconv.FormatUint(r.count, 10) + " " + until)
+	})
+	return
+}
+
+// Delete the unbanned failure records which started longest ago, a tenth of maxEntries at once so a flood pays for the scan only every so often
+func evictFailures(tx cacheTx, maxEntries uint64, now time.Time) (evicted int, err error) {
+	type record struct {
+		key		string
+		first	time.Time
+	}
+	var records []record
+	err = tx.ForEach("portknob-failures", func (k, v string) bool {
+		first, _, bannedUntil, _ := parseFailures(v)
+		if !bannedUntil.After(now) {
+			records = append(records, record { k, first })
+		}
+		return false
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(records, func (i, j int) bool { return records[i].first.Before(records[j].first) })
+	evicted = min(max(int(maxEntries / 10), 1), len(records))
+	for _, r := range records[:evicted] {
+		err = tx.Delete("portknob-failures", r.key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return evicted, nil
+}
+
+func (c *cache) FailureBan(subnet string) (bannedUntil time.Time, banned bool) {
+	now := time.Now().UTC()
+	c.store.View(func (tx cacheTx) error {
+		v, _ := tx.Get("portknob-failures", subnet)
+		_, _, bannedUntil, _ = parseFailures(v)
+		banned = bannedUntil.After(now)
+		return nil
+	})
+	return
+}
+
+// Return the subnets currently rate limited, with the end of their ban
+func (c *cache) FailureBans() (bans map[string]time.Time, err error) {
+	now := time.Now().UTC()
+	bans = make(map[string]time.Time)
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob-failures", func (k, v string) bool {
+			if _, _, bannedUntil, ok := parseFailures(v); ok && bannedUntil.After(now) {
+				bans[k] = bannedUntil
+			}
+			return false
+		})
+	})
+	return
+}
+
+func (c *cache) ClearFailures(subnet string) error {
+	err := c.store.Update(func (tx cacheTx) error {
+		if _, found := tx.Get("portknob-failures", subnet); !found {
+			return nil
+		}
+		if records := failureRecords(tx); records != 0 {
+			err := setFailureRecords(tx, records - 1)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Delete("portknob-failures", subnet)
+	})
+	return err
+}
+
+// Forget failed logins older than window and bans which ended, returning the subnets whose ban ended
+func (c *cache) CleanupFailures(window time.Duration) (unbanned []string, err error) {
+	now := time.Now().UTC()
+	err = c.store.Update(func (tx cacheTx) error {
+		unbanned = nil
+		// Counted again from scratch, which also corrects the count of databases from before it was kept
+		var records uint64
+		err := tx.ForEach("portknob-failures", func (k, v string) bool {
+			first, _, bannedUntil, ok := parseFailures(v)
+			if ok && (bannedUntil.After(now) || bannedUntil.IsZero() && now.Sub(first) < window) {
+				records++
+				return false
+			}
+			if !bannedUntil.IsZero() {
+				unbanned = append(unbanned, k)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return setFailureRecords(tx, records)
+	})
+	return
+}
+
+func parseFailures(v string) (first time.Time, count uint64, bannedUntil time.Time, ok bool) {
+	fields := strings.Fields(v)
+	if len(fields) != 3 {
+		return
+	}
+	first, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return
+	}
+	count, err = strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return
+	}
+	if fields[2] != "-" {
+		bannedUntil, err = time.Parse(time.RFC3339Nano, fields[2])
+		if err != nil {
+			return
+		}
+	}
+	return first, count, bannedUntil, true
+}
+
+func parseBan(v string) (expires time.Time, hits uint64, ok bool) {
+	fields := strings.Fields(v)
+	if len(fields) != 2 {
+		return
+	}
+	expires, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return
+	}
+	hits, err = strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return
+	}
+	return expires, hits, true
+}
+
+// Hours of denied packet counts kept by AddDenied
+const deniedHistoryHours = 24
+
+// Packets stopped by the deny rules of one denyLabel
+type deniedCount struct {
+	label	string
+	total	uint64
+	// The last deniedHistoryHours hours, the current one last
+	hourly	[]uint64
+}
+
+// Add packets stopped by the deny rules to their totals and the current hour, dropping hours older than deniedHistoryHours
+// Instances sharing the cache database add up their counts
+func (c *cache) AddDenied(hits map[string]uint64, now time.Time) error {
+	hour := now.UTC().Truncate(time.Hour)
+	oldest := hour.Add(-(deniedHistoryHours - 1) * time.Hour)
+	return c.store.Update(func (tx cacheTx) error {
+		for label, packets := range hits {
+			for _, key := range []string {"total " + label, hour.Format(time.RFC3339) + " " + label} {
+				v, _ := tx.Get("portknob-denied", key)
+				count, _ := strconv.ParseUint(v, 10, 64)
+				err := tx.Put("portknob-denied", key, strconv.FormatUint(count + packets, 10))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return tx.ForEach("portknob-denied", func (k, v string) bool {
+			at, err := time.Parse(time.RFC3339, strings.SplitN(k, " ", 2)[0])
+			return err == nil && at.Before(oldest)
+		})
+	})
+}
+
+// Return the packets stopped by the deny rules, sorted by label
+func (c *cache) Denied(now time.Time) (counts []deniedCount, err error) {
+	hour := now.UTC().Truncate(time.Hour)
+	byLabel := make(map[string]*deniedCount)
+	get := func (label string) *deniedCount {
+		if byLabel[label] == nil {
+			byLabel[label] = &deniedCount { label: label, hourly: make([]uint64, deniedHistoryHours) }
+		}
+		return byLabel[label]
+	}
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob-denied", func (k, v string) bool {
+			fields := strings.SplitN(k, " ", 2)
+			count, err := strconv.ParseUint(v, 10, 64)
+			if len(fields) != 2 || err != nil {
+				return false
+			}
+			if fields[0] == "total" {
+				get(fields[1]).total = count
+				return false
+			}
+			at, err := time.Parse(time.RFC3339, fields[0])
+			if err != nil {
+				return false
+			}
+			if i := deniedHistoryHours - 1 - int(hour.Sub(at) / time.Hour); i >= 0 && i < deniedHistoryHours {
+				get(fields[1]).hourly[i] = count
+			}
+			return false
+		})
+	})
+	for _, count := range byLabel {
+		counts = append(counts, *count)
+	}
+	sort.Slice(counts, func (i, j int) bool { return counts[i].label < counts[j].label })
+	return
+}
+
+// Where and when a login came from, for impossible-travel-kmh
+type travelRecord struct {
+	at			time.Time
+	addr		net.IP
+	country		string
+	latitude	float64
+	longitude	float64
+}
+
+func (r travelRecord) String() string {
+	country := r.country
+	if country == "" {
+		country = "-"
+	}
+	return strings.Join([]string {r.at.UTC().Format(time.RFC3339), r.addr.String(), country, strconv.FormatFloat(r.latitude, 'f', 4, 64), strconv.FormatFloat(r.longitude, 'f', 4, 64)}, " ")
+}
+
+func parseTravelRecord(v string) (r travelRecord, ok bool) {
+	fields := strings.Split(v, " ")
+	if len(fields) != 5 {
+		return r, false
+	}
+	var err1, err2, err3 error
+	r.at, err1 = time.Parse(time.RFC3339, fields[0])
+	r.addr = net.ParseIP(fields[1])
+	if fields[2] != "-" {
+		r.country = fields[2]
+	}
+	r.latitude, err2 = strconv.ParseFloat(fields[3], 64)
+	r.longitude, err3 = strconv.ParseFloat(fields[4], 64)
+	return r, err1 == nil && err2 == nil && err3 == nil && r.addr != nil
+}
+
+// Return the login of user the next one is checked against
+func (c *cache) LastLogin(user string) (r travelRecord, ok bool) {
+	c.store.View(func (tx cacheTx) error {
+		var v string
+		v, ok = tx.Get("portknob-travel", "last " + user)
+		if ok {
+			r, ok = parseTravelRecord(v)
+		}
+		return nil
+	})
+	return
+}
+
+func (c *cache) SetLastLogin(user string, r travelRecord) error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.Put("portknob-travel", "last " + user, r.String())
+	})
+}
+
+// Record a login of user refused for impossible travel, replacing an older one
+func (c *cache) HoldTravel(user string, r travelRecord) error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.Put("portknob-travel", "held " + user, r.String())
+	})
+}
+
+// Return the held logins by user
+func (c *cache) TravelHolds() (holds map[string]travelRecord, err error) {
+	holds = make(map[string]travelRecord)
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob-travel", func (k, v string) bool {
+			if user := strings.TrimPrefix(k, "held "); user != k {
+				if r, ok := parseTravelRecord(v); ok {
+					holds[user] = r
+				}
+			}
+			return false
+		})
+	})
+	return
+}
+
+// Remove the held login of user, making it the one the next is checked against if confirm
+func (c *cache) ReleaseTravel(user string, confirm bool) (r travelRecord, found bool, err error) {
+	err = c.store.Update(func (tx cacheTx) error {
+		var v string
+		v, found = tx.Get("portknob-travel", "held " + user)
+		if !found {
+			return nil
+		}
+		r, _ = parseTravelRecord(v)
+		if confirm {
+			err := tx.Put("portknob-travel", "last " + user, v)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Delete("portknob-travel", "held " + user)
+	})
+	return
+}
+
+// A share link, stored under the SHA-256 of its token, which only its creator ever sees
+type shareLink struct {
+	user		string
+	// key() of the firewall rule it opens
+	rule		string
+	created		time.Time
+	expires		time.Time
+	// Credential epoch of the user at creation, revoking the user voids the links
+	epoch		uint64
+}
+
+func (l shareLink) String() string {
+	return strings.Join([]string {l.created.UTC().Format(time.RFC3339), l.expires.UTC().Format(time.RFC3339), strconv.FormatUint(l.epoch, 10), l.user, l.rule}, "\n")
+}
+
+func parseShareLink(v string) (l shareLink, ok bool) {
+	fields := strings.SplitN(v, "\n", 5)
+	if len(fields) != 5 {
+		return l, false
+	}
+	var err1, err2, err3 error
+	l.created, err1 = time.Parse(time.RFC3339, fields[0])
+	l.expires, err2 = time.Parse(time.RFC3339, fields[1])
+	l.epoch, err3 = strconv.ParseUint(fields[2], 10, 64)
+	l.user, l.rule = fields[3], fields[4]
+	return l, err1 == nil && err2 == nil && err3 == nil
+}
+
+func (c *cache) AddShare(hash string, l shareLink) error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.Put("portknob-shares", hash, l.String())
+	})
+}
+
+// Return the link stored under hash, false if there is none or it expired by now
+func (c *cache) Share(hash string, now time.Time) (l shareLink, ok bool) {
+	c.store.View(func (tx cacheTx) error {
+		var v string
+		v, ok = tx.Get("portknob-shares", hash)
+		if ok {
+			l, ok = parseShareLink(v)
+		}
+		return nil
+	})
+	return l, ok && now.Before(l.expires)
+}
+
+// Remove the link stored under hash and return it, false if there was none or it expired by now
+// Both happen in one transaction, so a link opened twice at once still works only once
+func (c *cache) UseShare(hash string, now time.Time) (l shareLink, ok bool, err error) {
+	err = c.store.Update(func (tx cacheTx) error {
+		var v string
+		v, ok = tx.Get("portknob-shares", hash)
+		if !ok {
+			return nil
+		}
+		l, ok = parseShareLink(v)
+		ok = ok && now.Before(l.expires)
+		return tx.Delete("portknob-shares", hash)
+	})
+	if err != nil {
+		ok = false
+	}
+	return
+}
+
+// Return the links of user which did not expire by now, by hash
+func (c *cache) Shares(user string, now time.Time) (links map[string]shareLink, err error) {
+	links = make(map[string]shareLink)
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob-shares", func (k, v string) bool {
+			if l, ok := parseShareLink(v); ok && l.user == user && now.Before(l.expires) {
+				links[k] = l
+			}
+			return false
+		})
+	})
+	return
+}
+
+// Remove the links of user whose hash begins with id, returning whether there was one
+func (c *cache) RevokeShare(user, id string) (found bool, err error) {
+	if id == "" {
+		return false, nil
+	}
+	err = c.store.Update(func (tx cacheTx) error {
+		return tx.ForEach("portknob-shares", func (k, v string) bool {
+			l, _ := parseShareLink(v)
+			if strings.HasPrefix(k, id) && l.user == user {
+				found = true
+				return true
+			}
+			return false
+		})
+	})
+	if err != nil {
+		found = false
+	}
+	return
+}
+
+// Remove the links which expired by now, and those which do not parse
+func (c *cache) CleanupShares(now time.Time) error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.ForEach("portknob-shares", func (k, v string) bool {
+			l, ok := parseShareLink(v)
+			return !ok || !now.Before(l.expires)
+		})
+	})
+}
+
+// A login by cookie waiting for cookie-grant-delay, stored under the SHA-256 of the token which cancels it
+type pendingGrant struct {
+	activate	time.Time
+	addr		net.IP
+	user		string
+	// Arguments of the grant, deadline being zero without one
+	groups		[]string
+	skip		[]string
+	timeout		time.Duration
+	deadline	time.Time
+	// Credential epoch of user at the login, a revocation meanwhile drops the grant
+	epoch		uint64
+}
+
+func (p pendingGrant) String() string {
+	deadline := "-"
+	if !p.deadline.IsZero() {
+		deadline = p.deadline.UTC().Format(time.RFC3339)
+	}
+	return strings.Join([]string {p.activate.UTC().Format(time.RFC3339), p.addr.String(), strconv.FormatInt(int64(p.timeout / time.Second), 10), deadline, quoteList(p.groups), quoteList(p.skip), strconv.FormatUint(p.epoch, 10), p.user}, "\n")
+}
+
+func parsePendingGrant(v string) (p pendingGrant, ok bool) {
+	fields := strings.SplitN(v, "\n", 8)
+	if len(fields) != 8 {
+		return p, false
+	}
+	var err1, err2, err3, err4, err5, err6 error
+	p.activate, err1 = time.Parse(time.RFC3339, fields[0])
+	p.addr = net.ParseIP(fields[1])
+	timeout, err2 := strconv.ParseInt(fields[2], 10, 64)
+	p.timeout = time.Duration(timeout) * time.Second
+	if fields[3] != "-" {
+		p.deadline, err3 = time.Parse(time.RFC3339, fields[3])
+	}
+	p.groups, err4 = unquoteList(fields[4])
+	p.skip, err5 = unquoteList(fields[5])
+	p.epoch, err6 = strconv.ParseUint(fields[6], 10, 64)
+	p.user = fields[7]
+	return p, err1 == nil && err2 == nil && err3 == nil && err4 == nil && err5 == nil && err6 == nil && p.addr != nil
+}
+
+// Rule groups as quoted strings separated by spaces, as "" stands for rules without a group
+func quoteList(list []string) string {
+	quoted := make([]string, len(list))
+	for i, s := range list {
+		quoted[i] = strconv.Quote(s)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func unquoteList(v string) (list []string, err error) {
+	for _, field := range strings.Fields(v) {
+		s, err := strconv.Unquote(field)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+func (c *cache) AddPendingGrant(hash string, p pendingGrant) error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.Put("portknob-pending", hash, p.String())
+	})
+}
+
+// Return the grants still activating by hash, including those due
+func (c *cache) PendingGrants() (grants map[string]pendingGrant, err error) {
+	grants = make(map[string]pendingGrant)
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob-pending", func (k, v string) bool {
+			if p, ok := parsePendingGrant(v); ok {
+				grants[k] = p
+			}
+			return false
+		})
+	})
+	return
+}
+
+// Remove the grants due by now and return them by hash, records which do not parse are removed too
+// Another instance sharing the cache cannot take the same ones
+func (c *cache) TakePendingGrants(now time.Time) (due map[string]pendingGrant, err error) {
+	err = c.store.Update(func (tx cacheTx) error {
+		due = make(map[string]pendingGrant)
+		return tx.ForEach("portknob-pending", func (k, v string) bool {
+			p, ok := parsePendingGrant(v)
+			if ok && now.Before(p.activate) {
+				return false
+			}
+			if ok {
+				due[k] = p
+			}
+			return true
+		})
+	})
+	if err != nil {
+		due = nil
+	}
+	return
+}
+
+// Remove the grant under hash before it activates, returning it
+func (c *cache) CancelPendingGrant(hash string) (p pendingGrant, found bool, err error) {
+	err = c.store.Update(func (tx cacheTx) error {
+		var v string
+		v, found = tx.Get("portknob-pending", hash)
+		if !found {
+			return nil
+		}
+		p, _ = parsePendingGrant(v)
+		return tx.Delete("portknob-pending", hash)
+	})
+	if err != nil {
+		found = false
+	}
+	return
+}
+
+// Register the Ed25519 key of user in the authorized_keys format, under its fingerprint
+func (c *cache) AddLoginKey(user, fingerprint, key string) error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.Put("portknob-keys", user + "\n" + fingerprint, key)
+	})
+}
+
+func (c *cache) RemoveLoginKey(user, fingerprint string) (found bool, err error) {
+	err = c.store.Update(func (tx cacheTx) error {
+		_, found = tx.Get("portknob-keys", user + "\n" + fingerprint)
+		if !found {
+			return nil
+		}
+		return tx.Delete("portknob-keys", user + "\n" + fingerprint)
+	})
+	if err != nil {
+		found = false
+	}
+	return
+}
+
+// Return the registered keys by user
+func (c *cache) LoginKeys() (keys map[string][]string, err error) {
+	keys = make(map[string][]string)
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob-keys", func (k, v string) bool {
+			if i := strings.LastIndex(k, "\n"); i >= 0 {
+				keys[k[:i]] = append(keys[k[:i]], v)
+			}
+			return false
+		})
+	})
+	return
+}
+
+// A challenge of a key login, stored under its SHA-256 until it is used or expires
+type keyChallenge struct {
+	user		string
+	subnet		string
+	expires		time.Time
+}
+
+func (c keyChallenge) String() string {
+	return strings.Join([]string {c.expires.UTC().Format(time.RFC3339), c.subnet, c.user}, "\n")
+}
+
+func parseKeyChallenge(v string) (c keyChallenge, ok bool) {
+	fields := strings.SplitN(v, "\n", 3)
+	if len(fields) != 3 {
+		return c, false
+	}
+	var err error
+	c.expires, err = time.Parse(time.RFC3339, fields[0])
+	c.subnet, c.user = fields[1], fields[2]
+	return c, err == nil
+}
+
+func (c *cache) AddKeyChallenge(hash string, challenge keyChallenge) error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.Put("portknob-challenges", hash, challenge.String())
+	})
+}
+
+// Remove the challenge under hash and return it, ok is false if it is unknown or expired by now
+func (c *cache) UseKeyChallenge(hash string, now time.Time) (challenge keyChallenge, ok bool, err error) {
+	err = c.store.Update(func (tx cacheTx) error {
+		v, found := tx.Get("portknob-challenges", hash)
+		if !found {
+			return nil
+		}
+		challenge, ok = parseKeyChallenge(v)
+		ok = ok && now.Before(challenge.expires)
+		return tx.Delete("portknob-challenges", hash)
+	})
+	if err != nil {
+		ok = false
+	}
+	return
+}
+
+// Remove the challenges which expired by now, and those which do not parse
+func (c *cache) CleanupKeyChallenges(now time.Time) error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.ForEach("portknob-challenges", func (k, v string) bool {
+			challenge, ok := parseKeyChallenge(v)
+			return !ok || !now.Before(challenge.expires)
+		})
+	})
+}
+
+// A whitelist entry on probation, keyed by the subnet and group of its firewall element
+type probationEntry struct {
+	addr		net.IP
+	group		string
+	user		string
+	// End of probation-window, and the expiry the entry gets once it passes, zero for none
+	watchUntil	time.Time
+	expires		time.Time
+}
+
+func (p probationEntry) key(subnet *net.IPNet) string {
+	return subnet.String() + " " + p.group
+}
+
+func (p probationEntry) String() string {
+	expires := "-"
+	if !p.expires.IsZero() {
+		expires = p.expires.UTC().Format(time.RFC3339)
+	}
+	return strings.Join([]string {p.addr.String(), p.watchUntil.UTC().Format(time.RFC3339), expires, strconv.Quote(p.group), p.user}, "\n")
+}
+
+func parseProbationEntry(v string) (p probationEntry, ok bool) {
+	fields := strings.SplitN(v, "\n", 5)
+	if len(fields) != 5 {
+		return p, false
+	}
+	var err1, err2, err3 error
+	p.addr = net.ParseIP(fields[0])
+	p.watchUntil, err1 = time.Parse(time.RFC3339, fields[1])
+	if fields[2] != "-" {
+		p.expires, err2 = time.Parse(time.RFC3339, fields[2])
+	}
+	p.group, err3 = strconv.Unquote(fields[3])
+	p.user = fields[4]
+	return p, err1 == nil && err2 == nil && err3 == nil && p.addr != nil
+}
+
+// Put an entry on probation, a login while it already is only updates the expiry it gets once it passes
+func (c *cache) AddProbation(key string, p probationEntry) error {
+	return c.store.Update(func (tx cacheTx) error {
+		if v, found := tx.Get("portknob-probation", key); found {
+			if prev, ok := parseProbationEntry(v); ok {
+				p.watchUntil = prev.watchUntil
+			}
+		}
+		return tx.Put("portknob-probation", key, p.String())
+	})
+}
+
+// Return the entries on probation by key, records which do not parse are left out
+func (c *cache) Probations() (probations map[string]probationEntry, err error) {
+	probations = make(map[string]probationEntry)
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob-probation", func (k, v string) bool {
+			if p, ok := parseProbationEntry(v); ok {
+				probations[k] = p
+			}
+			return false
+		})
+	})
+	return
+}
+
+// End the probation under key, recording at now that user passed it unless user is empty
+func (c *cache) EndProbation(key, user string, now time.Time) error {
+	return c.store.Update(func (tx cacheTx) error {
+		if user != "" {
+			err := tx.Put("portknob-probation-passed", user, now.UTC().Format(time.RFC3339))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Delete("portknob-probation", key)
+	})
+}
+
+// Whether a login of user passed probation before
+func (c *cache) PassedProbation(user string) (passed bool) {
+	c.store.View(func (tx cacheTx) error {
+		_, passed = tx.Get("portknob-probation-passed", user)
+		return nil
+	})
+	return
+}
+
+// A verdict of the [authz] authorizer on a rule for a user, keyed by the user and the key of the rule
+type authzVerdict struct {
+	allowed		bool
+	// Seconds the authorizer set for the lifespan, 0 for the lifespan of the rule
+	lifespan	uint64
+	reason		string
+	expires		time.Time
+}
+
+func (v authzVerdict) String() string {
+	verdict := "deny"
+	if v.allowed {
+		verdict = "allow"
+	}
+	return strings.Join([]string {v.expires.UTC().Format(time.RFC3339), verdict, strconv.FormatUint(v.lifespan, 10), strconv.Quote(v.reason)}, "\n")
+}
+
+func parseAuthzVerdict(v string) (verdict authzVerdict, ok bool) {
+	fields := strings.SplitN(v, "\n", 4)
+	if len(fields) != 4 || (fields[1] != "allow" && fields[1] != "deny") {
+		return verdict, false
+	}
+	var err1, err2, err3 error
+	verdict.expires, err1 = time.Parse(time.RFC3339, fields[0])
+	verdict.allowed = fields[1] == "allow"
+	verdict.lifespan, err2 = strconv.ParseUint(fields[2], 10, 64)
+	verdict.reason, err3 = strconv.Unquote(fields[3])
+	return verdict, err1 == nil && err2 == nil && err3 == nil
+}
+
+// Store the verdicts on rules by key for user until expires
+func (c *cache) SetAuthzVerdicts(user string, verdicts map[string]authzVerdict, expires time.Time) error {
+	return c.store.Update(func (tx cacheTx) error {
+		for key, verdict := range verdicts {
+			verdict.expires = expires
+			err := tx.Put("portknob-authz", user + "\n" + key, verdict.String())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Return the verdicts for user on the rules of keys which have not expired by now
+func (c *cache) AuthzVerdicts(user string, keys []string, now time.Time) (verdicts map[string]authzVerdict) {
+	verdicts = make(map[string]authzVerdict)
+	c.store.View(func (tx cacheTx) error {
+		for _, key := range keys {
+			v, found := tx.Get("portknob-authz", user + "\n" + key)
+			if !found {
+				continue
+			}
+			if verdict, ok := parseAuthzVerdict(v); ok && now.Before(verdict.expires) {
+				verdicts[key] = verdict
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Remove the verdicts which expired by now, and those which do not parse
+func (c *cache) CleanupAuthzVerdicts(now time.Time) error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.ForEach("portknob-authz", func (k, v string) bool {
+			verdict, ok := parseAuthzVerdict(v)
+			return !ok || !now.Before(verdict.expires)
+		})
+	})
+}
+
+// Record a successful login from subnet at now
+func (c *cache) SetKnownSubnet(subnet string, now time.Time) error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.Put("portknob-known-subnets", subnet, now.UTC().Format(time.RFC3339))
+	})
+}
+
+// Whether subnet had a successful login after since
+func (c *cache) KnownSubnet(subnet string, since time.Time) (known bool) {
+	c.store.View(func (tx cacheTx) error {
+		v, found := tx.Get("portknob-known-subnets", subnet)
+		if !found {
+			return nil
+		}
+		at, err := time.Parse(time.RFC3339, v)
+		known = err == nil && at.After(since)
+		return nil
+	})
+	return
+}
+
+// Forget the subnets without a successful login after since, and the records which do not parse
+func (c *cache) CleanupKnownSubnets(since time.Time) error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.ForEach("portknob-known-subnets", func (k, v string) bool {
+			at, err := time.Parse(time.RFC3339, v)
+			return err != nil || !at.After(since)
+		})
+	})
+}
+
+// What the admin API did to the key of a [[device-key]], devices without one use the key of the configuration
+type deviceKeyState struct {
+	revoked			bool
+	// SHA-256 of the key of the last rotation
+	hash			string
+	// SHA-256 of the key before it, "config" for the key of the configuration, empty for none
+	previous		string
+	previousUntil	time.Time
+}
+
+func (st deviceKeyState) String() string {
+	state := "active"
+	if st.revoked {
+		state = "revoked"
+	}
+	until := ""
+	if !st.previousUntil.IsZero() {
+		until = st.previousUntil.UTC().Format(time.RFC3339)
+	}
+	return strings.Join([]string {state, st.hash, st.previous, until}, "\n")
+}
+
+func parseDeviceKeyState(v string) (st deviceKeyState, ok bool) {
+	fields := strings.Split(v, "\n")
+	if len(fields) != 4 || (fields[0] != "active" && fields[0] != "revoked") {
+		return st, false
+	}
+	st.revoked, st.hash, st.previous = fields[0] == "revoked", fields[1], fields[2]
+	if fields[3] != "" {
+		var err error
+		st.previousUntil, err = time.Parse(time.RFC3339, fields[3])
+		if err != nil {
+			return st, false
+		}
+	}
+	return st, true
+}
+
+// Return the state of the device keys by device name
+func (c *cache) DeviceKeyStates() (states map[string]deviceKeyState, err error) {
+	states = make(map[string]deviceKeyState)
+	err = c.store.View(func (tx cacheTx) error {
+		return tx.ForEach("portknob-device-keys", func (k, v string) bool {
+			if st, ok := parseDeviceKeyState(v); ok {
+				states[k] = st
+			}
+			return false
+		})
+	})
+	return
+}
+
+func (c *cache) SetDeviceKeyState(name string, st deviceKeyState) error {
+	return c.store.Update(func (tx cacheTx) error {
+		return tx.Put("portknob-device-keys", name, st.String())
+	})
+}
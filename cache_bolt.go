@@ -0,0 +1,325 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+	"github.com/boltdb/bolt"
+)
+
+// Cache database in a BoltDB file, only one process may open it
+type boltStore struct {
+	conf	*config
+	db		*bolt.DB
+}
+
+// cacheMigrations[i] upgrades a database from version i+1 to version i+2
+var cacheMigrations = []func (tx *bolt.Tx) error {
+	// 1 -> 2: honeypot bans
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-bans"))
+		return err
+	},
+	// 2 -> 3: time of the last password login per subnet, for reauth-after
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-auth"))
+		return err
+	},
+	// 3 -> 4: whitelist keys may carry a rule group after the address, existing keys belong to rules without a group
+	func (tx *bolt.Tx) error {
+		return nil
+	},
+	// 4 -> 5: whitelist values may carry the creation time and user after the expiry, subnets revoked by the admin API
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-revoked"))
+		return err
+	},
+	// 5 -> 6: failed logins per subnet, for auth-max-failures
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-failures"))
+		return err
+	},
+	// 6 -> 7: last TOTP time step used per user, against replayed codes
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-totp"))
+		return err
+	},
+	// 7 -> 8: credential epoch per user, advanced by revocations to invalidate login cookies
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-epochs"))
+		return err
+	},
+	// 8 -> 9: journal of grants changing the firewall, replayed after a crash
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-journal"))
+		return err
+	},
+	// 9 -> 10: packets stopped by the deny rules, in total and by hour
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-denied"))
+		return err
+	},
+	// 10 -> 11: location of the last login per user and logins held for impossible travel
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-travel"))
+		return err
+	},
+	// 11 -> 12: whitelist creation times may carry the host which wrote them after an "@"
+	func (tx *bolt.Tx) error {
+		return nil
+	},
+	// 12 -> 13: share links
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-shares"))
+		return err
+	},
+	// 13 -> 14: grants of cookie-grant-delay still activating
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-pending"))
+		return err
+	},
+	// 14 -> 15: login keys and their challenges
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-keys"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("portknob-challenges"))
+		return err
+	},
+	// 15 -> 16: whitelist entries on probation and the users who passed it
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-probation"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("portknob-probation-passed"))
+		return err
+	},
+	// 16 -> 17: verdicts of the [authz] authorizer
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-authz"))
+		return err
+	},
+	// 17 -> 18: subnets with successful logins, for [defense]
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-known-subnets"))
+		return err
+	},
+	// 18 -> 19: who granted the whitelist entries of the admin API and the control socket
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-granted-by"))
+		return err
+	},
+	// 19 -> 20: keys of [[device-key]] rotated or revoked through the admin API
+	func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob-device-keys"))
+		return err
+	},
+}
+
+func (s *boltStore) Start() error {
+	var err error
+	// Read-only, the file is locked shared, so any number of replicas may read a copy but not the file the daemon has open
+	s.db, err = bolt.Open(s.conf.Daemon.CacheDatabase, 0600, &bolt.Options { Timeout: 10 * time.Second, ReadOnly: s.conf.readOnly })
+	if err != nil {
+		return err
+	}
+	err = s.migrate()
+	if err != nil {
+		s.db.Close()
+	}
+	return err
+}
+
+func (s *boltStore) migrate() error {
+	var version uint64
+	err := s.db.View(func (tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if version == cacheSchemaVersion {
+		return nil
+	}
+	if s.conf.readOnly {
+		return &cacheReadOnlyError { s.conf.Daemon.CacheDatabase, version }
+	}
+	if version > cacheSchemaVersion && !s.conf.forceDowngrade {
+		return &cacheVersionError { s.conf.Daemon.CacheDatabase, version }
+	}
+
+	if version != 0 {
+		backup := fmt.Sprintf("%s.v%d.bak", s.conf.Daemon.CacheDatabase, version)
+		err = s.db.View(func (tx *bolt.Tx) error {
+			return tx.CopyFile(backup, 0600)
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Migrating cache database %q from schema version %d to %d, backup saved to %q\n", s.conf.Daemon.CacheDatabase, version, cacheSchemaVersion, backup)
+	}
+
+	return s.db.Update(func (tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("portknob"))
+		if err != nil {
+			return err
+		}
+		if version == 0 {
+			// A new database, nothing to migrate
+			for _, name := range cacheBuckets {
+				_, err := tx.CreateBucketIfNotExists([]byte(name))
+				if err != nil {
+					return err
+				}
+			}
+		} else if version > cacheSchemaVersion {
+			var unknown [][]byte
+			tx.ForEach(func (name []byte, b *bolt.Bucket) error {
+				for _, known := range cacheBuckets {
+					if string(name) == known {
+						return nil
+					}
+				}
+				unknown = append(unknown, append([]byte(nil), name...))
+				return nil
+			})
+			for _, name := range unknown {
+				log.Printf("Dropping bucket %q unknown to this version from cache database\n", name)
+				err = tx.DeleteBucket(name)
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			for i := version; i < cacheSchemaVersion; i++ {
+				err = cacheMigrations[i - 1](tx)
+				if err != nil {
+					return fmt.Errorf("cannot migrate cache database to schema version %d: %s", i + 1, err)
+				}
+			}
+		}
+		meta, err := tx.CreateBucketIfNotExists([]byte("portknob-meta"))
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte("schema-version"), []byte(strconv.FormatUint(cacheSchemaVersion, 10)))
+	})
+}
+
+// Return the schema version of a database, 0 means a new database
+func schemaVersion(tx *bolt.Tx) uint64 {
+	meta := tx.Bucket([]byte("portknob-meta"))
+	if meta == nil {
+		if tx.Bucket([]byte("portknob")) != nil {
+			// Written before schema versions were introduced
+			return 1
+		}
+		return 0
+	}
+	version, err := strconv.ParseUint(string(meta.Get([]byte("schema-version"))), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+func (s *boltStore) PrintInfo(w io.Writer) error {
+	db, err := bolt.Open(s.conf.Daemon.CacheDatabase, 0600, &bolt.Options { Timeout: 1 * time.Second, ReadOnly: true })
+	if err == bolt.ErrTimeout {
+		return fmt.Errorf("cache database %q is in use, stop portknob first", s.conf.Daemon.CacheDatabase)
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func (tx *bolt.Tx) error {
+		fmt.Fprintf(w, "database: %s\nschema version: %d (this binary: %d)\n", s.conf.Daemon.CacheDatabase, schemaVersion(tx), cacheSchemaVersion)
+		return tx.ForEach(func (name []byte, b *bolt.Bucket) error {
+			fmt.Fprintf(w, "%s: %d entries\n", name, b.Stats().KeyN)
+			return nil
+		})
+	})
+}
+
+func (s *boltStore) Size() (size int64, err error) {
+	err = s.db.View(func (tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return
+}
+
+func (s *boltStore) Stop() {
+	s.db.Close()
+}
+
+func (s *boltStore) View(fn func (tx cacheTx) error) error {
+	return s.db.View(func (tx *bolt.Tx) error {
+		return fn(boltTx { tx })
+	})
+}
+
+func (s *boltStore) Update(fn func (tx cacheTx) error) error {
+	return s.db.Update(func (tx *bolt.Tx) error {
+		return fn(boltTx { tx })
+	})
+}
+
+type boltTx struct {
+	tx			*bolt.Tx
+}
+
+func (t boltTx) Get(bucket, key string) (string, bool) {
+	v := t.tx.Bucket([]byte(bucket)).Get([]byte(key))
+	return string(v), v != nil
+}
+
+func (t boltTx) Put(bucket, key, value string) error {
+	return t.tx.Bucket([]byte(bucket)).Put([]byte(key), []byte(value))
+}
+
+func (t boltTx) Delete(bucket, key string) error {
+	return t.tx.Bucket([]byte(bucket)).Delete([]byte(key))
+}
+
+func (t boltTx) ForEach(bucket string, cb func (key, value string) bool) error {
+	b := t.tx.Bucket([]byte(bucket))
+	// Deleting under a cursor skips the key after the deleted one
+	var deleted [][]byte
+	cur := b.Cursor()
+	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		if cb(string(k), string(v)) {
+			deleted = append(deleted, k)
+		}
+	}
+	for _, k := range deleted {
+		err := b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"github.com/boltdb/bolt"
+)
+
+// Write a database as an older or newer binary would have left it
+func writeBoltDatabase(t *testing.T, path string, version uint64, buckets []string) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func (tx *bolt.Tx) error {
+		for _, name := range buckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+		err := tx.Bucket([]byte("portknob")).Put([]byte("192.0.2.0/24"), []byte("never"))
+		if err != nil {
+			return err
+		}
+		if version < 2 {
+			return nil
+		}
+		meta, err := tx.CreateBucketIfNotExists([]byte("portknob-meta"))
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte("schema-version"), []byte(strconv.FormatUint(version, 10)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltMigrate(t *testing.T) {
+	tests := []struct {
+		name			string
+		// Schema version of the existing database, 0 for none
+		version			uint64
+		buckets			[]string
+		forceDowngrade	bool
+		wantErr			bool
+		wantBackup		bool
+		wantDropped		string
+	}{
+		{ "new database", 0, nil, false, false, false, "" },
+		{ "before schema versions", 1, []string {"portknob"}, false, false, true, "" },
+		{ "version 2", 2, []string {"portknob", "portknob-bans"}, false, false, true, "" },
+		{ "version 4", 4, []string {"portknob", "portknob-bans", "portknob-auth"}, false, false, true, "" },
+		{ "version 6", 6, []string {"portknob", "portknob-bans", "portknob-auth", "portknob-revoked", "portknob-failures"}, false, false, true, "" },
+		{ "version 8", 8, []string {"portknob", "portknob-meta", "portknob-bans", "portknob-auth", "portknob-revoked", "portknob-failures", "portknob-totp", "portknob-epochs"}, false, false, true, "" },
+		{ "current version", cacheSchemaVersion, cacheBuckets, false, false, false, "" },
+		{ "newer version", cacheSchemaVersion + 1, append([]string {"portknob-future"}, cacheBuckets...), false, true, false, "" },
+		{ "forced downgrade", cacheSchemaVersion + 1, append([]string {"portknob-future"}, cacheBuckets...), true, false, true, "portknob-future" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			conf := &config { forceDowngrade: tt.forceDowngrade }
+			conf.Daemon.CacheDatabase = filepath.Join(t.TempDir(), "cache.db")
+			if tt.version != 0 {
+				writeBoltDatabase(t, conf.Daemon.CacheDatabase, tt.version, tt.buckets)
+			}
+			s := &boltStore { conf: conf }
+			err := s.Start()
+			if tt.wantErr {
+				var versionErr *cacheVersionError
+				if !errors.As(err, &versionErr) {
+					t.Fatalf("Start() = %v, want a cacheVersionError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			backup := conf.Daemon.CacheDatabase + ".v" + strconv.FormatUint(tt.version, 10) + ".bak"
+			_, err = os.Stat(backup)
+			if (err == nil) != tt.wantBackup {
+				t.Errorf("backup %q exists = %v, want %v", backup, err == nil, tt.wantBackup)
+			}
+
+			err = s.db.View(func (tx *bolt.Tx) error {
+				if v := schemaVersion(tx); v != cacheSchemaVersion {
+					t.Errorf("schema version = %d, want %d", v, cacheSchemaVersion)
+				}
+				for _, name := range cacheBuckets {
+					if tx.Bucket([]byte(name)) == nil {
+						t.Errorf("bucket %q missing", name)
+					}
+				}
+				if tt.wantDropped != "" && tx.Bucket([]byte(tt.wantDropped)) != nil {
+					t.Errorf("bucket %q not dropped", tt.wantDropped)
+				}
+				if tt.version != 0 && string(tx.Bucket([]byte("portknob")).Get([]byte("192.0.2.0/24"))) != "never" {
+					t.Error("whitelist entry lost in migration")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"strings"
+	"time"
+	"github.com/redis/go-redis/v9"
+)
+
+// Cache database in Redis, which instances on several hosts may share
+// Every entry is a string key made of cache-key-prefix, the bucket, a colon and the entry key
+type redisStore struct {
+	conf	*config
+	client	*redis.Client
+}
+
+// Attempts of a read-write transaction before giving up on other instances writing the same keys
+const redisTxAttempts = 10
+
+
+func (s *redisStore) Start() error {
+	opt, err := redis.ParseURL(s.conf.Daemon.CacheDatabase)
+	if err != nil {
+		return fmt.Errorf("cannot parse cache database URL: %s", err)
+	}
+	s.client = redis.NewClient(opt)
+	err = s.client.Ping(context.Background()).Err()
+	if err == nil {
+		err = checkSchemaVersion(s.conf, s)
+	}
+	if err != nil {
+		s.client.Close()
+		return fmt.Errorf("cannot connect to cache database %q: %s", s.redactedURL(), err)
+	}
+	return nil
+}
+
+func (s *redisStore) Stop() {
+	s.client.Close()
+}
+
+// The URL without its password, for logging
+func (s *redisStore) redactedURL() string {
+	u, err := url.Parse(s.conf.Daemon.CacheDatabase)
+	if err != nil {
+		return "redis"
+	}
+	return u.Redacted()
+}
+
+func (s *redisStore) prefix(bucket string) string {
+	return s.conf.Daemon.CacheKeyPrefix + bucket + ":"
+}
+
+func (s *redisStore) View(fn func (tx cacheTx) error) error {
+	return fn(&redisTx { store: s, cmd: s.client })
+}
+
+// Keys read are watched, and writes are only committed if none of them changed meanwhile, otherwise fn runs again
+func (s *redisStore) Update(fn func (tx cacheTx) error) error {
+	ctx := context.Background()
+	for i := 0; i < redisTxAttempts; i++ {
+		err := s.client.Watch(ctx, func (rtx *redis.Tx) error {
+			tx := &redisTx { store: s, cmd: rtx, watch: rtx }
+			err := fn(tx)
+			if err == nil {
+				err = tx.err
+			}
+			if err != nil || len(tx.writes) == 0 {
+				return err
+			}
+			_, err = rtx.TxPipelined(ctx, func (pipe redis.Pipeliner) error {
+				for _, write := range tx.writes {
+					write(pipe)
+				}
+				return nil
+			})
+			return err
+		})
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+		// Let the other writer finish instead of colliding with it again
+		time.Sleep(time.Duration(rand.Int63n(int64(i + 1) * int64(10 * time.Millisecond))))
+	}
+	return fmt.Errorf("cache database transaction failed %d times, too many concurrent writers", redisTxAttempts)
+}
+
+func (s *redisStore) Size() (size int64, err error) {
+	err = s.View(func (tx cacheTx) error {
+		for _, bucket := range cacheBuckets {
+			err := tx.ForEach(bucket, func (k, v string) bool {
+				size += int64(len(s.prefix(bucket)) + len(k) + len(v))
+				return false
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (s *redisStore) PrintInfo(w io.Writer) error {
+	err := s.Start()
+	if err != nil {
+		return err
+	}
+	defer s.Stop()
+	return s.View(func (tx cacheTx) error {
+		version, _ := tx.Get("portknob-meta", "schema-version")
+		fmt.Fprintf(w, "database: %s\nschema version: %s (this binary: %d)\n", s.redactedURL(), version, cacheSchemaVersion)
+		for _, bucket := range cacheBuckets {
+			var count int
+			err := tx.ForEach(bucket, func (k, v string) bool {
+				count++
+				return false
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s: %d entries\n", bucket, count)
+		}
+		return nil
+	})
+}
+
+type redisTx struct {
+	store		*redisStore
+	cmd			redis.Cmdable
+	// Set in read-write transactions only
+	watch		*redis.Tx
+	writes		[]func (pipe redis.Pipeliner)
+	err			error
+}
+
+func (t *redisTx) Get(bucket, key string) (value string, ok bool) {
+	ctx := context.Background()
+	k := t.store.prefix(bucket) + key
+	if t.watch != nil {
+		err := t.watch.Watch(ctx, k).Err()
+		if err != nil {
+			t.err = err
+			return
+		}
+	}
+	value, err := t.cmd.Get(ctx, k).Result()
+	if err != nil && err != redis.Nil {
+		t.err = err
+	}
+	return value, err == nil
+}
+
+func (t *redisTx) Put(bucket, key, value string) error {
+	k := t.store.prefix(bucket) + key
+	if t.watch == nil {
+		return errors.New("cannot write to the cache database in a read-only transaction")
+	}
+	t.writes = append(t.writes, func (pipe redis.Pipeliner) {
+		pipe.Set(context.Background(), k, value, 0)
+	})
+	return nil
+}
+
+func (t *redisTx) Delete(bucket, key string) error {
+	k := t.store.prefix(bucket) + key
+	if t.watch == nil {
+		return errors.New("cannot write to the cache database in a read-only transaction")
+	}
+	t.writes = append(t.writes, func (pipe redis.Pipeliner) {
+		pipe.Del(context.Background(), k)
+	})
+	return nil
+}
+
+// Removed entries are watched and deleted with the other writes of the transaction,
+// which runs again if another instance changed or removed one of them first, so only one instance acts on a removal
+func (t *redisTx) ForEach(bucket string, cb func (key, value string) bool) error {
+	ctx := context.Background()
+	prefix := t.store.prefix(bucket)
+	var cursor uint64
+	for {
+		keys, next, err := t.cmd.Scan(ctx, cursor, redisGlobEscape(prefix) + "*", 100).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) != 0 {
+			values, err := t.cmd.MGet(ctx, keys...).Result()
+			if err != nil {
+				return err
+			}
+			for i, k := range keys {
+				v, ok := values[i].(string)
+				if !ok {
+					// Deleted since the scan
+					continue
+				}
+				if cb(strings.TrimPrefix(k, prefix), v) {
+					if t.watch == nil {
+						return errors.New("cannot write to the cache database in a read-only transaction")
+					}
+					// Read again once watched, a change before the watch is not caught by it
+					err = t.watch.Watch(ctx, k).Err()
+					if err != nil {
+						return err
+					}
+					current, err := t.watch.Get(ctx, k).Result()
+					if err == redis.Nil || err == nil && current != v {
+						return redis.TxFailedErr
+					}
+					if err != nil {
+						return err
+					}
+					t.Delete(bucket, strings.TrimPrefix(k, prefix))
+				}
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]^\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,190 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	_ "modernc.org/sqlite"
+)
+
+// Cache database in an SQLite file, which several instances on the same host may share
+type sqliteStore struct {
+	conf	*config
+	db		*sql.DB
+}
+
+// Every bucket lives in one table, writers wait for each other instead of failing
+func (s *sqliteStore) open() (*sql.DB, error) {
+	path := "file:" + (&url.URL { Path: s.conf.Daemon.CacheDatabase }).EscapedPath()
+	if s.conf.readOnly {
+		// Reads alongside the daemon writing the same file, which keeps it in WAL mode
+		return sql.Open("sqlite", path + "?mode=ro&_pragma=busy_timeout(10000)")
+	}
+	db, err := sql.Open("sqlite", path + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS cache (bucket TEXT NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY (bucket, key)) WITHOUT ROWID")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot open cache database %q: %s", s.conf.Daemon.CacheDatabase, err)
+	}
+	return db, nil
+}
+
+func (s *sqliteStore) Start() error {
+	// SQLite would create the file world readable
+	flag := os.O_RDWR | os.O_CREATE
+	if s.conf.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(s.conf.Daemon.CacheDatabase, flag, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	s.db, err = s.open()
+	if err != nil {
+		return err
+	}
+	err = checkSchemaVersion(s.conf, s)
+	if err != nil {
+		s.db.Close()
+	}
+	return err
+}
+
+func (s *sqliteStore) Stop() {
+	s.db.Close()
+}
+
+func (s *sqliteStore) View(fn func (tx cacheTx) error) error {
+	return fn(sqliteTx { s.db })
+}
+
+func (s *sqliteStore) Update(fn func (tx cacheTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(sqliteTx { tx })
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Size() (size int64, err error) {
+	err = s.db.QueryRow("SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&size)
+	return
+}
+
+func (s *sqliteStore) PrintInfo(w io.Writer) error {
+	if _, err := os.Stat(s.conf.Daemon.CacheDatabase); err != nil {
+		return err
+	}
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	version, _ := sqliteTx { db }.Get("portknob-meta", "schema-version")
+	if version == "" {
+		version = "0"
+	}
+	fmt.Fprintf(w, "database: %s (sqlite)\nschema version: %s (this binary: %d)\n", s.conf.Daemon.CacheDatabase, version, cacheSchemaVersion)
+	rows, err := db.Query("SELECT bucket, COUNT(*) FROM cache GROUP BY bucket ORDER BY bucket")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bucket string
+		var count int64
+		err = rows.Scan(&bucket, &count)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: %d entries\n", bucket, count)
+	}
+	return rows.Err()
+}
+
+// Either the database, for reads outside of a transaction, or a transaction
+type sqliteQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type sqliteTx struct {
+	q			sqliteQuerier
+}
+
+func (t sqliteTx) Get(bucket, key string) (value string, ok bool) {
+	err := t.q.QueryRow("SELECT value FROM cache WHERE bucket = ? AND key = ?", bucket, key).Scan(&value)
+	return value, err == nil
+}
+
+func (t sqliteTx) Put(bucket, key, value string) error {
+	_, err := t.q.Exec("INSERT OR REPLACE INTO cache (bucket, key, value) VALUES (?, ?, ?)", bucket, key, value)
+	return err
+}
+
+func (t sqliteTx) Delete(bucket, key string) error {
+	_, err := t.q.Exec("DELETE FROM cache WHERE bucket = ? AND key = ?", bucket, key)
+	return err
+}
+
+func (t sqliteTx) ForEach(bucket string, cb func (key, value string) bool) error {
+	rows, err := t.q.Query("SELECT key, value FROM cache WHERE bucket = ? ORDER BY key", bucket)
+	if err != nil {
+		return err
+	}
+	// Read everything first, the rows cannot be deleted while the query is open
+	var keys, values []string
+	for rows.Next() {
+		var k, v string
+		err = rows.Scan(&k, &v)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		keys, values = append(keys, k), append(values, v)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	for i, k := range keys {
+		if cb(k, values[i]) {
+			err = t.Delete(bucket, k)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,452 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// A BoltDB cache in a temporary directory
+func newTestCache(t testing.TB) *cache {
+	conf := &config {}
+	conf.Daemon.CacheDatabase = filepath.Join(t.TempDir(), "cache.db")
+	c := newCache(conf)
+	err := c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Stop)
+	return c
+}
+
+func TestBanEscalation(t *testing.T) {
+	const duration = time.Hour
+	const day = 86400 * time.Second
+	tests := []struct {
+		name		string
+		duration	time.Duration
+		// Previous ban of the subnet, "" for none
+		previous	string
+		wantHits	uint64
+		wantLength	time.Duration
+	}{
+		{ "first ban", duration, "", 1, duration },
+		{ "while banned", duration, time.Now().Add(30 * time.Minute).Format(time.RFC3339Nano) + " 1", 2, 2 * duration },
+		{ "soon after the ban", duration, time.Now().Add(-30 * time.Minute).Format(time.RFC3339Nano) + " 2", 3, 4 * duration },
+		{ "long after the ban", duration, time.Now().Add(-2 * duration).Format(time.RFC3339Nano) + " 5", 1, duration },
+		{ "doubled 10 times at most", time.Second, time.Now().Format(time.RFC3339Nano) + " 20", 21, time.Second << 10 },
+		{ "below the cap", day, time.Now().Format(time.RFC3339Nano) + " 4", 5, day << 4 },
+		{ "capped", day, time.Now().Format(time.RFC3339Nano) + " 5", 6, maxBanDuration },
+		{ "capped after many bans", duration, time.Now().Format(time.RFC3339Nano) + " 20", 21, maxBanDuration },
+		{ "would overflow", day, time.Now().Format(time.RFC3339Nano) + " 18446744073709551614", 18446744073709551615, maxBanDuration },
+		{ "longer than the cap", 1000 * day, "", 1, maxBanDuration },
+		{ "corrupt record", duration, "garbage", 1, duration },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			c := newTestCache(t)
+			if tt.previous != "" {
+				err := c.store.Update(func (tx cacheTx) error {
+					return tx.Put("portknob-bans", "192.0.2.0/24", tt.previous)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			start := time.Now()
+			expires, hits, err := c.Ban("192.0.2.0/24", tt.duration)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hits != tt.wantHits {
+				t.Errorf("hits %d, want %d", hits, tt.wantHits)
+			}
+			if length := expires.Sub(start); length < tt.wantLength || length > tt.wantLength + time.Minute {
+				t.Errorf("banned for %s, want %s", length, tt.wantLength)
+			}
+			if _, banned := c.Banned("192.0.2.0/24"); !banned {
+				t.Error("subnet not banned")
+			}
+			if _, banned := c.Banned("198.51.100.0/24"); banned {
+				t.Error("other subnet banned")
+			}
+		})
+	}
+}
+
+func TestCleanupBans(t *testing.T) {
+	c := newTestCache(t)
+	now := time.Now()
+	bans := map[string]time.Time {
+		"192.0.2.0/24":		now.Add(time.Hour),
+		"198.51.100.0/24":	now.Add(-30 * time.Minute),
+		"203.0.113.0/24":	now.Add(-2 * time.Hour),
+	}
+	err := c.store.Update(func (tx cacheTx) error {
+		for subnet, expires := range bans {
+			err := tx.Put("portknob-bans", subnet, expires.Format(time.RFC3339Nano) + " 1")
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.CleanupBans(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for subnet, kept := range map[string]bool { "192.0.2.0/24": true, "198.51.100.0/24": true, "203.0.113.0/24": false } {
+		var found bool
+		c.store.View(func (tx cacheTx) error {
+			_, found = tx.Get("portknob-bans", subnet)
+			return nil
+		})
+		if found != kept {
+			t.Errorf("ban of %s kept %t, want %t", subnet, found, kept)
+		}
+	}
+}
+
+func TestCleanupAuthTimes(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name		string
+		keep		time.Duration
+		users		[]string
+		wantKept	[]string
+	}{
+		{ "nothing old", 2 * time.Hour, nil, []string {"alice", "bob"} },
+		{ "old login", 30 * time.Minute, nil, []string {"alice"} },
+		{ "listed user", 2 * time.Hour, []string {"alice"}, []string {"bob"} },
+		{ "unknown user", 2 * time.Hour, []string {"carol"}, []string {"alice", "bob"} },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			c := newTestCache(t)
+			c.SetAuthTime("alice", now.Add(-10 * time.Minute))
+			c.SetAuthTime("bob", now.Add(-time.Hour))
+			err := c.CleanupAuthTimes(tt.keep, tt.users)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, user := range []string {"alice", "bob"} {
+				_, found := c.AuthTime(user)
+				if want := containsString(tt.wantKept, user); found != want {
+					t.Errorf("login time of %s kept %t, want %t", user, found, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAddFailureThreshold(t *testing.T) {
+	const window, ban = 10 * time.Minute, time.Hour
+	tests := []struct {
+		name		string
+		failures	int
+		maxFailures	uint64
+		// Previous record of the subnet, "" for none
+		previous	string
+		wantCount	uint64
+		wantBanned	bool
+	}{
+		{ "below the threshold", 4, 5, "", 4, false },
+		{ "at the threshold", 5, 5, "", 5, true },
+		{ "threshold of one", 1, 1, "", 1, true },
+		{ "earlier failures in the window", 1, 5, time.Now().Add(-5 * time.Minute).Format(time.RFC3339Nano) + " 4 -", 5, true },
+		{ "earlier failures out of the window", 1, 5, time.Now().Add(-20 * time.Minute).Format(time.RFC3339Nano) + " 4 -", 1, false },
+		{ "after a ban", 1, 5, time.Now().Add(-2 * time.Minute).Format(time.RFC3339Nano) + " 5 " + time.Now().Add(-time.Minute).Format(time.RFC3339Nano), 1, false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			c := newTestCache(t)
+			if tt.previous != "" {
+				err := c.store.Update(func (tx cacheTx) error {
+					return tx.Put("portknob-failures", "192.0.2.0/24", tt.previous)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var count uint64
+			var bannedUntil time.Time
+			for i := 0; i < tt.failures; i++ {
+				r, err := c.AddFailure("192.0.2.0/24", "192.0.0.0/16", window, ban, tt.maxFailures, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				count, bannedUntil = r.count, r.bannedUntil
+			}
+			if count != tt.wantCount {
+				t.Errorf("count %d, want %d", count, tt.wantCount)
+			}
+			if !bannedUntil.IsZero() != tt.wantBanned {
+				t.Errorf("banned until %s, want banned %t", bannedUntil, tt.wantBanned)
+			}
+			if _, banned := c.FailureBan("192.0.2.0/24"); banned != tt.wantBanned {
+				t.Errorf("FailureBan %t, want %t", banned, tt.wantBanned)
+			}
+		})
+	}
+}
+
+func TestAddFailureMaxEntries(t *testing.T) {
+	const window, ban = 10 * time.Minute, time.Hour
+	now := time.Now()
+	tests := []struct {
+		name		string
+		// Records present before, by subnet
+		previous	map[string]string
+		wantKey		string
+		wantEvicted	int
+		wantDropped	bool
+		// Records there after
+		wantRecords	[]string
+	}{
+		{ "room left", map[string]string { "198.51.100.0/24": now.Format(time.RFC3339Nano) + " 1 -" }, "192.0.2.0/24", 0, false, []string { "192.0.2.0/24", "198.51.100.0/24" } },
+		{ "counted with the aggregate", map[string]string { "198.51.100.0/24": now.Format(time.RFC3339Nano) + " 1 -", "192.0.0.0/16": now.Format(time.RFC3339Nano) + " 1 -" }, "192.0.0.0/16", 0, false, []string { "192.0.0.0/16", "198.51.100.0/24" } },
+		{ "oldest evicted", map[string]string { "198.51.100.0/24": now.Add(-time.Minute).Format(time.RFC3339Nano) + " 1 -", "203.0.113.0/24": now.Format(time.RFC3339Nano) + " 1 -" }, "192.0.0.0/16", 1, false, []string { "192.0.0.0/16", "203.0.113.0/24" } },
+		{ "banned kept", map[string]string { "198.51.100.0/24": now.Add(-time.Minute).Format(time.RFC3339Nano) + " 5 " + now.Add(time.Hour).Format(time.RFC3339Nano), "203.0.113.0/24": now.Format(time.RFC3339Nano) + " 1 -" }, "192.0.0.0/16", 1, false, []string { "192.0.0.0/16", "198.51.100.0/24" } },
+		{ "all banned", map[string]string { "198.51.100.0/24": now.Format(time.RFC3339Nano) + " 5 " + now.Add(time.Hour).Format(time.RFC3339Nano), "203.0.113.0/24": now.Format(time.RFC3339Nano) + " 5 " + now.Add(time.Hour).Format(time.RFC3339Nano) }, "192.0.0.0/16", 0, true, []string { "198.51.100.0/24", "203.0.113.0/24" } },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			c := newTestCache(t)
+			err := c.store.Update(func (tx cacheTx) error {
+				for k, v := range tt.previous {
+					err := tx.Put("portknob-failures", k, v)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Counts the records
+			_, err = c.CleanupFailures(window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := c.AddFailure("192.0.2.0/24", "192.0.0.0/16", window, ban, 5, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.key != tt.wantKey || r.evicted != tt.wantEvicted || r.dropped != tt.wantDropped {
+				t.Errorf("got key %q, evicted %d, dropped %t, want %q, %d, %t", r.key, r.evicted, r.dropped, tt.wantKey, tt.wantEvicted, tt.wantDropped)
+			}
+			var records []string
+			var counted uint64
+			c.store.View(func (tx cacheTx) error {
+				counted = failureRecords(tx)
+				return tx.ForEach("portknob-failures", func (k, v string) bool {
+					records = append(records, k)
+					return false
+				})
+			})
+			sort.Strings(records)
+			if !reflect.DeepEqual(records, tt.wantRecords) {
+				t.Errorf("records %v, want %v", records, tt.wantRecords)
+			}
+			if counted != uint64(len(records)) {
+				t.Errorf("counted %d records, have %d", counted, len(records))
+			}
+		})
+	}
+}
+
+// A flood of failures from distinct subnets, as with spoofed addresses, stays within ratelimit-max-entries
+func TestAddFailureFlood(t *testing.T) {
+	c := newTestCache(t)
+	const maxEntries = 100
+	for i := 0; i < 5000; i++ {
+		subnet := fmt.Sprintf("10.%d.%d.0/24", i / 256 % 256, i % 256)
+		aggregate := fmt.Sprintf("10.%d.0.0/16", i / 256 % 256)
+		if i % 7 == 0 {
+			// Distinct aggregates too, as from all over the address space
+			subnet, aggregate = fmt.Sprintf("2001:db8:%x::/48", i), fmt.Sprintf("2001:db8:%x::/32", i)
+		}
+		_, err := c.AddFailure(subnet, aggregate, time.Hour, time.Hour, 5, maxEntries)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var records, counted uint64
+	c.store.View(func (tx cacheTx) error {
+		counted = failureRecords(tx)
+		return tx.ForEach("portknob-failures", func (k, v string) bool {
+			records++
+			return false
+		})
+	})
+	if records > maxEntries {
+		t.Errorf("%d records, want at most %d", records, maxEntries)
+	}
+	if counted != records {
+		t.Errorf("counted %d records, have %d", counted, records)
+	}
+}
+
+func BenchmarkAddFailure(b *testing.B) {
+	c := newTestCache(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := c.AddFailure(fmt.Sprintf("10.%d.%d.0/24", i / 256 % 256, i % 256), fmt.Sprintf("10.%d.0.0/16", i / 256 % 256), time.Hour, time.Hour, 5, 1000)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCleanupFailures(t *testing.T) {
+	const window = 10 * time.Minute
+	now := time.Now()
+	records := map[string]string {
+		// Still counting
+		"192.0.2.0/24":		now.Add(-5 * time.Minute).Format(time.RFC3339Nano) + " 2 -",
+		// Out of the window
+		"198.51.100.0/24":	now.Add(-20 * time.Minute).Format(time.RFC3339Nano) + " 2 -",
+		// Still banned
+		"203.0.113.0/24":	now.Add(-20 * time.Minute).Format(time.RFC3339Nano) + " 5 " + now.Add(time.Hour).Format(time.RFC3339Nano),
+		// Ban ended
+		"233.252.0.0/24":	now.Add(-2 * time.Hour).Format(time.RFC3339Nano) + " 5 " + now.Add(-time.Hour).Format(time.RFC3339Nano),
+	}
+	c := newTestCache(t)
+	err := c.store.Update(func (tx cacheTx) error {
+		for subnet, v := range records {
+			err := tx.Put("portknob-failures", subnet, v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbanned, err := c.CleanupFailures(window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unbanned) != 1 || unbanned[0] != "233.252.0.0/24" {
+		t.Errorf("unbanned %q, want [\"233.252.0.0/24\"]", unbanned)
+	}
+	for subnet, kept := range map[string]bool { "192.0.2.0/24": true, "198.51.100.0/24": false, "203.0.113.0/24": true, "233.252.0.0/24": false } {
+		var found bool
+		c.store.View(func (tx cacheTx) error {
+			_, found = tx.Get("portknob-failures", subnet)
+			return nil
+		})
+		if found != kept {
+			t.Errorf("failures of %s kept %t, want %t", subnet, found, kept)
+		}
+	}
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	tests := []struct {
+		name			string
+		// Schema version already recorded, "" for a new database
+		version			string
+		forceDowngrade	bool
+		wantErr			bool
+	}{
+		{ "new database", "", false, false },
+		{ "current version", strconv.FormatUint(cacheSchemaVersion, 10), false, false },
+		{ "older version", "1", false, false },
+		{ "newer version", strconv.FormatUint(cacheSchemaVersion + 1, 10), false, true },
+		{ "forced downgrade", strconv.FormatUint(cacheSchemaVersion + 1, 10), true, false },
+		{ "garbage version", "x", false, false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			conf := &config { forceDowngrade: tt.forceDowngrade }
+			conf.Daemon.CacheDatabase = filepath.Join(t.TempDir(), "cache.db")
+			s := &sqliteStore { conf: conf }
+			var err error
+			s.db, err = s.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+			if tt.version != "" {
+				err = s.Update(func (tx cacheTx) error {
+					return tx.Put("portknob-meta", "schema-version", tt.version)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = checkSchemaVersion(conf, s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkSchemaVersion() = %v, want error %v", err, tt.wantErr)
+			}
+			want := strconv.FormatUint(cacheSchemaVersion, 10)
+			if tt.wantErr {
+				want = tt.version
+			}
+			var got string
+			s.View(func (tx cacheTx) error {
+				got, _ = tx.Get("portknob-meta", "schema-version")
+				return nil
+			})
+			if got != want {
+				t.Errorf("schema version = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// A one-time code logs in once, and codes of earlier time steps no longer do
+func TestUseTOTP(t *testing.T) {
+	c := newTestCache(t)
+	steps := []struct {
+		user		string
+		counter		uint64
+		wantFresh	bool
+	}{
+		{ "alice", 100, true },
+		{ "alice", 100, false },
+		{ "alice", 99, false },
+		{ "bob", 100, true },
+		{ "alice", 101, true },
+		{ "alice", 100, false },
+	}
+	for _, step := range steps {
+		fresh, err := c.UseTOTP(step.user, step.counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fresh != step.wantFresh {
+			t.Errorf("UseTOTP(%q, %d) = %t, want %t", step.user, step.counter, fresh, step.wantFresh)
+		}
+	}
+}
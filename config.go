@@ -19,16 +19,58 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"filippo.io/age"
+	"filippo.io/age/armor"
 	"github.com/BurntSushi/toml"
+	"github.com/oschwald/maxminddb-golang"
 )
 
 type config struct {
 	Daemon		configDaemon		`toml:"daemon"`
 	Firewall	[]configFirewall	`toml:"firewall"`
-	Secrets		map[string]string	`toml:"secrets"`
+	RawSecrets	toml.Primitive		`toml:"secrets"`
+	Secrets		map[string]string	`toml:"-"`
+	SecretsGroups	map[string][]string	`toml:"-"`
+	SecretsLifespan	map[string]uint64	`toml:"-"`
+	SecretsShareLifespan	map[string]uint64	`toml:"-"`
+	SecretsEmail	map[string]string	`toml:"-"`
+	SecretsDefaultBundles	map[string][]string	`toml:"-"`
+	SecretsSchedule	map[string]*configSchedule	`toml:"secrets-schedule"`
+	SecretsHoneypot	map[string]string	`toml:"secrets-honeypot"`
+	AdminSecrets	map[string]string	`toml:"admin-secrets"`
+	TOTPSecrets	map[string]string	`toml:"totp-secrets"`
+	SecretsKeys	map[string][]string	`toml:"secrets-keys"`
+	Knock		map[string]*configKnock	`toml:"knock"`
+	Auth		configAuth		`toml:"auth"`
+	Notify		*configNotify		`toml:"notify"`
+	Authz		*configAuthz		`toml:"authz"`
+	Defense		*configDefense		`toml:"defense"`
+	DeviceKeys	[]*configDeviceKey	`toml:"device-key"`
+	totpKeys	map[string][]byte
+	lifespanGroups	map[string]lifespanGroup
+
+	// Set by the -force-downgrade command line option
+	forceDowngrade	bool
+	// Set by the -read-only command line option
+	readOnly	bool
+	// File the configuration was loaded from, for reloading on SIGHUP
+	path		string
+	// 1 for the configuration loaded at startup, counting up with each reload
+	generation	uint64
 }
 
 type configDaemon struct {
@@ -45,9 +87,28 @@ type configDaemon struct {
 	HTTPPath			string	`toml:"http-path"`
 
 	// HTTP header provided by the SLB indicating the visitor's IP address
+	// Ignored if "trusted-proxies" is set
 	// Default: "X-Real-IP"
 	ClientIP			string	`toml:"client-ip"`
 
+	// Addresses, subnets or hostnames of reverse proxies allowed to set X-Forwarded-For
+	// Hostnames are resolved at startup and every dns-refresh-interval seconds
+	// Requests from other peers are attributed to the peer address
+	// Requests from a trusted proxy get "400 Bad Request" unless X-Forwarded-For names an untrusted client
+	// Default: [] (use "client-ip" instead)
+	TrustedProxies		[]string	`toml:"trusted-proxies"`
+
+	// Expect a PROXY protocol v1 or v2 header from a TCP load balancer at the start of every connection to listen
+	// Only peers in trusted-proxies may connect, the address in the header replaces theirs
+	// Default: false
+	ProxyProtocol		bool	`toml:"proxy-protocol"`
+	trustedNets			*netList
+
+	// Seconds between resolving the hostnames in trusted-proxies, allow-cidr and deny-cidr again
+	// A hostname which fails to resolve keeps the addresses it last resolved to
+	// Default: 300
+	DNSRefreshInterval	uint64	`toml:"dns-refresh-interval"`
+
 	// IPv4 subnet prefix to add to the firewall whitelist
 	// Default: 24
 	IPv4Prefix			uint	`toml:"ipv4-prefix"`
@@ -56,10 +117,30 @@ type configDaemon struct {
 	// Default: 48
 	IPv6Prefix			uint	`toml:"ipv6-prefix"`
 
-	// File name in which stores the cache database
+	// File name in which stores the cache database, or a "redis://" or "rediss://" URL with cache-backend "redis"
 	// Default: "portknob.db"
 	CacheDatabase		string	`toml:"cache-database"`
 
+	// Cache database backend
+	// Possible values:
+	// - "bolt": a BoltDB file, only one instance may open it
+	// - "sqlite": an SQLite file, several instances on the same host may share it
+	// - "redis": a Redis server, several instances on different hosts may share it
+	// Default: "bolt"
+	CacheBackend		string	`toml:"cache-backend"`
+
+	// Prefix of every key with cache-backend "redis", to share a server with other applications or portknob setups
+	// Default: ""
+	CacheKeyPrefix		string	`toml:"cache-key-prefix"`
+
+	// Seconds between applying whitelist changes made by other instances sharing the cache database
+	// Default: 10
+	CacheSyncInterval	uint64	`toml:"cache-sync-interval"`
+
+	// Seconds the clock of another instance sharing the cache database may be off before its whitelist entries are corrected and it is reported
+	// Default: 30
+	MaxPeerClockSkew	uint64	`toml:"max-peer-clock-skew"`
+
 	// Lifespan to cache authorization info in visitor's web browser
 	// Default: 604800 (7 days)
 	CookieLifespan		*uint64	`toml:"cookie-lifespan"`
@@ -68,16 +149,336 @@ type configDaemon struct {
 	// Default: 604800 (7 days)
 	FirewallLifespan	*uint64	`toml:"firewall-lifespan"`
 
+	// Seconds after the user last entered their password during which their login cookie alone may extend a firewall whitelist entry
+	// After that, or if no password login of the user is on record, visitors must enter their password again
+	// Default: 0 (the login cookie always works)
+	ReauthAfter			uint64	`toml:"reauth-after"`
+
+	// Seconds a new whitelist entry from the login cookie alone waits before the firewall opens, logins with a typed password open at once
+	// Meanwhile the reply and a "pending-grant" notification carry a link cancelling it, so a stolen cookie can be stopped
+	// A cookie extending a live entry of its user from the same subnet does not wait
+	// Default: 0 (disabled)
+	CookieGrantDelay	uint64	`toml:"cookie-grant-delay"`
+
+	// Ask users with a one-time password who left its field empty for the code on a second page, which needs no JavaScript
+	// Set to false to count such a login as failed
+	// Default: true
+	NoJSFallback		*bool	`toml:"nojs-fallback"`
+
+	// Let users logged in with a password create links which whitelist whoever opens them for one rule with "shareable"
+	// <http-path>/share/ creates them and lists those of the user, who may revoke them there, each link works once until its lifespan is over
+	// Default: false
+	AllowShareLinks		bool	`toml:"allow-share-links"`
+
+	// Longest lifespan in seconds of a share link, users in [[secrets]] may have a "share-lifespan" of their own
+	// Default: 3600 (1 hour)
+	ShareLinkMaxLifespan	uint64	`toml:"share-link-max-lifespan"`
+
+	// Share links each user may create per minute
+	// Set to 0 to disable
+	// Default: 5
+	ShareLinkRateLimit	*uint64	`toml:"share-link-rate-limit"`
+
+	// Let users of [secrets] log in by signing a challenge with an Ed25519 key of [secrets-keys] or "portknob key add", see "portknob client"
+	// The challenges and logins are served at <http-path>/key/
+	// Default: false
+	AllowKeyLogins		bool	`toml:"allow-key-logins"`
+
+	// Shorten each new whitelist entry by a random number of seconds up to this value, so entries created at the same time do not all expire at once
+	// Default: 0 (disabled)
+	ExpiryJitter		uint64	`toml:"expiry-jitter"`
+
+	// Upper limit in seconds for the lifespan of any firewall whitelist entry, however it was created
+	// Default: 0 (no limit)
+	AbsoluteMaxLifespan	uint64	`toml:"absolute-max-lifespan"`
+
+	// Seconds the whitelist entries of a login last while its user is on probation, which users are until a login of theirs passes it
+	// The login passes once its entry saw probation-activity-bytes of traffic within probation-window, and its entry is then extended to its full lifespan
+	// Otherwise it lapses after this, rules may override all three options
+	// Changing it from or to 0 requires a restart
+	// Default: 0 (disabled)
+	ProbationLifespan	uint64	`toml:"probation-lifespan"`
+
+	// Seconds after a login on probation during which its traffic is watched
+	// Default: 1800 (30 minutes)
+	ProbationWindow		uint64	`toml:"probation-window"`
+
+	// Bytes of traffic through the rules of a whitelist entry which pass its probation
+	// Default: 10240
+	ProbationActivityBytes	uint64	`toml:"probation-activity-bytes"`
+
+	// Move the whitelist entries of a user to another IPv6 subnet when a cookie login comes from there and the old subnet sent no traffic for auto-rekey-ipv6-idle seconds, as after the ISP rotated the delegated prefix
+	// The entries keep their expiry, the whitelist sets then count the traffic of their elements
+	// Changing it requires a restart
+	// Default: false
+	AutoRekeyIPv6		bool	`toml:"auto-rekey-ipv6"`
+
+	// Seconds without traffic from the old subnet before its entries are moved, at least 60
+	// Default: 600 (10 minutes)
+	AutoRekeyIPv6Idle	uint64	`toml:"auto-rekey-ipv6-idle"`
+
+	// Moves per user within 24 hours, further logins from another subnet get entries of their own
+	// Default: 3
+	AutoRekeyIPv6MaxPerDay	uint64	`toml:"auto-rekey-ipv6-max-per-day"`
+
+	// Rules without a cached verdict when the [authz] authorizer cannot be reached, times out or replies without a valid signature
+	// Possible values:
+	// - "closed": they stay closed
+	// - "open": they open as if allowed, with their own lifespans
+	// Default: "closed"
+	AuthzFailMode		string	`toml:"authz-fail-mode"`
+
+	// Maximum seconds between two cleanups of expired entries in the cache database
+	// Cleanups also run whenever an entry expires
+	// Default: 300
+	SweeperMaxSleep		uint64	`toml:"sweeper-max-sleep"`
+
 	// Firewall chain name for Portknob to work on
+	// The nftables backend also names its table after it
 	// Default: "portknob"
 	FirewallChainName	string	`toml:"firewall-chain-name"`
 
+	// Firewall backend
+	// Possible values:
+	// - "iptables": iptables, ip6tables and ipset
+	// - "nftables": nft, in a table of its own
+	// Default: "iptables"
+	FirewallBackend		string	`toml:"firewall-backend"`
+
 	// Firewall rule to deny unauthorized clients
 	// Possible values:
 	// - "drop": silently drop any incoming requests, this works better if your firewall also drops incoming requests to other unoccupied ports
 	// - "reject": rejects incoming requests with "connection refused" reply, this works better if your firewall does not drop incoming requests to other unoccupied ports
 	// Default: "reject"
 	FirewallDenyMethod	string	`toml:"firewall-deny-method"`
+
+	// Seconds to wait for in-flight logins to finish updating the firewall on shutdown
+	// Default: 10
+	ShutdownGrace		uint64	`toml:"shutdown-grace"`
+
+	// Log a warning when a firewall command takes longer than this many milliseconds
+	// Set to 0 to disable
+	// Default: 1000
+	FirewallSlowThreshold	*uint64	`toml:"firewall-slow-threshold"`
+
+	// Seconds between reading the packet counters of the deny rules, for the denied packets of metrics and the admin page
+	// Set to 0 to disable
+	// Default: 60
+	DenyCounterInterval	*uint64	`toml:"deny-counter-interval"`
+
+	// Timezone used by [secrets-schedule] entries without their own timezone, as an IANA name such as "Europe/Berlin"
+	// Default: "Local" (system timezone)
+	Timezone			string	`toml:"timezone"`
+	location			*time.Location
+
+	// Extra seconds a whitelist entry stays valid after the user's [secrets-schedule] window closes
+	// Default: 0
+	ScheduleGrace		uint64	`toml:"schedule-grace"`
+
+	// Seconds to ban a subnet from logging in after it used [secrets-honeypot] credentials
+	// Every further hit within this time after the previous ban ends doubles the ban, up to 10 times and 2147483 seconds (about 24 days)
+	// Default: 86400 (1 day)
+	HoneypotBanDuration	uint64	`toml:"honeypot-ban-duration"`
+
+	// Failed logins from a subnet within auth-failure-window before it is rate limited
+	// Default: 5, 0 disables rate limiting
+	AuthMaxFailures		*uint64	`toml:"auth-max-failures"`
+
+	// Seconds in which auth-max-failures failed logins lead to a ban
+	// Default: 300
+	AuthFailureWindow	uint64	`toml:"auth-failure-window"`
+
+	// Subnets with failed logins counted apart, failures of further subnets are counted by /16 for IPv4 and /32 for IPv6
+	// Beyond that, the records which started counting longest ago are dropped, never ones of banned subnets
+	// Set to 0 to disable
+	// Default: 100000
+	RatelimitMaxEntries	*uint64	`toml:"ratelimit-max-entries"`
+
+	// Seconds a rate limited subnet gets "429 Too Many Requests"
+	// Default: 900
+	AuthBanDuration		uint64	`toml:"auth-ban-duration"`
+
+	// Also drop every packet from rate limited subnets in the firewall, for auth-ban-duration
+	// Behind a reverse proxy the firewall only sees the proxy, so this has no effect
+	// Default: false
+	AuthBanFirewall		bool	`toml:"auth-ban-firewall"`
+
+	// Addresses, subnets or hostnames always allowed to log in, and the only ones unless allow-countries is set
+	// Deny lists win over allow lists, and allow-cidr wins over the country lists
+	// The login page, single sign-on and knock sequences all follow these lists
+	// Default: [] (any)
+	AllowCIDR			[]string	`toml:"allow-cidr"`
+	allowNets			*netList
+
+	// Addresses, subnets or hostnames never allowed to log in
+	// Default: [] (none)
+	DenyCIDR			[]string	`toml:"deny-cidr"`
+	denyNets			*netList
+
+	// MaxMind GeoLite2 or GeoIP2 Country or City database for allow-countries, deny-countries and impossible-travel-kmh, read again on SIGHUP
+	// Default: "" (disabled)
+	GeoIPDatabase		string	`toml:"geoip-database"`
+	geoip				*maxminddb.Reader
+
+	// ISO 3166 country codes allowed to log in, such as ["DE", "FR"], addresses of unknown country such as private ones need allow-cidr
+	// Default: [] (any)
+	AllowCountries		[]string	`toml:"allow-countries"`
+
+	// ISO 3166 country codes never allowed to log in
+	// Default: [] (none)
+	DenyCountries		[]string	`toml:"deny-countries"`
+
+	// Flag successful logins of a user faster than this many km/h from the last one, by the locations of a GeoIP2 or GeoLite2 City geoip-database
+	// Locations closer than 300 km never count, Country databases have no locations
+	// Set to 0 to disable
+	// Default: 1000
+	ImpossibleTravelKMH	*uint64	`toml:"impossible-travel-kmh"`
+
+	// What to do about impossible travel
+	// Possible values:
+	// - "alert": log in anyway, with an audit event and a notification
+	// - "challenge": also refuse the login until the admin page confirms the new location
+	// Default: "alert"
+	ImpossibleTravelAction	string	`toml:"impossible-travel-action"`
+
+	// Subnets never checked for impossible travel by user, "*" for every user, such as the exits of a corporate VPN
+	// Default: {} (none)
+	ImpossibleTravelExempt	map[string][]string	`toml:"impossible-travel-exempt"`
+	travelExempt		map[string][]*net.IPNet
+
+	// Reply to visitors denied by the lists above
+	// Possible values:
+	// - "forbidden": "403 Forbidden"
+	// - "not-found": "404 Not Found", as if nothing was there
+	// - "close": close the connection without a reply
+	// Default: "forbidden"
+	PolicyDenyMethod	string	`toml:"policy-deny-method"`
+
+	// URL to redirect visitors denied by the lists above to, instead of policy-deny-method
+	// Default: "" (disabled)
+	PolicyRedirect		string	`toml:"policy-redirect"`
+
+	// Treat suspicious but valid option combinations as errors instead of warnings
+	// Default: false
+	StrictValidation	bool	`toml:"strict-validation"`
+
+	// Only warn instead of refusing to start when a file containing secrets is readable by other users
+	// Checked files: this configuration file, age-identity-file, tls-key and acme-cache-dir with acme-domains
+	// Default: false
+	PermissivePermissions	bool	`toml:"permissive-permissions"`
+
+	// Only warn instead of refusing to start when the "redir" of a firewall rule points to a port another rule denies
+	// Default: false
+	PermissiveRedir		bool	`toml:"permissive-redir"`
+
+	// File name of the age identity used to decrypt encrypted secrets
+	// Values in [secrets] and [admin-secrets] beginning with "-----BEGIN AGE ENCRYPTED FILE-----" are decrypted at load time
+	// Default: "" (disabled)
+	AgeIdentityFile		string	`toml:"age-identity-file"`
+
+	// HTTP path of the admin API, which lists, grants and revokes whitelist entries
+	// <admin-path>/ is a page for browsers, <admin-path>/entries the JSON API
+	// POST <admin-path>/grant needs the confirmation token of a dry run
+	// Requires "admin-allow" or [admin-secrets]
+	// Default: "" (disabled)
+	AdminPath			string	`toml:"admin-path"`
+
+	// Subnets allowed to use the admin API, such as ["127.0.0.1/32", "::1/128"]
+	// Checked against the peer address, or X-Forwarded-For with "trusted-proxies", never against "client-ip"
+	// Default: [] (any, if [admin-secrets] is not empty)
+	AdminAllow			[]string	`toml:"admin-allow"`
+	adminNets			[]*net.IPNet
+
+	// Users of [admin-secrets] allowed to POST <admin-path>/panic, which revokes every entry and login cookie
+	// Default: [] (nobody, the control socket can still run a panic)
+	AdminPanicUsers		[]string	`toml:"admin-panic-users"`
+
+	// Address and port, or "unix:" and a path, to serve admin-path on instead of listen, which then replies 404 there
+	// Plain HTTP on a unix socket, which the group of the daemon may connect to and where admin-allow does not apply
+	// Default: "" (admin-path is served on listen)
+	AdminListen			string	`toml:"admin-listen"`
+
+	// Requests per minute each client may make to admin-path and metrics-listen, and all of them together to control-socket
+	// Each is counted apart from the others and from logins, so a flood of one locks nobody out of another
+	// Set to 0 to disable
+	// Default: 120
+	AdminRateLimit		*uint64	`toml:"admin-rate-limit"`
+
+	// Logins, knocks and single sign-ons changing the firewall at the same time, the others wait for their turn
+	// The admin API and control socket never wait, so a flood of logins cannot hold up a revocation
+	// Set to 0 to disable
+	// Default: 16
+	MaxConcurrentGrants	*uint64	`toml:"max-concurrent-grants"`
+
+	// Unix socket for the list, grant, revoke, flush, maintenance and panic commands, only root may connect
+	// Default: "" (disabled)
+	ControlSocket		string	`toml:"control-socket"`
+
+	// Unix socket on which web applications of this host check the login cookies of their visitors, see the gate package
+	// It is created with mode 0660 and only tells whether a login cookie is valid and a subnet is whitelisted
+	// Default: "" (disabled)
+	SessionSocket		string	`toml:"session-socket"`
+
+	// HTTP address and port to serve Prometheus metrics on at /metrics, keep it away from the internet
+	// /readyz there replies 503 in maintenance mode
+	// Default: "" (disabled)
+	MetricsListen		string	`toml:"metrics-listen"`
+
+	// PEM certificate chain and private key to serve HTTPS on listen instead of HTTP
+	// The files are read again when they change, e.g. after a renewal by certbot
+	// Default: "" (plain HTTP)
+	TLSCert				string	`toml:"tls-cert"`
+	TLSKey				string	`toml:"tls-key"`
+
+	// Domains to obtain certificates for from Let's Encrypt, serving HTTPS on listen
+	// Requires listen on port 443 or acme-http-listen reachable from the internet, and cannot be combined with tls-cert
+	// Default: [] (disabled)
+	ACMEDomains			[]string	`toml:"acme-domains"`
+
+	// Contact address given to Let's Encrypt for expiry notices
+	// Default: "" (none)
+	ACMEEmail			string	`toml:"acme-email"`
+
+	// Directory keeping the ACME account key and certificates
+	// Default: "/var/cache/portknob-acme"
+	ACMECacheDir		string	`toml:"acme-cache-dir"`
+
+	// HTTP address and port answering HTTP-01 challenges and redirecting everything else to HTTPS
+	// Default: ":80"
+	ACMEHTTPListen		string	`toml:"acme-http-listen"`
+
+	// Where to record logins, whitelist changes and firewall command failures, a file name or "syslog"
+	// The file is opened again on SIGHUP, so it can be rotated
+	// Default: "" (disabled)
+	AuditLog			string	`toml:"audit-log"`
+
+	// Format of the audit log
+	// Possible values:
+	// - "json": one JSON object per line
+	// - "text": one line of key=value pairs per event
+	// Default: "json"
+	LogFormat			string	`toml:"log-format"`
+
+	// Add a sequence number and the SHA-256 of the previous line to each line of the audit log, so "portknob audit verify" finds edited or deleted lines
+	// Default: false
+	AuditHashChain		bool	`toml:"audit-hash-chain"`
+
+	// PEM file of an Ed25519 private key signing a checkpoint line every audit-checkpoint-interval seconds, so truncation shows too
+	// Such as made by "openssl genpkey -algorithm ed25519", requires "audit-hash-chain"
+	// Default: "" (no checkpoints)
+	AuditSigningKey		string	`toml:"audit-signing-key"`
+	auditKey			ed25519.PrivateKey
+
+	// Default: 3600
+	AuditCheckpointInterval	uint64	`toml:"audit-checkpoint-interval"`
+
+	// Confine the daemon with Landlock and seccomp once it listens, see "Sandbox" in README.md
+	// Possible values:
+	// - "off"
+	// - "permissive": log the system calls "enforcing" would kill, leaving files unrestricted
+	// - "enforcing": only allow the files and system calls portknob needs, killing it on any other system call
+	// Default: "off"
+	Sandbox				string	`toml:"sandbox"`
 }
 
 type configFirewall struct {
@@ -100,26 +501,240 @@ type configFirewall struct {
 	// This is a mandatory option
 	// Use "port" to specify a port number
 	// Use "first:last" to specify an inclusive range
+	// Use "port,first:last,..." to specify a list of ports and ranges
 	DestPort	string		`toml:"dport"`
+	destPorts	[]portRange
+
+	// Source Port
+	// Same syntax as "dport"
+	// Default: "" (any)
+	SourcePort	string		`toml:"sport"`
+	sourcePorts	[]portRange
 
 	// Redirect target
 	// Redirect unauthorized requests to another address, instead of denying it
 	// Supported values: "addr" ":port" "addr:port"
+	// Cannot be combined with a list in "dport"
+	// Must not point to a port of this host which another rule denies, unless "permissive-redir" is set
 	// Default: "" (disabled)
 	Redir		string		`toml:"redir"`
+
+	// Rule group
+	// Only users listed in [[secrets]] with this group are let through
+	// Default: "" (every authorized user)
+	Group		string		`toml:"group"`
+
+	// Users let through by this rule, a shorthand for a group given to each of them
+	// Cannot be combined with "group"
+	// Default: [] (every authorized user)
+	Users		[]string	`toml:"users"`
+
+	// Seconds to whitelist clients for this rule, instead of firewall-lifespan or the lifespan of the user
+	// 0 means never expire
+	// Default: unset (the lifespan of the login)
+	Lifespan	*uint64		`toml:"lifespan"`
+
+	// Put the whitelist entry back to the full lifespan whenever the client sends traffic matching this rule, so sessions in use do not expire
+	// Renewals are made by the firewall and are lost when portknob restarts
+	// The firewall cannot cut them short, so this cannot be combined with "absolute-max-lifespan" or with users who have a schedule
+	// Requires "lifespan", cannot be combined with "redir"
+	// Default: false
+	Sliding		bool		`toml:"sliding"`
+
+	// Let share links of users who may open this rule open it, see "allow-share-links"
+	// A whitelist entry opens every rule of the group, so they must all have this option
+	// Cannot be combined with "sliding"
+	// Default: false
+	Shareable	bool		`toml:"shareable"`
+
+	// Only open this rule for logins which checked a one-time password, other logins still open the rest
+	// Users without a TOTP seed, knocks and single sign-ons never open it, the admin API and control socket still may
+	// Every rule of the same group must have the same value, cannot be combined with "shareable"
+	// Default: false
+	RequireTOTP	bool		`toml:"require-totp"`
+
+	// What a login does to this rule
+	// "lockdown" rules are open to everyone until a login locks them down, then they deny everyone but the subnets with a live entry of the group
+	// The lockdown is lifted when the last of those entries expires or is revoked, or early from <http-path>/lockdown/
+	// Requires "group" or "users", every rule of the group must have the same mode, cannot be combined with "redir", "sliding" or "shareable"
+	// Changing it requires a restart
+	// Supported values: "open", "lockdown"
+	// Default: "open"
+	Mode		string		`toml:"mode"`
+
+	// probation-lifespan, probation-window and probation-activity-bytes of this rule, 0 for the lifespan exempts it from probation
+	// Every rule of the same group must have the same values, probation cannot be combined with "sliding"
+	// Default: unset (those of [daemon])
+	ProbationLifespan	*uint64	`toml:"probation-lifespan"`
+	ProbationWindow		*uint64	`toml:"probation-window"`
+	ProbationActivityBytes	*uint64	`toml:"probation-activity-bytes"`
+
+	// Checkbox of the login form this rule is listed under, password and cookie logins which leave it unchecked do not open the rule
+	// Rules without a bundle are opened by every login, single sign-ons, key logins and knocks open every bundle
+	// Requires "group" or "users", every rule of the same group must have the same bundle
+	// Default: "" (no bundle)
+	Bundle		string		`toml:"bundle"`
+}
+
+// Probation settings of a rule, see probation-lifespan, lockdown rules have none
+type probation struct {
+	lifespan	uint64
+	window		uint64
+	activityBytes	uint64
+}
+
+func (conf *config) ruleProbation(rule *configFirewall) probation {
+	p := probation { conf.Daemon.ProbationLifespan, conf.Daemon.ProbationWindow, conf.Daemon.ProbationActivityBytes }
+	if rule.Mode == "lockdown" {
+		p.lifespan = 0
+	}
+	if rule.ProbationLifespan != nil {
+		p.lifespan = *rule.ProbationLifespan
+	}
+	if rule.ProbationWindow != nil {
+		p.window = *rule.ProbationWindow
+	}
+	if rule.ProbationActivityBytes != nil {
+		p.activityBytes = *rule.ProbationActivityBytes
+	}
+	return p
+}
+
+// Return the probation of the rules of group, which all have the same, a lifespan of 0 if there is none
+func (conf *config) groupProbation(group string) probation {
+	for i := range conf.Firewall {
+		if conf.Firewall[i].Group == group {
+			return conf.ruleProbation(&conf.Firewall[i])
+		}
+	}
+	return probation {}
+}
+
+// Whether the whitelist sets of group count the traffic of their elements, for probation or auto-rekey-ipv6
+func (conf *config) groupCounters(group string) bool {
+	return conf.groupProbation(group).lifespan != 0 || conf.Daemon.AutoRekeyIPv6
+}
+
+// Whether any rule puts logins on probation, whose sets then count the traffic of their elements
+func (conf *config) probationEnabled() bool {
+	for i := range conf.Firewall {
+		if conf.ruleProbation(&conf.Firewall[i]).lifespan != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// A rule group of its own for rules with a lifespan, as their entries expire apart from the rest
+type lifespanGroup struct {
+	// Group the rules were given, users opening it also open this one
+	parent		string
+	lifespan	uint64
+	sliding		bool
+	lockdown	bool
+}
+
+// Check that path, served below http-path for option, overlaps neither with admin-path nor with the path of redirect-url
+func (conf *config) checkServedPath(option, path string) error {
+	if conf.Daemon.AdminPath != "" && (strings.HasPrefix(path, conf.Daemon.AdminPath + "/") || strings.HasPrefix(conf.Daemon.AdminPath + "/", path)) {
+		return &configError { fmt.Sprintf("option %q serves %q, which overlaps with \"admin-path\"\n", option, path) }
+	}
+	if strings.HasPrefix(conf.Auth.oidcPath(), path) {
+		return &configError { fmt.Sprintf("option %q serves %q, which overlaps with the path of \"redirect-url\"\n", option, path) }
+	}
+	return nil
+}
+
+// Name firewall rule i for visitors, by its comment if it has one
+func (conf *config) ruleName(i int) string {
+	rule := conf.Firewall[i]
+	if rule.Comment != "" {
+		return fmt.Sprintf("#%d %s", i + 1, rule.Comment)
+	}
+	return fmt.Sprintf("#%d port %s", i + 1, rule.DestPort)
+}
+
+// Find a rule by its number, as "2" or "#2", or by its comment, which must then belong to no other rule
+func (conf *config) findRule(name string) (int, bool) {
+	if n, err := strconv.Atoi(strings.TrimPrefix(name, "#")); err == nil {
+		return n - 1, n >= 1 && n <= len(conf.Firewall)
+	}
+	found := -1
+	for i, rule := range conf.Firewall {
+		if rule.Comment == name && name != "" {
+			if found >= 0 {
+				return 0, false
+			}
+			found = i
+		}
+	}
+	return found, found >= 0
+}
+
+// Identify a rule when comparing configurations
+func (rule *configFirewall) key() string {
+	return fmt.Sprintf("%q %q %q %q %q %q %q", rule.Comment, rule.Proto, rule.Dest, rule.DestPort, rule.SourcePort, rule.Redir, rule.Group)
+}
+
+type configSecret struct {
+	Username	string		`toml:"username"`
+	Password	string		`toml:"password"`
+
+	// Rule groups opened for this user, in addition to rules without a group
+	// Default: []
+	Groups		[]string	`toml:"groups"`
+
+	// Base32 TOTP seed, logging in then also requires the code of an authenticator app
+	// Default: "" (password only)
+	TOTP		string		`toml:"totp"`
+
+	// Seconds to whitelist this user's clients, instead of firewall-lifespan, for rules without a lifespan of their own
+	// Default: unset (firewall-lifespan)
+	Lifespan	*uint64		`toml:"lifespan"`
+
+	// Longest lifespan in seconds of the share links of this user, instead of "share-link-max-lifespan"
+	// Set to 0 to forbid the user to create share links
+	// Default: unset
+	ShareLifespan	*uint64	`toml:"share-lifespan"`
+
+	// Mail address the "pending-grant" notifications of this user are also sent to, with [notify] "smtp-server"
+	// Default: "" (only "smtp-to")
+	Email		string		`toml:"email"`
+
+	// Bundles checked on the login form of this user and opened by logins which do not choose, until the user selects others
+	// Default: unset (every bundle)
+	DefaultBundles	[]string	`toml:"default-bundles"`
 }
 
 func loadConfig(path string) (*config, error) {
-	conf := &config {}
+	conf := &config { path: path, generation: 1 }
 	metaData, err := toml.DecodeFile(path, conf)
 	if err != nil {
 		return nil, err
 	}
+	err = conf.decodeSecrets(metaData)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, key := range metaData.Undecoded() {
 		return nil, &configError { fmt.Sprintf("unknown option %q", key.String()) }
 	}
 
+	err = conf.checkPermissions(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range []string { conf.Daemon.AgeIdentityFile, conf.Daemon.TLSKey } {
+		if file == "" {
+			continue
+		}
+		err = conf.checkPermissions(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if conf.Daemon.Listen == "" {
 		conf.Daemon.Listen = "[::1]:706"
 	}
@@ -138,6 +753,63 @@ func loadConfig(path string) (*config, error) {
 	if conf.Daemon.CacheDatabase == "" {
 		conf.Daemon.CacheDatabase = "/var/cache/portknob.db"
 	}
+	if conf.Daemon.CacheBackend == "" {
+		conf.Daemon.CacheBackend = "bolt"
+	} else if conf.Daemon.CacheBackend != "bolt" && conf.Daemon.CacheBackend != "sqlite" && conf.Daemon.CacheBackend != "redis" {
+		return nil, conf.reportConfigError("cache-backend", conf.Daemon.CacheBackend)
+	}
+	if conf.Daemon.CacheBackend == "redis" && !strings.HasPrefix(conf.Daemon.CacheDatabase, "redis://") && !strings.HasPrefix(conf.Daemon.CacheDatabase, "rediss://") {
+		return nil, &configError { "option \"cache-backend\" \"redis\" requires a \"redis://\" or \"rediss://\" URL in \"cache-database\"\n" }
+	}
+	if conf.Daemon.CacheSyncInterval == 0 {
+		conf.Daemon.CacheSyncInterval = 10
+	}
+	if conf.Daemon.MaxPeerClockSkew == 0 {
+		conf.Daemon.MaxPeerClockSkew = 30
+	}
+	if (conf.Daemon.TLSCert == "") != (conf.Daemon.TLSKey == "") {
+		return nil, &configError { "options \"tls-cert\" and \"tls-key\" must be specified together\n" }
+	}
+	if len(conf.Daemon.ACMEDomains) != 0 && conf.Daemon.TLSCert != "" {
+		return nil, &configError { "options \"acme-domains\" and \"tls-cert\" cannot be combined\n" }
+	}
+	if conf.Daemon.ACMECacheDir == "" {
+		conf.Daemon.ACMECacheDir = "/var/cache/portknob-acme"
+	}
+	if len(conf.Daemon.ACMEDomains) != 0 {
+		// Created with mode 0700 on the first certificate if it does not exist yet
+		if _, err := os.Stat(conf.Daemon.ACMECacheDir); err == nil {
+			err = conf.checkPermissions(conf.Daemon.ACMECacheDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if conf.Daemon.ACMEHTTPListen == "" {
+		conf.Daemon.ACMEHTTPListen = ":80"
+	}
+	if conf.Daemon.LogFormat == "" {
+		conf.Daemon.LogFormat = "json"
+	} else if conf.Daemon.LogFormat != "json" && conf.Daemon.LogFormat != "text" {
+		return nil, conf.reportConfigError("log-format", conf.Daemon.LogFormat)
+	}
+	if conf.Daemon.Sandbox == "" {
+		conf.Daemon.Sandbox = "off"
+	} else if conf.Daemon.Sandbox != "off" && conf.Daemon.Sandbox != "permissive" && conf.Daemon.Sandbox != "enforcing" {
+		return nil, conf.reportConfigError("sandbox", conf.Daemon.Sandbox)
+	}
+	if conf.Daemon.AuditSigningKey != "" {
+		if !conf.Daemon.AuditHashChain {
+			return nil, &configError { "option \"audit-signing-key\" requires \"audit-hash-chain\"\n" }
+		}
+		conf.Daemon.auditKey, err = readAuditKey(conf.Daemon.AuditSigningKey)
+		if err != nil {
+			return nil, &configError { fmt.Sprintf("cannot read audit-signing-key %q: %s\n", conf.Daemon.AuditSigningKey, err) }
+		}
+	}
+	if conf.Daemon.AuditCheckpointInterval == 0 {
+		conf.Daemon.AuditCheckpointInterval = 3600
+	}
 	if conf.Daemon.CookieLifespan == nil {
 		var defaultCookieLifespan uint64 = 604800
 		conf.Daemon.CookieLifespan = &defaultCookieLifespan
@@ -146,6 +818,9 @@ func loadConfig(path string) (*config, error) {
 		var defaultFirewallLifespan uint64 = 604800
 		conf.Daemon.FirewallLifespan = &defaultFirewallLifespan
 	}
+	if conf.Daemon.SweeperMaxSleep == 0 {
+		conf.Daemon.SweeperMaxSleep = 300
+	}
 	if conf.Daemon.FirewallChainName == "" {
 		conf.Daemon.FirewallChainName = "portknob"
 	}
@@ -154,7 +829,213 @@ func loadConfig(path string) (*config, error) {
 	} else if conf.Daemon.FirewallDenyMethod != "drop" && conf.Daemon.FirewallDenyMethod != "reject" {
 		return nil, conf.reportConfigError("filewall-deny-method", conf.Daemon.FirewallDenyMethod)
 	}
+	if conf.Daemon.FirewallBackend == "" {
+		conf.Daemon.FirewallBackend = "iptables"
+	}
+	knownBackend := false
+	for _, backend := range compiledBackends {
+		knownBackend = knownBackend || backend == conf.Daemon.FirewallBackend
+	}
+	if !knownBackend {
+		return nil, conf.reportConfigError("firewall-backend", conf.Daemon.FirewallBackend)
+	}
+
+	if conf.Daemon.ShutdownGrace == 0 {
+		conf.Daemon.ShutdownGrace = 10
+	}
+	if conf.Daemon.FirewallSlowThreshold == nil {
+		var defaultFirewallSlowThreshold uint64 = 1000
+		conf.Daemon.FirewallSlowThreshold = &defaultFirewallSlowThreshold
+	}
+	if conf.Daemon.AdminRateLimit == nil {
+		var defaultAdminRateLimit uint64 = 120
+		conf.Daemon.AdminRateLimit = &defaultAdminRateLimit
+	}
+	if conf.Daemon.MaxConcurrentGrants == nil {
+		var defaultMaxConcurrentGrants uint64 = 16
+		conf.Daemon.MaxConcurrentGrants = &defaultMaxConcurrentGrants
+	}
+	if conf.Daemon.DenyCounterInterval == nil {
+		var defaultDenyCounterInterval uint64 = 60
+		conf.Daemon.DenyCounterInterval = &defaultDenyCounterInterval
+	}
+
+	if conf.Daemon.Timezone == "" {
+		conf.Daemon.Timezone = "Local"
+	}
+	conf.Daemon.location, err = time.LoadLocation(conf.Daemon.Timezone)
+	if err != nil {
+		return nil, conf.reportConfigError("timezone", conf.Daemon.Timezone)
+	}
+	if conf.Daemon.HoneypotBanDuration == 0 {
+		conf.Daemon.HoneypotBanDuration = 86400
+	}
+	if conf.Daemon.AuthMaxFailures == nil {
+		var defaultAuthMaxFailures uint64 = 5
+		conf.Daemon.AuthMaxFailures = &defaultAuthMaxFailures
+	}
+	if conf.Daemon.NoJSFallback == nil {
+		defaultNoJSFallback := true
+		conf.Daemon.NoJSFallback = &defaultNoJSFallback
+	}
+	if conf.Daemon.ProbationWindow == 0 {
+		conf.Daemon.ProbationWindow = 1800
+	}
+	if conf.Daemon.ProbationActivityBytes == 0 {
+		conf.Daemon.ProbationActivityBytes = 10240
+	}
+	if conf.Daemon.AutoRekeyIPv6Idle == 0 {
+		conf.Daemon.AutoRekeyIPv6Idle = 600
+	} else if conf.Daemon.AutoRekeyIPv6Idle < 60 {
+		// The traffic counters are only read every minute
+		return nil, conf.reportConfigError("auto-rekey-ipv6-idle", strconv.FormatUint(conf.Daemon.AutoRekeyIPv6Idle, 10))
+	}
+	if conf.Daemon.AutoRekeyIPv6MaxPerDay == 0 {
+		conf.Daemon.AutoRekeyIPv6MaxPerDay = 3
+	}
+	if conf.Daemon.AuthzFailMode == "" {
+		conf.Daemon.AuthzFailMode = "closed"
+	} else if conf.Daemon.AuthzFailMode != "closed" && conf.Daemon.AuthzFailMode != "open" {
+		return nil, conf.reportConfigError("authz-fail-mode", conf.Daemon.AuthzFailMode)
+	}
+	if conf.Daemon.ShareLinkMaxLifespan == 0 {
+		conf.Daemon.ShareLinkMaxLifespan = 3600
+	}
+	if conf.Daemon.ShareLinkRateLimit == nil {
+		var defaultShareLinkRateLimit uint64 = 5
+		conf.Daemon.ShareLinkRateLimit = &defaultShareLinkRateLimit
+	}
+	if conf.Daemon.RatelimitMaxEntries == nil {
+		var defaultRatelimitMaxEntries uint64 = 100000
+		conf.Daemon.RatelimitMaxEntries = &defaultRatelimitMaxEntries
+	}
+	if conf.Daemon.AuthFailureWindow == 0 {
+		conf.Daemon.AuthFailureWindow = 300
+	}
+	if conf.Daemon.AuthBanDuration == 0 {
+		conf.Daemon.AuthBanDuration = 900
+	}
+	for user := range conf.SecretsHoneypot {
+		if _, ok := conf.Secrets[user]; ok {
+			return nil, &configError { fmt.Sprintf("honeypot user %q is also listed in [secrets]\n", user) }
+		}
+	}
 
+	conf.totpKeys = make(map[string][]byte)
+	for user, seed := range conf.TOTPSecrets {
+		if _, ok := conf.Secrets[user]; !ok {
+			return nil, &configError { fmt.Sprintf("TOTP seed for unknown user %q\n", user) }
+		}
+		conf.totpKeys[user], err = decodeTOTPSeed(seed)
+		if err != nil {
+			return nil, &configError { fmt.Sprintf("cannot parse TOTP seed of user %q: %s\n", user, err) }
+		}
+	}
+
+	for user, keys := range conf.SecretsKeys {
+		if _, ok := conf.Secrets[user]; !ok {
+			return nil, &configError { fmt.Sprintf("login keys for unknown user %q\n", user) }
+		}
+		for _, key := range keys {
+			_, err = parseLoginKey(key)
+			if err != nil {
+				return nil, &configError { fmt.Sprintf("cannot parse login key of user %q: %s\n", user, err) }
+			}
+		}
+	}
+
+	for user, sched := range conf.SecretsSchedule {
+		if _, ok := conf.Secrets[user]; !ok {
+			return nil, &configError { fmt.Sprintf("schedule for unknown user %q\n", user) }
+		}
+		err = sched.parse(conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = conf.validateLifespans()
+	if err != nil {
+		return nil, err
+	}
+
+	// Encrypted secrets are not readable from the file either
+	for user, pass := range conf.Secrets {
+		if !isHashedSecret(pass) && !strings.HasPrefix(strings.TrimSpace(pass), armor.Header) {
+			log.Printf("Warning: password of user %q is stored in plaintext, replace it with the output of \"portknob hash\"\n", user)
+		}
+	}
+	for user, pass := range conf.AdminSecrets {
+		if !isHashedSecret(pass) && !strings.HasPrefix(strings.TrimSpace(pass), armor.Header) {
+			log.Printf("Warning: password of admin %q is stored in plaintext, replace it with the output of \"portknob hash\"\n", user)
+		}
+	}
+
+	err = conf.decryptSecrets()
+	if err != nil {
+		return nil, err
+	}
+	for user, pass := range conf.Secrets {
+		err = validateSecret(pass)
+		if err != nil {
+			return nil, &configError { fmt.Sprintf("cannot parse password hash of user %q: %s\n", user, err) }
+		}
+	}
+	for user, pass := range conf.AdminSecrets {
+		err = validateSecret(pass)
+		if err != nil {
+			return nil, &configError { fmt.Sprintf("cannot parse password hash of admin %q: %s\n", user, err) }
+		}
+	}
+
+	if conf.Daemon.AdminPath != "" {
+		conf.Daemon.AdminPath = strings.TrimRight(conf.Daemon.AdminPath, "/")
+		if !strings.HasPrefix(conf.Daemon.AdminPath, "/") || conf.Daemon.AdminPath == strings.TrimRight(conf.Daemon.HTTPPath, "/") {
+			return nil, conf.reportConfigError("admin-path", conf.Daemon.AdminPath)
+		}
+		// Knocking credentials must not open the admin API
+		if len(conf.Daemon.AdminAllow) == 0 && len(conf.AdminSecrets) == 0 {
+			return nil, &configError { "option \"admin-path\" requires \"admin-allow\" or [admin-secrets]\n" }
+		}
+	}
+	if conf.Daemon.AdminListen != "" {
+		if conf.Daemon.AdminPath == "" {
+			return nil, &configError { "option \"admin-listen\" requires \"admin-path\"\n" }
+		}
+		if path, unix := strings.CutPrefix(conf.Daemon.AdminListen, "unix:"); unix && path == "" {
+			return nil, conf.reportConfigError("admin-listen", conf.Daemon.AdminListen)
+		} else if _, _, err := net.SplitHostPort(conf.Daemon.AdminListen); !unix && err != nil {
+			return nil, conf.reportConfigError("admin-listen", conf.Daemon.AdminListen)
+		}
+	}
+	for _, user := range conf.Daemon.AdminPanicUsers {
+		if _, ok := conf.AdminSecrets[user]; !ok {
+			return nil, conf.reportConfigError("admin-panic-users", user)
+		}
+	}
+	conf.Daemon.trustedNets, err = parseNetList(conf, "trusted-proxies", conf.Daemon.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Daemon.DNSRefreshInterval == 0 {
+		conf.Daemon.DNSRefreshInterval = 300
+	}
+	if conf.Daemon.ProxyProtocol && conf.Daemon.trustedNets.Empty() {
+		return nil, &configError { "option \"proxy-protocol\" requires \"trusted-proxies\"\n" }
+	}
+	for _, cidr := range conf.Daemon.AdminAllow {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, conf.reportConfigError("admin-allow", cidr)
+		}
+		conf.Daemon.adminNets = append(conf.Daemon.adminNets, ipnet)
+	}
+	err = conf.parsePolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	conf.lifespanGroups = make(map[string]lifespanGroup)
 	for i, v := range conf.Firewall {
 		if v.Proto != "tcp" && v.Proto != "udp" && v.Proto != "" {
 			return nil, conf.reportConfigError("proto", v.Proto)
@@ -175,11 +1056,812 @@ func loadConfig(path string) (*config, error) {
 		if v.DestPort == "" {
 			return nil, &configError { "option \"dport\" not specified\n" }
 		}
+		conf.Firewall[i].destPorts, err = parsePortList("dport", v.DestPort)
+		if err != nil {
+			return nil, err
+		}
+		if v.SourcePort != "" {
+			conf.Firewall[i].sourcePorts, err = parsePortList("sport", v.SourcePort)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if v.Redir != "" && len(conf.Firewall[i].destPorts) > 1 {
+			return nil, &configError { fmt.Sprintf("option \"redir\" cannot be combined with the port list %q in option \"dport\"\n", v.DestPort) }
+		}
+		if len(v.Users) != 0 {
+			if v.Group != "" {
+				return nil, &configError { fmt.Sprintf("options \"users\" and \"group\" cannot be combined in firewall rule #%d (%q)\n", i + 1, v.Comment) }
+			}
+			for _, user := range v.Users {
+				if _, ok := conf.Secrets[user]; !ok {
+					return nil, &configError { fmt.Sprintf("firewall rule #%d (%q) lists unknown user %q\n", i + 1, v.Comment, user) }
+				}
+			}
+			v.Group = usersGroup(v.Users)
+			conf.Firewall[i].Group = v.Group
+			for _, user := range v.Users {
+				if !containsString(conf.SecretsGroups[user], v.Group) {
+					conf.SecretsGroups[user] = append(conf.SecretsGroups[user], v.Group)
+				}
+			}
+		}
+		if v.Sliding {
+			if v.Lifespan == nil || *v.Lifespan == 0 {
+				return nil, &configError { fmt.Sprintf("option \"sliding\" requires a \"lifespan\" of at least 1 in firewall rule #%d (%q)\n", i + 1, v.Comment) }
+			}
+			if v.Redir != "" {
+				return nil, &configError { fmt.Sprintf("options \"sliding\" and \"redir\" cannot be combined in firewall rule #%d (%q)\n", i + 1, v.Comment) }
+			}
+			// Renewals would keep a shared entry open past the lifespan of the link
+			if v.Shareable {
+				return nil, &configError { fmt.Sprintf("options \"sliding\" and \"shareable\" cannot be combined in firewall rule #%d (%q)\n", i + 1, v.Comment) }
+			}
+			// Renewals never pass through ClampLifespan or the schedule deadline
+			if conf.Daemon.AbsoluteMaxLifespan != 0 {
+				return nil, &configError { fmt.Sprintf("options \"sliding\" and \"absolute-max-lifespan\" cannot be combined in firewall rule #%d (%q)\n", i + 1, v.Comment) }
+			}
+			var scheduled []string
+			for user := range conf.SecretsSchedule {
+				if v.Group == "" || containsString(conf.SecretsGroups[user], v.Group) {
+					scheduled = append(scheduled, user)
+				}
+			}
+			if len(scheduled) != 0 {
+				sort.Strings(scheduled)
+				return nil, &configError { fmt.Sprintf("option \"sliding\" in firewall rule #%d (%q) cannot cover user %q, who has a schedule\n", i + 1, v.Comment, scheduled[0]) }
+			}
+		}
+		if v.ProbationWindow != nil && *v.ProbationWindow == 0 || v.ProbationActivityBytes != nil && *v.ProbationActivityBytes == 0 {
+			return nil, &configError { fmt.Sprintf("options \"probation-window\" and \"probation-activity-bytes\" must be at least 1 in firewall rule #%d (%q)\n", i + 1, v.Comment) }
+		}
+		// Renewals by the firewall would extend entries without passing probation
+		if v.Sliding && conf.ruleProbation(&conf.Firewall[i]).lifespan != 0 {
+			return nil, &configError { fmt.Sprintf("option \"sliding\" cannot be combined with probation in firewall rule #%d (%q), set its \"probation-lifespan\" to 0\n", i + 1, v.Comment) }
+		}
+		switch v.Mode {
+		case "", "open":
+			conf.Firewall[i].Mode = "open"
+		case "lockdown":
+			// The set of rules without a group must stay open, it decides which sources skip the chain
+			if v.Group == "" {
+				return nil, &configError { fmt.Sprintf("option \"mode\" = \"lockdown\" requires \"group\" or \"users\" in firewall rule #%d (%q)\n", i + 1, v.Comment) }
+			}
+			for _, option := range []struct { name string; set bool } {{ "redir", v.Redir != "" }, { "sliding", v.Sliding }, { "shareable", v.Shareable }} {
+				if option.set {
+					return nil, &configError { fmt.Sprintf("option \"mode\" = \"lockdown\" cannot be combined with %q in firewall rule #%d (%q)\n", option.name, i + 1, v.Comment) }
+				}
+			}
+		default:
+			return nil, conf.reportConfigError("mode", v.Mode)
+		}
+		if v.Bundle != "" {
+			// The rules without a group are opened by every login
+			if v.Group == "" {
+				return nil, &configError { fmt.Sprintf("option \"bundle\" requires \"group\" or \"users\" in firewall rule #%d (%q)\n", i + 1, v.Comment) }
+			}
+			err = conf.checkBundleName(v.Bundle)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if v.RequireTOTP && v.Shareable {
+			return nil, &configError { fmt.Sprintf("options \"require-totp\" and \"shareable\" cannot be combined in firewall rule #%d (%q)\n", i + 1, v.Comment) }
+		}
+		if v.Lifespan != nil {
+			group := lifespanGroup { parent: v.Group, lifespan: *v.Lifespan, sliding: v.Sliding, lockdown: conf.Firewall[i].Mode == "lockdown" }
+			v.Group = group.name()
+			conf.Firewall[i].Group = v.Group
+			conf.lifespanGroups[v.Group] = group
+		}
+		if v.Group != "" {
+			err = conf.checkGroupName(v.Group)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	// A whitelist entry opens every rule of its group
+	for i, rule := range conf.Firewall {
+		for j, other := range conf.Firewall[:i] {
+			if other.Group == rule.Group && other.RequireTOTP != rule.RequireTOTP {
+				return nil, &configError { fmt.Sprintf("firewall rules #%d (%q) and #%d (%q) of the same group must both have \"require-totp\" or neither\n", j + 1, other.Comment, i + 1, rule.Comment) }
+			}
+			if other.Group == rule.Group && other.Bundle != rule.Bundle {
+				return nil, &configError { fmt.Sprintf("firewall rules #%d (%q) and #%d (%q) of the same group must have the same \"bundle\"\n", j + 1, other.Comment, i + 1, rule.Comment) }
+			}
+			if other.Group == rule.Group && other.Mode != rule.Mode {
+				return nil, &configError { fmt.Sprintf("firewall rules #%d (%q) and #%d (%q) of the same group must have the same \"mode\"\n", j + 1, other.Comment, i + 1, rule.Comment) }
+			}
+			if other.Group == rule.Group && conf.ruleProbation(&conf.Firewall[j]) != conf.ruleProbation(&conf.Firewall[i]) {
+				return nil, &configError { fmt.Sprintf("firewall rules #%d (%q) and #%d (%q) of the same group must have the same probation options\n", j + 1, other.Comment, i + 1, rule.Comment) }
+			}
+		}
+	}
+	for user, groups := range conf.SecretsGroups {
+		for _, group := range groups {
+			if !conf.hasGroup(group) {
+				log.Printf("Warning: user %q has group %q, but no firewall rule uses it\n", user, group)
+			}
+		}
+	}
+
+	err = conf.parseBundles()
+	if err != nil {
+		return nil, err
+	}
+
+	err = conf.Auth.parse(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.Notify != nil {
+		err = conf.Notify.parse(conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Authz != nil {
+		err = conf.Authz.parse(conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Defense != nil {
+		err = conf.Defense.parse(conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = conf.parseDeviceKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	sequences := make(map[string]string)
+	for user, knock := range conf.Knock {
+		err = knock.parse(conf, user)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := sequences[knock.String()]; ok {
+			return nil, &configError { fmt.Sprintf("users %q and %q have the same knock sequence\n", other, user) }
+		}
+		sequences[knock.String()] = user
+	}
+
+	err = conf.checkRedirLoops()
+	if err != nil {
+		return nil, err
+	}
+
+	err = conf.checkShareable()
+	if err != nil {
+		return nil, err
+	}
+	if conf.Daemon.AllowKeyLogins {
+		err = conf.checkServedPath("allow-key-logins", conf.keyPath())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.Daemon.CookieGrantDelay != 0 {
+		err = conf.checkServedPath("cookie-grant-delay", conf.cancelPath())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(conf.lockdownGroups()) != 0 {
+		err = conf.checkServedPath("mode", conf.lockdownPath())
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return conf, nil
 }
 
+// Name the first option which cannot change without a restart, "" if newConf may be applied
+func (conf *config) restartOption(newConf *config) string {
+	switch {
+	case conf.Daemon.Listen != newConf.Daemon.Listen:
+		return "\"listen\""
+	case conf.Daemon.HTTPPath != newConf.Daemon.HTTPPath:
+		return "\"http-path\""
+	case conf.Daemon.AdminPath != newConf.Daemon.AdminPath:
+		return "\"admin-path\""
+	case conf.Daemon.AdminListen != newConf.Daemon.AdminListen:
+		return "\"admin-listen\""
+	case conf.Daemon.AllowShareLinks != newConf.Daemon.AllowShareLinks:
+		return "\"allow-share-links\""
+	case conf.Daemon.AllowKeyLogins != newConf.Daemon.AllowKeyLogins:
+		return "\"allow-key-logins\""
+	case (len(conf.DeviceKeys) == 0) != (len(newConf.DeviceKeys) == 0):
+		return "[[device-key]] from or to none"
+	case conf.probationEnabled() != newConf.probationEnabled():
+		return "\"probation-lifespan\""
+	case conf.Daemon.AutoRekeyIPv6 != newConf.Daemon.AutoRekeyIPv6:
+		return "\"auto-rekey-ipv6\""
+	case strings.Join(conf.lockdownGroups(), "\n") != strings.Join(newConf.lockdownGroups(), "\n"):
+		return "\"mode\" of a rule"
+	case (conf.Daemon.CookieGrantDelay == 0) != (newConf.Daemon.CookieGrantDelay == 0):
+		return "\"cookie-grant-delay\" from or to 0"
+	case *conf.Daemon.MaxConcurrentGrants != *newConf.Daemon.MaxConcurrentGrants:
+		return "\"max-concurrent-grants\""
+	case conf.Daemon.MetricsListen != newConf.Daemon.MetricsListen:
+		return "\"metrics-listen\""
+	case conf.Daemon.ControlSocket != newConf.Daemon.ControlSocket:
+		return "\"control-socket\""
+	case conf.Daemon.SessionSocket != newConf.Daemon.SessionSocket:
+		return "\"session-socket\""
+	case conf.Daemon.ProxyProtocol != newConf.Daemon.ProxyProtocol:
+		return "\"proxy-protocol\""
+	case conf.Daemon.TLSCert != newConf.Daemon.TLSCert || conf.Daemon.TLSKey != newConf.Daemon.TLSKey:
+		return "\"tls-cert\" or \"tls-key\""
+	case fmt.Sprint(conf.Daemon.ACMEDomains) != fmt.Sprint(newConf.Daemon.ACMEDomains) || conf.Daemon.ACMEEmail != newConf.Daemon.ACMEEmail || conf.Daemon.ACMECacheDir != newConf.Daemon.ACMECacheDir || conf.Daemon.ACMEHTTPListen != newConf.Daemon.ACMEHTTPListen:
+		return "the ACME options"
+	case conf.Daemon.FirewallChainName != newConf.Daemon.FirewallChainName:
+		return "\"firewall-chain-name\""
+	case conf.Daemon.FirewallBackend != newConf.Daemon.FirewallBackend:
+		return "\"firewall-backend\""
+	case conf.Daemon.CacheDatabase != newConf.Daemon.CacheDatabase:
+		return "\"cache-database\""
+	case conf.Daemon.CacheBackend != newConf.Daemon.CacheBackend || conf.Daemon.CacheKeyPrefix != newConf.Daemon.CacheKeyPrefix:
+		return "\"cache-backend\" or \"cache-key-prefix\""
+	case conf.Daemon.AuditLog != newConf.Daemon.AuditLog || conf.Daemon.LogFormat != newConf.Daemon.LogFormat:
+		return "\"audit-log\" or \"log-format\""
+	case conf.Daemon.AuditHashChain != newConf.Daemon.AuditHashChain || conf.Daemon.AuditSigningKey != newConf.Daemon.AuditSigningKey || conf.Daemon.AuditCheckpointInterval != newConf.Daemon.AuditCheckpointInterval:
+		return "\"audit-hash-chain\", \"audit-signing-key\" or \"audit-checkpoint-interval\""
+	case conf.Daemon.Sandbox != newConf.Daemon.Sandbox:
+		return "\"sandbox\""
+	case conf.Daemon.AuthBanFirewall != newConf.Daemon.AuthBanFirewall:
+		return "\"auth-ban-firewall\""
+	case conf.Daemon.IPv4Prefix != newConf.Daemon.IPv4Prefix:
+		return "\"ipv4-prefix\""
+	case conf.Daemon.IPv6Prefix != newConf.Daemon.IPv6Prefix:
+		return "\"ipv6-prefix\""
+	case (*conf.Daemon.FirewallLifespan == 0) != (*newConf.Daemon.FirewallLifespan == 0):
+		// The whitelist sets were created with or without a default timeout
+		return "\"firewall-lifespan\" from or to 0"
+	}
+	if fmt.Sprint(conf.Notify) != fmt.Sprint(newConf.Notify) {
+		return "the [notify] options"
+	}
+	if conf.Auth.oidcPath() != newConf.Auth.oidcPath() {
+		return "the path of \"redirect-url\""
+	}
+	if fmt.Sprint(conf.knockPorts()) != fmt.Sprint(newConf.knockPorts()) {
+		return "the knock ports"
+	}
+	// Without rule groups whitelisted sources skip the chain, with them every rule matches its own group
+	// Groups can be added or removed by a reload as long as there is one before and after
+	if conf.hasGroups() != newConf.hasGroups() {
+		return "the rule groups from or to none"
+	}
+	return ""
+}
+
+// Accept the flat [secrets] table, with passwords or tables as values, and [[secrets]] entries
+func (conf *config) decodeSecrets(metaData toml.MetaData) error {
+	conf.Secrets = make(map[string]string)
+	conf.SecretsGroups = make(map[string][]string)
+	conf.SecretsLifespan = make(map[string]uint64)
+	conf.SecretsShareLifespan = make(map[string]uint64)
+	conf.SecretsEmail = make(map[string]string)
+	conf.SecretsDefaultBundles = make(map[string][]string)
+	if !metaData.IsDefined("secrets") {
+		return nil
+	}
+	var entries []configSecret
+	if metaData.Type("secrets") == "Hash" {
+		// Values are passwords, or tables like [[secrets]] entries keyed by the username
+		var values map[string]toml.Primitive
+		err := metaData.PrimitiveDecode(conf.RawSecrets, &values)
+		if err != nil {
+			return err
+		}
+		for user, value := range values {
+			if metaData.Type("secrets", user) != "Hash" {
+				var pass string
+				err = metaData.PrimitiveDecode(value, &pass)
+				if err != nil {
+					return &configError { fmt.Sprintf("cannot parse secret of user %q: %s\n", user, err) }
+				}
+				conf.Secrets[user] = pass
+				continue
+			}
+			entry := configSecret { Username: user }
+			err = metaData.PrimitiveDecode(value, &entry)
+			if err != nil {
+				return &configError { fmt.Sprintf("cannot parse secret of user %q: %s\n", user, err) }
+			}
+			if entry.Username != user {
+				return &configError { fmt.Sprintf("option \"username\" %q does not match the key %q in [secrets]\n", entry.Username, user) }
+			}
+			entries = append(entries, entry)
+		}
+	} else {
+		err := metaData.PrimitiveDecode(conf.RawSecrets, &entries)
+		if err != nil {
+			return err
+		}
+	}
+	for _, v := range entries {
+		if v.Username == "" {
+			return &configError { "option \"username\" not specified in [[secrets]]\n" }
+		}
+		if _, ok := conf.Secrets[v.Username]; ok {
+			return &configError { fmt.Sprintf("user %q is listed twice in [[secrets]]\n", v.Username) }
+		}
+		conf.Secrets[v.Username] = v.Password
+		conf.SecretsGroups[v.Username] = v.Groups
+		if v.Lifespan != nil {
+			// A timeout of 0 would give entries the default of their set
+			if *v.Lifespan == 0 {
+				return &configError { fmt.Sprintf("option \"lifespan\" of user %q must be at least 1\n", v.Username) }
+			}
+			conf.SecretsLifespan[v.Username] = *v.Lifespan
+		}
+		if v.ShareLifespan != nil {
+			conf.SecretsShareLifespan[v.Username] = *v.ShareLifespan
+		}
+		if v.Email != "" {
+			// Written into the mail headers as it is
+			if strings.ContainsAny(v.Email, "\r\n<>,") || !strings.Contains(v.Email, "@") {
+				return &configError { fmt.Sprintf("invalid value of option \"email\" of user %q: %q\n", v.Username, v.Email) }
+			}
+			conf.SecretsEmail[v.Username] = v.Email
+		}
+		if v.DefaultBundles != nil {
+			conf.SecretsDefaultBundles[v.Username] = v.DefaultBundles
+		}
+		if v.TOTP != "" {
+			if _, ok := conf.TOTPSecrets[v.Username]; ok {
+				return &configError { fmt.Sprintf("user %q has a TOTP seed in both [[secrets]] and [totp-secrets]\n", v.Username) }
+			}
+			if conf.TOTPSecrets == nil {
+				conf.TOTPSecrets = make(map[string]string)
+			}
+			conf.TOTPSecrets[v.Username] = v.TOTP
+		}
+	}
+	return nil
+}
+
+// Name the group of rules with a "users" option, rules listing the same users share it
+func usersGroup(users []string) string {
+	sorted := append([]string(nil), users...)
+	sort.Strings(sorted)
+	h := fnv.New32a()
+	for i, user := range sorted {
+		if i != 0 && user == sorted[i - 1] {
+			continue
+		}
+		h.Write([]byte(user))
+		h.Write([]byte {0})
+	}
+	return fmt.Sprintf("users-%08x", h.Sum32())
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Group names become part of ipset names, which are limited to 31 characters
+func (conf *config) checkGroupName(group string) error {
+	for _, c := range group {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return conf.reportConfigError("group", group)
+		}
+	}
+	if setName := conf.Daemon.FirewallChainName + "-" + group + "-host4"; len(setName) > 31 {
+		return &configError { fmt.Sprintf("group %q is too long, ipset name %q exceeds 31 characters\n", group, setName) }
+	}
+	return nil
+}
+
+func (conf *config) hasGroup(group string) bool {
+	for _, rule := range conf.Firewall {
+		if rule.Group == group {
+			return true
+		}
+		if lg, ok := conf.lifespanGroups[rule.Group]; ok && lg.parent == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Add the lifespan groups of rules in groups, "" being rules without a group
+func (conf *config) expandGroups(groups []string) []string {
+	expanded := append([]string(nil), groups...)
+	for name, lg := range conf.lifespanGroups {
+		if containsString(groups, lg.parent) && !containsString(expanded, name) {
+			expanded = append(expanded, name)
+		}
+	}
+	return expanded
+}
+
+// Return the groups of require-totp rules among those opened for a user with groups, and whether other rules are opened too
+func (conf *config) gatedGroups(groups []string) (gated []string, others bool) {
+	opened := conf.expandGroups(append([]string {""}, groups...))
+	for _, rule := range conf.Firewall {
+		if !containsString(opened, rule.Group) {
+			continue
+		}
+		if !rule.RequireTOTP {
+			others = true
+		} else if !containsString(gated, rule.Group) {
+			gated = append(gated, rule.Group)
+		}
+	}
+	return
+}
+
+// Name the rules of groups, in the order of the configuration
+func (conf *config) groupRuleNames(groups []string) (names []string) {
+	for i, rule := range conf.Firewall {
+		if containsString(groups, rule.Group) {
+			names = append(names, conf.ruleName(i))
+		}
+	}
+	return
+}
+
+// Whether any firewall rule has a group, including those of users and lifespans
+func (conf *config) hasGroups() bool {
+	for _, rule := range conf.Firewall {
+		if rule.Group != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Default lifespan in seconds of the whitelist sets of group
+func (conf *config) groupLifespan(group string) uint64 {
+	if lg, ok := conf.lifespanGroups[group]; ok {
+		return lg.lifespan
+	}
+	return *conf.Daemon.FirewallLifespan
+}
+
+// Name the group of rules with a "lifespan" option, rules alike share it
+func (lg lifespanGroup) name() string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s\x00%d\x00%t", lg.parent, lg.lifespan, lg.sliding)
+	if lg.lockdown {
+		// Keeps the names of the groups of open rules as they were
+		h.Write([]byte("\x00lockdown"))
+	}
+	// Short enough for the ipset name limit with the default firewall-chain-name even under a long users group
+	return fmt.Sprintf("ls-%08x", h.Sum32())
+}
+
+// Parse "addr/prefix", or a single address as a subnet of its own
+func parseAddrOrCIDR(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), net.IPv4len * 8
+		}
+		return &net.IPNet { IP: ip, Mask: net.CIDRMask(bits, bits) }, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+// Parse "port" or "first<sep>last" into an inclusive range
+func parsePortRange(s string, sep byte) (first, last uint16, err error) {
+	i := strings.IndexByte(s, sep)
+	if i < 0 {
+		i = len(s)
+	}
+	first64, err := strconv.ParseUint(s[:i], 10, 16)
+	if err != nil {
+		return
+	}
+	last64 := first64
+	if i != len(s) {
+		last64, err = strconv.ParseUint(s[i+1:], 10, 16)
+		if err != nil {
+			return
+		}
+	}
+	if first64 == 0 || last64 < first64 {
+		err = strconv.ErrRange
+		return
+	}
+	return uint16(first64), uint16(last64), nil
+}
+
+type portRange struct {
+	first, last uint16
+}
+
+// Format as "port" or "first<sep>last"
+func (r portRange) format(sep string) string {
+	if r.first == r.last {
+		return strconv.Itoa(int(r.first))
+	}
+	return fmt.Sprintf("%d%s%d", r.first, sep, r.last)
+}
+
+// Parse a comma separated list of "port" and "first:last" elements, errors name the offending element
+func parsePortList(option, s string) ([]portRange, error) {
+	var ranges []portRange
+	for _, elem := range strings.Split(s, ",") {
+		first, last, err := parsePortRange(strings.TrimSpace(elem), ':')
+		if err != nil {
+			return nil, &configError { fmt.Sprintf("option %q does not support %q in %q, expected a port or an ascending range within 1-65535\n", option, elem, s) }
+		}
+		ranges = append(ranges, portRange { first, last })
+	}
+	return ranges, nil
+}
+
+// Split a redir target "addr", ":port" or "addr:port" into its parts, IPv6 addresses with a port are written as "[addr]:port"
+func splitRedir(redir string) (host, port string) {
+	if strings.HasPrefix(redir, "[") {
+		end := strings.IndexByte(redir, ']')
+		if end < 0 {
+			return redir, ""
+		}
+		host = redir[1:end]
+		if strings.HasPrefix(redir[end+1:], ":") {
+			port = redir[end+2:]
+		}
+		return
+	}
+	if strings.Count(redir, ":") == 1 {
+		i := strings.IndexByte(redir, ':')
+		return redir[:i], redir[i+1:]
+	}
+	return redir, ""
+}
+
+// Refuse redir targets which are themselves denied by a rule, unauthorized clients would be redirected into a blackhole
+func (conf *config) checkRedirLoops() error {
+	var localAddrs []net.Addr
+	for i, v := range conf.Firewall {
+		if v.Redir == "" {
+			continue
+		}
+		host, port := splitRedir(v.Redir)
+		var targetIP net.IP
+		if host != "" {
+			targetIP = net.ParseIP(host)
+			if targetIP == nil {
+				return conf.reportConfigError("redir", v.Redir)
+			}
+			// Redirecting to another machine never passes through the local deny rules
+			if localAddrs == nil {
+				localAddrs, _ = net.InterfaceAddrs()
+			}
+			local := targetIP.IsLoopback()
+			for _, addr := range localAddrs {
+				if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(targetIP) {
+					local = true
+				}
+			}
+			if !local {
+				continue
+			}
+		}
+		// Without a port, DNAT keeps the original destination port
+		first, last, err := parsePortRange(v.DestPort, ':')
+		if port != "" {
+			first, last, err = parsePortRange(port, '-')
+		}
+		if err != nil {
+			return conf.reportConfigError("redir", v.Redir)
+		}
+
+		for j, w := range conf.Firewall {
+			// Redirecting within its own ports is what the rule is for
+			if j == i {
+				continue
+			}
+			if v.Proto != "" && w.Proto != "" && v.Proto != w.Proto {
+				continue
+			}
+			if targetIP != nil && w.Dest != "" && !destContains(w.Dest, targetIP) {
+				continue
+			}
+			if targetIP == nil && v.Dest != "" && w.Dest != "" && !destContains(w.Dest, v.DestIP) {
+				continue
+			}
+			overlap := false
+			for _, r := range w.destPorts {
+				if last >= r.first && first <= r.last {
+					overlap = true
+				}
+			}
+			if !overlap {
+				continue
+			}
+			msg := fmt.Sprintf("option \"redir\" %q of firewall rule #%d (%q) points to a port denied by firewall rule #%d (%q)", v.Redir, i + 1, v.Comment, j + 1, w.Comment)
+			if !conf.Daemon.PermissiveRedir {
+				return &configError { msg + ", set \"permissive-redir\" to ignore\n" }
+			}
+			log.Println("Warning:", msg)
+		}
+	}
+	return nil
+}
+
+// Check whether the "dest" option of a rule, an address or a subnet, contains addr
+func destContains(dest string, addr net.IP) bool {
+	if strings.IndexByte(dest, '/') >= 0 {
+		_, subnet, err := net.ParseCIDR(dest)
+		return err == nil && subnet.Contains(addr)
+	}
+	return net.ParseIP(dest).Equal(addr)
+}
+
+// Warn when firewall-lifespan exceeds cookie-lifespan by more than this factor
+const lifespanRatioLimit = 4
+
+func (conf *config) validateLifespans() error {
+	cookieLifespan := *conf.Daemon.CookieLifespan
+	firewallLifespan := *conf.Daemon.FirewallLifespan
+	maxLifespan := conf.Daemon.AbsoluteMaxLifespan
+	if maxLifespan != 0 && (firewallLifespan == 0 || firewallLifespan > maxLifespan) {
+		msg := fmt.Sprintf("option \"firewall-lifespan\" (%s) exceeds \"absolute-max-lifespan\" (%s), whitelist entries will be limited to %s", formatLifespan(firewallLifespan), formatLifespan(maxLifespan), formatLifespan(maxLifespan))
+		if conf.Daemon.StrictValidation {
+			return &configError { msg + "\n" }
+		}
+		log.Println("Warning:", msg)
+		firewallLifespan = maxLifespan
+	}
+	// Rules and users with a lifespan of their own are clamped the same way
+	var clamped []string
+	if maxLifespan != 0 {
+		for i, v := range conf.Firewall {
+			if v.Lifespan != nil && (*v.Lifespan == 0 || *v.Lifespan > maxLifespan) {
+				clamped = append(clamped, fmt.Sprintf("option \"lifespan\" (%s) of firewall rule #%d (%q)", formatLifespan(*v.Lifespan), i + 1, v.Comment))
+			}
+		}
+		var users []string
+		for user, lifespan := range conf.SecretsLifespan {
+			if lifespan > maxLifespan {
+				users = append(users, user)
+			}
+		}
+		sort.Strings(users)
+		for _, user := range users {
+			clamped = append(clamped, fmt.Sprintf("option \"lifespan\" (%s) of user %q", formatLifespan(conf.SecretsLifespan[user]), user))
+		}
+	}
+	for _, option := range clamped {
+		msg := fmt.Sprintf("%s exceeds \"absolute-max-lifespan\" (%s), whitelist entries will be limited to %s", option, formatLifespan(maxLifespan), formatLifespan(maxLifespan))
+		if conf.Daemon.StrictValidation {
+			return &configError { msg + "\n" }
+		}
+		log.Println("Warning:", msg)
+	}
+	var msg string
+	if cookieLifespan != 0 && firewallLifespan != 0 && cookieLifespan > firewallLifespan {
+		msg = fmt.Sprintf("option \"cookie-lifespan\" (%s) exceeds \"firewall-lifespan\" (%s): browsers will keep the login after the firewall whitelist has expired, visit the page again to renew the whitelist, or lower \"cookie-lifespan\"", formatLifespan(cookieLifespan), formatLifespan(firewallLifespan))
+	} else if cookieLifespan != 0 && (firewallLifespan == 0 || firewallLifespan / cookieLifespan >= lifespanRatioLimit) {
+		msg = fmt.Sprintf("option \"firewall-lifespan\" (%s) is much longer than \"cookie-lifespan\" (%s): whitelist entries will outlive the browser login, raise \"cookie-lifespan\" or lower \"firewall-lifespan\"", formatLifespan(firewallLifespan), formatLifespan(cookieLifespan))
+	}
+	if msg == "" {
+		return nil
+	}
+	if conf.Daemon.StrictValidation {
+		return &configError { msg + "\n" }
+	}
+	log.Println("Warning:", msg)
+	return nil
+}
+
+// Format a lifespan in seconds for humans, 0 means "never"
+func formatLifespan(seconds uint64) string {
+	if seconds == 0 {
+		return "never"
+	}
+	if seconds == 86400 {
+		return "1 day"
+	}
+	if seconds % 86400 == 0 {
+		return fmt.Sprintf("%d days", seconds / 86400)
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+// Decrypt the age-encrypted values of secrets and admin-secrets, the identity file is only read if there are some
+func (conf *config) decryptSecrets() error {
+	var identities []age.Identity
+	err := conf.decryptMap(conf.Secrets, "secret", &identities)
+	if err != nil {
+		return err
+	}
+	return conf.decryptMap(conf.AdminSecrets, "admin secret", &identities)
+}
+
+func (conf *config) decryptMap(secrets map[string]string, kind string, identities *[]age.Identity) error {
+	for user, pass := range secrets {
+		pass = strings.TrimSpace(pass)
+		if !strings.HasPrefix(pass, armor.Header) {
+			continue
+		}
+		if *identities == nil {
+			if conf.Daemon.AgeIdentityFile == "" {
+				return &configError { fmt.Sprintf("%s %q is encrypted but option \"age-identity-file\" not specified\n", kind, user) }
+			}
+			f, err := os.Open(conf.Daemon.AgeIdentityFile)
+			if err != nil {
+				return err
+			}
+			*identities, err = age.ParseIdentities(f)
+			f.Close()
+			if err != nil {
+				return &configError { fmt.Sprintf("cannot parse age identity file %q: %s\n", conf.Daemon.AgeIdentityFile, err) }
+			}
+		}
+		// TOML multi-line strings are usually indented
+		lines := strings.Split(pass, "\n")
+		for i := range lines {
+			lines[i] = strings.TrimSpace(lines[i])
+		}
+		r, err := age.Decrypt(armor.NewReader(strings.NewReader(strings.Join(lines, "\n") + "\n")), *identities...)
+		if err != nil {
+			return &configError { fmt.Sprintf("cannot decrypt %s %q: %s\n", kind, user, err) }
+		}
+		plain, err := ioutil.ReadAll(r)
+		if err != nil {
+			return &configError { fmt.Sprintf("cannot decrypt %s %q: %s\n", kind, user, err) }
+		}
+		secrets[user] = string(bytes.TrimRight(plain, "\r\n"))
+	}
+	return nil
+}
+
+// Refuse files and directories containing secrets that other users may read or replace
+func (conf *config) checkPermissions(path string) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%q", path)
+	if resolved != path {
+		name = fmt.Sprintf("%q (resolved to %q)", path, resolved)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return err
+	}
+	kind, expected := "file", "0600"
+	if info.IsDir() {
+		kind, expected = "directory", "0700"
+	}
+	var msg string
+	if info.Mode().Perm() & 0077 != 0 {
+		msg = fmt.Sprintf("%s %s has mode %04o, expected %s or stricter", kind, name, info.Mode().Perm(), expected)
+	} else if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 && int(stat.Uid) != os.Geteuid() {
+		msg = fmt.Sprintf("%s %s is owned by uid %d, expected uid %d or root", kind, name, stat.Uid, os.Geteuid())
+	}
+	if msg == "" {
+		return nil
+	}
+	if conf.Daemon.PermissivePermissions {
+		log.Println("Warning:", msg)
+		return nil
+	}
+	return &configError { msg + ", set \"permissive-permissions\" to ignore\n" }
+}
+
 func (conf *config) reportConfigError(option, value string) *configError {
 	return &configError { fmt.Sprintf("option %q does not support %q\n", option, value) }
 }
@@ -0,0 +1,382 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+func encryptSecret(t *testing.T, recipient age.Recipient, plain string) string {
+	var buf bytes.Buffer
+	a := armor.NewWriter(&buf)
+	w, err := age.Encrypt(a, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(plain))
+	w.Close()
+	a.Close()
+	return buf.String()
+}
+
+// Recipients of testdata/age-identity.txt and of an identity not checked in
+const (
+	testAgeRecipient	= "age1chjxm4v78q9frnlqksq47azq4xnq92l0x3kgkw8cnk3legptqpgqwszqpv"
+	otherAgeRecipient	= "age16m0y9nzz8cuqpt7tptcggkgmgfmppf67trl722g3nn7htfqwuahqplqs0r"
+)
+
+func TestDecryptSecrets(t *testing.T) {
+	recipient, err := age.ParseX25519Recipient(testAgeRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.ParseX25519Recipient(otherAgeRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join("testdata", "age-identity.txt")
+	encrypted := encryptSecret(t, recipient, "hunter2\n")
+	tests := []struct {
+		name		string
+		secret		string
+		admin		bool
+		identityFile	string
+		want		string
+		wantErr		string
+	}{
+		{ "plaintext", "hunter2", false, "", "hunter2", "" },
+		{ "encrypted", encrypted, false, identityFile, "hunter2", "" },
+		{ "indented", strings.ReplaceAll(encrypted, "\n", "\n    "), false, identityFile, "hunter2", "" },
+		{ "no identity file", encrypted, false, "", "", "not specified" },
+		{ "wrong identity", encryptSecret(t, other, "hunter2"), false, identityFile, "", "cannot decrypt" },
+		{ "admin plaintext", "hunter2", true, "", "hunter2", "" },
+		{ "admin encrypted", encrypted, true, identityFile, "hunter2", "" },
+		{ "admin no identity file", encrypted, true, "", "", "admin secret \"alice\" is encrypted" },
+		{ "admin wrong identity", encryptSecret(t, other, "hunter2"), true, identityFile, "", "cannot decrypt admin secret" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			conf := &config { Secrets: map[string]string {}, AdminSecrets: map[string]string {} }
+			if tt.admin {
+				conf.AdminSecrets["alice"] = tt.secret
+			} else {
+				conf.Secrets["alice"] = tt.secret
+			}
+			conf.Daemon.AgeIdentityFile = tt.identityFile
+			err := conf.decryptSecrets()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := conf.Secrets["alice"]
+			if tt.admin {
+				got = conf.AdminSecrets["alice"]
+			}
+			if got != tt.want {
+				t.Errorf("secret %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Hashed and encrypted passwords are not readable from the configuration
+func TestPlaintextWarning(t *testing.T) {
+	recipient, err := age.ParseX25519Recipient(testAgeRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := encryptSecret(t, recipient, "hunter2")
+	hashed, err := hashSecret([]byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name		string
+		table		string
+		secret		string
+		wantWarning	bool
+	}{
+		{ "user plaintext", "secrets", "hunter2", true },
+		{ "user hashed", "secrets", hashed, false },
+		{ "user encrypted", "secrets", encrypted, false },
+		{ "admin plaintext", "admin-secrets", "hunter2", true },
+		{ "admin hashed", "admin-secrets", hashed, false },
+		{ "admin encrypted", "admin-secrets", encrypted, false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			defer log.SetOutput(os.Stderr)
+			_, err := loadConfig(writeTestConfig(t, fmt.Sprintf("[daemon]\ncache-database = \"/nonexistent/portknob.db\"\nage-identity-file = %q\npermissive-permissions = true\n[%s]\nalice = \"\"\"%s\"\"\"\n", filepath.Join("testdata", "age-identity.txt"), tt.table, tt.secret)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(buf.String(), "plaintext"); got != tt.wantWarning {
+				t.Errorf("warning %t, want %t: %s", got, tt.wantWarning, buf.String())
+			}
+		})
+	}
+}
+
+func TestValidateLifespans(t *testing.T) {
+	u := func (v uint64) *uint64 { return &v }
+	tests := []struct {
+		name		string
+		max			uint64
+		firewall	uint64
+		rule		*uint64
+		user		uint64
+		// Whether strict-validation refuses it
+		wantErr		bool
+	}{
+		{ "no cap", 0, 0, u(0), 86400, false },
+		{ "all below the cap", 3600, 600, u(1800), 1200, false },
+		{ "firewall-lifespan above the cap", 3600, 7200, nil, 0, true },
+		{ "firewall-lifespan never expiring", 3600, 0, nil, 0, true },
+		{ "rule above the cap", 3600, 600, u(7200), 0, true },
+		{ "rule never expiring", 3600, 600, u(0), 0, true },
+		{ "user above the cap", 3600, 600, nil, 86400, true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			conf := &config { SecretsLifespan: map[string]uint64 {} }
+			conf.Daemon.AbsoluteMaxLifespan = tt.max
+			conf.Daemon.FirewallLifespan = &tt.firewall
+			var cookieLifespan uint64
+			conf.Daemon.CookieLifespan = &cookieLifespan
+			conf.Daemon.StrictValidation = true
+			conf.Firewall = []configFirewall {{ Lifespan: tt.rule }}
+			if tt.user != 0 {
+				conf.SecretsLifespan["alice"] = tt.user
+			}
+			err := conf.validateLifespans()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateLifespans() error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Write a configuration file only its owner can read, as loadConfig insists
+func writeTestConfig(t *testing.T, text string) string {
+	path := filepath.Join(t.TempDir(), "portknob.conf")
+	err := os.WriteFile(path, []byte(text), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSecretsGroups(t *testing.T) {
+	rules := `
+[[firewall]]
+dport = "80"
+[[firewall]]
+dport = "22"
+group = "ssh"
+`
+	tests := []struct {
+		name		string
+		secrets		string
+		wantGroups	map[string][]string
+		wantErr		string
+	}{
+		{ "flat table", `
+[secrets]
+alice = "a"
+`, map[string][]string { "alice": nil }, "" },
+		{ "groups per user", `
+[[secrets]]
+username = "alice"
+password = "a"
+groups = ["ssh"]
+[[secrets]]
+username = "bob"
+password = "b"
+`, map[string][]string { "alice": {"ssh"}, "bob": nil }, "" },
+		{ "user listed twice", `
+[[secrets]]
+username = "alice"
+password = "a"
+[[secrets]]
+username = "alice"
+password = "b"
+`, nil, "listed twice" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			conf, err := loadConfig(writeTestConfig(t, "[daemon]\ncache-database = \"/nonexistent/portknob.db\"\n" + rules + tt.secrets))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for user, want := range tt.wantGroups {
+				if got := conf.SecretsGroups[user]; strings.Join(got, ",") != strings.Join(want, ",") {
+					t.Errorf("groups of %s %q, want %q", user, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckGroupName(t *testing.T) {
+	tests := []struct {
+		group		string
+		wantErr		bool
+	}{
+		{ "ssh", false },
+		{ "web_admin-2", false },
+		{ "with space", true },
+		{ "semi;colon", true },
+		{ "a-group-name-much-too-long", true },
+	}
+	conf := &config {}
+	conf.Daemon.FirewallChainName = "portknob"
+	for _, tt := range tests {
+		err := conf.checkGroupName(tt.group)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkGroupName(%q) error %v, want error %t", tt.group, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAuthProvider(t *testing.T) {
+	oidc := `
+[auth.oidc]
+issuer = "https://accounts.example.com"
+client-id = "portknob"
+redirect-url = "https://portknob.example.com/oidc"
+`
+	ldap := `
+[auth.ldap]
+server = "ldaps://ldap.example.com"
+base-dn = "ou=people,dc=example,dc=com"
+`
+	tests := []struct {
+		name		string
+		auth		string
+		user		string
+		// "secrets", "ldap" or "" for none
+		want		string
+	}{
+		{ "user in secrets", ldap, "alice", "secrets" },
+		{ "directory user", ldap, "bob", "ldap" },
+		{ "unknown without a directory", oidc, "bob", "" },
+		{ "single sign-on name", ldap + oidc, "oidc:alice", "" },
+		{ "no username", ldap, "", "" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			conf, err := loadConfig(writeTestConfig(t, "[daemon]\ncache-database = \"/nonexistent/portknob.db\"\n[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"a\"\n" + tt.auth))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			switch conf.authProvider(tt.user).(type) {
+			case secretsAuth:
+				got = "secrets"
+			case *configLDAP:
+				got = "ldap"
+			}
+			if got != tt.want {
+				t.Errorf("authProvider(%q) is %q, want %q", tt.user, got, tt.want)
+			}
+		})
+	}
+
+	_, err := loadConfig(writeTestConfig(t, "[daemon]\ncache-database = \"/nonexistent/portknob.db\"\n[[firewall]]\ndport = \"22\"\n[secrets]\n\"oidc:alice\" = \"a\"\n" + oidc))
+	if err == nil || !strings.Contains(err.Error(), "prefix") {
+		t.Errorf("error %v for a [secrets] user named like a single sign-on user, want one about the prefix", err)
+	}
+}
+
+func TestCheckRedirLoops(t *testing.T) {
+	tests := []struct {
+		name		string
+		rules		string
+		permissive	bool
+		wantErr		bool
+	}{
+		{ "direct", "[[firewall]]\ndport = \"80\"\nredir = \":8080\"\n[[firewall]]\ndport = \"8080\"\n", false, true },
+		{ "range overlap", "[[firewall]]\ndport = \"80\"\nredir = \"127.0.0.1:8000-8010\"\n[[firewall]]\ndport = \"8005:8100\"\n", false, true },
+		{ "any destination", "[[firewall]]\ndport = \"80\"\nredir = \"127.0.0.1:2222\"\n[[firewall]]\ndest = \"192.0.2.1\"\ndport = \"22\"\n[[firewall]]\ndport = \"2222\"\n", false, true },
+		{ "other destination", "[[firewall]]\ndport = \"80\"\nredir = \"127.0.0.1:2222\"\n[[firewall]]\ndest = \"192.0.2.1\"\ndport = \"2222\"\n", false, false },
+		{ "other protocol", "[[firewall]]\nproto = \"tcp\"\ndport = \"80\"\nredir = \":8080\"\n[[firewall]]\nproto = \"udp\"\ndport = \"8080\"\n", false, false },
+		{ "another host", "[[firewall]]\ndport = \"80\"\nredir = \"192.0.2.1:8080\"\n[[firewall]]\ndport = \"8080\"\n", false, false },
+		{ "within its own ports", "[[firewall]]\ndport = \"8000:8100\"\nredir = \":8080\"\n", false, false },
+		{ "permissive", "[[firewall]]\ndport = \"80\"\nredir = \":8080\"\n[[firewall]]\ndport = \"8080\"\n", true, false },
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, fmt.Sprintf("[daemon]\ncache-database = %q\npermissive-redir = %t\n%s", filepath.Join(t.TempDir(), "cache.db"), tt.permissive, tt.rules)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "permissive-redir") {
+				t.Errorf("error %q does not mention permissive-redir", err)
+			}
+		})
+	}
+}
+
+func TestRequireTOTPGroups(t *testing.T) {
+	tests := []struct {
+		name		string
+		rules		string
+		wantErr		bool
+	}{
+		{ "group of its own", "[[firewall]]\ndport = \"22\"\n[[firewall]]\ndport = \"8443\"\ngroup = \"admin\"\nrequire-totp = true\n", false },
+		{ "shared group", "[[firewall]]\ndport = \"22\"\n[[firewall]]\ndport = \"8443\"\nrequire-totp = true\n", true },
+		{ "own lifespan", "[[firewall]]\ndport = \"22\"\n[[firewall]]\ndport = \"8443\"\nlifespan = 600\nrequire-totp = true\n", false },
+		{ "shareable", "[[firewall]]\ndport = \"8443\"\ngroup = \"admin\"\nrequire-totp = true\nshareable = true\n", true },
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, fmt.Sprintf("[daemon]\ncache-database = %q\n%s", filepath.Join(t.TempDir(), "cache.db"), tt.rules)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,536 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Listen on control-socket for the list, grant, revoke, flush, maintenance, panic, rotate-cookie-secret, key and export commands
+// Only root may connect, there is no other authentication
+func (s *server) startControl() error {
+	ln, err := listenUnix(s.conf.Daemon.ControlSocket, 0600)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.controlHandlerFunc)
+	go func() {
+		log.Println(http.Serve(ln, mux))
+	}()
+	return nil
+}
+
+// Listen on the unix socket path with mode, replacing a socket left behind by a daemon which did not exit cleanly
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode() & os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another portknob is listening on %q", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Serve GET /entries, POST /grant, DELETE /entries/<subnet>, POST /flush, /maintenance, /panic, POST /rotate-cookie-secret, /keys and GET /access-review
+func (s *server) controlHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+
+	// Only root connects, one bucket for all of it is enough to stop a runaway script
+	if s.rateLimited(w, s.controlLimiter, "control") {
+		return
+	}
+	if s.readOnlyRefuses(w, r, r.URL.Path, "/entries", "/access-review", "/keys", "/maintenance", "/panic") {
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/entries" && r.Method == "GET":
+		s.adminListEntries(w)
+	case strings.HasPrefix(r.URL.Path, "/entries/") && r.Method == "DELETE":
+		s.adminRevoke(w, strings.TrimPrefix(r.URL.Path, "/entries/"), r.URL.Query().Get("rule"))
+	case r.URL.Path == "/grant" && r.Method == "POST":
+		s.serveGrant(w, r, false, controlActor(r))
+	case r.URL.Path == "/flush" && r.Method == "POST":
+		s.controlFlush(w)
+	case r.URL.Path == "/maintenance":
+		s.serveMaintenance(w, r, controlActor(r))
+	case r.URL.Path == "/panic":
+		s.servePanic(w, r, controlActor(r))
+	case r.URL.Path == "/rotate-cookie-secret" && r.Method == "POST":
+		s.controlRotateCookieKey(w, controlActor(r))
+	case r.URL.Path == "/keys" || r.URL.Path == "/keys/remove":
+		s.controlKeys(w, r, controlActor(r))
+	case r.URL.Path == "/access-review":
+		s.serveAccessReview(w, r)
+	case r.URL.Path == "/explain":
+		s.serveExplain(w, r)
+	default:
+		s.writeJSON(w, 404, map[string]string { "error": "not found" })
+	}
+}
+
+// Return who sent a control request, for the audit log
+// Only root reaches the socket, the command says which user ran it
+func controlActor(r *http.Request) string {
+	by := "control-socket"
+	if user := r.FormValue("by"); user != "" {
+		by += " " + user
+	}
+	return by
+}
+
+// Revoke every whitelisted subnet
+func (s *server) controlFlush(w http.ResponseWriter) {
+	entries, err := s.adminEntries()
+	if err != nil {
+		s.writeJSON(w, 500, map[string]string { "error": "cannot read cache database" })
+		return
+	}
+	revoked := []string {}
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if seen[entry.Subnet] {
+			continue
+		}
+		seen[entry.Subnet] = true
+		subnet, code, message := s.revokeSubnet(entry.Subnet)
+		if code != 200 && code != 404 {
+			s.writeJSON(w, code, map[string]interface{} { "error": message, "revoked": revoked })
+			return
+		}
+		if code == 200 {
+			revoked = append(revoked, subnet)
+		}
+	}
+	s.writeJSON(w, 200, map[string][]string { "revoked": revoked })
+}
+
+// Replace the key signing login cookies and grant tokens for every instance sharing the cache database
+// What the old key signed stays valid until it expires, so nobody has to log in again
+func (s *server) controlRotateCookieKey(w http.ResponseWriter, by string) {
+	previous, err := s.fw.cache.RotateCookieKey(time.Duration(*s.conf.Daemon.CookieLifespan) * time.Second, time.Now())
+	if err != nil {
+		log.Println(err)
+		s.writeJSON(w, 500, map[string]string { "error": "cannot update cache database" })
+		return
+	}
+	log.Printf("Cookie secret rotated by %s\n", by)
+	s.fw.audit.Event("cookie-secret-rotate", "by", by, "previous", previous)
+	s.writeJSON(w, 200, map[string]int { "previous": previous })
+}
+
+// Run a control command against the daemon using conf, args being the command and its arguments
+func runControlCommand(conf *config, args []string) error {
+	if conf.Daemon.ControlSocket == "" {
+		return fmt.Errorf("option \"control-socket\" is not set in %q", conf.path)
+	}
+	client := &http.Client {
+		Transport: &http.Transport {
+			DialContext: func (ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer {}).DialContext(ctx, "unix", conf.Daemon.ControlSocket)
+			},
+		},
+		Timeout: 30 * time.Second,
+	}
+	request := func (method, path string, form url.Values, reply interface{}) error {
+		req, err := http.NewRequest(method, "http://portknob" + path, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("cannot reach the daemon: %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			var failure struct { Error string `json:"error"` }
+			json.NewDecoder(resp.Body).Decode(&failure)
+			if failure.Error == "" {
+				failure.Error = resp.Status
+			}
+			return errors.New(failure.Error)
+		}
+		return json.NewDecoder(resp.Body).Decode(reply)
+	}
+
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return errUsage
+		}
+		var reply struct { Entries []adminEntry `json:"entries"` }
+		err := request("GET", "/entries", nil, &reply)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ADDRESS\tSUBNET\tUSER\tGROUP\tRULES\tEXPIRES")
+		for _, entry := range reply.Entries {
+			rules := strings.Join(entry.Rules, ", ")
+			if entry.Action != "" {
+				rules += " (" + entry.Action + ")"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Address, entry.Subnet, entry.User, entry.Group, rules, entry.Expires)
+		}
+		return tw.Flush()
+	case "grant":
+		flags := flag.NewFlagSet("grant", flag.ContinueOnError)
+		duration := flags.Duration("duration", 0, "Lifespan of the whitelist entries (default the lifespans of the user and the rules, like a login)")
+		user := flags.String("user", "", "User to record the entry for")
+		group := flags.String("group", "", "Rule group to open besides rules without a group")
+		dryRun := flags.Bool("dry-run", false, "Show what the grant would do and a token confirming it, without granting")
+		token := flags.String("token", "", "Confirmation token of a dry run of the same grant")
+		// Flags may come before or after the address
+		err := flags.Parse(args[1:])
+		if err != nil || flags.NArg() == 0 {
+			return errUsage
+		}
+		addr := flags.Arg(0)
+		err = flags.Parse(flags.Args()[1:])
+		if err != nil || flags.NArg() != 0 || *duration < 0 || *dryRun && *token != "" {
+			return errUsage
+		}
+		form := url.Values {
+			"address":	{ addr },
+			"duration":	{ strconv.FormatInt(int64(*duration / time.Second), 10) },
+			"user":		{ *user },
+			"group":	{ *group },
+			"token":	{ *token },
+			"by":		{ controlUser() },
+		}
+		if *dryRun {
+			form.Set("dry_run", "true")
+			var preview grantPreview
+			err = request("POST", "/grant", form, &preview)
+			if err != nil {
+				return err
+			}
+			for _, entry := range preview.Entries {
+				fmt.Printf("Would whitelist %s in %s, expires %s\n", entry.Subnet, entry.Set, entry.Expires)
+			}
+			for _, command := range preview.Commands {
+				fmt.Printf("Would run: %s\n", command)
+			}
+			for _, warning := range preview.Warnings {
+				fmt.Printf("Warning: %s\n", warning)
+			}
+			fmt.Printf("Confirm before %s by running the same command with -token %s instead of -dry-run\n", preview.TokenExpires, preview.Token)
+			return nil
+		}
+		var reply struct { Granted, Expires string }
+		err = request("POST", "/grant", form, &reply)
+		if err != nil {
+			return err
+		}
+		if reply.Expires == "" {
+			reply.Expires = "never"
+		}
+		fmt.Printf("Whitelisted %s, expires %s\n", reply.Granted, reply.Expires)
+		return nil
+	case "revoke":
+		flags := flag.NewFlagSet("revoke", flag.ContinueOnError)
+		subnet := flags.String("subnet", "", "Address or subnet to revoke, instead of the argument")
+		rule := flags.String("rule", "", "Number or comment of the rule to close, leaving the subnet's other rules open")
+		err := flags.Parse(args[1:])
+		if err == nil && flags.NArg() != 0 && *subnet == "" {
+			*subnet = flags.Arg(0)
+			err = flags.Parse(flags.Args()[1:])
+		}
+		if err != nil || flags.NArg() != 0 || *subnet == "" {
+			return errUsage
+		}
+		path := "/entries/" + *subnet
+		if *rule != "" {
+			path += "?rule=" + url.QueryEscape(*rule)
+		}
+		var reply struct { Revoked string; Rules []string }
+		err = request("DELETE", path, nil, &reply)
+		if err != nil {
+			return err
+		}
+		if *rule != "" {
+			fmt.Printf("Revoked %s for %s\n", reply.Revoked, strings.Join(reply.Rules, ", "))
+			return nil
+		}
+		fmt.Printf("Revoked %s\n", reply.Revoked)
+		return nil
+	case "maintenance":
+		if len(args) < 2 {
+			return errUsage
+		}
+		var reply maintenanceReply
+		switch args[1] {
+		case "on":
+			flags := flag.NewFlagSet("maintenance", flag.ContinueOnError)
+			duration := flags.Duration("duration", time.Hour, "How long new grants are refused")
+			message := flags.String("message", "", "Shown on the login page, such as \"back at 14:00 UTC\"")
+			err := flags.Parse(args[2:])
+			if err != nil || flags.NArg() != 0 || *duration < time.Second {
+				return errUsage
+			}
+			err = request("PUT", "/maintenance", url.Values {
+				"duration":	{ strconv.FormatInt(int64(*duration / time.Second), 10) },
+				"message":	{ *message },
+				"by":		{ controlUser() },
+			}, &reply)
+			if err != nil {
+				return err
+			}
+		case "off":
+			if len(args) != 2 {
+				return errUsage
+			}
+			err := request("DELETE", "/maintenance?" + url.Values { "by": { controlUser() } }.Encode(), nil, &reply)
+			if err != nil {
+				return err
+			}
+		case "status":
+			if len(args) != 2 {
+				return errUsage
+			}
+			err := request("GET", "/maintenance", nil, &reply)
+			if err != nil {
+				return err
+			}
+		default:
+			return errUsage
+		}
+		if !reply.Maintenance {
+			fmt.Println("Maintenance mode is off")
+			return nil
+		}
+		fmt.Printf("Maintenance mode until %s, turned on by %s at %s\n", reply.Until, reply.By, reply.Since)
+		if reply.Message != "" {
+			fmt.Printf("Message: %s\n", reply.Message)
+		}
+		return nil
+	case "panic":
+		flags := flag.NewFlagSet("panic", flag.ContinueOnError)
+		yes := flags.Bool("yes-i-mean-it", false, "Do not ask for the confirmation phrase")
+		acknowledge := flags.Bool("acknowledge", false, "Forget the record of the last panic instead")
+		err := flags.Parse(args[1:])
+		if err != nil || flags.NArg() != 0 || *yes && *acknowledge {
+			return errUsage
+		}
+		if *acknowledge {
+			var reply panicReply
+			err = request("DELETE", "/panic?" + url.Values { "by": { controlUser() } }.Encode(), nil, &reply)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Acknowledged the panic")
+			return nil
+		}
+		if !*yes {
+			fmt.Printf("This revokes every whitelist entry and login cookie, every user must log in again.\nType %q to go ahead: ", panicPhrase)
+			line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if strings.TrimSpace(line) != panicPhrase {
+				return errors.New("panic cancelled")
+			}
+		}
+		var summary panicSummary
+		err = request("POST", "/panic", url.Values { "confirm": { panicPhrase }, "by": { controlUser() } }, &summary)
+		if err != nil {
+			return err
+		}
+		for _, subnet := range summary.Revoked {
+			fmt.Printf("Revoked %s\n", subnet)
+		}
+		fmt.Printf("Revoked %d whitelist entries of %d subnets, the login cookies of every user no longer work\n", summary.Entries, len(summary.Revoked))
+		return nil
+	case "rotate-cookie-secret":
+		if len(args) != 1 {
+			return errUsage
+		}
+		var reply struct { Previous int `json:"previous"` }
+		err := request("POST", "/rotate-cookie-secret", url.Values { "by": { controlUser() } }, &reply)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rotated the cookie secret, %d previous keys still accept what they signed until it expires\n", reply.Previous)
+		return nil
+	case "key":
+		switch {
+		case len(args) == 2 && args[1] == "list":
+			var reply struct { Keys []loginKeyInfo `json:"keys"` }
+			err := request("GET", "/keys", nil, &reply)
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "USER\tFINGERPRINT\tSOURCE\tKEY")
+			for _, key := range reply.Keys {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", key.User, key.Fingerprint, key.Source, key.Key)
+			}
+			return tw.Flush()
+		case len(args) >= 4 && args[1] == "add":
+			var reply struct { User, Fingerprint string }
+			// The key is one argument or the words of an authorized_keys line
+			err := request("POST", "/keys", url.Values { "user": {args[2]}, "key": {strings.Join(args[3:], " ")}, "by": {controlUser()} }, &reply)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Added key %s of user %q\n", reply.Fingerprint, reply.User)
+			return nil
+		case len(args) == 4 && args[1] == "remove":
+			var reply struct { User, Fingerprint string }
+			err := request("POST", "/keys/remove", url.Values { "user": {args[2]}, "fingerprint": {args[3]}, "by": {controlUser()} }, &reply)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Removed key %s of user %q\n", reply.Fingerprint, reply.User)
+			return nil
+		}
+		return errUsage
+	case "flush":
+		if len(args) != 1 {
+			return errUsage
+		}
+		var reply struct { Revoked []string }
+		err := request("POST", "/flush", nil, &reply)
+		if err != nil {
+			return err
+		}
+		for _, subnet := range reply.Revoked {
+			fmt.Printf("Revoked %s\n", subnet)
+		}
+		return nil
+	case "explain":
+		flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+		ip := flags.String("ip", "", "Address the login comes from, a proxy when trusted-proxies lists it")
+		user := flags.String("user", "", "Username of the login")
+		var headers headerFlags
+		flags.Var(&headers, "header", "Header of the login as \"Name: value\", may be repeated")
+		err := flags.Parse(args[1:])
+		if err != nil || flags.NArg() != 0 || *ip == "" {
+			return errUsage
+		}
+		var reply explanation
+		err = request("POST", "/explain", url.Values { "ip": {*ip}, "user": {*user}, "header": headers }, &reply)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, step := range reply.Steps {
+			decided := step.Option
+			if step.Value != "" {
+				decided += " = " + step.Value
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", step.Check, step.Result, decided, step.Detail)
+		}
+		tw.Flush()
+		if reply.DeniedBy != "" {
+			fmt.Printf("Denied by %s\n", reply.DeniedBy)
+		} else {
+			fmt.Println("Allowed")
+		}
+		return nil
+	case "export":
+		flags := flag.NewFlagSet("export", flag.ContinueOnError)
+		format := flags.String("format", "access-review", "Layout of the export, only \"access-review\" so far")
+		anonymize := flags.Bool("anonymize", false, "Replace the subnets by keyed hashes")
+		err := flags.Parse(args[1:])
+		if err != nil || flags.NArg() != 0 {
+			return errUsage
+		}
+		if *format != "access-review" {
+			return fmt.Errorf("unknown export format %q", *format)
+		}
+		var reply accessReview
+		err = request("GET", "/access-review?anonymize=" + strconv.FormatBool(*anonymize), nil, &reply)
+		if err != nil {
+			return err
+		}
+		out, err := json.MarshalIndent(reply, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Printf("%s\n", out)
+		return err
+	}
+	return errUsage
+}
+
+var errUsage = errors.New(`Usage:
+  portknob list
+  portknob grant [-duration 1h] [-user USER] [-group GROUP] [-dry-run | -token TOKEN] <address>
+  portknob revoke [-rule RULE] <address or subnet>
+  portknob flush
+  portknob maintenance on [-duration 1h] [-message MESSAGE]
+  portknob maintenance off|status
+  portknob panic [-yes-i-mean-it | -acknowledge]
+  portknob rotate-cookie-secret
+  portknob key list
+  portknob key add <user> <Ed25519 public key>
+  portknob key remove <user> <fingerprint>
+  portknob export -format access-review [-anonymize]
+  portknob explain -ip <address> [-user USER] [-header "Name: value"]...`)
+
+// Values of a flag given several times
+type headerFlags []string
+
+func (f *headerFlags) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *headerFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Return who runs a control command, the user behind sudo if any
+func controlUser() string {
+	if user := os.Getenv("SUDO_USER"); user != "" {
+		return user
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(os.Getuid())
+}
@@ -0,0 +1,237 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// With [defense], a wave of failed logins raises the posture of this instance to elevated until it calms down
+// Elevated, users with a one-time password may only log in with it, bans last longer and share links are refused
+// Each instance counts its own failures, the audit log records each change as a "defense" event
+type configDefense struct {
+	// Failed logins within a minute which make the posture elevated
+	// This is a mandatory option
+	EnterFailures		uint64	`toml:"enter-failures-per-minute"`
+
+	// Failed logins within a minute which the posture returns to normal below, after cooldown
+	// Default: half of enter-failures-per-minute
+	ExitFailures		uint64	`toml:"exit-failures-per-minute"`
+
+	// Seconds the failures must stay below exit-failures-per-minute before the posture returns to normal
+	// Default: 600
+	Cooldown			uint64	`toml:"cooldown"`
+
+	// While elevated, users with a one-time password may not log in by knock, key or single sign-on, which skip the code
+	// Default: true
+	RequireTOTP			*bool	`toml:"require-totp"`
+
+	// While elevated, auth-ban-duration is multiplied by this
+	// Default: 2
+	BanDurationFactor	uint64	`toml:"ban-duration-factor"`
+
+	// While elevated, share links can neither be created nor opened
+	// Default: true
+	DisableShareLinks	*bool	`toml:"disable-share-links"`
+
+	// While elevated, subnets without a successful login in the last 90 days get the reply of the access policy to denied visitors
+	// Default: false
+	HideFromUnknownSubnets	bool	`toml:"hide-from-unknown-subnets"`
+}
+
+func (d *configDefense) parse(conf *config) error {
+	if d.EnterFailures == 0 {
+		return &configError { "[defense] requires \"enter-failures-per-minute\"\n" }
+	}
+	if d.ExitFailures == 0 {
+		d.ExitFailures = max(d.EnterFailures / 2, 1)
+	}
+	if d.ExitFailures > d.EnterFailures {
+		return &configError { "option \"exit-failures-per-minute\" cannot exceed \"enter-failures-per-minute\"\n" }
+	}
+	if d.Cooldown == 0 {
+		d.Cooldown = 600
+	}
+	if d.RequireTOTP == nil {
+		defaultRequireTOTP := true
+		d.RequireTOTP = &defaultRequireTOTP
+	}
+	if d.BanDurationFactor == 0 {
+		d.BanDurationFactor = 2
+	}
+	if d.DisableShareLinks == nil {
+		defaultDisableShareLinks := true
+		d.DisableShareLinks = &defaultDisableShareLinks
+	}
+	return nil
+}
+
+// Subnets with a successful login in this long are known to hide-from-unknown-subnets
+const defenseKnownSubnetLifespan = 90 * 24 * time.Hour
+
+// Seconds between two checks whether an elevated posture may return to normal
+const defenseCheckInterval = 10 * time.Second
+
+// Failed logins of the last minute and the posture they led to
+type defenseState struct {
+	mutex		sync.Mutex
+	// Failed logins by second, counts[i] being those of the Unix second seconds[i]
+	counts		[60]uint64
+	seconds		[60]int64
+	elevated	bool
+	since		time.Time
+	// While elevated, since when the failures stayed below exit-failures-per-minute, zero while they do not
+	calmSince	time.Time
+}
+
+func (d *defenseState) fail(now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	second := now.Unix()
+	i := (second % 60 + 60) % 60
+	if d.seconds[i] != second {
+		d.seconds[i] = second
+		d.counts[i] = 0
+	}
+	d.counts[i]++
+}
+
+// Failed logins within the minute up to now
+func (d *defenseState) rate(now time.Time) (rate uint64) {
+	second := now.Unix()
+	for i, s := range d.seconds {
+		if second - s < 60 && second >= s {
+			rate += d.counts[i]
+		}
+	}
+	return
+}
+
+// Move the posture to where the failures up to now lead with conf, returning whether it changed
+// It returns to normal at once without [defense], as after a reload removing it
+func (d *defenseState) update(conf *configDefense, now time.Time) (changed bool, rate uint64, since time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	rate = d.rate(now)
+	switch {
+	case conf == nil:
+		changed = d.elevated
+		d.elevated, since = false, d.since
+	case !d.elevated && rate >= conf.EnterFailures:
+		d.elevated, d.since, d.calmSince = true, now, time.Time {}
+		changed = true
+	case d.elevated && rate >= conf.ExitFailures:
+		d.calmSince = time.Time {}
+	case d.elevated && d.calmSince.IsZero():
+		d.calmSince = now
+	case d.elevated && now.Sub(d.calmSince) >= time.Duration(conf.Cooldown) * time.Second:
+		d.elevated, since = false, d.since
+		changed = true
+	}
+	return
+}
+
+func (d *defenseState) Elevated() (bool, time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.elevated, d.since
+}
+
+// Count a failed login towards [defense]
+func (s *server) defendFailure(now time.Time) {
+	if s.conf.Defense == nil {
+		return
+	}
+	s.defense.fail(now)
+	s.checkDefense(now)
+}
+
+// Change the posture if the failures up to now call for it, announcing the change
+func (s *server) checkDefense(now time.Time) {
+	changed, rate, since := s.defense.update(s.conf.Defense, now)
+	if !changed {
+		return
+	}
+	elevated, _ := s.defense.Elevated()
+	s.fw.metrics.Defense(elevated)
+	if elevated {
+		log.Printf("Defense: %d failed logins in the last minute, posture elevated\n", rate)
+		s.fw.audit.Event("defense", "posture", "elevated", "failures", rate)
+		s.fw.notify.Event("defense", fmt.Sprintf("Posture elevated after %d failed logins in a minute", rate), "posture", "elevated", "failures", rate)
+		return
+	}
+	log.Printf("Defense: posture back to normal, elevated since %s\n", since.UTC().Format(time.RFC3339))
+	s.fw.audit.Event("defense", "posture", "normal", "failures", rate, "since", since)
+	s.fw.notify.Event("defense", fmt.Sprintf("Posture back to normal, elevated since %s", since.UTC().Format(time.RFC3339)), "posture", "normal", "failures", rate, "since", since)
+}
+
+// Check every defenseCheckInterval whether an elevated posture may return to normal
+func (s *server) scheduleDefense() {
+	go func() {
+		for now := range time.Tick(defenseCheckInterval) {
+			s.fw.reloadMutex.RLock()
+			s.checkDefense(now)
+			s.fw.reloadMutex.RUnlock()
+		}
+	}()
+}
+
+// Whether the posture is elevated and [defense] enables what enabled says of it
+func (s *server) defenseElevated(enabled func (d *configDefense) bool) bool {
+	if s.conf.Defense == nil || !enabled(s.conf.Defense) {
+		return false
+	}
+	elevated, _ := s.defense.Elevated()
+	return elevated
+}
+
+// Whether hide-from-unknown-subnets hides the login form from clientIP now
+func (s *server) defenseHides(clientIP net.IP, now time.Time) bool {
+	if clientIP == nil || !s.defenseElevated(func (d *configDefense) bool { return d.HideFromUnknownSubnets }) {
+		return false
+	}
+	return !s.fw.cache.KnownSubnet(s.fw.Subnet(clientIP).String(), now.Add(-defenseKnownSubnetLifespan))
+}
+
+type defenseReply struct {
+	Enabled		bool		`json:"enabled"`
+	// "normal" or "elevated"
+	Posture		string		`json:"posture,omitempty"`
+	Since		string		`json:"since,omitempty"`
+	Failures	uint64		`json:"failures"`
+}
+
+func (s *server) defensePosture(now time.Time) defenseReply {
+	if s.conf.Defense == nil {
+		return defenseReply {}
+	}
+	s.defense.mutex.Lock()
+	defer s.defense.mutex.Unlock()
+	reply := defenseReply { Enabled: true, Posture: "normal", Failures: s.defense.rate(now) }
+	if s.defense.elevated {
+		reply.Posture = "elevated"
+		reply.Since = s.defense.since.UTC().Format(time.RFC3339)
+	}
+	return reply
+}
@@ -0,0 +1,147 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefensePosture(t *testing.T) {
+	conf := &configDefense { EnterFailures: 10, ExitFailures: 5, Cooldown: 60 }
+	d := &defenseState {}
+	start := time.Unix(1700000000, 0)
+	fail := func (at time.Time, n int) {
+		for i := 0; i < n; i++ {
+			d.fail(at)
+		}
+	}
+	steps := []struct {
+		name		string
+		at			time.Duration
+		failures	int
+		wantChanged	bool
+		wantElevated	bool
+	}{
+		{ "below enter", 0, 9, false, false },
+		{ "reaching enter", 0, 1, true, true },
+		// Still 10 within the minute
+		{ "within the minute", 50 * time.Second, 0, false, true },
+		{ "above exit", 70 * time.Second, 6, false, true },
+		{ "calm starts", 140 * time.Second, 0, false, true },
+		{ "a burst resets the cooldown", 150 * time.Second, 5, false, true },
+		{ "calm again", 220 * time.Second, 0, false, true },
+		{ "within cooldown", 279 * time.Second, 0, false, true },
+		{ "after cooldown", 280 * time.Second, 0, true, false },
+		{ "below enter again", 300 * time.Second, 9, false, false },
+	}
+	for _, step := range steps {
+		at := start.Add(step.at)
+		fail(at, step.failures)
+		changed, _, _ := d.update(conf, at)
+		elevated, _ := d.Elevated()
+		if changed != step.wantChanged || elevated != step.wantElevated {
+			t.Errorf("%s: changed %t, elevated %t, want %t, %t", step.name, changed, elevated, step.wantChanged, step.wantElevated)
+		}
+	}
+
+	// Removing [defense] ends the elevated posture at once
+	fail(start.Add(400 * time.Second), 10)
+	d.update(conf, start.Add(400 * time.Second))
+	if changed, _, _ := d.update(nil, start.Add(401 * time.Second)); !changed {
+		t.Error("update() without [defense] left the posture elevated")
+	}
+}
+
+func TestDefenseElevated(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	const seed = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+	key, err := decodeTOTPSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestServer(t, "allow-share-links = true\nauth-max-failures = 2\nauth-ban-duration = 100\n[[firewall]]\ndport = \"22\"\nshareable = true\n[secrets]\nalice = \"hunter2\"\nbob = \"hunter3\"\n[totp-secrets]\nalice = \"" + seed + "\"\n[defense]\nenter-failures-per-minute = 3\ncooldown = 60\nhide-from-unknown-subnets = true\n")
+	if w := testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"}, "totp": {totpCode(key, uint64(time.Now().Unix()) / totpStep)} }, nil); w.Code != 200 {
+		t.Fatalf("login of alice replied %d: %s", w.Code, w.Body.String())
+	}
+	if _, _, _, err := s.grantLogin(net.ParseIP("192.0.2.7"), "alice", "knock", nil, time.Hour, time.Time {}, time.Now()); err != nil {
+		t.Errorf("knock of alice in the normal posture: %v", err)
+	}
+
+	for _, addr := range []string {"203.0.113.1", "198.51.100.1", "192.0.2.8"} {
+		testLogin(s, addr, url.Values { "username": {"bob"}, "password": {"wrong"} }, nil)
+	}
+	if elevated, _ := s.defense.Elevated(); !elevated {
+		t.Fatal("three failures within the minute left the posture normal")
+	}
+	if !s.fw.metrics.defenseElevated {
+		t.Error("portknob_defense_elevated is 0")
+	}
+	if posture := s.defensePosture(time.Now()); posture.Posture != "elevated" || posture.Failures != 3 {
+		t.Errorf("posture %+v, want elevated after 3 failures", posture)
+	}
+
+	if _, _, _, err := s.grantLogin(net.ParseIP("192.0.2.7"), "alice", "knock", nil, time.Hour, time.Time {}, time.Now()); err != errDefenseTOTP {
+		t.Errorf("knock of alice in the elevated posture: %v, want errDefenseTOTP", err)
+	}
+	if _, _, _, err := s.grantLogin(net.ParseIP("192.0.2.7"), "bob", "knock", nil, time.Hour, time.Time {}, time.Now()); err != nil {
+		t.Errorf("knock of bob without a one-time password in the elevated posture: %v", err)
+	}
+	if w := testLogin(s, "198.51.100.7", nil, nil); w.Code != 403 {
+		t.Errorf("login page for an unknown subnet replied %d, want 403", w.Code)
+	}
+	if w := testLogin(s, "192.0.2.9", nil, nil); w.Code != 401 {
+		t.Errorf("login page for a known subnet replied %d, want 401", w.Code)
+	}
+	r := httptest.NewRequest("GET", "/share/?plain=1", nil)
+	r.RemoteAddr = "192.0.2.7:5000"
+	w := httptest.NewRecorder()
+	s.shareHandlerFunc(w, r)
+	if w.Code != 503 || !strings.Contains(w.Body.String(), "defense-elevated") {
+		t.Errorf("share links in the elevated posture replied %d: %s", w.Code, w.Body.String())
+	}
+
+	// The knock of bob cleared the failures of 192.0.2.0/24, two more ban it twice as long
+	before := time.Now()
+	testLogin(s, "192.0.2.8", url.Values { "username": {"bob"}, "password": {"wrong"} }, nil)
+	testLogin(s, "192.0.2.8", url.Values { "username": {"bob"}, "password": {"wrong"} }, nil)
+	if until, banned := s.fw.cache.FailureBan("192.0.2.0/24"); !banned || until.Before(before.Add(199 * time.Second)) {
+		t.Errorf("ban in the elevated posture until %s (%t), want 200 seconds", until, banned)
+	}
+
+	// Calm for the cooldown
+	now := time.Now()
+	s.checkDefense(now.Add(61 * time.Second))
+	s.checkDefense(now.Add(122 * time.Second))
+	if elevated, _ := s.defense.Elevated(); elevated {
+		t.Error("posture still elevated after the cooldown")
+	}
+	if w := testLogin(s, "198.51.100.7", nil, nil); w.Code != 401 {
+		t.Errorf("login page for an unknown subnet in the normal posture replied %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,406 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Device keys let cameras and sensors which cannot log in whitelist themselves for one rule, without being users
+// Whitelist entries of a device are recorded as those of "device:<name>"
+const deviceUserPrefix = "device:"
+
+// Header carrying the key of a device knock
+const deviceKeyHeader = "X-Portknob-Device-Key"
+
+// How long the key before a rotation keeps working by default, so the device can be updated meanwhile
+const deviceKeyOverlap = 24 * time.Hour
+
+type configDeviceKey struct {
+	// Name of the device in listings, audit events and the admin API
+	// This is a mandatory option
+	Name		string		`toml:"name"`
+
+	// Key the device sends in the X-Portknob-Device-Key header, at least 32 characters, or its bcrypt or Argon2id hash
+	// The admin API can replace it, the new key is then kept in the cache database
+	// This is a mandatory option
+	Key			string		`toml:"key"`
+
+	// Firewall rule the key opens, by number or comment, which must be the only rule of its group
+	// This is a mandatory option
+	Rule		string		`toml:"rule"`
+	rule		int
+
+	// Address or subnet the device must knock from
+	// Default: "" (anywhere)
+	Source		string		`toml:"source"`
+	sourceNet	*net.IPNet
+
+	// Lifespan in seconds of the whitelist entry of a knock
+	// Default: 0 (firewall-lifespan)
+	Lifespan	uint64		`toml:"lifespan"`
+}
+
+func (d *configDeviceKey) parse(conf *config) error {
+	if d.Name == "" || strings.ContainsAny(d.Name, " \t\n/") {
+		return conf.reportConfigError("name", d.Name)
+	}
+	if d.Key == "" {
+		return &configError { fmt.Sprintf("option \"key\" not specified for device %q\n", d.Name) }
+	}
+	if err := validateSecret(d.Key); err != nil {
+		return &configError { fmt.Sprintf("cannot parse the key hash of device %q: %s\n", d.Name, err) }
+	}
+	if !isHashedSecret(d.Key) && len(d.Key) < 32 {
+		return &configError { fmt.Sprintf("key of device %q is shorter than 32 characters\n", d.Name) }
+	}
+	var ok bool
+	d.rule, ok = conf.findRule(d.Rule)
+	if !ok {
+		return conf.reportConfigError("rule", d.Rule)
+	}
+	// A whitelist entry opens every rule of its group
+	group := conf.Firewall[d.rule].Group
+	if group == "" || len(conf.groupRuleNames([]string {group})) != 1 {
+		return &configError { fmt.Sprintf("rule %q of device %q must be the only rule of its group\n", d.Rule, d.Name) }
+	}
+	if d.Source != "" {
+		_, ipnet, err := net.ParseCIDR(d.Source)
+		if err != nil {
+			ip := net.ParseIP(d.Source)
+			if ip == nil {
+				return conf.reportConfigError("source", d.Source)
+			}
+			ipnet = &net.IPNet { IP: ip, Mask: net.CIDRMask(len(ip) * 8, len(ip) * 8) }
+		}
+		d.sourceNet = ipnet
+	}
+	return nil
+}
+
+// Check the [[device-key]] entries, whose names must differ and whose records cannot be those of a user
+func (conf *config) parseDeviceKeys() error {
+	names := make(map[string]bool)
+	for _, d := range conf.DeviceKeys {
+		err := d.parse(conf)
+		if err != nil {
+			return err
+		}
+		if names[d.Name] {
+			return &configError { fmt.Sprintf("two devices are named %q\n", d.Name) }
+		}
+		names[d.Name] = true
+	}
+	if len(conf.DeviceKeys) == 0 {
+		return nil
+	}
+	for user := range conf.Secrets {
+		if strings.HasPrefix(user, deviceUserPrefix) {
+			return &configError { fmt.Sprintf("user %q in [secrets] has the prefix %q of devices\n", user, deviceUserPrefix) }
+		}
+	}
+	return conf.checkServedPath("device-key", conf.deviceKnockPath())
+}
+
+func (conf *config) deviceKnockPath() string {
+	return strings.TrimRight(conf.Daemon.HTTPPath, "/") + "/api/v1/device-knock"
+}
+
+func (conf *config) findDeviceKey(name string) (*configDeviceKey, bool) {
+	for _, d := range conf.DeviceKeys {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// Serve POST <http-path>/api/v1/device-knock, whitelisting the caller for the rule of the device whose key it sends
+func (s *server) deviceKnockHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+
+	// Devices read plain text, whatever they accept
+	r.Header.Set("Accept", "text/plain")
+	clientIP, refused := s.checkClient(w, r)
+	if refused {
+		return
+	}
+	if r.Method != "POST" {
+		s.writeError(w, r, 405, "method-not-allowed", "Method Not Allowed")
+		return
+	}
+	if clientIP == nil {
+		s.writeError(w, r, 500, "internal", "cannot find client's IP address")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	now := time.Now()
+	d, err := s.matchDeviceKey(r.Header.Get(deviceKeyHeader), now)
+	if err != nil {
+		log.Println(err)
+		s.writeError(w, r, 500, "internal", "cannot read cache database")
+		return
+	}
+	// A stolen key used from elsewhere fails like a wrong one
+	if d == nil || d.sourceNet != nil && !d.sourceNet.Contains(clientIP) {
+		user := ""
+		if d != nil {
+			user = deviceUserPrefix + d.Name
+		}
+		s.auditLogin("failure", "device", user, clientIP)
+		s.countFailure(clientIP, user)
+		s.writeError(w, r, 401, "unauthorized", "Unauthorized: unknown or revoked device key")
+		return
+	}
+
+	user := deviceUserPrefix + d.Name
+	timeout := time.Duration(*s.conf.Daemon.FirewallLifespan) * time.Second
+	if d.Lifespan != 0 {
+		timeout = time.Duration(d.Lifespan) * time.Second
+	}
+	timeout = s.fw.ClampLifespan(timeout)
+	if s.grantSlots != nil {
+		s.grantSlots <- struct{}{}
+		defer func() { <-s.grantSlots }()
+	}
+	prefix, err := s.fw.InsertTimeout(clientIP, user, []string {s.conf.Firewall[d.rule].Group}, timeout, true)
+	if err == errFirewallStopping {
+		s.writeError(w, r, 503, "unavailable", "service is shutting down")
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, 500, "internal", "cannot update firewall")
+		return
+	}
+	s.auditLogin("success", "device", user, clientIP, "rule", s.conf.ruleName(d.rule))
+	if s.conf.Daemon.Verbose >= 1 {
+		log.Printf("Device %q knocked, whitelisted %s/%d\n", d.Name, clientIP, prefix)
+	}
+	expires := "never"
+	if timeout != 0 {
+		expires = now.Add(timeout).UTC().Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	fmt.Fprintf(w, "OK expires=%s subnet=%s\n", expires, s.fw.Subnet(clientIP))
+}
+
+// Return the device whose key is key at now, nil if there is none or it was revoked
+// Every key is compared, so the time taken does not tell which device came close
+func (s *server) matchDeviceKey(key string, now time.Time) (*configDeviceKey, error) {
+	if key == "" {
+		return nil, nil
+	}
+	states, err := s.fw.cache.DeviceKeyStates()
+	if err != nil {
+		return nil, err
+	}
+	hash := tokenHash(key)
+	var found *configDeviceKey
+	for _, d := range s.conf.DeviceKeys {
+		st, rotated := states[d.Name]
+		overlap := now.Before(st.previousUntil)
+		ok := false
+		if !rotated || st.previous == "config" && overlap {
+			ok = checkSecret(d.Key, key)
+		}
+		if rotated {
+			ok = subtle.ConstantTimeCompare([]byte(hash), []byte(st.hash)) == 1 || ok
+			ok = st.previous != "config" && overlap && subtle.ConstantTimeCompare([]byte(hash), []byte(st.previous)) == 1 || ok
+		}
+		if ok && !st.revoked && found == nil {
+			found = d
+		}
+	}
+	return found, nil
+}
+
+type deviceKeyInfo struct {
+	Name		string	`json:"name"`
+	Rule		string	`json:"rule"`
+	Source		string	`json:"source,omitempty"`
+	// "config" while the key of the configuration works, "rotated" once the admin API replaced it, or "revoked"
+	State		string	`json:"state"`
+	// Until when the key before the last rotation still works
+	PreviousUntil	string	`json:"previous_until,omitempty"`
+	// Subnets the device is whitelisted for
+	Subnets		[]string	`json:"subnets"`
+}
+
+// Serve GET <admin-path>/devices, POST <admin-path>/devices/<name>/rotate [overlap=SECONDS] and POST <admin-path>/devices/<name>/revoke
+func (s *server) serveDeviceKeys(w http.ResponseWriter, r *http.Request, rest, by string) {
+	if rest == "" {
+		if r.Method != "GET" {
+			s.writeJSON(w, 405, map[string]string { "error": "method not allowed" })
+			return
+		}
+		s.listDeviceKeys(w)
+		return
+	}
+	if r.Method != "POST" {
+		s.writeJSON(w, 405, map[string]string { "error": "method not allowed" })
+		return
+	}
+	name, action, _ := strings.Cut(rest, "/")
+	d, found := s.conf.findDeviceKey(name)
+	if !found {
+		s.writeJSON(w, 404, map[string]string { "error": "no such device" })
+		return
+	}
+	switch action {
+	case "rotate":
+		overlap := deviceKeyOverlap
+		if v := r.PostFormValue("overlap"); v != "" {
+			seconds, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				s.writeJSON(w, 400, map[string]string { "error": "cannot parse overlap" })
+				return
+			}
+			overlap = time.Duration(seconds) * time.Second
+		}
+		s.rotateDeviceKey(w, d, overlap, by, time.Now())
+	case "revoke":
+		s.revokeDeviceKey(w, d, by)
+	default:
+		s.writeJSON(w, 404, map[string]string { "error": "not found" })
+	}
+}
+
+func (s *server) listDeviceKeys(w http.ResponseWriter) {
+	states, err := s.fw.cache.DeviceKeyStates()
+	if err != nil {
+		s.writeJSON(w, 500, map[string]string { "error": "cannot read cache database" })
+		return
+	}
+	entries, err := s.fw.cache.Entries()
+	if err != nil {
+		s.writeJSON(w, 500, map[string]string { "error": "cannot read cache database" })
+		return
+	}
+	now := time.Now()
+	devices := []deviceKeyInfo {}
+	for _, d := range s.conf.DeviceKeys {
+		v := deviceKeyInfo { Name: d.Name, Rule: s.conf.ruleName(d.rule), Source: d.Source, State: "config", Subnets: []string {} }
+		if st, rotated := states[d.Name]; st.revoked {
+			v.State = "revoked"
+		} else if rotated {
+			v.State = "rotated"
+			if now.Before(st.previousUntil) {
+				v.PreviousUntil = st.previousUntil.UTC().Format(time.RFC3339)
+			}
+		}
+		for _, entry := range entries {
+			if entry.user == deviceUserPrefix + d.Name && entry.live(now) {
+				v.Subnets = append(v.Subnets, s.fw.Subnet(entry.addr).String())
+			}
+		}
+		sort.Strings(v.Subnets)
+		devices = append(devices, v)
+	}
+	s.writeJSON(w, 200, map[string][]deviceKeyInfo { "devices": devices })
+}
+
+// Replace the key of d by a new one, which is only ever shown in the reply
+// Unless d was revoked, its current key keeps working for overlap
+func (s *server) rotateDeviceKey(w http.ResponseWriter, d *configDeviceKey, overlap time.Duration, by string, now time.Time) {
+	states, err := s.fw.cache.DeviceKeyStates()
+	if err != nil {
+		s.writeJSON(w, 500, map[string]string { "error": "cannot read cache database" })
+		return
+	}
+	raw := make([]byte, 32)
+	_, err = rand.Read(raw)
+	if err != nil {
+		s.writeJSON(w, 500, map[string]string { "error": "cannot create key" })
+		return
+	}
+	key := base64.RawURLEncoding.EncodeToString(raw)
+	st, rotated := states[d.Name]
+	next := deviceKeyState { hash: tokenHash(key) }
+	if !st.revoked && overlap != 0 {
+		next.previous = "config"
+		if rotated {
+			next.previous = st.hash
+		}
+		next.previousUntil = now.Add(overlap)
+	}
+	err = s.fw.cache.SetDeviceKeyState(d.Name, next)
+	if err != nil {
+		log.Println(err)
+		s.writeJSON(w, 500, map[string]string { "error": "cannot update cache database" })
+		return
+	}
+	log.Printf("Key of device %q rotated by %s\n", d.Name, by)
+	s.fw.audit.Event("device-rotate", "device", d.Name, "by", by, "overlap", int64(overlap / time.Second))
+	reply := map[string]string { "name": d.Name, "key": key }
+	if !next.previousUntil.IsZero() {
+		reply["previous_until"] = next.previousUntil.UTC().Format(time.RFC3339)
+	}
+	s.writeJSON(w, 200, reply)
+}
+
+// Stop every key of d from working and close what it opened, until a rotation gives it a new key
+func (s *server) revokeDeviceKey(w http.ResponseWriter, d *configDeviceKey, by string) {
+	states, err := s.fw.cache.DeviceKeyStates()
+	if err != nil {
+		s.writeJSON(w, 500, map[string]string { "error": "cannot read cache database" })
+		return
+	}
+	st := states[d.Name]
+	st.revoked = true
+	err = s.fw.cache.SetDeviceKeyState(d.Name, st)
+	if err != nil {
+		log.Println(err)
+		s.writeJSON(w, 500, map[string]string { "error": "cannot update cache database" })
+		return
+	}
+	entries, err := s.fw.cache.Entries()
+	if err != nil {
+		s.writeJSON(w, 500, map[string]string { "error": "cannot read cache database" })
+		return
+	}
+	var addrs []net.IP
+	revoked := []string {}
+	for _, entry := range entries {
+		if entry.user == deviceUserPrefix + d.Name {
+			addrs = append(addrs, entry.addr)
+			revoked = append(revoked, s.fw.Subnet(entry.addr).String())
+		}
+	}
+	err = s.fw.RevokeGroup(s.conf.Firewall[d.rule].Group, addrs...)
+	if err != nil {
+		log.Println(err)
+		s.writeJSON(w, 500, map[string]string { "error": "cannot update firewall" })
+		return
+	}
+	log.Printf("Key of device %q revoked by %s\n", d.Name, by)
+	s.fw.audit.Event("device-revoke", "device", d.Name, "by", by)
+	s.writeJSON(w, 200, map[string]interface{} { "name": d.Name, "revoked": revoked })
+}
@@ -0,0 +1,211 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDeviceKey = "0123456789abcdefghijklmnopqrstuv"
+
+const testDeviceConfig = "admin-path = \"/admin\"\nadmin-allow = [\"192.0.2.0/24\"]\nauth-max-failures = 3\n[[firewall]]\ndport = \"22\"\n[[firewall]]\ncomment = \"camera1\"\ndport = \"554\"\ngroup = \"camera1\"\n[[device-key]]\nname = \"camera1\"\nkey = \"" + testDeviceKey + "\"\nrule = \"camera1\"\nsource = \"198.51.100.0/24\"\nlifespan = 600\n"
+
+// Send a device knock from addr with key, returning the reply
+func testDeviceKnock(s *server, method, addr, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/v1/device-knock", nil)
+	r.RemoteAddr = addr + ":5000"
+	if key != "" {
+		r.Header.Set(deviceKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	s.deviceKnockHandlerFunc(w, r)
+	return w
+}
+
+func TestDeviceKnock(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	tests := []struct {
+		name		string
+		method		string
+		addr		string
+		key			string
+		wantCode	int
+	}{
+		{ "right key", "POST", "198.51.100.7", testDeviceKey, 200 },
+		{ "wrong key", "POST", "198.51.100.7", testDeviceKey[1:] + "w", 401 },
+		{ "no key", "POST", "198.51.100.7", "", 401 },
+		{ "outside source", "POST", "203.0.113.7", testDeviceKey, 401 },
+		{ "GET", "GET", "198.51.100.7", testDeviceKey, 405 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			s, backend := newTestServer(t, testDeviceConfig)
+			w := testDeviceKnock(s, tt.method, tt.addr, tt.key)
+			if w.Code != tt.wantCode {
+				t.Fatalf("knock replied %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			entries, _ := s.fw.cache.Entries()
+			if tt.wantCode != 200 {
+				if len(entries) != 0 {
+					t.Errorf("refused knock left entries %v", entries)
+				}
+				return
+			}
+			if !strings.HasPrefix(w.Body.String(), "OK expires=") {
+				t.Errorf("reply %q", w.Body.String())
+			}
+			// Only the rule of the device, not those every login opens
+			cameraSet, _ := s.fw.setFor(net.ParseIP(tt.addr), "camera1")
+			defaultSet, _ := s.fw.setFor(net.ParseIP(tt.addr), "")
+			if !backend.elements[cameraSet + " " + tt.addr] || backend.elements[defaultSet + " " + tt.addr] {
+				t.Errorf("elements %v, want only the camera1 set", backend.elements)
+			}
+			if len(entries) != 1 || entries[0].user != "device:camera1" || entries[0].group != "camera1" || time.Until(entries[0].expires) > 600 * time.Second {
+				t.Errorf("entries %v", entries)
+			}
+		})
+	}
+}
+
+// Wrong keys count like failed logins, the ban refuses even the right key
+func TestDeviceKnockBan(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, _ := newTestServer(t, testDeviceConfig)
+	for i := 0; i < 3; i++ {
+		if w := testDeviceKnock(s, "POST", "198.51.100.7", "guess"); w.Code != 401 {
+			t.Fatalf("guess %d replied %d", i, w.Code)
+		}
+	}
+	if w := testDeviceKnock(s, "POST", "198.51.100.7", testDeviceKey); w.Code != 429 {
+		t.Errorf("banned knock replied %d, want 429: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDeviceKeyRotation(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, _ := newTestServer(t, testDeviceConfig)
+	admin := func (method, path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/admin/devices" + path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.adminHandlerFunc(w, r)
+		return w
+	}
+	matches := func (key string, after time.Duration) bool {
+		d, err := s.matchDeviceKey(key, time.Now().Add(after))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d != nil
+	}
+	state := func () deviceKeyInfo {
+		var reply struct { Devices []deviceKeyInfo }
+		w := admin("GET", "", nil)
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		if w.Code != 200 || len(reply.Devices) != 1 {
+			t.Fatalf("listing replied %d: %s", w.Code, w.Body.String())
+		}
+		return reply.Devices[0]
+	}
+	if st := state(); st.State != "config" || st.Rule != "#2 camera1" {
+		t.Errorf("before the rotation %+v", st)
+	}
+
+	w := admin("POST", "/camera1/rotate", url.Values { "overlap": {"3600"} })
+	var first struct { Key string }
+	json.Unmarshal(w.Body.Bytes(), &first)
+	if w.Code != 200 || first.Key == "" {
+		t.Fatalf("rotation replied %d: %s", w.Code, w.Body.String())
+	}
+	if !matches(first.Key, 0) || !matches(testDeviceKey, 0) || matches(testDeviceKey, 2 * time.Hour) || !matches(first.Key, 2 * time.Hour) {
+		t.Errorf("after the rotation, the new key must work and the old one for an hour only")
+	}
+	if st := state(); st.State != "rotated" || st.PreviousUntil == "" {
+		t.Errorf("after the rotation %+v", st)
+	}
+	w = admin("POST", "/camera1/rotate", nil)
+	var second struct { Key string }
+	json.Unmarshal(w.Body.Bytes(), &second)
+	if !matches(second.Key, 0) || !matches(first.Key, 0) || matches(testDeviceKey, 0) {
+		t.Errorf("after the second rotation, the two last keys must work and the configuration's no longer")
+	}
+
+	if w := testDeviceKnock(s, "POST", "198.51.100.7", second.Key); w.Code != 200 {
+		t.Fatalf("knock replied %d: %s", w.Code, w.Body.String())
+	}
+	w = admin("POST", "/camera1/revoke", nil)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "198.51.100.0/24") {
+		t.Fatalf("revocation replied %d: %s", w.Code, w.Body.String())
+	}
+	if matches(second.Key, 0) || matches(first.Key, 0) {
+		t.Errorf("revoked keys still work")
+	}
+	if entries, _ := s.fw.cache.Entries(); len(entries) != 0 {
+		t.Errorf("revocation left entries %v", entries)
+	}
+	if st := state(); st.State != "revoked" || len(st.Subnets) != 0 {
+		t.Errorf("after the revocation %+v", st)
+	}
+	if w := admin("POST", "/camera2/revoke", nil); w.Code != 404 {
+		t.Errorf("unknown device replied %d", w.Code)
+	}
+	if w := admin("GET", "/camera1/revoke", nil); w.Code != 405 {
+		t.Errorf("GET revoke replied %d", w.Code)
+	}
+}
+
+func TestDeviceKeyOptions(t *testing.T) {
+	rules := "[[firewall]]\ndport = \"22\"\n[[firewall]]\ndport = \"554\"\ngroup = \"cam\"\n[[firewall]]\ndport = \"555\"\ngroup = \"cams\"\n[[firewall]]\ndport = \"556\"\ngroup = \"cams\"\n"
+	tests := []struct {
+		name	string
+		device	string
+		wantErr	bool
+	}{
+		{ "valid", "name = \"c1\"\nkey = \"" + testDeviceKey + "\"\nrule = \"2\"\n", false },
+		{ "hashed key", "name = \"c1\"\nkey = \"$2y$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy\"\nrule = \"2\"\n", false },
+		{ "no name", "key = \"" + testDeviceKey + "\"\nrule = \"2\"\n", true },
+		{ "short key", "name = \"c1\"\nkey = \"short\"\nrule = \"2\"\n", true },
+		{ "unknown rule", "name = \"c1\"\nkey = \"" + testDeviceKey + "\"\nrule = \"9\"\n", true },
+		{ "rule without a group", "name = \"c1\"\nkey = \"" + testDeviceKey + "\"\nrule = \"1\"\n", true },
+		{ "group of two rules", "name = \"c1\"\nkey = \"" + testDeviceKey + "\"\nrule = \"3\"\n", true },
+		{ "bad source", "name = \"c1\"\nkey = \"" + testDeviceKey + "\"\nrule = \"2\"\nsource = \"camera\"\n", true },
+		{ "same name", "name = \"c1\"\nkey = \"" + testDeviceKey + "\"\nrule = \"2\"\n[[device-key]]\nname = \"c1\"\nkey = \"" + testDeviceKey + "\"\nrule = \"2\"\n", true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, "[daemon]\ncache-database = \"/nonexistent/portknob.db\"\n" + rules + "[[device-key]]\n" + tt.device))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
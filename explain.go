@@ -0,0 +1,299 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// A hypothetical login, as described to <admin-path>/api/v1/explain
+type explainRequest struct {
+	// Address the request comes from, a proxy when trusted-proxies lists it
+	peer		net.IP
+	header		http.Header
+	user		string
+	// Checked only when given, never reported
+	password	string
+
+	// Set by the checks for those after them
+	clientIP	net.IP
+	groups		[]string
+	known		bool
+}
+
+type explainStep struct {
+	Check		string	`json:"check"`
+	// "pass", "fail", or "skip" when an earlier check left nothing to decide on
+	Result		string	`json:"result"`
+	// Option which decided and its value, never a secret
+	Option		string	`json:"option,omitempty"`
+	Value		string	`json:"value,omitempty"`
+	Detail		string	`json:"detail,omitempty"`
+}
+
+type explanation struct {
+	Client		string		`json:"client,omitempty"`
+	User		string		`json:"user,omitempty"`
+	Headers		map[string]string	`json:"headers,omitempty"`
+	// "allowed" or "denied"
+	Decision	string		`json:"decision"`
+	DeniedBy	string		`json:"denied_by,omitempty"`
+	Steps		[]explainStep	`json:"steps"`
+}
+
+// The checks of a login in the order handlerFunc runs them, each reading the cache and the configuration only
+var loginChecks = []struct {
+	name	string
+	run	func (s *server, req *explainRequest, now time.Time) explainStep
+}{
+	{ "client-address", (*server).explainClientAddress },
+	{ "access-policy", (*server).explainPolicy },
+	{ "ban", (*server).explainBan },
+	{ "failure-ban", (*server).explainFailureBan },
+	{ "maintenance", (*server).explainMaintenance },
+	{ "honeypot", (*server).explainHoneypot },
+	{ "credentials", (*server).explainCredentials },
+	{ "revoked", (*server).explainRevoked },
+	{ "schedule", (*server).explainSchedule },
+	{ "second-factor", (*server).explainSecondFactor },
+	{ "capacity", (*server).explainCapacity },
+}
+
+// Headers whose values are credentials, left out of explanations
+var explainRedactedHeaders = []string { "Authorization", "Cookie", "Proxy-Authorization", deviceKeyHeader }
+
+// Run req through every login check without changing anything, the first failure deciding
+func (s *server) explain(req *explainRequest, now time.Time) *explanation {
+	e := &explanation { User: req.user, Decision: "allowed", Steps: []explainStep {} }
+	if len(req.header) != 0 {
+		e.Headers = make(map[string]string)
+		for name, values := range req.header {
+			e.Headers[name] = strings.Join(values, ", ")
+			for _, redacted := range explainRedactedHeaders {
+				if textproto.CanonicalMIMEHeaderKey(redacted) == name {
+					e.Headers[name] = "[redacted]"
+				}
+			}
+		}
+	}
+	for _, check := range loginChecks {
+		step := check.run(s, req, now)
+		step.Check = check.name
+		if step.Result == "fail" && e.DeniedBy == "" {
+			e.Decision, e.DeniedBy = "denied", check.name
+		}
+		e.Steps = append(e.Steps, step)
+	}
+	if req.clientIP != nil {
+		e.Client = req.clientIP.String()
+	}
+	return e
+}
+
+func (s *server) explainClientAddress(req *explainRequest, now time.Time) explainStep {
+	r := &http.Request { Header: req.header, RemoteAddr: net.JoinHostPort(req.peer.String(), "0") }
+	clientIP, err := s.clientIP(r)
+	option := "client-ip"
+	if !s.conf.Daemon.trustedNets.Empty() {
+		option = "trusted-proxies"
+	}
+	if err != nil {
+		return explainStep { Result: "fail", Option: option, Detail: err.Error() }
+	}
+	req.clientIP = clientIP
+	if clientIP == nil {
+		return explainStep { Result: "pass", Option: option, Detail: "no client address, nothing can be whitelisted" }
+	}
+	return explainStep { Result: "pass", Option: option, Value: clientIP.String() }
+}
+
+func (s *server) explainPolicy(req *explainRequest, now time.Time) explainStep {
+	allowed, option, value := s.conf.policyDecision(req.clientIP)
+	if !allowed {
+		return explainStep { Result: "fail", Option: option, Value: value, Detail: "policy-deny-method " + s.conf.Daemon.PolicyDenyMethod }
+	}
+	if s.defenseHides(req.clientIP, now) {
+		return explainStep { Result: "fail", Option: "hide-from-unknown-subnets", Value: "true", Detail: "the defense posture is elevated and the subnet logged in from nowhere lately" }
+	}
+	return explainStep { Result: "pass", Option: option, Value: value }
+}
+
+func (s *server) explainBan(req *explainRequest, now time.Time) explainStep {
+	if req.clientIP == nil {
+		return explainStep { Result: "skip" }
+	}
+	if expires, banned := s.fw.cache.Banned(s.fw.Subnet(req.clientIP).String()); banned {
+		return explainStep { Result: "fail", Option: "honeypot-ban-duration", Detail: fmt.Sprintf("%s is banned until %s for using a honeypot user", s.fw.Subnet(req.clientIP), expires.UTC().Format(time.RFC3339)) }
+	}
+	return explainStep { Result: "pass" }
+}
+
+func (s *server) explainFailureBan(req *explainRequest, now time.Time) explainStep {
+	if req.clientIP == nil {
+		return explainStep { Result: "skip" }
+	}
+	value := fmt.Sprint(*s.conf.Daemon.AuthMaxFailures)
+	if bannedUntil, banned := s.failureBan(req.clientIP); banned {
+		return explainStep { Result: "fail", Option: "auth-max-failures", Value: value, Detail: "too many failed logins, rate limited until " + bannedUntil.UTC().Format(time.RFC3339) }
+	}
+	return explainStep { Result: "pass", Option: "auth-max-failures", Value: value }
+}
+
+func (s *server) explainMaintenance(req *explainRequest, now time.Time) explainStep {
+	if req.clientIP == nil {
+		return explainStep { Result: "skip" }
+	}
+	if m, refused := s.maintenanceRefuses(req.clientIP, now); refused {
+		return explainStep { Result: "fail", Option: "maintenance", Value: m.until.UTC().Format(time.RFC3339), Detail: m.message }
+	}
+	return explainStep { Result: "pass" }
+}
+
+func (s *server) explainHoneypot(req *explainRequest, now time.Time) explainStep {
+	if _, ok := s.conf.SecretsHoneypot[req.user]; ok && req.user != "" {
+		return explainStep { Result: "fail", Option: "secrets-honeypot", Value: req.user, Detail: "logging in bans the subnet for honeypot-ban-duration" }
+	}
+	return explainStep { Result: "pass" }
+}
+
+func (s *server) explainCredentials(req *explainRequest, now time.Time) explainStep {
+	provider := s.conf.authProvider(req.user)
+	if provider == nil {
+		return explainStep { Result: "fail", Detail: fmt.Sprintf("no authentication provider knows user %q", req.user) }
+	}
+	var valid bool
+	var err error
+	detail := "the user exists, no password was given to check"
+	if req.password != "" {
+		req.groups, valid, err = provider.Authenticate(req.user, req.password)
+		detail = "the password is right"
+	} else {
+		req.groups, valid, err = provider.Lookup(req.user)
+	}
+	if err != nil {
+		return explainStep { Result: "fail", Detail: "the authentication server cannot be reached: " + err.Error() }
+	}
+	if !valid {
+		if req.password != "" {
+			return explainStep { Result: "fail", Detail: "incorrect password" }
+		}
+		return explainStep { Result: "fail", Detail: fmt.Sprintf("user %q may not log in", req.user) }
+	}
+	req.known = true
+	return explainStep { Result: "pass", Detail: detail }
+}
+
+func (s *server) explainRevoked(req *explainRequest, now time.Time) explainStep {
+	if req.clientIP == nil || !req.known {
+		return explainStep { Result: "skip" }
+	}
+	if s.fw.cache.Revoked(s.fw.Subnet(req.clientIP).String()) {
+		return explainStep { Result: "pass", Detail: "the subnet was revoked, only a typed password logs in, not a cookie" }
+	}
+	return explainStep { Result: "pass" }
+}
+
+func (s *server) explainSchedule(req *explainRequest, now time.Time) explainStep {
+	if !req.known {
+		return explainStep { Result: "skip" }
+	}
+	if _, ok := s.conf.SecretsSchedule[req.user]; !ok {
+		return explainStep { Result: "pass" }
+	}
+	_, allowed, boundary := s.loginTimeout(req.user, now)
+	if !allowed {
+		detail := "outside the schedule, it never opens again"
+		if !boundary.IsZero() {
+			detail = "outside the schedule until " + boundary.UTC().Format(time.RFC3339)
+		}
+		return explainStep { Result: "fail", Option: "secrets-schedule", Value: req.user, Detail: detail }
+	}
+	return explainStep { Result: "pass", Option: "secrets-schedule", Value: req.user, Detail: "inside the schedule until " + boundary.UTC().Format(time.RFC3339) }
+}
+
+func (s *server) explainSecondFactor(req *explainRequest, now time.Time) explainStep {
+	if !req.known {
+		return explainStep { Result: "skip" }
+	}
+	if _, enrolled := s.conf.totpKeys[req.user]; enrolled {
+		return explainStep { Result: "pass", Option: "totp-secrets", Value: req.user, Detail: "the login also needs a one-time code" }
+	}
+	gated, others := s.conf.gatedGroups(req.groups)
+	if len(gated) != 0 && !others {
+		return explainStep { Result: "fail", Option: "require-totp", Value: strings.Join(s.conf.groupRuleNames(gated), ", "), Detail: "every rule of the user needs a one-time code, the user has no seed" }
+	}
+	if len(gated) != 0 {
+		return explainStep { Result: "pass", Option: "require-totp", Value: strings.Join(s.conf.groupRuleNames(gated), ", "), Detail: "these rules stay closed without a one-time code" }
+	}
+	return explainStep { Result: "pass" }
+}
+
+func (s *server) explainCapacity(req *explainRequest, now time.Time) explainStep {
+	s.fw.stopMutex.Lock()
+	stopping := s.fw.stopping
+	s.fw.stopMutex.Unlock()
+	if stopping {
+		return explainStep { Result: "fail", Detail: "the service is shutting down" }
+	}
+	if s.grantSlots == nil {
+		return explainStep { Result: "pass", Option: "max-concurrent-grants", Value: "0" }
+	}
+	step := explainStep { Result: "pass", Option: "max-concurrent-grants", Value: fmt.Sprint(cap(s.grantSlots)) }
+	if len(s.grantSlots) == cap(s.grantSlots) {
+		step.Detail = "every slot is taken, the grant would wait for one"
+	}
+	return step
+}
+
+// Parse an explain request from the form fields ip, user, password and header, one "Name: value" each
+func parseExplainRequest(r *http.Request) (*explainRequest, error) {
+	req := &explainRequest { peer: net.ParseIP(r.PostFormValue("ip")), header: make(http.Header), user: r.PostFormValue("user"), password: r.PostFormValue("password") }
+	if req.peer == nil {
+		return nil, fmt.Errorf("invalid address %q", r.PostFormValue("ip"))
+	}
+	for _, line := range r.PostForm["header"] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, want \"Name: value\"", line)
+		}
+		req.header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return req, nil
+}
+
+// Explain what a login described by the form would run into
+func (s *server) serveExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.writeJSON(w, 405, map[string]string { "error": "method not allowed" })
+		return
+	}
+	req, err := parseExplainRequest(r)
+	if err != nil {
+		s.writeJSON(w, 400, map[string]string { "error": err.Error() })
+		return
+	}
+	s.writeJSON(w, 200, s.explain(req, time.Now()))
+}
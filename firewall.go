@@ -19,13 +19,18 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
-	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -35,386 +40,932 @@ type firewall struct {
 	cache		*cache
 	chainName	string
 	denyName	string
+	backend		firewallBackend
+	metrics		*metrics
+	audit		*auditLog
+	notify		*notifier
+	sets		map[string]*firewallSets
+	// Subnets rate limited with auth-ban-firewall
+	ban4Name	string
+	ban6Name	string
+	groups		[]string
+	stopReq		chan os.Signal
+	reloadReq	chan os.Signal
+	// Held for writing while a reloaded configuration is applied
+	reloadMutex	sync.RWMutex
+	sweepReq	chan struct{}
+	stopMutex	sync.Mutex
+	stopping	bool
+	inflight	sync.WaitGroup
+	// Expiry of the whitelist entries in the firewall by "subnet group", when other instances share the cache database
+	applied		map[string]time.Time
+	appliedMutex	sync.Mutex
+	// Deny rule counters read last time, to count the packets denied since
+	denyCounters	map[string]uint64
+	denyMutex	sync.Mutex
+	// Clocks of the other instances sharing the cache database by host, estimated by syncShared
+	peerClocks	map[string]peerClock
+	lastSync	time.Time
+	peerMutex	sync.Mutex
+	// Expiry of the engaged lockdowns by group, zero for those which never expire
+	lockdowns	map[string]time.Time
+	lockdownMutex	sync.Mutex
+	// Traffic of the IPv6 whitelist elements by "subnet group" and when moves of entries by user were made, with auto-rekey-ipv6
+	activity	map[string]activitySample
+	rekeys		map[string][]time.Time
+	rekeyMutex	sync.Mutex
+	// Runs the commands of execCmd and outputCmd, cmd.Run if nil
+	runner		func (cmd *exec.Cmd) error
+}
+
+// The clock of another instance, as estimated from the creation time of the whitelist entries it wrote
+type peerClock struct {
+	// Positive when it is ahead of this host
+	skew		time.Duration
+	seen		time.Time
+}
+
+// The commands needed to enforce the rules, so grants and expiry need not care which firewall is in use
+type firewallBackend interface {
+	// Fail early if the tools of the backend are missing
+	Check() error
+	// Create the whitelist sets and chains and activate the rules
+	Setup() error
+	// Remove everything Setup created, ignoring errors
+	Teardown()
+	// Update the chains after fw.conf changed from oldConf, keeping the whitelist sets
+	Reconcile(oldConf *config, added, removed []configFirewall) error
+	// Create the whitelist sets of a rule group added by a reload, before Reconcile refers to them
+	AddSets(group string) error
+	// Remove the whitelist sets of a rule group dropped by a reload, after Reconcile stopped referring to them
+	DelSets(sets *firewallSets)
+	// Add addr to a whitelist set, the subnet of addr being prefix bits long
+	// A timeout of 0 uses the default of the set, which is firewall-lifespan
+	AddElement(setName string, addr net.IP, prefix uint, timeout time.Duration) error
+	// Return the command line AddElement runs, for grant previews
+	ElementCommand(setName string, addr net.IP, prefix uint, timeout time.Duration) []string
+	// Remove addr from a whitelist set, succeeding if it is not there
+	DelElement(op string, setName string, addr net.IP, prefix uint) error
+	// Remove many elements at once with a single command, succeeding for those not there
+	DelElements(op string, elements []firewallElement) error
+	// Return the packet counters of the rules jumping to the deny chain, summed by denyLabel
+	DenyCounters() (map[string]uint64, error)
+	// Return the bytes counted for the elements of a whitelist set by their masked address, with probation or auto-rekey-ipv6 enabled
+	ElementBytes(setName string) (map[string]uint64, error)
+	// Engage the lockdown of a group of "lockdown" rules for timeout, 0 for good, replacing the timeout it had
+	AddLockdown(sets *firewallSets, timeout time.Duration) error
+	// Lift the lockdown of a group, succeeding if it is not engaged
+	DelLockdown(sets *firewallSets) error
+}
+
+func newFirewallBackend(name string, fw *firewall) firewallBackend {
+	switch name {
+	case "iptables":
+		return &iptablesBackend { fw }
+	case "nftables":
+		return &nftablesBackend { fw }
+	default:
+		return nil
+	}
+}
+
+// An element of a whitelist set, for DelElements
+type firewallElement struct {
+	setName		string
+	addr		net.IP
+	prefix		uint
+}
+
+// Whitelist sets of a rule group, "" is the group of rules without one
+type firewallSets struct {
 	net4Name	string
 	net6Name	string
 	host4Name	string
 	host6Name	string
-	stopReq		chan os.Signal
+	// Groups of "lockdown" rules also have sets whose elements cover every address while the lockdown is engaged
+	lockdown	bool
+	lock4Name	string
+	lock6Name	string
+}
+
+func newFirewallSets(prefix string, lockdown bool) *firewallSets {
+	return &firewallSets {
+		net4Name:	prefix + "-net4",
+		net6Name:	prefix + "-net6",
+		host4Name:	prefix + "-host4",
+		host6Name:	prefix + "-host6",
+		lockdown:	lockdown,
+		lock4Name:	prefix + "-lock4",
+		lock6Name:	prefix + "-lock6",
+	}
 }
 
+var errFirewallStopping = errors.New("firewall is shutting down")
+
 func newFirewall(conf *config) *firewall {
 	fw := &firewall {
 		conf:		conf,
 		cache:		newCache(conf),
+		metrics:	newMetrics(),
 		chainName:	conf.Daemon.FirewallChainName,
 		denyName:	conf.Daemon.FirewallChainName + "-deny",
-		net4Name:	conf.Daemon.FirewallChainName + "-net4",
-		net6Name:	conf.Daemon.FirewallChainName + "-net6",
-		host4Name:	conf.Daemon.FirewallChainName + "-host4",
-		host6Name:	conf.Daemon.FirewallChainName + "-host6",
+		sets:		map[string]*firewallSets { "": newFirewallSets(conf.Daemon.FirewallChainName, false) },
+		ban4Name:	conf.Daemon.FirewallChainName + "-ban4",
+		ban6Name:	conf.Daemon.FirewallChainName + "-ban6",
 		stopReq:	make(chan os.Signal, 1),
+		reloadReq:	make(chan os.Signal, 1),
+		sweepReq:	make(chan struct{}, 1),
+		applied:	make(map[string]time.Time),
+		peerClocks:	make(map[string]peerClock),
+		lockdowns:	make(map[string]time.Time),
+		activity:	make(map[string]activitySample),
+		rekeys:		make(map[string][]time.Time),
+	}
+	fw.backend = newFirewallBackend(conf.Daemon.FirewallBackend, fw)
+	for _, rule := range conf.Firewall {
+		if _, ok := fw.sets[rule.Group]; !ok {
+			fw.sets[rule.Group] = newFirewallSets(conf.Daemon.FirewallChainName + "-" + rule.Group, rule.Mode == "lockdown")
+			fw.groups = append(fw.groups, rule.Group)
+		}
 	}
 	return fw
 }
 
 func (fw *firewall) Start() error {
-	err := fw.cache.Start()
+	var err error
+	if !fw.conf.readOnly {
+		err = fw.backend.Check()
+		if err != nil { return err }
+	}
+	err = fw.cache.Start()
+	if err != nil { return err }
+	fw.audit, err = newAuditLog(fw.conf)
 	if err != nil { return err }
+	fw.notify = newNotifier(fw.conf)
 
 	signal.Notify(fw.stopReq, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	signal.Notify(fw.reloadReq, syscall.SIGHUP)
 
-	// ipset
-	if *fw.conf.Daemon.FirewallLifespan != 0 {
-		err = fw.execCmd("ipset", "-exist", "create", fw.net4Name, "hash:ip", "family", "inet", "netmask", strconv.FormatUint(uint64(fw.conf.Daemon.IPv4Prefix), 10), "timeout", strconv.FormatUint(*fw.conf.Daemon.FirewallLifespan, 10))
-		if err != nil { return err }
-		err = fw.execCmd("ipset", "-exist", "create", fw.net6Name, "hash:ip", "family", "inet6", "netmask", strconv.FormatUint(uint64(fw.conf.Daemon.IPv6Prefix), 10), "timeout", strconv.FormatUint(*fw.conf.Daemon.FirewallLifespan, 10))
-		if err != nil { return err }
-		err = fw.execCmd("ipset", "-exist", "create", fw.host4Name, "hash:ip", "family", "inet", "timeout", strconv.FormatUint(*fw.conf.Daemon.FirewallLifespan, 10))
-		if err != nil { return err }
-		err = fw.execCmd("ipset", "-exist", "create", fw.host6Name, "hash:ip", "family", "inet6", "timeout", strconv.FormatUint(*fw.conf.Daemon.FirewallLifespan, 10))
-		if err != nil { return err }
-	} else {
-		err = fw.execCmd("ipset", "-exist", "create", fw.net4Name, "hash:ip", "family", "inet", "netmask", strconv.FormatUint(uint64(fw.conf.Daemon.IPv4Prefix), 10))
-		if err != nil { return err }
-		err = fw.execCmd("ipset", "-exist", "create", fw.net6Name, "hash:ip", "family", "inet6", "netmask", strconv.FormatUint(uint64(fw.conf.Daemon.IPv6Prefix), 10))
-		if err != nil { return err }
-		err = fw.execCmd("ipset", "-exist", "create", fw.host4Name, "hash:ip", "family", "inet")
-		if err != nil { return err }
-		err = fw.execCmd("ipset", "-exist", "create", fw.host6Name, "hash:ip", "family", "inet6")
-		if err != nil { return err }
+	if fw.conf.readOnly {
+		// The firewall is the business of the daemon writing the cache database
+		go fw.readOnlyLoop()
+		return nil
 	}
 
+	err = fw.backend.Setup()
+	if err != nil { return err }
 
-	// IPv4 deny
-	fw.execCmd("iptables", "-t", "filter", "-N", fw.denyName)
-	if fw.conf.Daemon.FirewallDenyMethod == "reject" {
-		err = fw.execCmd("iptables", "-t", "filter", "-I", fw.denyName, "-j", "REJECT", "--reject-with", "icmp-port-unreachable")
-		if err != nil { return err }
-		err = fw.execCmd("iptables", "-t", "filter", "-I", fw.denyName, "-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset")
-		if err != nil { return err }
-	} else {
-		err = fw.execCmd("iptables", "-t", "filter", "-I", fw.denyName, "-j", "DROP")
-		if err != nil { return err }
+	fw.conf.resolveHosts(nil)
+	fw.replayJournal(true)
+	fw.doRestore()
+	if p, ok := fw.cache.Panic(); ok && p.state == "pending" {
+		log.Printf("Finishing the panic requested by %s at %s\n", p.by, p.at.Format(time.RFC3339))
+		_, err := fw.Panic(p.by, p.at)
+		if err != nil { log.Println(err) }
 	}
-	err = fw.execCmd("iptables", "-t", "filter", "-I", fw.denyName, "-m", "limit", "--limit", "3/min", "-j", "LOG", "--log-prefix", "[PORTKNOB-DENY] ")
-	if err != nil { return err }
-	fw.execCmd("iptables", "-t", "filter", "-N", fw.chainName)
-	err = fw.execCmd("iptables", "-t", "filter", "-I", fw.chainName, "-j", "RETURN")
-	if err != nil { return err }
 
-	// IPv4 redir
-	fw.execCmd("iptables", "-t", "nat", "-N", fw.chainName)
-	err = fw.execCmd("iptables", "-t", "nat", "-I", fw.chainName, "-j", "RETURN")
-	if err != nil { return err }
+	go fw.eventLoop()
 
-	// IPv6 deny
-	fw.execCmd("ip6tables", "-t", "filter", "-N", fw.denyName)
-	if fw.conf.Daemon.FirewallDenyMethod == "reject" {
-		err = fw.execCmd("ip6tables", "-t", "filter", "-I", fw.denyName, "-j", "REJECT", "--reject-with", "icmp6-port-unreachable")
-		if err != nil { return err }
-		err = fw.execCmd("ip6tables", "-t", "filter", "-I", fw.denyName, "-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset")
-		if err != nil { return err }
-	} else {
-		err = fw.execCmd("ip6tables", "-t", "filter", "-I", fw.denyName, "-j", "DROP")
-		if err != nil { return err }
+	return nil
+}
+
+func (fw *firewall) Insert(addr net.IP, user string, groups []string) (prefix uint, err error) {
+	return fw.InsertTimeout(addr, user, groups, time.Duration(*fw.conf.Daemon.FirewallLifespan) * time.Second, true)
+}
+
+// Whitelist addr for the given rule groups, "" being rules without a group, unknown groups are ignored
+// user is only recorded in the cache database
+func (fw *firewall) InsertTimeout(addr net.IP, user string, groups []string, timeout time.Duration, updateDB bool) (prefix uint, err error) {
+	timeouts := make([]time.Duration, len(groups))
+	for i := range timeouts {
+		timeouts[i] = timeout
 	}
-	err = fw.execCmd("ip6tables", "-t", "filter", "-I", fw.denyName, "-m", "limit", "--limit", "3/min", "-j", "LOG", "--log-prefix", "[PORTKNOB-DENY] ")
-	if err != nil { return err }
-	fw.execCmd("ip6tables", "-t", "filter", "-N", fw.chainName)
-	err = fw.execCmd("ip6tables", "-t", "filter", "-I", fw.chainName, "-j", "RETURN")
-	if err != nil { return err }
+	return fw.insertGroups(addr, user, groups, timeouts, updateDB)
+}
 
-	// IPv6 redir
-	fw.execCmd("ip6tables", "-t", "nat", "-N", fw.chainName)
-	err = fw.execCmd("ip6tables", "-t", "nat", "-I", fw.chainName, "-j", "RETURN")
-	if err != nil { return err }
+// Like InsertTimeout with a timeout per group, either every group is whitelisted or none
+// With updateDB, the grant is recorded in the journal until its entries are stored, so an interrupted grant is undone by replayJournal
+func (fw *firewall) insertGroups(addr net.IP, user string, groups []string, timeouts []time.Duration, updateDB bool) (prefix uint, err error) {
+	fw.stopMutex.Lock()
+	if fw.stopping {
+		fw.stopMutex.Unlock()
+		return 0, errFirewallStopping
+	}
+	fw.inflight.Add(1)
+	fw.stopMutex.Unlock()
+	defer fw.inflight.Done()
 
-	fw.generateRules(fw.conf.Firewall)
+	// Without updateDB, the caller restores the cache itself, possibly within a transaction
+	var cached []cacheEntry
+	if updateDB {
+		cached, err = fw.cache.Entries()
+		if err != nil {
+			return 0, err
+		}
+	}
+	var elements []grantElement
+	var entries []cacheEntry
+	for i, group := range groups {
+		if _, ok := fw.sets[group]; !ok {
+			continue
+		}
+		groupTimeout := fw.elementTimeout(group, timeouts[i])
+		// Zero for entries which never expire
+		var expires time.Time
+		if groupTimeout != 0 {
+			expires = time.Now().Add(groupTimeout).UTC()
+		}
+		element := grantElement { group: group, timeout: groupTimeout }
+		element.setName, prefix = fw.setFor(addr, group)
+		element.prev, element.existed = fw.liveExpiry(cached, addr, group)
+		elements = append(elements, element)
+		entries = append(entries, cacheEntry { addr: addr, group: group, user: user, expires: expires })
+	}
+	if updateDB {
+		err = fw.cache.SetJournal(entries, "pending")
+		if err != nil {
+			return
+		}
+	}
+	var added []grantElement
+	for _, element := range elements {
+		err = fw.backend.AddElement(element.setName, addr, prefix, element.timeout)
+		if err != nil { break }
+		added = append(added, element)
+	}
+	if err == nil && updateDB {
+		// Clears the journal in the same transaction
+		err = fw.cache.Set(entries)
+	}
+	if err != nil {
+		// Roll back the whole grant, otherwise some groups would not be restored after a restart
+		if fw.rollback(addr, prefix, added) && updateDB {
+			fw.cache.ClearJournal(entries)
+		} else if updateDB {
+			// Retried by the next cleanup
+			fw.cache.SetJournal(entries, "failed")
+		}
+		return
+	}
+	if fw.cache.Shared() {
+		fw.appliedMutex.Lock()
+		for _, entry := range entries {
+			fw.applied[fw.Subnet(addr).String() + " " + entry.group] = entry.expires
+		}
+		fw.appliedMutex.Unlock()
+	}
+	if updateDB {
+		for _, entry := range entries {
+			fw.audit.Event(fw.conf.entryEvent("add", entry.group), "client", addr, "subnet", fw.Subnet(addr), "group", entry.group, "user", user, "expires", formatExpiry(entry.expires))
+		}
+		fw.notifySweeper()
+		fw.syncLockdowns()
+	}
+	return
+}
 
-	// Activate
-	err = fw.execCmd("iptables", "-t", "filter", "-I", "INPUT", "-m", "set", "!", "--match-set", fw.net4Name, "src", "-m", "set", "!", "--match-set", fw.host4Name, "src", "-j", fw.chainName)
-	if err != nil { return err }
-	err = fw.execCmd("iptables", "-t", "nat", "-I", "OUTPUT", "-m", "set", "!", "--match-set", fw.net4Name, "src", "-m", "set", "!", "--match-set", fw.host4Name, "src", "-m", "addrtype", "--dst-type", "LOCAL", "-j", fw.chainName)
-	if err != nil { return err }
-	err = fw.execCmd("iptables", "-t", "nat", "-I", "PREROUTING", "-m", "set", "!", "--match-set", fw.net4Name, "src", "-m", "set", "!", "--match-set", fw.host4Name, "src", "-m", "addrtype", "--dst-type", "LOCAL", "-j", fw.chainName)
-	if err != nil { return err }
-	err = fw.execCmd("ip6tables", "-t", "filter", "-I", "INPUT", "-m", "set", "!", "--match-set", fw.net6Name, "src", "-m", "set", "!", "--match-set", fw.host6Name, "src", "-j", fw.chainName)
-	if err != nil { return err }
-	err = fw.execCmd("ip6tables", "-t", "nat", "-I", "OUTPUT", "-m", "set", "!", "--match-set", fw.net6Name, "src", "-m", "set", "!", "--match-set", fw.host6Name, "src", "-m", "addrtype", "--dst-type", "LOCAL", "-j", fw.chainName)
-	if err != nil { return err }
-	err = fw.execCmd("ip6tables", "-t", "nat", "-I", "PREROUTING", "-m", "set", "!", "--match-set", fw.net6Name, "src", "-m", "set", "!", "--match-set", fw.host6Name, "src", "-m", "addrtype", "--dst-type", "LOCAL", "-j", fw.chainName)
-	if err != nil { return err }
+// Return the timeout of the element of group for a grant with timeout, after absolute-max-lifespan
+// The default of the set is spelt out so the cache knows when the entry expires
+func (fw *firewall) elementTimeout(group string, timeout time.Duration) time.Duration {
+	timeout = fw.ClampLifespan(timeout)
+	if timeout == 0 {
+		timeout = time.Duration(fw.conf.groupLifespan(group)) * time.Second
+	}
+	return timeout
+}
 
-	fw.doRestore()
+// A firewall element changed by a grant, with the state to roll it back to
+type grantElement struct {
+	group		string
+	setName		string
+	timeout		time.Duration
+	// Whether an earlier grant of the subnet had the element, until prev, zero for never
+	existed		bool
+	prev		time.Time
+}
 
-	go fw.eventLoop()
+// Return when the element of the subnet of addr in group expires according to the cached entries, false if the subnet has no live entry there
+// Addresses of the same subnet share one element, which lives as long as the last of their entries
+func (fw *firewall) liveExpiry(cached []cacheEntry, addr net.IP, group string) (expires time.Time, ok bool) {
+	subnet := fw.Subnet(addr).String()
+	now := time.Now()
+	for _, entry := range cached {
+		entry.expires = fw.localExpiry(entry, now)
+		if entry.group != group || !entry.live(now) || fw.Subnet(entry.addr).String() != subnet {
+			continue
+		}
+		if !ok || !expires.IsZero() && (entry.expires.IsZero() || entry.expires.After(expires)) {
+			expires = entry.expires
+		}
+		ok = true
+	}
+	return
+}
 
-	return nil
+// Put elements added by a failed grant back the way they were, returning whether every element was
+// Adding an element only refreshes the timeout of one an earlier grant added, which must stay until its own expiry
+func (fw *firewall) rollback(addr net.IP, prefix uint, elements []grantElement) bool {
+	ok := true
+	for _, element := range elements {
+		var err error
+		if remaining := time.Until(element.prev); element.existed && (element.prev.IsZero() || remaining >= time.Second) {
+			if element.prev.IsZero() {
+				remaining = 0
+			}
+			err = fw.backend.AddElement(element.setName, addr, prefix, remaining)
+		} else {
+			err = fw.backend.DelElement("grant-rollback", element.setName, addr, prefix)
+		}
+		if err != nil {
+			log.Printf("Cannot roll back the whitelist entry of %s in %s: %s\n", fw.Subnet(addr), element.setName, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Undo the firewall changes of grants left in the journal, all of them at startup, otherwise only those whose rollback failed
+// The firewall is made to match the cache database, which only knows about completed grants
+func (fw *firewall) replayJournal(all bool) {
+	records, err := fw.cache.Journal()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(records) == 0 {
+		return
+	}
+	cached, err := fw.cache.Entries()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var done []cacheEntry
+	for _, record := range records {
+		if !all && record.state != "failed" {
+			continue
+		}
+		if _, ok := fw.sets[record.entry.group]; ok {
+			setName, prefix := fw.setFor(record.entry.addr, record.entry.group)
+			prev, existed := fw.liveExpiry(cached, record.entry.addr, record.entry.group)
+			if !fw.rollback(record.entry.addr, prefix, []grantElement {{ group: record.entry.group, setName: setName, existed: existed, prev: prev }}) {
+				continue
+			}
+		}
+		log.Printf("Rolled back an interrupted grant of %s in rule group %q\n", fw.Subnet(record.entry.addr), record.entry.group)
+		fw.audit.Event("whitelist-rollback", "client", record.entry.addr, "subnet", fw.Subnet(record.entry.addr), "group", record.entry.group, "started", record.started)
+		done = append(done, record.entry)
+	}
+	fw.cache.ClearJournal(done)
+}
+
+// Format the expiry of a whitelist entry, "never" if it is zero
+func formatExpiry(expires time.Time) string {
+	if expires.IsZero() {
+		return "never"
+	}
+	return expires.UTC().Format(time.RFC3339)
+}
+
+// Whitelist addr after a login with a lifespan of timeout, groups being the rule groups of the user without ""
+// Groups in skip are left out, even "" or those with a lifespan of their own
+// Rules with a lifespan of their own use it instead, no entry outlives deadline unless it is zero
+// Returns the prefix and the longest lifespan given after absolute-max-lifespan and expiry-jitter, 0 being the longest
+func (fw *firewall) Grant(addr net.IP, user string, groups, skip []string, timeout time.Duration, deadline time.Time) (prefix uint, longest time.Duration, err error) {
+	grantGroups, timeouts := fw.grantLifespans(groups, skip, nil, timeout, deadline, time.Now())
+	for i := range timeouts {
+		timeouts[i] = fw.JitterLifespan(timeouts[i])
+		if i == 0 || longest != 0 && (timeouts[i] == 0 || timeouts[i] > longest) {
+			longest = timeouts[i]
+		}
+	}
+	prefix, err = fw.insertGroups(addr, user, grantGroups, timeouts, true)
+	return
+}
+
+// Return the rule groups opened by Grant at now and their lifespans before expiry-jitter
+// Lifespans by group, set by the [authz] authorizer, replace those of the rules
+func (fw *firewall) grantLifespans(groups, skip []string, lifespans map[string]time.Duration, timeout time.Duration, deadline, now time.Time) (grantGroups []string, timeouts []time.Duration) {
+	for _, group := range fw.conf.expandGroups(append([]string {""}, groups...)) {
+		if _, ok := fw.sets[group]; !ok || containsString(skip, group) {
+			continue
+		}
+		groupTimeout := timeout
+		if lg, ok := fw.conf.lifespanGroups[group]; ok {
+			groupTimeout = time.Duration(lg.lifespan) * time.Second
+		}
+		if lifespan, ok := lifespans[group]; ok {
+			groupTimeout = lifespan
+		}
+		if !deadline.IsZero() {
+			remaining := deadline.Sub(now)
+			if groupTimeout == 0 || remaining < groupTimeout {
+				// A timeout of 0 would make the entry permanent
+				groupTimeout = remaining
+				if groupTimeout < time.Second {
+					groupTimeout = time.Second
+				}
+			}
+		}
+		grantGroups = append(grantGroups, group)
+		timeouts = append(timeouts, fw.ClampLifespan(groupTimeout))
+	}
+	return
 }
 
-func (fw *firewall) Insert(addr net.IP) (prefix uint, err error) {
-	return fw.InsertTimeout(addr, time.Duration(*fw.conf.Daemon.FirewallLifespan) * time.Second, true)
+// Apply absolute-max-lifespan to the lifespan of a whitelist entry, 0 means no expiry
+func (fw *firewall) ClampLifespan(timeout time.Duration) time.Duration {
+	maxLifespan := time.Duration(fw.conf.Daemon.AbsoluteMaxLifespan) * time.Second
+	if maxLifespan != 0 && (timeout == 0 || timeout > maxLifespan) {
+		return maxLifespan
+	}
+	return timeout
+}
+
+// Shorten the lifespan of a new whitelist entry by a random amount up to expiry-jitter, so entries created together do not expire together
+func (fw *firewall) JitterLifespan(timeout time.Duration) time.Duration {
+	jitter := time.Duration(fw.conf.Daemon.ExpiryJitter) * time.Second
+	if timeout == 0 || jitter == 0 {
+		return timeout
+	}
+	if jitter > timeout / 2 {
+		jitter = timeout / 2
+	}
+	return timeout - time.Duration(rand.Int63n(int64(jitter / time.Second) + 1)) * time.Second
 }
 
-func (fw *firewall) InsertTimeout(addr net.IP, timeout time.Duration, updateDB bool) (prefix uint, err error) {
-	var setName string
+// Return the ipset of group and prefix length used to whitelist addr
+func (fw *firewall) setFor(addr net.IP, group string) (setName string, prefix uint) {
+	sets := fw.sets[group]
 	if addr.To4() != nil {
 		prefix = fw.conf.Daemon.IPv4Prefix
-		setName = fw.net4Name
+		setName = sets.net4Name
 		if addr.Mask(net.CIDRMask(int(fw.conf.Daemon.IPv4Prefix), net.IPv4len * 8)).Equal(net.IPv4zero) {
 			prefix = 32
-			setName = fw.host4Name
+			setName = sets.host4Name
 		}
 	} else {
 		prefix = fw.conf.Daemon.IPv6Prefix
-		setName = fw.net6Name
+		setName = sets.net6Name
 		if addr.Mask(net.CIDRMask(int(fw.conf.Daemon.IPv6Prefix), net.IPv6len * 8)).Equal(net.IPv6zero) {
 			prefix = 128
-			setName = fw.host6Name
+			setName = sets.host6Name
 		}
 	}
-	if timeout != 0 {
-		err = fw.execCmd("ipset", "-exist", "add", setName, addr.String(), "timeout", strconv.FormatUint(uint64(timeout / time.Second), 10))
-	} else {
-		err = fw.execCmd("ipset", "-exist", "add", setName, addr.String())
-	}
-	if err != nil { return }
-	if updateDB && timeout != 0 {
-		err = fw.cache.Set(addr, time.Now().UTC().Add(timeout))
-	}
 	return
 }
 
-func (fw *firewall) generateRules(rules []configFirewall) {
-	for i := 0; i < len(rules); i++ {
-		rule := &rules[len(rules) - i - 1]
-		var rule_ipv4 bool
-		var rule_ipv6 bool
-		if rule.Dest == "" {
-			rule_ipv4 = true
-			rule_ipv6 = true
-		} else {
-			rule_ipv4 = rule.DestIP.To4() != nil
-			rule_ipv6 = !rule_ipv4
-		}
-
-		clause_filter := []string {"-t", "filter"}
-		clause_nat := []string {"-t", "nat"}
-		clause_chain := []string {"-I", fw.chainName}
-		var clause_dest []string
-		if rule.Dest != "" {
-			clause_dest = []string {"-d", rule.Dest}
-		}
-		clause_tcp := []string {"-p", "tcp", "-m", "tcp"}
-		clause_udp := []string {"-p", "udp", "-m", "udp"}
-		clause_dport := []string {"--dport", rule.DestPort}
-		var clause_comment []string
-		if rule.Comment != "" {
-			clause_comment = []string {"-m", "comment", "--comment", rule.Comment}
-		}
-		clause_deny := []string {"-j", fw.denyName}
-		clause_redir := []string {"-j", "DNAT", "--to-destination", rule.Redir}
-		clause_log := []string {"-m", "limit", "--limit", "3/min", "-j", "LOG", "--log-prefix", "[PORTKNOB-REDIR] "}
-
-		// Deny
-		if rule_ipv4 {
-			if rule.Proto == "udp" || rule.Proto == "" {
-				args := make([]string, 0, 18)
-				args = append(args, clause_filter...)
-				args = append(args, clause_chain...)
-				args = append(args, clause_dest...)
-				args = append(args, clause_udp...)
-				args = append(args, clause_dport...)
-				args = append(args, clause_comment...)
-				args = append(args, clause_deny...)
-				err := fw.execCmd("iptables", args...)
-				if err != nil { log.Println(err) }
-			}
-			if rule.Proto == "tcp" || rule.Proto == "" {
-				args := make([]string, 0, 18)
-				args = append(args, clause_filter...)
-				args = append(args, clause_chain...)
-				args = append(args, clause_dest...)
-				args = append(args, clause_tcp...)
-				args = append(args, clause_dport...)
-				args = append(args, clause_comment...)
-				args = append(args, clause_deny...)
-				err := fw.execCmd("iptables", args...)
-				if err != nil { log.Println(err) }
-			}
+// Return the subnet opened by whitelisting addr
+func (fw *firewall) Subnet(addr net.IP) *net.IPNet {
+	_, prefix := fw.setFor(addr, "")
+	bits := net.IPv6len * 8
+	if addr.To4() != nil {
+		addr = addr.To4()
+		bits = net.IPv4len * 8
+	}
+	mask := net.CIDRMask(int(prefix), bits)
+	return &net.IPNet { IP: addr.Mask(mask), Mask: mask }
+}
+
+// Remove the subnets of addrs from the whitelist of every rule group, with one command however many there are
+func (fw *firewall) Revoke(addrs ...net.IP) error {
+	var elements []firewallElement
+	var subnets []*net.IPNet
+	for _, addr := range addrs {
+		for group := range fw.sets {
+			setName, prefix := fw.setFor(addr, group)
+			elements = append(elements, firewallElement { setName, addr, prefix })
 		}
-		if rule_ipv6 {
-			if rule.Proto == "udp" || rule.Proto == "" {
-				args := make([]string, 0, 18)
-				args = append(args, clause_filter...)
-				args = append(args, clause_chain...)
-				args = append(args, clause_dest...)
-				args = append(args, clause_udp...)
-				args = append(args, clause_dport...)
-				args = append(args, clause_comment...)
-				args = append(args, clause_deny...)
-				err := fw.execCmd("ip6tables", args...)
-				if err != nil { log.Println(err) }
-			}
-			if rule.Proto == "tcp" || rule.Proto == "" {
-				args := make([]string, 0, 18)
-				args = append(args, clause_filter...)
-				args = append(args, clause_chain...)
-				args = append(args, clause_dest...)
-				args = append(args, clause_tcp...)
-				args = append(args, clause_dport...)
-				args = append(args, clause_comment...)
-				args = append(args, clause_deny...)
-				err := fw.execCmd("ip6tables", args...)
-				if err != nil { log.Println(err) }
+		subnets = append(subnets, fw.Subnet(addr))
+	}
+	if len(elements) == 0 {
+		return nil
+	}
+	err := fw.backend.DelElements("revoke", elements)
+	if err != nil { return err }
+	for _, subnet := range subnets {
+		fw.audit.Event("whitelist-revoke", "subnet", subnet)
+	}
+	contained := func (addr net.IP) bool {
+		for _, subnet := range subnets {
+			if subnet.Contains(addr) {
+				return true
 			}
 		}
+		return false
+	}
+	// The users of the subnets must type their password again, wherever they log in from
+	var users []string
+	entries, _ := fw.cache.Entries()
+	for _, entry := range entries {
+		if contained(entry.addr) && entry.user != "" && !containsString(users, entry.user) {
+			users = append(users, entry.user)
+		}
+	}
+	_, err = fw.cache.Iter(func (entry cacheEntry) bool {
+		return contained(entry.addr)
+	})
+	fw.cache.CleanupAuthTimes(math.MaxInt64, users)
+	fw.notifySweeper()
+	fw.syncLockdowns()
+	return err
+}
 
-		// Redirect
-		if rule.Redir != "" {
-			if rule_ipv4 {
-				if rule.Proto == "udp" || rule.Proto == "" {
-					args := make([]string, 0, 20)
-					args = append(args, clause_nat...)
-					args = append(args, clause_chain...)
-					args = append(args, clause_dest...)
-					args = append(args, clause_udp...)
-					args = append(args, clause_dport...)
-					args = append(args, clause_comment...)
-					args = append(args, clause_redir...)
-					err := fw.execCmd("iptables", args...)
-					if err != nil { log.Println(err) }
-					args = make([]string, 0, 24)
-					args = append(args, clause_nat...)
-					args = append(args, clause_chain...)
-					args = append(args, clause_dest...)
-					args = append(args, clause_udp...)
-					args = append(args, clause_dport...)
-					args = append(args, clause_comment...)
-					args = append(args, clause_log...)
-					err = fw.execCmd("iptables", args...)
-					if err != nil { log.Println(err) }
-				}
-				if rule.Proto == "tcp" || rule.Proto == "" {
-					args := make([]string, 0, 20)
-					args = append(args, clause_nat...)
-					args = append(args, clause_chain...)
-					args = append(args, clause_dest...)
-					args = append(args, clause_tcp...)
-					args = append(args, clause_dport...)
-					args = append(args, clause_comment...)
-					args = append(args, clause_redir...)
-					err := fw.execCmd("iptables", args...)
-					if err != nil { log.Println(err) }
-					args = make([]string, 0, 24)
-					args = append(args, clause_nat...)
-					args = append(args, clause_chain...)
-					args = append(args, clause_dest...)
-					args = append(args, clause_tcp...)
-					args = append(args, clause_dport...)
-					args = append(args, clause_comment...)
-					args = append(args, clause_log...)
-					err = fw.execCmd("iptables", args...)
-					if err != nil { log.Println(err) }
-				}
-			}
-			if rule_ipv6 {
-				if rule.Proto == "udp" || rule.Proto == "" {
-					args := make([]string, 0, 20)
-					args = append(args, clause_nat...)
-					args = append(args, clause_chain...)
-					args = append(args, clause_dest...)
-					args = append(args, clause_udp...)
-					args = append(args, clause_dport...)
-					args = append(args, clause_comment...)
-					args = append(args, clause_redir...)
-					err := fw.execCmd("ip6tables", args...)
-					if err != nil { log.Println(err) }
-					args = make([]string, 0, 24)
-					args = append(args, clause_nat...)
-					args = append(args, clause_chain...)
-					args = append(args, clause_dest...)
-					args = append(args, clause_udp...)
-					args = append(args, clause_dport...)
-					args = append(args, clause_comment...)
-					args = append(args, clause_log...)
-					err = fw.execCmd("ip6tables", args...)
-					if err != nil { log.Println(err) }
-				}
-				if rule.Proto == "tcp" || rule.Proto == "" {
-					args := make([]string, 0, 20)
-					args = append(args, clause_nat...)
-					args = append(args, clause_chain...)
-					args = append(args, clause_dest...)
-					args = append(args, clause_tcp...)
-					args = append(args, clause_dport...)
-					args = append(args, clause_comment...)
-					args = append(args, clause_redir...)
-					err := fw.execCmd("ip6tables", args...)
-					if err != nil { log.Println(err) }
-					args = make([]string, 0, 24)
-					args = append(args, clause_nat...)
-					args = append(args, clause_chain...)
-					args = append(args, clause_dest...)
-					args = append(args, clause_tcp...)
-					args = append(args, clause_dport...)
-					args = append(args, clause_comment...)
-					args = append(args, clause_log...)
-					err = fw.execCmd("ip6tables", args...)
-					if err != nil { log.Println(err) }
-				}
+// Remove the subnets of addrs from the whitelist of one rule group only, the other groups stay open
+// The users keep their login cookies, so their next login opens the group again
+func (fw *firewall) RevokeGroup(group string, addrs ...net.IP) error {
+	if _, ok := fw.sets[group]; !ok || len(addrs) == 0 {
+		return nil
+	}
+	var elements []firewallElement
+	var subnets []*net.IPNet
+	for _, addr := range addrs {
+		setName, prefix := fw.setFor(addr, group)
+		elements = append(elements, firewallElement { setName, addr, prefix })
+		subnets = append(subnets, fw.Subnet(addr))
+	}
+	err := fw.backend.DelElements("revoke", elements)
+	if err != nil { return err }
+	for _, subnet := range subnets {
+		fw.audit.Event(fw.conf.entryEvent("revoke", group), "subnet", subnet, "group", group)
+	}
+	_, err = fw.cache.Iter(func (entry cacheEntry) bool {
+		if entry.group != group {
+			return false
+		}
+		for _, subnet := range subnets {
+			if subnet.Contains(entry.addr) {
+				return true
 			}
 		}
-	}
+		return false
+	})
+	fw.notifySweeper()
+	fw.syncLockdowns()
+	return err
 }
 
 func (fw *firewall) eventLoop() {
-	cleanupTick := time.Tick(1 * time.Minute)
+	cleanupTimer := time.NewTimer(fw.nextCleanup(time.Now()))
+	dnsTicker := time.NewTicker(time.Duration(fw.conf.Daemon.DNSRefreshInterval) * time.Second)
+	defer dnsTicker.Stop()
+	denyTicker := time.NewTicker(time.Hour)
+	defer denyTicker.Stop()
+	fw.resetDenyTicker(denyTicker)
+	probationTicker := time.NewTicker(probationCheckInterval)
+	defer probationTicker.Stop()
+	if !fw.conf.probationEnabled() && !fw.conf.Daemon.AutoRekeyIPv6 {
+		probationTicker.Stop()
+	}
 	for {
 		select {
 		case <-fw.stopReq:
 			fw.Stop(0)
 			return
-		case <-cleanupTick:
+		case <-fw.sweepReq:
+			cleanupTimer.Stop()
+		case <-fw.reloadReq:
+			fw.reload()
+			dnsTicker.Reset(time.Duration(fw.conf.Daemon.DNSRefreshInterval) * time.Second)
+			fw.resetDenyTicker(denyTicker)
+			cleanupTimer.Stop()
+		case <-dnsTicker.C:
+			go fw.refreshHosts()
+			continue
+		case <-denyTicker.C:
+			go fw.recordDenied(time.Now())
+			continue
+		case <-probationTicker.C:
+			go fw.checkProbation(time.Now())
+			if fw.conf.Daemon.AutoRekeyIPv6 {
+				go fw.sampleActivity(time.Now())
+			}
+			continue
+		case <-cleanupTimer.C:
 			fw.doCleanup()
 		}
+		cleanupTimer.Reset(fw.nextCleanup(time.Now()))
+	}
+}
+
+// Wait for a signal to stop with -read-only, which has nothing to clean up or sweep
+func (fw *firewall) readOnlyLoop() {
+	for {
+		select {
+		case <-fw.stopReq:
+			fw.Stop(0)
+			return
+		case <-fw.reloadReq:
+			log.Println("Not reloading the configuration with -read-only, restart instead")
+		}
+	}
+}
+
+// Reload the configuration file on SIGHUP, keeping the old configuration if the new one is invalid
+func (fw *firewall) reload() {
+	// Even if the new configuration is rejected, logrotate expects the old audit log file to be let go
+	err := fw.audit.Reopen()
+	if err != nil {
+		log.Printf("Cannot reopen audit log %q: %s\n", fw.conf.Daemon.AuditLog, err)
+	}
+	newConf, err := loadConfig(fw.conf.path)
+	if err != nil {
+		log.Printf("Cannot reload %q, keeping the old configuration: %s\n", fw.conf.path, err)
+		return
+	}
+	newConf.forceDowngrade = fw.conf.forceDowngrade
+	newConf.generation = fw.conf.generation + 1
+	if option := fw.conf.restartOption(newConf); option != "" {
+		log.Printf("Not reloading %q: changing %s requires a restart\n", fw.conf.path, option)
+		return
+	}
+	newConf.resolveHosts(fw.conf)
+
+	fw.reloadMutex.Lock()
+	defer fw.reloadMutex.Unlock()
+	oldConf := *fw.conf
+	*fw.conf = *newConf
+	// Groups are named after the users and lifespan of their rules, so editing those replaces the group
+	newGroups := map[string]bool { "": true }
+	for _, rule := range newConf.Firewall {
+		newGroups[rule.Group] = true
+		if _, ok := fw.sets[rule.Group]; ok {
+			continue
+		}
+		fw.sets[rule.Group] = newFirewallSets(fw.conf.Daemon.FirewallChainName + "-" + rule.Group, rule.Mode == "lockdown")
+		fw.groups = append(fw.groups, rule.Group)
+		err = fw.backend.AddSets(rule.Group)
+		if err != nil {
+			log.Printf("Reloaded %q, but creating the sets of rule group %q failed: %s\n", fw.conf.path, rule.Group, err)
+			return
+		}
+	}
+	added, removed := diffRules(oldConf.Firewall, newConf.Firewall)
+	err = fw.backend.Reconcile(&oldConf, added, removed)
+	if err != nil {
+		log.Printf("Reloaded %q, but updating the firewall failed: %s\n", fw.conf.path, err)
+		return
+	}
+	var groups []string
+	for _, group := range fw.groups {
+		if newGroups[group] {
+			groups = append(groups, group)
+			continue
+		}
+		// Clients log in again to be whitelisted in the group replacing it
+		if !fw.cache.Shared() {
+			// Other instances may not have reloaded yet, and restarts forget the entries anyway
+			fw.cache.Iter(func (entry cacheEntry) bool {
+				return entry.group == group
+			})
+		}
+		fw.backend.DelSets(fw.sets[group])
+		delete(fw.sets, group)
+	}
+	fw.groups = groups
+	log.Printf("Reloaded %q: %d firewall rules added, %d removed\n", fw.conf.path, len(added), len(removed))
+}
+
+// Return the rules only in newRules and the rules only in oldRules
+func diffRules(oldRules, newRules []configFirewall) (added, removed []configFirewall) {
+	count := make(map[string]int)
+	for _, rule := range oldRules {
+		count[rule.key()]++
+	}
+	for _, rule := range newRules {
+		if count[rule.key()] > 0 {
+			count[rule.key()]--
+		} else {
+			added = append(added, rule)
+		}
+	}
+	for i := len(oldRules) - 1; i >= 0; i-- {
+		if count[oldRules[i].key()] > 0 {
+			count[oldRules[i].key()]--
+			removed = append(removed, oldRules[i])
+		}
+	}
+	return
+}
+
+// Resolve the hostnames of the configuration again, outside the event loop so slow DNS does not hold up cleanups
+func (fw *firewall) refreshHosts() {
+	fw.reloadMutex.RLock()
+	lists := fw.conf.netLists()
+	timeout := fw.conf.dnsTimeout()
+	fw.reloadMutex.RUnlock()
+	for _, l := range lists {
+		l.Refresh(timeout)
+	}
+}
+
+// Ask the event loop to recompute when the next cleanup is due
+func (fw *firewall) notifySweeper() {
+	select {
+	case fw.sweepReq <- struct{}{}:
+	default:
+	}
+}
+
+// Sleep until the earliest entry expires, but at least a second and at most sweeper-max-sleep
+func (fw *firewall) nextCleanup(now time.Time) time.Duration {
+	sleep := time.Duration(fw.conf.Daemon.SweeperMaxSleep) * time.Second
+	if earliest, ok := fw.cache.NextExpiry(func (entry cacheEntry) time.Time { return fw.localExpiry(entry, now) }); ok {
+		if until := earliest.Sub(now); until < sleep {
+			sleep = until
+		}
+	}
+	if interval := time.Duration(fw.conf.Daemon.CacheSyncInterval) * time.Second; fw.cache.Shared() && interval < sleep {
+		sleep = interval
+	}
+	if sleep < time.Second {
+		sleep = time.Second
+	}
+	return sleep
+}
+
+// Apply the whitelist entries other instances added, extended or revoked in the shared cache database
+func (fw *firewall) syncShared() {
+	entries, err := fw.cache.Entries()
+	if err != nil {
+		log.Printf("Cannot read the shared cache database: %s\n", err)
+		return
+	}
+	now := time.Now()
+	fw.peerMutex.Lock()
+	lastSync := fw.lastSync
+	fw.lastSync = now
+	fw.peerMutex.Unlock()
+	// Entries of addresses in the same subnet share one firewall element, which lives as long as the last of them
+	latest := make(map[string]cacheEntry)
+	for _, entry := range entries {
+		if _, ok := fw.sets[entry.group]; !ok {
+			continue
+		}
+		key := fw.Subnet(entry.addr).String() + " " + entry.group
+		if prev, ok := latest[key]; !ok || !prev.expires.IsZero() && (entry.expires.IsZero() || entry.expires.After(prev.expires)) {
+			latest[key] = entry
+		}
+	}
+
+	var added []cacheEntry
+	fw.appliedMutex.Lock()
+	for key, entry := range latest {
+		expires, ok := fw.applied[key]
+		if entry.expires.IsZero() {
+			if !ok || !expires.IsZero() {
+				added = append(added, entry)
+			}
+		} else if fw.localExpiry(entry, now).Sub(now) >= time.Second && (!ok || expires.IsZero() || entry.expires.Sub(expires) > time.Second || expires.Sub(entry.expires) > time.Second) {
+			added = append(added, entry)
+		}
+	}
+	var removed []string
+	for key, expires := range fw.applied {
+		if _, ok := latest[key]; ok {
+			continue
+		}
+		if expires.IsZero() || expires.After(now) {
+			// Revoked by another instance
+			removed = append(removed, key)
+		}
+		delete(fw.applied, key)
+	}
+	fw.appliedMutex.Unlock()
+
+	// The latest entry of each writer since the last sync tells how far off its clock is, entries of the first sync may be much older
+	if !lastSync.IsZero() {
+		newest := make(map[string]cacheEntry)
+		for _, entry := range added {
+			if prev, ok := newest[entry.node]; !ok || entry.created.After(prev.created) {
+				newest[entry.node] = entry
+			}
+		}
+		for _, entry := range newest {
+			fw.observeClock(entry, now.Sub(lastSync), now)
+		}
+	}
+	for _, entry := range added {
+		expires := fw.localExpiry(entry, now)
+		if fw.conf.Daemon.Verbose >= 1 {
+			log.Printf("Shared cache: whitelisting %s until %s\n", fw.Subnet(entry.addr), formatExpiry(expires))
+		}
+		var timeout time.Duration
+		if !expires.IsZero() {
+			timeout = expires.Sub(now)
+			if timeout < time.Second {
+				continue
+			}
+		}
+		_, err := fw.InsertTimeout(entry.addr, entry.user, []string {entry.group}, timeout, false)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		// Even if absolute-max-lifespan shortened it, do not apply it again on every sync
+		fw.appliedMutex.Lock()
+		fw.applied[fw.Subnet(entry.addr).String() + " " + entry.group] = entry.expires
+		fw.appliedMutex.Unlock()
+	}
+	// After a mass revocation elsewhere, one command removes them all
+	var elements []firewallElement
+	for _, key := range removed {
+		fields := strings.SplitN(key, " ", 2)
+		_, subnet, err := net.ParseCIDR(fields[0])
+		if err != nil { continue }
+		if _, ok := fw.sets[fields[1]]; !ok { continue }
+		if fw.conf.Daemon.Verbose >= 1 {
+			log.Printf("Shared cache: revoking %s\n", subnet)
+		}
+		setName, prefix := fw.setFor(subnet.IP, fields[1])
+		elements = append(elements, firewallElement { setName, subnet.IP, prefix })
+	}
+	if len(elements) != 0 {
+		err := fw.backend.DelElements("shared-revoke", elements)
+		if err != nil { log.Println(err) }
+	}
+}
+
+// Estimate the clock skew of the instance which wrote entry, read by a sync elapsed after the previous one
+// The entry was created between the two syncs, so the skew lies between created - now and that plus elapsed, the estimate is the value of that range closest to zero
+func (fw *firewall) observeClock(entry cacheEntry, elapsed time.Duration, now time.Time) {
+	if entry.node == "" || entry.node == fw.cache.journalOwner || entry.created.IsZero() {
+		return
+	}
+	skew := entry.created.Sub(now)
+	if skew < 0 {
+		skew += elapsed
+		if skew > 0 {
+			skew = 0
+		}
+	}
+	max := time.Duration(fw.conf.Daemon.MaxPeerClockSkew) * time.Second
+	fw.peerMutex.Lock()
+	prev, known := fw.peerClocks[entry.node]
+	fw.peerClocks[entry.node] = peerClock { skew: skew, seen: now }
+	fw.peerMutex.Unlock()
+	fw.metrics.PeerSkew(entry.node, skew)
+	if skew.Abs() > max && (!known || prev.skew.Abs() <= max) {
+		log.Printf("Shared cache: clock of %s is %s off, more than max-peer-clock-skew, correcting its whitelist entries\n", entry.node, skew.Round(time.Second))
+		fw.audit.Event("peer-clock-skew", "peer", entry.node, "skew", skew.Round(time.Second))
+	} else if skew.Abs() <= max && known && prev.skew.Abs() > max {
+		log.Printf("Shared cache: clock of %s is back within max-peer-clock-skew\n", entry.node)
+	}
+}
+
+// Return when entry expires by the clock of this host
+// Entries another instance wrote are moved by its skew once that exceeds max-peer-clock-skew, and never outlive the lifespan it gave them
+// Without a shared cache database every entry is this host's own and is returned as it is
+func (fw *firewall) localExpiry(entry cacheEntry, now time.Time) time.Time {
+	if entry.expires.IsZero() || !fw.cache.Shared() || entry.node == "" || entry.node == fw.cache.journalOwner {
+		return entry.expires
+	}
+	expires := entry.expires
+	fw.peerMutex.Lock()
+	peer, known := fw.peerClocks[entry.node]
+	fw.peerMutex.Unlock()
+	if known && peer.skew.Abs() > time.Duration(fw.conf.Daemon.MaxPeerClockSkew) * time.Second {
+		expires = expires.Add(-peer.skew)
+	}
+	if lifespan := entry.expires.Sub(entry.created); !entry.created.IsZero() && expires.Sub(now) > lifespan {
+		expires = now.Add(lifespan)
 	}
+	return expires
+}
+
+// Return the estimated clocks of the other instances sharing the cache database
+func (fw *firewall) PeerClocks() map[string]peerClock {
+	fw.peerMutex.Lock()
+	defer fw.peerMutex.Unlock()
+	clocks := make(map[string]peerClock, len(fw.peerClocks))
+	for peer, clock := range fw.peerClocks {
+		clocks[peer] = clock
+	}
+	return clocks
 }
 
 func (fw *firewall) Stop(exitcode int) {
 	signal.Stop(fw.stopReq)
+	signal.Stop(fw.reloadReq)
+
+	// Refuse new grants and let in-flight ones finish
+	fw.stopMutex.Lock()
+	fw.stopping = true
+	fw.stopMutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		fw.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(fw.conf.Daemon.ShutdownGrace) * time.Second):
+		log.Println("Timed out waiting for in-flight grants, shutting down anyway")
+	}
 
-	// IPv4
-	fw.execCmd("iptables", "-t", "filter", "-D", "INPUT", "-m", "set", "!", "--match-set", fw.net4Name, "src", "-m", "set", "!", "--match-set", fw.host4Name, "src", "-j", fw.chainName)
-	fw.execCmd("iptables", "-t", "nat", "-D", "OUTPUT", "-m", "set", "!", "--match-set", fw.net4Name, "src", "-m", "set", "!", "--match-set", fw.host4Name, "src", "-m", "addrtype", "--dst-type", "LOCAL", "-j", fw.chainName)
-	fw.execCmd("iptables", "-t", "nat", "-D", "PREROUTING", "-m", "set", "!", "--match-set", fw.net4Name, "src", "-m", "set", "!", "--match-set", fw.host4Name, "src", "-m", "addrtype", "--dst-type", "LOCAL", "-j", fw.chainName)
-
-	// IPv6
-	fw.execCmd("ip6tables", "-t", "filter", "-D", "INPUT", "-m", "set", "!", "--match-set", fw.net6Name, "src", "-m", "set", "!", "--match-set", fw.host6Name, "src", "-j", fw.chainName)
-	fw.execCmd("ip6tables", "-t", "nat", "-D", "OUTPUT", "-m", "set", "!", "--match-set", fw.net6Name, "src", "-m", "set", "!", "--match-set", fw.host6Name, "src", "-m", "addrtype", "--dst-type", "LOCAL", "-j", fw.chainName)
-	fw.execCmd("ip6tables", "-t", "nat", "-D", "PREROUTING", "-m", "set", "!", "--match-set", fw.net6Name, "src", "-m", "set", "!", "--match-set", fw.host6Name, "src", "-m", "addrtype", "--dst-type", "LOCAL", "-j", fw.chainName)
-
-	// IPv4 chain
-	fw.execCmd("iptables", "-t", "nat", "-F", fw.chainName)
-	fw.execCmd("iptables", "-t", "nat", "-X", fw.chainName)
-	fw.execCmd("iptables", "-t", "filter", "-F", fw.chainName)
-	fw.execCmd("iptables", "-t", "filter", "-X", fw.chainName)
-	fw.execCmd("iptables", "-t", "filter", "-F", fw.denyName)
-	fw.execCmd("iptables", "-t", "filter", "-X", fw.denyName)
-
-	// IPv6 chain
-	fw.execCmd("ip6tables", "-t", "nat", "-F", fw.chainName)
-	fw.execCmd("ip6tables", "-t", "nat", "-X", fw.chainName)
-	fw.execCmd("ip6tables", "-t", "filter", "-F", fw.chainName)
-	fw.execCmd("ip6tables", "-t", "filter", "-X", fw.chainName)
-	fw.execCmd("ip6tables", "-t", "filter", "-F", fw.denyName)
-	fw.execCmd("ip6tables", "-t", "filter", "-X", fw.denyName)
-
-	// ipset
-	fw.execCmd("ipset", "destroy", fw.net4Name)
-	fw.execCmd("ipset", "destroy", fw.net6Name)
-	fw.execCmd("ipset", "destroy", fw.host4Name)
-	fw.execCmd("ipset", "destroy", fw.host6Name)
+	if !fw.conf.readOnly {
+		fw.backend.Teardown()
+	}
 
 	fw.cache.Stop()
 
@@ -422,36 +973,225 @@ func (fw *firewall) Stop(exitcode int) {
 }
 
 func (fw *firewall) doCleanup() {
+	if fw.cache.Shared() {
+		fw.syncShared()
+	}
+	fw.replayJournal(false)
 	now := time.Now().UTC()
-	fw.cache.Iter(func (addr net.IP, expires time.Time) bool {
-		return expires.Sub(now) <= 0
+	// One notification per subnet, not one per rule group
+	var expired []string
+	expiredGroups := make(map[string][]string)
+	// Events only for entries this instance removed, another one sharing the cache reports the rest
+	removed, _ := fw.cache.Iter(func (entry cacheEntry) bool {
+		return !entry.expires.IsZero() && fw.localExpiry(entry, now).Sub(now) <= 0
 	})
+	for _, entry := range removed {
+		fw.audit.Event(fw.conf.entryEvent("expire", entry.group), "client", entry.addr, "subnet", fw.Subnet(entry.addr), "group", entry.group, "expired", entry.expires)
+		subnet := fw.Subnet(entry.addr).String()
+		if _, ok := expiredGroups[subnet]; !ok {
+			expired = append(expired, subnet)
+		}
+		expiredGroups[subnet] = append(expiredGroups[subnet], entry.group)
+	}
+	for _, subnet := range expired {
+		fw.notify.Event("expire", fmt.Sprintf("Whitelist entry of %s expired", subnet), "subnet", subnet, "groups", expiredGroups[subnet])
+	}
+	fw.cache.CleanupBans(time.Duration(fw.conf.Daemon.HoneypotBanDuration) * time.Second)
+	unbanned, _ := fw.cache.CleanupFailures(time.Duration(fw.conf.Daemon.AuthFailureWindow) * time.Second)
+	for _, subnet := range unbanned {
+		if fw.conf.Daemon.Verbose >= 1 {
+			log.Printf("Rate limit: unbanned %s\n", subnet)
+		}
+		fw.audit.Event("unban", "subnet", subnet)
+	}
+	// Once reauth-after has passed, no entry lives longer than firewall-lifespan
+	if fw.conf.Daemon.ReauthAfter != 0 && *fw.conf.Daemon.FirewallLifespan != 0 {
+		fw.cache.CleanupAuthTimes(time.Duration(fw.conf.Daemon.ReauthAfter + *fw.conf.Daemon.FirewallLifespan) * time.Second, nil)
+	}
+	if *fw.conf.Daemon.CookieLifespan != 0 {
+		fw.cache.CleanupRevoked(time.Duration(*fw.conf.Daemon.CookieLifespan) * time.Second)
+	}
+	fw.syncLockdowns()
+	fw.cache.CleanupShares(now)
+	fw.cache.CleanupKeyChallenges(now)
+	fw.cache.CleanupAuthzVerdicts(now)
+	fw.cache.CleanupKnownSubnets(now.Add(-defenseKnownSubnetLifespan))
+	fw.cache.CleanupGrantedBy()
+	if m, ok := fw.cache.Maintenance(); ok && !now.Before(m.until) {
+		if m, ended, _ := fw.cache.EndMaintenance(now, false); ended {
+			log.Println("Maintenance mode ended")
+			fw.audit.Event("maintenance-off", "by", "expiry", "since", m.since)
+		}
+	}
+}
+
+// Drop every packet from the subnet of addr for timeout, with auth-ban-firewall
+func (fw *firewall) Ban(addr net.IP, timeout time.Duration) error {
+	if !fw.conf.Daemon.AuthBanFirewall || timeout < time.Second {
+		return nil
+	}
+	if addr.To4() != nil {
+		return fw.backend.AddElement(fw.ban4Name, addr, fw.conf.Daemon.IPv4Prefix, timeout)
+	}
+	return fw.backend.AddElement(fw.ban6Name, addr, fw.conf.Daemon.IPv6Prefix, timeout)
 }
 
 func (fw *firewall) doRestore() {
 	now := time.Now().UTC()
-	fw.cache.Iter(func (addr net.IP, expires time.Time) bool {
+	fw.cache.Iter(func (entry cacheEntry) bool {
+		addr, group, expires := entry.addr, entry.group, fw.localExpiry(entry, now)
+		if _, ok := fw.sets[group]; !ok {
+			// The rule group was removed from the configuration
+			return true
+		}
+		if expires.IsZero() {
+			if fw.ClampLifespan(0) != 0 || fw.conf.groupLifespan(group) != 0 {
+				// The configuration no longer lets it live forever, the user logs in again
+				return true
+			}
+			_, err := fw.InsertTimeout(addr, "", []string {group}, 0, false)
+			if err != nil { log.Println(err) }
+			return false
+		}
 		timeout := expires.Sub(now)
 		if timeout >= time.Second {
-			_, err := fw.InsertTimeout(addr, timeout, false)
+			_, err := fw.InsertTimeout(addr, "", []string {group}, timeout, false)
 			if err != nil { log.Println(err) }
 			return false
 		} else {
 			return true
 		}
 	})
+	fw.syncLockdowns()
+
+	if fw.conf.Daemon.AuthBanFirewall {
+		bans, err := fw.cache.FailureBans()
+		if err != nil { log.Println(err) }
+		for subnet, bannedUntil := range bans {
+			_, ipnet, err := net.ParseCIDR(subnet)
+			if err != nil { continue }
+			err = fw.Ban(ipnet.IP, bannedUntil.Sub(now))
+			if err != nil { log.Println(err) }
+		}
+	}
 }
 
-func (fw *firewall) execCmd(name string, arg ...string) error {
-	if fw.conf.Daemon.Verbose >= 1 {
-		log.Printf("Exec: %s %s\n", name, strings.Join(arg, " "))
+// Start ticker with deny-counter-interval, or stop it for good if that is 0
+func (fw *firewall) resetDenyTicker(ticker *time.Ticker) {
+	ticker.Stop()
+	if *fw.conf.Daemon.DenyCounterInterval != 0 {
+		ticker.Reset(time.Duration(*fw.conf.Daemon.DenyCounterInterval) * time.Second)
+	}
+}
+
+// Count the packets the deny rules stopped since the last call in the metrics and the cache database
+// A counter below its last value belongs to a rule inserted again by a reload, which counted from zero
+func (fw *firewall) recordDenied(now time.Time) {
+	counters, err := fw.backend.DenyCounters()
+	if err != nil {
+		log.Printf("Cannot read the deny rule counters: %s\n", err)
+		return
+	}
+	fw.denyMutex.Lock()
+	defer fw.denyMutex.Unlock()
+	hits := make(map[string]uint64)
+	for label, packets := range counters {
+		if last, ok := fw.denyCounters[label]; ok && packets >= last {
+			packets -= last
+		}
+		if packets != 0 {
+			hits[label] = packets
+		}
 	}
+	fw.denyCounters = counters
+	if len(hits) == 0 {
+		return
+	}
+	fw.metrics.Denied(hits)
+	err = fw.cache.AddDenied(hits, now)
+	if err != nil {
+		log.Printf("Cannot record denied packets: %s\n", err)
+	}
+}
+
+// Name a deny rule by what it protects, like "tcp/22", "tcp/80,8000-8080" or "udp/53 192.0.2.1"
+func denyLabel(proto, ports, dest string) string {
+	switch proto {
+	case "6":
+		proto = "tcp"
+	case "17":
+		proto = "udp"
+	}
+	label := proto + "/" + strings.Replace(ports, ":", "-", -1)
+	dest = strings.TrimSuffix(strings.TrimSuffix(dest, "/32"), "/128")
+	if dest != "" && dest != "0.0.0.0/0" && dest != "::/0" {
+		label += " " + dest
+	}
+	return label
+}
+
+func (fw *firewall) execCmd(op string, name string, arg ...string) error {
+	cmd := exec.Command(name, arg...)
+	cmd.Stdout = os.Stdout
+	return fw.runCmd(op, cmd)
+}
+
+// Run a command like execCmd, feeding it input
+func (fw *firewall) inputCmd(op string, input string, name string, arg ...string) error {
 	cmd := exec.Command(name, arg...)
+	cmd.Stdin = strings.NewReader(input)
 	cmd.Stdout = os.Stdout
+	return fw.runCmd(op, cmd)
+}
+
+// Run a command like execCmd, returning its output instead of passing it on
+func (fw *firewall) outputCmd(op string, name string, arg ...string) ([]byte, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(name, arg...)
+	cmd.Stdout = &out
+	err := fw.runCmd(op, cmd)
+	return out.Bytes(), err
+}
+
+var errFirewallReadOnly = errors.New("firewall is not changed with -read-only")
+
+func (fw *firewall) runCmd(op string, cmd *exec.Cmd) error {
+	name, arg := cmd.Args[0], cmd.Args[1:]
+	if fw.conf.readOnly {
+		return errFirewallReadOnly
+	}
+	if fw.conf.Daemon.Verbose >= 1 {
+		log.Printf("Exec: %s %s\n", name, strings.Join(arg, " "))
+	}
 	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	run := (*exec.Cmd).Run
+	if fw.runner != nil {
+		run = fw.runner
+	}
+	start := time.Now()
+	err := run(cmd)
+	elapsed := time.Since(start)
+	fw.metrics.FirewallOp(op, err)
+	fw.metrics.FirewallDuration(op, commandFamily(name), elapsed)
+	if err != nil {
+		fw.audit.Event("firewall-error", "op", op, "command", name + " " + strings.Join(arg, " "), "error", err)
+	}
+	if *fw.conf.Daemon.FirewallSlowThreshold != 0 && elapsed >= time.Duration(*fw.conf.Daemon.FirewallSlowThreshold) * time.Millisecond {
+		log.Printf("Slow firewall command (op=%s family=%s) took %s: %s %s\n", op, commandFamily(name), elapsed, name, strings.Join(arg, " "))
+	}
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+func commandFamily(name string) string {
+	switch name {
+	case "iptables":
+		return "ipv4"
+	case "ip6tables":
+		return "ipv6"
+	default:
+		return name
+	}
+}
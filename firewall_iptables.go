@@ -0,0 +1,803 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Firewall backend using iptables, ip6tables and ipset
+type iptablesBackend struct {
+	fw		*firewall
+}
+
+func (b *iptablesBackend) Check() error {
+	for _, name := range []string {"iptables", "ip6tables", "ipset"} {
+		_, err := exec.LookPath(name)
+		if err != nil {
+			return &configError { fmt.Sprintf("firewall-backend \"iptables\" requires %q: %s\n", name, err) }
+		}
+	}
+	return nil
+}
+
+func (b *iptablesBackend) Setup() error {
+	var err error
+
+	// ipset
+	// Sets always carry a timeout so that individual entries may expire earlier than firewall-lifespan, a timeout of 0 adds entries permanently
+	for group := range b.fw.sets {
+		err = b.createSets("chain-init", group)
+		if err != nil { return err }
+	}
+
+	if b.fw.conf.Daemon.AuthBanFirewall {
+		err = b.fw.execCmd("chain-init", "ipset", "-exist", "create", b.fw.ban4Name, "hash:ip", "family", "inet", "netmask", strconv.FormatUint(uint64(b.fw.conf.Daemon.IPv4Prefix), 10), "timeout", "0")
+		if err != nil { return err }
+		err = b.fw.execCmd("chain-init", "ipset", "-exist", "create", b.fw.ban6Name, "hash:ip", "family", "inet6", "netmask", strconv.FormatUint(uint64(b.fw.conf.Daemon.IPv6Prefix), 10), "timeout", "0")
+		if err != nil { return err }
+		for _, setName := range []string {b.fw.ban4Name, b.fw.ban6Name} {
+			err = b.fw.execCmd("chain-init", "ipset", "flush", setName)
+			if err != nil { return err }
+		}
+	}
+
+	// IPv4 deny
+	b.fw.execCmd("chain-init", "iptables", "-t", "filter", "-N", b.fw.denyName)
+	denyRules := b.denyRules(b.fw.conf.Daemon.FirewallDenyMethod, false)
+	for i := len(denyRules) - 1; i >= 0; i-- {
+		err = b.fw.execCmd("chain-init", "iptables", append([]string {"-t", "filter", "-I", b.fw.denyName}, denyRules[i]...)...)
+		if err != nil { return err }
+	}
+	err = b.fw.execCmd("chain-init", "iptables", "-t", "filter", "-I", b.fw.denyName, "-m", "limit", "--limit", "3/min", "-j", "LOG", "--log-prefix", "[PORTKNOB-DENY] ")
+	if err != nil { return err }
+	b.fw.execCmd("chain-init", "iptables", "-t", "filter", "-N", b.fw.chainName)
+	err = b.fw.execCmd("chain-init", "iptables", "-t", "filter", "-I", b.fw.chainName, "-j", "RETURN")
+	if err != nil { return err }
+
+	// IPv4 redir
+	b.fw.execCmd("chain-init", "iptables", "-t", "nat", "-N", b.fw.chainName)
+	err = b.fw.execCmd("chain-init", "iptables", "-t", "nat", "-I", b.fw.chainName, "-j", "RETURN")
+	if err != nil { return err }
+
+	// IPv6 deny
+	b.fw.execCmd("chain-init", "ip6tables", "-t", "filter", "-N", b.fw.denyName)
+	denyRules = b.denyRules(b.fw.conf.Daemon.FirewallDenyMethod, true)
+	for i := len(denyRules) - 1; i >= 0; i-- {
+		err = b.fw.execCmd("chain-init", "ip6tables", append([]string {"-t", "filter", "-I", b.fw.denyName}, denyRules[i]...)...)
+		if err != nil { return err }
+	}
+	err = b.fw.execCmd("chain-init", "ip6tables", "-t", "filter", "-I", b.fw.denyName, "-m", "limit", "--limit", "3/min", "-j", "LOG", "--log-prefix", "[PORTKNOB-DENY] ")
+	if err != nil { return err }
+	b.fw.execCmd("chain-init", "ip6tables", "-t", "filter", "-N", b.fw.chainName)
+	err = b.fw.execCmd("chain-init", "ip6tables", "-t", "filter", "-I", b.fw.chainName, "-j", "RETURN")
+	if err != nil { return err }
+
+	// IPv6 redir
+	b.fw.execCmd("chain-init", "ip6tables", "-t", "nat", "-N", b.fw.chainName)
+	err = b.fw.execCmd("chain-init", "ip6tables", "-t", "nat", "-I", b.fw.chainName, "-j", "RETURN")
+	if err != nil { return err }
+
+	b.generateRules(b.fw.conf.Firewall, "-I", "chain-init")
+
+	// Activate
+	err = b.fw.execCmd("chain-init", "iptables", b.jumpArgs("filter", "-I", "INPUT", false)...)
+	if err != nil { return err }
+	err = b.fw.execCmd("chain-init", "iptables", b.jumpArgs("nat", "-I", "OUTPUT", false)...)
+	if err != nil { return err }
+	err = b.fw.execCmd("chain-init", "iptables", b.jumpArgs("nat", "-I", "PREROUTING", false)...)
+	if err != nil { return err }
+	err = b.fw.execCmd("chain-init", "ip6tables", b.jumpArgs("filter", "-I", "INPUT", true)...)
+	if err != nil { return err }
+	err = b.fw.execCmd("chain-init", "ip6tables", b.jumpArgs("nat", "-I", "OUTPUT", true)...)
+	if err != nil { return err }
+	err = b.fw.execCmd("chain-init", "ip6tables", b.jumpArgs("nat", "-I", "PREROUTING", true)...)
+	if err != nil { return err }
+
+	// Bans go above the jumps, whitelisted sources are dropped too
+	if b.fw.conf.Daemon.AuthBanFirewall {
+		err = b.fw.execCmd("chain-init", "iptables", b.banArgs("-I", false)...)
+		if err != nil { return err }
+		err = b.fw.execCmd("chain-init", "ip6tables", b.banArgs("-I", true)...)
+		if err != nil { return err }
+	}
+
+	return nil
+}
+
+// Create the four ipsets of group, empty
+// With probation or auto-rekey-ipv6, the sets count the traffic of their elements
+func (b *iptablesBackend) createSets(op string, group string) error {
+	sets := b.fw.sets[group]
+	defaultTimeout := strconv.FormatUint(b.fw.conf.groupLifespan(group), 10)
+	var counters []string
+	if b.fw.conf.groupCounters(group) {
+		counters = []string {"counters"}
+	}
+	err := b.fw.execCmd(op, "ipset", append([]string {"-exist", "create", sets.net4Name, "hash:ip", "family", "inet", "netmask", strconv.FormatUint(uint64(b.fw.conf.Daemon.IPv4Prefix), 10), "timeout", defaultTimeout}, counters...)...)
+	if err != nil { return err }
+	err = b.fw.execCmd(op, "ipset", append([]string {"-exist", "create", sets.net6Name, "hash:ip", "family", "inet6", "netmask", strconv.FormatUint(uint64(b.fw.conf.Daemon.IPv6Prefix), 10), "timeout", defaultTimeout}, counters...)...)
+	if err != nil { return err }
+	err = b.fw.execCmd(op, "ipset", append([]string {"-exist", "create", sets.host4Name, "hash:ip", "family", "inet", "timeout", defaultTimeout}, counters...)...)
+	if err != nil { return err }
+	err = b.fw.execCmd(op, "ipset", append([]string {"-exist", "create", sets.host6Name, "hash:ip", "family", "inet6", "timeout", defaultTimeout}, counters...)...)
+	if err != nil { return err }
+	setNames := []string {sets.net4Name, sets.net6Name, sets.host4Name, sets.host6Name}
+	if sets.lockdown {
+		err = b.fw.execCmd(op, "ipset", "-exist", "create", sets.lock4Name, "hash:net", "family", "inet", "timeout", "0")
+		if err != nil { return err }
+		err = b.fw.execCmd(op, "ipset", "-exist", "create", sets.lock6Name, "hash:net", "family", "inet6", "timeout", "0")
+		if err != nil { return err }
+		setNames = append(setNames, sets.lock4Name, sets.lock6Name)
+	}
+	// Entries left behind by an unclean shutdown are not tracked by the cache, doRestore will add back the tracked ones
+	for _, setName := range setNames {
+		err = b.fw.execCmd(op, "ipset", "flush", setName)
+		if err != nil { return err }
+	}
+	return nil
+}
+
+func (b *iptablesBackend) AddSets(group string) error {
+	return b.createSets("chain-reload", group)
+}
+
+func (b *iptablesBackend) DelSets(sets *firewallSets) {
+	setNames := []string {sets.net4Name, sets.net6Name, sets.host4Name, sets.host6Name}
+	if sets.lockdown {
+		setNames = append(setNames, sets.lock4Name, sets.lock6Name)
+	}
+	for _, setName := range setNames {
+		b.fw.execCmd("chain-reload", "ipset", "destroy", setName)
+	}
+}
+
+// Arguments of the rule dropping rate limited sources
+func (b *iptablesBackend) banArgs(op string, ipv6 bool) []string {
+	setName := b.fw.ban4Name
+	if ipv6 {
+		setName = b.fw.ban6Name
+	}
+	return []string {"-t", "filter", op, "INPUT", "-m", "set", "--match-set", setName, "src", "-j", "DROP"}
+}
+
+// Rules of the deny chain after the LOG rule for method, from top to bottom
+func (b *iptablesBackend) denyRules(method string, ipv6 bool) [][]string {
+	if method == "drop" {
+		return [][]string {{"-j", "DROP"}}
+	}
+	icmp := "icmp-port-unreachable"
+	if ipv6 {
+		icmp = "icmp6-port-unreachable"
+	}
+	return [][]string {{"-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset"}, {"-j", "REJECT", "--reject-with", icmp}}
+}
+
+// Apply a reloaded configuration, inserting new rules before deleting old ones so nothing is let through in between
+func (b *iptablesBackend) Reconcile(oldConf *config, added, removed []configFirewall) error {
+	if oldConf.Daemon.FirewallDenyMethod != b.fw.conf.Daemon.FirewallDenyMethod {
+		for _, ipv6 := range []bool {false, true} {
+			name := "iptables"
+			if ipv6 {
+				name = "ip6tables"
+			}
+			// Right below the LOG rule
+			newRules := b.denyRules(b.fw.conf.Daemon.FirewallDenyMethod, ipv6)
+			for i := len(newRules) - 1; i >= 0; i-- {
+				err := b.fw.execCmd("chain-reload", name, append([]string {"-t", "filter", "-I", b.fw.denyName, "2"}, newRules[i]...)...)
+				if err != nil { return err }
+			}
+			for _, rule := range b.denyRules(oldConf.Daemon.FirewallDenyMethod, ipv6) {
+				err := b.fw.execCmd("chain-reload", name, append([]string {"-t", "filter", "-D", b.fw.denyName}, rule...)...)
+				if err != nil { return err }
+			}
+		}
+	}
+	b.generateRules(added, "-I", "chain-reload")
+	b.generateRules(removed, "-D", "chain-reload")
+	return nil
+}
+
+// Arguments of a rule jumping from a builtin chain to our chain
+// Without rule groups whitelisted sources skip the chain, otherwise every rule in the chain matches its own group
+func (b *iptablesBackend) jumpArgs(table, op, builtin string, ipv6 bool) []string {
+	args := []string {"-t", table, op, builtin}
+	if len(b.fw.groups) == 0 {
+		args = append(args, b.setMatch("", ipv6)...)
+	}
+	if table == "nat" {
+		args = append(args, "-m", "addrtype", "--dst-type", "LOCAL")
+	}
+	return append(args, "-j", b.fw.chainName)
+}
+
+// Match sources not whitelisted for group, only while its lockdown is engaged for lockdown groups
+func (b *iptablesBackend) setMatch(group string, ipv6 bool) []string {
+	sets := b.fw.sets[group]
+	var lock []string
+	if ipv6 {
+		if sets.lockdown {
+			lock = []string {"-m", "set", "--match-set", sets.lock6Name, "src"}
+		}
+		return append(lock, "-m", "set", "!", "--match-set", sets.net6Name, "src", "-m", "set", "!", "--match-set", sets.host6Name, "src")
+	}
+	if sets.lockdown {
+		lock = []string {"-m", "set", "--match-set", sets.lock4Name, "src"}
+	}
+	return append(lock, "-m", "set", "!", "--match-set", sets.net4Name, "src", "-m", "set", "!", "--match-set", sets.host4Name, "src")
+}
+
+// Insert ("-I") or delete ("-D") the chain rules of rules
+func (b *iptablesBackend) generateRules(rules []configFirewall, action string, op string) {
+	for i := 0; i < len(rules); i++ {
+		rule := &rules[len(rules) - i - 1]
+		for _, clause_ports := range portClauses(rule) {
+			b.generateRule(rule, clause_ports, action, op)
+		}
+	}
+}
+
+// Port matches of a rule, one per generated rule as a multiport match holds at most 15 ports
+func portClauses(rule *configFirewall) [][]string {
+	dports := portMatches("--dport", "--dports", rule.destPorts)
+	sports := [][]string {nil}
+	if len(rule.sourcePorts) != 0 {
+		sports = portMatches("--sport", "--sports", rule.sourcePorts)
+	}
+	clauses := make([][]string, 0, len(dports) * len(sports))
+	for _, dport := range dports {
+		for _, sport := range sports {
+			// Single port options belong to the protocol match, keep them right after it
+			clause := make([]string, 0, len(dport) + len(sport))
+			if len(dport) == 2 {
+				clause = append(clause, dport...)
+				clause = append(clause, sport...)
+			} else {
+				clause = append(clause, sport...)
+				clause = append(clause, dport...)
+			}
+			clauses = append(clauses, clause)
+		}
+	}
+	return clauses
+}
+
+// A multiport match counts a range as two ports
+const multiportLimit = 15
+
+func portMatches(single, multi string, ranges []portRange) [][]string {
+	if len(ranges) == 1 {
+		return [][]string {{single, ranges[0].format(":")}}
+	}
+	var matches [][]string
+	var elems []string
+	slots := 0
+	for _, r := range ranges {
+		n := 1
+		if r.first != r.last {
+			n = 2
+		}
+		if slots + n > multiportLimit {
+			matches = append(matches, []string {"-m", "multiport", multi, strings.Join(elems, ",")})
+			elems = nil
+			slots = 0
+		}
+		elems = append(elems, r.format(":"))
+		slots += n
+	}
+	matches = append(matches, []string {"-m", "multiport", multi, strings.Join(elems, ",")})
+	return matches
+}
+
+func (b *iptablesBackend) generateRule(rule *configFirewall, clause_ports []string, action string, op string) {
+	var rule_ipv4 bool
+	var rule_ipv6 bool
+	if rule.Dest == "" {
+		rule_ipv4 = true
+		rule_ipv6 = true
+	} else {
+		rule_ipv4 = rule.DestIP.To4() != nil
+		rule_ipv6 = !rule_ipv4
+	}
+
+	clause_filter := []string {"-t", "filter"}
+	clause_nat := []string {"-t", "nat"}
+	clause_chain := []string {action, b.fw.chainName}
+	var clause_set4, clause_set6 []string
+	if len(b.fw.groups) != 0 {
+		clause_set4 = b.setMatch(rule.Group, false)
+		clause_set6 = b.setMatch(rule.Group, true)
+	}
+	var clause_dest []string
+	if rule.Dest != "" {
+		clause_dest = []string {"-d", rule.Dest}
+	}
+	clause_tcp := []string {"-p", "tcp", "-m", "tcp"}
+	clause_udp := []string {"-p", "udp", "-m", "udp"}
+	var clause_comment []string
+	if rule.Comment != "" {
+		clause_comment = []string {"-m", "comment", "--comment", rule.Comment}
+	}
+	clause_deny := []string {"-j", b.fw.denyName}
+	var clause_renew4, clause_renew6 [][]string
+	if rule.Sliding {
+		// Whitelisted sources matching the rule are added again, which puts their entry back to the full lifespan
+		timeout := strconv.FormatUint(*rule.Lifespan, 10)
+		sets := b.fw.sets[rule.Group]
+		if rule_ipv4 {
+			for _, setName := range []string {sets.net4Name, sets.host4Name} {
+				clause_renew4 = append(clause_renew4, []string {"-m", "set", "--match-set", setName, "src", "-j", "SET", "--add-set", setName, "src", "--exist", "--timeout", timeout})
+			}
+		}
+		if rule_ipv6 {
+			for _, setName := range []string {sets.net6Name, sets.host6Name} {
+				clause_renew6 = append(clause_renew6, []string {"-m", "set", "--match-set", setName, "src", "-j", "SET", "--add-set", setName, "src", "--exist", "--timeout", timeout})
+			}
+		}
+	}
+	clause_redir := []string {"-j", "DNAT", "--to-destination", rule.Redir}
+	clause_log := []string {"-m", "limit", "--limit", "3/min", "-j", "LOG", "--log-prefix", "[PORTKNOB-REDIR] "}
+
+	// Deny
+	if rule_ipv4 {
+		if rule.Proto == "udp" || rule.Proto == "" {
+			args := make([]string, 0, 30)
+			args = append(args, clause_filter...)
+			args = append(args, clause_chain...)
+			args = append(args, clause_set4...)
+			args = append(args, clause_dest...)
+			args = append(args, clause_udp...)
+			args = append(args, clause_ports...)
+			args = append(args, clause_comment...)
+			args = append(args, clause_deny...)
+			err := b.fw.execCmd(op, "iptables", args...)
+			if err != nil { log.Println(err) }
+		}
+		if rule.Proto == "tcp" || rule.Proto == "" {
+			args := make([]string, 0, 30)
+			args = append(args, clause_filter...)
+			args = append(args, clause_chain...)
+			args = append(args, clause_set4...)
+			args = append(args, clause_dest...)
+			args = append(args, clause_tcp...)
+			args = append(args, clause_ports...)
+			args = append(args, clause_comment...)
+			args = append(args, clause_deny...)
+			err := b.fw.execCmd(op, "iptables", args...)
+			if err != nil { log.Println(err) }
+		}
+	}
+	if rule_ipv6 {
+		if rule.Proto == "udp" || rule.Proto == "" {
+			args := make([]string, 0, 30)
+			args = append(args, clause_filter...)
+			args = append(args, clause_chain...)
+			args = append(args, clause_set6...)
+			args = append(args, clause_dest...)
+			args = append(args, clause_udp...)
+			args = append(args, clause_ports...)
+			args = append(args, clause_comment...)
+			args = append(args, clause_deny...)
+			err := b.fw.execCmd(op, "ip6tables", args...)
+			if err != nil { log.Println(err) }
+		}
+		if rule.Proto == "tcp" || rule.Proto == "" {
+			args := make([]string, 0, 30)
+			args = append(args, clause_filter...)
+			args = append(args, clause_chain...)
+			args = append(args, clause_set6...)
+			args = append(args, clause_dest...)
+			args = append(args, clause_tcp...)
+			args = append(args, clause_ports...)
+			args = append(args, clause_comment...)
+			args = append(args, clause_deny...)
+			err := b.fw.execCmd(op, "ip6tables", args...)
+			if err != nil { log.Println(err) }
+		}
+	}
+
+	// Renew
+	for _, clause_renew := range clause_renew4 {
+		if rule.Proto == "udp" || rule.Proto == "" {
+			args := make([]string, 0, 36)
+			args = append(args, clause_filter...)
+			args = append(args, clause_chain...)
+			args = append(args, clause_dest...)
+			args = append(args, clause_udp...)
+			args = append(args, clause_ports...)
+			args = append(args, clause_comment...)
+			args = append(args, clause_renew...)
+			err := b.fw.execCmd(op, "iptables", args...)
+			if err != nil { log.Println(err) }
+		}
+		if rule.Proto == "tcp" || rule.Proto == "" {
+			args := make([]string, 0, 36)
+			args = append(args, clause_filter...)
+			args = append(args, clause_chain...)
+			args = append(args, clause_dest...)
+			args = append(args, clause_tcp...)
+			args = append(args, clause_ports...)
+			args = append(args, clause_comment...)
+			args = append(args, clause_renew...)
+			err := b.fw.execCmd(op, "iptables", args...)
+			if err != nil { log.Println(err) }
+		}
+	}
+	for _, clause_renew := range clause_renew6 {
+		if rule.Proto == "udp" || rule.Proto == "" {
+			args := make([]string, 0, 36)
+			args = append(args, clause_filter...)
+			args = append(args, clause_chain...)
+			args = append(args, clause_dest...)
+			args = append(args, clause_udp...)
+			args = append(args, clause_ports...)
+			args = append(args, clause_comment...)
+			args = append(args, clause_renew...)
+			err := b.fw.execCmd(op, "ip6tables", args...)
+			if err != nil { log.Println(err) }
+		}
+		if rule.Proto == "tcp" || rule.Proto == "" {
+			args := make([]string, 0, 36)
+			args = append(args, clause_filter...)
+			args = append(args, clause_chain...)
+			args = append(args, clause_dest...)
+			args = append(args, clause_tcp...)
+			args = append(args, clause_ports...)
+			args = append(args, clause_comment...)
+			args = append(args, clause_renew...)
+			err := b.fw.execCmd(op, "ip6tables", args...)
+			if err != nil { log.Println(err) }
+		}
+	}
+
+	// Redirect
+	if rule.Redir != "" {
+		if rule_ipv4 {
+			if rule.Proto == "udp" || rule.Proto == "" {
+				args := make([]string, 0, 32)
+				args = append(args, clause_nat...)
+				args = append(args, clause_chain...)
+				args = append(args, clause_set4...)
+				args = append(args, clause_dest...)
+				args = append(args, clause_udp...)
+				args = append(args, clause_ports...)
+				args = append(args, clause_comment...)
+				args = append(args, clause_redir...)
+				err := b.fw.execCmd(op, "iptables", args...)
+				if err != nil { log.Println(err) }
+				args = make([]string, 0, 36)
+				args = append(args, clause_nat...)
+				args = append(args, clause_chain...)
+				args = append(args, clause_set4...)
+				args = append(args, clause_dest...)
+				args = append(args, clause_udp...)
+				args = append(args, clause_ports...)
+				args = append(args, clause_comment...)
+				args = append(args, clause_log...)
+				err = b.fw.execCmd(op, "iptables", args...)
+				if err != nil { log.Println(err) }
+			}
+			if rule.Proto == "tcp" || rule.Proto == "" {
+				args := make([]string, 0, 32)
+				args = append(args, clause_nat...)
+				args = append(args, clause_chain...)
+				args = append(args, clause_set4...)
+				args = append(args, clause_dest...)
+				args = append(args, clause_tcp...)
+				args = append(args, clause_ports...)
+				args = append(args, clause_comment...)
+				args = append(args, clause_redir...)
+				err := b.fw.execCmd(op, "iptables", args...)
+				if err != nil { log.Println(err) }
+				args = make([]string, 0, 36)
+				args = append(args, clause_nat...)
+				args = append(args, clause_chain...)
+				args = append(args, clause_set4...)
+				args = append(args, clause_dest...)
+				args = append(args, clause_tcp...)
+				args = append(args, clause_ports...)
+				args = append(args, clause_comment...)
+				args = append(args, clause_log...)
+				err = b.fw.execCmd(op, "iptables", args...)
+				if err != nil { log.Println(err) }
+			}
+		}
+		if rule_ipv6 {
+			if rule.Proto == "udp" || rule.Proto == "" {
+				args := make([]string, 0, 32)
+				args = append(args, clause_nat...)
+				args = append(args, clause_chain...)
+				args = append(args, clause_set6...)
+				args = append(args, clause_dest...)
+				args = append(args, clause_udp...)
+				args = append(args, clause_ports...)
+				args = append(args, clause_comment...)
+				args = append(args, clause_redir...)
+				err := b.fw.execCmd(op, "ip6tables", args...)
+				if err != nil { log.Println(err) }
+				args = make([]string, 0, 36)
+				args = append(args, clause_nat...)
+				args = append(args, clause_chain...)
+				args = append(args, clause_set6...)
+				args = append(args, clause_dest...)
+				args = append(args, clause_udp...)
+				args = append(args, clause_ports...)
+				args = append(args, clause_comment...)
+				args = append(args, clause_log...)
+				err = b.fw.execCmd(op, "ip6tables", args...)
+				if err != nil { log.Println(err) }
+			}
+			if rule.Proto == "tcp" || rule.Proto == "" {
+				args := make([]string, 0, 32)
+				args = append(args, clause_nat...)
+				args = append(args, clause_chain...)
+				args = append(args, clause_set6...)
+				args = append(args, clause_dest...)
+				args = append(args, clause_tcp...)
+				args = append(args, clause_ports...)
+				args = append(args, clause_comment...)
+				args = append(args, clause_redir...)
+				err := b.fw.execCmd(op, "ip6tables", args...)
+				if err != nil { log.Println(err) }
+				args = make([]string, 0, 36)
+				args = append(args, clause_nat...)
+				args = append(args, clause_chain...)
+				args = append(args, clause_set6...)
+				args = append(args, clause_dest...)
+				args = append(args, clause_tcp...)
+				args = append(args, clause_ports...)
+				args = append(args, clause_comment...)
+				args = append(args, clause_log...)
+				err = b.fw.execCmd(op, "ip6tables", args...)
+				if err != nil { log.Println(err) }
+			}
+		}
+	}
+}
+
+func (b *iptablesBackend) Teardown() {
+	if b.fw.conf.Daemon.AuthBanFirewall {
+		b.fw.execCmd("chain-cleanup", "iptables", b.banArgs("-D", false)...)
+		b.fw.execCmd("chain-cleanup", "ip6tables", b.banArgs("-D", true)...)
+	}
+
+	// IPv4
+	b.fw.execCmd("chain-cleanup", "iptables", b.jumpArgs("filter", "-D", "INPUT", false)...)
+	b.fw.execCmd("chain-cleanup", "iptables", b.jumpArgs("nat", "-D", "OUTPUT", false)...)
+	b.fw.execCmd("chain-cleanup", "iptables", b.jumpArgs("nat", "-D", "PREROUTING", false)...)
+
+	// IPv6
+	b.fw.execCmd("chain-cleanup", "ip6tables", b.jumpArgs("filter", "-D", "INPUT", true)...)
+	b.fw.execCmd("chain-cleanup", "ip6tables", b.jumpArgs("nat", "-D", "OUTPUT", true)...)
+	b.fw.execCmd("chain-cleanup", "ip6tables", b.jumpArgs("nat", "-D", "PREROUTING", true)...)
+
+	// IPv4 chain
+	b.fw.execCmd("chain-cleanup", "iptables", "-t", "nat", "-F", b.fw.chainName)
+	b.fw.execCmd("chain-cleanup", "iptables", "-t", "nat", "-X", b.fw.chainName)
+	b.fw.execCmd("chain-cleanup", "iptables", "-t", "filter", "-F", b.fw.chainName)
+	b.fw.execCmd("chain-cleanup", "iptables", "-t", "filter", "-X", b.fw.chainName)
+	b.fw.execCmd("chain-cleanup", "iptables", "-t", "filter", "-F", b.fw.denyName)
+	b.fw.execCmd("chain-cleanup", "iptables", "-t", "filter", "-X", b.fw.denyName)
+
+	// IPv6 chain
+	b.fw.execCmd("chain-cleanup", "ip6tables", "-t", "nat", "-F", b.fw.chainName)
+	b.fw.execCmd("chain-cleanup", "ip6tables", "-t", "nat", "-X", b.fw.chainName)
+	b.fw.execCmd("chain-cleanup", "ip6tables", "-t", "filter", "-F", b.fw.chainName)
+	b.fw.execCmd("chain-cleanup", "ip6tables", "-t", "filter", "-X", b.fw.chainName)
+	b.fw.execCmd("chain-cleanup", "ip6tables", "-t", "filter", "-F", b.fw.denyName)
+	b.fw.execCmd("chain-cleanup", "ip6tables", "-t", "filter", "-X", b.fw.denyName)
+
+	// ipset
+	for _, sets := range b.fw.sets {
+		b.fw.execCmd("chain-cleanup", "ipset", "destroy", sets.net4Name)
+		b.fw.execCmd("chain-cleanup", "ipset", "destroy", sets.net6Name)
+		b.fw.execCmd("chain-cleanup", "ipset", "destroy", sets.host4Name)
+		b.fw.execCmd("chain-cleanup", "ipset", "destroy", sets.host6Name)
+	}
+	if b.fw.conf.Daemon.AuthBanFirewall {
+		b.fw.execCmd("chain-cleanup", "ipset", "destroy", b.fw.ban4Name)
+		b.fw.execCmd("chain-cleanup", "ipset", "destroy", b.fw.ban6Name)
+	}
+}
+
+func (b *iptablesBackend) AddElement(setName string, addr net.IP, prefix uint, timeout time.Duration) error {
+	cmd := b.ElementCommand(setName, addr, prefix, timeout)
+	return b.fw.execCmd("grant-insert", cmd[0], cmd[1:]...)
+}
+
+func (b *iptablesBackend) ElementCommand(setName string, addr net.IP, prefix uint, timeout time.Duration) []string {
+	if timeout != 0 {
+		return []string {"ipset", "-exist", "add", setName, addr.String(), "timeout", strconv.FormatUint(uint64(timeout / time.Second), 10)}
+	}
+	return []string {"ipset", "-exist", "add", setName, addr.String()}
+}
+
+func (b *iptablesBackend) DelElement(op string, setName string, addr net.IP, prefix uint) error {
+	return b.fw.execCmd(op, "ipset", "-exist", "del", setName, addr.String())
+}
+
+// One ipset restore instead of an ipset del per element
+func (b *iptablesBackend) DelElements(op string, elements []firewallElement) error {
+	var input strings.Builder
+	for _, element := range elements {
+		fmt.Fprintf(&input, "del %s %s\n", element.setName, element.addr)
+	}
+	return b.fw.inputCmd(op, input.String(), "ipset", "-exist", "restore")
+}
+
+// One ipset restore filling both lock sets, adding an element again updates its timeout
+func (b *iptablesBackend) AddLockdown(sets *firewallSets, timeout time.Duration) error {
+	var input strings.Builder
+	for _, half := range lockdownHalves4 {
+		fmt.Fprintf(&input, "add %s %s timeout %d\n", sets.lock4Name, half, timeout / time.Second)
+	}
+	for _, half := range lockdownHalves6 {
+		fmt.Fprintf(&input, "add %s %s timeout %d\n", sets.lock6Name, half, timeout / time.Second)
+	}
+	return b.fw.inputCmd("lockdown", input.String(), "ipset", "-exist", "restore")
+}
+
+func (b *iptablesBackend) DelLockdown(sets *firewallSets) error {
+	err := b.fw.execCmd("lockdown", "ipset", "flush", sets.lock4Name)
+	if err != nil { return err }
+	return b.fw.execCmd("lockdown", "ipset", "flush", sets.lock6Name)
+}
+
+func (b *iptablesBackend) ElementBytes(setName string) (map[string]uint64, error) {
+	out, err := b.fw.outputCmd("probation", "ipset", "save", setName)
+	if err != nil { return nil, err }
+	return parseIpsetBytes(out), nil
+}
+
+// The byte counters of the elements in the output of "ipset save", by address
+func parseIpsetBytes(out []byte) map[string]uint64 {
+	counters := make(map[string]uint64)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "add" {
+			continue
+		}
+		for i := 3; i + 1 < len(fields); i++ {
+			if fields[i] == "bytes" {
+				counters[fields[2]], _ = strconv.ParseUint(fields[i + 1], 10, 64)
+			}
+		}
+	}
+	return counters
+}
+
+func (b *iptablesBackend) DenyCounters() (map[string]uint64, error) {
+	counters := make(map[string]uint64)
+	for _, name := range []string {"iptables", "ip6tables"} {
+		out, err := b.fw.outputCmd("deny-counters", name, "-t", "filter", "-L", b.fw.chainName, "-v", "-x", "-n")
+		if err != nil { return nil, err }
+		for label, packets := range parseIptablesCounters(out, b.fw.denyName) {
+			counters[label] += packets
+		}
+	}
+	return counters, nil
+}
+
+// Sum the packet counters of the rules jumping to denyName by denyLabel
+// Takes the table of "iptables -L -v -x -n", whose opt column ip6tables leaves out and newer versions print protocols of by number, or the rules of "iptables -S -v" and "iptables-save -c"
+func parseIptablesCounters(out []byte, denyName string) map[string]uint64 {
+	counters := make(map[string]uint64)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var label, target string
+		var packets uint64
+		var ok bool
+		if fields[0] == "-A" || strings.HasPrefix(fields[0], "[") {
+			label, target, packets, ok = parseIptablesSpec(fields)
+		} else {
+			label, target, packets, ok = parseIptablesListing(fields)
+		}
+		if ok && target == denyName {
+			counters[label] += packets
+		}
+	}
+	return counters
+}
+
+func parseIptablesListing(fields []string) (label, target string, packets uint64, ok bool) {
+	if len(fields) < 8 {
+		return
+	}
+	packets, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		// Chain and column headers
+		return
+	}
+	target, proto := fields[2], fields[3]
+	rest := fields[4:]
+	if rest[0] == "--" || rest[0] == "-f" || rest[0] == "!f" {
+		rest = rest[1:]
+	}
+	if len(rest) < 4 {
+		return
+	}
+	dest := rest[3]
+	var ports string
+	extra := rest[4:]
+	for i := 0; i < len(extra); i++ {
+		switch {
+		case extra[i] == "/*":
+			for i < len(extra) && extra[i] != "*/" {
+				i++
+			}
+		case strings.HasPrefix(extra[i], "dpt:"):
+			ports = extra[i][4:]
+		case strings.HasPrefix(extra[i], "dpts:"):
+			ports = extra[i][5:]
+		case extra[i] == "dports" && i + 1 < len(extra):
+			ports = extra[i + 1]
+		}
+	}
+	return denyLabel(proto, ports, dest), target, packets, true
+}
+
+func parseIptablesSpec(fields []string) (label, target string, packets uint64, ok bool) {
+	var proto, ports, dest string
+	var err error
+	if strings.HasPrefix(fields[0], "[") {
+		counters := strings.SplitN(strings.Trim(fields[0], "[]"), ":", 2)
+		packets, err = strconv.ParseUint(counters[0], 10, 64)
+		if err != nil {
+			return
+		}
+		fields = fields[1:]
+	}
+	for i := 0; i + 1 < len(fields); i++ {
+		value := fields[i + 1]
+		switch fields[i] {
+		case "-p":
+			proto = value
+		case "-d":
+			dest = value
+		case "--dport", "--dports":
+			ports = value
+		case "-j":
+			target = value
+		case "-c":
+			packets, err = strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return
+			}
+		case "--comment":
+			// Quoted comments may hold spaces
+			for strings.HasPrefix(value, "\"") && !strings.HasSuffix(value[1:], "\"") && i + 2 < len(fields) {
+				i++
+				value = fields[i + 1]
+			}
+		default:
+			continue
+		}
+		i++
+	}
+	return denyLabel(proto, ports, dest), target, packets, true
+}
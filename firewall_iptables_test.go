@@ -0,0 +1,167 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPortClauses(t *testing.T) {
+	// Ports 1 to n
+	ports := func (n int) string {
+		var list []string
+		for i := 1; i <= n; i++ {
+			list = append(list, fmt.Sprint(i))
+		}
+		return strings.Join(list, ",")
+	}
+	// n ranges of two ports, 1:2, 11:12 and so on
+	ranges := func (n int) string {
+		var list []string
+		for i := 0; i < n; i++ {
+			list = append(list, fmt.Sprintf("%d:%d", i * 10 + 1, i * 10 + 2))
+		}
+		return strings.Join(list, ",")
+	}
+	tests := []struct {
+		name	string
+		dport	string
+		sport	string
+		want	[]string
+	}{
+		{ "single port", "22", "", []string {"--dport 22"} },
+		{ "single range", "6000:6010", "", []string {"--dport 6000:6010"} },
+		{ "port list", "80,443", "", []string {"-m multiport --dports 80,443"} },
+		{ "fifteen ports", ports(15), "", []string {"-m multiport --dports " + ports(15)} },
+		{ "sixteen ports", ports(16), "", []string {"-m multiport --dports " + ports(15), "-m multiport --dports 16"} },
+		{ "ranges take two slots", ranges(8), "", []string {"-m multiport --dports " + ranges(7), "-m multiport --dports 71:72"} },
+		{ "source port", "53", "1024:65535", []string {"--dport 53 --sport 1024:65535"} },
+		{ "source port list", "53", "53,5353", []string {"--dport 53 -m multiport --sports 53,5353"} },
+		{ "both split", ports(16), "1,2", []string {"-m multiport --sports 1,2 -m multiport --dports " + ports(15), "-m multiport --sports 1,2 -m multiport --dports 16"} },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			var err error
+			rule := &configFirewall {}
+			rule.destPorts, err = parsePortList("dport", tt.dport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.sport != "" {
+				rule.sourcePorts, err = parsePortList("sport", tt.sport)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []string
+			for _, clause := range portClauses(rule) {
+				got = append(got, strings.Join(clause, " "))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("portClauses() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestParsePortList(t *testing.T) {
+	tests := []struct {
+		s		string
+		want	[]portRange
+		wantErr	bool
+	}{
+		{ "22", []portRange {{ 22, 22 }}, false },
+		{ "80, 443", []portRange {{ 80, 80 }, { 443, 443 }}, false },
+		{ "6000:6010", []portRange {{ 6000, 6010 }}, false },
+		{ "0", nil, true },
+		{ "65536", nil, true },
+		{ "6010:6000", nil, true },
+		{ "80,", nil, true },
+		{ "http", nil, true },
+	}
+	for _, tt := range tests {
+		got, err := parsePortList("dport", tt.s)
+		if (err != nil) != tt.wantErr || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parsePortList(%q) = %v, %v, want %v, error %t", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseIptablesCounters(t *testing.T) {
+	tests := []struct {
+		file	string
+		want	map[string]uint64
+	} {
+		{"deny-counters-iptables-legacy.txt", map[string]uint64 {"tcp/22": 12, "udp/53 192.0.2.1": 5, "tcp/80,8000-8080": 7, "tcp/6000-6010": 0}},
+		// No opt column and protocols by number
+		{"deny-counters-iptables-nft.txt", map[string]uint64 {"tcp/22": 40, "udp/53 2001:db8::1": 2}},
+		{"deny-counters-iptables-save.txt", map[string]uint64 {"tcp/22": 12, "udp/53 192.0.2.1": 5, "tcp/80,8000-8080": 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			out, err := os.ReadFile("testdata/" + tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := parseIptablesCounters(out, "portknob-deny")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseIptablesCounters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Many elements go through a single ipset restore
+func TestIptablesDelElements(t *testing.T) {
+	var commands []string
+	var input []byte
+	conf := &config {}
+	var threshold uint64
+	conf.Daemon.FirewallSlowThreshold = &threshold
+	fw := &firewall { conf: conf, metrics: newMetrics(), chainName: "portknob", runner: func (cmd *exec.Cmd) error {
+		commands = append(commands, strings.Join(cmd.Args, " "))
+		var err error
+		input, err = io.ReadAll(cmd.Stdin)
+		return err
+	} }
+	b := &iptablesBackend { fw }
+	err := b.DelElements("revoke", []firewallElement {
+		{ "portknob-net4", net.ParseIP("192.0.2.7"), 24 },
+		{ "portknob-web-net4", net.ParseIP("192.0.2.7"), 24 },
+		{ "portknob-net6", net.ParseIP("2001:db8::1"), 48 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(commands, []string {"ipset -exist restore"}) {
+		t.Errorf("ran %q, want one ipset restore", commands)
+	}
+	want := "del portknob-net4 192.0.2.7\ndel portknob-web-net4 192.0.2.7\ndel portknob-net6 2001:db8::1\n"
+	if string(input) != want {
+		t.Errorf("restore input %q, want %q", input, want)
+	}
+}
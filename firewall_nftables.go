@@ -0,0 +1,517 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Firewall backend using nft, everything lives in an inet table named after firewall-chain-name
+// Base chains hook in slightly before the default priorities, so other tables see only traffic we let through
+type nftablesBackend struct {
+	fw		*firewall
+}
+
+func (b *nftablesBackend) Check() error {
+	_, err := exec.LookPath("nft")
+	if err != nil {
+		return &configError { fmt.Sprintf("firewall-backend \"nftables\" requires \"nft\": %s\n", err) }
+	}
+	return nil
+}
+
+// Run nft, "--" keeps negative priorities from being parsed as options
+func (b *nftablesBackend) nft(op string, arg ...string) error {
+	return b.fw.execCmd(op, "nft", append([]string {"--"}, arg...)...)
+}
+
+func (b *nftablesBackend) Setup() error {
+	table := b.fw.chainName
+	redirName := b.fw.chainName + "-redir"
+
+	// A table left behind by an unclean shutdown is not tracked by the cache, doRestore will add back the tracked entries
+	err := b.nft("chain-init", "add", "table", "inet", table)
+	if err != nil { return err }
+	err = b.nft("chain-init", "delete", "table", "inet", table)
+	if err != nil { return err }
+	err = b.nft("chain-init", "add", "table", "inet", table)
+	if err != nil { return err }
+
+	// Sets
+	// Net sets hold addresses masked to ipv4-prefix or ipv6-prefix, like ipset hash:ip with a netmask
+	// Sets of sliding rules are updated from the packet path, which requires the dynamic flag
+	for group := range b.fw.sets {
+		err = b.createSets("chain-init", group)
+		if err != nil { return err }
+	}
+
+	if b.fw.conf.Daemon.AuthBanFirewall {
+		for _, set := range [][2]string {{b.fw.ban4Name, "ipv4_addr"}, {b.fw.ban6Name, "ipv6_addr"}} {
+			err = b.nft("chain-init", "add", "set", "inet", table, set[0], "{", "type", set[1], ";", "flags", "timeout", ";", "}")
+			if err != nil { return err }
+		}
+	}
+
+	// Deny
+	err = b.nft("chain-init", "add", "chain", "inet", table, b.fw.denyName)
+	if err != nil { return err }
+	for _, args := range b.denyRules() {
+		err = b.nft("chain-init", args...)
+		if err != nil { return err }
+	}
+	err = b.nft("chain-init", "add", "chain", "inet", table, b.fw.chainName)
+	if err != nil { return err }
+
+	// Redir
+	err = b.nft("chain-init", "add", "chain", "inet", table, redirName)
+	if err != nil { return err }
+
+	for _, args := range b.generateRules(b.fw.conf.Firewall) {
+		err := b.nft("chain-init", args...)
+		if err != nil { log.Println(err) }
+	}
+
+	// Activate
+	err = b.nft("chain-init", "add", "chain", "inet", table, "input", "{", "type", "filter", "hook", "input", "priority", "-10", ";", "policy", "accept", ";", "}")
+	if err != nil { return err }
+	err = b.nft("chain-init", "add", "chain", "inet", table, "prerouting", "{", "type", "nat", "hook", "prerouting", "priority", "-110", ";", "policy", "accept", ";", "}")
+	if err != nil { return err }
+	err = b.nft("chain-init", "add", "chain", "inet", table, "output", "{", "type", "nat", "hook", "output", "priority", "-110", ";", "policy", "accept", ";", "}")
+	if err != nil { return err }
+	// Bans go before the jumps, whitelisted sources are dropped too
+	if b.fw.conf.Daemon.AuthBanFirewall {
+		mask4 := net.IP(net.CIDRMask(int(b.fw.conf.Daemon.IPv4Prefix), net.IPv4len * 8)).String()
+		err = b.nft("chain-init", "add", "rule", "inet", table, "input", "ip", "saddr", "&", mask4, "==", "@" + b.fw.ban4Name, "drop")
+		if err != nil { return err }
+		mask6 := net.IP(net.CIDRMask(int(b.fw.conf.Daemon.IPv6Prefix), net.IPv6len * 8)).String()
+		err = b.nft("chain-init", "add", "rule", "inet", table, "input", "ip6", "saddr", "&", mask6, "==", "@" + b.fw.ban6Name, "drop")
+		if err != nil { return err }
+	}
+	for _, ipv6 := range []bool {false, true} {
+		var match []string
+		if len(b.fw.groups) == 0 {
+			match = b.setMatch("", ipv6)
+		} else {
+			match = b.familyMatch(ipv6)
+		}
+		err = b.nft("chain-init", append(append([]string {"add", "rule", "inet", table, "input"}, match...), "jump", b.fw.chainName)...)
+		if err != nil { return err }
+		err = b.nft("chain-init", append(append([]string {"add", "rule", "inet", table, "prerouting", "fib", "daddr", "type", "local"}, match...), "jump", redirName)...)
+		if err != nil { return err }
+		err = b.nft("chain-init", append(append([]string {"add", "rule", "inet", table, "output", "fib", "daddr", "type", "local"}, match...), "jump", redirName)...)
+		if err != nil { return err }
+	}
+
+	return nil
+}
+
+func (b *nftablesBackend) familyMatch(ipv6 bool) []string {
+	if ipv6 {
+		return []string {"meta", "nfproto", "ipv6"}
+	}
+	return []string {"meta", "nfproto", "ipv4"}
+}
+
+// Match sources not whitelisted for group, only while its lockdown is engaged for lockdown groups
+func (b *nftablesBackend) setMatch(group string, ipv6 bool) []string {
+	sets := b.fw.sets[group]
+	var lock []string
+	if ipv6 {
+		if sets.lockdown {
+			lock = []string {"ip6", "saddr", "@" + sets.lock6Name}
+		}
+		mask := net.IP(net.CIDRMask(int(b.fw.conf.Daemon.IPv6Prefix), net.IPv6len * 8)).String()
+		return append(lock, "ip6", "saddr", "&", mask, "!=", "@" + sets.net6Name, "ip6", "saddr", "!=", "@" + sets.host6Name)
+	}
+	if sets.lockdown {
+		lock = []string {"ip", "saddr", "@" + sets.lock4Name}
+	}
+	mask := net.IP(net.CIDRMask(int(b.fw.conf.Daemon.IPv4Prefix), net.IPv4len * 8)).String()
+	return append(lock, "ip", "saddr", "&", mask, "!=", "@" + sets.net4Name, "ip", "saddr", "!=", "@" + sets.host4Name)
+}
+
+// Commands filling the deny chain for the configured deny method
+func (b *nftablesBackend) denyRules() [][]string {
+	table := b.fw.chainName
+	cmds := [][]string {{"add", "rule", "inet", table, b.fw.denyName, "limit", "rate", "3/minute", "log", "prefix", "\"[PORTKNOB-DENY] \""}}
+	if b.fw.conf.Daemon.FirewallDenyMethod == "reject" {
+		cmds = append(cmds, []string {"add", "rule", "inet", table, b.fw.denyName, "meta", "l4proto", "tcp", "reject", "with", "tcp", "reset"})
+		cmds = append(cmds, []string {"add", "rule", "inet", table, b.fw.denyName, "reject", "with", "icmpx", "type", "port-unreachable"})
+	} else {
+		cmds = append(cmds, []string {"add", "rule", "inet", table, b.fw.denyName, "drop"})
+	}
+	return cmds
+}
+
+// Commands adding the chain rules of rules
+// Unlike iptables -I, nft add appends, so rules are added in their configured order
+func (b *nftablesBackend) generateRules(rules []configFirewall) (cmds [][]string) {
+	table := b.fw.chainName
+	redirName := b.fw.chainName + "-redir"
+	for i := range rules {
+		rule := &rules[i]
+		var families []bool
+		if rule.Dest == "" {
+			families = []bool {false, true}
+		} else {
+			families = []bool {rule.DestIP.To4() == nil}
+		}
+		var protos []string
+		if rule.Proto == "" {
+			protos = []string {"udp", "tcp"}
+		} else {
+			protos = []string {rule.Proto}
+		}
+		var clause_comment []string
+		if rule.Comment != "" {
+			clause_comment = []string {"comment", strconv.Quote(rule.Comment)}
+		}
+		redirHost, redirPort := splitRedir(rule.Redir)
+
+		for _, ipv6 := range families {
+			clause_dest := b.familyMatch(ipv6)
+			if rule.Dest != "" {
+				if ipv6 {
+					clause_dest = append(clause_dest, "ip6", "daddr", rule.Dest)
+				} else {
+					clause_dest = append(clause_dest, "ip", "daddr", rule.Dest)
+				}
+			}
+			clause_match := clause_dest
+			if len(b.fw.groups) != 0 {
+				clause_match = append(append([]string(nil), clause_dest...), b.setMatch(rule.Group, ipv6)...)
+			}
+
+			// Renew, whitelisted sources matching the rule get their entry back to the full lifespan
+			if rule.Sliding {
+				for _, renew := range b.renewMatches(rule, ipv6) {
+					for _, proto := range protos {
+						args := []string {"add", "rule", "inet", table, b.fw.chainName}
+						args = append(args, clause_dest...)
+						args = append(args, renew[0]...)
+						args = append(args, b.portMatch(proto, rule)...)
+						args = append(args, renew[1]...)
+						args = append(args, clause_comment...)
+						cmds = append(cmds, args)
+					}
+				}
+			}
+
+			// Deny
+			for _, proto := range protos {
+				args := []string {"add", "rule", "inet", table, b.fw.chainName}
+				args = append(args, clause_match...)
+				args = append(args, b.portMatch(proto, rule)...)
+				args = append(args, "counter", "jump", b.fw.denyName)
+				args = append(args, clause_comment...)
+				cmds = append(cmds, args)
+			}
+
+			// Redirect
+			if rule.Redir == "" {
+				continue
+			}
+			var clause_redir []string
+			switch {
+			case redirHost == "":
+				clause_redir = []string {"redirect", "to", ":" + redirPort}
+			case (net.ParseIP(redirHost).To4() == nil) != ipv6:
+				// The target is of the other address family
+				continue
+			case ipv6 && redirPort != "":
+				clause_redir = []string {"dnat", "ip6", "to", "[" + redirHost + "]:" + redirPort}
+			case ipv6:
+				clause_redir = []string {"dnat", "ip6", "to", redirHost}
+			case redirPort != "":
+				clause_redir = []string {"dnat", "ip", "to", redirHost + ":" + redirPort}
+			default:
+				clause_redir = []string {"dnat", "ip", "to", redirHost}
+			}
+			for _, proto := range protos {
+				args := []string {"add", "rule", "inet", table, redirName}
+				args = append(args, clause_match...)
+				args = append(args, b.portMatch(proto, rule)...)
+				args = append(args, "limit", "rate", "3/minute", "log", "prefix", "\"[PORTKNOB-REDIR] \"")
+				args = append(args, clause_comment...)
+				cmds = append(cmds, args)
+				args = []string {"add", "rule", "inet", table, redirName}
+				args = append(args, clause_match...)
+				args = append(args, b.portMatch(proto, rule)...)
+				args = append(args, clause_redir...)
+				args = append(args, clause_comment...)
+				cmds = append(cmds, args)
+			}
+		}
+	}
+	return
+}
+
+// Matches and update statements renewing the net and host entries of a sliding rule
+func (b *nftablesBackend) renewMatches(rule *configFirewall, ipv6 bool) [][2][]string {
+	sets := b.fw.sets[rule.Group]
+	timeout := strconv.FormatUint(*rule.Lifespan, 10) + "s"
+	if ipv6 {
+		mask := net.IP(net.CIDRMask(int(b.fw.conf.Daemon.IPv6Prefix), net.IPv6len * 8)).String()
+		return [][2][]string {
+			{{"ip6", "saddr", "&", mask, "==", "@" + sets.net6Name}, {"update", "@" + sets.net6Name, "{", "ip6", "saddr", "&", mask, "timeout", timeout, "}"}},
+			{{"ip6", "saddr", "==", "@" + sets.host6Name}, {"update", "@" + sets.host6Name, "{", "ip6", "saddr", "timeout", timeout, "}"}},
+		}
+	}
+	mask := net.IP(net.CIDRMask(int(b.fw.conf.Daemon.IPv4Prefix), net.IPv4len * 8)).String()
+	return [][2][]string {
+		{{"ip", "saddr", "&", mask, "==", "@" + sets.net4Name}, {"update", "@" + sets.net4Name, "{", "ip", "saddr", "&", mask, "timeout", timeout, "}"}},
+		{{"ip", "saddr", "==", "@" + sets.host4Name}, {"update", "@" + sets.host4Name, "{", "ip", "saddr", "timeout", timeout, "}"}},
+	}
+}
+
+// Match the ports of a rule, lists become anonymous sets
+func (b *nftablesBackend) portMatch(proto string, rule *configFirewall) []string {
+	args := []string {proto, "dport", nftPorts(rule.destPorts)}
+	if len(rule.sourcePorts) != 0 {
+		args = append(args, proto, "sport", nftPorts(rule.sourcePorts))
+	}
+	return args
+}
+
+func nftPorts(ranges []portRange) string {
+	if len(ranges) == 1 {
+		return ranges[0].format("-")
+	}
+	elems := make([]string, len(ranges))
+	for i, r := range ranges {
+		elems[i] = r.format("-")
+	}
+	return "{ " + strings.Join(elems, ", ") + " }"
+}
+
+// Apply a reloaded configuration by rebuilding the chains in a single transaction, so nothing is let through in between
+func (b *nftablesBackend) Reconcile(oldConf *config, added, removed []configFirewall) error {
+	table := b.fw.chainName
+	cmds := [][]string {{"flush", "chain", "inet", table, b.fw.chainName}, {"flush", "chain", "inet", table, b.fw.chainName + "-redir"}}
+	if oldConf.Daemon.FirewallDenyMethod != b.fw.conf.Daemon.FirewallDenyMethod {
+		cmds = append(cmds, []string {"flush", "chain", "inet", table, b.fw.denyName})
+		cmds = append(cmds, b.denyRules()...)
+	}
+	cmds = append(cmds, b.generateRules(b.fw.conf.Firewall)...)
+	var args []string
+	for i, cmd := range cmds {
+		if i != 0 {
+			args = append(args, ";")
+		}
+		args = append(args, cmd...)
+	}
+	return b.nft("chain-reload", args...)
+}
+
+// Create the four sets of group in our table
+func (b *nftablesBackend) createSets(op string, group string) error {
+	sets := b.fw.sets[group]
+	var defaultTimeout []string
+	if lifespan := b.fw.conf.groupLifespan(group); lifespan != 0 {
+		defaultTimeout = []string {"timeout", strconv.FormatUint(lifespan, 10) + "s", ";"}
+	}
+	flags := "timeout"
+	if b.fw.conf.lifespanGroups[group].sliding {
+		flags = "dynamic,timeout"
+	}
+	// With probation or auto-rekey-ipv6, the sets count the traffic of their elements
+	if b.fw.conf.groupCounters(group) {
+		defaultTimeout = append(defaultTimeout, "counter", ";")
+	}
+	for _, set := range [][2]string {{sets.net4Name, "ipv4_addr"}, {sets.net6Name, "ipv6_addr"}, {sets.host4Name, "ipv4_addr"}, {sets.host6Name, "ipv6_addr"}} {
+		args := []string {"add", "set", "inet", b.fw.chainName, set[0], "{", "type", set[1], ";", "flags", flags, ";"}
+		args = append(args, defaultTimeout...)
+		args = append(args, "}")
+		err := b.nft(op, args...)
+		if err != nil { return err }
+	}
+	if sets.lockdown {
+		for _, set := range [][2]string {{sets.lock4Name, "ipv4_addr"}, {sets.lock6Name, "ipv6_addr"}} {
+			err := b.nft(op, "add", "set", "inet", b.fw.chainName, set[0], "{", "type", set[1], ";", "flags", "interval,timeout", ";", "}")
+			if err != nil { return err }
+		}
+	}
+	return nil
+}
+
+func (b *nftablesBackend) AddSets(group string) error {
+	return b.createSets("chain-reload", group)
+}
+
+func (b *nftablesBackend) DelSets(sets *firewallSets) {
+	setNames := []string {sets.net4Name, sets.net6Name, sets.host4Name, sets.host6Name}
+	if sets.lockdown {
+		setNames = append(setNames, sets.lock4Name, sets.lock6Name)
+	}
+	for _, setName := range setNames {
+		b.nft("chain-reload", "delete", "set", "inet", b.fw.chainName, setName)
+	}
+}
+
+func (b *nftablesBackend) Teardown() {
+	b.nft("chain-cleanup", "delete", "table", "inet", b.fw.chainName)
+}
+
+// The element of addr, masked like ipset does for net sets
+func (b *nftablesBackend) element(addr net.IP, prefix uint) string {
+	if addr.To4() != nil {
+		return addr.Mask(net.CIDRMask(int(prefix), net.IPv4len * 8)).String()
+	}
+	return addr.Mask(net.CIDRMask(int(prefix), net.IPv6len * 8)).String()
+}
+
+// Adding an existing element keeps its old timeout, so the element is deleted and added again in one transaction
+func (b *nftablesBackend) AddElement(setName string, addr net.IP, prefix uint, timeout time.Duration) error {
+	cmd := b.ElementCommand(setName, addr, prefix, timeout)
+	return b.fw.execCmd("grant-insert", cmd[0], cmd[1:]...)
+}
+
+func (b *nftablesBackend) ElementCommand(setName string, addr net.IP, prefix uint, timeout time.Duration) []string {
+	elem := b.element(addr, prefix)
+	args := []string {"add", "element", "inet", b.fw.chainName, setName, "{", elem, "}", ";", "delete", "element", "inet", b.fw.chainName, setName, "{", elem, "}", ";", "add", "element", "inet", b.fw.chainName, setName, "{", elem}
+	if timeout != 0 {
+		args = append(args, "timeout", strconv.FormatUint(uint64(timeout / time.Second), 10) + "s")
+	}
+	return append(append([]string {"nft", "--"}, args...), "}")
+}
+
+// Adding first keeps nft from failing when the element is not there
+func (b *nftablesBackend) DelElement(op string, setName string, addr net.IP, prefix uint) error {
+	elem := b.element(addr, prefix)
+	return b.nft(op, "add", "element", "inet", b.fw.chainName, setName, "{", elem, "}", ";", "delete", "element", "inet", b.fw.chainName, setName, "{", elem, "}")
+}
+
+// One nft invocation, which applies its commands in a single transaction
+func (b *nftablesBackend) DelElements(op string, elements []firewallElement) error {
+	var args []string
+	for _, element := range elements {
+		elem := b.element(element.addr, element.prefix)
+		if len(args) != 0 {
+			args = append(args, ";")
+		}
+		args = append(args, "add", "element", "inet", b.fw.chainName, element.setName, "{", elem, "}", ";", "delete", "element", "inet", b.fw.chainName, element.setName, "{", elem, "}")
+	}
+	return b.nft(op, args...)
+}
+
+// Adding an existing element keeps its old timeout, so the lock sets are flushed and filled again in one transaction
+func (b *nftablesBackend) AddLockdown(sets *firewallSets, timeout time.Duration) error {
+	var args []string
+	for _, set := range []struct { name string; halves []string } {{sets.lock4Name, lockdownHalves4}, {sets.lock6Name, lockdownHalves6}} {
+		if len(args) != 0 {
+			args = append(args, ";")
+		}
+		args = append(args, "flush", "set", "inet", b.fw.chainName, set.name, ";", "add", "element", "inet", b.fw.chainName, set.name, "{")
+		for i, half := range set.halves {
+			if i != 0 {
+				args = append(args, ",")
+			}
+			args = append(args, half)
+			if timeout != 0 {
+				args = append(args, "timeout", strconv.FormatUint(uint64(timeout / time.Second), 10) + "s")
+			}
+		}
+		args = append(args, "}")
+	}
+	return b.nft("lockdown", args...)
+}
+
+func (b *nftablesBackend) DelLockdown(sets *firewallSets) error {
+	return b.nft("lockdown", "flush", "set", "inet", b.fw.chainName, sets.lock4Name, ";", "flush", "set", "inet", b.fw.chainName, sets.lock6Name)
+}
+
+func (b *nftablesBackend) ElementBytes(setName string) (map[string]uint64, error) {
+	out, err := b.fw.outputCmd("probation", "nft", "list", "set", "inet", b.fw.chainName, setName)
+	if err != nil { return nil, err }
+	return parseNftBytes(out), nil
+}
+
+// The byte counters of the elements in the output of "nft list set", by address
+func parseNftBytes(out []byte) map[string]uint64 {
+	counters := make(map[string]uint64)
+	fields := strings.Fields(string(out))
+	var addr string
+	for i := 0; i < len(fields); i++ {
+		switch {
+		case fields[i] == "elements" && i + 3 < len(fields) && fields[i + 2] == "{":
+			i += 3
+			addr = strings.TrimSuffix(fields[i], ",")
+		case i > 0 && strings.HasSuffix(fields[i - 1], ",") && addr != "":
+			addr = strings.TrimSuffix(fields[i], ",")
+		case fields[i] == "bytes" && i + 1 < len(fields) && addr != "":
+			counters[addr], _ = strconv.ParseUint(strings.TrimSuffix(fields[i + 1], ","), 10, 64)
+		case fields[i] == "}":
+			addr = ""
+		}
+	}
+	return counters
+}
+
+func (b *nftablesBackend) DenyCounters() (map[string]uint64, error) {
+	out, err := b.fw.outputCmd("deny-counters", "nft", "list", "chain", "inet", b.fw.chainName, b.fw.chainName)
+	if err != nil { return nil, err }
+	return parseNftCounters(out, b.fw.denyName), nil
+}
+
+// Sum the counters of the rules jumping to denyName in the output of "nft list chain" by denyLabel
+func parseNftCounters(out []byte, denyName string) map[string]uint64 {
+	counters := make(map[string]uint64)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		var proto, ports, dest string
+		var packets uint64
+		deny := false
+		for i := 0; i + 1 < len(fields); i++ {
+			switch fields[i] {
+			case "jump":
+				deny = fields[i + 1] == denyName
+			case "packets":
+				packets, _ = strconv.ParseUint(fields[i + 1], 10, 64)
+			case "daddr":
+				dest = fields[i + 1]
+			case "dport":
+				if i > 0 {
+					proto = fields[i - 1]
+				}
+				if fields[i + 1] != "{" {
+					ports = fields[i + 1]
+					continue
+				}
+				var elems []string
+				for i += 2; i < len(fields) && fields[i] != "}"; i++ {
+					elems = append(elems, strings.TrimSuffix(fields[i], ","))
+				}
+				ports = strings.Join(elems, ",")
+			case "comment":
+				// The rest of the line is the comment
+				i = len(fields)
+			}
+		}
+		if deny {
+			counters[denyLabel(proto, ports, dest)] += packets
+		}
+	}
+	return counters
+}
@@ -0,0 +1,65 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNftCounters(t *testing.T) {
+	out, err := os.ReadFile("testdata/deny-counters-nft.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both address families of a rule add up
+	want := map[string]uint64 {"tcp/22": 52, "udp/53 192.0.2.1": 5, "tcp/80,8000-8080": 7}
+	got := parseNftCounters(out, "portknob-deny")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseNftCounters() = %v, want %v", got, want)
+	}
+}
+
+// Many elements go through a single nft invocation
+func TestNftDelElements(t *testing.T) {
+	var commands []string
+	conf := &config {}
+	var threshold uint64
+	conf.Daemon.FirewallSlowThreshold = &threshold
+	fw := &firewall { conf: conf, metrics: newMetrics(), chainName: "portknob", runner: func (cmd *exec.Cmd) error {
+		commands = append(commands, strings.Join(cmd.Args, " "))
+		return nil
+	} }
+	b := &nftablesBackend { fw }
+	err := b.DelElements("revoke", []firewallElement {
+		{ "portknob-net4", net.ParseIP("192.0.2.7"), 24 },
+		{ "portknob-net6", net.ParseIP("2001:db8::1"), 48 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string {"nft -- add element inet portknob portknob-net4 { 192.0.2.0 } ; delete element inet portknob portknob-net4 { 192.0.2.0 } ; add element inet portknob portknob-net6 { 2001:db8:: } ; delete element inet portknob portknob-net6 { 2001:db8:: }"}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("ran %q, want %q", commands, want)
+	}
+}
@@ -0,0 +1,882 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecCmdSlowWarning(t *testing.T) {
+	tests := []struct {
+		name		string
+		threshold	uint64
+		command		string
+		arg			[]string
+		wantWarning	bool
+	}{
+		{ "disabled", 0, "sleep", []string {"0.05"}, false },
+		{ "fast", 10000, "true", nil, false },
+		{ "slow", 10, "sleep", []string {"0.05"}, true },
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			buf.Reset()
+			conf := &config {}
+			conf.Daemon.FirewallSlowThreshold = &tt.threshold
+			fw := &firewall { conf: conf, metrics: newMetrics() }
+			err := fw.execCmd("grant-insert", tt.command, tt.arg...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			warned := strings.Contains(buf.String(), "Slow firewall command (op=grant-insert family=" + tt.command + ")")
+			if warned != tt.wantWarning {
+				t.Errorf("warning logged %t, want %t: %q", warned, tt.wantWarning, buf.String())
+			}
+		})
+	}
+}
+
+// Commands whose duration the fake runner injects are measured by op and family
+func TestFirewallCommandDuration(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	threshold := uint64(20)
+	conf := &config {}
+	conf.Daemon.FirewallSlowThreshold = &threshold
+	delays := map[string]time.Duration { "iptables": 0, "ip6tables": 30 * time.Millisecond }
+	var ran []string
+	fw := &firewall { conf: conf, metrics: newMetrics(), runner: func (cmd *exec.Cmd) error {
+		ran = append(ran, cmd.Args[0])
+		time.Sleep(delays[cmd.Args[0]])
+		return nil
+	} }
+	for _, name := range []string { "iptables", "iptables", "ip6tables" } {
+		err := fw.execCmd("grant-insert", name, "-A", "portknob")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(ran, []string { "iptables", "iptables", "ip6tables" }) {
+		t.Fatalf("ran %v", ran)
+	}
+	var out bytes.Buffer
+	fw.metrics.WriteTo(&out, 0, 0)
+	for _, want := range []string {
+		`portknob_firewall_command_duration_seconds_bucket{op="grant-insert",family="ipv4",le="0.005"} 2`,
+		`portknob_firewall_command_duration_seconds_count{op="grant-insert",family="ipv4"} 2`,
+		`portknob_firewall_command_duration_seconds_bucket{op="grant-insert",family="ipv6",le="0.025"} 0`,
+		`portknob_firewall_command_duration_seconds_bucket{op="grant-insert",family="ipv6",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(out.String(), want + "\n") {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+	p95 := fw.metrics.FirewallP95()
+	if got := p95[firewallCommand { "grant-insert", "ipv6" }]; got < 30 * time.Millisecond {
+		t.Errorf("p95 of ipv6 %s, want at least 30ms", got)
+	}
+	if got := p95[firewallCommand { "grant-insert", "ipv4" }]; got >= 20 * time.Millisecond {
+		t.Errorf("p95 of ipv4 %s, want below 20ms", got)
+	}
+	if strings.Count(buf.String(), "Slow firewall command") != 1 || !strings.Contains(buf.String(), "(op=grant-insert family=ipv6)") || !strings.Contains(buf.String(), "ip6tables -A portknob") {
+		t.Errorf("want one warning about the ip6tables command, got %q", buf.String())
+	}
+}
+
+func TestFirewallP95(t *testing.T) {
+	m := newMetrics()
+	// Only the last metricsRecentCommands count
+	for i := 0; i < 50; i++ {
+		m.FirewallDuration("revoke", "ipset", time.Hour)
+	}
+	for i := 1; i <= 100; i++ {
+		m.FirewallDuration("revoke", "ipset", time.Duration(i) * time.Millisecond)
+	}
+	if got := m.FirewallP95()[firewallCommand { "revoke", "ipset" }]; got != 95 * time.Millisecond {
+		t.Errorf("p95 %s, want 95ms", got)
+	}
+}
+
+func TestCommandFamily(t *testing.T) {
+	tests := []struct {
+		name	string
+		want	string
+	}{
+		{ "iptables", "ipv4" },
+		{ "ip6tables", "ipv6" },
+		{ "ipset", "ipset" },
+		{ "nft", "nft" },
+	}
+	for _, tt := range tests {
+		if got := commandFamily(tt.name); got != tt.want {
+			t.Errorf("commandFamily(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Records whitelist changes instead of running commands, failing AddElement for the sets in fail
+type fakeBackend struct {
+	fail		map[string]bool
+	elements	map[string]bool
+	// Fail DelElement
+	failDelete	bool
+	// Panic on AddElement call number crashAt, like the process dying before the command runs
+	crashAt		int
+	calls		int
+	// Returned by DenyCounters
+	denied		map[string]uint64
+	// Byte counters returned by ElementBytes, by set
+	bytes		map[string]map[string]uint64
+	// Timeout of the engaged lockdowns by lock4 set name
+	lockdowns	map[string]time.Duration
+	// Timeout of the last AddElement by element, if not nil
+	timeouts	map[string]time.Duration
+	// Calls of DelElements
+	batches		int
+	// If not nil, AddElement signals entered and waits for block to be closed, like a slow command
+	entered		chan struct{}
+	block		chan struct{}
+	mutex		sync.Mutex
+}
+
+func (b *fakeBackend) Check() error { return nil }
+func (b *fakeBackend) Setup() error { return nil }
+func (b *fakeBackend) Teardown() {}
+func (b *fakeBackend) Reconcile(oldConf *config, added, removed []configFirewall) error { return nil }
+func (b *fakeBackend) AddSets(group string) error { return nil }
+func (b *fakeBackend) DelSets(sets *firewallSets) {}
+
+func (b *fakeBackend) AddElement(setName string, addr net.IP, prefix uint, timeout time.Duration) error {
+	if b.block != nil {
+		b.entered <- struct{}{}
+		<-b.block
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.calls++
+	if b.calls == b.crashAt {
+		panic(errTestCrash)
+	}
+	if b.fail[setName] {
+		return errors.New("cannot add to " + setName)
+	}
+	b.elements[setName + " " + addr.String()] = true
+	if b.timeouts != nil {
+		b.timeouts[setName + " " + addr.String()] = timeout
+	}
+	return nil
+}
+
+func (b *fakeBackend) ElementCommand(setName string, addr net.IP, prefix uint, timeout time.Duration) []string {
+	return []string {"add", setName, addr.String(), timeout.String()}
+}
+
+func (b *fakeBackend) DenyCounters() (map[string]uint64, error) {
+	if b.denied == nil {
+		return nil, errors.New("no counters")
+	}
+	return b.denied, nil
+}
+
+func (b *fakeBackend) ElementBytes(setName string) (map[string]uint64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.bytes[setName], nil
+}
+
+func (b *fakeBackend) AddLockdown(sets *firewallSets, timeout time.Duration) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.lockdowns == nil {
+		b.lockdowns = make(map[string]time.Duration)
+	}
+	b.lockdowns[sets.lock4Name] = timeout
+	return nil
+}
+
+func (b *fakeBackend) DelLockdown(sets *firewallSets) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.lockdowns, sets.lock4Name)
+	return nil
+}
+
+func (b *fakeBackend) DelElements(op string, elements []firewallElement) error {
+	b.mutex.Lock()
+	b.batches++
+	b.mutex.Unlock()
+	for _, element := range elements {
+		err := b.DelElement(op, element.setName, element.addr, element.prefix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *fakeBackend) DelElement(op string, setName string, addr net.IP, prefix uint) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.failDelete {
+		return errors.New("cannot delete from " + setName)
+	}
+	delete(b.elements, setName + " " + addr.String())
+	return nil
+}
+
+var errTestCrash = errors.New("crashed")
+
+// Fails or panics on read-write transaction number at, panicking like the process dying before the commit
+type failingStore struct {
+	cacheStore
+	at		int
+	crash	bool
+	calls	*int
+}
+
+func (s failingStore) Update(fn func (tx cacheTx) error) error {
+	*s.calls++
+	if *s.calls == s.at {
+		if s.crash {
+			panic(errTestCrash)
+		}
+		return errors.New("cannot write")
+	}
+	return s.cacheStore.Update(fn)
+}
+
+// A firewall with the rule groups "" and "web", a fake backend and a BoltDB cache in a temporary directory
+func newTestFirewall(t *testing.T) (*firewall, *fakeBackend) {
+	conf := &config {}
+	conf.Daemon.FirewallChainName = "portknob"
+	conf.Daemon.CacheDatabase = filepath.Join(t.TempDir(), "cache.db")
+	conf.Daemon.IPv4Prefix, conf.Daemon.IPv6Prefix = 24, 48
+	var lifespan uint64 = 3600
+	conf.Daemon.FirewallLifespan = &lifespan
+	conf.Firewall = []configFirewall {{ Group: "" }, { Group: "web" }}
+	fw := newFirewall(conf)
+	backend := &fakeBackend { fail: make(map[string]bool), elements: make(map[string]bool) }
+	fw.backend = backend
+	err := fw.cache.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fw.cache.Stop)
+	return fw, backend
+}
+
+func TestInsertTimeoutRollback(t *testing.T) {
+	addr := net.ParseIP("192.0.2.7")
+	tests := []struct {
+		name		string
+		stopping	bool
+		fail		string
+		readOnly	bool
+		wantErr		bool
+		wantEntries	int
+	}{
+		{ "granted", false, "", false, false, 2 },
+		{ "second group fails", false, "portknob-web-net4", false, true, 0 },
+		{ "first group fails", false, "portknob-net4", false, true, 0 },
+		{ "cache write fails", false, "", true, true, 0 },
+		{ "shutting down", true, "", false, true, 0 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			fw, backend := newTestFirewall(t)
+			fw.stopping = tt.stopping
+			if tt.fail != "" {
+				backend.fail[tt.fail] = true
+			}
+			if tt.readOnly {
+				fw.cache.store = readOnlyStore { fw.cache.store }
+			}
+			_, err := fw.InsertTimeout(addr, "alice", []string {"", "web"}, time.Hour, true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if tt.stopping && err != errFirewallStopping {
+				t.Errorf("error %v, want %v", err, errFirewallStopping)
+			}
+			entries, err := fw.cache.Entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.wantEntries || len(backend.elements) != tt.wantEntries {
+				t.Errorf("%d cache entries and %d firewall elements, want %d of each", len(entries), len(backend.elements), tt.wantEntries)
+			}
+		})
+	}
+}
+
+// A failed grant leaves the elements of earlier grants of the subnet in place
+func TestInsertTimeoutKeepsEarlierGrants(t *testing.T) {
+	fw, backend := newTestFirewall(t)
+	addr := net.ParseIP("192.0.2.7")
+	_, err := fw.InsertTimeout(addr, "carol", []string {""}, time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.fail["portknob-web-net4"] = true
+	_, err = fw.InsertTimeout(addr, "alice", []string {"", "web"}, time.Hour, true)
+	if err == nil {
+		t.Fatal("grant succeeded, want error")
+	}
+	want := map[string]bool {"portknob-net4 192.0.2.7": true}
+	if !reflect.DeepEqual(backend.elements, want) {
+		t.Errorf("firewall elements %v, want %v", backend.elements, want)
+	}
+	records, err := fw.cache.Journal()
+	if err != nil || len(records) != 0 {
+		t.Errorf("journal %v, %v, want empty", records, err)
+	}
+}
+
+// Interrupt a grant at each stage, then restart without flushing the firewall, which must match the cache again
+func TestGrantJournalReplay(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	addr := net.ParseIP("192.0.2.7")
+	earlier := map[string]bool {"portknob-net4 192.0.2.7": true}
+	granted := map[string]bool {"portknob-net4 192.0.2.7": true, "portknob-web-net4 192.0.2.7": true}
+	tests := []struct {
+		name		string
+		// AddElement call of the grant to crash at, 0 for none
+		crashAt		int
+		// Read-write transaction of the grant to fail at, 0 for none
+		failAt		int
+		crashStore	bool
+		failDelete	bool
+		// Journal records and firewall elements left behind
+		wantRecords	int
+		wantBefore	map[string]bool
+	}{
+		{ "crash writing the journal", 0, 1, true, false, 0, earlier },
+		{ "crash before the first element", 1, 0, false, false, 2, earlier },
+		{ "crash before the second element", 2, 0, false, false, 2, earlier },
+		{ "crash writing the cache", 0, 2, true, false, 2, granted },
+		{ "cache write fails", 0, 2, false, false, 0, earlier },
+		{ "rollback fails", 0, 2, false, true, 2, granted },
+		{ "completed", 0, 0, false, false, 0, granted },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			fw, backend := newTestFirewall(t)
+			_, err := fw.InsertTimeout(addr, "carol", []string {""}, time.Hour, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := fw.cache.store
+			var calls int
+			fw.cache.store = failingStore { store, tt.failAt, tt.crashStore, &calls }
+			backend.calls, backend.crashAt, backend.failDelete = 0, tt.crashAt, tt.failDelete
+			func () {
+				defer func () {
+					if r := recover(); r != nil && r != errTestCrash {
+						panic(r)
+					}
+				}()
+				fw.InsertTimeout(addr, "alice", []string {"", "web"}, time.Hour, true)
+			}()
+			fw.cache.store = store
+			backend.crashAt, backend.failDelete = 0, false
+			records, err := fw.cache.Journal()
+			if err != nil || len(records) != tt.wantRecords {
+				t.Errorf("%d journal records, %v, want %d", len(records), err, tt.wantRecords)
+			}
+			if !reflect.DeepEqual(backend.elements, tt.wantBefore) {
+				t.Errorf("firewall elements %v before the restart, want %v", backend.elements, tt.wantBefore)
+			}
+
+			restarted := newFirewall(fw.conf)
+			restarted.cache, restarted.backend = fw.cache, backend
+			restarted.replayJournal(true)
+			restarted.doRestore()
+			want := make(map[string]bool)
+			entries, err := fw.cache.Entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				setName, _ := fw.setFor(entry.addr, entry.group)
+				want[setName + " " + entry.addr.String()] = true
+			}
+			if !reflect.DeepEqual(backend.elements, want) {
+				t.Errorf("firewall elements %v after the restart, want %v from the cache", backend.elements, want)
+			}
+			records, err = fw.cache.Journal()
+			if err != nil || len(records) != 0 {
+				t.Errorf("journal %v, %v after the restart, want empty", records, err)
+			}
+		})
+	}
+}
+
+// Cleanups retry the rollbacks which failed, not the grants still running
+func TestCleanupReplaysFailedRollbacks(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	fw, backend := newTestFirewall(t)
+	addr := net.ParseIP("192.0.2.7")
+	other := net.ParseIP("198.51.100.7")
+	err := fw.cache.SetJournal([]cacheEntry {{ addr: other, group: "web" }}, "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := fw.cache.store
+	var calls int
+	fw.cache.store = failingStore { store, 2, false, &calls }
+	backend.failDelete = true
+	_, err = fw.InsertTimeout(addr, "alice", []string {"", "web"}, time.Hour, true)
+	if err == nil {
+		t.Fatal("grant succeeded, want error")
+	}
+	fw.cache.store = store
+	backend.failDelete = false
+	fw.replayJournal(false)
+	if len(backend.elements) != 0 {
+		t.Errorf("firewall elements %v, want none", backend.elements)
+	}
+	records, err := fw.cache.Journal()
+	if err != nil || len(records) != 1 || !records[0].entry.addr.Equal(other) || records[0].state != "pending" {
+		t.Errorf("journal %v, %v, want only the pending grant of %s", records, err, other)
+	}
+}
+
+// Looks shared to the cache, like the SQLite and Redis stores
+type sharedStore struct {
+	cacheStore
+}
+
+func TestNextCleanup(t *testing.T) {
+	now := time.Now()
+	const maxSleep = 300 * time.Second
+	tests := []struct {
+		name		string
+		// Expiries of the entries after now, -1 for never
+		expiries	[]time.Duration
+		shared		bool
+		syncInterval	uint64
+		want		time.Duration
+	}{
+		{ "no entries", nil, false, 10, maxSleep },
+		{ "entry about to expire", []time.Duration {60 * time.Second}, false, 10, 60 * time.Second },
+		{ "earliest of several", []time.Duration {600 * time.Second, 90 * time.Second, 120 * time.Second}, false, 10, 90 * time.Second },
+		{ "later than sweeper-max-sleep", []time.Duration {600 * time.Second}, false, 10, maxSleep },
+		{ "never expires", []time.Duration {-1}, false, 10, maxSleep },
+		{ "at least a second", []time.Duration {200 * time.Millisecond}, false, 10, time.Second },
+		{ "already expired", []time.Duration {-time.Hour}, false, 10, time.Second },
+		{ "cache-sync-interval when shared", []time.Duration {60 * time.Second}, true, 30, 30 * time.Second },
+		{ "entry before cache-sync-interval", []time.Duration {60 * time.Second}, true, 120, 60 * time.Second },
+		{ "cache-sync-interval ignored when not shared", nil, false, 30, maxSleep },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			fw, _ := newTestFirewall(t)
+			fw.conf.Daemon.SweeperMaxSleep = uint64(maxSleep / time.Second)
+			fw.conf.Daemon.CacheSyncInterval = tt.syncInterval
+			var entries []cacheEntry
+			for i, expiry := range tt.expiries {
+				entry := cacheEntry { addr: net.IPv4(192, 0, 2, byte(i + 1)) }
+				if expiry != -1 {
+					entry.expires = now.Add(expiry)
+				}
+				entries = append(entries, entry)
+			}
+			err := fw.cache.Set(entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.shared {
+				fw.cache.store = sharedStore { fw.cache.store }
+			}
+			if got := fw.nextCleanup(now); got != tt.want {
+				t.Errorf("nextCleanup() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClampLifespan(t *testing.T) {
+	tests := []struct {
+		name		string
+		max			uint64
+		timeout		time.Duration
+		want		time.Duration
+	}{
+		{ "no cap", 0, time.Hour, time.Hour },
+		{ "no cap, no expiry", 0, 0, 0 },
+		{ "below the cap", 7200, time.Hour, time.Hour },
+		{ "at the cap", 3600, time.Hour, time.Hour },
+		{ "above the cap", 1800, time.Hour, 30 * time.Minute },
+		{ "no expiry is capped", 1800, 0, 30 * time.Minute },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			conf := &config {}
+			conf.Daemon.AbsoluteMaxLifespan = tt.max
+			fw := &firewall { conf: conf }
+			if got := fw.ClampLifespan(tt.timeout); got != tt.want {
+				t.Errorf("ClampLifespan(%s) = %s, want %s", tt.timeout, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJitterLifespan(t *testing.T) {
+	tests := []struct {
+		name		string
+		jitter		uint64
+		timeout		time.Duration
+		wantMin		time.Duration
+		wantMax		time.Duration
+	}{
+		{ "no jitter", 0, time.Hour, time.Hour, time.Hour },
+		{ "no expiry", 600, 0, 0, 0 },
+		{ "jittered", 600, time.Hour, 50 * time.Minute, time.Hour },
+		{ "at most half the lifespan", 600, 10 * time.Minute, 5 * time.Minute, 10 * time.Minute },
+		{ "one second", 600, time.Second, time.Second, time.Second },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			conf := &config {}
+			conf.Daemon.ExpiryJitter = tt.jitter
+			fw := &firewall { conf: conf }
+			for i := 0; i < 1000; i++ {
+				got := fw.JitterLifespan(tt.timeout)
+				if got < tt.wantMin || got > tt.wantMax || got % time.Second != 0 {
+					t.Fatalf("JitterLifespan(%s) = %s, want whole seconds from %s to %s", tt.timeout, got, tt.wantMin, tt.wantMax)
+				}
+			}
+		})
+	}
+}
+
+// Many clients logging in at once, like a whole office at 09:00, expire spread over expiry-jitter and are revoked with one command
+func TestMassGrantExpiry(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	fw, backend := newTestFirewall(t)
+	fw.conf.Daemon.ExpiryJitter = 600
+	var cookieLifespan uint64 = 86400
+	fw.conf.Daemon.CookieLifespan = &cookieLifespan
+	backend.timeouts = make(map[string]time.Duration)
+	const clients = 200
+	var addrs []net.IP
+	for i := 0; i < clients; i++ {
+		addr := net.IPv4(10, byte(i / 250), byte(i % 250), 1)
+		addrs = append(addrs, addr)
+		_, _, err := fw.Grant(addr, "alice", []string {""}, nil, time.Hour, time.Time {})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// By minute of jitter, 20 of the 200 each on average
+	var minutes [10]int
+	seconds := make(map[time.Duration]int)
+	for _, addr := range addrs {
+		subnet := fw.Subnet(addr)
+		timeout := backend.timeouts["portknob-net4 " + addr.String()]
+		if timeout < 3000 * time.Second || timeout > 3600 * time.Second {
+			t.Fatalf("timeout of %s is %s, want 3000s to 3600s", subnet, timeout)
+		}
+		minutes[min(int(3600 * time.Second - timeout) / int(time.Minute), 9)]++
+		seconds[timeout]++
+	}
+	for minute, count := range minutes {
+		if count < 5 || count > 45 {
+			t.Errorf("%d of %d entries expire in minute %d of the jitter, want them spread: %v", count, clients, minute, minutes)
+		}
+	}
+	for timeout, count := range seconds {
+		if count > 6 {
+			t.Errorf("%d entries expire together after %s", count, timeout)
+		}
+	}
+	// The cache shows the expiry the firewall got
+	entries, err := fw.cache.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		timeout := backend.timeouts["portknob-net4 " + entry.addr.String()]
+		if d := entry.expires.Sub(entry.created) - timeout; d.Abs() > time.Second {
+			t.Errorf("cache entry of %s expires %s after it was created, the firewall got %s", entry.addr, entry.expires.Sub(entry.created), timeout)
+		}
+	}
+
+	err = fw.Revoke(addrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.batches != 1 || len(backend.elements) != 0 {
+		t.Errorf("revoking %d subnets took %d commands and left %d elements, want 1 and 0", clients, backend.batches, len(backend.elements))
+	}
+}
+
+func TestRevokeForgetsAuthTimes(t *testing.T) {
+	fw, _ := newTestFirewall(t)
+	for _, grant := range []struct {
+		addr	string
+		user	string
+	}{
+		{ "192.0.2.7", "alice" },
+		{ "192.0.2.8", "bob" },
+		{ "198.51.100.7", "carol" },
+	} {
+		_, err := fw.InsertTimeout(net.ParseIP(grant.addr), grant.user, []string {""}, time.Hour, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.cache.SetAuthTime(grant.user, time.Now())
+	}
+	err := fw.Revoke(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for user, want := range map[string]bool { "alice": false, "bob": false, "carol": true } {
+		if _, found := fw.cache.AuthTime(user); found != want {
+			t.Errorf("login time of %s kept %t, want %t", user, found, want)
+		}
+	}
+	entries, _ := fw.cache.Entries()
+	if len(entries) != 1 || entries[0].user != "carol" {
+		t.Errorf("entries %v left, want only carol's", entries)
+	}
+}
+
+func TestGrantGroups(t *testing.T) {
+	tests := []struct {
+		name		string
+		groups		[]string
+		wantSets	[]string
+	}{
+		{ "no groups", nil, []string {"portknob-net4"} },
+		{ "one group", []string {"web"}, []string {"portknob-net4", "portknob-web-net4"} },
+		{ "unknown group", []string {"ssh"}, []string {"portknob-net4"} },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			fw, backend := newTestFirewall(t)
+			_, _, err := fw.Grant(net.ParseIP("192.0.2.7"), "alice", tt.groups, nil, time.Hour, time.Time {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(backend.elements) != len(tt.wantSets) {
+				t.Errorf("elements %v, want %q", backend.elements, tt.wantSets)
+			}
+			for _, setName := range tt.wantSets {
+				if !backend.elements[setName + " 192.0.2.7"] {
+					t.Errorf("192.0.2.7 not in %s", setName)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordDenied(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	fw, backend := newTestFirewall(t)
+	start := time.Date(2025, 2, 1, 10, 30, 0, 0, time.UTC)
+	steps := []struct {
+		counters	map[string]uint64
+		at			time.Duration
+	} {
+		// Counted since the rules were set up
+		{map[string]uint64 {"tcp/22": 10, "udp/53": 4}, 0},
+		{map[string]uint64 {"tcp/22": 25, "udp/53": 4}, time.Minute},
+		// Reloaded, tcp/22 was inserted again and counts from zero
+		{map[string]uint64 {"tcp/22": 3, "udp/53": 6}, time.Hour},
+		// Unreadable counters change nothing
+		{nil, time.Hour + time.Minute},
+	}
+	for _, step := range steps {
+		backend.denied = step.counters
+		fw.recordDenied(start.Add(step.at))
+	}
+
+	counts, err := fw.cache.Denied(start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 {
+		t.Fatalf("got %d rules, want 2", len(counts))
+	}
+	tcp, udp := counts[0], counts[1]
+	if tcp.label != "tcp/22" || tcp.total != 28 || udp.label != "udp/53" || udp.total != 6 {
+		t.Errorf("totals = %+v %+v, want tcp/22 28 and udp/53 6", tcp, udp)
+	}
+	last := deniedHistoryHours - 1
+	if tcp.hourly[last - 1] != 25 || tcp.hourly[last] != 3 || udp.hourly[last - 1] != 4 || udp.hourly[last] != 2 {
+		t.Errorf("hourly = %v %v, want 25 then 3 and 4 then 2", tcp.hourly, udp.hourly)
+	}
+
+	var metrics bytes.Buffer
+	fw.metrics.WriteTo(&metrics, 0, 0)
+	if !strings.Contains(metrics.String(), "portknob_denied_packets_total{rule=\"tcp/22\"} 28\n") {
+		t.Errorf("metrics lack the tcp/22 count:\n%s", metrics.String())
+	}
+
+	// Hours older than the history are dropped
+	backend.denied = map[string]uint64 {"tcp/22": 4, "udp/53": 6}
+	fw.recordDenied(start.Add(30 * time.Hour))
+	counts, _ = fw.cache.Denied(start.Add(30 * time.Hour))
+	for _, count := range counts {
+		for i, packets := range count.hourly[:last] {
+			if packets != 0 {
+				t.Errorf("%s: hour %d kept %d packets", count.label, i, packets)
+			}
+		}
+	}
+}
+
+func TestPeerClockSkew(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	tests := []struct {
+		name		string
+		// How far the clock of the peer which wrote the entries is ahead
+		skew		time.Duration
+		shared		bool
+		// Whether an entry the peer wrote an hour ago is live until the sweep, it expired a minute ago ahead or expires in a minute behind
+		wantLive	bool
+		wantCorrected	bool
+	}{
+		{ "ahead", 10 * time.Minute, true, false, true },
+		{ "behind", -10 * time.Minute, true, true, true },
+		{ "within max-peer-clock-skew", 10 * time.Second, true, false, false },
+		{ "bolt", 10 * time.Minute, false, true, false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			fw, backend := newTestFirewall(t)
+			fw.conf.Daemon.MaxPeerClockSkew = 30
+			var cookieLifespan uint64
+			fw.conf.Daemon.CookieLifespan = &cookieLifespan
+			backend.timeouts = make(map[string]time.Duration)
+			if tt.shared {
+				fw.cache.store = sharedStore { fw.cache.store }
+			}
+			now := time.Now()
+			old := net.IPv4(192, 0, 2, 1)
+			fresh := net.IPv4(198, 51, 100, 1)
+			// The old entry really expires a minute ago ahead, but only in the clock of the peer behind
+			oldExpires := now.Add(-time.Minute)
+			if tt.skew < 0 {
+				oldExpires = now.Add(time.Minute)
+			}
+			format := func (at time.Time) string {
+				return at.Add(tt.skew).UTC().Format(time.RFC3339Nano)
+			}
+			err := fw.cache.store.Update(func (tx cacheTx) error {
+				err := tx.Put("portknob", old.String(), format(oldExpires) + " " + format(oldExpires.Add(-time.Hour)) + "@peer alice")
+				if err != nil { return err }
+				return tx.Put("portknob", fresh.String(), format(now.Add(time.Hour)) + " " + format(now) + "@peer bob")
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Not the first sync, which cannot tell when the entries were written
+			fw.lastSync = now.Add(-10 * time.Second)
+
+			if tt.shared {
+				fw.syncShared()
+				timeout := backend.timeouts["portknob-net4 " + fresh.String()]
+				if timeout < time.Hour - 15 * time.Second || timeout > time.Hour + time.Second {
+					t.Errorf("timeout of the fresh entry = %s, want an hour", timeout)
+				}
+				clock, ok := fw.PeerClocks()["peer"]
+				if !ok || (clock.skew - tt.skew).Abs() > 15 * time.Second {
+					t.Errorf("estimated skew = %s, %t, want %s", clock.skew, ok, tt.skew)
+				}
+			}
+			cached, err := fw.cache.Entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, live := fw.liveExpiry(cached, old, ""); live != tt.wantLive {
+				t.Errorf("liveExpiry() of the old entry = %t, want %t", live, tt.wantLive)
+			}
+
+			fw.doCleanup()
+			cached, err = fw.cache.Entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			kept := false
+			for _, entry := range cached {
+				if entry.addr.Equal(old) {
+					kept = true
+				}
+			}
+			if kept != tt.wantLive {
+				t.Errorf("old entry kept by the sweep = %t, want %t", kept, tt.wantLive)
+			}
+			clock, ok := fw.PeerClocks()["peer"]
+			if corrected := ok && clock.skew.Abs() > 30 * time.Second; corrected != tt.wantCorrected {
+				t.Errorf("corrected = %t, want %t", corrected, tt.wantCorrected)
+			}
+			if !tt.shared && len(fw.PeerClocks()) != 0 {
+				t.Errorf("PeerClocks() = %v in bolt mode, want none", fw.PeerClocks())
+			}
+		})
+	}
+}
+
+func TestParseEntryNode(t *testing.T) {
+	tests := []struct {
+		name		string
+		value		string
+		wantNode	string
+		wantCreated	bool
+	}{
+		{ "with host", "never 2024-01-02T03:04:05Z@gw1 alice", "gw1", true },
+		{ "before schema version 12", "never 2024-01-02T03:04:05Z alice", "", true },
+		{ "before schema version 5", "never", "", false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			entry, ok := parseEntry("192.0.2.1", tt.value)
+			if !ok {
+				t.Fatal("parseEntry() failed")
+			}
+			if entry.node != tt.wantNode || entry.created.IsZero() == tt.wantCreated {
+				t.Errorf("parseEntry() = node %q, created %s, want node %q", entry.node, entry.created, tt.wantNode)
+			}
+		})
+	}
+}
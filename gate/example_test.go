@@ -0,0 +1,63 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package gate_test
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"github.com/5l1v3r1/portknob/gate"
+)
+
+func ExampleNew() {
+	// Stands in for the session-socket of portknob, which knows no session here
+	dir, _ := os.MkdirTemp("", "gate")
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "session.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"session": "invalid", "granted": false}`)
+	}))
+	defer ln.Close()
+
+	protect, err := gate.New(gate.Config {
+		Socket:		socket,
+		Rule:		"wiki",
+		LoginURL:	"https://knock.example.com/",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	wiki := protect(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello %s\n", gate.User(r))
+	}))
+
+	w := httptest.NewRecorder()
+	wiki.ServeHTTP(w, httptest.NewRequest("GET", "http://knock.example.com:8080/wiki/", nil))
+	fmt.Println(w.Code, w.Header().Get("Location"))
+	// Output: 303 https://knock.example.com/?next=http%3A%2F%2Fknock.example.com%3A8080%2Fwiki%2F
+}
@@ -0,0 +1,175 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+// Package gate protects the handlers of a web application with the login cookies of portknob on the same host
+//
+// The application asks the session-socket of portknob whether the login cookies of each request are valid,
+// and, with Rule, whether the subnet of the visitor is whitelisted for that firewall rule
+// Visitors without are redirected to the login page, which sends them back once they logged in
+//
+// Browsers only send the cookies to the application if it is served on the host name of portknob,
+// under its http-path, any port will do
+package gate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type Config struct {
+	// session-socket of portknob
+	// This is a mandatory option
+	Socket		string
+
+	// Firewall rule the subnet of the visitor must be whitelisted for, by its number as "2" or its comment
+	// Default: "" (a valid login cookie is enough)
+	Rule		string
+
+	// Login page of portknob, visitors are redirected there with "next" set to the URL they asked for
+	// This is a mandatory option
+	LoginURL	string
+
+	// Address of the visitor, e.g. taken from X-Real-IP behind a reverse proxy
+	// Default: the address of RemoteAddr
+	ClientIP	func (r *http.Request) net.IP
+
+	// Time to wait for portknob, which replies 502 Bad Gateway to the visitor after that
+	// Default: 5 seconds
+	Timeout		time.Duration
+}
+
+// What portknob says about the login cookies of a request
+type session struct {
+	// "valid", "invalid" or "revoked"
+	Session		string	`json:"session"`
+	User		string	`json:"user"`
+	Granted		*bool	`json:"granted"`
+	Error		string	`json:"error"`
+}
+
+type contextKey struct {}
+
+// Return the user logged in by the cookies of a request let through by the middleware of New
+func User(r *http.Request) string {
+	user, _ := r.Context().Value(contextKey {}).(string)
+	return user
+}
+
+// Return a middleware passing on the requests with valid login cookies of portknob, from a subnet whitelisted for Rule if set
+func New(conf Config) (func (http.Handler) http.Handler, error) {
+	if conf.Socket == "" {
+		return nil, errors.New("gate: Socket is required")
+	}
+	loginURL, err := url.Parse(conf.LoginURL)
+	if err != nil || conf.LoginURL == "" {
+		return nil, fmt.Errorf("gate: cannot parse LoginURL %q", conf.LoginURL)
+	}
+	if conf.ClientIP == nil {
+		conf.ClientIP = remoteIP
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = 5 * time.Second
+	}
+	client := &http.Client {
+		Transport:	&http.Transport {
+			DialContext:	func (ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", conf.Socket)
+			},
+		},
+		Timeout:	conf.Timeout,
+	}
+	return func (next http.Handler) http.Handler {
+		return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			clientIP := conf.ClientIP(r)
+			if clientIP == nil {
+				http.Error(w, "Bad Request: cannot find the address of the client", 400)
+				return
+			}
+			s, err := check(client, r, clientIP, conf.Rule)
+			if err != nil {
+				http.Error(w, "Bad Gateway: cannot check the login: " + err.Error(), 502)
+				return
+			}
+			if s.Session != "valid" || (s.Granted != nil && !*s.Granted) {
+				redirect := *loginURL
+				query := redirect.Query()
+				query.Set("next", requestURL(r))
+				redirect.RawQuery = query.Encode()
+				http.Redirect(w, r, redirect.String(), 303)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey {}, s.User)))
+		})
+	}, nil
+}
+
+// Ask portknob about the login cookies of r, passing on only those of portknob
+func check(client *http.Client, r *http.Request, clientIP net.IP, rule string) (*session, error) {
+	query := url.Values { "client": {clientIP.String()} }
+	if rule != "" {
+		query.Set("rule", rule)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "GET", "http://portknob/session?" + query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string {"portknob_user", "portknob_pass", "portknob_session"} {
+		if cookie, err := r.Cookie(name); err == nil {
+			req.AddCookie(&http.Cookie { Name: cookie.Name, Value: cookie.Value })
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var s session
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("portknob replied %d: %s", resp.StatusCode, s.Error)
+	}
+	return &s, nil
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// The URL a visitor asked for, to come back to after logging in
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
@@ -0,0 +1,331 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Grants of the control socket and the admin API can be previewed with dry_run=true, which changes nothing
+// The preview comes with a confirmation token, which commits the same grant once within grantTokenLifespan
+const grantTokenLifespan = time.Minute
+
+var (
+	errGrantTokenMissing = errors.New("grant needs the confirmation token of a dry run")
+	errGrantTokenInvalid = errors.New("confirmation token does not match the grant")
+	errGrantTokenExpired = errors.New("confirmation token has expired, run the dry run again")
+	errGrantTokenUsed = errors.New("confirmation token was already used")
+)
+
+// A grant as sent to the control socket or the admin API
+type grantRequest struct {
+	addr		net.IP
+	user		string
+	group		string
+	// Zero for the lifespans of the user and the rules, like a login, otherwise every entry gets it
+	duration	time.Duration
+}
+
+// What a grant would do, the reply of a dry run
+type grantPreview struct {
+	DryRun			bool				`json:"dry_run"`
+	Entries			[]grantPreviewEntry	`json:"entries"`
+	Commands		[]string			`json:"commands"`
+	Warnings		[]string			`json:"warnings"`
+	Token			string				`json:"token"`
+	TokenExpires	string				`json:"token_expires"`
+}
+
+type grantPreviewEntry struct {
+	Subnet		string	`json:"subnet"`
+	Group		string	`json:"group,omitempty"`
+	Set			string	`json:"set"`
+	Expires		string	`json:"expires"`
+}
+
+// Parse the address, user, group and duration in seconds of a grant
+func (s *server) parseGrantRequest(r *http.Request) (req grantRequest, err error) {
+	req.addr = net.ParseIP(r.PostFormValue("address"))
+	if req.addr == nil {
+		return req, errors.New("cannot parse address")
+	}
+	req.user = r.PostFormValue("user")
+	if duration := r.PostFormValue("duration"); duration != "" {
+		seconds, err := strconv.ParseUint(duration, 10, 64)
+		if err != nil {
+			return req, errors.New("cannot parse duration")
+		}
+		req.duration = time.Duration(seconds) * time.Second
+	}
+	req.group = r.PostFormValue("group")
+	if req.group != "" && !s.conf.hasGroup(req.group) {
+		return req, errors.New("no firewall rule has group " + strconv.Quote(req.group))
+	}
+	return req, nil
+}
+
+// Serve POST /grant for by, previewing the grant with dry_run=true and committing it with the token of the preview
+// Without a token the grant is committed right away, unless requireToken
+func (s *server) serveGrant(w http.ResponseWriter, r *http.Request, requireToken bool, by string) {
+	req, err := s.parseGrantRequest(r)
+	if err != nil {
+		s.writeJSON(w, 400, map[string]string { "error": err.Error() })
+		return
+	}
+	if dryRun := r.PostFormValue("dry_run"); dryRun != "" {
+		if ok, err := strconv.ParseBool(dryRun); err != nil {
+			s.writeJSON(w, 400, map[string]string { "error": "cannot parse dry_run" })
+			return
+		} else if ok {
+			preview, err := s.previewGrant(req, time.Now())
+			if err != nil {
+				s.writeJSON(w, 500, map[string]string { "error": "cannot read cache database" })
+				return
+			}
+			s.writeJSON(w, 200, preview)
+			return
+		}
+	}
+	if token := r.PostFormValue("token"); token != "" || requireToken {
+		err = s.checkGrantToken(req, token, time.Now())
+		if err != nil {
+			code, message := grantTokenFailure(err)
+			s.writeJSON(w, code, map[string]string { "error": message })
+			return
+		}
+	}
+	prefix, timeout, err := s.commitGrant(req, by)
+	if err != nil {
+		code, message := grantFailure(err)
+		s.writeJSON(w, code, map[string]string { "error": message })
+		return
+	}
+	expires := ""
+	if timeout != 0 {
+		expires = time.Now().Add(timeout).UTC().Format(time.RFC3339)
+	}
+	s.writeJSON(w, 200, map[string]string { "granted": fmt.Sprintf("%s/%d", req.addr, prefix), "expires": expires })
+}
+
+// Return the groups req whitelists at now and their lifespans, before expiry-jitter
+func (s *server) grantLifespans(req grantRequest, now time.Time) (groups []string, timeouts []time.Duration) {
+	var requested []string
+	if req.group != "" {
+		requested = append(requested, req.group)
+	}
+	if req.duration == 0 {
+		timeout := time.Duration(*s.conf.Daemon.FirewallLifespan) * time.Second
+		if lifespan, ok := s.conf.SecretsLifespan[req.user]; ok {
+			timeout = time.Duration(lifespan) * time.Second
+		}
+		return s.fw.grantLifespans(requested, nil, nil, timeout, time.Time {}, now)
+	}
+	for _, group := range s.conf.expandGroups(append([]string { "" }, requested...)) {
+		if _, ok := s.fw.sets[group]; ok {
+			groups = append(groups, group)
+			timeouts = append(timeouts, s.fw.ClampLifespan(req.duration))
+		}
+	}
+	return
+}
+
+// Whitelist req, returning the prefix and the longest lifespan given, 0 being the longest
+// Whitelist req on behalf of by, who is notified about as nobody logged in
+func (s *server) commitGrant(req grantRequest, by string) (prefix uint, longest time.Duration, err error) {
+	if req.duration != 0 {
+		longest = s.fw.ClampLifespan(req.duration)
+		groups, _ := s.grantLifespans(req, time.Now())
+		prefix, err = s.fw.InsertTimeout(req.addr, req.user, groups, longest, true)
+	} else {
+		var groups []string
+		if req.group != "" {
+			groups = append(groups, req.group)
+		}
+		timeout := time.Duration(*s.conf.Daemon.FirewallLifespan) * time.Second
+		if lifespan, ok := s.conf.SecretsLifespan[req.user]; ok {
+			timeout = time.Duration(lifespan) * time.Second
+		}
+		prefix, longest, err = s.fw.Grant(req.addr, req.user, groups, nil, timeout, time.Time {})
+	}
+	if err != nil {
+		return
+	}
+	// For the access review, the entries look like those of a login otherwise
+	var entries []cacheEntry
+	granted, _ := s.grantLifespans(req, time.Now())
+	for _, group := range granted {
+		entries = append(entries, cacheEntry { addr: req.addr, group: group })
+	}
+	if err := s.fw.cache.SetGrantedBy(entries, by); err != nil {
+		log.Println(err)
+	}
+	subnet := fmt.Sprintf("%s/%d", req.addr, prefix)
+	var expires time.Time
+	if longest != 0 {
+		expires = time.Now().Add(longest)
+	}
+	message := fmt.Sprintf("%s whitelisted %s until %s", by, subnet, formatExpiry(expires))
+	if req.user != "" {
+		message = fmt.Sprintf("%s whitelisted %s for user %q until %s", by, subnet, req.user, formatExpiry(expires))
+	}
+	s.fw.notify.Event("grant", message, "by", by, "user", req.user, "client", req.addr, "subnet", subnet, "group", req.group, "expires", formatExpiry(expires))
+	return
+}
+
+func grantFailure(err error) (code int, message string) {
+	if err == errFirewallStopping {
+		return 503, "service is shutting down"
+	}
+	return 500, "cannot update firewall"
+}
+
+func grantTokenFailure(err error) (code int, message string) {
+	switch err {
+	case errGrantTokenMissing, errGrantTokenInvalid, errGrantTokenExpired, errGrantTokenUsed:
+		return 400, err.Error()
+	}
+	return 500, "cannot read cache database"
+}
+
+// Return what whitelisting req at now would do, without changing anything
+func (s *server) previewGrant(req grantRequest, now time.Time) (*grantPreview, error) {
+	cached, err := s.fw.cache.Entries()
+	if err != nil {
+		return nil, err
+	}
+	preview := &grantPreview {
+		DryRun:		true,
+		Entries:	[]grantPreviewEntry {},
+		Commands:	[]string {},
+		Warnings:	[]string {},
+	}
+	subnet := s.fw.Subnet(req.addr)
+	groups, timeouts := s.grantLifespans(req, now)
+	for i, group := range groups {
+		setName, prefix := s.fw.setFor(req.addr, group)
+		timeout := s.fw.elementTimeout(group, timeouts[i])
+		// Zero for entries which never expire
+		var expires time.Time
+		if timeout != 0 {
+			expires = now.Add(timeout)
+		}
+		preview.Entries = append(preview.Entries, grantPreviewEntry { subnet.String(), group, setName, formatExpiry(expires) })
+		preview.Commands = append(preview.Commands, strings.Join(s.fw.backend.ElementCommand(setName, req.addr, prefix, timeout), " "))
+	}
+
+	if len(groups) == 0 {
+		preview.Warnings = append(preview.Warnings, "no firewall rule applies, nothing would be whitelisted")
+	}
+	if ones, bits := subnet.Mask.Size(); bits == 32 && ones < 24 || bits == 128 && ones < 48 {
+		preview.Warnings = append(preview.Warnings, fmt.Sprintf("%s is a broad subnet, every address in it would be whitelisted", subnet))
+	}
+	if maxLifespan := s.conf.Daemon.AbsoluteMaxLifespan; req.duration != 0 && maxLifespan != 0 && req.duration > time.Duration(maxLifespan) * time.Second {
+		preview.Warnings = append(preview.Warnings, fmt.Sprintf("duration is cut to absolute-max-lifespan (%s)", formatLifespan(maxLifespan)))
+	}
+	if jitter := s.conf.Daemon.ExpiryJitter; jitter != 0 && req.duration == 0 {
+		preview.Warnings = append(preview.Warnings, fmt.Sprintf("expiry-jitter shortens the lifespans by up to %s", formatLifespan(jitter)))
+	}
+	for _, entry := range cached {
+		other := s.fw.Subnet(entry.addr)
+		if !entry.live(now) || !other.Contains(subnet.IP) && !subnet.Contains(other.IP) {
+			continue
+		}
+		preview.Warnings = append(preview.Warnings, fmt.Sprintf("%s overlaps the grant of %s (user %q, group %q) which expires %s", subnet, entry.addr, entry.user, entry.group, formatExpiry(entry.expires)))
+	}
+
+	var expires time.Time
+	preview.Token, expires, err = s.grantToken(req, now)
+	if err != nil {
+		return nil, err
+	}
+	preview.TokenExpires = expires.UTC().Format(time.RFC3339)
+	return preview, nil
+}
+
+// Return the confirmation token of a dry run of req at now, "expiry.mac" signed with the key of the login cookies
+func (s *server) grantToken(req grantRequest, now time.Time) (token string, expires time.Time, err error) {
+	key, err := s.fw.cache.CookieKey()
+	if err != nil {
+		return "", time.Time {}, err
+	}
+	expires = now.Add(grantTokenLifespan)
+	payload := strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + grantMAC(key, s.fw.cache.GlobalEpoch(), req, payload), expires, nil
+}
+
+// The MAC covers every field of the grant, so the token commits nothing else, and the global epoch, so a panic voids every token
+func grantMAC(key []byte, epoch uint64, req grantRequest, expires string) string {
+	fields := []string {req.addr.String(), req.user, req.group, strconv.FormatInt(int64(req.duration / time.Second), 10), expires, strconv.FormatUint(epoch, 10)}
+	return sessionMAC(key, "portknob-grant", strings.Join(fields, "\x00"))
+}
+
+// Check the confirmation token of req at now, which is then used up
+func (s *server) checkGrantToken(req grantRequest, token string, now time.Time) error {
+	if token == "" {
+		return errGrantTokenMissing
+	}
+	payload, mac, ok := strings.Cut(token, ".")
+	if !ok {
+		return errGrantTokenInvalid
+	}
+	// Tokens from before a rotation of the key stay valid for their short lifespan
+	keys, err := s.fw.cache.CookieKeys(grantTokenLifespan, now)
+	if err != nil {
+		return err
+	}
+	signed := false
+	for _, key := range keys {
+		if hmac.Equal([]byte(mac), []byte(grantMAC(key, s.fw.cache.GlobalEpoch(), req, payload))) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return errGrantTokenInvalid
+	}
+	unix, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return errGrantTokenInvalid
+	}
+	expires := time.Unix(unix, 0)
+	if !now.Before(expires) {
+		return errGrantTokenExpired
+	}
+
+	s.grantMutex.Lock()
+	defer s.grantMutex.Unlock()
+	for used, usedExpires := range s.usedGrantTokens {
+		if !now.Before(usedExpires) {
+			delete(s.usedGrantTokens, used)
+		}
+	}
+	if _, ok := s.usedGrantTokens[token]; ok {
+		return errGrantTokenUsed
+	}
+	s.usedGrantTokens[token] = expires
+	return nil
+}
@@ -0,0 +1,254 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testGrantConfig = "admin-path = \"/admin\"\nadmin-allow = [\"192.0.2.0/24\"]\n[[firewall]]\ndport = \"22\"\n[[firewall]]\ndport = \"80\"\ngroup = \"web\"\n"
+
+// Post form to a handler of s, as a page of the admin host would
+func testGrantPost(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Origin", "http://example.com")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestGrantToken(t *testing.T) {
+	req := grantRequest { net.ParseIP("192.0.2.7"), "alice", "web", time.Hour }
+	tests := []struct {
+		name	string
+		// Changes the grant the token is checked against
+		change	func (req *grantRequest)
+		token	func (token string) string
+		after	time.Duration
+		want	error
+	}{
+		{ "valid", nil, nil, 30 * time.Second, nil },
+		{ "expired", nil, nil, grantTokenLifespan, errGrantTokenExpired },
+		{ "other address", func (req *grantRequest) { req.addr = net.ParseIP("192.0.2.8") }, nil, 0, errGrantTokenInvalid },
+		{ "other user", func (req *grantRequest) { req.user = "bob" }, nil, 0, errGrantTokenInvalid },
+		{ "other group", func (req *grantRequest) { req.group = "" }, nil, 0, errGrantTokenInvalid },
+		{ "other duration", func (req *grantRequest) { req.duration = 2 * time.Hour }, nil, 0, errGrantTokenInvalid },
+		{ "later expiry", nil, func (token string) string { return "9" + token }, 0, errGrantTokenInvalid },
+		{ "garbled", nil, func (token string) string { return "garbled" }, 0, errGrantTokenInvalid },
+		{ "missing", nil, func (token string) string { return "" }, 0, errGrantTokenMissing },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			s, _ := newTestServer(t, "")
+			now := time.Now()
+			token, expires, err := s.grantToken(req, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !expires.Equal(now.Add(grantTokenLifespan)) {
+				t.Errorf("token expires %s, want %s", expires, now.Add(grantTokenLifespan))
+			}
+			checked := req
+			if tt.change != nil {
+				tt.change(&checked)
+			}
+			if tt.token != nil {
+				token = tt.token(token)
+			}
+			if err := s.checkGrantToken(checked, token, now.Add(tt.after)); err != tt.want {
+				t.Fatalf("checkGrantToken() = %v, want %v", err, tt.want)
+			}
+			if tt.want == nil {
+				if err := s.checkGrantToken(checked, token, now.Add(tt.after)); err != errGrantTokenUsed {
+					t.Errorf("second checkGrantToken() = %v, want %v", err, errGrantTokenUsed)
+				}
+			}
+		})
+	}
+}
+
+// The dry run renders the commands of the real backends and changes nothing
+func TestGrantDryRun(t *testing.T) {
+	tests := []struct {
+		name	string
+		backend	string
+		// Extra daemon options
+		options	string
+		form	url.Values
+	}{
+		{ "iptables", "iptables", "", url.Values { "address": {"192.0.2.7"}, "user": {"alice"}, "group": {"web"}, "duration": {"600"} } },
+		{ "nftables", "nftables", "", url.Values { "address": {"192.0.2.7"}, "user": {"alice"}, "group": {"web"}, "duration": {"600"} } },
+		{ "lifespan of the rules", "iptables", "", url.Values { "address": {"192.0.2.7"} } },
+		{ "overlap", "iptables", "", url.Values { "address": {"198.51.100.9"}, "duration": {"600"} } },
+		{ "broad subnet", "iptables", "ipv4-prefix = 16\n", url.Values { "address": {"192.0.2.7"}, "duration": {"600"} } },
+		{ "capped", "iptables", "absolute-max-lifespan = 300\nexpiry-jitter = 60\n", url.Values { "address": {"192.0.2.7"}, "duration": {"600"} } },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			log.SetOutput(io.Discard)
+			defer log.SetOutput(os.Stderr)
+			s, backend := newTestServer(t, tt.options + testGrantConfig)
+			_, err := s.fw.InsertTimeout(net.ParseIP("198.51.100.7"), "bob", []string {""}, time.Hour, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, _ := s.fw.cache.Entries()
+			elements := len(backend.elements)
+			s.fw.backend = newFirewallBackend(tt.backend, s.fw)
+
+			form := url.Values { "dry_run": {"true"} }
+			for k, v := range tt.form {
+				form[k] = v
+			}
+			w := testGrantPost(s.controlHandlerFunc, "/grant", form)
+			if w.Code != 200 {
+				t.Fatalf("dry run replied %d: %s", w.Code, w.Body.String())
+			}
+			var preview grantPreview
+			err = json.Unmarshal(w.Body.Bytes(), &preview)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preview.Token == "" {
+				t.Error("dry run gave no token")
+			}
+			after, _ := s.fw.cache.Entries()
+			if len(after) != len(before) || len(backend.elements) != elements {
+				t.Errorf("dry run changed the cache (%d entries, want %d) or the firewall (%d elements, want %d)", len(after), len(before), len(backend.elements), elements)
+			}
+
+			// The token changes from one run to the next
+			body := regexp.MustCompile(`"token":"[^"]*"`).ReplaceAll(w.Body.Bytes(), []byte(`"token":"TOKEN"`))
+			w.Body.Reset()
+			w.Body.Write(body)
+			checkGolden(t, "grant-dry-run-" + strings.ReplaceAll(tt.name, " ", "-") + ".txt", w)
+		})
+	}
+}
+
+func TestGrantConfirm(t *testing.T) {
+	tests := []struct {
+		name		string
+		// Handler and path of the dry run and the grant
+		admin		bool
+		path		string
+		// Form values of the grant besides the token, nil for those of the dry run
+		confirm		url.Values
+		noToken		bool
+		wantCode	int
+	}{
+		{ "control socket", false, "/grant", nil, false, 200 },
+		{ "control socket without token", false, "/grant", nil, true, 200 },
+		{ "control socket other address", false, "/grant", url.Values { "address": {"192.0.2.8"}, "group": {"web"} }, false, 400 },
+		{ "admin API", true, "/admin/grant", nil, false, 200 },
+		{ "admin API without token", true, "/admin/grant", nil, true, 400 },
+		{ "admin API other group", true, "/admin/grant", url.Values { "address": {"192.0.2.7"} }, false, 400 },
+		{ "admin form", true, "/admin/confirm-grant", nil, false, 303 },
+		{ "admin form without token", true, "/admin/confirm-grant", nil, true, 400 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			log.SetOutput(io.Discard)
+			defer log.SetOutput(os.Stderr)
+			s, backend := newTestServer(t, testGrantConfig)
+			notifications := make(chan map[string]interface{}, 10)
+			s.fw.notify = &notifier { conf: configNotify { Events: notifyEvents }, webhook: notifications }
+			handler := s.controlHandlerFunc
+			wantBy := "control-socket"
+			if tt.admin {
+				handler = s.adminHandlerFunc
+				wantBy = "admin from 192.0.2.1"
+			}
+			form := url.Values { "address": {"192.0.2.7"}, "group": {"web"} }
+			var token string
+			if tt.path == "/admin/confirm-grant" {
+				// The confirmation page carries the token in a hidden field
+				w := testGrantPost(handler, "/admin/preview-grant", form)
+				if w.Code != 200 {
+					t.Fatalf("preview replied %d: %s", w.Code, w.Body.String())
+				}
+				match := regexp.MustCompile(`name="token" value="([^"]*)"`).FindStringSubmatch(w.Body.String())
+				if match == nil {
+					t.Fatalf("no token in the confirmation page:\n%s", w.Body.String())
+				}
+				token = match[1]
+			} else {
+				dryRun := url.Values { "dry_run": {"1"} }
+				for k, v := range form {
+					dryRun[k] = v
+				}
+				w := testGrantPost(handler, tt.path, dryRun)
+				var preview grantPreview
+				if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &preview) != nil {
+					t.Fatalf("dry run replied %d: %s", w.Code, w.Body.String())
+				}
+				token = preview.Token
+			}
+			if len(backend.elements) != 0 {
+				t.Fatalf("dry run whitelisted %v", backend.elements)
+			}
+
+			confirm := form
+			if tt.confirm != nil {
+				confirm = tt.confirm
+			}
+			if !tt.noToken {
+				confirm.Set("token", token)
+			}
+			w := testGrantPost(handler, tt.path, confirm)
+			if w.Code != tt.wantCode {
+				t.Fatalf("grant replied %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			granted := backend.elements["portknob-web-net4 192.0.2.7"]
+			if granted != (tt.wantCode != 400) {
+				t.Errorf("granted %t, want %t: %v", granted, tt.wantCode != 400, backend.elements)
+			}
+			// Someone else whitelisted the address, so there is no login to notify about
+			select {
+			case fields := <-notifications:
+				if tt.wantCode == 400 || fields["event"] != "grant" || fields["by"] != wantBy || fields["subnet"] != "192.0.2.7/24" {
+					t.Errorf("notified %v, want a grant by %q", fields, wantBy)
+				}
+			default:
+				if tt.wantCode != 400 {
+					t.Error("grant not notified about")
+				}
+			}
+			if tt.wantCode != 400 && !tt.noToken {
+				// The token commits the grant once
+				w := testGrantPost(handler, tt.path, confirm)
+				if w.Code != 400 {
+					t.Errorf("second grant with the token replied %d, want 400", w.Code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Key logins let scripts on headless servers log in by signing a challenge with an Ed25519 key instead of sending a password
+// Keys of [secrets] users come from [secrets-keys] and from "portknob key add", which keeps them in the cache database
+// A challenge works once, within keyChallengeLifespan, from the subnet it was issued to and for the user it names
+// The signature covers the user as well, so a key can only ever log in the user it is registered for
+
+const keyChallengeLifespan = 30 * time.Second
+
+// Challenges each subnet may ask for per minute
+const keyChallengeRateLimit = 10
+
+func (conf *config) keyPath() string {
+	return strings.TrimRight(conf.Daemon.HTTPPath, "/") + "/key/"
+}
+
+// What the client signs, a login key stays unusable for SSH logins as these data can never be an SSH session
+func keySignedData(user, challenge string) []byte {
+	return []byte("portknob-key-login\n" + user + "\n" + challenge)
+}
+
+// Parse an Ed25519 public key in the authorized_keys format
+func parseLoginKey(line string) (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, err
+	}
+	if key.Type() != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("key type %q is not %q", key.Type(), ssh.KeyAlgoED25519)
+	}
+	return key, nil
+}
+
+// Return the keys of user from [secrets-keys] and the cache database
+func (s *server) loginKeys(user string) ([]ssh.PublicKey, error) {
+	registered, err := s.fw.cache.LoginKeys()
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for _, line := range append(append([]string(nil), s.conf.SecretsKeys[user]...), registered[user]...) {
+		if key, err := parseLoginKey(line); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Serve POST <http-path>/key/challenge and <http-path>/key/login, both with the form field "username"
+func (s *server) keyHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+
+	clientIP, refused := s.checkClient(w, r)
+	if refused {
+		return
+	}
+	if r.Method != "POST" {
+		s.writeError(w, r, 405, "method-not-allowed", "Method Not Allowed")
+		return
+	}
+	if clientIP == nil {
+		s.writeError(w, r, 500, "internal", "cannot find client's IP address")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	switch strings.TrimPrefix(r.URL.Path, s.conf.keyPath()) {
+	case "challenge":
+		s.issueKeyChallenge(w, r, clientIP, r.PostFormValue("username"), time.Now())
+	case "login":
+		s.keyLogin(w, r, clientIP, r.PostFormValue("username"), time.Now())
+	default:
+		s.writeError(w, r, 404, "not-found", "Not Found")
+	}
+}
+
+// Reply with a challenge for user, whether it has keys or not so users cannot be told apart
+func (s *server) issueKeyChallenge(w http.ResponseWriter, r *http.Request, clientIP net.IP, user string, now time.Time) {
+	subnet := s.fw.Subnet(clientIP).String()
+	if allowed, retry := s.challengeLimiter.Allow(subnet, keyChallengeRateLimit, now); !allowed {
+		w.Header().Set("Retry-After", fmt.Sprint(int(retry / time.Second) + 1))
+		s.writeError(w, r, 429, "rate-limited", "Too Many Requests: too many challenges, try again later")
+		return
+	}
+	challenge := randomToken()
+	expires := now.Add(keyChallengeLifespan)
+	err := s.fw.cache.AddKeyChallenge(tokenHash(challenge), keyChallenge { user, subnet, expires })
+	if err != nil {
+		log.Println(err)
+		s.writeError(w, r, 500, "internal", "cannot update cache database")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	fmt.Fprintf(w, "OK challenge=%s expires=%s\n", challenge, expires.UTC().Format(time.RFC3339))
+}
+
+// Whitelist clientIP if the form signs a challenge issued to its subnet for user with a key of user, like a knock
+func (s *server) keyLogin(w http.ResponseWriter, r *http.Request, clientIP net.IP, user string, now time.Time) {
+	challenge := r.PostFormValue("challenge")
+	signature, err := base64.StdEncoding.DecodeString(r.PostFormValue("signature"))
+	// Used up whatever the outcome, a replay finds nothing
+	issued, valid, err2 := s.fw.cache.UseKeyChallenge(tokenHash(challenge), now)
+	if err2 != nil {
+		log.Println(err2)
+		s.writeError(w, r, 500, "internal", "cannot update cache database")
+		return
+	}
+	valid = valid && err == nil && issued.user == user && issued.subnet == s.fw.Subnet(clientIP).String()
+	if valid {
+		keys, err := s.loginKeys(user)
+		if err != nil {
+			s.writeError(w, r, 500, "internal", "cannot read cache database")
+			return
+		}
+		valid = false
+		for _, key := range keys {
+			pub := key.(ssh.CryptoPublicKey).CryptoPublicKey().(ed25519.PublicKey)
+			if ed25519.Verify(pub, keySignedData(user, challenge), signature) {
+				valid = true
+				break
+			}
+		}
+	}
+	if !valid {
+		s.auditLogin("failure", "key", user, clientIP)
+		s.countFailure(clientIP, user)
+		s.writeError(w, r, 401, "unauthorized", "Unauthorized: unknown or expired challenge, or wrong signature")
+		return
+	}
+
+	timeout, allowed, boundary := s.loginTimeout(user, now)
+	if !allowed {
+		s.auditLogin("forbidden", "key", user, clientIP)
+		s.writeScheduleForbidden(w, r, boundary)
+		return
+	}
+	prefix, timeout, notes, err := s.grantLogin(clientIP, user, "key", s.conf.SecretsGroups[user], timeout, s.loginDeadline(user, boundary), now)
+	if err != nil {
+		s.writeGrantLoginError(w, r, err, now)
+		return
+	}
+	s.fw.metrics.AuthSuccess(user)
+	gated, _ := s.conf.gatedGroups(s.conf.SecretsGroups[user])
+	s.auditSuccess("key", user, clientIP, gated)
+	if s.conf.Daemon.Verbose >= 1 {
+		log.Printf("User %q logged in with a key, whitelisted %s/%d\n", user, clientIP, prefix)
+	}
+	s.writeLoginSucceeded(w, r, clientIP, prefix, timeout, "", append(s.gatedNotes(w, gated), notes...), false)
+}
+
+type loginKeyInfo struct {
+	User		string	`json:"user"`
+	Fingerprint	string	`json:"fingerprint"`
+	Key		string	`json:"key"`
+	// "config" for [secrets-keys], which only the configuration file changes, or "cache"
+	Source		string	`json:"source"`
+}
+
+// Serve GET /keys, POST /keys with "user" and "key", and POST /keys/remove with "user" and "fingerprint" on the control socket
+func (s *server) controlKeys(w http.ResponseWriter, r *http.Request, by string) {
+	switch {
+	case r.URL.Path == "/keys" && r.Method == "GET":
+		registered, err := s.fw.cache.LoginKeys()
+		if err != nil {
+			s.writeJSON(w, 500, map[string]string { "error": "cannot read cache database" })
+			return
+		}
+		keys := []loginKeyInfo {}
+		for source, lists := range map[string]map[string][]string { "config": s.conf.SecretsKeys, "cache": registered } {
+			for user, lines := range lists {
+				for _, line := range lines {
+					if key, err := parseLoginKey(line); err == nil {
+						keys = append(keys, loginKeyInfo { user, ssh.FingerprintSHA256(key), strings.TrimSpace(line), source })
+					}
+				}
+			}
+		}
+		sort.Slice(keys, func (i, j int) bool {
+			return keys[i].User < keys[j].User || keys[i].User == keys[j].User && keys[i].Fingerprint < keys[j].Fingerprint
+		})
+		s.writeJSON(w, 200, map[string][]loginKeyInfo { "keys": keys })
+	case r.URL.Path == "/keys" && r.Method == "POST":
+		user := r.PostFormValue("user")
+		if _, found := s.conf.Secrets[user]; !found {
+			s.writeJSON(w, 400, map[string]string { "error": "user is not in [secrets]" })
+			return
+		}
+		line := strings.TrimSpace(r.PostFormValue("key"))
+		key, err := parseLoginKey(line)
+		if err != nil {
+			s.writeJSON(w, 400, map[string]string { "error": "cannot parse key: " + err.Error() })
+			return
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		err = s.fw.cache.AddLoginKey(user, fingerprint, line)
+		if err != nil {
+			log.Println(err)
+			s.writeJSON(w, 500, map[string]string { "error": "cannot update cache database" })
+			return
+		}
+		s.fw.audit.Event("login-key-add", "user", user, "fingerprint", fingerprint, "by", by)
+		s.writeJSON(w, 200, map[string]string { "user": user, "fingerprint": fingerprint })
+	case r.URL.Path == "/keys/remove" && r.Method == "POST":
+		user, fingerprint := r.PostFormValue("user"), r.PostFormValue("fingerprint")
+		found, err := s.fw.cache.RemoveLoginKey(user, fingerprint)
+		if err != nil {
+			log.Println(err)
+			s.writeJSON(w, 500, map[string]string { "error": "cannot update cache database" })
+			return
+		}
+		if !found {
+			s.writeJSON(w, 404, map[string]string { "error": "no such key registered, keys of [secrets-keys] are removed from the configuration" })
+			return
+		}
+		s.fw.audit.Event("login-key-remove", "user", user, "fingerprint", fingerprint, "by", by)
+		s.writeJSON(w, 200, map[string]string { "user": user, "fingerprint": fingerprint })
+	default:
+		s.writeJSON(w, 404, map[string]string { "error": "not found" })
+	}
+}
+
+var errClientUsage = errors.New(`Usage:
+  portknob client [-user USER] [-key FILE] <URL of the login page>
+
+Without -key, the first Ed25519 key of the running ssh-agent signs, a FILE ending in .pub picks one of its keys`)
+
+// Log in to the portknob at the URL in args by signing a challenge, for scripts and cron jobs
+func runKeyClient(args []string) error {
+	flags := flag.NewFlagSet("client", flag.ContinueOnError)
+	user := flags.String("user", os.Getenv("USER"), "User to log in as")
+	keyFile := flags.String("key", "", "Ed25519 private key file, or public key file of a key in ssh-agent")
+	err := flags.Parse(args[1:])
+	if err != nil || flags.NArg() == 0 {
+		return errClientUsage
+	}
+	base := flags.Arg(0)
+	err = flags.Parse(flags.Args()[1:])
+	if err != nil || flags.NArg() != 0 || *user == "" {
+		return errClientUsage
+	}
+	signer, err := keySigner(*keyFile)
+	if err != nil {
+		return err
+	}
+	base = strings.TrimRight(base, "/") + "/key/"
+	client := &http.Client { Timeout: 30 * time.Second }
+	post := func (path string, form url.Values) (string, error) {
+		resp, err := client.PostForm(base + path + "?plain=1", form)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		reply, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		reply = strings.TrimSpace(reply)
+		if resp.StatusCode != 200 {
+			if reply == "" {
+				reply = resp.Status
+			}
+			return "", errors.New(reply)
+		}
+		return reply, nil
+	}
+
+	reply, err := post("challenge", url.Values { "username": {*user} })
+	if err != nil {
+		return fmt.Errorf("cannot get a challenge: %s", err)
+	}
+	challenge := ""
+	for _, field := range strings.Fields(reply) {
+		if strings.HasPrefix(field, "challenge=") {
+			challenge = strings.TrimPrefix(field, "challenge=")
+		}
+	}
+	if challenge == "" {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	signature, err := signer.Sign(rand.Reader, keySignedData(*user, challenge))
+	if err != nil {
+		return err
+	}
+	reply, err = post("login", url.Values {
+		"username":	{ *user },
+		"challenge":	{ challenge },
+		"signature":	{ base64.StdEncoding.EncodeToString(signature.Blob) },
+	})
+	if err != nil {
+		return fmt.Errorf("login failed: %s", err)
+	}
+	fmt.Println(reply)
+	return nil
+}
+
+// Return the signer of the Ed25519 key in path, of the ssh-agent key of the public key in path, or of the first Ed25519 key of the agent
+// Keys with a passphrase must be loaded in the agent
+func keySigner(path string) (ssh.Signer, error) {
+	var want ssh.PublicKey
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(path, ".pub") {
+			signer, err := ssh.ParsePrivateKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse %q: %s", path, err)
+			}
+			if signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+				return nil, fmt.Errorf("%q is not an Ed25519 key", path)
+			}
+			return signer, nil
+		}
+		want, err = parseLoginKey(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %q: %s", path, err)
+		}
+	}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("no -key given and no ssh-agent running")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach ssh-agent: %s", err)
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the keys of ssh-agent: %s", err)
+	}
+	for _, signer := range signers {
+		key := signer.PublicKey()
+		if key.Type() == ssh.KeyAlgoED25519 && (want == nil || string(key.Marshal()) == string(want.Marshal())) {
+			return signer, nil
+		}
+	}
+	return nil, errors.New("ssh-agent has no such Ed25519 key")
+}
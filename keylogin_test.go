@@ -0,0 +1,211 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"golang.org/x/crypto/ssh"
+)
+
+// Return a new Ed25519 key and its public key in the authorized_keys format
+func testLoginKey(t *testing.T) (ed25519.PrivateKey, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func testKeyRequest(s *server, addr, path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/key/" + path + "?plain=1", strings.NewReader(form.Encode()))
+	r.RemoteAddr = addr + ":5000"
+	r.Header.Set("X-Real-IP", addr)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.keyHandlerFunc(w, r)
+	return w
+}
+
+// Ask for a challenge for user from addr
+func testChallenge(t *testing.T, s *server, addr, user string) string {
+	w := testKeyRequest(s, addr, "challenge", url.Values { "username": {user} })
+	if w.Code != 200 || !strings.HasPrefix(w.Body.String(), "OK challenge=") {
+		t.Fatalf("challenge replied %d: %s", w.Code, w.Body.String())
+	}
+	return strings.TrimPrefix(strings.Fields(w.Body.String())[1], "challenge=")
+}
+
+func testKeyLogin(s *server, addr, user, challenge string, key ed25519.PrivateKey, signedUser string) *httptest.ResponseRecorder {
+	signature := ed25519.Sign(key, keySignedData(signedUser, challenge))
+	return testKeyRequest(s, addr, "login", url.Values {
+		"username":	{user},
+		"challenge":	{challenge},
+		"signature":	{base64.StdEncoding.EncodeToString(signature)},
+	})
+}
+
+func TestKeyLogin(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	alice, alicePub := testLoginKey(t)
+	bob, bobPub := testLoginKey(t)
+	s, backend := newTestServer(t, `allow-key-logins = true
+[[firewall]]
+dport = "22"
+[secrets]
+alice = "hunter2"
+bob = "hunter3"
+[secrets-keys]
+alice = [` + "\"" + alicePub + "\"" + `]
+`)
+	err := s.fw.cache.AddLoginKey("bob", "bob-key", bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := testChallenge(t, s, "192.0.2.7", "alice")
+	if w := testKeyLogin(s, "192.0.2.7", "alice", challenge, alice, "alice"); w.Code != 200 || !backend.elements["portknob-net4 192.0.2.7"] {
+		t.Fatalf("key login replied %d: %s", w.Code, w.Body.String())
+	}
+	if w := testKeyLogin(s, "192.0.2.7", "alice", challenge, alice, "alice"); w.Code != 401 {
+		t.Errorf("replayed login replied %d: %s", w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		name		string
+		// Subnet the challenge is asked from, and user it is asked for
+		issuedTo	string
+		issuedFor	string
+		addr		string
+		user		string
+		key		ed25519.PrivateKey
+		signedUser	string
+		wantCode	int
+	}{
+		{ "key of a registered user", "198.51.100.7", "bob", "198.51.100.7", "bob", bob, "bob", 200 },
+		{ "key of another user", "203.0.113.7", "alice", "203.0.113.7", "alice", bob, "alice", 401 },
+		{ "challenge of another user", "203.0.113.7", "bob", "203.0.113.7", "alice", alice, "alice", 401 },
+		{ "signature for another user", "203.0.113.7", "bob", "203.0.113.7", "bob", alice, "alice", 401 },
+		{ "challenge of another subnet", "198.51.100.8", "alice", "203.0.113.7", "alice", alice, "alice", 401 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			challenge := testChallenge(t, s, tt.issuedTo, tt.issuedFor)
+			w := testKeyLogin(s, tt.addr, tt.user, challenge, tt.key, tt.signedUser)
+			if w.Code != tt.wantCode {
+				t.Errorf("login replied %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+	if backend.elements["portknob-net4 203.0.113.7"] {
+		t.Error("a failed key login whitelisted 203.0.113.7")
+	}
+
+	// Expired
+	w := httptest.NewRecorder()
+	s.issueKeyChallenge(w, httptest.NewRequest("POST", "/key/challenge?plain=1", nil), []byte {203, 0, 113, 8}, "alice", time.Now().Add(-time.Minute))
+	challenge = strings.TrimPrefix(strings.Fields(w.Body.String())[1], "challenge=")
+	if w := testKeyLogin(s, "203.0.113.8", "alice", challenge, alice, "alice"); w.Code != 401 {
+		t.Errorf("expired challenge replied %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// portknob key add, list and remove
+func TestControlKeys(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	_, pub := testLoginKey(t)
+	s, _ := newTestServer(t, "[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\n")
+	control := func (method, path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.controlHandlerFunc(w, r)
+		return w
+	}
+	if w := control("POST", "/keys", url.Values { "user": {"mallory"}, "key": {pub} }); w.Code != 400 {
+		t.Errorf("key of an unknown user replied %d: %s", w.Code, w.Body.String())
+	}
+	w := control("POST", "/keys", url.Values { "user": {"alice"}, "key": {pub} })
+	if w.Code != 200 {
+		t.Fatalf("add replied %d: %s", w.Code, w.Body.String())
+	}
+	key, _ := parseLoginKey(pub)
+	fingerprint := ssh.FingerprintSHA256(key)
+	if w := control("GET", "/keys", nil); !strings.Contains(w.Body.String(), `"fingerprint":"` + fingerprint + `"`) {
+		t.Errorf("list replied %d without the key: %s", w.Code, w.Body.String())
+	}
+	if keys, _ := s.loginKeys("alice"); len(keys) != 1 {
+		t.Errorf("alice has %d keys, want 1", len(keys))
+	}
+	if w := control("POST", "/keys/remove", url.Values { "user": {"alice"}, "fingerprint": {fingerprint} }); w.Code != 200 {
+		t.Errorf("remove replied %d: %s", w.Code, w.Body.String())
+	}
+	if w := control("POST", "/keys/remove", url.Values { "user": {"alice"}, "fingerprint": {fingerprint} }); w.Code != 404 {
+		t.Errorf("second remove replied %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// portknob client signs with a key file
+func TestKeyClient(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	priv, pub := testLoginKey(t)
+	s, backend := newTestServer(t, "allow-key-logins = true\n[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\n[secrets-keys]\nalice = [\"" + pub + "\"]\n")
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	err = os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.servemux)
+	defer ts.Close()
+	stdout := os.Stdout
+	os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	err = runKeyClient([]string {"client", "-user", "alice", "-key", path, ts.URL + "/"})
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !backend.elements["portknob-net4 127.0.0.1"] {
+		t.Errorf("firewall has %v, want 127.0.0.1", backend.elements)
+	}
+	if err := runKeyClient([]string {"client", "-user", "bob", "-key", path, ts.URL}); err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("login of bob with the key of alice returned %v", err)
+	}
+}
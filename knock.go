@@ -0,0 +1,261 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type configKnock struct {
+	// Ports to hit in order, e.g. [{ port = 7000 }, { port = 8000, proto = "tcp", timeout = 5 }]
+	// This is a mandatory option
+	Steps			[]configKnockStep	`toml:"steps"`
+
+	// Seconds allowed to hit a step after the previous one, for steps without their own timeout
+	// Default: 10
+	StepTimeout		uint64			`toml:"step-timeout"`
+}
+
+type configKnockStep struct {
+	// Port number
+	// This is a mandatory option
+	Port			uint16			`toml:"port"`
+
+	// Protocol name
+	// Supported values: "udp", "tcp"
+	// Default: "udp"
+	Proto			string			`toml:"proto"`
+
+	// Seconds allowed to hit this step after the previous one
+	// Default: 0 (use step-timeout)
+	Timeout			uint64			`toml:"timeout"`
+}
+
+func (knock *configKnock) parse(conf *config, user string) error {
+	if _, ok := conf.Secrets[user]; !ok {
+		return &configError { fmt.Sprintf("knock sequence for unknown user %q\n", user) }
+	}
+	if _, ok := conf.totpKeys[user]; ok {
+		// A knock cannot carry the one-time code
+		return &configError { fmt.Sprintf("user %q has a TOTP seed and cannot have a knock sequence\n", user) }
+	}
+	if len(knock.Steps) == 0 {
+		return &configError { fmt.Sprintf("option \"steps\" not specified in [knock.%s]\n", user) }
+	}
+	if len(knock.Steps) < 3 {
+		log.Printf("Warning: knock sequence of user %q has only %d steps, port scans may complete it\n", user, len(knock.Steps))
+	}
+	if knock.StepTimeout == 0 {
+		knock.StepTimeout = 10
+	}
+	for i := range knock.Steps {
+		step := &knock.Steps[i]
+		if step.Port == 0 {
+			return conf.reportConfigError("port", "0")
+		}
+		if step.Proto == "" {
+			step.Proto = "udp"
+		}
+		if step.Proto != "udp" && step.Proto != "tcp" {
+			return conf.reportConfigError("proto", step.Proto)
+		}
+		if step.Timeout == 0 {
+			step.Timeout = knock.StepTimeout
+		}
+		// Unauthorized clients are the ones knocking, a denied port never reaches the listener
+		for j, rule := range conf.Firewall {
+			if rule.Proto != "" && rule.Proto != step.Proto {
+				continue
+			}
+			for _, r := range rule.destPorts {
+				if step.Port >= r.first && step.Port <= r.last {
+					return &configError { fmt.Sprintf("knock port %d/%s of user %q is denied by firewall rule #%d (%q)\n", step.Port, step.Proto, user, j + 1, rule.Comment) }
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (step configKnockStep) String() string {
+	return fmt.Sprintf("%d/%s", step.Port, step.Proto)
+}
+
+func (knock *configKnock) String() string {
+	s := ""
+	for i := range knock.Steps {
+		if i != 0 {
+			s += ","
+		}
+		s += knock.Steps[i].String()
+	}
+	return s
+}
+
+// Ports to listen on for knocks, sorted
+func (conf *config) knockPorts() []configKnockStep {
+	seen := make(map[string]bool)
+	var ports []configKnockStep
+	for _, knock := range conf.Knock {
+		for _, step := range knock.Steps {
+			if !seen[step.String()] {
+				seen[step.String()] = true
+				ports = append(ports, configKnockStep { Port: step.Port, Proto: step.Proto })
+			}
+		}
+	}
+	sort.Slice(ports, func (i, j int) bool {
+		return ports[i].Port < ports[j].Port || ports[i].Port == ports[j].Port && ports[i].Proto < ports[j].Proto
+	})
+	return ports
+}
+
+// Position of a client in the knock sequence of a user
+type knockProgress struct {
+	next		int
+	deadline	time.Time
+}
+
+type knocker struct {
+	s			*server
+	mutex		sync.Mutex
+	// Keyed by "addr user"
+	progress	map[string]*knockProgress
+	nextPrune	time.Time
+}
+
+func newKnocker(s *server) *knocker {
+	return &knocker {
+		s:			s,
+		progress:	make(map[string]*knockProgress),
+	}
+}
+
+// Listen on every knock port, so a port in use fails at startup
+func (k *knocker) Start() error {
+	for _, port := range k.s.conf.knockPorts() {
+		addr := ":" + strconv.Itoa(int(port.Port))
+		if port.Proto == "udp" {
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				return err
+			}
+			go k.serveUDP(conn, port.Port)
+		} else {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			go k.serveTCP(ln, port.Port)
+		}
+	}
+	return nil
+}
+
+func (k *knocker) serveUDP(conn net.PacketConn, port uint16) {
+	buf := make([]byte, 1)
+	for {
+		_, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			k.hit(udpAddr.IP, "udp", port)
+		}
+	}
+}
+
+func (k *knocker) serveTCP(ln net.Listener, port uint16) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			k.hit(tcpAddr.IP, "tcp", port)
+		}
+		conn.Close()
+	}
+}
+
+// Advance the sequences of a client and log in the users whose sequence it completed
+func (k *knocker) hit(addr net.IP, proto string, port uint16) {
+	s := k.s
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+	if ip4 := addr.To4(); ip4 != nil {
+		addr = ip4
+	}
+
+	for _, user := range k.advance(addr, proto, port, time.Now()) {
+		s.knockLogin(addr, user)
+	}
+}
+
+// Advance the sequences of a client hitting port at now, returning the users whose sequence it completed
+// A hit on any other than the expected step starts over, from the second step if it is the first one
+func (k *knocker) advance(addr net.IP, proto string, port uint16, now time.Time) (completed []string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for user, knock := range k.s.conf.Knock {
+		key := addr.String() + " " + user
+		next := 0
+		if p, ok := k.progress[key]; ok && now.Before(p.deadline) {
+			next = p.next
+		}
+		matches := func (i int) bool {
+			return knock.Steps[i].Port == port && knock.Steps[i].Proto == proto
+		}
+		if matches(next) {
+			next++
+		} else if matches(0) {
+			next = 1
+		} else {
+			next = 0
+		}
+		switch {
+		case next == len(knock.Steps):
+			delete(k.progress, key)
+			completed = append(completed, user)
+		case next == 0:
+			delete(k.progress, key)
+		default:
+			k.progress[key] = &knockProgress { next, now.Add(time.Duration(knock.Steps[next].Timeout) * time.Second) }
+		}
+	}
+	if now.After(k.nextPrune) {
+		// Clients which stopped halfway would otherwise stay forever
+		for key, p := range k.progress {
+			if now.After(p.deadline) {
+				delete(k.progress, key)
+			}
+		}
+		k.nextPrune = now.Add(time.Minute)
+	}
+	sort.Strings(completed)
+	return
+}
@@ -0,0 +1,84 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKnockAdvance(t *testing.T) {
+	conf := &config { Knock: map[string]*configKnock {
+		"alice": { Steps: []configKnockStep {{ 7000, "udp", 10 }, { 8000, "tcp", 5 }, { 9000, "udp", 10 }}},
+		// The first step is repeated
+		"bob": { Steps: []configKnockStep {{ 6000, "udp", 10 }, { 6000, "udp", 10 }, { 5000, "udp", 10 }}},
+	}}
+	type knockHit struct {
+		addr	string
+		port	uint16
+		proto	string
+		// Seconds after the first hit
+		at		int
+		// Users completed by this hit, comma-separated
+		want	string
+	}
+	const a, b = "192.0.2.7", "198.51.100.7"
+	tests := []struct {
+		name		string
+		hits		[]knockHit
+		// Sequences still in progress after the last hit
+		wantPending	int
+	}{
+		{ "in order", []knockHit {{ a, 7000, "udp", 0, "" }, { a, 8000, "tcp", 1, "" }, { a, 9000, "udp", 2, "alice" }}, 0 },
+		{ "out of order", []knockHit {{ a, 7000, "udp", 0, "" }, { a, 9000, "udp", 1, "" }, { a, 8000, "tcp", 2, "" }, { a, 9000, "udp", 3, "" }}, 0 },
+		{ "wrong protocol", []knockHit {{ a, 7000, "udp", 0, "" }, { a, 8000, "udp", 1, "" }, { a, 9000, "udp", 2, "" }}, 0 },
+		{ "interrupted by another port", []knockHit {{ a, 7000, "udp", 0, "" }, { a, 8000, "tcp", 1, "" }, { a, 4000, "udp", 2, "" }, { a, 9000, "udp", 3, "" }}, 0 },
+		{ "step timed out", []knockHit {{ a, 7000, "udp", 0, "" }, { a, 8000, "tcp", 6, "" }, { a, 9000, "udp", 7, "" }}, 0 },
+		{ "just in time", []knockHit {{ a, 7000, "udp", 0, "" }, { a, 8000, "tcp", 4, "" }, { a, 9000, "udp", 13, "alice" }}, 0 },
+		{ "last step timed out", []knockHit {{ a, 7000, "udp", 0, "" }, { a, 8000, "tcp", 4, "" }, { a, 9000, "udp", 14, "" }}, 0 },
+		{ "first step restarts", []knockHit {{ a, 7000, "udp", 0, "" }, { a, 8000, "tcp", 1, "" }, { a, 7000, "udp", 2, "" }, { a, 8000, "tcp", 3, "" }, { a, 9000, "udp", 4, "alice" }}, 0 },
+		{ "first step twice", []knockHit {{ a, 7000, "udp", 0, "" }, { a, 7000, "udp", 1, "" }, { a, 8000, "tcp", 2, "" }, { a, 9000, "udp", 3, "alice" }}, 0 },
+		{ "first step after a timeout", []knockHit {{ a, 7000, "udp", 0, "" }, { a, 7000, "udp", 30, "" }, { a, 8000, "tcp", 31, "" }, { a, 9000, "udp", 32, "alice" }}, 0 },
+		{ "repeated step", []knockHit {{ a, 6000, "udp", 0, "" }, { a, 6000, "udp", 1, "" }, { a, 5000, "udp", 2, "bob" }}, 0 },
+		{ "repeated step once too often", []knockHit {{ a, 6000, "udp", 0, "" }, { a, 6000, "udp", 1, "" }, { a, 6000, "udp", 2, "" }, { a, 5000, "udp", 3, "" }}, 0 },
+		{ "clients do not combine", []knockHit {{ a, 7000, "udp", 0, "" }, { b, 8000, "tcp", 1, "" }, { a, 9000, "udp", 2, "" }}, 0 },
+		{ "clients knock at once", []knockHit {{ a, 7000, "udp", 0, "" }, { b, 7000, "udp", 0, "" }, { b, 8000, "tcp", 1, "" }, { a, 8000, "tcp", 1, "" }, { a, 9000, "udp", 2, "alice" }}, 1 },
+		{ "halfway", []knockHit {{ a, 7000, "udp", 0, "" }, { a, 8000, "tcp", 1, "" }}, 1 },
+		{ "other sequence started", []knockHit {{ a, 7000, "udp", 0, "" }, { a, 6000, "udp", 1, "" }}, 1 },
+		{ "abandoned sequences pruned", []knockHit {{ a, 7000, "udp", 0, "" }, { b, 6000, "udp", 1, "" }, { a, 4000, "udp", 120, "" }}, 0 },
+	}
+	start := time.Unix(1700000000, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			k := newKnocker(&server { conf: conf })
+			for i, hit := range tt.hits {
+				completed := k.advance(net.ParseIP(hit.addr).To4(), hit.proto, hit.port, start.Add(time.Duration(hit.at) * time.Second))
+				if got := strings.Join(completed, ","); got != hit.want {
+					t.Errorf("hit #%d on %d/%s completed %q, want %q", i + 1, hit.port, hit.proto, got, hit.want)
+				}
+			}
+			if len(k.progress) != tt.wantPending {
+				t.Errorf("%d sequences in progress, want %d", len(k.progress), tt.wantPending)
+			}
+		})
+	}
+}
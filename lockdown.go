@@ -0,0 +1,278 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Rules with mode = "lockdown" are open to everyone until a login locks them down for everyone but the subnets whitelisted in their group
+// Their deny rules also match the lock sets of the group, which hold the two halves of the address space while the lockdown is engaged
+// Logins add whitelist entries to the group like to any other, so listing, expiry and revocation stay the same, the lockdown lasts as long as the last of them
+
+// Elements of the lock sets, which together match every source
+var (
+	lockdownHalves4 = []string {"0.0.0.0/1", "128.0.0.0/1"}
+	lockdownHalves6 = []string {"::/1", "8000::/1"}
+)
+
+// Path of the page lifting lockdowns early, below http-path
+func (conf *config) lockdownPath() string {
+	return strings.TrimRight(conf.Daemon.HTTPPath, "/") + "/lockdown/"
+}
+
+// Return the groups of "lockdown" rules, in the order of the rules
+func (conf *config) lockdownGroups() (groups []string) {
+	for _, rule := range conf.Firewall {
+		if rule.Mode == "lockdown" && !containsString(groups, rule.Group) {
+			groups = append(groups, rule.Group)
+		}
+	}
+	return
+}
+
+// Whether group holds "lockdown" rules, whose rules then all are
+func (conf *config) groupLockdown(group string) bool {
+	return containsString(conf.lockdownGroups(), group)
+}
+
+// Return the lockdown groups a login of a user with groups engages, groups in skip being left out
+func (conf *config) loginLockdowns(groups, skip []string) (lockdowns []string) {
+	for _, group := range conf.expandGroups(groups) {
+		if conf.groupLockdown(group) && !containsString(skip, group) {
+			lockdowns = append(lockdowns, group)
+		}
+	}
+	return
+}
+
+// Name the audit event of kind about a whitelist entry of group, "lockdown-" instead of "whitelist-" for lockdown groups
+func (conf *config) entryEvent(kind, group string) string {
+	if conf.groupLockdown(group) {
+		return "lockdown-" + kind
+	}
+	return "whitelist-" + kind
+}
+
+// Engage the lockdown of each lockdown group with live entries until the last of them expires, and lift the others
+// The lock sets expire by themselves too, so a lockdown never outlives its entries while portknob is not running
+func (fw *firewall) syncLockdowns() {
+	groups := fw.conf.lockdownGroups()
+	if len(groups) == 0 {
+		return
+	}
+	entries, err := fw.cache.Entries()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	now := time.Now()
+	fw.lockdownMutex.Lock()
+	defer fw.lockdownMutex.Unlock()
+	for _, group := range groups {
+		sets, ok := fw.sets[group]
+		if !ok {
+			continue
+		}
+		// Zero if an entry never expires
+		var until time.Time
+		var subnets []string
+		forever := false
+		for _, entry := range entries {
+			expires := fw.localExpiry(entry, now)
+			if entry.group != group || !expires.IsZero() && !expires.After(now) {
+				continue
+			}
+			if expires.IsZero() {
+				forever = true
+			} else if expires.After(until) {
+				until = expires
+			}
+			subnets = append(subnets, fw.Subnet(entry.addr).String())
+		}
+		if forever {
+			until = time.Time {}
+		}
+		prev, engaged := fw.lockdowns[group]
+		switch {
+		case len(subnets) != 0 && (!engaged || !prev.Equal(until)):
+			var timeout time.Duration
+			if !until.IsZero() {
+				timeout = until.Sub(now).Truncate(time.Second) + time.Second
+			}
+			err := fw.backend.AddLockdown(sets, timeout)
+			if err != nil {
+				log.Printf("Cannot lock down the rules of group %q: %s\n", group, err)
+				continue
+			}
+			fw.lockdowns[group] = until
+			if !engaged {
+				log.Printf("Locked down %s for everyone but %s\n", strings.Join(fw.conf.groupRuleNames([]string {group}), ", "), strings.Join(subnets, ", "))
+				fw.audit.Event("lockdown", "state", "engaged", "group", group, "rules", fw.conf.groupRuleNames([]string {group}), "subnets", subnets, "until", formatExpiry(until))
+			}
+		case len(subnets) == 0 && engaged:
+			err := fw.backend.DelLockdown(sets)
+			if err != nil {
+				log.Printf("Cannot lift the lockdown of the rules of group %q: %s\n", group, err)
+				continue
+			}
+			delete(fw.lockdowns, group)
+			log.Printf("Lifted the lockdown of %s\n", strings.Join(fw.conf.groupRuleNames([]string {group}), ", "))
+			fw.audit.Event("lockdown", "state", "lifted", "group", group, "rules", fw.conf.groupRuleNames([]string {group}))
+		}
+	}
+}
+
+// Return the live entries of user in lockdown groups within the subnet of clientIP
+func (s *server) lockdownEntries(user string, clientIP net.IP, now time.Time) ([]cacheEntry, error) {
+	cached, err := s.fw.cache.Entries()
+	if err != nil {
+		return nil, err
+	}
+	subnet := s.fw.Subnet(clientIP)
+	var entries []cacheEntry
+	for _, entry := range cached {
+		if entry.user == user && entry.live(now) && subnet.Contains(entry.addr) && s.conf.groupLockdown(entry.group) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Serve the lockdowns a user engaged from the subnet of the visitor, POST action=lift lifts them before they expire
+func (s *server) lockdownHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+
+	clientIP, refused := s.checkClient(w, r)
+	if refused {
+		return
+	}
+	if err := s.shareProtection.Check(r); err != nil {
+		s.writeError(w, r, 403, "forbidden", "Access Forbidden: " + err.Error())
+		return
+	}
+	user, _, ok, err := s.sessionOwner(r, clientIP)
+	if err != nil {
+		log.Println(err)
+		s.writeError(w, r, 503, "unavailable", "Service Unavailable: cannot reach the authentication server")
+		return
+	}
+	if !ok {
+		s.writeError(w, r, 401, "unauthorized", fmt.Sprintf("Access Unauthorized: log in at %s first", s.conf.Daemon.HTTPPath))
+		return
+	}
+	entries, err := s.lockdownEntries(user, clientIP, time.Now())
+	if err != nil {
+		log.Println(err)
+		s.writeError(w, r, 500, "internal", "cannot read cache database")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != "POST" {
+		s.writeLockdowns(w, r, user, entries)
+		return
+	}
+	if r.PostFormValue("action") != "lift" {
+		s.writeError(w, r, 400, "bad-request", "Bad Request: the action must be \"lift\"")
+		return
+	}
+	if len(entries) == 0 {
+		s.writeError(w, r, 404, "not-found", "Not Found: you have no lockdown from this network")
+		return
+	}
+	var groups []string
+	for _, entry := range entries {
+		err = s.fw.RevokeGroup(entry.group, clientIP)
+		if err != nil {
+			log.Println(err)
+			s.writeError(w, r, 500, "internal", "cannot update firewall")
+			return
+		}
+		groups = append(groups, entry.group)
+	}
+	rules := s.conf.groupRuleNames(groups)
+	s.fw.audit.Event("lockdown-lift", "user", user, "client", clientIP, "subnet", s.fw.Subnet(clientIP), "rules", rules)
+	if s.wantsPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		fmt.Fprintf(w, "OK lifted=%s\n", strings.Join(rules, ","))
+		return
+	}
+	http.Redirect(w, r, s.conf.lockdownPath(), 303)
+}
+
+func (s *server) writeLockdowns(w http.ResponseWriter, r *http.Request, user string, entries []cacheEntry) {
+	data := lockdownPageData { User: user, Path: s.conf.lockdownPath() }
+	for _, entry := range entries {
+		data.Lockdowns = append(data.Lockdowns, lockdownData { strings.Join(s.conf.groupRuleNames([]string {entry.group}), ", "), formatExpiry(entry.expires) })
+	}
+	if s.wantsPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Write([]byte("OK\n"))
+		for _, lockdown := range data.Lockdowns {
+			fmt.Fprintf(w, "%s %s\n", lockdown.Expires, lockdown.Rules)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	lockdownPage.Execute(w, data)
+}
+
+type lockdownData struct {
+	Rules		string
+	Expires		string
+}
+
+type lockdownPageData struct {
+	User		string
+	Path		string
+	Lockdowns	[]lockdownData
+}
+
+var lockdownPage = template.Must(template.New("lockdown").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Lockdown - Portknob</title>
+</head>
+<body>
+<main>
+<h1>Lockdowns of {{.User}}</h1>
+{{if .Lockdowns}}<table>
+<tr><th>Rules</th><th>Until</th></tr>
+{{range .Lockdowns}}<tr><td>{{.Rules}}</td><td>{{.Expires}}</td></tr>
+{{end}}</table>
+<p>Only this network can reach these rules meanwhile.</p>
+<form method="post" action="{{.Path}}">
+<input type="hidden" name="action" value="lift">
+<p><button type="submit">Lift the lockdown</button></p>
+</form>
+{{else}}<p>You have no lockdown from this network.</p>
+{{end}}</main>
+</body>
+</html>
+`))
@@ -0,0 +1,219 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const lockdownTestConfig = `firewall-lifespan = 3600
+[[firewall]]
+comment = "ssh"
+dport = "22"
+[[firewall]]
+comment = "web"
+dport = "443"
+mode = "lockdown"
+users = ["alice"]
+[[secrets]]
+username = "alice"
+password = "hunter2"
+[[secrets]]
+username = "bob"
+password = "swordfish"
+`
+
+func testLockdownPage(s *server, addr, method string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/lockdown/?plain=1", strings.NewReader(form.Encode()))
+	r.RemoteAddr = addr + ":5000"
+	r.Header.Set("X-Real-IP", addr)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.lockdownHandlerFunc(w, r)
+	return w
+}
+
+func TestLockdown(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, backend := newTestServer(t, lockdownTestConfig)
+	group := s.conf.lockdownGroups()[0]
+	lockName := s.fw.sets[group].lock4Name
+
+	w := testLogin(s, "198.51.100.7", url.Values { "username": {"bob"}, "password": {"swordfish"} }, nil)
+	if w.Code != 200 || len(backend.lockdowns) != 0 {
+		t.Fatalf("login of bob replied %d and engaged %v: %s", w.Code, backend.lockdowns, w.Body.String())
+	}
+
+	w = testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "lift the lockdown early at /lockdown/") {
+		t.Fatalf("login of alice replied %d: %s", w.Code, w.Body.String())
+	}
+	if timeout, ok := backend.lockdowns[lockName]; !ok || timeout < 3590 * time.Second || timeout > 3601 * time.Second {
+		t.Errorf("lockdown engaged %v, want %s for about an hour", backend.lockdowns, lockName)
+	}
+	if !backend.elements["portknob-" + group + "-net4 192.0.2.7"] {
+		t.Error("the subnet of alice is not let through the lockdown")
+	}
+	entries, err := s.adminEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, entry.Subnet + " " + entry.Action)
+	}
+	sort.Strings(actions)
+	if want := []string {"192.0.2.0/24 ", "192.0.2.0/24 lockdown", "198.51.100.0/24 "}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("entries %q, want %q", actions, want)
+	}
+	cookies := w.Result().Cookies()
+
+	if w := testLockdownPage(s, "192.0.2.7", "GET", nil, cookies); w.Code != 200 || !strings.HasSuffix(w.Body.String(), " #2 web\n") {
+		t.Errorf("lockdown page replied %d: %s", w.Code, w.Body.String())
+	}
+	// The cookie alone cannot lift it from elsewhere
+	if w := testLockdownPage(s, "203.0.113.7", "POST", url.Values { "action": {"lift"} }, cookies); w.Code != 401 {
+		t.Errorf("lift from another subnet replied %d: %s", w.Code, w.Body.String())
+	}
+	if w := testLockdownPage(s, "192.0.2.7", "POST", url.Values { "action": {"lift"} }, cookies); w.Code != 200 || w.Body.String() != "OK lifted=#2 web\n" {
+		t.Errorf("lift replied %d: %s", w.Code, w.Body.String())
+	}
+	if len(backend.lockdowns) != 0 {
+		t.Errorf("lockdown still engaged after the lift: %v", backend.lockdowns)
+	}
+	if backend.elements["portknob-" + group + "-net4 192.0.2.7"] || !backend.elements["portknob-net4 192.0.2.7"] {
+		t.Error("the lift did not remove only the lockdown entry")
+	}
+	if w := testLockdownPage(s, "192.0.2.7", "POST", url.Values { "action": {"lift"} }, cookies); w.Code != 404 {
+		t.Errorf("second lift replied %d: %s", w.Code, w.Body.String())
+	}
+
+	// The lockdown ends with its last entry
+	testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+	if _, ok := backend.lockdowns[lockName]; !ok {
+		t.Fatal("second login did not engage the lockdown")
+	}
+	err = s.fw.cache.Set([]cacheEntry {{ addr: net.ParseIP("192.0.2.7"), group: group, user: "alice", expires: time.Now().Add(-time.Second) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.fw.doCleanup()
+	if len(backend.lockdowns) != 0 {
+		t.Errorf("lockdown engaged after its entry expired: %v", backend.lockdowns)
+	}
+}
+
+func TestLockdownOptions(t *testing.T) {
+	tests := []struct {
+		name		string
+		rules		string
+		wantErr		bool
+	}{
+		{ "group", "[[firewall]]\ndport = \"443\"\nmode = \"lockdown\"\ngroup = \"ops\"\n", false },
+		{ "own lifespan", "[[firewall]]\ndport = \"443\"\nmode = \"lockdown\"\ngroup = \"ops\"\nlifespan = 600\n[[firewall]]\ndport = \"22\"\ngroup = \"ops\"\nlifespan = 600\n", false },
+		{ "no group", "[[firewall]]\ndport = \"443\"\nmode = \"lockdown\"\n", true },
+		{ "shared group", "[[firewall]]\ndport = \"443\"\nmode = \"lockdown\"\ngroup = \"ops\"\n[[firewall]]\ndport = \"22\"\ngroup = \"ops\"\n", true },
+		{ "redir", "[[firewall]]\ndport = \"443\"\nmode = \"lockdown\"\ngroup = \"ops\"\nredir = \":8443\"\n", true },
+		{ "sliding", "[[firewall]]\ndport = \"443\"\nmode = \"lockdown\"\ngroup = \"ops\"\nlifespan = 600\nsliding = true\n", true },
+		{ "unknown mode", "[[firewall]]\ndport = \"443\"\nmode = \"closed\"\n", true },
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, fmt.Sprintf("[daemon]\ncache-database = %q\n%s", filepath.Join(t.TempDir(), "cache.db"), tt.rules)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Deny rules of lockdown groups only match while the lock sets hold the halves of the address space
+func TestLockdownCommands(t *testing.T) {
+	var commands, inputs []string
+	conf := &config {}
+	var threshold uint64
+	conf.Daemon.FirewallSlowThreshold = &threshold
+	conf.Daemon.IPv6Prefix = 48
+	fw := &firewall { conf: conf, metrics: newMetrics(), chainName: "portknob", runner: func (cmd *exec.Cmd) error {
+		commands = append(commands, strings.Join(cmd.Args, " "))
+		if cmd.Stdin != nil {
+			input, err := io.ReadAll(cmd.Stdin)
+			inputs = append(inputs, string(input))
+			return err
+		}
+		return nil
+	} }
+	sets := newFirewallSets("portknob-ops", true)
+	fw.sets = map[string]*firewallSets { "ops": sets }
+
+	ipt := &iptablesBackend { fw }
+	if got, want := strings.Join(ipt.setMatch("ops", false), " "), "-m set --match-set portknob-ops-lock4 src -m set ! --match-set portknob-ops-net4 src -m set ! --match-set portknob-ops-host4 src"; got != want {
+		t.Errorf("iptables setMatch() = %q, want %q", got, want)
+	}
+	err := ipt.AddLockdown(sets, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "add portknob-ops-lock4 0.0.0.0/1 timeout 3600\nadd portknob-ops-lock4 128.0.0.0/1 timeout 3600\nadd portknob-ops-lock6 ::/1 timeout 3600\nadd portknob-ops-lock6 8000::/1 timeout 3600\n"
+	if !reflect.DeepEqual(commands, []string {"ipset -exist restore"}) || !reflect.DeepEqual(inputs, []string {want}) {
+		t.Errorf("ran %q with %q, want one ipset restore with %q", commands, inputs, want)
+	}
+
+	commands = nil
+	nft := &nftablesBackend { fw }
+	if got, want := strings.Join(nft.setMatch("ops", true), " "), "ip6 saddr @portknob-ops-lock6 ip6 saddr & ffff:ffff:ffff:: != @portknob-ops-net6 ip6 saddr != @portknob-ops-host6"; got != want {
+		t.Errorf("nft setMatch() = %q, want %q", got, want)
+	}
+	err = nft.AddLockdown(sets, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nft.DelLockdown(sets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCommands := []string {
+		"nft -- flush set inet portknob portknob-ops-lock4 ; add element inet portknob portknob-ops-lock4 { 0.0.0.0/1 timeout 3600s , 128.0.0.0/1 timeout 3600s } ; flush set inet portknob portknob-ops-lock6 ; add element inet portknob portknob-ops-lock6 { ::/1 timeout 3600s , 8000::/1 timeout 3600s }",
+		"nft -- flush set inet portknob portknob-ops-lock4 ; flush set inet portknob portknob-ops-lock6",
+	}
+	if !reflect.DeepEqual(commands, wantCommands) {
+		t.Errorf("ran %q, want %q", commands, wantCommands)
+	}
+}
@@ -19,18 +19,126 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
 )
 
 func main() {
 	confPath := flag.String("conf", "portknob.conf", "Configuration file")
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	cacheInfo := flag.Bool("cache-info", false, "Print the schema version and entry counts of the cache database and exit")
+	forceDowngrade := flag.Bool("force-downgrade", false, "Open a cache database written by a newer version, dropping data this version does not understand")
+	readOnly := flag.Bool("read-only", false, "Serve the admin page, metrics and listings from a copy of the cache database, never changing it or the firewall nor accepting logins")
+	hashPassword := flag.Bool("hash", false, "Read a password from stdin, print its bcrypt hash for use in [secrets] and exit")
+	totpGen := flag.String("totp-gen", "", "Print a new TOTP seed for the given user, with an otpauth:// URI for authenticator apps, and exit")
 	flag.Parse()
 
+	// Commands are the same as their command line options
+	switch flag.Arg(0) {
+	case "":
+	case "hash":
+		if flag.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Usage: portknob hash < password")
+			os.Exit(2)
+		}
+		*hashPassword = true
+	case "totp-enroll":
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: portknob totp-enroll <user>")
+			os.Exit(2)
+		}
+		*totpGen = flag.Arg(1)
+	case "list", "grant", "revoke", "flush", "maintenance", "panic", "rotate-cookie-secret", "key", "export", "explain":
+		// Sent to the daemon once the configuration names its control socket
+	case "client":
+		// Runs on the machine knocking, which has no configuration
+		err := runKeyClient(flag.Args())
+		if err == errClientUsage {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	case "audit":
+		err := runAuditCommand(*confPath, flag.Args())
+		if err == errAuditUsage {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", flag.Arg(0))
+		os.Exit(2)
+	}
+
+	if *showVersion {
+		fmt.Print(versionString())
+		return
+	}
+
+	if *hashPassword {
+		if stat, err := os.Stdin.Stat(); err == nil && stat.Mode() & os.ModeCharDevice != 0 {
+			// The password is echoed, hashing from a pipe keeps it off the screen
+			fmt.Fprint(os.Stderr, "Password: ")
+		}
+		password, err := bufio.NewReader(os.Stdin).ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalln(err)
+		}
+		hash, err := hashSecret(password)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	if *totpGen != "" {
+		seed, uri, err := generateTOTPSeed(*totpGen)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("seed: %s\nuri: %s\n", seed, uri)
+		fmt.Fprintf(os.Stderr, "\nAdd totp = %q to the secret of %q, or %q = %q to [totp-secrets]\nShow the URI as a QR code for the authenticator app with: qrencode -t ansiutf8 '%s'\n", seed, *totpGen, *totpGen, seed, uri)
+		return
+	}
+
 	conf, err := loadConfig(*confPath)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	conf.forceDowngrade = *forceDowngrade
+	conf.readOnly = *readOnly
+
+	switch flag.Arg(0) {
+	case "list", "grant", "revoke", "flush", "maintenance", "panic", "rotate-cookie-secret", "key", "export", "explain":
+		err = runControlCommand(conf, flag.Args())
+		if err == errUsage {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if *cacheInfo {
+		err = newCache(conf).PrintInfo(os.Stdout)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 
 	firewall := newFirewall(conf)
 	err = firewall.Start()
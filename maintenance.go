@@ -0,0 +1,156 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Maintenance mode turns away logins which would whitelist a new subnet with 503 and Retry-After, until it ends
+// Whitelisted subnets may log in again to renew their entries, the sweeper, the control socket and the admin API keep working
+var errMaintenance = errors.New("maintenance mode refuses new grants")
+
+// Longest message shown on the maintenance page
+const maxMaintenanceMessage = 200
+
+type maintenanceReply struct {
+	Maintenance	bool	`json:"maintenance"`
+	Since		string	`json:"since,omitempty"`
+	Until		string	`json:"until,omitempty"`
+	By			string	`json:"by,omitempty"`
+	Message		string	`json:"message,omitempty"`
+}
+
+// Return the maintenance mode refusing a new grant to clientIP at now, false if the grant may go ahead
+// A subnet with a live entry renews it instead of getting a new one
+func (s *server) maintenanceRefuses(clientIP net.IP, now time.Time) (m maintenance, refused bool) {
+	m, ok := s.fw.cache.Maintenance()
+	if !ok || !now.Before(m.until) {
+		return m, false
+	}
+	entries, err := s.fw.cache.Entries()
+	if err != nil {
+		log.Println(err)
+		return m, true
+	}
+	subnet := s.fw.Subnet(clientIP).String()
+	for _, entry := range entries {
+		if entry.live(now) && s.fw.Subnet(entry.addr).String() == subnet {
+			return m, false
+		}
+	}
+	return m, true
+}
+
+func (s *server) writeMaintenance(w http.ResponseWriter, r *http.Request, m maintenance, now time.Time) {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(m.until.Sub(now) / time.Second) + 1, 10))
+	message := fmt.Sprintf("Service Unavailable: down for maintenance until %s", m.until.Format(time.RFC1123Z))
+	if m.message != "" {
+		message += ", " + m.message
+	}
+	s.writeError(w, r, 503, "maintenance until=" + m.until.UTC().Format(time.RFC3339), message)
+}
+
+// Return the maintenance mode at now as replied by the control socket and the admin API
+func (s *server) maintenanceState(now time.Time) maintenanceReply {
+	m, ok := s.fw.cache.Maintenance()
+	if !ok || !now.Before(m.until) {
+		return maintenanceReply {}
+	}
+	return maintenanceReply {
+		Maintenance:	true,
+		Since:			m.since.UTC().Format(time.RFC3339),
+		Until:			m.until.UTC().Format(time.RFC3339),
+		By:				m.by,
+		Message:		m.message,
+	}
+}
+
+// Serve GET, PUT and DELETE /maintenance for the control socket and the admin API, by being who asks
+// PUT turns maintenance mode on for duration seconds with message, DELETE turns it off
+// Browsers do not send either method from another site, so the credentials of an admin cannot be abused
+func (s *server) serveMaintenance(w http.ResponseWriter, r *http.Request, by string) {
+	now := time.Now()
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		seconds, err := strconv.ParseUint(r.PostFormValue("duration"), 10, 32)
+		if err != nil || seconds == 0 {
+			s.writeJSON(w, 400, map[string]string { "error": "cannot parse duration" })
+			return
+		}
+		m := maintenance { since: now, until: now.Add(time.Duration(seconds) * time.Second), by: by, message: maintenanceMessage(r.PostFormValue("message")) }
+		err = s.fw.cache.SetMaintenance(m)
+		if err != nil {
+			s.writeJSON(w, 500, map[string]string { "error": "cannot update cache database" })
+			return
+		}
+		log.Printf("Maintenance mode until %s, turned on by %s\n", m.until.UTC().Format(time.RFC3339), by)
+		s.fw.audit.Event("maintenance-on", "by", by, "until", m.until, "message", m.message)
+	case "DELETE":
+		m, ended, err := s.fw.cache.EndMaintenance(now, true)
+		if err != nil {
+			s.writeJSON(w, 500, map[string]string { "error": "cannot update cache database" })
+			return
+		}
+		if ended {
+			log.Printf("Maintenance mode turned off by %s\n", by)
+			s.fw.audit.Event("maintenance-off", "by", by, "since", m.since)
+		}
+	default:
+		s.writeJSON(w, 405, map[string]string { "error": "method not allowed" })
+		return
+	}
+	s.writeJSON(w, 200, s.maintenanceState(now))
+}
+
+// Keep the message on one line of printable characters and at most maxMaintenanceMessage long
+func maintenanceMessage(message string) string {
+	message = strings.Map(func (r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, strings.TrimSpace(message))
+	if runes := []rune(message); len(runes) > maxMaintenanceMessage {
+		message = string(runes[:maxMaintenanceMessage])
+	}
+	return message
+}
+
+// Serve /readyz on metrics-listen, 503 with Retry-After in maintenance mode for load balancers and monitoring
+func (s *server) readyHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	w.Header().Set("Cache-Control", "no-cache")
+	if m, ok := s.fw.cache.Maintenance(); ok && now.Before(m.until) {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(m.until.Sub(now) / time.Second) + 1, 10))
+		http.Error(w, "maintenance until " + m.until.UTC().Format(time.RFC3339), 503)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,141 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	tests := []struct {
+		name		string
+		// Address logging in while maintenance mode lasts for duration
+		addr		string
+		duration	time.Duration
+		// Turn it off through the control socket before the login
+		off			bool
+		wantCode	int
+	}{
+		{ "new subnet", "198.51.100.7", time.Hour, false, 503 },
+		{ "renewal", "192.0.2.8", time.Hour, false, 200 },
+		{ "ended", "198.51.100.7", -time.Second, false, 200 },
+		{ "turned off", "198.51.100.7", time.Hour, true, 200 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			log.SetOutput(io.Discard)
+			defer log.SetOutput(os.Stderr)
+			audit := filepath.Join(t.TempDir(), "audit.log")
+			s, _ := newTestServer(t, "audit-log = " + strconv.Quote(audit) + "\n[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\n")
+			s.fw.audit, _ = newAuditLog(s.conf)
+			login := url.Values { "username": {"alice"}, "password": {"hunter2"} }
+			if w := testLogin(s, "192.0.2.7", login, nil); w.Code != 200 {
+				t.Fatalf("login before maintenance replied %d: %s", w.Code, w.Body.String())
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("PUT", "/maintenance", strings.NewReader(url.Values { "duration": {"3600"}, "message": {"back at 14:00 UTC\n"}, "by": {"alice"} }.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			s.controlHandlerFunc(w, r)
+			if w.Code != 200 || !strings.Contains(w.Body.String(), `"maintenance":true`) {
+				t.Fatalf("PUT /maintenance replied %d: %s", w.Code, w.Body.String())
+			}
+			if tt.duration < 0 {
+				m, _ := s.fw.cache.Maintenance()
+				m.until = time.Now().Add(tt.duration)
+				s.fw.cache.SetMaintenance(m)
+			}
+			if tt.off {
+				w := httptest.NewRecorder()
+				s.controlHandlerFunc(w, httptest.NewRequest("DELETE", "/maintenance?by=bob", nil))
+				if w.Code != 200 || !strings.Contains(w.Body.String(), `"maintenance":false`) {
+					t.Fatalf("DELETE /maintenance replied %d: %s", w.Code, w.Body.String())
+				}
+			}
+
+			// The state is in the cache database, not the daemon
+			s.fw.cache.Stop()
+			err := s.fw.cache.Start()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w = testLogin(s, tt.addr, login, nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("login from %s replied %d, want %d: %s", tt.addr, w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode == 503 {
+				if retry, _ := strconv.Atoi(w.Header().Get("Retry-After")); retry < 3500 || retry > 3601 {
+					t.Errorf("Retry-After %q, want about 3600", w.Header().Get("Retry-After"))
+				}
+				if body := w.Body.String(); !strings.HasPrefix(body, "ERROR maintenance until=") || !strings.Contains(body, ", back at 14:00 UTC\n") {
+					t.Errorf("reply %q, want the maintenance message", body)
+				}
+				ready := httptest.NewRecorder()
+				s.readyHandlerFunc(ready, httptest.NewRequest("GET", "/readyz", nil))
+				if ready.Code != 503 {
+					t.Errorf("/readyz replied %d in maintenance mode", ready.Code)
+				}
+			}
+
+			s.fw.doCleanup()
+			if _, ok := s.fw.cache.Maintenance(); ok != (tt.duration > 0 && !tt.off) {
+				t.Errorf("maintenance mode still recorded %t after cleanup", ok)
+			}
+			logged, _ := os.ReadFile(audit)
+			wantEvents := []string {`"event":"maintenance-on","by":"control-socket alice"`}
+			if tt.off {
+				wantEvents = append(wantEvents, `"event":"maintenance-off","by":"control-socket bob"`)
+			}
+			if tt.duration < 0 {
+				wantEvents = append(wantEvents, `"event":"maintenance-off","by":"expiry"`)
+			}
+			for _, event := range wantEvents {
+				if !strings.Contains(string(logged), event) {
+					t.Errorf("audit log lacks %s:\n%s", event, logged)
+				}
+			}
+		})
+	}
+}
+
+func TestMaintenanceMessage(t *testing.T) {
+	tests := []struct {
+		message	string
+		want	string
+	}{
+		{ "back at 14:00 UTC", "back at 14:00 UTC" },
+		{ " two\nlines\r\n", "two lines" },
+		{ strings.Repeat("é", maxMaintenanceMessage + 1), strings.Repeat("é", maxMaintenanceMessage) },
+	}
+	for _, tt := range tests {
+		if got := maintenanceMessage(tt.message); got != tt.want {
+			t.Errorf("maintenanceMessage(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
+
@@ -0,0 +1,277 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Buckets of the HTTP handler and firewall command latency histograms in seconds, the Prometheus defaults
+var metricsLatencyBuckets = []float64 {0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Firewall commands of each op and family whose durations make up the p95 on the admin page
+const metricsRecentCommands = 100
+
+// An op and family of firewall commands, like "grant-insert" and "ipv4"
+type firewallCommand struct {
+	op		string
+	family	string
+}
+
+// Durations of the firewall commands of one firewallCommand
+type commandDurations struct {
+	counts	[]uint64
+	count	uint64
+	sum		float64
+	// The last metricsRecentCommands durations, recent[next] being the oldest once full
+	recent	[]time.Duration
+	next	int
+}
+
+// Counters exposed in the Prometheus text format on metrics-listen
+type metrics struct {
+	mutex			sync.Mutex
+	authSuccess		map[string]uint64
+	authFailure		map[string]uint64
+	firewallOps		map[string]uint64
+	firewallErrors	map[string]uint64
+	// Packets stopped by the deny rules by denyLabel, since this process started
+	denied			map[string]uint64
+	// Failed logins beyond ratelimit-max-entries
+	failureAggregated	uint64
+	failureEvicted		uint64
+	failureDropped		uint64
+	// Estimated clock skew in seconds of the other instances sharing the cache database, by host
+	peerSkew		map[string]float64
+	firewallDurations	map[firewallCommand]*commandDurations
+	latencyCounts	[]uint64
+	latencyCount	uint64
+	latencySum		float64
+	// Posture of [defense], and how often it changed
+	defenseElevated	bool
+	defenseChanges	uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics {
+		authSuccess:	make(map[string]uint64),
+		authFailure:	make(map[string]uint64),
+		firewallOps:	make(map[string]uint64),
+		firewallErrors:	make(map[string]uint64),
+		denied:			make(map[string]uint64),
+		peerSkew:		make(map[string]float64),
+		firewallDurations:	make(map[firewallCommand]*commandDurations),
+		latencyCounts:	make([]uint64, len(metricsLatencyBuckets)),
+	}
+}
+
+func (m *metrics) AuthSuccess(user string) {
+	m.mutex.Lock()
+	m.authSuccess[user]++
+	m.mutex.Unlock()
+}
+
+// Count a failed login, user should be "unknown" unless it is listed in [secrets]
+func (m *metrics) AuthFailure(user string) {
+	m.mutex.Lock()
+	m.authFailure[user]++
+	m.mutex.Unlock()
+}
+
+// Record a change of the posture of [defense]
+func (m *metrics) Defense(elevated bool) {
+	m.mutex.Lock()
+	m.defenseElevated = elevated
+	m.defenseChanges++
+	m.mutex.Unlock()
+}
+
+func (m *metrics) FirewallOp(op string, err error) {
+	m.mutex.Lock()
+	m.firewallOps[op]++
+	if err != nil {
+		m.firewallErrors[op]++
+	}
+	m.mutex.Unlock()
+}
+
+func (m *metrics) FirewallDuration(op, family string, elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	m.mutex.Lock()
+	d := m.firewallDurations[firewallCommand { op, family }]
+	if d == nil {
+		d = &commandDurations { counts: make([]uint64, len(metricsLatencyBuckets)) }
+		m.firewallDurations[firewallCommand { op, family }] = d
+	}
+	for i, bound := range metricsLatencyBuckets {
+		if seconds <= bound {
+			d.counts[i]++
+		}
+	}
+	d.count++
+	d.sum += seconds
+	if len(d.recent) < metricsRecentCommands {
+		d.recent = append(d.recent, elapsed)
+	} else {
+		d.recent[d.next] = elapsed
+		d.next = (d.next + 1) % metricsRecentCommands
+	}
+	m.mutex.Unlock()
+}
+
+// Return the 95th percentile duration of the last metricsRecentCommands firewall commands of each op and family
+func (m *metrics) FirewallP95() map[firewallCommand]time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p95 := make(map[firewallCommand]time.Duration, len(m.firewallDurations))
+	for command, d := range m.firewallDurations {
+		recent := append([]time.Duration(nil), d.recent...)
+		sort.Slice(recent, func (i, j int) bool { return recent[i] < recent[j] })
+		p95[command] = recent[(len(recent) * 95 + 99) / 100 - 1]
+	}
+	return p95
+}
+
+// Count a failed login counted with its aggregate, the records evicted for it, or its being dropped
+func (m *metrics) FailureRecords(aggregated bool, evicted int, dropped bool) {
+	m.mutex.Lock()
+	if aggregated && !dropped {
+		m.failureAggregated++
+	}
+	m.failureEvicted += uint64(evicted)
+	if dropped {
+		m.failureDropped++
+	}
+	m.mutex.Unlock()
+}
+
+func (m *metrics) Denied(hits map[string]uint64) {
+	m.mutex.Lock()
+	for label, packets := range hits {
+		m.denied[label] += packets
+	}
+	m.mutex.Unlock()
+}
+
+func (m *metrics) PeerSkew(peer string, skew time.Duration) {
+	m.mutex.Lock()
+	m.peerSkew[peer] = skew.Seconds()
+	m.mutex.Unlock()
+}
+
+func (m *metrics) Latency(elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	m.mutex.Lock()
+	for i, bound := range metricsLatencyBuckets {
+		if seconds <= bound {
+			m.latencyCounts[i]++
+		}
+	}
+	m.latencyCount++
+	m.latencySum += seconds
+	m.mutex.Unlock()
+}
+
+// Measure the latency of every request served by h
+func (m *metrics) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		m.Latency(time.Since(start))
+	})
+}
+
+// Write all metrics, activeEntries being the number of live whitelist entries in the cache database
+func (m *metrics) WriteTo(w io.Writer, activeEntries int, cacheSize int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP portknob_auth_success_total Successful logins.\n# TYPE portknob_auth_success_total counter\n")
+	writeLabeled(w, "portknob_auth_success_total", "user", m.authSuccess)
+	fmt.Fprintf(w, "# HELP portknob_auth_failure_total Failed logins, users not in [secrets] are counted as \"unknown\".\n# TYPE portknob_auth_failure_total counter\n")
+	writeLabeled(w, "portknob_auth_failure_total", "user", m.authFailure)
+	fmt.Fprintf(w, "# HELP portknob_whitelist_entries Live whitelist entries in the cache database.\n# TYPE portknob_whitelist_entries gauge\nportknob_whitelist_entries %d\n", activeEntries)
+	fmt.Fprintf(w, "# HELP portknob_cache_database_bytes Size of the cache database.\n# TYPE portknob_cache_database_bytes gauge\nportknob_cache_database_bytes %d\n", cacheSize)
+	fmt.Fprintf(w, "# HELP portknob_firewall_operations_total Firewall commands run.\n# TYPE portknob_firewall_operations_total counter\n")
+	writeLabeled(w, "portknob_firewall_operations_total", "op", m.firewallOps)
+	fmt.Fprintf(w, "# HELP portknob_firewall_errors_total Firewall commands which failed.\n# TYPE portknob_firewall_errors_total counter\n")
+	writeLabeled(w, "portknob_firewall_errors_total", "op", m.firewallErrors)
+	fmt.Fprintf(w, "# HELP portknob_firewall_command_duration_seconds Duration of the firewall commands, by op and address family.\n# TYPE portknob_firewall_command_duration_seconds histogram\n")
+	commands := make([]firewallCommand, 0, len(m.firewallDurations))
+	for command := range m.firewallDurations {
+		commands = append(commands, command)
+	}
+	sort.Slice(commands, func (i, j int) bool {
+		if commands[i].op != commands[j].op {
+			return commands[i].op < commands[j].op
+		}
+		return commands[i].family < commands[j].family
+	})
+	for _, command := range commands {
+		d := m.firewallDurations[command]
+		labels := fmt.Sprintf("op=%q,family=%q", command.op, command.family)
+		for i, bound := range metricsLatencyBuckets {
+			fmt.Fprintf(w, "portknob_firewall_command_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, d.counts[i])
+		}
+		fmt.Fprintf(w, "portknob_firewall_command_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, d.count)
+		fmt.Fprintf(w, "portknob_firewall_command_duration_seconds_sum{%s} %g\nportknob_firewall_command_duration_seconds_count{%s} %d\n", labels, d.sum, labels, d.count)
+	}
+	fmt.Fprintf(w, "# HELP portknob_auth_failure_aggregated_total Failed logins counted by /16 or /32 because ratelimit-max-entries subnets had records.\n# TYPE portknob_auth_failure_aggregated_total counter\nportknob_auth_failure_aggregated_total %d\n", m.failureAggregated)
+	fmt.Fprintf(w, "# HELP portknob_auth_failure_evicted_total Failure records dropped to stay within ratelimit-max-entries.\n# TYPE portknob_auth_failure_evicted_total counter\nportknob_auth_failure_evicted_total %d\n", m.failureEvicted)
+	fmt.Fprintf(w, "# HELP portknob_auth_failure_dropped_total Failed logins not counted, every record being banned.\n# TYPE portknob_auth_failure_dropped_total counter\nportknob_auth_failure_dropped_total %d\n", m.failureDropped)
+	fmt.Fprintf(w, "# HELP portknob_denied_packets_total Packets stopped by the deny rules, by protocol, ports and destination they protect.\n# TYPE portknob_denied_packets_total counter\n")
+	writeLabeled(w, "portknob_denied_packets_total", "rule", m.denied)
+	fmt.Fprintf(w, "# HELP portknob_peer_clock_skew_seconds Estimated clock skew of other instances sharing the cache database, positive when ahead.\n# TYPE portknob_peer_clock_skew_seconds gauge\n")
+	peers := make([]string, 0, len(m.peerSkew))
+	for peer := range m.peerSkew {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	for _, peer := range peers {
+		fmt.Fprintf(w, "portknob_peer_clock_skew_seconds{peer=%q} %g\n", peer, m.peerSkew[peer])
+	}
+	elevated := 0
+	if m.defenseElevated {
+		elevated = 1
+	}
+	fmt.Fprintf(w, "# HELP portknob_defense_elevated Whether the posture of [defense] is elevated.\n# TYPE portknob_defense_elevated gauge\nportknob_defense_elevated %d\n", elevated)
+	fmt.Fprintf(w, "# HELP portknob_defense_changes_total Changes of the posture of [defense], either way.\n# TYPE portknob_defense_changes_total counter\nportknob_defense_changes_total %d\n", m.defenseChanges)
+	fmt.Fprintf(w, "# HELP portknob_http_request_duration_seconds Latency of the HTTP handlers.\n# TYPE portknob_http_request_duration_seconds histogram\n")
+	for i, bound := range metricsLatencyBuckets {
+		fmt.Fprintf(w, "portknob_http_request_duration_seconds_bucket{le=\"%g\"} %d\n", bound, m.latencyCounts[i])
+	}
+	fmt.Fprintf(w, "portknob_http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyCount)
+	fmt.Fprintf(w, "portknob_http_request_duration_seconds_sum %g\nportknob_http_request_duration_seconds_count %d\n", m.latencySum, m.latencyCount)
+}
+
+func writeLabeled(w io.Writer, name, label string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
@@ -0,0 +1,328 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Addresses, subnets and hostnames given to an option, the hostnames being resolved again every dns-refresh-interval
+// A nil list is empty
+type netList struct {
+	option		string
+	static		[]*net.IPNet
+	hosts		[]string
+	lookup		func (ctx context.Context, host string) ([]net.IP, error)
+	// Serializes Refresh, which alone writes resolved
+	mutex		sync.Mutex
+	// Addresses of each hostname at its last successful resolution
+	resolved	map[string][]net.IP
+	// Replaced as a whole, so matching needs no lock
+	table		atomic.Pointer[netTable]
+}
+
+// Ranges of addresses sorted by their first address, which never overlap
+type netTable struct {
+	v4			[]netRange
+	v6			[]netRange
+}
+
+type netRange struct {
+	first		[]byte
+	last		[]byte
+}
+
+// Parse the values of option, the ones neither an address nor a subnet must be hostnames
+func parseNetList(conf *config, option string, values []string) (*netList, error) {
+	l := &netList {
+		option:		option,
+		lookup:		func (ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+		resolved:	make(map[string][]net.IP),
+	}
+	for _, value := range values {
+		ipnet, err := parseAddrOrCIDR(value)
+		if err == nil {
+			l.static = append(l.static, ipnet)
+			continue
+		}
+		if !isHostname(value) {
+			return nil, conf.reportConfigError(option, value)
+		}
+		if !containsString(l.hosts, value) {
+			l.hosts = append(l.hosts, value)
+		}
+	}
+	l.rebuild()
+	return l, nil
+}
+
+// Whether s is a DNS name, so a mistyped address is not taken for one
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	labels := strings.Split(s, ".")
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label) - 1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	// "192.0.2.300" is a mistyped address, top-level domains are never numeric
+	last := labels[len(labels) - 1]
+	return strings.Trim(last, "0123456789") != ""
+}
+
+// Whether the option was given any value, even a hostname which does not resolve
+func (l *netList) Empty() bool {
+	return l == nil || len(l.static) == 0 && len(l.hosts) == 0
+}
+
+func (l *netList) Contains(addr net.IP) bool {
+	if l == nil || addr == nil {
+		return false
+	}
+	table := l.table.Load()
+	ranges, key := table.v6, addr.To16()
+	if ip4 := addr.To4(); ip4 != nil {
+		ranges, key = table.v4, ip4
+	}
+	// The last range starting at or before addr is the only one which may contain it
+	i := sort.Search(len(ranges), func (i int) bool {
+		return bytes.Compare(ranges[i].first, key) > 0
+	})
+	return i > 0 && bytes.Compare(key, ranges[i - 1].last) <= 0
+}
+
+// The subnet or hostname of the list containing addr, "" if none does, for explanations rather than every request
+func (l *netList) Match(addr net.IP) string {
+	if !l.Contains(addr) {
+		return ""
+	}
+	for _, ipnet := range l.static {
+		if ipnet.Contains(addr) {
+			return ipnet.String()
+		}
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, host := range l.hosts {
+		for _, resolved := range l.resolved[host] {
+			if resolved.Equal(addr) {
+				return host
+			}
+		}
+	}
+	return ""
+}
+
+// Resolve the hostnames again, keeping the last addresses of those which fail and logging the addresses which changed
+func (l *netList) Refresh(timeout time.Duration) {
+	if l == nil || len(l.hosts) == 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	changed := false
+	for _, host := range l.hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		addrs, err := l.lookup(ctx, host)
+		cancel()
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("no addresses")
+		}
+		if err != nil {
+			if prev, ok := l.resolved[host]; ok {
+				log.Printf("Cannot resolve %q in %q, keeping %s: %s\n", host, l.option, joinIPs(prev), err)
+			} else {
+				log.Printf("Cannot resolve %q in %q, it matches no address until it resolves: %s\n", host, l.option, err)
+			}
+			continue
+		}
+		addrs = sortIPs(addrs)
+		prev, ok := l.resolved[host]
+		added, removed := diffIPs(prev, addrs)
+		if ok && len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		if ok {
+			log.Printf("Resolved %q in %q again: added %s, removed %s\n", host, l.option, joinIPs(added), joinIPs(removed))
+		} else {
+			log.Printf("Resolved %q in %q to %s\n", host, l.option, joinIPs(addrs))
+		}
+		l.resolved[host] = addrs
+		changed = true
+	}
+	if changed {
+		l.rebuild()
+	}
+}
+
+// Start from the addresses old resolved its hostnames to, so a reload while DNS fails keeps them
+func (l *netList) Inherit(old *netList) {
+	if l == nil || old == nil || len(l.hosts) == 0 {
+		return
+	}
+	old.mutex.Lock()
+	l.mutex.Lock()
+	for _, host := range l.hosts {
+		if addrs, ok := old.resolved[host]; ok {
+			l.resolved[host] = addrs
+		}
+	}
+	old.mutex.Unlock()
+	l.rebuild()
+	l.mutex.Unlock()
+}
+
+// Build the prefix table of the subnets and resolved addresses
+func (l *netList) rebuild() {
+	table := &netTable {}
+	add := func (ipnet *net.IPNet) {
+		ip, mask := ipnet.IP, ipnet.Mask
+		if ip4 := ip.To4(); ip4 != nil && len(mask) == net.IPv4len {
+			ip = ip4
+		}
+		first := make([]byte, len(ip))
+		last := make([]byte, len(ip))
+		for i := range ip {
+			first[i] = ip[i] & mask[i]
+			last[i] = ip[i] | ^mask[i]
+		}
+		if len(ip) == net.IPv4len {
+			table.v4 = append(table.v4, netRange { first, last })
+		} else {
+			table.v6 = append(table.v6, netRange { first, last })
+		}
+	}
+	for _, ipnet := range l.static {
+		add(ipnet)
+	}
+	for _, host := range l.hosts {
+		for _, addr := range l.resolved[host] {
+			ipnet, _ := parseAddrOrCIDR(addr.String())
+			add(ipnet)
+		}
+	}
+	table.v4 = mergeRanges(table.v4)
+	table.v6 = mergeRanges(table.v6)
+	l.table.Store(table)
+}
+
+// Sort ranges and merge the overlapping ones, so at most one contains an address
+func mergeRanges(ranges []netRange) []netRange {
+	sort.Slice(ranges, func (i, j int) bool {
+		return bytes.Compare(ranges[i].first, ranges[j].first) < 0
+	})
+	var merged []netRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && bytes.Compare(r.first, merged[n - 1].last) <= 0 {
+			if bytes.Compare(r.last, merged[n - 1].last) > 0 {
+				merged[n - 1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func sortIPs(addrs []net.IP) []net.IP {
+	sorted := make([]net.IP, len(addrs))
+	copy(sorted, addrs)
+	sort.Slice(sorted, func (i, j int) bool {
+		return bytes.Compare(sorted[i].To16(), sorted[j].To16()) < 0
+	})
+	return sorted
+}
+
+// Return the addresses only in newAddrs and the addresses only in oldAddrs
+func diffIPs(oldAddrs, newAddrs []net.IP) (added, removed []net.IP) {
+	has := func (addrs []net.IP, addr net.IP) bool {
+		for _, a := range addrs {
+			if a.Equal(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, addr := range newAddrs {
+		if !has(oldAddrs, addr) {
+			added = append(added, addr)
+		}
+	}
+	for _, addr := range oldAddrs {
+		if !has(newAddrs, addr) {
+			removed = append(removed, addr)
+		}
+	}
+	return
+}
+
+func joinIPs(addrs []net.IP) string {
+	if len(addrs) == 0 {
+		return "none"
+	}
+	s := make([]string, len(addrs))
+	for i, addr := range addrs {
+		s[i] = addr.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// Lists of the configuration which may contain hostnames
+func (conf *config) netLists() []*netList {
+	return []*netList { conf.Daemon.trustedNets, conf.Daemon.allowNets, conf.Daemon.denyNets }
+}
+
+// Time allowed to resolve a hostname, at most 10 seconds and never beyond the next refresh
+func (conf *config) dnsTimeout() time.Duration {
+	timeout := time.Duration(conf.Daemon.DNSRefreshInterval) * time.Second
+	if timeout > 10 * time.Second {
+		timeout = 10 * time.Second
+	}
+	return timeout
+}
+
+// Resolve the hostnames in trusted-proxies, allow-cidr and deny-cidr, starting from those of old if not nil
+func (conf *config) resolveHosts(old *config) {
+	for i, l := range conf.netLists() {
+		if old != nil {
+			l.Inherit(old.netLists()[i])
+		}
+		l.Refresh(conf.dnsTimeout())
+	}
+}
@@ -0,0 +1,179 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNetListContains(t *testing.T) {
+	l, err := parseNetList(&config {}, "allow-cidr", []string {"192.0.2.0/25", "192.0.2.64/26", "192.0.2.128/25", "198.51.100.7", "10.0.0.0/8", "2001:db8::/32", "2001:db8:1::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr	string
+		want	bool
+	}{
+		{ "192.0.2.0", true },
+		{ "192.0.2.100", true },
+		{ "192.0.2.255", true },
+		{ "192.0.1.255", false },
+		{ "192.0.3.0", false },
+		{ "198.51.100.7", true },
+		{ "198.51.100.6", false },
+		{ "198.51.100.8", false },
+		{ "10.255.255.255", true },
+		{ "11.0.0.0", false },
+		{ "9.255.255.255", false },
+		{ "::ffff:192.0.2.1", true },
+		{ "2001:db8::1", true },
+		{ "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true },
+		{ "2001:db9::", false },
+		{ "2001:db7:ffff::", false },
+		{ "::", false },
+		{ "0.0.0.0", false },
+	}
+	for _, tt := range tests {
+		if got := l.Contains(net.ParseIP(tt.addr)); got != tt.want {
+			t.Errorf("Contains(%s) = %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+	if l.Contains(nil) {
+		t.Error("Contains(nil) = true")
+	}
+	var empty *netList
+	if !empty.Empty() || empty.Contains(net.ParseIP("192.0.2.1")) {
+		t.Error("nil list is not empty")
+	}
+}
+
+func TestParseNetList(t *testing.T) {
+	tests := []struct {
+		value	string
+		wantErr	bool
+	}{
+		{ "192.0.2.0/24", false },
+		{ "2001:db8::1", false },
+		{ "proxy.example.com", false },
+		{ "proxy.example.com.", false },
+		{ "localhost", false },
+		{ "192.0.2.300", true },
+		{ "192.0.2.0/33", true },
+		{ "proxy example", true },
+		{ "-proxy.example.com", true },
+		{ "proxy..example.com", true },
+		{ "", true },
+	}
+	for _, tt := range tests {
+		l, err := parseNetList(&config {}, "trusted-proxies", []string {tt.value})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseNetList(%q) error %v, want error %t", tt.value, err, tt.wantErr)
+		}
+		if err == nil && l.Empty() {
+			t.Errorf("parseNetList(%q) is empty", tt.value)
+		}
+	}
+}
+
+// Answers lookups from a script, one step per Refresh
+type testResolver struct {
+	addrs	[]string
+	err		error
+}
+
+func (r *testResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	var addrs []net.IP
+	for _, addr := range r.addrs {
+		addrs = append(addrs, net.ParseIP(addr))
+	}
+	return addrs, nil
+}
+
+func TestNetListRefresh(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	errDNS := errors.New("server misbehaving")
+	steps := []struct {
+		name	string
+		addrs	[]string
+		err		error
+		in		[]string
+		out		[]string
+		// Logged, "" for nothing
+		wantLog	string
+	}{
+		{ "not resolved yet", nil, errDNS, nil, []string {"192.0.2.1"}, "matches no address until it resolves" },
+		{ "resolved", []string {"192.0.2.1"}, nil, []string {"192.0.2.1", "198.51.100.1"}, []string {"192.0.2.2"}, "to 192.0.2.1" },
+		{ "address added", []string {"192.0.2.2", "192.0.2.1"}, nil, []string {"192.0.2.1", "192.0.2.2"}, nil, "added 192.0.2.2, removed none" },
+		{ "unchanged", []string {"192.0.2.1", "192.0.2.2"}, nil, []string {"192.0.2.1", "192.0.2.2"}, nil, "" },
+		{ "failure keeps the last addresses", nil, errDNS, []string {"192.0.2.1", "192.0.2.2"}, nil, "keeping 192.0.2.1, 192.0.2.2" },
+		{ "no addresses keeps the last addresses", []string {}, nil, []string {"192.0.2.1", "192.0.2.2"}, nil, "no addresses" },
+		{ "address removed", []string {"192.0.2.2", "2001:db8::2"}, nil, []string {"192.0.2.2", "2001:db8::2"}, []string {"192.0.2.1"}, "added 2001:db8::2, removed 192.0.2.1" },
+	}
+	resolver := &testResolver {}
+	l, err := parseNetList(&config {}, "trusted-proxies", []string {"proxy.example.com", "198.51.100.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.lookup = resolver.lookup
+	for _, step := range steps {
+		resolver.addrs, resolver.err = step.addrs, step.err
+		buf.Reset()
+		l.Refresh(time.Second)
+		for _, addr := range step.in {
+			if !l.Contains(net.ParseIP(addr)) {
+				t.Errorf("%s: %s not in the list", step.name, addr)
+			}
+		}
+		for _, addr := range step.out {
+			if l.Contains(net.ParseIP(addr)) {
+				t.Errorf("%s: %s in the list", step.name, addr)
+			}
+		}
+		if step.wantLog == "" && buf.Len() != 0 || !strings.Contains(buf.String(), step.wantLog) {
+			t.Errorf("%s: logged %q, want %q", step.name, buf.String(), step.wantLog)
+		}
+	}
+
+	// A reload while DNS fails keeps the addresses from before
+	reloaded, err := parseNetList(&config {}, "trusted-proxies", []string {"proxy.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded.lookup = (&testResolver { err: errDNS }).lookup
+	reloaded.Inherit(l)
+	reloaded.Refresh(time.Second)
+	if !reloaded.Contains(net.ParseIP("192.0.2.2")) || reloaded.Contains(net.ParseIP("198.51.100.1")) {
+		t.Error("reloaded list lost the addresses resolved before")
+	}
+}
@@ -0,0 +1,383 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type configNotify struct {
+	// Events to notify about
+	// Supported values: "login" (successful logins), "ban" (subnets banned after failed logins or a honeypot user), "expire" (whitelist entries expiring), "impossible-travel" (logins too far from the last one), "grant" (whitelisting by the admin API or the control socket), "pending-grant" (logins by cookie waiting for cookie-grant-delay), "defense" (changes of the posture of [defense])
+	// Panics are always notified about
+	// Default: ["login", "ban", "expire", "impossible-travel", "grant", "pending-grant", "defense"]
+	Events			[]string	`toml:"events"`
+
+	// URL to POST a JSON payload to for each event
+	// Default: "" (no webhook)
+	WebhookURL		string		`toml:"webhook-url"`
+
+	// Go text/template of the payload, given the fields of the event, e.g. {"text": {{json .message}}}
+	// Default: "" (the fields as a JSON object)
+	WebhookTemplate	string		`toml:"webhook-template"`
+
+	// Mail server to send a mail through for each event, "host:port", STARTTLS is used when the server offers it
+	// Default: "" (no mail)
+	SMTPServer		string		`toml:"smtp-server"`
+
+	// Credentials for the mail server, only sent over TLS
+	// Default: "" (no authentication)
+	SMTPUsername	string		`toml:"smtp-username"`
+	SMTPPassword	string		`toml:"smtp-password"`
+
+	// Sender and recipients of the mails
+	// Required with "smtp-server"
+	SMTPFrom		string		`toml:"smtp-from"`
+	SMTPTo			[]string	`toml:"smtp-to"`
+
+	// Attempts to deliver each notification, waiting twice as long after each failure, starting at a second
+	// Default: 5
+	Retries			uint64		`toml:"retries"`
+
+	// Seconds to wait for the webhook or the mail server on each attempt
+	// Default: 10
+	Timeout			uint64		`toml:"timeout"`
+}
+
+var notifyEvents = []string { "login", "ban", "expire", "impossible-travel", "grant", "pending-grant", "defense" }
+
+// Sent whatever "events" says, marked "priority": "urgent" and waited for rather than dropped when the queue is full
+var notifyUrgentEvents = []string { "panic" }
+
+const notifyUrgentWait = 10 * time.Second
+
+func (n *configNotify) parse(conf *config) error {
+	if n.Events == nil {
+		n.Events = notifyEvents
+	}
+	for _, event := range n.Events {
+		if !containsString(notifyEvents, event) {
+			return conf.reportConfigError("events", event)
+		}
+	}
+	if n.WebhookURL == "" && n.SMTPServer == "" {
+		return &configError { "[notify] requires \"webhook-url\" or \"smtp-server\"\n" }
+	}
+	if n.WebhookURL != "" {
+		webhookURL, err := url.Parse(n.WebhookURL)
+		if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+			return conf.reportConfigError("webhook-url", n.WebhookURL)
+		}
+	}
+	if n.WebhookTemplate != "" {
+		_, err := newNotifyTemplate(n.WebhookTemplate)
+		if err != nil {
+			return &configError { fmt.Sprintf("cannot parse option \"webhook-template\": %s\n", err) }
+		}
+	}
+	if n.SMTPServer != "" {
+		_, _, err := net.SplitHostPort(n.SMTPServer)
+		if err != nil {
+			return conf.reportConfigError("smtp-server", n.SMTPServer)
+		}
+		if n.SMTPFrom == "" {
+			return &configError { "option \"smtp-server\" requires \"smtp-from\"\n" }
+		}
+		if len(n.SMTPTo) == 0 {
+			return &configError { "option \"smtp-server\" requires \"smtp-to\"\n" }
+		}
+		// Addresses are written into the headers as they are
+		if strings.ContainsAny(n.SMTPFrom, "\r\n<>") {
+			return conf.reportConfigError("smtp-from", n.SMTPFrom)
+		}
+		for _, address := range n.SMTPTo {
+			if strings.ContainsAny(address, "\r\n<>") {
+				return conf.reportConfigError("smtp-to", address)
+			}
+		}
+	}
+	if n.SMTPUsername == "" && n.SMTPPassword != "" {
+		return &configError { "option \"smtp-password\" requires \"smtp-username\"\n" }
+	}
+	if n.Retries == 0 {
+		n.Retries = 5
+	}
+	if n.Timeout == 0 {
+		n.Timeout = 10
+	}
+	return nil
+}
+
+func newNotifyTemplate(text string) (*template.Template, error) {
+	return template.New("webhook-template").Funcs(template.FuncMap {
+		"json": func (value interface{}) (string, error) {
+			b, err := json.Marshal(value)
+			return string(b), err
+		},
+	}).Parse(text)
+}
+
+// Longest wait between two delivery attempts
+const notifyMaxBackoff = 5 * time.Minute
+
+// Notifications waiting for delivery, further ones are dropped so a slow endpoint never blocks a login
+const notifyQueueLength = 100
+
+// Delivers notifications about access events in the background, a nil notifier discards everything
+// The settings are copied when it is created, so [notify] changes require a restart
+type notifier struct {
+	conf		configNotify
+	template	*template.Template
+	hostname	string
+	client		*http.Client
+	webhook		chan map[string]interface{}
+	mail		chan map[string]interface{}
+}
+
+func newNotifier(conf *config) *notifier {
+	if conf.Notify == nil {
+		return nil
+	}
+	n := &notifier {
+		conf:		*conf.Notify,
+		client:		&http.Client { Timeout: time.Duration(conf.Notify.Timeout) * time.Second },
+	}
+	n.hostname, _ = os.Hostname()
+	if n.conf.WebhookTemplate != "" {
+		// Already checked by configNotify.parse
+		n.template, _ = newNotifyTemplate(n.conf.WebhookTemplate)
+	}
+	if n.conf.WebhookURL != "" {
+		n.webhook = make(chan map[string]interface{}, notifyQueueLength)
+		go n.deliver("webhook", n.webhook, n.sendWebhook)
+	}
+	if n.conf.SMTPServer != "" {
+		n.mail = make(chan map[string]interface{}, notifyQueueLength)
+		go n.deliver("mail", n.mail, n.sendMail)
+	}
+	return n
+}
+
+// Notify about event, if enabled in "events", with message for people and fields given as key, value pairs
+func (n *notifier) Event(event string, message string, keyvals ...interface{}) {
+	urgent := containsString(notifyUrgentEvents, event)
+	if n == nil || !urgent && !containsString(n.conf.Events, event) {
+		return
+	}
+	fields := map[string]interface{} {
+		"time":		time.Now().UTC().Format(time.RFC3339),
+		"event":	event,
+		"host":		n.hostname,
+		"message":	message,
+	}
+	for i := 0; i + 1 < len(keyvals); i += 2 {
+		fields[fmt.Sprint(keyvals[i])] = eventValue(keyvals[i + 1])
+	}
+	if urgent {
+		fields["priority"] = "urgent"
+	}
+	for name, queue := range map[string]chan map[string]interface{} { "webhook": n.webhook, "mail": n.mail } {
+		if queue == nil {
+			continue
+		}
+		select {
+		case queue <- fields:
+			continue
+		default:
+		}
+		if urgent {
+			select {
+			case queue <- fields:
+				continue
+			case <-time.After(notifyUrgentWait):
+			}
+		}
+		log.Printf("Notify: %s queue is full, dropping notification %q\n", name, message)
+	}
+}
+
+// Send the notifications of queue one after another, retrying each with a growing pause
+func (n *notifier) deliver(name string, queue chan map[string]interface{}, send func (map[string]interface{}) error) {
+	for fields := range queue {
+		pause := time.Second
+		for attempt := uint64(1); ; attempt++ {
+			err := send(fields)
+			if err == nil {
+				break
+			}
+			if _, permanent := err.(permanentError); permanent || attempt >= n.conf.Retries {
+				log.Printf("Notify: cannot send %s notification %q after %d attempts: %s\n", name, fields["message"], attempt, err)
+				break
+			}
+			time.Sleep(pause)
+			pause *= 2
+			if pause > notifyMaxBackoff {
+				pause = notifyMaxBackoff
+			}
+		}
+	}
+}
+
+// A delivery failure which trying again cannot fix
+type permanentError struct {
+	err			error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (n *notifier) sendWebhook(fields map[string]interface{}) error {
+	var body bytes.Buffer
+	if n.template == nil {
+		err := json.NewEncoder(&body).Encode(fields)
+		if err != nil {
+			return permanentError { err }
+		}
+	} else {
+		err := n.template.Execute(&body, fields)
+		if err != nil {
+			return permanentError { err }
+		}
+	}
+	req, err := http.NewRequest("POST", n.conf.WebhookURL, &body)
+	if err != nil {
+		return permanentError { err }
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "portknob/" + version)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode / 100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("webhook returned %s", resp.Status)
+	if resp.StatusCode / 100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		// The endpoint rejects the payload, it would reject it again
+		return permanentError { err }
+	}
+	return err
+}
+
+func (n *notifier) sendMail(fields map[string]interface{}) error {
+	timeout := time.Duration(n.conf.Timeout) * time.Second
+	host, _, _ := net.SplitHostPort(n.conf.SMTPServer)
+	conn, err := net.DialTimeout("tcp", n.conf.SMTPServer, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config { ServerName: host, MinVersion: tls.VersionTLS12 })
+		if err != nil {
+			return err
+		}
+	}
+	if n.conf.SMTPUsername != "" {
+		// PlainAuth refuses to send the password without TLS, except to localhost
+		err = c.Auth(smtp.PlainAuth("", n.conf.SMTPUsername, n.conf.SMTPPassword, host))
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(n.conf.SMTPFrom)
+	if err != nil {
+		return err
+	}
+	for _, to := range mailRecipients(n.conf.SMTPTo, fields) {
+		err = c.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(n.mailMessage(fields))
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Return smtp-to and the "email" of the user an event is meant for, such as a pending grant
+func mailRecipients(to []string, fields map[string]interface{}) []string {
+	if email, ok := fields["email"].(string); ok && email != "" && !containsString(to, email) {
+		return append(append([]string(nil), to...), email)
+	}
+	return to
+}
+
+func (n *notifier) mailMessage(fields map[string]interface{}) []byte {
+	// Usernames of failed logins come from the client, they must not start new header lines
+	subject := strings.Map(func (r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, fmt.Sprintf("portknob on %s: %s", n.hostname, fields["message"]))
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.conf.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(mailRecipients(n.conf.SMTPTo, fields), ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if fields["priority"] == "urgent" {
+		msg.WriteString("Importance: high\r\nX-Priority: 1\r\n")
+	}
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\n", fields["message"])
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if key != "message" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&msg, "%s: %v\r\n", key, fields[key])
+	}
+	return msg.Bytes()
+}
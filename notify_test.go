@@ -0,0 +1,112 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/mail"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNotifyParse(t *testing.T) {
+	tests := []struct {
+		name	string
+		notify	configNotify
+		wantErr	string
+	}{
+		{ "mail", configNotify { SMTPServer: "mail.example.com:25", SMTPFrom: "portknob@example.com", SMTPTo: []string {"admin@example.com"} }, "" },
+		{ "webhook", configNotify { WebhookURL: "https://hooks.example.com/portknob" }, "" },
+		{ "nothing to send to", configNotify {}, "requires" },
+		{ "bad webhook scheme", configNotify { WebhookURL: "ftp://hooks.example.com/" }, `"webhook-url"` },
+		{ "unknown event", configNotify { WebhookURL: "https://hooks.example.com/", Events: []string {"reboot"} }, `"events"` },
+		{ "no port", configNotify { SMTPServer: "mail.example.com", SMTPFrom: "portknob@example.com", SMTPTo: []string {"admin@example.com"} }, `"smtp-server"` },
+		{ "no sender", configNotify { SMTPServer: "mail.example.com:25", SMTPTo: []string {"admin@example.com"} }, `requires "smtp-from"` },
+		{ "no recipient", configNotify { SMTPServer: "mail.example.com:25", SMTPFrom: "portknob@example.com" }, `requires "smtp-to"` },
+		{ "header in sender", configNotify { SMTPServer: "mail.example.com:25", SMTPFrom: "portknob@example.com\r\nBcc: evil@example.com", SMTPTo: []string {"admin@example.com"} }, `"smtp-from"` },
+		{ "header in recipient", configNotify { SMTPServer: "mail.example.com:25", SMTPFrom: "portknob@example.com", SMTPTo: []string {"admin@example.com\nBcc: evil@example.com"} }, `"smtp-to"` },
+		{ "password without username", configNotify { WebhookURL: "https://hooks.example.com/", SMTPPassword: "hunter2" }, `"smtp-username"` },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			err := tt.notify.parse(&config {})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Usernames of failed logins come from clients, they must not add headers to the mail
+func TestMailMessage(t *testing.T) {
+	n := &notifier {
+		conf:		configNotify { SMTPFrom: "portknob@example.com", SMTPTo: []string {"a@example.com", "b@example.com"} },
+		hostname:	"gateway",
+	}
+	tests := []struct {
+		name		string
+		message		string
+		user		string
+		wantSubject	string
+	}{
+		{ "plain", "Login of alice", "alice", "portknob on gateway: Login of alice" },
+		{ "CRLF in the message", "Login of x\r\nBcc: evil@example.com", "x", "portknob on gateway: Login of x  Bcc: evil@example.com" },
+		{ "LF in the message", "Login of x\nBcc: evil@example.com", "x", "portknob on gateway: Login of x Bcc: evil@example.com" },
+		{ "control characters", "Login\x00of\x7fx", "x", "portknob on gateway: Login of x" },
+		{ "CRLF in a field", "Login of x", "x\r\nBcc: evil@example.com", "portknob on gateway: Login of x" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			msg, err := mail.ReadMessage(bytes.NewReader(n.mailMessage(map[string]interface{} { "message": tt.message, "user": tt.user, "event": "login" })))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var headers []string
+			for key := range msg.Header {
+				headers = append(headers, key)
+			}
+			sort.Strings(headers)
+			if got, want := strings.Join(headers, ","), "Content-Type,Date,From,Mime-Version,Subject,To"; got != want {
+				t.Errorf("headers %s, want %s", got, want)
+			}
+			if got := msg.Header.Get("Subject"); got != tt.wantSubject {
+				t.Errorf("subject %q, want %q", got, tt.wantSubject)
+			}
+			if got := msg.Header.Get("To"); got != "a@example.com, b@example.com" {
+				t.Errorf("recipients %q", got)
+			}
+			body, err := io.ReadAll(msg.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(body), "event: login\r\n") {
+				t.Errorf("body %q lacks the fields", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Single sign-on users are recorded as "oidc:<username>", so they share no login times, schedule or lifespan with users of [secrets] or the directory
+const oidcUserPrefix = "oidc:"
+
+type configOIDC struct {
+	// Issuer URL of the OpenID Connect provider, its discovery document is read from there
+	// This is a mandatory option
+	Issuer			string		`toml:"issuer"`
+
+	// Client registered with the provider
+	// This is a mandatory option
+	ClientID		string		`toml:"client-id"`
+	ClientSecret	string		`toml:"client-secret"`
+
+	// URL the provider sends visitors back to, as registered with it
+	// Portknob serves the sign in on its path, which must differ from "http-path"
+	// This is a mandatory option
+	RedirectURL		string		`toml:"redirect-url"`
+	redirectPath	string
+
+	// Scopes to ask for besides "openid"
+	// Default: ["profile", "email"]
+	Scopes			[]string	`toml:"scopes"`
+
+	// ID token claim holding the username
+	// Default: "preferred_username"
+	UsernameClaim	string		`toml:"username-claim"`
+
+	// Users allowed to sign in
+	// Default: [] (every user of the provider)
+	AllowedUsers	[]string	`toml:"allowed-users"`
+
+	// Rule groups opened for users signing in, in addition to rules without a group
+	// Default: []
+	Groups			[]string	`toml:"groups"`
+
+	// The provider is discovered at the first sign in, so Portknob starts while it is unreachable
+	mutex			sync.Mutex
+	provider		*oidc.Provider
+}
+
+func (o *configOIDC) parse(conf *config) error {
+	if o.Issuer == "" {
+		return &configError { "option \"issuer\" not specified in [auth.oidc]\n" }
+	}
+	if o.ClientID == "" {
+		return &configError { "option \"client-id\" not specified in [auth.oidc]\n" }
+	}
+	if o.RedirectURL == "" {
+		return &configError { "option \"redirect-url\" not specified in [auth.oidc]\n" }
+	}
+	redirectURL, err := url.Parse(o.RedirectURL)
+	if err != nil || (redirectURL.Scheme != "http" && redirectURL.Scheme != "https") || redirectURL.Host == "" || !strings.HasPrefix(redirectURL.Path, "/") {
+		return conf.reportConfigError("redirect-url", o.RedirectURL)
+	}
+	o.redirectPath = redirectURL.Path
+	if o.redirectPath == conf.Daemon.HTTPPath || (conf.Daemon.AdminPath != "" && strings.HasPrefix(o.redirectPath + "/", conf.Daemon.AdminPath + "/")) {
+		return &configError { fmt.Sprintf("the path of option \"redirect-url\" %q is already served\n", o.redirectPath) }
+	}
+	if o.Scopes == nil {
+		o.Scopes = []string { "profile", "email" }
+	}
+	if o.UsernameClaim == "" {
+		o.UsernameClaim = "preferred_username"
+	}
+	for user := range conf.Secrets {
+		if strings.HasPrefix(user, oidcUserPrefix) {
+			return &configError { fmt.Sprintf("user %q in [secrets] has the prefix %q of single sign-on users\n", user, oidcUserPrefix) }
+		}
+	}
+	for _, group := range o.Groups {
+		err = conf.checkGroupName(group)
+		if err != nil {
+			return err
+		}
+		if !conf.hasGroup(group) {
+			log.Printf("Warning: [auth.oidc] has group %q, but no firewall rule uses it\n", group)
+		}
+	}
+	return nil
+}
+
+// Discover the provider, a failed discovery is tried again at the next sign in
+func (o *configOIDC) oauth2Config(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.provider == nil {
+		provider, err := oidc.NewProvider(ctx, o.Issuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		o.provider = provider
+	}
+	config := &oauth2.Config {
+		ClientID:		o.ClientID,
+		ClientSecret:	o.ClientSecret,
+		Endpoint:		o.provider.Endpoint(),
+		RedirectURL:	o.RedirectURL,
+		Scopes:			append([]string { oidc.ScopeOpenID }, o.Scopes...),
+	}
+	return config, o.provider.Verifier(&oidc.Config { ClientID: o.ClientID }), nil
+}
+
+// Trade the authorization code for an ID token and read the username from it
+func (o *configOIDC) exchange(ctx context.Context, code, nonce, verifier string) (string, error) {
+	config, idVerifier, err := o.oauth2Config(ctx)
+	if err != nil {
+		return "", err
+	}
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return "", err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", fmt.Errorf("no ID token in the token response")
+	}
+	idToken, err := idVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return "", err
+	}
+	if idToken.Nonce != nonce {
+		return "", fmt.Errorf("ID token nonce mismatch")
+	}
+	var claims map[string]interface{}
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return "", err
+	}
+	user, ok := claims[o.UsernameClaim].(string)
+	if !ok || user == "" {
+		return "", fmt.Errorf("ID token has no string claim %q", o.UsernameClaim)
+	}
+	return user, nil
+}
+
+func (o *configOIDC) allowed(user string) bool {
+	return len(o.AllowedUsers) == 0 || containsString(o.AllowedUsers, user)
+}
+
+// Serve redirect-url: without a state, send the visitor to the provider, with one, finish the sign in
+func (s *server) oidcHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+
+	o := s.conf.Auth.OIDC
+	if o == nil || r.URL.Path != o.redirectPath {
+		// Removed by a reload
+		http.NotFound(w, r)
+		return
+	}
+	clientIP, err := s.clientIP(r)
+	if err != nil {
+		s.writeError(w, r, 400, "bad-request", "Bad Request: " + err.Error())
+		return
+	}
+	if clientIP == nil {
+		s.writeError(w, r, 500, "internal", "cannot find client's IP address")
+		return
+	}
+	if s.writePolicyDenied(w, r, clientIP) {
+		return
+	}
+	if s.writeBanned(w, r, clientIP) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10 * time.Second)
+	defer cancel()
+
+	query := r.URL.Query()
+	if query.Get("state") == "" {
+		config, _, err := o.oauth2Config(ctx)
+		if err != nil {
+			log.Printf("OIDC: cannot discover %q: %s\n", o.Issuer, err)
+			s.writeError(w, r, 503, "unavailable", "Service Unavailable: cannot reach the sign in provider")
+			return
+		}
+		state, nonce, verifier := randomToken(), randomToken(), oauth2.GenerateVerifier()
+		http.SetCookie(w, &http.Cookie {
+			Name:		"portknob_oidc",
+			Value:		state + "." + nonce + "." + verifier,
+			Path:		o.redirectPath,
+			MaxAge:		600,
+			HttpOnly:	true,
+			Secure:		s.secureRequest(r),
+			// Sent along when the provider redirects back
+			SameSite:	http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), 303)
+		return
+	}
+
+	cookie, _ := s.cookieString(r, "portknob_oidc")
+	http.SetCookie(w, &http.Cookie { Name: "portknob_oidc", Path: o.redirectPath, MaxAge: -1 })
+	fields := strings.Split(cookie, ".")
+	if len(fields) != 3 || fields[0] != query.Get("state") {
+		s.writeError(w, r, 400, "bad-request", "Bad Request: the sign in expired or was started in another browser, try again")
+		return
+	}
+	if reason := query.Get("error"); reason != "" {
+		s.writeError(w, r, 403, "forbidden", "Access Forbidden: the sign in provider refused: " + reason + " " + query.Get("error_description"))
+		return
+	}
+	user, err := o.exchange(ctx, query.Get("code"), fields[1], fields[2])
+	if err != nil {
+		log.Printf("OIDC: sign in from %s failed: %s\n", clientIP, err)
+		s.fw.metrics.AuthFailure("unknown")
+		s.auditLogin("failure", "oidc", "", clientIP)
+		s.writeError(w, r, 403, "forbidden", "Access Forbidden: the sign in could not be verified")
+		return
+	}
+	if !o.allowed(user) {
+		if s.conf.Daemon.Verbose >= 1 {
+			log.Printf("OIDC: user %q from %s is not in \"allowed-users\"\n", user, clientIP)
+		}
+		s.fw.metrics.AuthFailure("unknown")
+		s.auditLogin("forbidden", "oidc", user, clientIP)
+		s.writeError(w, r, 403, "forbidden", "Access Forbidden: user " + user + " may not log in")
+		return
+	}
+	user = oidcUserPrefix + user
+
+	now := time.Now()
+	timeout, allowed, boundary := s.loginTimeout(user, now)
+	if !allowed {
+		s.auditLogin("forbidden", "oidc", user, clientIP)
+		s.writeScheduleForbidden(w, r, boundary)
+		return
+	}
+	prefix, timeout, notes, err := s.grantLogin(clientIP, user, "oidc", o.Groups, timeout, s.loginDeadline(user, boundary), now)
+	if err != nil {
+		s.writeGrantLoginError(w, r, err, now)
+		return
+	}
+	gated, _ := s.conf.gatedGroups(o.Groups)
+	s.auditSuccess("oidc", user, clientIP, gated)
+	if s.conf.Daemon.Verbose >= 1 {
+		log.Printf("OIDC: user %q signed in, whitelisted %s/%d\n", user, clientIP, prefix)
+	}
+	s.writeLoginSucceeded(w, r, clientIP, prefix, timeout, "", append(s.gatedNotes(w, gated), notes...), false)
+}
+
+func randomToken() string {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(token)
+}
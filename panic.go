@@ -0,0 +1,160 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// A panic revokes every whitelist entry, login cookie and grant token at once, for a suspected credential leak
+// Users get back in by logging in again with their password, the firewall rules and bans stay
+// The request must carry panicPhrase, so a stray or replayed command line cannot trigger it
+const panicPhrase = "revoke everything"
+
+// What a panic removed
+type panicSummary struct {
+	At			string		`json:"at"`
+	By			string		`json:"by"`
+	Revoked		[]string	`json:"revoked"`
+	Entries		int			`json:"entries"`
+	Users		[]string	`json:"users"`
+}
+
+type panicReply struct {
+	Panic		bool		`json:"panic"`
+	State		string		`json:"state,omitempty"`
+	At			string		`json:"at,omitempty"`
+	By			string		`json:"by,omitempty"`
+	Revoked		int			`json:"revoked,omitempty"`
+}
+
+// Run a panic requested by by at now
+// The record is written first and left "pending" until every entry is revoked, so Start finishes a panic cut short
+func (fw *firewall) Panic(by string, now time.Time) (summary panicSummary, err error) {
+	summary = panicSummary { At: now.UTC().Format(time.RFC3339), By: by, Revoked: []string {}, Users: []string {} }
+	err = fw.cache.SetPanic(panicRecord { "pending", now, by, 0 })
+	if err != nil {
+		return
+	}
+	// First, so no cookie renews an entry meanwhile
+	err = fw.cache.BumpGlobalEpoch()
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	// Logins already past the cookie check may add entries meanwhile, a few passes catch them
+	for pass := 0; pass < 3; pass++ {
+		var entries []cacheEntry
+		entries, err = fw.cache.Entries()
+		if err != nil {
+			return
+		}
+		if len(entries) == 0 {
+			break
+		}
+		var addrs []net.IP
+		var subnets []string
+		for _, entry := range entries {
+			summary.Entries++
+			if entry.user != "" && !containsString(summary.Users, entry.user) {
+				summary.Users = append(summary.Users, entry.user)
+			}
+			subnet := fw.Subnet(entry.addr).String()
+			if seen[subnet] {
+				continue
+			}
+			addrs = append(addrs, entry.addr)
+			subnets = append(subnets, subnet)
+			seen[subnet] = true
+		}
+		err = fw.Revoke(addrs...)
+		if err != nil {
+			return
+		}
+		summary.Revoked = append(summary.Revoked, subnets...)
+	}
+	err = fw.cache.SetPanic(panicRecord { "executed", now, by, len(summary.Revoked) })
+	if err != nil {
+		return
+	}
+	log.Printf("Panic: %s revoked %d whitelist entries of %d subnets and every login cookie\n", by, summary.Entries, len(summary.Revoked))
+	fw.audit.Event("panic", "by", by, "subnets", len(summary.Revoked), "entries", summary.Entries, "users", summary.Users)
+	fw.notify.Event("panic", fmt.Sprintf("Panic: %s revoked every whitelist entry (%d subnets) and login cookie", by, len(summary.Revoked)), "by", by, "subnets", summary.Revoked, "users", summary.Users)
+	return
+}
+
+// Serve GET, POST and DELETE /panic for the control socket and the admin API, by being who asks
+// POST runs a panic when confirm is panicPhrase, DELETE acknowledges the record of the last one
+func (s *server) servePanic(w http.ResponseWriter, r *http.Request, by string) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if r.PostFormValue("confirm") != panicPhrase {
+			s.writeJSON(w, 400, map[string]string { "error": fmt.Sprintf("confirm must be %q", panicPhrase) })
+			return
+		}
+		summary, err := s.fw.Panic(by, time.Now())
+		if err != nil {
+			log.Println(err)
+			s.writeJSON(w, 500, map[string]interface{} { "error": "cannot revoke every entry, run the panic again", "revoked": summary.Revoked })
+			return
+		}
+		s.writeJSON(w, 200, summary)
+		return
+	case "DELETE":
+		code, message := s.acknowledgePanic(by)
+		if code != 200 {
+			s.writeJSON(w, code, map[string]string { "error": message })
+			return
+		}
+	default:
+		s.writeJSON(w, 405, map[string]string { "error": "method not allowed" })
+		return
+	}
+	s.writeJSON(w, 200, s.panicState())
+}
+
+// Forget the record of an executed panic, returning the HTTP status and message of the failure
+func (s *server) acknowledgePanic(by string) (int, string) {
+	p, ok := s.fw.cache.Panic()
+	if !ok {
+		return 200, ""
+	}
+	if p.state != "executed" {
+		return 409, "the panic has not finished, run it again"
+	}
+	err := s.fw.cache.ClearPanic()
+	if err != nil {
+		return 500, "cannot update cache database"
+	}
+	s.fw.audit.Event("panic-acknowledge", "by", by, "at", p.at)
+	return 200, ""
+}
+
+func (s *server) panicState() panicReply {
+	p, ok := s.fw.cache.Panic()
+	if !ok {
+		return panicReply {}
+	}
+	return panicReply { true, p.state, p.at.UTC().Format(time.RFC3339), p.by, p.revoked }
+}
@@ -0,0 +1,134 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Nothing but the rules and the bans survives a panic
+func TestPanic(t *testing.T) {
+	tests := []struct {
+		name		string
+		admin		bool
+		// Basic auth user of the admin API
+		user		string
+		confirm		string
+		wantCode	int
+	}{
+		{ "control socket", false, "", panicPhrase, 200 },
+		{ "wrong phrase", false, "", "yes", 400 },
+		{ "admin API", true, "oncall", panicPhrase, 200 },
+		{ "admin without the scope", true, "admin", panicPhrase, 403 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			log.SetOutput(io.Discard)
+			defer log.SetOutput(os.Stderr)
+			s, backend := newTestServer(t, "auth-ban-firewall = true\nadmin-path = \"/admin\"\nadmin-panic-users = [\"oncall\"]\n[[firewall]]\ndport = \"22\"\n[[firewall]]\ndport = \"80\"\ngroup = \"web\"\n[secrets]\nalice = \"hunter2\"\nbob = \"hunter3\"\n[admin-secrets]\nadmin = \"admin1\"\noncall = \"admin2\"\n")
+			w := testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+			if w.Code != 200 {
+				t.Fatalf("login replied %d: %s", w.Code, w.Body.String())
+			}
+			cookies := w.Result().Cookies()
+			if w := testLogin(s, "198.51.100.7", url.Values { "username": {"bob"}, "password": {"hunter3"} }, nil); w.Code != 200 {
+				t.Fatalf("login of bob replied %d: %s", w.Code, w.Body.String())
+			}
+			_, err := s.fw.InsertTimeout(net.ParseIP("203.0.113.7"), "", []string {"", "web"}, 0, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			grant := grantRequest { addr: net.ParseIP("203.0.113.9") }
+			token, _, err := s.grantToken(grant, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.fw.Ban(net.ParseIP("233.252.0.7"), time.Hour)
+			if err != nil || len(backend.elements) != 5 {
+				t.Fatalf("elements before the panic %v: %v", backend.elements, err)
+			}
+
+			r := httptest.NewRequest("POST", "/panic", strings.NewReader(url.Values { "confirm": {tt.confirm}, "by": {"alice"} }.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w = httptest.NewRecorder()
+			if tt.admin {
+				r.URL.Path = "/admin/panic"
+				r.SetBasicAuth(tt.user, map[string]string { "admin": "admin1", "oncall": "admin2" }[tt.user])
+				s.adminHandlerFunc(w, r)
+			} else {
+				s.controlHandlerFunc(w, r)
+			}
+			if w.Code != tt.wantCode {
+				t.Fatalf("panic replied %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			entries, _ := s.fw.cache.Entries()
+			if tt.wantCode != 200 {
+				if len(entries) != 4 || len(backend.elements) != 5 {
+					t.Errorf("refused panic left %d entries and %v", len(entries), backend.elements)
+				}
+				return
+			}
+			var summary panicSummary
+			json.Unmarshal(w.Body.Bytes(), &summary)
+			if len(summary.Revoked) != 3 || summary.Entries != 4 || len(summary.Users) != 2 {
+				t.Errorf("summary %+v, want 3 subnets, 4 entries and 2 users", summary)
+			}
+
+			if len(entries) != 0 {
+				t.Errorf("entries left in the cache: %v", entries)
+			}
+			for element := range backend.elements {
+				if !strings.HasPrefix(element, s.fw.ban4Name + " ") {
+					t.Errorf("whitelist element %s left", element)
+				}
+			}
+			if !backend.elements[s.fw.ban4Name + " 233.252.0.7"] {
+				t.Errorf("ban lost: %v", backend.elements)
+			}
+			if w := testLogin(s, "192.0.2.7", nil, cookies); w.Code != 401 {
+				t.Errorf("cookie from before the panic got %d", w.Code)
+			}
+			if err := s.checkGrantToken(grant, token, time.Now()); err != errGrantTokenInvalid {
+				t.Errorf("grant token from before the panic: %v, want %v", err, errGrantTokenInvalid)
+			}
+			if state := s.panicState(); state.State != "executed" || state.Revoked != 3 {
+				t.Errorf("panic record %+v", state)
+			}
+
+			// Recovery is logging in again
+			if w := testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil); w.Code != 200 {
+				t.Errorf("login after the panic replied %d: %s", w.Code, w.Body.String())
+			}
+			w = httptest.NewRecorder()
+			s.controlHandlerFunc(w, httptest.NewRequest("DELETE", "/panic", nil))
+			if w.Code != 200 || s.panicState().Panic {
+				t.Errorf("acknowledge replied %d, record %+v", w.Code, s.panicState())
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Check password against a value from [secrets]
+// Values beginning with "$2a$", "$2b$" or "$2y$" are bcrypt hashes, values beginning with "$argon2id$" are argon2id hashes,
+// anything else is a plaintext password
+func checkSecret(secret, password string) bool {
+	if isBcryptHash(secret) {
+		// bcrypt ignores anything past 72 bytes, so longer passwords would match on their beginning
+		return len(password) <= 72 && bcrypt.CompareHashAndPassword([]byte(secret), []byte(password)) == nil
+	}
+	if strings.HasPrefix(secret, "$argon2id$") {
+		ok, err := checkArgon2id(secret, password)
+		return ok && err == nil
+	}
+	// Comparing digests keeps the length of the secret from leaking as well
+	secretSum := sha256.Sum256([]byte(secret))
+	passwordSum := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(secretSum[:], passwordSum[:]) == 1
+}
+
+// Return an error if secret looks like a hash but cannot be parsed
+func validateSecret(secret string) error {
+	if isBcryptHash(secret) {
+		_, err := bcrypt.Cost([]byte(secret))
+		return err
+	}
+	if strings.HasPrefix(secret, "$argon2id$") {
+		_, err := checkArgon2id(secret, "")
+		return err
+	}
+	return nil
+}
+
+// Tell hashes apart from plaintext passwords
+func isHashedSecret(secret string) bool {
+	return isBcryptHash(secret) || strings.HasPrefix(secret, "$argon2id$")
+}
+
+func isBcryptHash(secret string) bool {
+	return strings.HasPrefix(secret, "$2a$") || strings.HasPrefix(secret, "$2b$") || strings.HasPrefix(secret, "$2y$")
+}
+
+// Verify a hash in the PHC string format, "$argon2id$v=19$m=65536,t=3,p=4$salt$hash"
+func checkArgon2id(secret, password string) (bool, error) {
+	fields := strings.Split(secret, "$")
+	if len(fields) != 6 {
+		return false, fmt.Errorf("malformed argon2id hash")
+	}
+	var version int
+	_, err := fmt.Sscanf(fields[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2id version %q", fields[2])
+	}
+	var memory, time uint32
+	var threads uint8
+	_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil || time == 0 || threads == 0 {
+		return false, fmt.Errorf("malformed argon2id parameters %q", fields[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2id salt: %s", err)
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(hash) == 0 {
+		return false, fmt.Errorf("malformed argon2id hash")
+	}
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(computed, hash) == 1, nil
+}
+
+// Return a bcrypt hash of password, for the hash command
+func hashSecret(password []byte) (string, error) {
+	password = bytes.TrimRight(password, "\r\n")
+	if len(password) == 0 {
+		return "", fmt.Errorf("empty password")
+	}
+	if len(password) > 72 {
+		return "", fmt.Errorf("bcrypt only uses the first 72 bytes of a password, use a shorter one")
+	}
+	hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	return string(hash), err
+}
@@ -0,0 +1,153 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hash password in the PHC string format with parameters cheap enough for tests
+func testArgon2id(password string) string {
+	salt := []byte("0123456789abcdef")
+	hash := argon2.IDKey([]byte(password), salt, 1, 64, 1, 16)
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash))
+}
+
+func TestCheckSecret(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("a", 72)
+	longHash, err := bcrypt.GenerateFromPassword([]byte(long), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2idHash := testArgon2id("hunter2")
+	tests := []struct {
+		name		string
+		secret		string
+		password	string
+		want		bool
+	}{
+		{ "plaintext", "hunter2", "hunter2", true },
+		{ "plaintext wrong", "hunter2", "hunter3", false },
+		{ "plaintext prefix", "hunter2", "hunter", false },
+		{ "bcrypt", string(bcryptHash), "hunter2", true },
+		{ "bcrypt wrong", string(bcryptHash), "hunter3", false },
+		{ "bcrypt $2y$", "$2y$" + string(bcryptHash[4:]), "hunter2", true },
+		{ "bcrypt hash as password", string(bcryptHash), string(bcryptHash), false },
+		{ "bcrypt 72 bytes", string(longHash), long, true },
+		{ "bcrypt over 72 bytes", string(longHash), long + "b", false },
+		{ "argon2id", argon2idHash, "hunter2", true },
+		{ "argon2id wrong", argon2idHash, "hunter3", false },
+		{ "argon2id malformed", "$argon2id$v=19$m=64,t=1,p=1$c2FsdA", "hunter2", false },
+		{ "argon2id hash as password", argon2idHash, argon2idHash, false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			if got := checkSecret(tt.secret, tt.password); got != tt.want {
+				t.Errorf("checkSecret() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSecret(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := testArgon2id("hunter2")
+	fields := strings.Split(valid, "$")
+	tests := []struct {
+		name	string
+		secret	string
+		wantErr	string
+	}{
+		{ "plaintext", "hunter2", "" },
+		{ "bcrypt", string(bcryptHash), "" },
+		{ "bcrypt truncated", string(bcryptHash[:20]), "too short" },
+		{ "bcrypt bad cost", "$2a$99$" + string(bcryptHash[7:]), "cost" },
+		{ "argon2id", valid, "" },
+		{ "argon2id missing field", "$argon2id$v=19$m=64,t=1,p=1$" + fields[5], "malformed argon2id hash" },
+		{ "argon2id version", strings.Replace(valid, "v=19", "v=16", 1), "unsupported argon2id version" },
+		{ "argon2id no version", strings.Replace(valid, "v=19", "19", 1), "unsupported argon2id version" },
+		{ "argon2id zero time", strings.Replace(valid, "t=1", "t=0", 1), "malformed argon2id parameters" },
+		{ "argon2id zero threads", strings.Replace(valid, "p=1", "p=0", 1), "malformed argon2id parameters" },
+		{ "argon2id bad parameters", strings.Replace(valid, "m=64,t=1,p=1", "m=64", 1), "malformed argon2id parameters" },
+		{ "argon2id bad salt", strings.Replace(valid, fields[4], "!!", 1), "malformed argon2id salt" },
+		{ "argon2id bad hash", strings.Replace(valid, fields[5], "!!", 1), "malformed argon2id hash" },
+		{ "argon2id empty hash", strings.TrimSuffix(valid, fields[5]), "malformed argon2id hash" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			err := validateSecret(tt.secret)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error %v, want %q", err, tt.wantErr)
+			}
+			if !isHashedSecret(tt.secret) {
+				t.Error("not recognized as a hash")
+			}
+		})
+	}
+}
+
+func TestHashSecret(t *testing.T) {
+	tests := []struct {
+		name		string
+		password	string
+		wantErr		string
+	}{
+		{ "password", "hunter2", "" },
+		{ "trailing newline", "hunter2\r\n", "" },
+		{ "72 bytes", strings.Repeat("a", 72), "" },
+		{ "73 bytes", strings.Repeat("a", 73), "72 bytes" },
+		{ "empty", "\n", "empty password" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			hash, err := hashSecret([]byte(tt.password))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isHashedSecret(hash) || !checkSecret(hash, strings.TrimRight(tt.password, "\r\n")) {
+				t.Errorf("hash %q does not check", hash)
+			}
+		})
+	}
+}
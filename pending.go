@@ -0,0 +1,221 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// With cookie-grant-delay, a login by cookie alone which opens a new subnet waits before the firewall changes
+// The user is notified with a link cancelling it, in case the cookie was stolen
+// Logins which only extend an entry of the user in the subnet, and those with a typed password, are not delayed
+// The audit log follows each one with "cookie-grant" events of state "activating", then "activated", "aborted", "revoked" or "expired"
+
+func (conf *config) cancelPath() string {
+	return strings.TrimRight(conf.Daemon.HTTPPath, "/") + "/cancel/"
+}
+
+// Accept a login by cookie of user from clientIP, whitelisting it after cookie-grant-delay unless cancelled
+func (s *server) delayGrant(w http.ResponseWriter, r *http.Request, clientIP net.IP, user string, groups, skip []string, timeout time.Duration, deadline time.Time, now time.Time) {
+	delay := time.Duration(s.conf.Daemon.CookieGrantDelay) * time.Second
+	p := pendingGrant {
+		activate:	now.Add(delay),
+		addr:		clientIP,
+		user:		user,
+		groups:		groups,
+		skip:		skip,
+		timeout:	timeout,
+		deadline:	deadline,
+		epoch:		s.fw.cache.Epoch(user),
+	}
+	token := randomToken()
+	err := s.fw.cache.AddPendingGrant(tokenHash(token), p)
+	if err != nil {
+		log.Println(err)
+		s.writeError(w, r, 500, "internal", "cannot update cache database")
+		return
+	}
+	time.AfterFunc(delay, func () { s.activatePending(time.Now()) })
+
+	scheme := "http"
+	if s.secureRequest(r) {
+		scheme = "https"
+	}
+	cancelURL := scheme + "://" + r.Host + s.conf.cancelPath() + token
+	subnet := s.fw.Subnet(clientIP)
+	activates := p.activate.UTC().Format(time.RFC3339)
+	s.fw.audit.Event("cookie-grant", "state", "activating", "user", user, "client", clientIP, "subnet", subnet, "activates", activates)
+	keyvals := []interface{} {"user", user, "client", clientIP, "subnet", subnet, "activates", activates, "cancel", cancelURL}
+	if email := s.conf.SecretsEmail[user]; email != "" {
+		keyvals = append(keyvals, "email", email)
+	}
+	s.fw.notify.Event("pending-grant", fmt.Sprintf("A login cookie of user %q opens access for %s at %s, cancel it at %s if this was not you", user, subnet, activates, cancelURL), keyvals...)
+	if s.conf.Daemon.Verbose >= 1 {
+		log.Printf("User %q logged in by cookie, whitelisting %s at %s\n", user, clientIP, activates)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if s.wantsPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.WriteHeader(202)
+		fmt.Fprintf(w, "PENDING activates=%s subnet=%s\ncancel=%s\n", activates, subnet, cancelURL)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.WriteHeader(202)
+	pendingPage.Execute(w, pendingData { subnet.String(), p.activate.Format(time.RFC1123Z), cancelURL })
+}
+
+// Schedule the grants left activating by a previous run, those already due activate or expire at once
+func (s *server) schedulePending() {
+	pending, err := s.fw.cache.PendingGrants()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, p := range pending {
+		time.AfterFunc(time.Until(p.activate), func () { s.activatePending(time.Now()) })
+	}
+}
+
+// Whitelist the grants due by now
+// One overdue by more than cookie-grant-delay, as portknob was not running, expires instead of opening long after the login
+func (s *server) activatePending(now time.Time) {
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+
+	due, err := s.fw.cache.TakePendingGrants(now)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	delay := time.Duration(s.conf.Daemon.CookieGrantDelay) * time.Second
+	for _, p := range due {
+		subnet := s.fw.Subnet(p.addr)
+		activates := p.activate.UTC().Format(time.RFC3339)
+		if now.Sub(p.activate) > delay || (!p.deadline.IsZero() && !now.Before(p.deadline)) {
+			s.fw.audit.Event("cookie-grant", "state", "expired", "user", p.user, "client", p.addr, "subnet", subnet, "activates", activates)
+			continue
+		}
+		if p.epoch != s.fw.cache.Epoch(p.user) || s.fw.cache.Revoked(subnet.String()) {
+			s.fw.audit.Event("cookie-grant", "state", "revoked", "user", p.user, "client", p.addr, "subnet", subnet, "activates", activates)
+			continue
+		}
+		if _, refused := s.maintenanceRefuses(p.addr, now); refused {
+			s.fw.audit.Event("cookie-grant", "state", "aborted", "user", p.user, "client", p.addr, "subnet", subnet, "activates", activates, "reason", "maintenance")
+			continue
+		}
+		decision, err := s.authorize(p.user, p.addr, p.groups, p.skip, now)
+		if err == errAuthzDenied || err == errAuthzUnavailable {
+			s.fw.audit.Event("cookie-grant", "state", "aborted", "user", p.user, "client", p.addr, "subnet", subnet, "activates", activates, "reason", "authz")
+			continue
+		}
+		prefix, _, err := s.publicGrant(p.addr, p.user, p.groups, decision.skip, decision.lifespans, p.timeout, p.deadline)
+		if err != nil {
+			log.Println(err)
+			s.auditLogin("error", "cookie", p.user, p.addr)
+			continue
+		}
+		s.fw.audit.Event("cookie-grant", "state", "activated", "user", p.user, "client", p.addr, "subnet", subnet, "activates", activates)
+		s.fw.metrics.AuthSuccess(p.user)
+		s.auditSuccess("cookie", p.user, p.addr, p.skip)
+		if s.conf.Daemon.Verbose >= 1 {
+			log.Printf("User %q logged in by cookie, whitelisted %s/%d\n", p.user, p.addr, prefix)
+		}
+	}
+}
+
+// Cancel the grant of the token in the path, the token alone is enough so the user may cancel from anywhere
+// Opening the link cancels it in one click, a link preview doing so only fails closed
+func (s *server) cancelHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+
+	hash := tokenHash(strings.TrimPrefix(r.URL.Path, s.conf.cancelPath()))
+	w.Header().Set("Cache-Control", "no-store")
+	p, found, err := s.fw.cache.CancelPendingGrant(hash)
+	if err != nil {
+		log.Println(err)
+		s.writeError(w, r, 500, "internal", "cannot update cache database")
+		return
+	}
+	if !found {
+		s.writeError(w, r, 404, "not-found", "Not Found: this grant is unknown, already activated or cancelled")
+		return
+	}
+	subnet := s.fw.Subnet(p.addr)
+	s.fw.audit.Event("cookie-grant", "state", "aborted", "user", p.user, "client", p.addr, "subnet", subnet, "activates", p.activate.UTC().Format(time.RFC3339), "reason", "cancelled", "by", peerIP(r))
+	if s.conf.Daemon.Verbose >= 1 {
+		log.Printf("Grant of %s to user %q cancelled\n", subnet, p.user)
+	}
+	if s.wantsPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		fmt.Fprintf(w, "OK cancelled subnet=%s\n", subnet)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	cancelPage.Execute(w, pendingData { Subnet: subnet.String() })
+}
+
+type pendingData struct {
+	Subnet		string
+	Activates	string
+	CancelURL	string
+}
+
+var pendingPage = template.Must(template.New("pending").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Activating - Portknob</title>
+</head>
+<body>
+<main>
+<h1>Access activating</h1>
+<p role="status">You logged in with your saved login, access from {{.Subnet}} opens at {{.Activates}}.</p>
+<form method="post" action="{{.CancelURL}}">
+<p><button type="submit">Cancel</button></p>
+</form>
+</main>
+</body>
+</html>
+`))
+
+var cancelPage = template.Must(template.New("cancel").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Cancel access - Portknob</title>
+</head>
+<body>
+<main>
+<h1>Portknob access</h1>
+<p role="status">Access from {{.Subnet}} was cancelled. Change your password if this was not you, as someone else may have your saved login.</p>
+</main>
+</body>
+</html>
+`))
@@ -0,0 +1,138 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const pendingTestConfig = `cookie-grant-delay = 60
+[[firewall]]
+comment = "ssh"
+dport = "22"
+[[secrets]]
+username = "alice"
+password = "hunter2"
+email = "alice@example.com"
+`
+
+// Log in with the cookies from addr, returning the token of the cancel link of the grant it delays
+func testPendingLogin(t *testing.T, s *server, addr string, cookies []*http.Cookie) string {
+	w := testLogin(s, addr, nil, cookies)
+	if w.Code != 202 || !strings.HasPrefix(w.Body.String(), "PENDING activates=") {
+		t.Fatalf("cookie login from %s replied %d: %s", addr, w.Code, w.Body.String())
+	}
+	i := strings.Index(w.Body.String(), "cancel=http://example.com/cancel/")
+	if i < 0 {
+		t.Fatalf("cookie login from %s has no cancel link: %s", addr, w.Body.String())
+	}
+	return strings.TrimSpace(w.Body.String()[i + len("cancel=http://example.com/cancel/"):])
+}
+
+func testCancel(s *server, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/cancel/" + token + "?plain=1", nil)
+	w := httptest.NewRecorder()
+	s.cancelHandlerFunc(w, r)
+	return w
+}
+
+func TestCookieGrantDelay(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, backend := newTestServer(t, pendingTestConfig)
+	w := testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+	if w.Code != 200 || !backend.elements["portknob-net4 192.0.2.7"] {
+		t.Fatalf("password login replied %d: %s", w.Code, w.Body.String())
+	}
+	cookies := w.Result().Cookies()
+
+	// Extending an entry of alice is not delayed
+	if w := testLogin(s, "192.0.2.8", nil, cookies); w.Code != 200 || !backend.elements["portknob-net4 192.0.2.8"] {
+		t.Errorf("cookie login in a subnet of alice replied %d: %s", w.Code, w.Body.String())
+	}
+
+	now := time.Now()
+	testPendingLogin(t, s, "198.51.100.7", cookies)
+	if backend.elements["portknob-net4 198.51.100.7"] {
+		t.Fatal("cookie login from a new subnet whitelisted before the delay")
+	}
+	s.activatePending(now.Add(30 * time.Second))
+	if backend.elements["portknob-net4 198.51.100.7"] {
+		t.Error("grant activated before the delay")
+	}
+	s.activatePending(now.Add(61 * time.Second))
+	if !backend.elements["portknob-net4 198.51.100.7"] {
+		t.Error("grant did not activate after the delay")
+	}
+
+	// Cancelled by opening the link
+	token := testPendingLogin(t, s, "203.0.113.7", cookies)
+	if w := testCancel(s, token); w.Code != 200 || !strings.HasPrefix(w.Body.String(), "OK cancelled subnet=203.0.113.0/24") {
+		t.Fatalf("cancel replied %d: %s", w.Code, w.Body.String())
+	}
+	if w := testCancel(s, token); w.Code != 404 {
+		t.Errorf("second cancel replied %d: %s", w.Code, w.Body.String())
+	}
+	s.activatePending(now.Add(61 * time.Second))
+	if backend.elements["portknob-net4 203.0.113.7"] {
+		t.Error("cancelled grant activated")
+	}
+
+	// Overdue, portknob was not running when it was due
+	testPendingLogin(t, s, "203.0.113.8", cookies)
+	s.activatePending(now.Add(121 * time.Second))
+	if backend.elements["portknob-net4 203.0.113.8"] {
+		t.Error("grant overdue by more than the delay activated")
+	}
+	if pending, _ := s.fw.cache.PendingGrants(); len(pending) != 0 {
+		t.Errorf("cache still has %d pending grants", len(pending))
+	}
+
+	// A revocation of alice meanwhile drops it
+	testPendingLogin(t, s, "203.0.113.9", cookies)
+	s.fw.cache.BumpEpochs([]string {"alice"})
+	s.activatePending(now.Add(61 * time.Second))
+	if backend.elements["portknob-net4 203.0.113.9"] {
+		t.Error("grant of a revoked user activated")
+	}
+}
+
+func TestPendingGrantRecord(t *testing.T) {
+	p := pendingGrant {
+		activate:	time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		addr:		[]byte {192, 0, 2, 7},
+		user:		"alice\nbob",
+		groups:		[]string {"", "web"},
+		skip:		[]string {"admin"},
+		timeout:	300 * time.Second,
+		epoch:		4,
+	}
+	q, ok := parsePendingGrant(p.String())
+	if !ok || !q.activate.Equal(p.activate) || !q.addr.Equal(p.addr) || q.user != p.user || strings.Join(q.groups, ",") != ",web" || strings.Join(q.skip, ",") != "admin" || q.timeout != p.timeout || !q.deadline.IsZero() || q.epoch != 4 {
+		t.Errorf("parsed %+v back, want %+v", q, p)
+	}
+}
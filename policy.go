@@ -0,0 +1,207 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Check allow-cidr, deny-cidr, allow-countries and deny-countries, and open geoip-database
+func (conf *config) parsePolicy() error {
+	var err error
+	conf.Daemon.allowNets, err = parseNetList(conf, "allow-cidr", conf.Daemon.AllowCIDR)
+	if err != nil {
+		return err
+	}
+	conf.Daemon.denyNets, err = parseNetList(conf, "deny-cidr", conf.Daemon.DenyCIDR)
+	if err != nil {
+		return err
+	}
+	for option, countries := range map[string][]string { "allow-countries": conf.Daemon.AllowCountries, "deny-countries": conf.Daemon.DenyCountries } {
+		for i, country := range countries {
+			if len(country) != 2 || strings.Trim(strings.ToUpper(country), "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+				return conf.reportConfigError(option, country)
+			}
+			countries[i] = strings.ToUpper(country)
+		}
+	}
+	if len(conf.Daemon.AllowCountries) + len(conf.Daemon.DenyCountries) != 0 && conf.Daemon.GeoIPDatabase == "" {
+		return &configError { "options \"allow-countries\" and \"deny-countries\" require \"geoip-database\"\n" }
+	}
+	if conf.Daemon.GeoIPDatabase != "" {
+		// Read into memory rather than mapped, so a reload may replace the file and nothing has to be closed
+		data, err := ioutil.ReadFile(conf.Daemon.GeoIPDatabase)
+		if err != nil {
+			return err
+		}
+		conf.Daemon.geoip, err = maxminddb.FromBytes(data)
+		if err != nil {
+			return &configError { fmt.Sprintf("cannot read GeoIP database %q: %s\n", conf.Daemon.GeoIPDatabase, err) }
+		}
+	}
+	if conf.Daemon.ImpossibleTravelKMH == nil {
+		var defaultImpossibleTravelKMH uint64 = 1000
+		conf.Daemon.ImpossibleTravelKMH = &defaultImpossibleTravelKMH
+	}
+	switch conf.Daemon.ImpossibleTravelAction {
+	case "":
+		conf.Daemon.ImpossibleTravelAction = "alert"
+	case "alert", "challenge":
+	default:
+		return conf.reportConfigError("impossible-travel-action", conf.Daemon.ImpossibleTravelAction)
+	}
+	conf.Daemon.travelExempt = make(map[string][]*net.IPNet)
+	for user, subnets := range conf.Daemon.ImpossibleTravelExempt {
+		for _, subnet := range subnets {
+			_, ipnet, err := net.ParseCIDR(subnet)
+			if err != nil {
+				return conf.reportConfigError("impossible-travel-exempt", subnet)
+			}
+			conf.Daemon.travelExempt[user] = append(conf.Daemon.travelExempt[user], ipnet)
+		}
+	}
+	switch conf.Daemon.PolicyDenyMethod {
+	case "":
+		conf.Daemon.PolicyDenyMethod = "forbidden"
+	case "forbidden", "not-found", "close":
+	default:
+		return conf.reportConfigError("policy-deny-method", conf.Daemon.PolicyDenyMethod)
+	}
+	if conf.Daemon.PolicyRedirect != "" {
+		redirectURL, err := url.Parse(conf.Daemon.PolicyRedirect)
+		if err != nil || (redirectURL.Scheme != "http" && redirectURL.Scheme != "https") || redirectURL.Host == "" {
+			return conf.reportConfigError("policy-redirect", conf.Daemon.PolicyRedirect)
+		}
+	}
+	return nil
+}
+
+// Country of addr in geoip-database as an ISO 3166 code, "" if unknown
+func (conf *config) country(addr net.IP) string {
+	if conf.Daemon.geoip == nil {
+		return ""
+	}
+	var record struct {
+		Country struct {
+			ISOCode		string	`maxminddb:"iso_code"`
+		}	`maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode		string	`maxminddb:"iso_code"`
+		}	`maxminddb:"registered_country"`
+	}
+	err := conf.Daemon.geoip.Lookup(addr, &record)
+	if err != nil || record.Country.ISOCode == "" {
+		// Anycast and satellite networks only have the country they are registered in
+		return record.RegisteredCountry.ISOCode
+	}
+	return record.Country.ISOCode
+}
+
+// Coordinates of addr in geoip-database, which only City databases have
+func (conf *config) location(addr net.IP) (latitude, longitude float64, ok bool) {
+	if conf.Daemon.geoip == nil {
+		return 0, 0, false
+	}
+	var record struct {
+		Location struct {
+			Latitude	*float64	`maxminddb:"latitude"`
+			Longitude	*float64	`maxminddb:"longitude"`
+		}	`maxminddb:"location"`
+	}
+	err := conf.Daemon.geoip.Lookup(addr, &record)
+	if err != nil || record.Location.Latitude == nil || record.Location.Longitude == nil {
+		return 0, 0, false
+	}
+	return *record.Location.Latitude, *record.Location.Longitude, true
+}
+
+// Whether addr may log in at all, nil being an address that could not be found
+// deny-cidr wins over allow-cidr, which wins over the country lists, with an allow list set other addresses are denied
+func (conf *config) policyAllows(addr net.IP) bool {
+	allowed, _, _ := conf.policyDecision(addr)
+	return allowed
+}
+
+// Like policyAllows, also naming the option which decided and the matching value, "" for none
+func (conf *config) policyDecision(addr net.IP) (allowed bool, option, value string) {
+	d := &conf.Daemon
+	listed := func () (bool, string, string) {
+		switch {
+		case !d.allowNets.Empty() && len(d.AllowCountries) != 0:
+			return false, "allow-cidr, allow-countries", "unlisted"
+		case !d.allowNets.Empty():
+			return false, "allow-cidr", "unlisted"
+		case len(d.AllowCountries) != 0:
+			return false, "allow-countries", "unlisted"
+		}
+		return true, "", ""
+	}
+	if addr == nil {
+		return listed()
+	}
+	if net := d.denyNets.Match(addr); net != "" {
+		return false, "deny-cidr", net
+	}
+	if net := d.allowNets.Match(addr); net != "" {
+		return true, "allow-cidr", net
+	}
+	if len(d.AllowCountries) == 0 && len(d.DenyCountries) == 0 {
+		return listed()
+	}
+	country := conf.country(addr)
+	if containsString(d.DenyCountries, country) {
+		return false, "deny-countries", country
+	}
+	if containsString(d.AllowCountries, country) {
+		return true, "allow-countries", country
+	}
+	return listed()
+}
+
+// Turn away a client the access policy denies before it sees the login form, returning whether it was
+func (s *server) writePolicyDenied(w http.ResponseWriter, r *http.Request, clientIP net.IP) bool {
+	if s.conf.policyAllows(clientIP) && !s.defenseHides(clientIP, time.Now()) {
+		return false
+	}
+	if s.conf.Daemon.Verbose >= 1 {
+		log.Printf("Policy: denied %s from %s\n", r.URL.Path, clientIP)
+	}
+	if s.conf.Daemon.PolicyRedirect != "" {
+		http.Redirect(w, r, s.conf.Daemon.PolicyRedirect, http.StatusFound)
+		return true
+	}
+	switch s.conf.Daemon.PolicyDenyMethod {
+	case "not-found":
+		s.writeError(w, r, 404, "not-found", "404 page not found")
+	case "close":
+		// Ends the connection without a reply, also under HTTP/2
+		panic(http.ErrAbortHandler)
+	default:
+		s.writeError(w, r, 403, "forbidden", "Access Forbidden")
+	}
+	return true
+}
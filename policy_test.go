@@ -0,0 +1,240 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// A network of a test GeoIP database, with the country it is in or only registered in, and latitude and longitude like a City database
+type testGeoIPNetwork struct {
+	cidr		string
+	country		string
+	registered	string
+	location	[]float64
+}
+
+// Write an IPv4 MaxMind database of networks, so the policy is tested without a real one
+func writeTestGeoIP(t *testing.T, networks []testGeoIPNetwork) string {
+	// Search tree with 24-bit records, -1 for no data, >= 0 for a node, < -1 for data at offset -2 - record
+	nodes := [][2]int {{ -1, -1 }}
+	var data []byte
+	for _, network := range networks {
+		_, ipnet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := map[string]interface{} {}
+		if network.country != "" {
+			record["country"] = map[string]interface{} { "iso_code": network.country }
+		}
+		if network.registered != "" {
+			record["registered_country"] = map[string]interface{} { "iso_code": network.registered }
+		}
+		if network.location != nil {
+			record["location"] = map[string]interface{} { "latitude": network.location[0], "longitude": network.location[1] }
+		}
+		offset := len(data)
+		data = appendMMDB(data, record)
+		ones, _ := ipnet.Mask.Size()
+		ip := ipnet.IP.To4()
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i / 8] >> (7 - uint(i % 8)) & 1)
+			if i == ones - 1 {
+				nodes[node][bit] = -2 - offset
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int { -1, -1 })
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+	var db bytes.Buffer
+	for _, node := range nodes {
+		for _, record := range node {
+			value := record
+			if record == -1 {
+				value = len(nodes)
+			} else if record < -1 {
+				value = len(nodes) + 16 + (-2 - record)
+			}
+			db.Write([]byte { byte(value >> 16), byte(value >> 8), byte(value) })
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data)
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	db.Write(appendMMDB(nil, map[string]interface{} {
+		"binary_format_major_version":	uint16(2),
+		"binary_format_minor_version":	uint16(0),
+		"build_epoch":					uint64(0),
+		"database_type":				"Portknob-Test",
+		"description":					map[string]interface{} { "en": "Portknob test database" },
+		"ip_version":					uint16(4),
+		"languages":					[]string {"en"},
+		"node_count":					uint32(len(nodes)),
+		"record_size":					uint16(24),
+	}))
+	path := filepath.Join(t.TempDir(), "geoip.mmdb")
+	err := os.WriteFile(path, db.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Append v in the MaxMind DB data format, for the few types writeTestGeoIP needs
+func appendMMDB(b []byte, v interface{}) []byte {
+	appendUint := func (typ byte, value uint64, size int) []byte {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], value)
+		if typ > 7 {
+			b = append(b, byte(size), typ - 7)
+		} else {
+			b = append(b, typ << 5 | byte(size))
+		}
+		return append(b, buf[8 - size:]...)
+	}
+	switch v := v.(type) {
+	case string:
+		b = append(b, 2 << 5 | byte(len(v)))
+		return append(b, v...)
+	case float64:
+		b = append(b, 3 << 5 | 8)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	case uint16:
+		return appendUint(5, uint64(v), 2)
+	case uint32:
+		return appendUint(6, uint64(v), 4)
+	case uint64:
+		return appendUint(9, v, 8)
+	case []string:
+		b = append(b, byte(len(v)), 11 - 7)
+		for _, s := range v {
+			b = appendMMDB(b, s)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = append(b, 7 << 5 | byte(len(v)))
+		for _, k := range keys {
+			b = appendMMDB(appendMMDB(b, k), v[k])
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+func TestCountry(t *testing.T) {
+	conf := &config {}
+	conf.Daemon.GeoIPDatabase = writeTestGeoIP(t, testGeoIPNetworks)
+	err := conf.parsePolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr	string
+		want	string
+	}{
+		{ "192.0.2.7", "FR" },
+		{ "198.51.100.7", "DE" },
+		{ "203.0.113.7", "US" },
+		{ "10.0.0.1", "" },
+		{ "2001:db8::1", "" },
+	}
+	for _, tt := range tests {
+		if got := conf.country(net.ParseIP(tt.addr)); got != tt.want {
+			t.Errorf("country(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+var testGeoIPNetworks = []testGeoIPNetwork {
+	{ "192.0.2.0/24", "FR", "FR", nil },
+	{ "198.51.100.0/24", "DE", "DE", nil },
+	// Anycast, only registered in a country
+	{ "203.0.113.0/24", "", "US", nil },
+}
+
+func TestPolicyAllows(t *testing.T) {
+	fr, de, us, unknown := "192.0.2.7", "198.51.100.7", "203.0.113.7", "10.0.0.1"
+	tests := []struct {
+		name		string
+		allowCIDR	[]string
+		denyCIDR	[]string
+		allow		[]string
+		deny		[]string
+		addr		string
+		want		bool
+	}{
+		{ "no policy", nil, nil, nil, nil, fr, true },
+		{ "no policy, unknown address", nil, nil, nil, nil, "", true },
+		{ "denied network", nil, []string {"192.0.2.0/24"}, nil, nil, fr, false },
+		{ "other network", nil, []string {"192.0.2.0/24"}, nil, nil, de, true },
+		{ "deny-cidr wins over allow-cidr", []string {"192.0.2.0/23"}, []string {"192.0.2.7"}, nil, nil, fr, false },
+		{ "allowed network", []string {"192.0.2.0/24"}, nil, nil, nil, fr, true },
+		{ "outside the allowed networks", []string {"192.0.2.0/24"}, nil, nil, nil, de, false },
+		{ "allowed country", nil, nil, []string {"fr"}, nil, fr, true },
+		{ "other country", nil, nil, []string {"FR"}, nil, de, false },
+		{ "unknown country with an allow list", nil, nil, []string {"FR"}, nil, unknown, false },
+		{ "denied country", nil, nil, nil, []string {"DE"}, de, false },
+		{ "country not denied", nil, nil, nil, []string {"DE"}, fr, true },
+		{ "unknown country with a deny list", nil, nil, nil, []string {"DE"}, unknown, true },
+		{ "registered country", nil, nil, []string {"US"}, nil, us, true },
+		{ "allow-cidr wins over deny-countries", []string {"198.51.100.0/24"}, nil, nil, []string {"DE"}, de, true },
+		{ "deny-cidr wins over allow-countries", nil, []string {"192.0.2.7"}, []string {"FR"}, nil, fr, false },
+		{ "allowed country outside allow-cidr", []string {"198.51.100.0/24"}, nil, []string {"FR"}, nil, fr, true },
+		{ "neither allowed network nor country", []string {"198.51.100.0/24"}, nil, []string {"FR"}, nil, us, false },
+		{ "deny-countries with allow-cidr", []string {"198.51.100.0/24"}, nil, nil, []string {"DE"}, unknown, false },
+		{ "unknown address with allow-cidr", []string {"192.0.2.0/24"}, nil, nil, nil, "", false },
+		{ "unknown address with allow-countries", nil, nil, []string {"FR"}, nil, "", false },
+		{ "unknown address with deny lists", nil, []string {"192.0.2.0/24"}, nil, []string {"DE"}, "", true },
+	}
+	path := writeTestGeoIP(t, testGeoIPNetworks)
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			conf := &config {}
+			conf.Daemon.AllowCIDR, conf.Daemon.DenyCIDR = tt.allowCIDR, tt.denyCIDR
+			conf.Daemon.AllowCountries, conf.Daemon.DenyCountries = tt.allow, tt.deny
+			conf.Daemon.GeoIPDatabase = path
+			err := conf.parsePolicy()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := conf.policyAllows(net.ParseIP(tt.addr)); got != tt.want {
+				t.Errorf("policyAllows(%s) = %t, want %t", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
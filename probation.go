@@ -0,0 +1,141 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// With probation-lifespan, the logins of a user who never passed probation get short whitelist entries
+// Each set counts the traffic of its elements, an entry whose element saw probation-activity-bytes within probation-window gets its full lifespan
+// The user has then passed, later logins get full lifespans at once, entries which saw too little lapse
+// The audit log records each outcome as a "probation" event, "extended" or "lapsed"
+
+// Seconds between two checks of the counters of entries on probation
+const probationCheckInterval = time.Minute
+
+// Like Grant for a login, shortening the entries of groups with probation if user has not passed it yet
+// Lifespans by group, set by the [authz] authorizer, replace those of the rules
+func (fw *firewall) LoginGrant(addr net.IP, user string, groups, skip []string, lifespans map[string]time.Duration, timeout time.Duration, deadline time.Time) (prefix uint, longest time.Duration, err error) {
+	now := time.Now()
+	grantGroups, timeouts := fw.grantLifespans(groups, skip, lifespans, timeout, deadline, now)
+	var probations []probationEntry
+	if user != "" && fw.conf.probationEnabled() && !fw.cache.PassedProbation(user) {
+		for i, group := range grantGroups {
+			p := fw.conf.groupProbation(group)
+			short := time.Duration(p.lifespan) * time.Second
+			if short == 0 || timeouts[i] != 0 && timeouts[i] <= short {
+				continue
+			}
+			entry := probationEntry {
+				addr:		addr,
+				group:		group,
+				user:		user,
+				watchUntil:	now.Add(time.Duration(p.window) * time.Second),
+			}
+			if timeouts[i] != 0 {
+				entry.expires = now.Add(timeouts[i])
+			}
+			probations = append(probations, entry)
+			timeouts[i] = short
+		}
+	}
+	for i := range timeouts {
+		timeouts[i] = fw.JitterLifespan(timeouts[i])
+		if i == 0 || longest != 0 && (timeouts[i] == 0 || timeouts[i] > longest) {
+			longest = timeouts[i]
+		}
+	}
+	prefix, err = fw.insertGroups(addr, user, grantGroups, timeouts, true)
+	if err != nil {
+		return
+	}
+	for _, entry := range probations {
+		err := fw.cache.AddProbation(entry.key(fw.Subnet(addr)), entry)
+		if err != nil {
+			log.Printf("Cannot put the entry of %s on probation: %s\n", addr, err)
+		}
+	}
+	return
+}
+
+// Extend the entries on probation whose elements saw enough traffic by now, and stop watching those past probation-window
+func (fw *firewall) checkProbation(now time.Time) {
+	fw.reloadMutex.RLock()
+	defer fw.reloadMutex.RUnlock()
+
+	probations, err := fw.cache.Probations()
+	if err != nil || len(probations) == 0 {
+		return
+	}
+	entries, err := fw.cache.Entries()
+	if err != nil {
+		return
+	}
+	live := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.live(now) {
+			live[fw.Subnet(entry.addr).String() + " " + entry.group] = true
+		}
+	}
+	counters := make(map[string]map[string]uint64)
+	for key, p := range probations {
+		subnet := fw.Subnet(p.addr)
+		if _, ok := fw.sets[p.group]; !ok || !live[key] {
+			// Revoked, expired or its rules are gone
+			fw.cache.EndProbation(key, "", now)
+			continue
+		}
+		setName, prefix := fw.setFor(p.addr, p.group)
+		element := p.addr
+		if element.To4() != nil {
+			element = element.To4()
+		}
+		if _, ok := counters[setName]; !ok {
+			counters[setName], err = fw.backend.ElementBytes(setName)
+			if err != nil {
+				log.Printf("Cannot read the traffic counters of %s: %s\n", setName, err)
+				continue
+			}
+		}
+		bytes := counters[setName][element.Mask(net.CIDRMask(int(prefix), len(element) * 8)).String()]
+		switch {
+		case bytes >= fw.conf.groupProbation(p.group).activityBytes:
+			var timeout time.Duration
+			if !p.expires.IsZero() {
+				timeout = p.expires.Sub(now)
+				if timeout < time.Second {
+					timeout = time.Second
+				}
+			}
+			_, err := fw.InsertTimeout(p.addr, p.user, []string {p.group}, timeout, true)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			fw.cache.EndProbation(key, p.user, now)
+			fw.audit.Event("probation", "result", "extended", "user", p.user, "subnet", subnet, "group", p.group, "bytes", bytes, "expires", formatExpiry(p.expires))
+		case !now.Before(p.watchUntil):
+			fw.cache.EndProbation(key, "", now)
+			fw.audit.Event("probation", "result", "lapsed", "user", p.user, "subnet", subnet, "group", p.group, "bytes", bytes)
+		}
+	}
+}
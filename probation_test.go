@@ -0,0 +1,148 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const probationTestConfig = `firewall-lifespan = 3600
+probation-lifespan = 300
+probation-window = 120
+probation-activity-bytes = 10000
+[[firewall]]
+comment = "ssh"
+dport = "22"
+[[secrets]]
+username = "alice"
+password = "hunter2"
+[[secrets]]
+username = "bob"
+password = "swordfish"
+`
+
+func TestProbation(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, backend := newTestServer(t, probationTestConfig)
+	backend.timeouts = make(map[string]time.Duration)
+	login := func (addr, user, password string) time.Duration {
+		w := testLogin(s, addr, url.Values { "username": {user}, "password": {password} }, nil)
+		if w.Code != 200 {
+			t.Fatalf("login of %s from %s replied %d: %s", user, addr, w.Code, w.Body.String())
+		}
+		return backend.timeouts["portknob-net4 " + addr]
+	}
+
+	if got := login("192.0.2.7", "alice", "hunter2"); got != 300 * time.Second {
+		t.Errorf("login on probation got a timeout of %s, want 5m0s", got)
+	}
+	if got := login("203.0.113.7", "bob", "swordfish"); got != 300 * time.Second {
+		t.Errorf("login on probation got a timeout of %s, want 5m0s", got)
+	}
+
+	// Too little traffic yet
+	backend.bytes = map[string]map[string]uint64 { "portknob-net4": {"192.0.2.0": 9999, "203.0.113.0": 500} }
+	s.fw.checkProbation(time.Now())
+	if got := backend.timeouts["portknob-net4 192.0.2.7"]; got != 300 * time.Second {
+		t.Errorf("entry with too little traffic got a timeout of %s, want 5m0s", got)
+	}
+	if s.fw.cache.PassedProbation("alice") {
+		t.Error("alice passed probation with too little traffic")
+	}
+
+	backend.bytes["portknob-net4"]["192.0.2.0"] = 10000
+	s.fw.checkProbation(time.Now())
+	if got := backend.timeouts["portknob-net4 192.0.2.7"]; got < 3500 * time.Second || got > 3600 * time.Second {
+		t.Errorf("entry with enough traffic got a timeout of %s, want its full lifespan", got)
+	}
+	if !s.fw.cache.PassedProbation("alice") {
+		t.Error("alice did not pass probation with enough traffic")
+	}
+	if got := login("198.51.100.7", "alice", "hunter2"); got != 3600 * time.Second {
+		t.Errorf("login after passing probation got a timeout of %s, want 1h0m0s", got)
+	}
+
+	// The entry of bob saw too little traffic within probation-window
+	s.fw.checkProbation(time.Now().Add(130 * time.Second))
+	probations, err := s.fw.cache.Probations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probations) != 0 {
+		t.Errorf("probations left after the window: %v", probations)
+	}
+	if s.fw.cache.PassedProbation("bob") {
+		t.Error("bob passed probation with too little traffic")
+	}
+	if got := backend.timeouts["portknob-net4 203.0.113.7"]; got != 300 * time.Second {
+		t.Errorf("lapsed entry got a timeout of %s, want 5m0s", got)
+	}
+}
+
+func TestProbationOptions(t *testing.T) {
+	tests := []struct {
+		name		string
+		rules		string
+		wantErr		bool
+	}{
+		{ "rule of its own", "[[firewall]]\ndport = \"22\"\nprobation-lifespan = 300\n[[firewall]]\ndport = \"8443\"\ngroup = \"admin\"\n", false },
+		{ "shared group", "[[firewall]]\ndport = \"22\"\nprobation-lifespan = 300\n[[firewall]]\ndport = \"8443\"\n", true },
+		{ "own lifespan", "[[firewall]]\ndport = \"22\"\n[[firewall]]\ndport = \"8443\"\nlifespan = 600\nprobation-lifespan = 60\n", false },
+		{ "sliding", "[[firewall]]\ndport = \"22\"\nlifespan = 600\nsliding = true\nprobation-lifespan = 60\n", true },
+		{ "no window", "[[firewall]]\ndport = \"22\"\nprobation-lifespan = 60\nprobation-window = 0\n", true },
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, fmt.Sprintf("[daemon]\ncache-database = %q\n%s", filepath.Join(t.TempDir(), "cache.db"), tt.rules)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseElementBytes(t *testing.T) {
+	want := map[string]uint64 {"192.0.2.0": 15000, "198.51.100.0": 0}
+	out, err := os.ReadFile("testdata/probation-ipset-save.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parseIpsetBytes(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseIpsetBytes() = %v, want %v", got, want)
+	}
+	out, err = os.ReadFile("testdata/probation-nft-list-set.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parseNftBytes(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseNftBytes() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Seconds a load balancer has to send the PROXY protocol header
+const proxyHeaderTimeout = 10
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A listener whose connections start with a PROXY protocol v1 or v2 header from a trusted load balancer
+type proxyListener struct {
+	net.Listener
+	trusted		func (net.IP) bool
+}
+
+func (ln *proxyListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn { Conn: conn, trusted: ln.trusted, reader: bufio.NewReader(conn) }, nil
+}
+
+// The header is read on first use, in the goroutine serving the connection, so slow peers do not hold up Accept
+type proxyConn struct {
+	net.Conn
+	trusted		func (net.IP) bool
+	reader		*bufio.Reader
+	once		sync.Once
+	remoteAddr	net.Addr
+	err			error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	return c.remoteAddr
+}
+
+func (c *proxyConn) readHeader() {
+	c.remoteAddr = c.Conn.RemoteAddr()
+	if addr, ok := c.remoteAddr.(*net.TCPAddr); !ok || !c.trusted(addr.IP) {
+		c.err = fmt.Errorf("PROXY protocol header from untrusted peer %s", c.remoteAddr)
+		c.Conn.Close()
+		return
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout * time.Second))
+	defer c.Conn.SetReadDeadline(time.Time {})
+
+	var addr net.Addr
+	prefix, err := c.reader.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(prefix, proxyV2Signature) {
+		addr, err = c.readHeaderV2()
+	} else {
+		addr, err = c.readHeaderV1()
+	}
+	if err != nil {
+		c.err = fmt.Errorf("bad PROXY protocol header from %s: %s", c.remoteAddr, err)
+		c.Conn.Close()
+		return
+	}
+	// Health checks of the load balancer itself carry no client address
+	if addr != nil {
+		c.remoteAddr = addr
+	}
+}
+
+// "PROXY TCP4 src dst sport dport\r\n", at most 107 bytes
+func (c *proxyConn) readHeaderV1() (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("header too long")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("not a PROXY protocol header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr { IP: ip, Port: int(port) }, nil
+}
+
+// Binary header: signature, version and command, family and protocol, length, addresses
+func (c *proxyConn) readHeaderV2() (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(c.reader, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[12] >> 4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12] >> 4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(c.reader, body)
+	if err != nil {
+		return nil, err
+	}
+	if header[12] & 0xf == 0 {
+		// LOCAL command
+		return nil, nil
+	}
+	switch header[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("truncated IPv4 addresses")
+		}
+		return &net.TCPAddr { IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10])) }, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("truncated IPv6 addresses")
+		}
+		return &net.TCPAddr { IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34])) }, nil
+	}
+	// AF_UNSPEC or AF_UNIX, there is no client address to use
+	return nil, nil
+}
@@ -0,0 +1,107 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// One end of a pipe claiming to come from a load balancer
+type pipeConn struct {
+	net.Conn
+}
+
+func (c pipeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr { IP: net.ParseIP("10.0.0.1"), Port: 40000 }
+}
+
+// A v2 header with command cmd, family fam and the address block addrs
+func proxyV2Header(version, cmd, fam byte, addrs []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, version << 4 | cmd, fam << 4 | 1, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestProxyHeader(t *testing.T) {
+	ipv4 := []byte {203, 0, 113, 9, 10, 0, 0, 2, 0xc7, 0x38, 0x01, 0xbb}
+	ipv6 := append(append(append([]byte(nil), net.ParseIP("2001:db8::9")...), net.ParseIP("2001:db8::2")...), 0xc7, 0x38, 0x01, 0xbb)
+	tests := []struct {
+		name		string
+		trusted		bool
+		header		[]byte
+		want		string
+		wantErr		bool
+	}{
+		{ "v1 TCP4", true, []byte("PROXY TCP4 203.0.113.9 10.0.0.2 51000 443\r\n"), "203.0.113.9:51000", false },
+		{ "v1 TCP6", true, []byte("PROXY TCP6 2001:db8::9 2001:db8::2 51000 443\r\n"), "[2001:db8::9]:51000", false },
+		{ "v1 UNKNOWN", true, []byte("PROXY UNKNOWN\r\n"), "10.0.0.1:40000", false },
+		{ "v1 bad address", true, []byte("PROXY TCP4 203.0.113 10.0.0.2 51000 443\r\n"), "", true },
+		{ "v1 bad port", true, []byte("PROXY TCP4 203.0.113.9 10.0.0.2 70000 443\r\n"), "", true },
+		{ "v1 missing fields", true, []byte("PROXY TCP4 203.0.113.9\r\n"), "", true },
+		{ "v1 too long", true, []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", true },
+		{ "no header", true, []byte("GET / HTTP/1.1\r\n"), "", true },
+		{ "v2 IPv4", true, proxyV2Header(2, 1, 1, ipv4), "203.0.113.9:51000", false },
+		{ "v2 IPv6", true, proxyV2Header(2, 1, 2, ipv6), "[2001:db8::9]:51000", false },
+		{ "v2 LOCAL", true, proxyV2Header(2, 0, 0, nil), "10.0.0.1:40000", false },
+		{ "v2 unix socket", true, proxyV2Header(2, 1, 3, make([]byte, 216)), "10.0.0.1:40000", false },
+		{ "v2 bad version", true, proxyV2Header(1, 1, 1, ipv4), "", true },
+		{ "v2 truncated IPv4", true, proxyV2Header(2, 1, 1, ipv4[:8]), "", true },
+		{ "v2 truncated IPv6", true, proxyV2Header(2, 1, 2, ipv6[:20]), "", true },
+		{ "untrusted peer", false, []byte("PROXY TCP4 203.0.113.9 10.0.0.2 51000 443\r\n"), "", true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func () {
+				client.Write(tt.header)
+				client.Write([]byte("payload"))
+				client.Close()
+			}()
+			trusted := func (net.IP) bool { return tt.trusted }
+			conn := &proxyConn { Conn: pipeConn { server }, trusted: trusted, reader: bufio.NewReader(server) }
+			defer conn.Close()
+			got := conn.RemoteAddr().String()
+			payload, err := io.ReadAll(conn)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("no error, remote address %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("remote address %s, want %s", got, tt.want)
+			}
+			if !bytes.Equal(payload, []byte("payload")) {
+				t.Errorf("payload %q, want \"payload\"", payload)
+			}
+		})
+	}
+}
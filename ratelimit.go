@@ -0,0 +1,82 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Buckets kept before idle ones are dropped
+const rateLimiterMaxKeys = 4096
+
+// Token buckets by client for one endpoint, each holding a minute of requests and refilled continuously
+// Every endpoint has its own limiter, so a flood of one cannot lock clients out of another
+type rateLimiter struct {
+	mutex		sync.Mutex
+	buckets		map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens		float64
+	last		time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter { buckets: make(map[string]*rateBucket) }
+}
+
+// Take a request of key at now out of a bucket of perMinute, 0 allowing everything
+// Returns how long to wait when the bucket is empty
+func (l *rateLimiter) Allow(key string, perMinute uint64, now time.Time) (ok bool, retry time.Duration) {
+	if perMinute == 0 {
+		return true, 0
+	}
+	size := float64(perMinute)
+	perSecond := size / 60
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= rateLimiterMaxKeys {
+			l.prune(size, perSecond, now)
+		}
+		bucket = &rateBucket { tokens: size, last: now }
+		l.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * perSecond
+	if bucket.tokens > size {
+		bucket.tokens = size
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Drop the buckets which have filled up again, their clients start afresh anyway
+func (l *rateLimiter) prune(size, perSecond float64, now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens + now.Sub(bucket.last).Seconds() * perSecond >= size {
+			delete(l.buckets, key)
+		}
+	}
+}
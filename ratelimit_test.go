@@ -0,0 +1,95 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name		string
+		perMinute	uint64
+		// Offsets of the requests from start
+		requests	[]time.Duration
+		want		[]bool
+	}{
+		{ "burst of a minute", 3, []time.Duration {0, 0, 0, 0}, []bool {true, true, true, false} },
+		{ "refilled", 3, []time.Duration {0, 0, 0, 0, 20 * time.Second, 20 * time.Second}, []bool {true, true, true, false, true, false} },
+		{ "no more than a minute", 2, []time.Duration {0, 0, time.Hour, time.Hour, time.Hour}, []bool {true, true, true, true, false} },
+		{ "disabled", 0, []time.Duration {0, 0, 0}, []bool {true, true, true} },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			l := newRateLimiter()
+			for i, offset := range tt.requests {
+				ok, retry := l.Allow("192.0.2.7", tt.perMinute, start.Add(offset))
+				if ok != tt.want[i] {
+					t.Fatalf("request %d allowed %t, want %t", i, ok, tt.want[i])
+				}
+				if !ok && (retry <= 0 || retry > time.Minute) {
+					t.Errorf("request %d retry after %s", i, retry)
+				}
+			}
+			// Other clients have buckets of their own
+			if ok, _ := l.Allow("192.0.2.8", tt.perMinute, start); !ok {
+				t.Error("another client is limited too")
+			}
+		})
+	}
+}
+
+// A flood of the admin API locks neither other admins nor the control socket out
+func TestAdminRateLimit(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, _ := newTestServer(t, "admin-path = \"/admin\"\nadmin-allow = [\"192.0.2.0/24\"]\nadmin-rate-limit = 3\n")
+	admin := func (addr string) int {
+		r := httptest.NewRequest("GET", "/admin/entries", nil)
+		r.RemoteAddr = addr + ":5000"
+		w := httptest.NewRecorder()
+		s.adminHandlerFunc(w, r)
+		if w.Code == 429 && w.Header().Get("Retry-After") == "" {
+			t.Error("429 without Retry-After")
+		}
+		return w.Code
+	}
+	for i := 0; i < 3; i++ {
+		if code := admin("192.0.2.1"); code != 200 {
+			t.Fatalf("request %d replied %d", i, code)
+		}
+	}
+	if code := admin("192.0.2.1"); code != 429 {
+		t.Errorf("request beyond admin-rate-limit replied %d, want 429", code)
+	}
+	if code := admin("192.0.2.2"); code != 200 {
+		t.Errorf("another admin got %d, want 200", code)
+	}
+	w := httptest.NewRecorder()
+	s.controlHandlerFunc(w, httptest.NewRequest("GET", "/entries", nil))
+	if w.Code != 200 {
+		t.Errorf("control socket replied %d, want 200", w.Code)
+	}
+}
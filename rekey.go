@@ -0,0 +1,186 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// No entries of the user were moved, the login opens its own
+var errNoRekey = errors.New("no entries to move")
+
+// Bytes counted for a whitelist element and when that count was first read
+type activitySample struct {
+	bytes		uint64
+	changed		time.Time
+}
+
+// Read the traffic counters of the live IPv6 entries of users, so moves can tell how long the old subnet has been idle
+func (fw *firewall) sampleActivity(now time.Time) {
+	fw.reloadMutex.RLock()
+	defer fw.reloadMutex.RUnlock()
+
+	entries, err := fw.cache.Entries()
+	if err != nil {
+		return
+	}
+	counters := make(map[string]map[string]uint64)
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.addr.To4() != nil || entry.user == "" || !entry.live(now) {
+			continue
+		}
+		bytes, ok := fw.entryBytes(counters, entry.addr, entry.group)
+		if !ok {
+			continue
+		}
+		key := fw.Subnet(entry.addr).String() + " " + entry.group
+		seen[key] = true
+		fw.rekeyMutex.Lock()
+		if sample, found := fw.activity[key]; !found || sample.bytes != bytes {
+			fw.activity[key] = activitySample { bytes, now }
+		}
+		fw.rekeyMutex.Unlock()
+	}
+	fw.rekeyMutex.Lock()
+	for key := range fw.activity {
+		if !seen[key] {
+			delete(fw.activity, key)
+		}
+	}
+	fw.rekeyMutex.Unlock()
+}
+
+// Bytes counted for the element of addr in the whitelist of group, reading each set once into counters
+func (fw *firewall) entryBytes(counters map[string]map[string]uint64, addr net.IP, group string) (uint64, bool) {
+	if _, ok := fw.sets[group]; !ok {
+		return 0, false
+	}
+	setName, prefix := fw.setFor(addr, group)
+	if _, ok := counters[setName]; !ok {
+		set, err := fw.backend.ElementBytes(setName)
+		if err != nil {
+			log.Printf("Cannot read the traffic counters of %s: %s\n", setName, err)
+			return 0, false
+		}
+		counters[setName] = set
+	}
+	bytes := counters[setName][addr.Mask(net.CIDRMask(int(prefix), len(addr) * 8)).String()]
+	return bytes, true
+}
+
+// Move the live entries of user from the IPv6 subnet it logged in from last to the subnet of addr, keeping their expiry
+// Only when the old subnet sent no traffic for auto-rekey-ipv6-idle seconds and the user made fewer than auto-rekey-ipv6-max-per-day moves in a day
+// Groups in skip are left where they are, errNoRekey when nothing was moved
+func (fw *firewall) RekeyIPv6(addr net.IP, user string, skip []string, now time.Time) (prefix uint, longest time.Duration, err error) {
+	if !fw.conf.Daemon.AutoRekeyIPv6 || addr.To4() != nil || user == "" {
+		return 0, 0, errNoRekey
+	}
+	entries, err := fw.cache.Entries()
+	if err != nil {
+		return 0, 0, err
+	}
+	subnet := fw.Subnet(addr)
+	// The most recent login from another IPv6 subnet, unless the user already has one from here
+	var old *net.IPNet
+	var created time.Time
+	for _, entry := range entries {
+		if entry.user != user || entry.addr.To4() != nil || !entry.live(now) {
+			continue
+		}
+		if subnet.Contains(entry.addr) {
+			return 0, 0, errNoRekey
+		}
+		if old == nil || entry.created.After(created) {
+			old, created = fw.Subnet(entry.addr), entry.created
+		}
+	}
+	if old == nil {
+		return 0, 0, errNoRekey
+	}
+	var moved []cacheEntry
+	for _, entry := range entries {
+		if entry.user == user && old.Contains(entry.addr) && entry.live(now) && !containsString(skip, entry.group) {
+			moved = append(moved, entry)
+		}
+	}
+	if len(moved) == 0 {
+		return 0, 0, errNoRekey
+	}
+	sort.Slice(moved, func (i, j int) bool { return moved[i].group < moved[j].group })
+
+	fw.rekeyMutex.Lock()
+	defer fw.rekeyMutex.Unlock()
+	counters := make(map[string]map[string]uint64)
+	idle := time.Duration(fw.conf.Daemon.AutoRekeyIPv6Idle) * time.Second
+	for _, entry := range moved {
+		// Without a sample old enough, traffic may have passed since the prefix rotated
+		sample, found := fw.activity[old.String() + " " + entry.group]
+		bytes, ok := fw.entryBytes(counters, entry.addr, entry.group)
+		if !found || !ok || bytes != sample.bytes || now.Sub(sample.changed) < idle {
+			return 0, 0, errNoRekey
+		}
+	}
+	var recent []time.Time
+	for _, at := range fw.rekeys[user] {
+		if now.Sub(at) < 24 * time.Hour {
+			recent = append(recent, at)
+		}
+	}
+	if uint64(len(recent)) >= fw.conf.Daemon.AutoRekeyIPv6MaxPerDay {
+		log.Printf("User %q reached auto-rekey-ipv6-max-per-day, the entries of %s stay\n", user, old)
+		fw.rekeys[user] = recent
+		return 0, 0, errNoRekey
+	}
+
+	groups := make([]string, len(moved))
+	timeouts := make([]time.Duration, len(moved))
+	for i, entry := range moved {
+		groups[i] = entry.group
+		// Entries which never expire keep the default of their set
+		if !entry.expires.IsZero() {
+			timeouts[i] = entry.expires.Sub(now)
+			if timeouts[i] < time.Second {
+				timeouts[i] = time.Second
+			}
+		}
+		if i == 0 || longest != 0 && (timeouts[i] == 0 || timeouts[i] > longest) {
+			longest = timeouts[i]
+		}
+	}
+	prefix, err = fw.insertGroups(addr, user, groups, timeouts, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, entry := range moved {
+		err := fw.RevokeGroup(entry.group, entry.addr)
+		if err != nil {
+			log.Printf("Cannot revoke the entry of %s moved to %s: %s\n", old, subnet, err)
+		}
+	}
+	fw.rekeys[user] = append(recent, now)
+	fw.audit.Event("prefix-rotation", "user", user, "from", old, "to", subnet, "groups", groups)
+	return prefix, longest, nil
+}
@@ -0,0 +1,132 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRekeyIPv6(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	tests := []struct {
+		name		string
+		// Age of the traffic sample of the old subnet
+		idle		time.Duration
+		// Bytes the old subnet sent after the sample
+		residual	uint64
+		// Log in again with the password instead of the cookie
+		typed		bool
+		wantMoved	bool
+	}{
+		{ "idle", time.Hour, 0, false, true },
+		{ "residual traffic", time.Hour, 1500, false, false },
+		{ "recently active", time.Minute, 0, false, false },
+		{ "password login", time.Hour, 0, true, false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			audit := filepath.Join(t.TempDir(), "audit.log")
+			s, backend := newTestServer(t, "audit-log = " + strconv.Quote(audit) + "\nfirewall-lifespan = 3600\nauto-rekey-ipv6 = true\n[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\n")
+			s.fw.audit, _ = newAuditLog(s.conf)
+			backend.timeouts = make(map[string]time.Duration)
+			w := testLogin(s, "2001:db8:1::7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+			if w.Code != 200 {
+				t.Fatalf("login replied %d: %s", w.Code, w.Body.String())
+			}
+			before, _ := s.fw.cache.Entries()
+			backend.bytes = map[string]map[string]uint64 { "portknob-net6": {"2001:db8:1::": 4096} }
+			s.fw.sampleActivity(time.Now().Add(-tt.idle))
+			backend.bytes["portknob-net6"]["2001:db8:1::"] += tt.residual
+
+			var form url.Values
+			var cookies []*http.Cookie
+			if tt.typed {
+				form = url.Values { "username": {"alice"}, "password": {"hunter2"} }
+			} else {
+				cookies = w.Result().Cookies()
+			}
+			w = testLogin(s, "2001:db8:2::7", form, cookies)
+			if w.Code != 200 {
+				t.Fatalf("login from the new prefix replied %d: %s", w.Code, w.Body.String())
+			}
+			if !backend.elements["portknob-net6 2001:db8:2::7"] {
+				t.Error("the new prefix was not let through")
+			}
+			if backend.elements["portknob-net6 2001:db8:1::7"] == tt.wantMoved {
+				t.Errorf("old prefix let through %v, want %v", tt.wantMoved, !tt.wantMoved)
+			}
+			entries, _ := s.fw.cache.Entries()
+			data, _ := os.ReadFile(audit)
+			if !tt.wantMoved {
+				if len(entries) != 2 || strings.Contains(string(data), "prefix-rotation") {
+					t.Errorf("entries %v and audit log after a login which should not move:\n%s", entries, data)
+				}
+				return
+			}
+			if len(entries) != 1 || entries[0].addr.String() != "2001:db8:2::7" || entries[0].expires.Sub(before[0].expires).Abs() > time.Second {
+				t.Errorf("entries %v after the move, want the one of 2001:db8:2::7 expiring at %s", entries, before[0].expires)
+			}
+			if timeout := backend.timeouts["portknob-net6 2001:db8:2::7"]; timeout > time.Hour || timeout < time.Hour - time.Minute {
+				t.Errorf("moved entry got a timeout of %s, want the rest of the hour", timeout)
+			}
+			if !strings.Contains(string(data), `"event":"prefix-rotation","user":"alice","from":"2001:db8:1::/48","to":"2001:db8:2::/48"`) {
+				t.Errorf("audit log lacks the move:\n%s", data)
+			}
+		})
+	}
+}
+
+func TestRekeyIPv6MaxPerDay(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, backend := newTestServer(t, "auto-rekey-ipv6 = true\nauto-rekey-ipv6-max-per-day = 1\n[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\n")
+	w := testLogin(s, "2001:db8:1::7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+	cookies := w.Result().Cookies()
+	backend.bytes = map[string]map[string]uint64 { "portknob-net6": {} }
+	for i, addr := range []string {"2001:db8:2::7", "2001:db8:3::7"} {
+		s.fw.sampleActivity(time.Now().Add(-time.Hour))
+		if w := testLogin(s, addr, nil, cookies); w.Code != 200 {
+			t.Fatalf("login from %s replied %d: %s", addr, w.Code, w.Body.String())
+		}
+		if entries, _ := s.fw.cache.Entries(); len(entries) != i + 1 {
+			t.Errorf("%d entries after the login from %s, want %d", len(entries), addr, i + 1)
+		}
+	}
+	if !backend.elements["portknob-net6 2001:db8:2::7"] || !backend.elements["portknob-net6 2001:db8:3::7"] || backend.elements["portknob-net6 2001:db8:1::7"] {
+		t.Errorf("elements %v, want only the first login moved", backend.elements)
+	}
+}
+
+func TestRekeyIPv6Options(t *testing.T) {
+	if _, err := loadConfig(writeTestConfig(t, "[daemon]\nauto-rekey-ipv6 = true\nauto-rekey-ipv6-idle = 30\n[[firewall]]\ndport = \"22\"\n")); err == nil {
+		t.Error("auto-rekey-ipv6-idle below a minute was accepted")
+	}
+}
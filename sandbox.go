@@ -0,0 +1,143 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	errSandboxUnsupported	= errors.New("not supported on this system")
+	errLandlockThreads	= errors.New("cannot restrict all threads of a cgo build before Linux 6.19, build with CGO_ENABLED=0")
+)
+
+// What applySandbox did, for the admin page and admin-path/capabilities
+var sandboxState string
+
+// A file or directory the sandbox allows, read and executed, or also written
+type sandboxPath struct {
+	path	string
+	write	bool
+}
+
+// Return what the daemon may touch under "enforcing": the system, the firewall commands and the files of conf
+func (conf *config) sandboxPaths() []sandboxPath {
+	paths := []sandboxPath {}
+	add := func (path string, write bool) {
+		if path == "" {
+			return
+		}
+		paths = append(paths, sandboxPath { path, write })
+		// Such as certbot's live directory linking to its archive
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil && resolved != path {
+			paths = append(paths, sandboxPath { resolved, write })
+		}
+	}
+	for _, dir := range []string {"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/etc", "/proc", "/sys"} {
+		add(dir, false)
+	}
+	// /dev/null for the firewall commands, and /run/xtables.lock for iptables -w
+	add("/dev", true)
+	add("/run", true)
+	commands := []string {"iptables", "ip6tables", "ipset"}
+	if conf.Daemon.FirewallBackend == "nftables" {
+		commands = []string {"nft"}
+	}
+	for _, name := range commands {
+		path, err := exec.LookPath(name)
+		if err == nil {
+			add(filepath.Dir(path), false)
+			resolved, err := filepath.EvalSymlinks(path)
+			if err == nil {
+				add(filepath.Dir(resolved), false)
+			}
+		}
+	}
+	// Directories rather than files, which editors and renewals replace
+	if conf.path != "" {
+		add(filepath.Dir(conf.path), false)
+	}
+	for _, file := range []string {conf.Daemon.GeoIPDatabase, conf.Daemon.TLSCert, conf.Daemon.TLSKey, conf.Daemon.AgeIdentityFile, conf.Daemon.AuditSigningKey} {
+		if file != "" {
+			add(filepath.Dir(file), false)
+		}
+	}
+	if conf.Daemon.CacheBackend != "redis" {
+		add(filepath.Dir(conf.Daemon.CacheDatabase), true)
+	}
+	if conf.Daemon.AuditLog != "" && conf.Daemon.AuditLog != "syslog" {
+		add(filepath.Dir(conf.Daemon.AuditLog), true)
+	}
+	if len(conf.Daemon.ACMEDomains) != 0 {
+		add(conf.Daemon.ACMECacheDir, true)
+	}
+	// Sockets are removed on shutdown
+	for _, socket := range []string {conf.Daemon.ControlSocket, conf.Daemon.SessionSocket} {
+		if socket != "" {
+			add(filepath.Dir(socket), true)
+		}
+	}
+	if path, unix := strings.CutPrefix(conf.Daemon.AdminListen, "unix:"); unix {
+		add(filepath.Dir(path), true)
+	}
+	return paths
+}
+
+// Confine the daemon as the sandbox option says, once it has everything open that it listens on
+// Without Landlock or seccomp in the kernel it carries on with what there is, saying so in sandboxState
+func applySandbox(conf *config) error {
+	mode := conf.Daemon.Sandbox
+	if mode == "off" {
+		sandboxState = "off"
+		return nil
+	}
+	parts := []string {}
+	if mode == "enforcing" {
+		abi, err := landlockRestrict(conf.sandboxPaths())
+		switch {
+		case err == nil:
+			parts = append(parts, "landlock ABI " + strconv.Itoa(abi))
+		case errors.Is(err, errSandboxUnsupported) || errors.Is(err, errLandlockThreads):
+			log.Printf("Sandbox: files are not restricted, Landlock: %s\n", err)
+			parts = append(parts, "no landlock")
+		default:
+			return fmt.Errorf("sandbox: Landlock: %s", err)
+		}
+	}
+	err := seccompFilter(mode == "permissive")
+	switch {
+	case err == nil:
+		parts = append(parts, "seccomp")
+	case errors.Is(err, errSandboxUnsupported):
+		log.Printf("Sandbox: system calls are not restricted, seccomp: %s\n", err)
+		parts = append(parts, "no seccomp")
+	default:
+		return fmt.Errorf("sandbox: seccomp: %s", err)
+	}
+	sandboxState = mode + " (" + strings.Join(parts, ", ") + ")"
+	log.Printf("Sandbox: %s\n", sandboxState)
+	return nil
+}
@@ -0,0 +1,213 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Landlock rights of files, the others only apply to directories
+const landlockFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE | unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+
+const (
+	landlockRead	= unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockWrite	= landlockRead | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE | unix.LANDLOCK_ACCESS_FS_IOCTL_DEV | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_DIR | unix.LANDLOCK_ACCESS_FS_MAKE_SOCK
+)
+
+// Restrict the files of all threads and their children to paths, returning the Landlock ABI version
+func landlockRestrict(paths []sandboxPath) (int, error) {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno == unix.ENOSYS || errno == unix.EOPNOTSUPP {
+		return 0, errSandboxUnsupported
+	} else if errno != 0 {
+		return 0, errno
+	}
+	// Handle every right of the ABI, so that none is left unrestricted
+	handled := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM << 1 - 1)
+	if abi >= 2 {
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi >= 5 {
+		handled |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+	attr := unix.LandlockRulesetAttr { Access_fs: handled }
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	defer unix.Close(int(fd))
+	for _, path := range paths {
+		access := uint64(landlockRead)
+		if path.write {
+			access = landlockWrite
+		}
+		err := landlockAllow(int(fd), path.path, access & handled)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err := allThreads(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0)
+	if err == nil {
+		err = allThreads(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0)
+	}
+	if err == unix.ENOTSUP && abi >= 8 {
+		// A cgo build, whose threads Landlock restricts itself since Linux 6.19
+		_, _, errno = unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, unix.LANDLOCK_RESTRICT_SELF_TSYNC, 0)
+		if errno != 0 {
+			return 0, errno
+		}
+	} else if err == unix.ENOTSUP {
+		return 0, errLandlockThreads
+	} else if err != nil {
+		return 0, err
+	}
+	return int(abi), nil
+}
+
+// Allow access beneath path, or to path if it is not a directory, skipping it if it does not exist
+func landlockAllow(rulesetFd int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH | unix.O_CLOEXEC, 0)
+	if err == unix.ENOENT {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	defer unix.Close(fd)
+	var stat unix.Stat_t
+	err = unix.Fstat(fd, &stat)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if stat.Mode & unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFileAccess
+	}
+	attr := unix.LandlockPathBeneathAttr { Allowed_access: access, Parent_fd: int32(fd) }
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFd), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("%s: %s", path, errno)
+	}
+	return nil
+}
+
+// Make a system call on every thread, which the Go runtime refuses in a cgo build with ENOTSUP
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Install a seccomp filter on all threads and their children allowing seccompSyscalls, which logs the others if permissive and otherwise kills the process
+func seccompFilter(permissive bool) error {
+	violation := uint32(unix.SECCOMP_RET_KILL_PROCESS)
+	flags := uintptr(unix.SECCOMP_FILTER_FLAG_TSYNC)
+	if permissive {
+		violation = unix.SECCOMP_RET_LOG
+		flags |= unix.SECCOMP_FILTER_FLAG_LOG
+	}
+	// Both actions appeared in Linux 4.14
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_GET_ACTION_AVAIL, 0, uintptr(unsafe.Pointer(&violation)))
+	if errno == unix.ENOSYS || errno == unix.EINVAL || errno == unix.EOPNOTSUPP {
+		return errSandboxUnsupported
+	} else if errno != 0 {
+		return errno
+	}
+	filter := seccompProgram(violation)
+	prog := unix.SockFprog { Len: uint16(len(filter)), Filter: &filter[0] }
+	// Threads get no_new_privs and the filter from this one
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	thread, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, flags, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return errno
+	} else if thread != 0 {
+		return fmt.Errorf("thread %d cannot take the filter", thread)
+	}
+	return nil
+}
+
+// Return a BPF program allowing seccompSyscalls of seccompArch, and returning violation for any other
+func seccompProgram(violation uint32) []unix.SockFilter {
+	load := func (offset uint32) unix.SockFilter {
+		return unix.SockFilter { Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offset }
+	}
+	ret := func (action uint32) unix.SockFilter {
+		return unix.SockFilter { Code: unix.BPF_RET | unix.BPF_K, K: action }
+	}
+	// Offsets of nr and arch in struct seccomp_data
+	filter := []unix.SockFilter {
+		load(4),
+		{ Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: seccompArch },
+		ret(violation),
+		load(0),
+	}
+	if seccompMaxSyscall != 0 {
+		// Such as the x32 system calls of amd64
+		filter = append(filter, unix.SockFilter { Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jf: 1, K: seccompMaxSyscall }, ret(violation))
+	}
+	for _, nr := range seccompSyscalls() {
+		filter = append(filter, unix.SockFilter { Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 1, K: uint32(nr) }, ret(unix.SECCOMP_RET_ALLOW))
+	}
+	return append(filter, ret(violation))
+}
+
+// System calls of the daemon, the Go runtime, the firewall commands and the shell, on every architecture
+func seccompSyscalls() []uintptr {
+	return append([]uintptr {
+		unix.SYS_READ, unix.SYS_WRITE, unix.SYS_READV, unix.SYS_WRITEV, unix.SYS_PREAD64, unix.SYS_PWRITE64, unix.SYS_PREADV, unix.SYS_PWRITEV,
+		unix.SYS_OPENAT, unix.SYS_OPENAT2, unix.SYS_CLOSE, unix.SYS_CLOSE_RANGE, unix.SYS_LSEEK, unix.SYS_FSTAT, unix.SYS_STATX, unix.SYS_STATFS, unix.SYS_FSTATFS,
+		unix.SYS_FACCESSAT, unix.SYS_FACCESSAT2, unix.SYS_READLINKAT, unix.SYS_GETDENTS64, unix.SYS_GETCWD, unix.SYS_CHDIR, unix.SYS_FCHDIR,
+		unix.SYS_MKDIRAT, unix.SYS_UNLINKAT, unix.SYS_RENAMEAT, unix.SYS_RENAMEAT2, unix.SYS_LINKAT, unix.SYS_SYMLINKAT, unix.SYS_UMASK,
+		unix.SYS_FCHMOD, unix.SYS_FCHMODAT, unix.SYS_FCHOWN, unix.SYS_FCHOWNAT, unix.SYS_UTIMENSAT,
+		unix.SYS_FCNTL, unix.SYS_FLOCK, unix.SYS_FSYNC, unix.SYS_FDATASYNC, unix.SYS_FTRUNCATE, unix.SYS_FALLOCATE, unix.SYS_FADVISE64, unix.SYS_IOCTL,
+		unix.SYS_DUP, unix.SYS_DUP3, unix.SYS_PIPE2, unix.SYS_COPY_FILE_RANGE, unix.SYS_SENDFILE, unix.SYS_SPLICE,
+		unix.SYS_MMAP, unix.SYS_MUNMAP, unix.SYS_MPROTECT, unix.SYS_MADVISE, unix.SYS_MREMAP, unix.SYS_MINCORE, unix.SYS_MSYNC, unix.SYS_BRK, unix.SYS_MEMBARRIER,
+		unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK, unix.SYS_RT_SIGRETURN, unix.SYS_RT_SIGPENDING, unix.SYS_RT_SIGSUSPEND, unix.SYS_RT_SIGTIMEDWAIT, unix.SYS_SIGALTSTACK, unix.SYS_SIGNALFD4,
+		unix.SYS_KILL, unix.SYS_TKILL, unix.SYS_TGKILL, unix.SYS_PIDFD_OPEN, unix.SYS_PIDFD_SEND_SIGNAL, unix.SYS_RESTART_SYSCALL,
+		unix.SYS_CLONE, unix.SYS_CLONE3, unix.SYS_EXECVE, unix.SYS_EXECVEAT, unix.SYS_EXIT, unix.SYS_EXIT_GROUP, unix.SYS_WAIT4, unix.SYS_WAITID,
+		unix.SYS_FUTEX, unix.SYS_SET_ROBUST_LIST, unix.SYS_GET_ROBUST_LIST, unix.SYS_SET_TID_ADDRESS, unix.SYS_RSEQ, unix.SYS_SCHED_YIELD,
+		unix.SYS_SCHED_GETAFFINITY, unix.SYS_SCHED_SETAFFINITY, unix.SYS_SCHED_GETPARAM, unix.SYS_SCHED_GETSCHEDULER, unix.SYS_GETCPU,
+		unix.SYS_NANOSLEEP, unix.SYS_CLOCK_NANOSLEEP, unix.SYS_CLOCK_GETTIME, unix.SYS_CLOCK_GETRES, unix.SYS_GETTIMEOFDAY,
+		unix.SYS_SETITIMER, unix.SYS_GETITIMER, unix.SYS_TIMER_CREATE, unix.SYS_TIMER_SETTIME, unix.SYS_TIMER_GETTIME, unix.SYS_TIMER_DELETE,
+		unix.SYS_TIMERFD_CREATE, unix.SYS_TIMERFD_SETTIME, unix.SYS_TIMERFD_GETTIME, unix.SYS_EVENTFD2,
+		unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL, unix.SYS_EPOLL_PWAIT, unix.SYS_EPOLL_PWAIT2, unix.SYS_PPOLL, unix.SYS_PSELECT6,
+		unix.SYS_SOCKET, unix.SYS_SOCKETPAIR, unix.SYS_BIND, unix.SYS_LISTEN, unix.SYS_ACCEPT4, unix.SYS_CONNECT, unix.SYS_SHUTDOWN,
+		unix.SYS_GETSOCKNAME, unix.SYS_GETPEERNAME, unix.SYS_SETSOCKOPT, unix.SYS_GETSOCKOPT,
+		unix.SYS_SENDTO, unix.SYS_RECVFROM, unix.SYS_SENDMSG, unix.SYS_RECVMSG, unix.SYS_SENDMMSG, unix.SYS_RECVMMSG,
+		unix.SYS_GETPID, unix.SYS_GETTID, unix.SYS_GETPPID, unix.SYS_GETPGID, unix.SYS_SETPGID, unix.SYS_GETSID, unix.SYS_SETSID,
+		unix.SYS_GETUID, unix.SYS_GETEUID, unix.SYS_GETGID, unix.SYS_GETEGID, unix.SYS_GETRESUID, unix.SYS_GETRESGID, unix.SYS_GETGROUPS,
+		unix.SYS_CAPGET, unix.SYS_CAPSET, unix.SYS_PRCTL, unix.SYS_UNAME, unix.SYS_SYSINFO, unix.SYS_GETRANDOM,
+		unix.SYS_GETRLIMIT, unix.SYS_SETRLIMIT, unix.SYS_PRLIMIT64, unix.SYS_GETRUSAGE, unix.SYS_GETPRIORITY,
+	}, seccompArchSyscalls...)
+}
@@ -0,0 +1,33 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seccompArch		= unix.AUDIT_ARCH_AARCH64
+	seccompMaxSyscall	= 0
+)
+
+// The system calls of arm64 not shared with amd64
+var seccompArchSyscalls = []uintptr {
+	unix.SYS_FSTATAT,
+}
@@ -0,0 +1,197 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSandboxPaths(t *testing.T) {
+	dir := t.TempDir()
+	conf, err := loadConfig(writeTestConfig(t, "[daemon]\ncache-database = " + strconv.Quote(filepath.Join(dir, "cache", "cache.db")) + "\naudit-log = \"syslog\"\ncontrol-socket = " + strconv.Quote(filepath.Join(dir, "run", "portknob.sock")) + "\nsandbox = \"enforcing\"\n[[firewall]]\ndport = \"22\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := map[string]bool {}
+	for _, path := range conf.sandboxPaths() {
+		if path.write {
+			written[path.path] = true
+		}
+	}
+	for _, want := range []string {"/dev", "/run", filepath.Join(dir, "cache"), filepath.Join(dir, "run")} {
+		if !written[want] {
+			t.Errorf("%s is not writable", want)
+		}
+	}
+	for _, unwanted := range []string {"/etc", "/usr", filepath.Dir(conf.path)} {
+		if written[unwanted] {
+			t.Errorf("%s is writable", unwanted)
+		}
+	}
+
+	_, err = loadConfig(writeTestConfig(t, "[daemon]\nsandbox = \"strict\"\n"))
+	if err == nil || !strings.Contains(err.Error(), "sandbox") {
+		t.Errorf("sandbox = \"strict\" gave %v", err)
+	}
+}
+
+// Build the daemon and take it under "enforcing" through a login, a revocation and its shutdown, with a shell script for iptables, ip6tables and ipset
+func TestSandbox(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the daemon")
+	}
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip(err)
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "portknob")
+	build := exec.Command(goCmd, "build", "-o", bin, ".")
+	// Landlock restricts all threads of a cgo build only since Linux 6.19
+	build.Env = append(os.Environ(), "CGO_ENABLED=0")
+	out, err := build.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go build: %s\n%s", err, out)
+	}
+
+	// The commands log their arguments and try to write outside of the sandbox, as a compromised daemon could
+	outside := filepath.Join(t.TempDir(), "escaped")
+	commandLog := filepath.Join(dir, "commands.log")
+	script := "#!/bin/sh\necho \"${0##*/} $*\" >> " + strconv.Quote(commandLog) + "\n[ \"$2\" != restore ] || cat >> " + strconv.Quote(commandLog) + "\n{ echo escaped > " + strconv.Quote(outside) + "; } 2> /dev/null\nexit 0\n"
+	binDir := filepath.Join(dir, "bin")
+	err = os.Mkdir(binDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string {"iptables", "ip6tables", "ipset"} {
+		err = os.WriteFile(filepath.Join(binDir, name), []byte(script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := ln.Addr().String()
+	ln.Close()
+	confPath := writeTestConfig(t, "[daemon]\nlisten = " + strconv.Quote(listen) + "\ncache-database = " + strconv.Quote(filepath.Join(dir, "cache.db")) + "\naudit-log = " + strconv.Quote(filepath.Join(dir, "audit.log")) + "\ncontrol-socket = " + strconv.Quote(filepath.Join(dir, "control.sock")) + "\nadmin-path = \"/admin\"\nadmin-allow = [\"127.0.0.1/32\"]\nsandbox = \"enforcing\"\n[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\n")
+	var stderr bytes.Buffer
+	daemon := exec.Command(bin, "-conf", confPath)
+	daemon.Env = []string {"PATH=" + binDir + ":/usr/sbin:/usr/bin:/sbin:/bin"}
+	daemon.Stderr = &stderr
+	err = daemon.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- daemon.Wait()
+	}()
+	defer daemon.Process.Kill()
+
+	request := func (method string, path string, form url.Values) (*http.Response, error) {
+		r, err := http.NewRequest(method, "http://" + listen + path, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("X-Real-IP", "192.0.2.7")
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return http.DefaultClient.Do(r)
+	}
+	var reply *http.Response
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		reply, err = request("GET", "/admin/capabilities", nil)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		select {
+		case err := <-exited:
+			t.Fatalf("daemon exited: %v\n%s", err, stderr.String())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if err != nil {
+		t.Fatalf("%s\n%s", err, stderr.String())
+	}
+	var capabilities struct { Sandbox string }
+	err = json.NewDecoder(reply.Body).Decode(&capabilities)
+	reply.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(capabilities.Sandbox, "enforcing (landlock ABI ") || !strings.HasSuffix(capabilities.Sandbox, ", seccomp)") {
+		t.Skipf("this kernel only allows %q", capabilities.Sandbox)
+	}
+	// Written by the setup, before the sandbox
+	os.Remove(outside)
+
+	reply, err = request("POST", "/?plain=1", url.Values { "username": {"alice"}, "password": {"hunter2"} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply.Body.Close()
+	if reply.StatusCode != http.StatusOK {
+		t.Errorf("login replied %s", reply.Status)
+	}
+	revoke := exec.Command(bin, "-conf", confPath, "revoke", "192.0.2.7")
+	out, err = revoke.CombinedOutput()
+	if err != nil {
+		t.Errorf("revoke: %s\n%s", err, out)
+	}
+	err = daemon.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-exited:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("daemon did not stop\n%s", stderr.String())
+	}
+	if err != nil {
+		t.Errorf("daemon exited with %s\n%s", err, stderr.String())
+	}
+
+	commands, err := os.ReadFile(commandLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string {"ipset -exist add portknob-net4 192.0.2.7 ", "del portknob-net4 192.0.2.7", "iptables -t filter -D INPUT "} {
+		if !strings.Contains(string(commands), want) {
+			t.Errorf("no %q in the commands:\n%s", want, commands)
+		}
+	}
+	_, err = os.Stat(outside)
+	if err == nil {
+		t.Errorf("a firewall command wrote %s", outside)
+	}
+}
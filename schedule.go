@@ -0,0 +1,165 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+type configSchedule struct {
+	// Daily time window in which the user may log in, "HH:MM-HH:MM" in the user's timezone
+	// A window whose end is before its start spans midnight
+	// Default: "" (all day)
+	AllowedHours	string			`toml:"allowed-hours"`
+
+	// Days of week on which the window opens
+	// Supported values: "mon", "tue", "wed", "thu", "fri", "sat", "sun"
+	// Default: [] (every day)
+	AllowedDays		[]string		`toml:"allowed-days"`
+
+	// Timezone of the window, as an IANA name such as "Europe/Berlin"
+	// Default: "" (use the daemon timezone)
+	Timezone		string			`toml:"timezone"`
+
+	startMinute		int
+	endMinute		int
+	days			[7]bool
+	location		*time.Location
+}
+
+var weekdayNames = map[string]time.Weekday {
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (sched *configSchedule) parse(conf *config) error {
+	if sched.AllowedHours == "" {
+		sched.startMinute, sched.endMinute = 0, 24 * 60
+	} else {
+		dash := strings.IndexByte(sched.AllowedHours, '-')
+		if dash < 0 {
+			return conf.reportConfigError("allowed-hours", sched.AllowedHours)
+		}
+		var err error
+		sched.startMinute, err = parseClock(sched.AllowedHours[:dash])
+		if err != nil {
+			return conf.reportConfigError("allowed-hours", sched.AllowedHours)
+		}
+		sched.endMinute, err = parseClock(sched.AllowedHours[dash+1:])
+		if err != nil {
+			return conf.reportConfigError("allowed-hours", sched.AllowedHours)
+		}
+		if sched.endMinute == sched.startMinute {
+			return conf.reportConfigError("allowed-hours", sched.AllowedHours)
+		}
+	}
+
+	if len(sched.AllowedDays) == 0 {
+		for i := range sched.days {
+			sched.days[i] = true
+		}
+	}
+	for _, day := range sched.AllowedDays {
+		weekday, ok := weekdayNames[strings.ToLower(day)]
+		if !ok {
+			return conf.reportConfigError("allowed-days", day)
+		}
+		sched.days[weekday] = true
+	}
+
+	sched.location = conf.Daemon.location
+	if sched.Timezone != "" {
+		var err error
+		sched.location, err = time.LoadLocation(sched.Timezone)
+		if err != nil {
+			return conf.reportConfigError("timezone", sched.Timezone)
+		}
+	}
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	colon := strings.IndexByte(s, ':')
+	if colon < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	hour, err := strconv.ParseUint(strings.TrimSpace(s[:colon]), 10, 8)
+	if err != nil {
+		return 0, err
+	}
+	minute, err := strconv.ParseUint(strings.TrimSpace(s[colon+1:]), 10, 8)
+	if err != nil {
+		return 0, err
+	}
+	if minute >= 60 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, strconv.ErrRange
+	}
+	return int(hour) * 60 + int(minute), nil
+}
+
+// Return the window opening on the given day, relative to now
+func (sched *configSchedule) window(now time.Time, dayOffset int) (start, end time.Time, ok bool) {
+	year, month, day := now.Date()
+	date := time.Date(year, month, day + dayOffset, 0, 0, 0, 0, sched.location)
+	if !sched.days[date.Weekday()] {
+		return
+	}
+	// time.Date normalizes wall clock times skipped or repeated by DST transitions
+	start = time.Date(year, month, day + dayOffset, sched.startMinute / 60, sched.startMinute % 60, 0, 0, sched.location)
+	if sched.endMinute < sched.startMinute {
+		end = time.Date(year, month, day + dayOffset + 1, sched.endMinute / 60, sched.endMinute % 60, 0, 0, sched.location)
+	} else {
+		end = time.Date(year, month, day + dayOffset, sched.endMinute / 60, sched.endMinute % 60, 0, 0, sched.location)
+	}
+	return start, end, true
+}
+
+// Check whether now falls inside the schedule
+// If it does, return the time the current window closes,
+// otherwise return the time the next window opens
+func (sched *configSchedule) Check(now time.Time) (allowed bool, boundary time.Time) {
+	now = now.In(sched.location)
+	// Start from yesterday in case a window spans midnight
+	for i := -1; i <= 7; i++ {
+		start, end, ok := sched.window(now, i)
+		if !ok || !now.Before(end) {
+			continue
+		}
+		if now.Before(start) {
+			return false, start
+		}
+		// Windows on consecutive days may join into one
+		for j := i + 1; j <= 8; j++ {
+			nextStart, nextEnd, ok := sched.window(now, j)
+			if !ok || nextStart.After(end) {
+				break
+			}
+			end = nextEnd
+		}
+		return true, end
+	}
+	return false, time.Time {}
+}
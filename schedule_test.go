@@ -0,0 +1,106 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleCheck(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 2026-10-12 is a Monday, clocks in Berlin go back from 03:00 to 02:00 on Sunday 2026-10-25
+	at := func (loc *time.Location, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, loc)
+	}
+	utc := time.UTC
+	weekdays := []string {"mon", "tue", "wed", "thu", "fri"}
+	tests := []struct {
+		name		string
+		hours		string
+		days		[]string
+		timezone	string
+		now			time.Time
+		allowed		bool
+		boundary	time.Time
+	}{
+		{ "inside business hours", "09:00-17:00", weekdays, "UTC", at(utc, 10, 12, 10, 0), true, at(utc, 10, 12, 17, 0) },
+		{ "before business hours", "09:00-17:00", weekdays, "UTC", at(utc, 10, 12, 8, 0), false, at(utc, 10, 12, 9, 0) },
+		{ "at closing time", "09:00-17:00", weekdays, "UTC", at(utc, 10, 12, 17, 0), false, at(utc, 10, 13, 9, 0) },
+		{ "friday evening", "09:00-17:00", weekdays, "UTC", at(utc, 10, 16, 18, 0), false, at(utc, 10, 19, 9, 0) },
+		{ "saturday", "09:00-17:00", weekdays, "UTC", at(utc, 10, 17, 12, 0), false, at(utc, 10, 19, 9, 0) },
+		{ "night shift before midnight", "22:00-06:00", nil, "UTC", at(utc, 10, 12, 23, 0), true, at(utc, 10, 13, 6, 0) },
+		{ "night shift after midnight", "22:00-06:00", nil, "UTC", at(utc, 10, 13, 3, 0), true, at(utc, 10, 13, 6, 0) },
+		{ "night shift at noon", "22:00-06:00", nil, "UTC", at(utc, 10, 13, 12, 0), false, at(utc, 10, 13, 22, 0) },
+		{ "night shift ending on a day off", "22:00-06:00", []string {"fri"}, "UTC", at(utc, 10, 17, 3, 0), true, at(utc, 10, 17, 6, 0) },
+		{ "whole days join", "", []string {"mon", "tue"}, "UTC", at(utc, 10, 12, 12, 0), true, at(utc, 10, 14, 0, 0) },
+		{ "timezone of the user", "09:00-17:00", nil, "Europe/Berlin", at(utc, 10, 12, 15, 30), false, at(berlin, 10, 13, 9, 0) },
+		{ "window across the DST change", "01:00-04:00", []string {"sun"}, "Europe/Berlin", at(utc, 10, 25, 2, 30), true, at(berlin, 10, 25, 4, 0) },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			sched := &configSchedule { AllowedHours: tt.hours, AllowedDays: tt.days, Timezone: tt.timezone }
+			err := sched.parse(&config {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			allowed, boundary := sched.Check(tt.now)
+			if allowed != tt.allowed || !boundary.Equal(tt.boundary) {
+				t.Errorf("Check(%s) = %t, %s, want %t, %s", tt.now, allowed, boundary, tt.allowed, tt.boundary)
+			}
+		})
+	}
+}
+
+func TestScheduleParse(t *testing.T) {
+	tests := []struct {
+		name		string
+		sched		configSchedule
+		wantErr		bool
+	}{
+		{ "all day", configSchedule {}, false },
+		{ "business hours", configSchedule { AllowedHours: "09:00-17:30", AllowedDays: []string {"Mon", "fri"} }, false },
+		{ "until midnight", configSchedule { AllowedHours: "18:00-24:00" }, false },
+		{ "no dash", configSchedule { AllowedHours: "09:00" }, true },
+		{ "no colon", configSchedule { AllowedHours: "9-17" }, true },
+		{ "empty window", configSchedule { AllowedHours: "09:00-09:00" }, true },
+		{ "hour out of range", configSchedule { AllowedHours: "09:00-25:00" }, true },
+		{ "minute out of range", configSchedule { AllowedHours: "09:60-17:00" }, true },
+		{ "past midnight", configSchedule { AllowedHours: "24:30-06:00" }, true },
+		{ "unknown day", configSchedule { AllowedDays: []string {"funday"} }, true },
+		{ "unknown timezone", configSchedule { Timezone: "Mars/Olympus_Mons" }, true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			sched := tt.sched
+			if sched.Timezone == "" {
+				// The daemon timezone is only set by loadConfig
+				sched.Timezone = "UTC"
+			}
+			err := sched.parse(&config {})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parse() error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
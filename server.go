@@ -19,10 +19,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"html/template"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"os"
 	"github.com/gorilla/handlers"
@@ -32,6 +39,24 @@ type server struct {
 	conf		*config
 	fw			*firewall
 	servemux	*http.ServeMux
+	knocker		*knocker
+	// Confirmation tokens of grants already committed, until they expire
+	grantMutex		sync.Mutex
+	usedGrantTokens	map[string]time.Time
+	// admin-rate-limit buckets of admin-path, metrics-listen and control-socket
+	adminLimiter	*rateLimiter
+	metricsLimiter	*rateLimiter
+	controlLimiter	*rateLimiter
+	// share-link-rate-limit buckets by user
+	shareLimiter	*rateLimiter
+	// Key login challenges by subnet
+	challengeLimiter	*rateLimiter
+	// Share links are created and revoked with the login cookie, which browsers also send along with requests of other sites
+	shareProtection	*http.CrossOriginProtection
+	// Slots of max-concurrent-grants, nil without a limit
+	grantSlots		chan struct{}
+	// Posture of [defense]
+	defense			*defenseState
 }
 
 func newServer(conf *config, fw *firewall) *server {
@@ -39,44 +64,426 @@ func newServer(conf *config, fw *firewall) *server {
 		conf:		conf,
 		fw:			fw,
 		servemux:	http.NewServeMux(),
+		usedGrantTokens:	make(map[string]time.Time),
+		adminLimiter:	newRateLimiter(),
+		metricsLimiter:	newRateLimiter(),
+		controlLimiter:	newRateLimiter(),
+		shareLimiter:	newRateLimiter(),
+		challengeLimiter:	newRateLimiter(),
+		shareProtection:	http.NewCrossOriginProtection(),
+		defense:		&defenseState {},
+	}
+	if *conf.Daemon.MaxConcurrentGrants != 0 {
+		s.grantSlots = make(chan struct{}, *conf.Daemon.MaxConcurrentGrants)
+	}
+	if conf.readOnly {
+		s.servemux.HandleFunc(conf.Daemon.HTTPPath, s.readOnlyHandlerFunc)
+	} else {
+		s.servemux.HandleFunc(conf.Daemon.HTTPPath, s.handlerFunc)
+	}
+	if conf.Daemon.AdminListen != "" {
+		// Not even http-path "/" may serve it
+		s.servemux.HandleFunc(conf.Daemon.AdminPath + "/", http.NotFound)
+	} else if conf.Daemon.AdminPath != "" {
+		s.servemux.HandleFunc(conf.Daemon.AdminPath + "/", s.adminHandlerFunc)
+	}
+	s.knocker = newKnocker(s)
+	if conf.readOnly {
+		return s
+	}
+	if conf.Auth.OIDC != nil {
+		s.servemux.HandleFunc(conf.Auth.OIDC.redirectPath, s.oidcHandlerFunc)
+	}
+	if conf.Daemon.AllowShareLinks {
+		s.servemux.HandleFunc(conf.sharePath(), s.shareHandlerFunc)
+	}
+	if conf.Daemon.CookieGrantDelay != 0 {
+		s.servemux.HandleFunc(conf.cancelPath(), s.cancelHandlerFunc)
+	}
+	if conf.Daemon.AllowKeyLogins {
+		s.servemux.HandleFunc(conf.keyPath(), s.keyHandlerFunc)
+	}
+	if len(conf.lockdownGroups()) != 0 {
+		s.servemux.HandleFunc(conf.lockdownPath(), s.lockdownHandlerFunc)
+	}
+	if len(conf.DeviceKeys) != 0 {
+		s.servemux.HandleFunc(conf.deviceKnockPath(), s.deviceKnockHandlerFunc)
 	}
-	s.servemux.HandleFunc(conf.Daemon.HTTPPath, s.handlerFunc)
 	return s
 }
 
+// Refuse logins with -read-only, only admin-path and the listings of the control socket are served
+func (s *server) readOnlyHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	s.writeError(w, r, 503, "read-only", "Service Unavailable: this is a read-only replica, log in at the daemon whose cache database it reads")
+}
+
+// With -read-only, refuse everything but the GET requests of paths, writing the reply
+func (s *server) readOnlyRefuses(w http.ResponseWriter, r *http.Request, path string, paths ...string) bool {
+	if !s.conf.readOnly || r.Method == "GET" && containsString(paths, path) {
+		return false
+	}
+	s.writeJSON(w, 503, map[string]string { "error": "read-only replica" })
+	return true
+}
+
 func (s *server) Start() error {
-	return http.ListenAndServe(s.conf.Daemon.Listen, handlers.CombinedLoggingHandler(os.Stdout, s.servemux))
+	if s.conf.Daemon.MetricsListen != "" {
+		// Listen before serving, so a wrong address fails at startup
+		ln, err := net.Listen("tcp", s.conf.Daemon.MetricsListen)
+		if err != nil {
+			return err
+		}
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("/metrics", s.metricsHandlerFunc)
+		metricsMux.HandleFunc("/readyz", s.readyHandlerFunc)
+		go func() {
+			log.Println(http.Serve(ln, http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+				if !s.rateLimited(w, s.metricsLimiter, peerIP(r).String()) {
+					metricsMux.ServeHTTP(w, r)
+				}
+			})))
+		}()
+	}
+	if s.conf.Daemon.ControlSocket != "" {
+		err := s.startControl()
+		if err != nil {
+			return err
+		}
+	}
+	if s.conf.Daemon.SessionSocket != "" && !s.conf.readOnly {
+		err := s.startSessionSocket()
+		if err != nil {
+			return err
+		}
+	}
+	if !s.conf.readOnly {
+		err := s.knocker.Start()
+		if err != nil {
+			return err
+		}
+		if s.conf.Daemon.CookieGrantDelay != 0 {
+			s.schedulePending()
+		}
+		// Also without [defense], which a reload may add
+		s.scheduleDefense()
+	}
+	handler := handlers.CombinedLoggingHandler(os.Stdout, s.fw.metrics.Handler(s.servemux))
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	if s.conf.Daemon.AdminListen != "" {
+		err = s.startAdmin(tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen("tcp", s.conf.Daemon.Listen)
+	if err != nil {
+		return err
+	}
+	if s.conf.Daemon.ProxyProtocol {
+		ln = &proxyListener { ln, func (addr net.IP) bool {
+			s.fw.reloadMutex.RLock()
+			defer s.fw.reloadMutex.RUnlock()
+			return s.trustedProxy(addr)
+		} }
+	}
+	srv := &http.Server {
+		Handler:	handler,
+		TLSConfig:	tlsConfig,
+	}
+	// Everything is open and listening, the sandbox may take away the rest
+	err = applySandbox(s.conf)
+	if err != nil {
+		return err
+	}
+	if tlsConfig == nil {
+		return srv.Serve(ln)
+	}
+	return srv.ServeTLS(ln, "", "")
+}
+
+// Serve admin-path on admin-listen, with HTTPS like listen on an address and plain HTTP on a unix socket
+func (s *server) startAdmin(tlsConfig *tls.Config) error {
+	var ln net.Listener
+	var err error
+	if path, unix := strings.CutPrefix(s.conf.Daemon.AdminListen, "unix:"); unix {
+		tlsConfig = nil
+		ln, err = listenUnix(path, 0660)
+	} else {
+		ln, err = net.Listen("tcp", s.conf.Daemon.AdminListen)
+	}
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.conf.Daemon.AdminPath + "/", s.adminHandlerFunc)
+	srv := &http.Server {
+		Handler:	handlers.CombinedLoggingHandler(os.Stdout, mux),
+		TLSConfig:	tlsConfig,
+	}
+	go func() {
+		if tlsConfig == nil {
+			log.Println(srv.Serve(ln))
+		} else {
+			log.Println(srv.ServeTLS(ln, "", ""))
+		}
+	}()
+	return nil
+}
+
+// Reply 429 and return true once key used up admin-rate-limit on the endpoint of limiter
+func (s *server) rateLimited(w http.ResponseWriter, limiter *rateLimiter, key string) bool {
+	ok, retry := limiter.Allow(key, *s.conf.Daemon.AdminRateLimit, time.Now())
+	if ok {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry / time.Second) + 1))
+	s.writeJSON(w, 429, map[string]string { "error": "too many requests" })
+	return true
+}
+
+// Whitelist clientIP for a login, knock or single sign-on in one of the max-concurrent-grants slots, waiting for one if need be
+// The admin API and the control socket call the firewall directly, so they are never queued behind logins
+// Groups in skip are not opened, like those of require-totp rules for logins without a one-time password
+// Users who have not passed probation get short entries, see probation-lifespan
+// Lifespans by group, set by the [authz] authorizer, replace those of the rules
+func (s *server) publicGrant(clientIP net.IP, user string, groups, skip []string, lifespans map[string]time.Duration, timeout time.Duration, deadline time.Time) (uint, time.Duration, error) {
+	if s.grantSlots != nil {
+		s.grantSlots <- struct{}{}
+		defer func() { <-s.grantSlots }()
+	}
+	return s.fw.LoginGrant(clientIP, user, groups, skip, lifespans, timeout, deadline)
+}
+
+func (s *server) metricsHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	// Counted from the cache database, so the gauge is right after restarts and cleanups
+	entries, err := s.fw.cache.Entries()
+	if err != nil {
+		http.Error(w, "cannot read cache database", 500)
+		return
+	}
+	now := time.Now()
+	active := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.live(now) {
+			active[entry.addr.String()] = true
+		}
+	}
+	size, err := s.fw.cache.Size()
+	if err != nil {
+		http.Error(w, "cannot read cache database", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=UTF-8")
+	s.fw.metrics.WriteTo(w, len(active), size)
 }
 
 func (s *server) handlerFunc(w http.ResponseWriter, r *http.Request) {
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+
 	cookie_user, _ := s.cookieString(r, "portknob_user")
 	cookie_user, _ = url.QueryUnescape(cookie_user)
 	cookie_pass, _ := s.cookieString(r, "portknob_pass")
 	cookie_pass, _ = url.QueryUnescape(cookie_pass)
+	cookie_session, _ := s.cookieString(r, "portknob_session")
 
 	auth_user, auth_pass, _ := r.BasicAuth()
 
-	match_user, match_pass, ok := "", "", false
-	for user, pass := range s.conf.Secrets {
-		if (user == auth_user && pass == auth_pass) || (user == cookie_user && pass == cookie_pass) {
-			match_user, match_pass, ok = user, pass, true
+	form_user, form_pass, form_totp := "", "", ""
+	if r.Method == "POST" {
+		form_user, form_pass, form_totp = r.PostFormValue("username"), r.PostFormValue("password"), r.PostFormValue("totp")
+	}
+
+	clientIP, refused := s.checkClient(w, r)
+	if refused {
+		return
+	}
+
+	// The second page of a login without JavaScript sends the code with the token of the first page instead of the password
+	form_step := r.Method == "POST" && r.PostFormValue("totp-step") != ""
+	if form_step && (clientIP == nil || !s.checkTOTPStep(form_user, s.fw.Subnet(clientIP).String(), r.PostFormValue("totp-step"), time.Now())) {
+		s.auditLogin("failure", "password", form_user, clientIP)
+		s.countFailure(clientIP, form_user)
+		s.writeLoginPage(w, r, "")
+		return
+	}
+
+	// Honeypot credentials are checked first and get the usual failure reply
+	for user, pass := range s.conf.SecretsHoneypot {
+		if (user == auth_user && checkSecret(pass, auth_pass)) || (user == form_user && checkSecret(pass, form_pass)) || (user == cookie_user && checkSecret(pass, cookie_pass)) {
+			if clientIP != nil {
+				go s.banHoneypot(clientIP, user)
+			}
+			s.auditLogin("honeypot", "password", user, clientIP)
+			s.fw.metrics.AuthFailure("unknown")
+			s.writeUnauthorized(w, r)
+			return
+		}
+	}
+
+	// The cookie keeps the password as supplied, the secret may be a hash
+	match_user, match_pass, match_groups, ok, typed, unavailable, revoked := "", "", []string(nil), false, false, false, false
+	// Set when the password of a user with a one-time password was right but the form had no code
+	step_user := ""
+	for _, cred := range []struct { user, pass, code string; typed, form bool } {
+		{ auth_user, auth_pass, "", true, false },
+		{ form_user, form_pass, form_totp, true, true },
+		{ cookie_user, cookie_pass, "", false, false },
+	} {
+		provider := s.conf.authProvider(cred.user)
+		if provider == nil {
+			continue
+		}
+		// A cookie from before a revocation of the user does not log in, even from another subnet
+		if !cred.typed {
+			state := s.checkSession(cred.user, cookie_session, time.Now())
+			revoked = state == sessionRevoked
+			if state != sessionValid {
+				continue
+			}
+		}
+		pass, code := cred.pass, cred.code
+		key, needsTOTP := s.conf.totpKeys[cred.user]
+		if needsTOTP && cred.typed && code == "" && !(cred.form && form_step) {
+			pass, code = splitTOTPCode(pass)
+		}
+		// Other providers are only asked whether the user still exists, their cookies never carry the password
+		_, keepsPassword := provider.(secretsAuth)
+		var groups []string
+		var valid bool
+		var err error
+		if cred.form && form_step {
+			// The first page checked the password
+			groups, valid, err = provider.Lookup(cred.user)
+		} else if cred.typed || keepsPassword {
+			groups, valid, err = provider.Authenticate(cred.user, pass)
+		} else {
+			groups, valid, err = provider.Lookup(cred.user)
+		}
+		if err != nil {
+			log.Println(err)
+			unavailable = true
+			if cred.typed {
+				s.auditLogin("error", "password", cred.user, clientIP)
+			} else {
+				s.auditLogin("error", "cookie", cred.user, clientIP)
+			}
+			continue
+		}
+		if !valid {
+			continue
+		}
+		if needsTOTP && cred.form && !form_step && code == "" && *s.conf.Daemon.NoJSFallback && !s.wantsPlainText(r) {
+			step_user = cred.user
 			break
 		}
+		// A wrong code is a failed login, even with a valid cookie, so codes cannot be guessed past auth-max-failures
+		// The cookie holds no code, the login page asks for one below
+		if needsTOTP && cred.typed && !s.checkTOTPCode(cred.user, key, code) {
+			break
+		}
+		match_user, match_pass, match_groups, ok, typed = cred.user, pass, groups, true, cred.typed
+		if !keepsPassword {
+			match_pass = ""
+		}
+		break
+	}
+
+	if step_user != "" && clientIP != nil {
+		s.writeTOTPStep(w, r, step_user, clientIP)
+		return
 	}
 
 	if ok {
-		clientIP := net.ParseIP(r.Header.Get(s.conf.Daemon.ClientIP))
 		if clientIP == nil {
-			addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
-			if err == nil {
-				clientIP = addr.IP
+			s.writeError(w, r, 500, "internal", "cannot find client's IP address")
+			return
+		}
+
+		// A second factor is asked for at every login
+		if _, needsTOTP := s.conf.totpKeys[match_user]; needsTOTP && !typed {
+			s.writeLoginPage(w, r, "totp-required")
+			return
+		}
+
+		// After the admin API revoked the subnet, only a typed password lets it in again
+		if subnet := s.fw.Subnet(clientIP).String(); s.fw.cache.Revoked(subnet) {
+			if !typed {
+				s.writeLoginPage(w, r, "revoked")
+				return
+			}
+			err := s.fw.cache.SetRevoked(subnet, false)
+			if err != nil {
+				s.writeError(w, r, 500, "internal", "cannot update cache database")
+				return
 			}
 		}
-		if clientIP == nil {
-			http.Error(w, "cannot find client's IP address", 500)
+		if *s.conf.Daemon.AuthMaxFailures != 0 {
+			s.fw.cache.ClearFailures(s.fw.Subnet(clientIP).String())
+		}
+
+		method := "cookie"
+		if typed {
+			method = "password"
+		}
+		timeout, allowed, boundary := s.loginTimeout(match_user, time.Now())
+		if !allowed {
+			s.auditLogin("forbidden", method, match_user, clientIP)
+			s.writeScheduleForbidden(w, r, boundary)
 			return
 		}
+		// Users with a seed always typed a checked code to get here
+		var gated []string
+		if _, checked := s.conf.totpKeys[match_user]; !checked {
+			var others bool
+			gated, others = s.conf.gatedGroups(match_groups)
+			if len(gated) != 0 && !others {
+				s.auditLogin("forbidden", method, match_user, clientIP, "gated", s.conf.groupRuleNames(gated))
+				s.writeSecondFactorRequired(w, r)
+				return
+			}
+		}
+		bundles, chosen, err := s.loginBundles(r, match_user, match_groups)
+		if err != nil {
+			s.writeError(w, r, 400, "bad-request", "Bad Request: " + err.Error())
+			return
+		}
+		skip := append(append([]string(nil), gated...), s.conf.unselectedGroups(bundles)...)
+
+		if s.conf.Daemon.ReauthAfter != 0 {
+			authTime, found := s.fw.cache.AuthTime(match_user)
+			if typed {
+				err := s.fw.cache.SetAuthTime(match_user, time.Now())
+				if err != nil {
+					s.writeError(w, r, 500, "internal", "cannot update cache database")
+					return
+				}
+			} else if !found || time.Since(authTime) > time.Duration(s.conf.Daemon.ReauthAfter) * time.Second {
+				// The cookie alone may no longer extend the whitelist entry, a cookie without a password login on record never could
+				s.writeLoginPage(w, r, "reauth-required")
+				return
+			}
+		}
+
+		err = s.checkTravel(match_user, method, clientIP, time.Now())
+		if err == errTravelHeld {
+			s.auditLogin("held", method, match_user, clientIP)
+			s.writeTravelHeld(w, r)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+		}
 
+		session, err := s.sessionCookie(match_user, time.Now())
+		if err != nil {
+			log.Println(err)
+			s.writeError(w, r, 500, "internal", "cannot update cache database")
+			return
+		}
 		expires := time.Time {}
 		if *s.conf.Daemon.CookieLifespan != 0 {
 			expires = time.Now().Add(time.Duration(*s.conf.Daemon.CookieLifespan) * time.Second).UTC()
@@ -87,29 +494,760 @@ func (s *server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 			Path:		s.conf.Daemon.HTTPPath,
 			Expires:	expires,
 			HttpOnly:	true,
+			Secure:		s.secureRequest(r),
 		})
+		if match_pass != "" {
+			http.SetCookie(w, &http.Cookie {
+				Name:		"portknob_pass",
+				Value:		url.QueryEscape(match_pass),
+				Path:		s.conf.Daemon.HTTPPath,
+				Expires:	expires,
+				HttpOnly:	true,
+				Secure:		s.secureRequest(r),
+			})
+		} else {
+			http.SetCookie(w, &http.Cookie { Name: "portknob_pass", Path: s.conf.Daemon.HTTPPath, MaxAge: -1 })
+		}
 		http.SetCookie(w, &http.Cookie {
-			Name:		"portknob_pass",
-			Value:		url.QueryEscape(match_pass),
+			Name:		"portknob_session",
+			Value:		session,
 			Path:		s.conf.Daemon.HTTPPath,
 			Expires:	expires,
 			HttpOnly:	true,
+			Secure:		s.secureRequest(r),
 		})
+		if chosen {
+			s.setBundlesCookie(w, r, bundles)
+		}
+
+		if !typed && s.conf.Daemon.CookieGrantDelay != 0 {
+			extends, err := s.ownsEntry(match_user, clientIP, time.Now())
+			if err != nil {
+				s.writeError(w, r, 500, "internal", "cannot read cache database")
+				return
+			}
+			if !extends {
+				s.delayGrant(w, r, clientIP, match_user, match_groups, skip, timeout, s.loginDeadline(match_user, boundary), time.Now())
+				return
+			}
+		}
 
-		prefix, err := s.fw.Insert(clientIP)
+		decision, err := s.authorize(match_user, clientIP, match_groups, skip, time.Now())
+		if err == errAuthzDenied {
+			s.auditLogin("forbidden", method, match_user, clientIP, "denied", s.conf.groupRuleNames(decision.skip))
+			s.writeAuthzDenied(w, r)
+			return
+		}
+		if err == errAuthzUnavailable {
+			s.writeError(w, r, 503, "unavailable", "Service Unavailable: cannot reach the authorization server")
+			return
+		}
+		// A cookie coming back from another IPv6 prefix may take its entries along, see auto-rekey-ipv6
+		var prefix uint
+		var moved time.Duration
+		err = errNoRekey
+		if !typed {
+			prefix, moved, err = s.fw.RekeyIPv6(clientIP, match_user, decision.skip, time.Now())
+		}
+		if err == nil {
+			timeout = moved
+		} else if err == errNoRekey {
+			prefix, timeout, err = s.publicGrant(clientIP, match_user, match_groups, decision.skip, decision.lifespans, timeout, s.loginDeadline(match_user, boundary))
+		}
+		if err == errFirewallStopping {
+			s.writeError(w, r, 503, "unavailable", "service is shutting down")
+			return
+		}
 		if err != nil {
-			http.Error(w, "cannot update firewall", 500)
+			s.writeError(w, r, 500, "internal", "cannot update firewall")
 			return
 		}
+		s.fw.metrics.AuthSuccess(match_user)
+		s.auditSuccess(method, match_user, clientIP, gated)
+
+		cookieLifespan := "when the browser is closed"
+		if *s.conf.Daemon.CookieLifespan != 0 {
+			cookieLifespan = "in " + formatLifespan(*s.conf.Daemon.CookieLifespan)
+		}
+		notes := append(s.gatedNotes(w, gated), decision.notes...)
+		if s.conf.Daemon.AllowShareLinks && !s.defenseElevated(func (d *configDefense) bool { return *d.DisableShareLinks }) && s.conf.shareLifespan(match_user) != 0 && len(s.conf.shareableRules(match_groups)) != 0 {
+			notes = append(notes, "Share access with others at " + s.conf.sharePath())
+		}
+		if lockdowns := s.conf.loginLockdowns(match_groups, decision.skip); len(lockdowns) != 0 {
+			notes = append(notes, "Only this network can reach " + strings.Join(s.conf.groupRuleNames(lockdowns), ", ") + " now, lift the lockdown early at " + s.conf.lockdownPath())
+		}
+		s.writeLoginSucceeded(w, r, clientIP, prefix, timeout, cookieLifespan, notes, true)
+	} else if unavailable {
+		// The visitor may well have the right password, a directory outage must not rate limit everyone
+		s.writeError(w, r, 503, "unavailable", "Service Unavailable: cannot reach the authentication server")
+	} else if revoked && auth_user == "" && form_user == "" {
+		// Only the password can tell, this is no guess
+		s.auditLogin("revoked", "cookie", cookie_user, clientIP)
+		s.writeLoginPage(w, r, "revoked")
+	} else {
+		for i, user := range []string {auth_user, form_user, cookie_user} {
+			if user != "" {
+				method := "password"
+				if i == 2 {
+					method = "cookie"
+				}
+				s.auditLogin("failure", method, user, clientIP)
+				s.countFailure(clientIP, user)
+				break
+			}
+		}
+		s.writeUnauthorized(w, r)
+	}
+}
+
+// Whitelist lifespan of a login by user at now, the user's lifespan or firewall-lifespan cut short when the user's schedule window closes
+// Outside the window allowed is false and boundary is when it opens, zero if never
+func (s *server) loginTimeout(user string, now time.Time) (timeout time.Duration, allowed bool, boundary time.Time) {
+	timeout = time.Duration(*s.conf.Daemon.FirewallLifespan) * time.Second
+	if lifespan, ok := s.conf.SecretsLifespan[user]; ok {
+		timeout = time.Duration(lifespan) * time.Second
+	}
+	sched, ok := s.conf.SecretsSchedule[user]
+	if !ok {
+		return timeout, true, time.Time {}
+	}
+	allowed, boundary = sched.Check(now)
+	if !allowed {
+		return 0, false, boundary
+	}
+	remaining := boundary.Add(time.Duration(s.conf.Daemon.ScheduleGrace) * time.Second).Sub(now)
+	if timeout == 0 || remaining < timeout {
+		// A timeout of 0 would make the entry permanent
+		timeout = remaining
+		if timeout < time.Second {
+			timeout = time.Second
+		}
+	}
+	return timeout, true, boundary
+}
+
+// Time no whitelist entry of a login by user may outlive, boundary being the close of the schedule window from loginTimeout
+// Zero if user has no schedule
+func (s *server) loginDeadline(user string, boundary time.Time) time.Time {
+	if _, ok := s.conf.SecretsSchedule[user]; !ok {
+		return time.Time {}
+	}
+	return boundary.Add(time.Duration(s.conf.Daemon.ScheduleGrace) * time.Second)
+}
+
+// Whether the subnet of clientIP has a live whitelist entry of user at now
+func (s *server) ownsEntry(user string, clientIP net.IP, now time.Time) (bool, error) {
+	entries, err := s.fw.cache.Entries()
+	if err != nil {
+		return false, err
+	}
+	subnet := s.fw.Subnet(clientIP)
+	for _, entry := range entries {
+		if entry.user == user && entry.live(now) && subnet.Contains(entry.addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Reply to a login whose grantLogin failed with err
+func (s *server) writeGrantLoginError(w http.ResponseWriter, r *http.Request, err error, now time.Time) {
+	switch err {
+	case errMaintenance:
+		m, _ := s.fw.cache.Maintenance()
+		s.writeMaintenance(w, r, m, now)
+	case errTravelHeld:
+		s.writeTravelHeld(w, r)
+	case errSecondFactor:
+		s.writeSecondFactorRequired(w, r)
+	case errAuthzDenied:
+		s.writeAuthzDenied(w, r)
+	case errDefenseTOTP:
+		s.writeError(w, r, 403, "defense-totp-required", "Access Forbidden: while many logins fail, users with a one-time password log in with the login form and their code")
+	case errAuthzUnavailable:
+		s.writeError(w, r, 503, "unavailable", "Service Unavailable: cannot reach the authorization server")
+	case errFirewallStopping:
+		s.writeError(w, r, 503, "unavailable", "service is shutting down")
+	default:
+		log.Println(err)
+		s.writeError(w, r, 500, "internal", "cannot update firewall")
+	}
+}
+
+var errSecondFactor = errors.New("every rule of the login requires a one-time password")
+
+var errDefenseTOTP = errors.New("the elevated posture of [defense] refuses logins without the one-time password of the user")
+
+// Find the visitor's address, replying and returning refused when it is malformed, denied by the access policy, banned or in maintenance mode
+func (s *server) checkClient(w http.ResponseWriter, r *http.Request) (clientIP net.IP, refused bool) {
+	clientIP, err := s.clientIP(r)
+	if err != nil {
+		s.writeError(w, r, 400, "bad-request", "Bad Request: " + err.Error())
+		return nil, true
+	}
+	if s.writePolicyDenied(w, r, clientIP) {
+		return nil, true
+	}
+	if clientIP != nil && s.writeBanned(w, r, clientIP) {
+		return nil, true
+	}
+	if clientIP != nil {
+		if m, refused := s.maintenanceRefuses(clientIP, time.Now()); refused {
+			s.writeMaintenance(w, r, m, time.Now())
+			return nil, true
+		}
+	}
+	return clientIP, false
+}
+
+// Find the visitor's address, failing only on a malformed X-Forwarded-For from a trusted proxy
+func (s *server) clientIP(r *http.Request) (net.IP, error) {
+	peer := peerIP(r)
+	if s.conf.Daemon.trustedNets.Empty() {
+		clientIP := net.ParseIP(r.Header.Get(s.conf.Daemon.ClientIP))
+		if clientIP == nil {
+			clientIP = peer
+		}
+		return clientIP, nil
+	}
+	if peer == nil || !s.trustedProxy(peer) {
+		return peer, nil
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	// The rightmost address not belonging to a trusted proxy is the first one a proxy did not make up
+	for i := len(hops) - 1; i >= 0; i-- {
+		clientIP := parseForwardedAddr(strings.TrimSpace(hops[i]))
+		if clientIP == nil {
+			return nil, fmt.Errorf("malformed X-Forwarded-For element %q", strings.TrimSpace(hops[i]))
+		}
+		if !s.trustedProxy(clientIP) {
+			return clientIP, nil
+		}
+	}
+	// Falling back to a proxy would whitelist everyone behind it
+	if len(hops) == 0 {
+		return nil, errors.New("missing X-Forwarded-For from a trusted proxy")
+	}
+	return nil, errors.New("every X-Forwarded-For element is a trusted proxy")
+}
+
+// Return the address of the TCP peer, or the one a PROXY protocol header gave, nil if unknown
+func peerIP(r *http.Request) net.IP {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return addr.IP
+}
+
+func (s *server) trustedProxy(addr net.IP) bool {
+	return s.conf.Daemon.trustedNets.Contains(addr)
+}
+
+// Parse an X-Forwarded-For element, "addr", "addr:port", "[addr]" or "[addr]:port"
+func parseForwardedAddr(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1:len(s) - 1]
+	}
+	if strings.Contains(s, "%") {
+		// Zones mean nothing to a remote host
+		return nil
+	}
+	return net.ParseIP(s)
+}
+
+// Count a failed login, rate limiting the subnet after auth-max-failures
+func (s *server) countFailure(clientIP net.IP, user string) {
+	s.defendFailure(time.Now())
+	if _, ok := s.conf.Secrets[user]; ok {
+		s.fw.metrics.AuthFailure(user)
+	} else {
+		// Usernames made up by clients would let the number of metrics grow without bound
+		s.fw.metrics.AuthFailure("unknown")
+	}
+	if clientIP == nil || *s.conf.Daemon.AuthMaxFailures == 0 {
+		return
+	}
+	banDuration := time.Duration(s.conf.Daemon.AuthBanDuration) * time.Second
+	if s.defenseElevated(func (d *configDefense) bool { return d.BanDurationFactor > 1 }) {
+		banDuration *= time.Duration(s.conf.Defense.BanDurationFactor)
+	}
+	result, err := s.fw.cache.AddFailure(s.fw.Subnet(clientIP).String(), s.failureAggregate(clientIP).String(), time.Duration(s.conf.Daemon.AuthFailureWindow) * time.Second, banDuration, *s.conf.Daemon.AuthMaxFailures, *s.conf.Daemon.RatelimitMaxEntries)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	s.fw.metrics.FailureRecords(result.key != s.fw.Subnet(clientIP).String(), result.evicted, result.dropped)
+	subnet, count, bannedUntil := result.key, result.count, result.bannedUntil
+	if bannedUntil.IsZero() {
+		return
+	}
+	if s.conf.Daemon.Verbose >= 1 {
+		log.Printf("Rate limit: banned %s until %s after %d failed logins\n", subnet, bannedUntil.Format(time.RFC3339), count)
+	}
+	s.fw.audit.Event("ban", "subnet", subnet, "reason", "auth-failures", "failures", count, "until", bannedUntil)
+	s.fw.notify.Event("ban", fmt.Sprintf("Banned %s until %s after %d failed logins", subnet, bannedUntil.Format(time.RFC3339), count), "subnet", subnet, "reason", "auth-failures", "user", user, "failures", count, "until", bannedUntil)
+	err = s.fw.Ban(clientIP, time.Until(bannedUntil))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Check the TOTP code of user, each time step logs in only once
+func (s *server) checkTOTPCode(user string, key []byte, code string) bool {
+	counter, ok := checkTOTP(key, code, time.Now())
+	if !ok {
+		return false
+	}
+	fresh, err := s.fw.cache.UseTOTP(user, counter)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if !fresh && s.conf.Daemon.Verbose >= 1 {
+		log.Printf("TOTP: rejected a reused code of user %q\n", user)
+	}
+	return fresh
+}
+
+// Whitelist a client which completed the knock sequence of user, like a login with a typed password
+func (s *server) knockLogin(clientIP net.IP, user string) {
+	subnet := s.fw.Subnet(clientIP).String()
+	if _, banned := s.fw.cache.Banned(subnet); banned {
+		return
+	}
+	if _, banned := s.failureBan(clientIP); banned {
+		return
+	}
+	if !s.conf.policyAllows(clientIP) {
+		if s.conf.Daemon.Verbose >= 1 {
+			log.Printf("Knock: %s completed the sequence of user %q, but the access policy denies it\n", clientIP, user)
+		}
+		return
+	}
+	now := time.Now()
+	timeout, allowed, boundary := s.loginTimeout(user, now)
+	if !allowed {
+		if s.conf.Daemon.Verbose >= 1 {
+			log.Printf("Knock: %s completed the sequence of user %q outside the login schedule\n", clientIP, user)
+		}
+		s.auditLogin("forbidden", "knock", user, clientIP)
+		return
+	}
+	prefix, _, _, err := s.grantLogin(clientIP, user, "knock", s.conf.SecretsGroups[user], timeout, s.loginDeadline(user, boundary), now)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	gated, _ := s.conf.gatedGroups(s.conf.SecretsGroups[user])
+	s.auditSuccess("knock", user, clientIP, gated)
+	log.Printf("Knock: %s completed the sequence of user %q, whitelisted %s/%d\n", clientIP, user, clientIP, prefix)
+}
+
+// Record a login attempt in the audit log, result is "success", "failure", "forbidden", "honeypot", "revoked", "held" or "error"
+// keyvals are further fields, such as the rules "gated" by require-totp
+// Successful logins are also notified about
+func (s *server) auditLogin(result, method, user string, clientIP net.IP, keyvals ...interface{}) {
+	if result == "success" && s.conf.Defense != nil && clientIP != nil {
+		// For hide-from-unknown-subnets, kept whatever the posture so a wave finds the subnets known
+		err := s.fw.cache.SetKnownSubnet(s.fw.Subnet(clientIP).String(), time.Now())
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	if result == "success" {
+		s.fw.notify.Event("login", fmt.Sprintf("User %q logged in from %s", user, clientIP), "method", method, "user", user, "client", clientIP, "subnet", s.fw.Subnet(clientIP))
+	}
+	if clientIP == nil {
+		s.fw.audit.Event("login", append([]interface{} {"result", result, "method", method, "user", user}, keyvals...)...)
+		return
+	}
+	s.fw.audit.Event("login", append([]interface{} {"result", result, "method", method, "user", user, "client", clientIP, "subnet", s.fw.Subnet(clientIP)}, keyvals...)...)
+}
+
+// Record a successful login, naming the rules of the groups gated by require-totp which it left closed
+func (s *server) auditSuccess(method, user string, clientIP net.IP, gated []string) {
+	if len(gated) == 0 {
+		s.auditLogin("success", method, user, clientIP)
+		return
+	}
+	s.auditLogin("success", method, user, clientIP, "gated", s.conf.groupRuleNames(gated))
+}
+
+// Whitelist a client which proved to be user without a password form or cookie, like a login with a typed password
+// No one-time password was checked, so rules with require-totp are left out, errSecondFactor if that leaves none
+// Returns the prefix and the longest lifespan of the entries after absolute-max-lifespan and expiry-jitter, and why the [authz] authorizer left rules closed
+func (s *server) grantLogin(clientIP net.IP, user, method string, groups []string, timeout time.Duration, deadline time.Time, now time.Time) (uint, time.Duration, []string, error) {
+	if _, refused := s.maintenanceRefuses(clientIP, now); refused {
+		return 0, 0, nil, errMaintenance
+	}
+	gated, others := s.conf.gatedGroups(groups)
+	if len(gated) != 0 && !others {
+		s.auditLogin("forbidden", method, user, clientIP, "gated", s.conf.groupRuleNames(gated))
+		return 0, 0, nil, errSecondFactor
+	}
+	if _, enrolled := s.conf.totpKeys[user]; enrolled && s.defenseElevated(func (d *configDefense) bool { return *d.RequireTOTP }) {
+		s.auditLogin("forbidden", method, user, clientIP, "reason", "defense")
+		return 0, 0, nil, errDefenseTOTP
+	}
+	err := s.checkTravel(user, method, clientIP, now)
+	if err == errTravelHeld {
+		s.auditLogin("held", method, user, clientIP)
+		return 0, 0, nil, err
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	decision, err := s.authorize(user, clientIP, groups, gated, now)
+	if err == errAuthzDenied {
+		s.auditLogin("forbidden", method, user, clientIP, "denied", s.conf.groupRuleNames(decision.skip))
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	subnet := s.fw.Subnet(clientIP).String()
+	if s.fw.cache.Revoked(subnet) {
+		err := s.fw.cache.SetRevoked(subnet, false)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	if *s.conf.Daemon.AuthMaxFailures != 0 {
+		s.fw.cache.ClearFailures(subnet)
+	}
+	if s.conf.Daemon.ReauthAfter != 0 {
+		err := s.fw.cache.SetAuthTime(user, now)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
 
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("X-Portknob-ACL-Allow", fmt.Sprintf("%s/%d", clientIP, prefix))
-		w.Write([]byte(fmt.Sprintf("<!DOCTYPE html><html><head><script language=\"javascript\">window.alert(\"Login succeeded for %s/%d\");window.history.back();window.close();</script></head></html>\r\n", clientIP, prefix)))
+	prefix, timeout, err := s.publicGrant(clientIP, user, groups, decision.skip, decision.lifespans, timeout, deadline)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	s.fw.metrics.AuthSuccess(user)
+	return prefix, timeout, decision.notes, nil
+}
+
+func (s *server) banHoneypot(clientIP net.IP, user string) {
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+
+	subnet := s.fw.Subnet(clientIP)
+	expires, hits, err := s.fw.cache.Ban(subnet.String(), time.Duration(s.conf.Daemon.HoneypotBanDuration) * time.Second)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("Honeytoken: %s used honeypot user %q, banned %s until %s (hit %d)\n", clientIP, user, subnet, expires.Format(time.RFC3339), hits)
+	s.fw.audit.Event("ban", "subnet", subnet, "reason", "honeypot", "user", user, "hits", hits, "until", expires)
+	s.fw.notify.Event("ban", fmt.Sprintf("Banned %s until %s for using honeypot user %q", subnet, expires.Format(time.RFC3339), user), "subnet", subnet, "reason", "honeypot", "user", user, "hits", hits, "until", expires)
+	err = s.fw.Revoke(clientIP)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Return the /16 of an IPv4 or the /32 of an IPv6 address, or its subnet if that is wider
+// Once ratelimit-max-entries subnets have failure records, the failures of new ones are counted there
+func (s *server) failureAggregate(addr net.IP) *net.IPNet {
+	subnet := s.fw.Subnet(addr)
+	ones, bits := subnet.Mask.Size()
+	wide := 16
+	if bits == 128 {
+		wide = 32
+	}
+	if ones < wide {
+		return subnet
+	}
+	mask := net.CIDRMask(wide, bits)
+	return &net.IPNet { IP: subnet.IP.Mask(mask), Mask: mask }
+}
+
+// Return until when clientIP is rate limited for failed logins of its subnet or of the aggregate it was counted with
+func (s *server) failureBan(clientIP net.IP) (bannedUntil time.Time, banned bool) {
+	if *s.conf.Daemon.AuthMaxFailures == 0 {
+		return
+	}
+	if bannedUntil, banned = s.fw.cache.FailureBan(s.fw.Subnet(clientIP).String()); banned {
+		return
+	}
+	return s.fw.cache.FailureBan(s.failureAggregate(clientIP).String())
+}
+
+// Turn away a client whose subnet is banned, returning whether it is
+func (s *server) writeBanned(w http.ResponseWriter, r *http.Request, clientIP net.IP) bool {
+	if _, banned := s.fw.cache.Banned(s.fw.Subnet(clientIP).String()); banned {
+		s.writeUnauthorized(w, r)
+		return true
+	}
+	if bannedUntil, banned := s.failureBan(clientIP); banned {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(time.Until(bannedUntil) / time.Second) + 1, 10))
+		s.writeError(w, r, 429, "rate-limited until=" + bannedUntil.UTC().Format(time.RFC3339), fmt.Sprintf("Too Many Requests: too many failed logins, try again after %s", bannedUntil.Format(time.RFC1123Z)))
+		return true
+	}
+	return false
+}
+
+// Refuse a login outside the schedule of the user, boundary is when the window opens
+func (s *server) writeScheduleForbidden(w http.ResponseWriter, r *http.Request, boundary time.Time) {
+	if boundary.IsZero() {
+		s.writeError(w, r, 403, "forbidden", "Access Forbidden: login is not allowed at any time")
 	} else {
+		s.writeError(w, r, 403, "forbidden until=" + boundary.UTC().Format(time.RFC3339), fmt.Sprintf("Access Forbidden: login is not allowed until %s", boundary.Format(time.RFC1123Z)))
+	}
+}
+
+// Tell the visitor about the new whitelist entry
+// cookieLifespan is "" when no login cookie was set, notes are further lines, back returns the browser to the page it tried to reach
+func (s *server) writeLoginSucceeded(w http.ResponseWriter, r *http.Request, clientIP net.IP, prefix uint, timeout time.Duration, cookieLifespan string, notes []string, back bool) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Portknob-ACL-Allow", fmt.Sprintf("%s/%d", clientIP, prefix))
+	firewallLifespan := "never"
+	if timeout != 0 {
+		firewallLifespan = "in " + formatLifespan(uint64(timeout / time.Second))
+	}
+	lines := []string {
+		fmt.Sprintf("Login succeeded for %s/%d", clientIP, prefix),
+		"Firewall whitelist expires " + firewallLifespan,
+	}
+	if cookieLifespan != "" {
+		lines = append(lines, "Login cookie expires " + cookieLifespan)
+	}
+	lines = append(lines, notes...)
+	if next := safeNext(r); next != "" && !s.wantsPlainText(r) {
+		// Back to the application of this host which sent the visitor to log in, see the gate package
+		http.Redirect(w, r, next, 303)
+		return
+	}
+	if s.wantsPlainText(r) {
+		firewallExpires := "never"
+		if timeout != 0 {
+			firewallExpires = time.Now().Add(timeout).UTC().Format(time.RFC3339)
+		}
+		subnet := s.fw.Subnet(clientIP)
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Write([]byte(fmt.Sprintf("OK expires=%s subnet=%s\n%s\n", firewallExpires, subnet, strings.Join(lines, "\n"))))
+		return
+	}
+	// Notes may carry the deny reasons of the [authz] authorizer
+	htmlLines := make([]string, len(lines))
+	jsLines := make([]string, len(lines))
+	for i, line := range lines {
+		htmlLines[i] = template.HTMLEscapeString(line)
+		jsLines[i] = template.JSEscapeString(line)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	if !back {
+		w.Write([]byte(fmt.Sprintf("<!DOCTYPE html><html lang=\"en\"><head><meta charset=\"UTF-8\"><title>Portknob</title></head><body><p>%s</p><p>You may close this page now.</p></body></html>\r\n", strings.Join(htmlLines, "</p><p>"))))
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("<!DOCTYPE html><html lang=\"en\"><head><meta charset=\"UTF-8\"><title>Portknob</title><script language=\"javascript\">window.alert(\"%s\");window.history.back();window.close();</script></head><body><noscript><p>%s</p><p>You may close this page now.</p></noscript></body></html>\r\n", strings.Join(jsLines, "\\n"), strings.Join(htmlLines, "</p><p>"))))
+}
+
+// Tell the visitor which rules were not opened for want of a one-time password, also in X-Portknob-TOTP-Required for scripts
+func (s *server) gatedNotes(w http.ResponseWriter, gated []string) (notes []string) {
+	var numbers []string
+	for i, rule := range s.conf.Firewall {
+		if containsString(gated, rule.Group) {
+			numbers = append(numbers, strconv.Itoa(i + 1))
+			notes = append(notes, fmt.Sprintf("Rule %s requires a one-time password, it was not opened", s.conf.ruleName(i)))
+		}
+	}
+	if len(numbers) != 0 {
+		w.Header().Set("X-Portknob-TOTP-Required", strings.Join(numbers, ","))
+	}
+	return
+}
+
+// Refuse a login which opens only rules with require-totp, without a one-time password
+func (s *server) writeSecondFactorRequired(w http.ResponseWriter, r *http.Request) {
+	s.writeError(w, r, 403, "totp-required-by-rules", "Access Forbidden: every rule you may open requires a one-time password, which your account does not have")
+}
+
+// Refuse a login the [authz] authorizer allowed none of the rules of
+func (s *server) writeAuthzDenied(w http.ResponseWriter, r *http.Request) {
+	s.writeError(w, r, 403, "authz-denied", "Access Forbidden: the authorization service allowed none of the rules you may open")
+}
+
+func (s *server) writeTravelHeld(w http.ResponseWriter, r *http.Request) {
+	s.writeError(w, r, 403, "travel-held", "Access Forbidden: this login is too far from your last one to be plausible, an administrator has to confirm it")
+}
+
+func (s *server) writeUnauthorized(w http.ResponseWriter, r *http.Request) {
+	s.writeLoginPage(w, r, "")
+}
+
+// Why the login cookie alone is no longer enough, as the reason of plain text replies and the text of the login page
+var reauthMessages = map[string]struct { plain, page string } {
+	"reauth-required":	{ "Enter your password again to extend access", "Your login is too old to be extended automatically. Enter your password again to keep access." },
+	"totp-required":	{ "Enter your password and one-time code to log in", "Your account requires a one-time code at every login. Enter your password and the code to keep access." },
+	"revoked":			{ "Access of your network was revoked, enter your password again to log in", "Access of your network was revoked. Enter your password again to log in." },
+}
+
+// Ask for the password, reauth is a key of reauthMessages telling the visitor why the login cookie is not enough, or ""
+func (s *server) writeLoginPage(w http.ResponseWriter, r *http.Request, reauth string) {
+	// Visitors using the login form should not get the browser's password dialog on top of it
+	if r.Method != "POST" {
 		w.Header().Set("WWW-Authenticate", "Basic")
-		http.Error(w, "Access Unauthorized", 401)
 	}
+	if s.wantsPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(401)
+		if reauth != "" {
+			w.Write([]byte(fmt.Sprintf("ERROR %s\n%s\n\nTo log in, send your username and password:\n  curl -d username=USER -d password=PASS '%s?plain=1'\nUsers with a one-time password also send -d totp=CODE\n", reauth, reauthMessages[reauth].plain, s.requestURL(r))))
+		} else {
+			w.Write([]byte(fmt.Sprintf("ERROR unauthorized\nAccess Unauthorized\n\nTo log in, send your username and password:\n  curl -d username=USER -d password=PASS '%s?plain=1'\nUsers with a one-time password also send -d totp=CODE\n", s.requestURL(r))))
+		}
+		return
+	}
+	data := loginPageData { Reauth: reauthMessages[reauth].page, OIDCPath: s.conf.Auth.oidcPath() }
+	if reauth != "" {
+		data.Username, _ = s.cookieString(r, "portknob_user")
+		data.Username, _ = url.QueryUnescape(data.Username)
+	} else {
+		// Credentials were given but not accepted
+		if user, _, ok := r.BasicAuth(); ok {
+			data.Username, data.Failed = user, true
+		}
+		if r.Method == "POST" {
+			data.Username, data.Failed = r.PostFormValue("username"), true
+		}
+	}
+	data.Bundles = s.loginPageBundles(r, data.Username)
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(401)
+	loginPage.Execute(w, data)
+}
+
+// Ask for the one-time code of user, whose password was right, on a page of its own
+func (s *server) writeTOTPStep(w http.ResponseWriter, r *http.Request, user string, clientIP net.IP) {
+	token, err := s.totpStepToken(user, s.fw.Subnet(clientIP).String(), time.Now())
+	if err != nil {
+		log.Println(err)
+		s.writeError(w, r, 500, "internal", "cannot update cache database")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(401)
+	// The second page sends the bundles chosen on the first
+	totpStepPage.Execute(w, totpStepData { user, token, r.PostFormValue("bundle-choice") != "", r.PostForm["bundles"] })
+}
+
+type totpStepData struct {
+	Username	string
+	Token		string
+	BundleChoice	bool
+	Bundles		[]string
+}
+
+var totpStepPage = template.Must(template.New("totp-step").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>One-time code required - Portknob</title>
+</head>
+<body>
+<main>
+<h1>Portknob login</h1>
+<p id="login-totp" role="status">Enter the one-time code of your authenticator app to finish logging in as {{.Username}}.</p>
+<form method="post">
+<input type="hidden" name="username" value="{{.Username}}">
+<input type="hidden" name="totp-step" value="{{.Token}}">
+{{if .BundleChoice}}<input type="hidden" name="bundle-choice" value="1">
+{{end}}{{range .Bundles}}<input type="hidden" name="bundles" value="{{.}}">
+{{end}}<p><label for="totp">One-time code</label><br>
+<input id="totp" name="totp" type="text" inputmode="numeric" pattern="[0-9]{6}" maxlength="6" autocomplete="one-time-code" aria-describedby="login-totp" required autofocus></p>
+<p><button type="submit">Log in</button></p>
+</form>
+</main>
+</body>
+</html>
+`))
+
+type loginPageData struct {
+	Username	string
+	Failed		bool
+	// Why the password is needed again, "" for the first login
+	Reauth		string
+	OIDCPath	string
+	// Checkboxes of the rule bundles, none when there is nothing to choose
+	Bundles		[]loginPageBundle
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Failed}}Login failed - {{else if .Reauth}}Password required - {{end}}Portknob</title>
+</head>
+<body>
+<main>
+<h1>Portknob login</h1>
+{{if .Failed}}<p id="login-error" role="alert"><strong>Error:</strong> incorrect username, password or one-time code.</p>
+{{end}}{{if .Reauth}}<p id="login-reauth" role="status">{{.Reauth}}</p>
+{{end}}<form method="post">
+<p><label for="username">Username</label><br>
+<input id="username" name="username" type="text" value="{{.Username}}" autocomplete="username" autocapitalize="none" spellcheck="false" required{{if .Failed}} aria-invalid="true" aria-describedby="login-error"{{end}}{{if not .Reauth}} autofocus{{end}}></p>
+<p><label for="password">Password</label><br>
+<input id="password" name="password" type="password" autocomplete="current-password" required{{if .Failed}} aria-invalid="true" aria-describedby="login-error"{{end}}{{if .Reauth}} aria-describedby="login-reauth" autofocus{{end}}></p>
+<p><label for="totp">One-time code</label> (if enabled)<br>
+<input id="totp" name="totp" type="text" inputmode="numeric" pattern="[0-9]{6}" maxlength="6" autocomplete="one-time-code"{{if .Failed}} aria-invalid="true" aria-describedby="login-error"{{end}}></p>
+{{if .Bundles}}<fieldset>
+<legend>Open</legend>
+<input type="hidden" name="bundle-choice" value="1">
+{{range .Bundles}}<p><label><input type="checkbox" name="bundles" value="{{.Name}}"{{if .Checked}} checked{{end}}> {{.Name}}</label> ({{.Rules}})</p>
+{{end}}</fieldset>
+{{end}}<p><button type="submit">Log in</button></p>
+</form>
+{{if .OIDCPath}}<p><a href="{{.OIDCPath}}">Log in with single sign-on</a></p>
+{{end}}</main>
+</body>
+</html>
+`))
+
+// Report an error, plain text clients get a machine-stable first line "ERROR <reason>"
+func (s *server) writeError(w http.ResponseWriter, r *http.Request, code int, reason, message string) {
+	if s.wantsPlainText(r) {
+		http.Error(w, "ERROR " + reason + "\n" + message, code)
+		return
+	}
+	http.Error(w, message, code)
+}
+
+// Serve plain text to clients asking for "?plain=1" or preferring text/plain over text/html
+func (s *server) wantsPlainText(r *http.Request) bool {
+	if r.URL.Query().Get("plain") == "1" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "text/html")
+}
+
+func (s *server) requestURL(r *http.Request) string {
+	scheme := "http"
+	if s.secureRequest(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.Path
+}
+
+// Whether the visitor reached us over HTTPS, directly or through a TLS terminating proxy
+// Cookies are then only sent back over HTTPS, a forged header can only make that stricter
+func (s *server) secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
 }
 
 func (s *server) cookieString(r *http.Request, name string) (string, error) {
@@ -0,0 +1,768 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name		string
+		trusted		[]string
+		peer		string
+		header		map[string][]string
+		want		string
+		wantErr		bool
+	}{
+		{ "direct without proxies", nil, "203.0.113.9:5000", nil, "203.0.113.9", false },
+		{ "client-ip header without proxies", nil, "127.0.0.1:5000", map[string][]string { "X-Real-Ip": {"203.0.113.9"} }, "203.0.113.9", false },
+		{ "garbage client-ip header", nil, "127.0.0.1:5000", map[string][]string { "X-Real-Ip": {"nonsense"} }, "127.0.0.1", false },
+		{ "untrusted peer", []string {"10.0.0.0/8"}, "203.0.113.9:5000", map[string][]string { "X-Forwarded-For": {"198.51.100.1"} }, "203.0.113.9", false },
+		{ "single hop", []string {"10.0.0.0/8"}, "10.0.0.1:5000", map[string][]string { "X-Forwarded-For": {"203.0.113.9"} }, "203.0.113.9", false },
+		{ "spoofed leftmost hop", []string {"10.0.0.0/8"}, "10.0.0.1:5000", map[string][]string { "X-Forwarded-For": {"198.51.100.1, 203.0.113.9"} }, "203.0.113.9", false },
+		{ "chain of trusted proxies", []string {"10.0.0.0/8"}, "10.0.0.1:5000", map[string][]string { "X-Forwarded-For": {"203.0.113.9, 10.0.0.2, 10.0.0.3"} }, "203.0.113.9", false },
+		{ "several headers", []string {"10.0.0.0/8"}, "10.0.0.1:5000", map[string][]string { "X-Forwarded-For": {"198.51.100.1", "203.0.113.9, 10.0.0.2"} }, "203.0.113.9", false },
+		{ "IPv6 with port", []string {"10.0.0.0/8"}, "10.0.0.1:5000", map[string][]string { "X-Forwarded-For": {"[2001:db8::1]:443"} }, "2001:db8::1", false },
+		{ "IPv4 with port", []string {"10.0.0.0/8"}, "10.0.0.1:5000", map[string][]string { "X-Forwarded-For": {"203.0.113.9:443"} }, "203.0.113.9", false },
+		{ "missing header", []string {"10.0.0.0/8"}, "10.0.0.1:5000", nil, "", true },
+		{ "only trusted hops", []string {"10.0.0.0/8"}, "10.0.0.1:5000", map[string][]string { "X-Forwarded-For": {"10.0.0.2, 10.0.0.3"} }, "", true },
+		{ "malformed hop", []string {"10.0.0.0/8"}, "10.0.0.1:5000", map[string][]string { "X-Forwarded-For": {"203.0.113.9, unknown"} }, "", true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			conf := &config {}
+			conf.Daemon.ClientIP = "X-Real-IP"
+			var err error
+			conf.Daemon.trustedNets, err = parseNetList(conf, "trusted-proxies", tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &server { conf: conf }
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.peer
+			for name, values := range tt.header {
+				for _, value := range values {
+					r.Header.Add(name, value)
+				}
+			}
+			got, err := s.clientIP(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("clientIP() = %v, %v, want error %t", got, err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("clientIP() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseForwardedAddr(t *testing.T) {
+	tests := []struct {
+		s		string
+		want	string
+	}{
+		{ "203.0.113.9", "203.0.113.9" },
+		{ "203.0.113.9:443", "203.0.113.9" },
+		{ "2001:db8::1", "2001:db8::1" },
+		{ "[2001:db8::1]", "2001:db8::1" },
+		{ "[2001:db8::1]:443", "2001:db8::1" },
+		{ "fe80::1%eth0", "" },
+		{ "unknown", "" },
+		{ "", "" },
+	}
+	for _, tt := range tests {
+		got := parseForwardedAddr(tt.s)
+		if tt.want == "" && got != nil || tt.want != "" && !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("parseForwardedAddr(%q) = %v, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+// A server with the rules of the config text, a fake firewall backend and a BoltDB cache in a temporary directory
+func newTestServer(t *testing.T, text string) (*server, *fakeBackend) {
+	conf, err := loadConfig(writeTestConfig(t, "[daemon]\ncache-database = " + strconv.Quote(filepath.Join(t.TempDir(), "cache.db")) + "\n" + text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw := newFirewall(conf)
+	backend := &fakeBackend { fail: make(map[string]bool), elements: make(map[string]bool) }
+	fw.backend = backend
+	err = fw.cache.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fw.cache.Stop)
+	return newServer(conf, fw), backend
+}
+
+// Send a login request from addr with the cookies, returning the reply
+func testLogin(s *server, addr string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	method := "GET"
+	if form != nil {
+		method = "POST"
+	}
+	r := httptest.NewRequest(method, "/?plain=1", strings.NewReader(form.Encode()))
+	r.RemoteAddr = addr + ":5000"
+	r.Header.Set("X-Real-IP", addr)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.handlerFunc(w, r)
+	return w
+}
+
+func TestRevokeInvalidatesCookie(t *testing.T) {
+	tests := []struct {
+		name		string
+		// Address of the revoked subnet, "" for no revocation
+		revoke		string
+		// Where the cookie is used after the revocation
+		replay		string
+		wantCode	int
+	}{
+		{ "no revocation", "", "198.51.100.7", 200 },
+		{ "same subnet", "192.0.2.7", "192.0.2.7", 401 },
+		{ "different subnet", "192.0.2.7", "198.51.100.7", 401 },
+		{ "other subnet revoked", "203.0.113.7", "198.51.100.7", 200 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			log.SetOutput(io.Discard)
+			defer log.SetOutput(os.Stderr)
+			s, backend := newTestServer(t, "[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\nbob = \"hunter3\"\n")
+			w := testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+			if w.Code != 200 {
+				t.Fatalf("login replied %d: %s", w.Code, w.Body.String())
+			}
+			cookies := w.Result().Cookies()
+			if tt.revoke == "203.0.113.7" {
+				w := testLogin(s, tt.revoke, url.Values { "username": {"bob"}, "password": {"hunter3"} }, nil)
+				if w.Code != 200 {
+					t.Fatalf("login of bob replied %d: %s", w.Code, w.Body.String())
+				}
+			}
+			if tt.revoke != "" {
+				_, code, message := s.revokeSubnet(tt.revoke)
+				if code != 200 {
+					t.Fatalf("revokeSubnet() = %d %s", code, message)
+				}
+			}
+
+			w = testLogin(s, tt.replay, nil, cookies)
+			if w.Code != tt.wantCode {
+				t.Fatalf("replayed cookie got %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if whitelisted := backend.elements["portknob-net4 " + tt.replay]; whitelisted != (tt.wantCode == 200) {
+				t.Errorf("%s whitelisted %t, want %t", tt.replay, whitelisted, tt.wantCode == 200)
+			}
+			if tt.wantCode != 200 && !strings.HasPrefix(w.Body.String(), "ERROR revoked\n") {
+				t.Errorf("reply %q, want ERROR revoked", w.Body.String())
+			}
+
+			// The password logs in again and gives a cookie of the new epoch
+			w = testLogin(s, tt.replay, url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+			if w.Code != 200 {
+				t.Fatalf("login after revocation replied %d: %s", w.Code, w.Body.String())
+			}
+			w = testLogin(s, tt.replay, nil, w.Result().Cookies())
+			if w.Code != 200 {
+				t.Errorf("new cookie got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Compare a reply with testdata/name, or rewrite the file with -update
+// Times in the reply are replaced, so the files do not change from one run to the next
+func checkGolden(t *testing.T, name string, w *httptest.ResponseRecorder) {
+	got := []byte(fmt.Sprintf("%d %s\n\n%s", w.Code, w.Header().Get("Content-Type"), w.Body.String()))
+	got = regexp.MustCompile(`\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ`).ReplaceAll(got, []byte("TIME"))
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		err := os.WriteFile(path, got, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s, run the test with -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("reply differs from %s, run the test with -update if intended:\n%s", path, got)
+	}
+}
+
+// Plain text replies are for scripts, their first line must not change
+// Revoking one rule closes its group only, and the login cookie opens it again
+func TestRevokeRule(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, backend := newTestServer(t, `[[firewall]]
+comment = "ssh"
+dport = "22"
+[[firewall]]
+comment = "pgsql"
+dport = "5432"
+group = "db"
+[[firewall]]
+comment = "redis"
+dport = "6379"
+group = "db"
+[[firewall]]
+comment = "redis"
+dport = "6380"
+[[secrets]]
+username = "alice"
+password = "hunter2"
+groups = ["db"]
+`)
+	w := testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+	if w.Code != 200 || !backend.elements["portknob-db-net4 192.0.2.7"] {
+		t.Fatalf("login replied %d: %s", w.Code, w.Body.String())
+	}
+	cookies := w.Result().Cookies()
+
+	if _, _, code, _ := s.revokeRule("192.0.2.7", "redis"); code != 400 {
+		t.Errorf("comment of two rules got %d, want 400", code)
+	}
+	if _, _, code, _ := s.revokeRule("192.0.2.7", "#5"); code != 400 {
+		t.Errorf("rule #5 of 4 got %d, want 400", code)
+	}
+	w = httptest.NewRecorder()
+	s.adminRevoke(w, "192.0.2.0/24", "pgsql")
+	if w.Code != 200 || w.Body.String() != `{"revoked":"192.0.2.0/24","rules":["#2 pgsql","#3 redis"]}` + "\n" {
+		t.Errorf("revoke reply %d: %s", w.Code, w.Body.String())
+	}
+	if backend.elements["portknob-db-net4 192.0.2.7"] || !backend.elements["portknob-net4 192.0.2.7"] {
+		t.Errorf("firewall has %v, want only the db group closed", backend.elements)
+	}
+	entries, _ := s.fw.cache.Entries()
+	for _, entry := range entries {
+		if entry.group == "db" {
+			t.Errorf("cache still has %s for group db", entry.addr)
+		}
+	}
+	if _, _, code, _ := s.revokeRule("192.0.2.7", "2"); code != 404 {
+		t.Errorf("second revoke got %d, want 404", code)
+	}
+
+	if w := testLogin(s, "192.0.2.7", nil, cookies); w.Code != 200 || !backend.elements["portknob-db-net4 192.0.2.7"] {
+		t.Errorf("cookie login after revoking a rule replied %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPlainTextReplies(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	tests := []struct {
+		name	string
+		method	string
+		target	string
+		accept	string
+		form	url.Values
+		// Revoke the subnet after logging in, then send the request with the login cookies
+		revoke	bool
+		daemon	string
+	}{
+		{ "unauthorized", "GET", "/?plain=1", "", nil, false, "" },
+		{ "accept header", "GET", "/", "text/plain", nil, false, "" },
+		{ "login failed", "POST", "/?plain=1", "", url.Values { "username": {"alice"}, "password": {"wrong"} }, false, "" },
+		{ "login succeeded", "POST", "/?plain=1", "", url.Values { "username": {"alice"}, "password": {"hunter2"} }, false, "" },
+		{ "revoked", "GET", "/?plain=1", "", nil, true, "" },
+		{ "denied by policy", "GET", "/?plain=1", "", nil, false, "deny-cidr = [\"192.0.2.0/24\"]\n" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			s, _ := newTestServer(t, tt.daemon + "[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\n")
+			var cookies []*http.Cookie
+			if tt.revoke {
+				w := testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+				cookies = w.Result().Cookies()
+				s.revokeSubnet("192.0.2.7")
+			}
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.form.Encode()))
+			r.RemoteAddr = "192.0.2.7:5000"
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			for _, cookie := range cookies {
+				r.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			s.handlerFunc(w, r)
+			checkGolden(t, "plain-" + strings.ReplaceAll(tt.name, " ", "-") + ".txt", w)
+		})
+	}
+}
+
+// The login page tells assistive technology about errors, see the ARIA attributes in the files
+func TestLoginPageMarkup(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	tests := []struct {
+		name	string
+		method	string
+		form	url.Values
+		// Revoke the subnet after logging in, then send the request with the login cookies
+		revoke	bool
+	}{
+		{ "first visit", "GET", nil, false },
+		{ "login failed", "POST", url.Values { "username": {"alice"}, "password": {"wrong"} }, false },
+		{ "username escaped", "POST", url.Values { "username": {"<b>\"alice"}, "password": {"wrong"} }, false },
+		{ "password required", "GET", nil, true },
+		{ "login succeeded", "POST", url.Values { "username": {"alice"}, "password": {"hunter2"} }, false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			s, _ := newTestServer(t, "[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\n")
+			var cookies []*http.Cookie
+			if tt.revoke {
+				w := testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+				cookies = w.Result().Cookies()
+				s.revokeSubnet("192.0.2.7")
+			}
+			r := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.form.Encode()))
+			r.RemoteAddr = "192.0.2.7:5000"
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Accept", "text/html")
+			for _, cookie := range cookies {
+				r.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			s.handlerFunc(w, r)
+			checkGolden(t, "page-" + strings.ReplaceAll(tt.name, " ", "-") + ".html", w)
+		})
+	}
+}
+
+// With admin-listen, admin-path is only served there
+func TestAdminListen(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	s, _ := newTestServer(t, "admin-path = \"/admin\"\nadmin-allow = [\"192.0.2.0/24\"]\nadmin-listen = \"unix:" + path + "\"\n")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/admin/entries", nil)
+	r.RemoteAddr = "192.0.2.1:5000"
+	s.servemux.ServeHTTP(w, r)
+	if w.Code != 404 {
+		t.Errorf("admin-path on listen replied %d, want 404", w.Code)
+	}
+
+	err := s.startAdmin(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client { Transport: &http.Transport {
+		DialContext: func (ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer {}).DialContext(ctx, "unix", path)
+		},
+	} }
+	resp, err := client.Get("http://portknob/admin/entries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// The socket has no peer address, its permissions stand in for admin-allow
+	if resp.StatusCode != 200 {
+		t.Errorf("admin-path on admin-listen replied %d, want 200", resp.StatusCode)
+	}
+}
+
+// Logins waiting for the firewall hold up neither each other beyond max-concurrent-grants nor a revocation
+func TestGrantSlots(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, backend := newTestServer(t, "max-concurrent-grants = 2\n[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\n")
+	_, err := s.fw.InsertTimeout(net.ParseIP("198.51.100.7"), "bob", []string {""}, time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const logins = 6
+	backend.entered = make(chan struct{}, logins)
+	backend.block = make(chan struct{})
+
+	var wg sync.WaitGroup
+	codes := make(chan int, logins)
+	for i := 0; i < logins; i++ {
+		wg.Add(1)
+		go func (i int) {
+			defer wg.Done()
+			w := testLogin(s, fmt.Sprintf("192.0.%d.7", i), url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+			codes <- w.Code
+		}(i)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-backend.entered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("logins did not reach the firewall")
+		}
+	}
+	select {
+	case <-backend.entered:
+		t.Error("more logins than max-concurrent-grants reached the firewall")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	done := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		s.controlHandlerFunc(w, httptest.NewRequest("DELETE", "/entries/198.51.100.0/24", nil))
+		done <- w.Code
+	}()
+	select {
+	case code := <-done:
+		if code != 200 {
+			t.Errorf("revocation replied %d, want 200", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("revocation waited for the logins")
+	}
+
+	close(backend.block)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != 200 {
+			t.Errorf("login replied %d, want 200", code)
+		}
+	}
+}
+
+func TestFailureAggregate(t *testing.T) {
+	tests := []struct {
+		name	string
+		config	string
+		addr	string
+		want	string
+	}{
+		{ "IPv4", "", "192.0.2.1", "192.0.0.0/16" },
+		{ "IPv6", "", "2001:db8:1:2::1", "2001:db8::/32" },
+		{ "subnet wider already", "ipv4-prefix = 8\n", "192.0.2.1", "192.0.0.0/8" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			s, _ := newTestServer(t, tt.config)
+			if got := s.failureAggregate(net.ParseIP(tt.addr)).String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Once ratelimit-max-entries subnets have records, clients of a banned aggregate are refused
+func TestFailureAggregateBan(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, _ := newTestServer(t, "auth-max-failures = 2\nratelimit-max-entries = 1\n")
+	s.countFailure(net.ParseIP("198.51.100.1"), "alice")
+	for _, addr := range []string { "192.0.2.1", "192.0.3.1" } {
+		s.countFailure(net.ParseIP(addr), "alice")
+	}
+	if _, banned := s.failureBan(net.ParseIP("192.0.200.1")); !banned {
+		t.Error("client of the banned aggregate not rate limited")
+	}
+	if _, banned := s.failureBan(net.ParseIP("203.0.113.1")); banned {
+		t.Error("client of another aggregate rate limited")
+	}
+}
+
+// A browser without JavaScript logs in with forms and cookies alone, users with a one-time password on a second page
+func TestLoginWithoutJavaScript(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	const seed = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+	key, err := decodeTOTPSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name		string
+		config		string
+		user		string
+		// Code typed on the second page, "" if the first one should log in
+		code		func () string
+		wantGrant	bool
+	}{
+		{ "password only", "", "bob", nil, true },
+		{ "one-time code on the second page", "", "alice", func () string { return totpCode(key, uint64(time.Now().Unix()) / totpStep) }, true },
+		{ "wrong code on the second page", "", "alice", func () string { return "000000" }, false },
+		{ "fallback disabled", "nojs-fallback = false\n", "alice", nil, false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			s, backend := newTestServer(t, tt.config + "[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\nbob = \"hunter3\"\n[totp-secrets]\nalice = \"" + seed + "\"\n")
+			server := httptest.NewServer(http.HandlerFunc(s.handlerFunc))
+			defer server.Close()
+			jar, err := cookiejar.New(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client { Jar: jar }
+			get := func (method string, form url.Values) (int, string) {
+				var resp *http.Response
+				var err error
+				if method == "GET" {
+					resp, err = client.Get(server.URL + "/")
+				} else {
+					resp, err = client.PostForm(server.URL + "/", form)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.Contains(string(body), "<script") && !strings.Contains(string(body), "<noscript>") {
+					t.Errorf("page needs JavaScript:\n%s", body)
+				}
+				return resp.StatusCode, string(body)
+			}
+			if code, body := get("GET", nil); code != 401 || !strings.Contains(body, `<form method="post">`) {
+				t.Fatalf("first visit got %d:\n%s", code, body)
+			}
+			password := map[string]string { "alice": "hunter2", "bob": "hunter3" }[tt.user]
+			code, body := get("POST", url.Values { "username": {tt.user}, "password": {password} })
+			if tt.code != nil {
+				token := regexp.MustCompile(`name="totp-step" value="([^"]+)"`).FindStringSubmatch(body)
+				if code != 401 || token == nil {
+					t.Fatalf("password without a code got %d, want the second page:\n%s", code, body)
+				}
+				code, body = get("POST", url.Values { "username": {tt.user}, "totp-step": {token[1]}, "totp": {tt.code()} })
+			}
+			if (code == 200) != tt.wantGrant || (len(backend.elements) != 0) != tt.wantGrant {
+				t.Errorf("got %d with %d firewall elements, want granted %t:\n%s", code, len(backend.elements), tt.wantGrant, body)
+			}
+			if !tt.wantGrant {
+				return
+			}
+			// The cookies renew the grant of users without a one-time password on the next visit
+			code, body = get("GET", nil)
+			if tt.user == "bob" && code != 200 {
+				t.Errorf("visit with the cookies got %d:\n%s", code, body)
+			}
+		})
+	}
+}
+
+// The token of the second page only stands in for the password of its user from its subnet
+func TestTOTPStepToken(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, _ := newTestServer(t, "[secrets]\nalice = \"hunter2\"\n")
+	now := time.Now()
+	token, err := s.totpStepToken("alice", "192.0.2.0/24", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name	string
+		user	string
+		subnet	string
+		token	string
+		at		time.Time
+		want	bool
+	}{
+		{ "valid", "alice", "192.0.2.0/24", token, now, true },
+		{ "other user", "bob", "192.0.2.0/24", token, now, false },
+		{ "other subnet", "alice", "198.51.100.0/24", token, now, false },
+		{ "expired", "alice", "192.0.2.0/24", token, now.Add(totpStepLifespan), false },
+		{ "forged", "alice", "192.0.2.0/24", strconv.FormatInt(now.Add(time.Hour).Unix(), 10) + "." + strings.SplitN(token, ".", 2)[1], now, false },
+		{ "malformed", "alice", "192.0.2.0/24", "garbage", now, false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			if got := s.checkTOTPStep(tt.user, tt.subnet, tt.token, tt.at); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+	// Revoking the user voids it
+	err = s.fw.cache.BumpEpochs([]string {"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.checkTOTPStep("alice", "192.0.2.0/24", token, now) {
+		t.Error("token valid after the user was revoked")
+	}
+}
+
+func TestRequireTOTP(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	const seed = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+	key, err := decodeTOTPSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := "[[secrets]]\nusername = \"alice\"\npassword = \"hunter2\"\ngroups = [\"admin\"]\ntotp = \"" + seed + "\"\n[[secrets]]\nusername = \"bob\"\npassword = \"hunter3\"\ngroups = [\"admin\"]\n"
+	admin := "[[firewall]]\ncomment = \"admin panel\"\ndport = \"8443\"\ngroup = \"admin\"\nrequire-totp = true\n"
+	tests := []struct {
+		name		string
+		rules		string
+		form		url.Values
+		wantCode	int
+		// Sets the address was whitelisted in
+		wantSets	[]string
+		wantHeader	string
+	}{
+		{ "password only", "[[firewall]]\ndport = \"22\"\n" + admin, url.Values { "username": {"bob"}, "password": {"hunter3"} }, 200, []string {"portknob-net4"}, "2" },
+		{ "one-time password", "[[firewall]]\ndport = \"22\"\n" + admin, url.Values { "username": {"alice"}, "password": {"hunter2"}, "totp": {totpCode(key, uint64(time.Now().Unix()) / totpStep)} }, 200, []string {"portknob-net4", "portknob-admin-net4"}, "" },
+		{ "nothing left to open", admin, url.Values { "username": {"bob"}, "password": {"hunter3"} }, 403, nil, "" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			s, backend := newTestServer(t, tt.rules + secrets)
+			w := testLogin(s, "192.0.2.7", tt.form, nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("login replied %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if len(backend.elements) != len(tt.wantSets) {
+				t.Errorf("firewall has %v, want %v", backend.elements, tt.wantSets)
+			}
+			for _, set := range tt.wantSets {
+				if !backend.elements[set + " 192.0.2.7"] {
+					t.Errorf("192.0.2.7 missing from %s", set)
+				}
+			}
+			if got := w.Header().Get("X-Portknob-TOTP-Required"); got != tt.wantHeader {
+				t.Errorf("X-Portknob-TOTP-Required %q, want %q", got, tt.wantHeader)
+			}
+			if tt.wantHeader != "" && !strings.Contains(w.Body.String(), "Rule #2 admin panel requires a one-time password") {
+				t.Errorf("reply does not name the rule: %s", w.Body.String())
+			}
+		})
+	}
+}
+
+// A replica reads the cache database of another daemon and never runs a firewall command, whatever it is asked
+func TestReadOnly(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	options := "admin-path = \"/admin\"\nadmin-allow = [\"192.0.2.0/24\"]\ncontrol-socket = \"/nonexistent/portknob.sock\"\nallow-share-links = true\nallow-key-logins = true\n[[firewall]]\ndport = \"22\"\nshareable = true\n[secrets]\nalice = \"hunter2\"\n"
+	primary, _ := newTestServer(t, options)
+	if w := testLogin(primary, "203.0.113.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil); w.Code != 200 {
+		t.Fatalf("login replied %d: %s", w.Code, w.Body.String())
+	}
+	primary.fw.cache.Stop()
+
+	conf, err := loadConfig(writeTestConfig(t, "[daemon]\ncache-database = " + strconv.Quote(primary.conf.Daemon.CacheDatabase) + "\n" + options))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.readOnly = true
+	fw := newFirewall(conf)
+	var commands []string
+	fw.runner = func (cmd *exec.Cmd) error {
+		commands = append(commands, strings.Join(cmd.Args, " "))
+		return nil
+	}
+	err = fw.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fw.cache.Stop)
+	s := newServer(conf, fw)
+
+	tests := []struct {
+		method		string
+		path		string
+		form		url.Values
+		wantCode	int
+	}{
+		{ "GET", "/admin/", nil, 200 },
+		{ "GET", "/admin/entries", nil, 200 },
+		{ "GET", "/admin/access-review", nil, 200 },
+		{ "GET", "/admin/capabilities", nil, 200 },
+		{ "GET", "/", nil, 503 },
+		{ "POST", "/", url.Values { "username": {"alice"}, "password": {"hunter2"} }, 503 },
+		{ "POST", "/share/", url.Values { "action": {"create"}, "rule": {"1"}, "username": {"alice"}, "password": {"hunter2"} }, 503 },
+		{ "POST", "/key/challenge", url.Values { "username": {"alice"} }, 503 },
+		{ "POST", "/admin/grant", url.Values { "address": {"192.0.2.9"} }, 503 },
+		{ "POST", "/admin/revoke", url.Values { "subnet": {"203.0.113.0/24"} }, 503 },
+		{ "DELETE", "/admin/entries/203.0.113.0/24", nil, 503 },
+		{ "PUT", "/admin/maintenance", url.Values { "duration": {"60"} }, 503 },
+		{ "POST", "/admin/panic", url.Values { "confirm": {panicPhrase} }, 503 },
+		{ "GET", "control:/entries", nil, 200 },
+		{ "POST", "control:/grant", url.Values { "address": {"192.0.2.9"} }, 503 },
+		{ "DELETE", "control:/entries/203.0.113.0/24", nil, 503 },
+		{ "POST", "control:/flush", nil, 503 },
+		{ "POST", "control:/rotate-cookie-secret", nil, 503 },
+	}
+	for _, tt := range tests {
+		path, control := strings.CutPrefix(tt.path, "control:")
+		r := httptest.NewRequest(tt.method, path, strings.NewReader(tt.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		if control {
+			s.controlHandlerFunc(w, r)
+		} else {
+			s.servemux.ServeHTTP(w, r)
+		}
+		if w.Code != tt.wantCode {
+			t.Errorf("%s %s replied %d, want %d: %s", tt.method, tt.path, w.Code, tt.wantCode, w.Body.String())
+		}
+		if tt.wantCode == 503 && !strings.Contains(w.Body.String(), "read-only replica") {
+			t.Errorf("%s %s replied %q", tt.method, tt.path, w.Body.String())
+		}
+		if tt.path == "/admin/entries" && !strings.Contains(w.Body.String(), "203.0.113.0/24") {
+			t.Errorf("entries of the primary missing: %s", w.Body.String())
+		}
+	}
+	if len(commands) != 0 {
+		t.Errorf("replica ran %q", commands)
+	}
+	if entries, _ := fw.cache.Entries(); len(entries) != 1 {
+		t.Errorf("replica left %d entries, want the 1 of the primary", len(entries))
+	}
+	if err := fw.cache.SetRevoked("203.0.113.0/24", true); err == nil {
+		t.Errorf("replica wrote to the cache database")
+	}
+}
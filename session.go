@@ -0,0 +1,262 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Login cookies come with portknob_session, "epoch.issued.mac" signed with the key in the cache database, or one it replaced within cookie-lifespan
+// The MAC covers the user, so a session of one user is nothing to another
+type sessionState int
+
+const (
+	sessionInvalid sessionState = iota
+	sessionValid
+	// Signed before the access of the user was revoked
+	sessionRevoked
+)
+
+// Return the portknob_session value for a login of user at now
+func (s *server) sessionCookie(user string, now time.Time) (string, error) {
+	key, err := s.fw.cache.CookieKey()
+	if err != nil {
+		return "", err
+	}
+	payload := strconv.FormatUint(s.fw.cache.Epoch(user), 10) + "." + strconv.FormatInt(now.Unix(), 10)
+	return payload + "." + sessionMAC(key, user, payload), nil
+}
+
+func sessionMAC(key []byte, user, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(user))
+	mac.Write([]byte {0})
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Check the portknob_session value sent along with the login cookie of user
+func (s *server) checkSession(user, value string, now time.Time) sessionState {
+	fields := strings.Split(value, ".")
+	if len(fields) != 3 {
+		return sessionInvalid
+	}
+	keys, err := s.fw.cache.CookieKeys(time.Duration(*s.conf.Daemon.CookieLifespan) * time.Second, now)
+	if err != nil {
+		log.Println(err)
+		return sessionInvalid
+	}
+	signed := false
+	for _, key := range keys {
+		if hmac.Equal([]byte(fields[2]), []byte(sessionMAC(key, user, fields[0] + "." + fields[1]))) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return sessionInvalid
+	}
+	epoch, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return sessionInvalid
+	}
+	issued, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return sessionInvalid
+	}
+	// The browser should have dropped it by now
+	if lifespan := *s.conf.Daemon.CookieLifespan; lifespan != 0 && now.Sub(time.Unix(issued, 0)) > time.Duration(lifespan) * time.Second {
+		return sessionInvalid
+	}
+	if epoch != s.fw.cache.Epoch(user) {
+		return sessionRevoked
+	}
+	return sessionValid
+}
+
+// The second page of a login without JavaScript asks only for the one-time code, the password having been checked
+// Its totp-step field, "expires.mac", stands in for the password from the same subnet for totpStepLifespan
+const totpStepLifespan = 5 * time.Minute
+
+func (s *server) totpStepToken(user string, subnet string, now time.Time) (string, error) {
+	key, err := s.fw.cache.CookieKey()
+	if err != nil {
+		return "", err
+	}
+	payload := strconv.FormatInt(now.Add(totpStepLifespan).Unix(), 10)
+	return payload + "." + sessionMAC(key, "portknob-totp-step", totpStepPayload(user, subnet, s.fw.cache.Epoch(user), payload)), nil
+}
+
+// The MAC covers the epoch of the user, so revoking the user voids the pages given out before
+func totpStepPayload(user, subnet string, epoch uint64, expires string) string {
+	return strings.Join([]string {user, subnet, strconv.FormatUint(epoch, 10), expires}, "\x00")
+}
+
+func (s *server) checkTOTPStep(user, subnet, token string, now time.Time) bool {
+	payload, mac, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	keys, err := s.fw.cache.CookieKeys(totpStepLifespan, now)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	signed := false
+	for _, key := range keys {
+		if hmac.Equal([]byte(mac), []byte(sessionMAC(key, "portknob-totp-step", totpStepPayload(user, subnet, s.fw.cache.Epoch(user), payload)))) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return false
+	}
+	expires, err := strconv.ParseInt(payload, 10, 64)
+	return err == nil && now.Before(time.Unix(expires, 0))
+}
+
+// Listen on session-socket for the gate package, which other web applications of the host protect their handlers with
+func (s *server) startSessionSocket() error {
+	ln, err := listenUnix(s.conf.Daemon.SessionSocket, 0660)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/session", s.sessionHandlerFunc)
+	go func() {
+		log.Println(http.Serve(ln, mux))
+	}()
+	return nil
+}
+
+type sessionCheck struct {
+	// "valid", "invalid" or "revoked"
+	Session		string	`json:"session"`
+	User		string	`json:"user,omitempty"`
+	// Whether the subnet of "client" has a live whitelist entry of "rule", or of any rule without one
+	Granted		*bool	`json:"granted,omitempty"`
+}
+
+// Serve GET /session with the login cookies of a visitor of another web application, and "client" and "rule" in the query
+// The cookies are checked like those of a login, without whitelisting anything
+func (s *server) sessionHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+
+	if r.Method != "GET" {
+		s.writeJSON(w, 405, map[string]string { "error": "method not allowed" })
+		return
+	}
+	now := time.Now()
+	cookie_user, _ := s.cookieString(r, "portknob_user")
+	cookie_user, _ = url.QueryUnescape(cookie_user)
+	cookie_pass, _ := s.cookieString(r, "portknob_pass")
+	cookie_pass, _ = url.QueryUnescape(cookie_pass)
+	cookie_session, _ := s.cookieString(r, "portknob_session")
+
+	check := sessionCheck { Session: "invalid" }
+	if provider := s.conf.authProvider(cookie_user); provider != nil {
+		switch s.checkSession(cookie_user, cookie_session, now) {
+		case sessionRevoked:
+			check.Session = "revoked"
+		case sessionValid:
+			// Like a login by cookie, a changed password or a user removed from the directory ends the session
+			var valid bool
+			var err error
+			if _, keepsPassword := provider.(secretsAuth); keepsPassword {
+				_, valid, err = provider.Authenticate(cookie_user, cookie_pass)
+			} else {
+				_, valid, err = provider.Lookup(cookie_user)
+			}
+			if err != nil {
+				log.Println(err)
+				s.writeJSON(w, 503, map[string]string { "error": "cannot reach the authentication server" })
+				return
+			}
+			if valid {
+				check.Session = "valid"
+				check.User = cookie_user
+			}
+		}
+	}
+
+	if client := r.URL.Query().Get("client"); client != "" {
+		addr := net.ParseIP(client)
+		if addr == nil {
+			s.writeJSON(w, 400, map[string]string { "error": "cannot parse client" })
+			return
+		}
+		group := ""
+		if rule := r.URL.Query().Get("rule"); rule != "" {
+			i, found := s.conf.findRule(rule)
+			if !found {
+				s.writeJSON(w, 400, map[string]string { "error": "unknown rule, give its number or a comment no other rule has" })
+				return
+			}
+			group = s.conf.Firewall[i].Group
+		}
+		entries, err := s.fw.cache.Entries()
+		if err != nil {
+			s.writeJSON(w, 500, map[string]string { "error": "cannot read cache database" })
+			return
+		}
+		granted := false
+		subnet := s.fw.Subnet(addr).String()
+		for _, entry := range entries {
+			if entry.group == group && entry.live(now) && s.fw.Subnet(entry.addr).String() == subnet {
+				granted = true
+				break
+			}
+		}
+		check.Granted = &granted
+	}
+	s.writeJSON(w, 200, check)
+}
+
+// Return the "next" query parameter of a login, where it goes once it succeeded, if it is on this host
+// Any other would make the login page an open redirect
+func safeNext(r *http.Request) string {
+	next := r.URL.Query().Get("next")
+	if strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\") {
+		return next
+	}
+	u, err := url.Parse(next)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if u.Hostname() == "" || !strings.EqualFold(u.Hostname(), strings.Trim(host, "[]")) {
+		return ""
+	}
+	return next
+}
@@ -0,0 +1,238 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"github.com/5l1v3r1/portknob/gate"
+)
+
+func TestRotateCookieKey(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	req := grantRequest { net.ParseIP("192.0.2.7"), "alice", "", time.Hour }
+	tests := []struct {
+		name		string
+		rotations	int
+		want		sessionState
+		wantToken	error
+	}{
+		{ "no rotation", 0, sessionValid, nil },
+		{ "one rotation", 1, sessionValid, nil },
+		{ "as many as cookie-key-history", cookieKeyHistory, sessionValid, nil },
+		{ "beyond cookie-key-history", cookieKeyHistory + 1, sessionInvalid, errGrantTokenInvalid },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			s, _ := newTestServer(t, "")
+			now := time.Now()
+			session, err := s.sessionCookie("alice", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, _, err := s.grantToken(req, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.rotations; i++ {
+				w := testGrantPost(s.controlHandlerFunc, "/rotate-cookie-secret", url.Values { "by": { "alice" } })
+				var reply struct { Previous int `json:"previous"` }
+				json.NewDecoder(w.Body).Decode(&reply)
+				if w.Code != 200 || reply.Previous != min(i + 1, cookieKeyHistory) {
+					t.Fatalf("rotation %d = %d, %d previous keys, want 200, %d", i, w.Code, reply.Previous, min(i + 1, cookieKeyHistory))
+				}
+			}
+			if got := s.checkSession("alice", session, now); got != tt.want {
+				t.Errorf("checkSession() of the old cookie = %d, want %d", got, tt.want)
+			}
+			if err := s.checkGrantToken(req, token, now); err != tt.wantToken {
+				t.Errorf("checkGrantToken() of the old token = %v, want %v", err, tt.wantToken)
+			}
+			// Whatever the history, cookies signed now are valid
+			session, err = s.sessionCookie("alice", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.checkSession("alice", session, now); got != sessionValid {
+				t.Errorf("checkSession() of a new cookie = %d, want %d", got, sessionValid)
+			}
+		})
+	}
+}
+
+func TestCookieKeysRetired(t *testing.T) {
+	s, _ := newTestServer(t, "")
+	now := time.Now()
+	current, err := s.fw.cache.CookieKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.fw.cache.RotateCookieKey(time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name	string
+		keep	time.Duration
+		at		time.Time
+		want	int
+	}{
+		{ "within keep", time.Hour, now.Add(59 * time.Minute), 2 },
+		{ "after keep", time.Hour, now.Add(time.Hour), 1 },
+		{ "keep 0", 0, now.Add(1000 * time.Hour), 2 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			keys, err := s.fw.cache.CookieKeys(tt.keep, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != tt.want {
+				t.Fatalf("CookieKeys() returned %d keys, want %d", len(keys), tt.want)
+			}
+			if string(keys[0]) == string(current) {
+				t.Error("CookieKeys() starts with the retired key")
+			}
+			if tt.want == 2 && string(keys[1]) != string(current) {
+				t.Error("CookieKeys() lacks the retired key")
+			}
+		})
+	}
+}
+
+func TestSessionGate(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	socket := filepath.Join(t.TempDir(), "session.sock")
+	s, _ := newTestServer(t, "cookie-lifespan = 3600\nsession-socket = " + strconv.Quote(socket) + "\n[[firewall]]\ncomment = \"ssh\"\ndport = \"22\"\n[[firewall]]\ncomment = \"wiki\"\ndport = \"8080\"\ngroup = \"staff\"\n[[secrets]]\nusername = \"alice\"\npassword = \"hunter2\"\n[[secrets]]\nusername = \"bob\"\npassword = \"swordfish\"\ngroups = [\"staff\"]\n")
+	err := s.startSessionSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cookies []*http.Cookie
+	for _, login := range []struct { addr, user, password string } { {"192.0.2.7", "alice", "hunter2"}, {"198.51.100.7", "bob", "swordfish"} } {
+		w := testLogin(s, login.addr, url.Values { "username": {login.user}, "password": {login.password} }, nil)
+		if w.Code != 200 {
+			t.Fatalf("login of %s replied %d: %s", login.user, w.Code, w.Body.String())
+		}
+		if login.user == "alice" {
+			cookies = w.Result().Cookies()
+		}
+	}
+	middleware, err := gate.New(gate.Config {
+		Socket:		socket,
+		Rule:		"ssh",
+		LoginURL:	"https://knock.example.com/",
+		ClientIP:	func (r *http.Request) net.IP { return net.ParseIP(r.Header.Get("X-Real-IP")) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := middleware(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello " + gate.User(r))
+	}))
+	expired, err := s.sessionCookie("alice", time.Now().Add(-2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name		string
+		addr		string
+		// Replaces the value of portknob_session
+		session		string
+		wantCode	int
+	}{
+		{ "valid", "192.0.2.99", "", 200 },
+		{ "expired", "192.0.2.7", expired, 303 },
+		{ "forged", "192.0.2.7", "1.2.3", 303 },
+		{ "wrong subnet", "203.0.113.7", "", 303 },
+		// Whitelisted for the rule, by another user
+		{ "other user's subnet", "198.51.100.7", "", 200 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			r := httptest.NewRequest("GET", "https://knock.example.com:8443/wiki/?page=1", nil)
+			r.Header.Set("X-Real-IP", tt.addr)
+			for _, cookie := range cookies {
+				if cookie.Name == "portknob_session" && tt.session != "" {
+					cookie = &http.Cookie { Name: cookie.Name, Value: tt.session }
+				}
+				r.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("app replied %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if w.Code == 200 && w.Body.String() != "hello alice" {
+				t.Errorf("app replied %q, want \"hello alice\"", w.Body.String())
+			}
+			if want := "https://knock.example.com/?next=https%3A%2F%2Fknock.example.com%3A8443%2Fwiki%2F%3Fpage%3D1"; w.Code == 303 && w.Header().Get("Location") != want {
+				t.Errorf("redirected to %q, want %q", w.Header().Get("Location"), want)
+			}
+		})
+	}
+
+	// Back to the application once logged in
+	r := httptest.NewRequest("POST", "https://knock.example.com/?next=https%3A%2F%2Fknock.example.com%3A8443%2Fwiki%2F", strings.NewReader(url.Values { "username": {"alice"}, "password": {"hunter2"} }.Encode()))
+	r.RemoteAddr = "203.0.113.7:5000"
+	r.Header.Set("X-Real-IP", "203.0.113.7")
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.handlerFunc(w, r)
+	if w.Code != 303 || w.Header().Get("Location") != "https://knock.example.com:8443/wiki/" {
+		t.Errorf("login with next replied %d to %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	tests := []struct {
+		next		string
+		want		string
+	}{
+		{ "/wiki/", "/wiki/" },
+		{ "https://knock.example.com:8443/wiki/", "https://knock.example.com:8443/wiki/" },
+		{ "http://KNOCK.example.com/", "http://KNOCK.example.com/" },
+		{ "https://evil.example.com/", "" },
+		{ "//evil.example.com/", "" },
+		{ "/\\evil.example.com/", "" },
+		{ "https://knock.example.com@evil.example.com/", "" },
+		{ "javascript:alert(1)", "" },
+		{ "", "" },
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "https://knock.example.com/?next=" + url.QueryEscape(tt.next), nil)
+		if got := safeNext(r); got != tt.want {
+			t.Errorf("safeNext(%q) = %q, want %q", tt.next, got, tt.want)
+		}
+	}
+}
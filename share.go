@@ -0,0 +1,459 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Share links let a user who logged in whitelist someone else for one rule with "shareable"
+// The token is only ever shown to its creator, the cache database keeps its SHA-256 hash
+// Whitelist entries of a link are recorded as those of "shared-by:<user>"
+const shareUserPrefix = "shared-by:"
+
+// Path serving the share links, below http-path
+func (conf *config) sharePath() string {
+	return strings.TrimRight(conf.Daemon.HTTPPath, "/") + "/share/"
+}
+
+// Longest lifespan in seconds of the share links of user, 0 if the user may not create any
+func (conf *config) shareLifespan(user string) uint64 {
+	if lifespan, ok := conf.SecretsShareLifespan[user]; ok {
+		return lifespan
+	}
+	return conf.Daemon.ShareLinkMaxLifespan
+}
+
+// Return the indexes of the shareable rules opened for a user with groups
+func (conf *config) shareableRules(groups []string) (rules []int) {
+	opened := conf.expandGroups(append([]string {""}, groups...))
+	for i, rule := range conf.Firewall {
+		if rule.Shareable && containsString(opened, rule.Group) {
+			rules = append(rules, i)
+		}
+	}
+	return
+}
+
+// Return the index of the rule with key, false if it is gone or no longer shareable
+func (conf *config) shareRule(key string) (int, bool) {
+	for i, rule := range conf.Firewall {
+		if rule.key() == key {
+			return i, rule.Shareable
+		}
+	}
+	return 0, false
+}
+
+// Check that share links open no more than the rules with "shareable", and that nothing else is served on their path
+func (conf *config) checkShareable() error {
+	for i, rule := range conf.Firewall {
+		if !rule.Shareable {
+			continue
+		}
+		for j, other := range conf.Firewall {
+			if other.Group == rule.Group && !other.Shareable {
+				return &configError { fmt.Sprintf("firewall rule #%d (%q) is shareable, but the link would also open rule #%d (%q) of the same group\n", i + 1, rule.Comment, j + 1, other.Comment) }
+			}
+		}
+		if !conf.Daemon.AllowShareLinks {
+			log.Printf("Warning: firewall rule #%d (%q) is shareable, but option \"allow-share-links\" is not set\n", i + 1, rule.Comment)
+		}
+	}
+	if !conf.Daemon.AllowShareLinks {
+		return nil
+	}
+	return conf.checkServedPath("allow-share-links", conf.sharePath())
+}
+
+// Hash a token given out by share links or cookie-grant-delay, only the hash is stored
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// The part of the hash shown to the creator, enough to revoke the link but not to open it
+func shareID(hash string) string {
+	return hash[:16]
+}
+
+// Return the user whose login cookie came with r and whose own login whitelisted the subnet of clientIP, with the rule groups of the user
+// A cookie alone never whitelists users with a one-time password or after reauth-after, so it cannot act from elsewhere either
+func (s *server) sessionOwner(r *http.Request, clientIP net.IP) (user string, groups []string, ok bool, err error) {
+	user, _ = s.cookieString(r, "portknob_user")
+	user, _ = url.QueryUnescape(user)
+	pass, _ := s.cookieString(r, "portknob_pass")
+	pass, _ = url.QueryUnescape(pass)
+	session, _ := s.cookieString(r, "portknob_session")
+	provider := s.conf.authProvider(user)
+	if provider == nil || clientIP == nil || s.checkSession(user, session, time.Now()) != sessionValid {
+		return "", nil, false, nil
+	}
+	if _, keepsPassword := provider.(secretsAuth); keepsPassword {
+		groups, ok, err = provider.Authenticate(user, pass)
+	} else {
+		groups, ok, err = provider.Lookup(user)
+	}
+	if !ok || err != nil {
+		return "", nil, ok, err
+	}
+	owns, err := s.ownsEntry(user, clientIP, time.Now())
+	if !owns || err != nil {
+		return "", nil, false, err
+	}
+	return user, groups, true, nil
+}
+
+func (s *server) shareHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	s.fw.reloadMutex.RLock()
+	defer s.fw.reloadMutex.RUnlock()
+
+	clientIP, refused := s.checkClient(w, r)
+	if refused {
+		return
+	}
+	if err := s.shareProtection.Check(r); err != nil {
+		s.writeError(w, r, 403, "forbidden", "Access Forbidden: " + err.Error())
+		return
+	}
+	if s.defenseElevated(func (d *configDefense) bool { return *d.DisableShareLinks }) {
+		s.writeError(w, r, 503, "defense-elevated", "Service Unavailable: share links are disabled while many logins fail, try again later")
+		return
+	}
+	if token := strings.TrimPrefix(r.URL.Path, s.conf.sharePath()); token != "" {
+		s.openShare(w, r, clientIP, token)
+		return
+	}
+
+	user, groups, ok, err := s.sessionOwner(r, clientIP)
+	if err != nil {
+		log.Println(err)
+		s.writeError(w, r, 503, "unavailable", "Service Unavailable: cannot reach the authentication server")
+		return
+	}
+	if !ok {
+		s.writeError(w, r, 401, "unauthorized", fmt.Sprintf("Access Unauthorized: log in at %s first", s.conf.Daemon.HTTPPath))
+		return
+	}
+	maxLifespan := s.conf.shareLifespan(user)
+	rules := s.conf.shareableRules(groups)
+	if maxLifespan == 0 || len(rules) == 0 {
+		s.writeError(w, r, 403, "forbidden", "Access Forbidden: you may not create share links")
+		return
+	}
+	if r.Method != "POST" {
+		s.writeShares(w, r, user, rules, maxLifespan, "", time.Time {})
+		return
+	}
+
+	now := time.Now()
+	switch r.PostFormValue("action") {
+	case "create":
+		if allowed, retry := s.shareLimiter.Allow(user, *s.conf.Daemon.ShareLinkRateLimit, now); !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry / time.Second) + 1))
+			s.writeError(w, r, 429, "rate-limited", "Too Many Requests: too many share links, try again later")
+			return
+		}
+		number, err := strconv.Atoi(r.PostFormValue("rule"))
+		if err != nil || !containsInt(rules, number - 1) {
+			s.writeError(w, r, 400, "bad-request", "Bad Request: unknown rule")
+			return
+		}
+		lifespan := maxLifespan
+		if v := r.PostFormValue("lifespan"); v != "" {
+			lifespan, err = strconv.ParseUint(v, 10, 64)
+			if err != nil || lifespan == 0 || lifespan > maxLifespan {
+				s.writeError(w, r, 400, "bad-request", fmt.Sprintf("Bad Request: the lifespan must be between 1 and %d seconds", maxLifespan))
+				return
+			}
+		}
+		raw := make([]byte, 32)
+		_, err = rand.Read(raw)
+		if err != nil {
+			s.writeError(w, r, 500, "internal", "cannot create share link")
+			return
+		}
+		token := base64.RawURLEncoding.EncodeToString(raw)
+		link := shareLink {
+			user:		user,
+			rule:		s.conf.Firewall[number - 1].key(),
+			created:	now,
+			expires:	now.Add(time.Duration(lifespan) * time.Second),
+			epoch:		s.fw.cache.Epoch(user),
+		}
+		hash := tokenHash(token)
+		err = s.fw.cache.AddShare(hash, link)
+		if err != nil {
+			log.Println(err)
+			s.writeError(w, r, 500, "internal", "cannot update cache database")
+			return
+		}
+		s.fw.audit.Event("share-create", "user", user, "id", shareID(hash), "rule", s.conf.ruleName(number - 1), "client", clientIP, "until", link.expires)
+		s.writeShares(w, r, user, rules, maxLifespan, s.requestURL(r) + token, link.expires)
+	case "revoke":
+		id := r.PostFormValue("id")
+		found, err := s.fw.cache.RevokeShare(user, id)
+		if err != nil {
+			log.Println(err)
+			s.writeError(w, r, 500, "internal", "cannot update cache database")
+			return
+		}
+		if !found {
+			s.writeError(w, r, 404, "not-found", "Not Found: no such share link")
+			return
+		}
+		s.fw.audit.Event("share-revoke", "user", user, "id", id, "client", clientIP)
+		if s.wantsPlainText(r) {
+			w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			w.Write([]byte("OK revoked=" + id + "\n"))
+			return
+		}
+		http.Redirect(w, r, s.conf.sharePath(), 303)
+	default:
+		s.writeError(w, r, 400, "bad-request", "Bad Request: the action must be \"create\" or \"revoke\"")
+	}
+}
+
+// List the share links of user, newURL being the one just created
+func (s *server) writeShares(w http.ResponseWriter, r *http.Request, user string, rules []int, maxLifespan uint64, newURL string, newExpires time.Time) {
+	links, err := s.fw.cache.Shares(user, time.Now())
+	if err != nil {
+		log.Println(err)
+		s.writeError(w, r, 500, "internal", "cannot read cache database")
+		return
+	}
+	data := sharePageData { User: user, Path: s.conf.sharePath(), MaxLifespan: maxLifespan, NewURL: newURL }
+	if newURL != "" {
+		data.NewExpires = newExpires.Format(time.RFC1123Z)
+	}
+	for _, i := range rules {
+		data.Rules = append(data.Rules, shareRuleData { i + 1, s.conf.ruleName(i) })
+	}
+	var hashes []string
+	for hash := range links {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func (i, j int) bool { return links[hashes[i]].created.Before(links[hashes[j]].created) })
+	for _, hash := range hashes {
+		name := "a rule which is gone"
+		if i, ok := s.conf.shareRule(links[hash].rule); ok {
+			name = s.conf.ruleName(i)
+		}
+		data.Links = append(data.Links, shareLinkData { shareID(hash), name, links[hash].expires.Format(time.RFC3339) })
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if s.wantsPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		if newURL != "" {
+			fmt.Fprintf(w, "OK url=%s expires=%s\n", newURL, newExpires.UTC().Format(time.RFC3339))
+			return
+		}
+		w.Write([]byte("OK\n"))
+		for _, link := range data.Links {
+			fmt.Fprintf(w, "%s %s %s\n", link.ID, link.Expires, link.Rule)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	sharePage.Execute(w, data)
+}
+
+// Show the link of token, and whitelist clientIP for its rule once it is posted back
+// Opening the link only asks for a confirmation, so link previews of chat programs cannot use it up
+func (s *server) openShare(w http.ResponseWriter, r *http.Request, clientIP net.IP, token string) {
+	now := time.Now()
+	hash := tokenHash(token)
+	if r.Method != "POST" {
+		link, ok := s.fw.cache.Share(hash, now)
+		i, shareable := s.conf.shareRule(link.rule)
+		if !ok || !shareable {
+			s.writeError(w, r, 404, "not-found", "Not Found: this share link is unknown, used up or expired")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if s.wantsPlainText(r) {
+			w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			fmt.Fprintf(w, "OK shared-by=%s expires=%s\n%s shares %s with you, POST to this URL to open it\n", link.user, link.expires.UTC().Format(time.RFC3339), link.user, s.conf.ruleName(i))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		shareOpenPage.Execute(w, shareOpenData { link.user, s.conf.ruleName(i), link.expires.Format(time.RFC1123Z) })
+		return
+	}
+	if clientIP == nil {
+		s.writeError(w, r, 500, "internal", "cannot find client's IP address")
+		return
+	}
+
+	// Used up before the firewall is changed, so it cannot be opened twice however the grant ends
+	link, ok, err := s.fw.cache.UseShare(hash, now)
+	if err != nil {
+		log.Println(err)
+		s.writeError(w, r, 500, "internal", "cannot update cache database")
+		return
+	}
+	// The creator must still be allowed to share the rule
+	i, shareable := s.conf.shareRule(link.rule)
+	var groups []string
+	if ok && shareable {
+		ok = link.epoch == s.fw.cache.Epoch(link.user) && s.conf.shareLifespan(link.user) != 0
+		if provider := s.conf.authProvider(link.user); ok && provider != nil {
+			groups, ok, err = provider.Lookup(link.user)
+		} else {
+			ok = false
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		s.writeError(w, r, 503, "unavailable", "Service Unavailable: cannot reach the authentication server")
+		return
+	}
+	if !ok || !shareable || !containsInt(s.conf.shareableRules(groups), i) {
+		s.writeError(w, r, 404, "not-found", "Not Found: this share link is unknown, used up or expired")
+		return
+	}
+
+	user := shareUserPrefix + link.user
+	rule := s.conf.Firewall[i]
+	timeout := link.expires.Sub(now)
+	if lg, ok := s.conf.lifespanGroups[rule.Group]; ok && lg.lifespan != 0 && time.Duration(lg.lifespan) * time.Second < timeout {
+		timeout = time.Duration(lg.lifespan) * time.Second
+	}
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	timeout = s.fw.ClampLifespan(timeout)
+	// Queued behind logins like them, the share link being a login by proxy
+	if s.grantSlots != nil {
+		s.grantSlots <- struct{}{}
+		defer func() { <-s.grantSlots }()
+	}
+	prefix, err := s.fw.InsertTimeout(clientIP, user, []string {rule.Group}, timeout, true)
+	if err == errFirewallStopping {
+		s.writeError(w, r, 503, "unavailable", "service is shutting down")
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, 500, "internal", "cannot update firewall")
+		return
+	}
+	s.auditLogin("success", "share", user, clientIP)
+	s.writeLoginSucceeded(w, r, clientIP, prefix, timeout, "", nil, false)
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+type shareRuleData struct {
+	Number		int
+	Name		string
+}
+
+type shareLinkData struct {
+	ID			string
+	Rule		string
+	Expires		string
+}
+
+type sharePageData struct {
+	User		string
+	Path		string
+	Rules		[]shareRuleData
+	MaxLifespan	uint64
+	Links		[]shareLinkData
+	// The link just created, shown only this once
+	NewURL		string
+	NewExpires	string
+}
+
+var sharePage = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Share links - Portknob</title>
+</head>
+<body>
+<main>
+<h1>Share links of {{.User}}</h1>
+{{if .NewURL}}<p id="share-new" role="status">Send this link to the person you share access with, it works once until {{.NewExpires}} and is not shown again:<br>
+<input type="text" value="{{.NewURL}}" size="80" readonly aria-labelledby="share-new"></p>
+{{end}}<form method="post" action="{{.Path}}">
+<input type="hidden" name="action" value="create">
+<p><label for="rule">Rule</label><br>
+<select id="rule" name="rule">
+{{range .Rules}}<option value="{{.Number}}">{{.Name}}</option>
+{{end}}</select></p>
+<p><label for="lifespan">Lifespan in seconds</label> (at most {{.MaxLifespan}})<br>
+<input id="lifespan" name="lifespan" type="number" min="1" max="{{.MaxLifespan}}" value="{{.MaxLifespan}}" required></p>
+<p><button type="submit">Create share link</button></p>
+</form>
+{{if .Links}}<table>
+<tr><th>Link</th><th>Rule</th><th>Expires</th><th></th></tr>
+{{range .Links}}<tr><td>{{.ID}}</td><td>{{.Rule}}</td><td>{{.Expires}}</td><td><form method="post" action="{{$.Path}}"><input type="hidden" name="action" value="revoke"><input type="hidden" name="id" value="{{.ID}}"><button type="submit">Revoke {{.ID}}</button></form></td></tr>
+{{end}}</table>
+{{else}}<p>You have no share links which are still usable.</p>
+{{end}}</main>
+</body>
+</html>
+`))
+
+type shareOpenData struct {
+	User		string
+	Rule		string
+	Expires		string
+}
+
+var shareOpenPage = template.Must(template.New("share-open").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Share link - Portknob</title>
+</head>
+<body>
+<main>
+<h1>Portknob share link</h1>
+<p>{{.User}} shares access to {{.Rule}} with you until {{.Expires}}. The link works only once.</p>
+<form method="post">
+<p><button type="submit">Open access from this network</button></p>
+</form>
+</main>
+</body>
+</html>
+`))
@@ -0,0 +1,192 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const shareTestConfig = `allow-share-links = true
+share-link-rate-limit = 3
+[[firewall]]
+comment = "ssh"
+dport = "22"
+[[firewall]]
+comment = "web"
+dport = "443"
+group = "web"
+shareable = true
+[[secrets]]
+username = "alice"
+password = "hunter2"
+groups = ["web"]
+[[secrets]]
+username = "bob"
+password = "hunter3"
+groups = ["web"]
+share-lifespan = 0
+`
+
+// Send a request for path below the share path from addr with the cookies, returning the reply
+func testShare(s *server, addr, path string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	method := "GET"
+	if form != nil {
+		method = "POST"
+	}
+	r := httptest.NewRequest(method, "/share/" + path + "?plain=1", strings.NewReader(form.Encode()))
+	r.RemoteAddr = addr + ":5000"
+	r.Header.Set("X-Real-IP", addr)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.shareHandlerFunc(w, r)
+	return w
+}
+
+func TestShareLink(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, backend := newTestServer(t, shareTestConfig)
+	w := testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "Share access with others at /share/") {
+		t.Fatalf("login replied %d: %s", w.Code, w.Body.String())
+	}
+	cookies := w.Result().Cookies()
+
+	create := url.Values { "action": {"create"}, "rule": {"2"}, "lifespan": {"600"} }
+	if w := testShare(s, "198.51.100.7", "", create, cookies); w.Code != 401 {
+		t.Errorf("cookie from a subnet alice did not log in from got %d: %s", w.Code, w.Body.String())
+	}
+	if w := testShare(s, "192.0.2.7", "", url.Values { "action": {"create"}, "rule": {"1"} }, cookies); w.Code != 400 {
+		t.Errorf("rule without shareable got %d: %s", w.Code, w.Body.String())
+	}
+	w = testShare(s, "192.0.2.7", "", create, cookies)
+	if w.Code != 200 || !strings.HasPrefix(w.Body.String(), "OK url=http://example.com/share/") {
+		t.Fatalf("create replied %d: %s", w.Code, w.Body.String())
+	}
+	link := strings.Fields(w.Body.String())[1]
+	token := strings.TrimPrefix(link, "url=http://example.com/share/")
+	if links, _ := s.fw.cache.Shares("alice", time.Now()); len(links) != 1 || links[tokenHash(token)].user != "alice" {
+		t.Errorf("cache has %v, want the link under the hash of its token", links)
+	}
+
+	// Opening the link only asks to confirm
+	w = testShare(s, "203.0.113.9", token, nil, nil)
+	if w.Code != 200 || !strings.HasPrefix(w.Body.String(), "OK shared-by=alice ") || backend.elements["portknob-web-net4 203.0.113.9"] {
+		t.Fatalf("open replied %d: %s", w.Code, w.Body.String())
+	}
+	w = testShare(s, "203.0.113.9", token, url.Values {}, nil)
+	if w.Code != 200 {
+		t.Fatalf("confirm replied %d: %s", w.Code, w.Body.String())
+	}
+	if !backend.elements["portknob-web-net4 203.0.113.9"] || backend.elements["portknob-net4 203.0.113.9"] {
+		t.Errorf("firewall has %v, want 203.0.113.9 only for the shared rule", backend.elements)
+	}
+	entries, _ := s.fw.cache.Entries()
+	for _, entry := range entries {
+		if entry.addr.String() == "203.0.113.9" && (entry.user != "shared-by:alice" || entry.expires.After(time.Now().Add(600 * time.Second))) {
+			t.Errorf("entry of %s by %q expires %s, want by shared-by:alice within 600 seconds", entry.addr, entry.user, entry.expires)
+		}
+	}
+	if w := testShare(s, "203.0.113.10", token, url.Values {}, nil); w.Code != 404 {
+		t.Errorf("second use got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The creator lists and revokes the links
+	w = testShare(s, "192.0.2.7", "", create, cookies)
+	token = strings.TrimPrefix(strings.Fields(w.Body.String())[1], "url=http://example.com/share/")
+	w = testShare(s, "192.0.2.7", "", nil, cookies)
+	id := shareID(tokenHash(token))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), id + " ") {
+		t.Fatalf("list replied %d without %s: %s", w.Code, id, w.Body.String())
+	}
+	if w := testShare(s, "192.0.2.7", "", url.Values { "action": {"revoke"}, "id": {id} }, cookies); w.Code != 200 {
+		t.Errorf("revoke replied %d: %s", w.Code, w.Body.String())
+	}
+	if w := testShare(s, "203.0.113.11", token, url.Values {}, nil); w.Code != 404 {
+		t.Errorf("revoked link got %d: %s", w.Code, w.Body.String())
+	}
+	if w := testShare(s, "192.0.2.7", "", create, cookies); w.Code != 429 {
+		t.Errorf("fourth link in a minute got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = testLogin(s, "192.0.2.8", url.Values { "username": {"bob"}, "password": {"hunter3"} }, nil)
+	if strings.Contains(w.Body.String(), "Share access") {
+		t.Errorf("success page of bob offers share links: %s", w.Body.String())
+	}
+	if w := testShare(s, "192.0.2.8", "", create, w.Result().Cookies()); w.Code != 403 {
+		t.Errorf("bob with share-lifespan = 0 got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestShareLinkCrossOrigin(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s, _ := newTestServer(t, shareTestConfig)
+	w := testLogin(s, "192.0.2.7", url.Values { "username": {"alice"}, "password": {"hunter2"} }, nil)
+	r := httptest.NewRequest("POST", "/share/", strings.NewReader("action=create&rule=2"))
+	r.RemoteAddr = "192.0.2.7:5000"
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Sec-Fetch-Site", "cross-site")
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	s.shareHandlerFunc(w, r)
+	if w.Code != 403 {
+		t.Errorf("request of another site got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCheckShareable(t *testing.T) {
+	tests := []struct {
+		name		string
+		config		string
+		wantErr		bool
+	}{
+		{ "shareable group", "allow-share-links = true\n[[firewall]]\ndport = \"22\"\n[[firewall]]\ndport = \"443\"\ngroup = \"web\"\nshareable = true\n", false },
+		{ "shared group", "allow-share-links = true\n[[firewall]]\ndport = \"80\"\ngroup = \"web\"\n[[firewall]]\ndport = \"443\"\ngroup = \"web\"\nshareable = true\n", true },
+		{ "rules without a group", "allow-share-links = true\n[[firewall]]\ndport = \"22\"\n[[firewall]]\ndport = \"443\"\nshareable = true\n", true },
+		{ "own lifespan", "allow-share-links = true\n[[firewall]]\ndport = \"22\"\n[[firewall]]\ndport = \"443\"\nlifespan = 3600\nshareable = true\n", false },
+		{ "sliding", "allow-share-links = true\n[[firewall]]\ndport = \"443\"\nlifespan = 3600\nsliding = true\nshareable = true\n", true },
+		{ "admin-path", "allow-share-links = true\nadmin-path = \"/share\"\nadmin-allow = [\"127.0.0.1/32\"]\n[[firewall]]\ndport = \"443\"\nshareable = true\n", true },
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, fmt.Sprintf("[daemon]\ncache-database = %q\n%s", filepath.Join(t.TempDir(), "cache.db"), tt.config)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS configuration of the listener, nil to serve plain HTTP
+func (s *server) tlsConfig() (*tls.Config, error) {
+	switch {
+	case s.conf.Daemon.TLSCert != "":
+		reloader := &certReloader { certFile: s.conf.Daemon.TLSCert, keyFile: s.conf.Daemon.TLSKey }
+		// Fail at startup rather than at the first handshake
+		_, err := reloader.GetCertificate(nil)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config { GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12 }, nil
+	case len(s.conf.Daemon.ACMEDomains) != 0:
+		manager := &autocert.Manager {
+			Prompt:		autocert.AcceptTOS,
+			HostPolicy:	autocert.HostWhitelist(s.conf.Daemon.ACMEDomains...),
+			Cache:		autocert.DirCache(s.conf.Daemon.ACMECacheDir),
+			Email:		s.conf.Daemon.ACMEEmail,
+		}
+		ln, err := net.Listen("tcp", s.conf.Daemon.ACMEHTTPListen)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			log.Println(http.Serve(ln, manager.HTTPHandler(nil)))
+		}()
+		config := manager.TLSConfig()
+		config.MinVersion = tls.VersionTLS12
+		return config, nil
+	}
+	return nil, nil
+}
+
+// A certificate read again whenever its files change
+type certReloader struct {
+	certFile	string
+	keyFile		string
+	mutex		sync.Mutex
+	cert		*tls.Certificate
+	certMod		time.Time
+	keyMod		time.Time
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return r.keepCertificate(err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return r.keepCertificate(err)
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return r.keepCertificate(err)
+	}
+	if r.cert != nil {
+		log.Printf("Loaded the renewed certificate %q\n", r.certFile)
+	}
+	r.cert, r.certMod, r.keyMod = &cert, certInfo.ModTime(), keyInfo.ModTime()
+	return r.cert, nil
+}
+
+// The files may be read while a renewal replaces them one after the other, the old certificate is still good then
+func (r *certReloader) keepCertificate(err error) (*tls.Certificate, error) {
+	if r.cert == nil {
+		return nil, err
+	}
+	log.Printf("Cannot load certificate %q, keeping the old one: %s\n", r.certFile, err)
+	return r.cert, nil
+}
@@ -0,0 +1,107 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 parameters understood by every authenticator app
+const totpStep = 30
+const totpDigits = 6
+
+// Decode a base32 seed as shown by authenticator apps, ignoring case, spaces and padding
+func decodeTOTPSeed(seed string) ([]byte, error) {
+	seed = strings.ToUpper(strings.Join(strings.Fields(seed), ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(seed, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 10 {
+		return nil, fmt.Errorf("seed is shorter than 80 bits")
+	}
+	return key, nil
+}
+
+// Compute the RFC 4226 code of a time step
+func totpCode(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum) - 1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value % 1000000)
+}
+
+// Check code against the time steps around now, allowing one step of clock drift either way
+func checkTOTP(key []byte, code string, now time.Time) (counter uint64, ok bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := uint64(now.Unix()) / totpStep
+	for _, step := range []uint64 {current - 1, current, current + 1} {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			counter, ok = step, true
+		}
+	}
+	return
+}
+
+// Split "password:123456" as typed by users whose client has no field for the code
+func splitTOTPCode(pass string) (password, code string) {
+	i := strings.LastIndexByte(pass, ':')
+	if i < 0 || len(pass) - i - 1 != totpDigits {
+		return pass, ""
+	}
+	for _, c := range pass[i+1:] {
+		if c < '0' || c > '9' {
+			return pass, ""
+		}
+	}
+	return pass[:i], pass[i+1:]
+}
+
+// Generate a new seed for user, with the otpauth:// URI authenticator apps scan as a QR code
+func generateTOTPSeed(user string) (seed, uri string, err error) {
+	key := make([]byte, 20)
+	_, err = rand.Read(key)
+	if err != nil {
+		return
+	}
+	seed = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+	query := url.Values {}
+	query.Set("secret", seed)
+	query.Set("issuer", "portknob")
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpStep))
+	uri = "otpauth://totp/" + url.PathEscape("portknob:" + user) + "?" + query.Encode()
+	return
+}
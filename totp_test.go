@@ -0,0 +1,123 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// Seed of the RFC 6238 SHA-1 test vectors
+var rfc6238Key = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// The last 6 digits of the 8-digit codes of RFC 6238 appendix B
+	tests := []struct {
+		unix	int64
+		want	string
+	}{
+		{ 59, "287082" },
+		{ 1111111109, "081804" },
+		{ 1111111111, "050471" },
+		{ 1234567890, "005924" },
+		{ 2000000000, "279037" },
+		{ 20000000000, "353130" },
+	}
+	for _, tt := range tests {
+		if got := totpCode(rfc6238Key, uint64(tt.unix) / totpStep); got != tt.want {
+			t.Errorf("code at %d = %q, want %q", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := uint64(now.Unix()) / totpStep
+	tests := []struct {
+		name	string
+		code	string
+		wantOK	bool
+	}{
+		{ "current step", totpCode(rfc6238Key, current), true },
+		{ "one step behind", totpCode(rfc6238Key, current - 1), true },
+		{ "one step ahead", totpCode(rfc6238Key, current + 1), true },
+		{ "two steps behind", totpCode(rfc6238Key, current - 2), false },
+		{ "two steps ahead", totpCode(rfc6238Key, current + 2), false },
+		{ "8 digits", "14050471", false },
+		{ "empty", "", false },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			counter, ok := checkTOTP(rfc6238Key, tt.code, now)
+			if ok != tt.wantOK {
+				t.Fatalf("ok %t, want %t", ok, tt.wantOK)
+			}
+			if ok && totpCode(rfc6238Key, counter) != tt.code {
+				t.Errorf("counter %d does not give code %s", counter, tt.code)
+			}
+		})
+	}
+}
+
+func TestDecodeTOTPSeed(t *testing.T) {
+	seed := base32.StdEncoding.EncodeToString(rfc6238Key)
+	tests := []struct {
+		name	string
+		seed	string
+		wantErr	bool
+	}{
+		{ "padded", seed, false },
+		{ "as shown by apps", "gezd gnbv gy3t qojq gezd gnbv gy3t qojq", false },
+		{ "too short", "GEZDGNBV", true },
+		{ "not base32", "GEZDGNBVGY3TQOJQ!!", true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			key, err := decodeTOTPSeed(tt.seed)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && string(key) != string(rfc6238Key) {
+				t.Errorf("key %q, want %q", key, rfc6238Key)
+			}
+		})
+	}
+}
+
+func TestSplitTOTPCode(t *testing.T) {
+	tests := []struct {
+		pass			string
+		wantPassword	string
+		wantCode		string
+	}{
+		{ "hunter2:123456", "hunter2", "123456" },
+		{ "a:b:123456", "a:b", "123456" },
+		{ "hunter2", "hunter2", "" },
+		{ "hunter2:12345", "hunter2:12345", "" },
+		{ "hunter2:12345a", "hunter2:12345a", "" },
+	}
+	for _, tt := range tests {
+		password, code := splitTOTPCode(tt.pass)
+		if password != tt.wantPassword || code != tt.wantCode {
+			t.Errorf("splitTOTPCode(%q) = %q, %q, want %q, %q", tt.pass, password, code, tt.wantPassword, tt.wantCode)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+// GeoIP locations are often off by a few hundred kilometres, logins closer than this never count as impossible travel
+const travelMinDistance = 300
+
+const earthRadius = 6371
+
+var errTravelHeld = errors.New("login too far from the last one, held for confirmation")
+
+// Check a successful login of user from clientIP against the last one, with impossible-travel-kmh
+// The login becomes the one the next is checked against, unless impossible-travel-action "challenge" holds it and errTravelHeld is returned
+func (s *server) checkTravel(user, method string, clientIP net.IP, now time.Time) error {
+	if *s.conf.Daemon.ImpossibleTravelKMH == 0 {
+		return nil
+	}
+	latitude, longitude, ok := s.conf.location(clientIP)
+	if !ok {
+		return nil
+	}
+	login := travelRecord { now, clientIP, s.conf.country(clientIP), latitude, longitude }
+	last, found := s.fw.cache.LastLogin(user)
+	if found && !s.travelExempt(user, clientIP) && !s.travelExempt(user, last.addr) {
+		distance := travelDistance(last, login)
+		// Logins within the same second still take a second
+		speed := distance / math.Max(now.Sub(last.at).Hours(), 1.0 / 3600)
+		if distance >= travelMinDistance && speed > float64(*s.conf.Daemon.ImpossibleTravelKMH) {
+			held := s.conf.Daemon.ImpossibleTravelAction == "challenge"
+			result := "alert"
+			if held {
+				result = "held"
+			}
+			s.fw.audit.Event("impossible-travel", "result", result, "method", method, "user", user, "client", clientIP, "country", login.country, "location", formatLocation(login), "last-client", last.addr, "last-country", last.country, "last-location", formatLocation(last), "last-login", last.at, "km", int(distance), "kmh", int(speed))
+			s.fw.notify.Event("impossible-travel", fmt.Sprintf("User %q logged in from %s (%s), %d km from the login from %s (%s) %s before", user, clientIP, login.country, int(distance), last.addr, last.country, now.Sub(last.at).Round(time.Second)), "result", result, "user", user, "client", clientIP, "country", login.country, "last-client", last.addr, "last-country", last.country, "km", int(distance))
+			if held {
+				err := s.fw.cache.HoldTravel(user, login)
+				if err != nil {
+					return err
+				}
+				return errTravelHeld
+			}
+		}
+	}
+	return s.fw.cache.SetLastLogin(user, login)
+}
+
+// Whether addr is in impossible-travel-exempt for user or everyone
+func (s *server) travelExempt(user string, addr net.IP) bool {
+	for _, key := range []string {user, "*"} {
+		for _, ipnet := range s.conf.Daemon.travelExempt[key] {
+			if ipnet.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Release the held login of user, confirmed or dismissed on the admin page, by is who did
+func (s *server) releaseTravel(user string, confirm bool, by string) (code int, message string) {
+	login, found, err := s.fw.cache.ReleaseTravel(user, confirm)
+	if err != nil {
+		return 500, "cannot update cache database"
+	}
+	if !found {
+		return 404, "no login of " + user + " is held"
+	}
+	result := "dismissed"
+	if confirm {
+		result = "confirmed"
+	}
+	s.fw.audit.Event("impossible-travel", "result", result, "by", by, "user", user, "client", login.addr, "country", login.country, "location", formatLocation(login))
+	return 200, ""
+}
+
+// Great-circle distance between two logins in km
+func travelDistance(a, b travelRecord) float64 {
+	lat1, lat2 := a.latitude * math.Pi / 180, b.latitude * math.Pi / 180
+	dlat := lat2 - lat1
+	dlon := (b.longitude - a.longitude) * math.Pi / 180
+	h := math.Sin(dlat / 2) * math.Sin(dlat / 2) + math.Cos(lat1) * math.Cos(lat2) * math.Sin(dlon / 2) * math.Sin(dlon / 2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func formatLocation(r travelRecord) string {
+	return fmt.Sprintf("%.4f,%.4f", r.latitude, r.longitude)
+}
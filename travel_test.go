@@ -0,0 +1,163 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Networks of a test City database
+var testTravelNetworks = []testGeoIPNetwork {
+	// Berlin
+	{ "192.0.2.0/24", "DE", "DE", []float64 {52.52, 13.405} },
+	// Paris, 878 km from Berlin
+	{ "233.252.0.0/24", "FR", "FR", []float64 {48.8566, 2.3522} },
+	// Singapore, 9900 km from Berlin
+	{ "198.51.100.0/24", "SG", "SG", []float64 {1.29, 103.85} },
+	// Exits of a corporate VPN
+	{ "203.0.113.0/24", "US", "US", []float64 {37.751, -97.822} },
+	// A Country database
+	{ "10.0.0.0/8", "DE", "DE", nil },
+}
+
+func newTestTravelServer(t *testing.T, action string) *server {
+	geoip := writeTestGeoIP(t, testTravelNetworks)
+	audit := filepath.Join(t.TempDir(), "audit.log")
+	s, _ := newTestServer(t, "audit-log = " + strconv.Quote(audit) + "\ngeoip-database = " + strconv.Quote(geoip) + "\nimpossible-travel-action = " + strconv.Quote(action) + "\nimpossible-travel-exempt = { alice = [\"203.0.113.0/24\"] }\nadmin-path = \"/admin\"\n[[firewall]]\ndport = \"22\"\n[secrets]\nalice = \"hunter2\"\nbob = \"hunter3\"\n[admin-secrets]\nadmin = \"admin1\"\n")
+	s.fw.audit, _ = newAuditLog(s.conf)
+	return s
+}
+
+func TestCheckTravel(t *testing.T) {
+	tests := []struct {
+		name		string
+		action		string
+		user		string
+		first		string
+		second		string
+		after		time.Duration
+		// Result of the impossible-travel event, "" for none
+		want		string
+	}{
+		{ "plausible", "alert", "alice", "192.0.2.7", "233.252.0.7", 2 * time.Hour, "" },
+		{ "too fast", "alert", "alice", "192.0.2.7", "233.252.0.7", 15 * time.Minute, "alert" },
+		{ "challenged", "challenge", "alice", "192.0.2.7", "198.51.100.7", 15 * time.Minute, "held" },
+		{ "same city", "challenge", "alice", "192.0.2.7", "192.0.2.8", time.Second, "" },
+		{ "exempt VPN exit", "challenge", "alice", "192.0.2.7", "203.0.113.7", 15 * time.Minute, "" },
+		{ "exempt VPN exit of another user", "challenge", "bob", "192.0.2.7", "203.0.113.7", 15 * time.Minute, "held" },
+		{ "from the exempt VPN exit", "challenge", "alice", "203.0.113.7", "192.0.2.7", 15 * time.Minute, "" },
+		{ "no location", "challenge", "alice", "192.0.2.7", "10.0.0.1", time.Second, "" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			log.SetOutput(io.Discard)
+			defer log.SetOutput(os.Stderr)
+			s := newTestTravelServer(t, tt.action)
+			now := time.Date(2025, 2, 1, 10, 0, 0, 0, time.UTC)
+			err := s.checkTravel(tt.user, "password", net.ParseIP(tt.first), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.checkTravel(tt.user, "password", net.ParseIP(tt.second), now.Add(tt.after))
+			if (err == errTravelHeld) != (tt.want == "held") {
+				t.Fatalf("checkTravel() = %v, want result %q", err, tt.want)
+			}
+
+			data, _ := os.ReadFile(s.conf.Daemon.AuditLog)
+			audit := string(data)
+			if tt.want == "" {
+				if strings.Contains(audit, "impossible-travel") {
+					t.Errorf("audit log records impossible travel:\n%s", audit)
+				}
+				return
+			}
+			if !strings.Contains(audit, `"event":"impossible-travel","result":"` + tt.want + `"`) || !strings.Contains(audit, `"last-country":"DE"`) || !strings.Contains(audit, `"last-client":"` + tt.first + `"`) {
+				t.Errorf("audit log lacks the %s event with both locations:\n%s", tt.want, audit)
+			}
+			last, _ := s.fw.cache.LastLogin(tt.user)
+			if wantLast := map[bool]string { true: tt.first, false: tt.second }[tt.want == "held"]; last.addr.String() != wantLast {
+				t.Errorf("last login from %s, want %s", last.addr, wantLast)
+			}
+		})
+	}
+}
+
+func TestTravelChallenge(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	s := newTestTravelServer(t, "challenge")
+	login := url.Values { "username": {"alice"}, "password": {"hunter2"} }
+	if w := testLogin(s, "192.0.2.7", login, nil); w.Code != 200 {
+		t.Fatalf("login from Berlin replied %d: %s", w.Code, w.Body.String())
+	}
+	w := testLogin(s, "198.51.100.7", login, nil)
+	if w.Code != 403 || !strings.HasPrefix(w.Body.String(), "ERROR travel-held\n") {
+		t.Fatalf("login from Singapore replied %d: %s", w.Code, w.Body.String())
+	}
+	if entries, _ := s.fw.cache.Entries(); len(entries) != 1 {
+		t.Errorf("held login left %d whitelist entries, want 1", len(entries))
+	}
+
+	admin := func (method, path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "http://example.com")
+		r.SetBasicAuth("admin", "admin1")
+		w := httptest.NewRecorder()
+		s.adminHandlerFunc(w, r)
+		return w
+	}
+	if w := admin("GET", "/admin/", nil); !strings.Contains(w.Body.String(), "<td>alice</td><td>198.51.100.7</td><td>SG</td>") {
+		t.Errorf("admin page lacks the held login:\n%s", w.Body.String())
+	}
+	if w := admin("POST", "/admin/confirm-travel", url.Values { "user": {"bob"} }); w.Code != 404 {
+		t.Errorf("confirming a login which is not held replied %d", w.Code)
+	}
+	if w := admin("POST", "/admin/confirm-travel", url.Values { "user": {"alice"} }); w.Code != 303 {
+		t.Fatalf("confirm replied %d: %s", w.Code, w.Body.String())
+	}
+	if w := testLogin(s, "198.51.100.7", login, nil); w.Code != 200 {
+		t.Fatalf("confirmed login from Singapore replied %d: %s", w.Code, w.Body.String())
+	}
+	data, _ := os.ReadFile(s.conf.Daemon.AuditLog)
+	if !strings.Contains(string(data), `"event":"impossible-travel","result":"confirmed","by":"admin admin"`) {
+		t.Errorf("audit log lacks the confirmation:\n%s", data)
+	}
+}
+
+func TestTravelDistance(t *testing.T) {
+	berlin := travelRecord { latitude: 52.52, longitude: 13.405 }
+	paris := travelRecord { latitude: 48.8566, longitude: 2.3522 }
+	if d := travelDistance(berlin, paris); d < 870 || d > 885 {
+		t.Errorf("Berlin to Paris is %.0f km, want 878", d)
+	}
+	if d := travelDistance(berlin, berlin); d != 0 {
+		t.Errorf("Berlin to Berlin is %.0f km", d)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Populated at build time with -ldflags "-X main.version=..."
+var (
+	version		= "devel"
+	gitCommit	= "unknown"
+	buildDate	= "unknown"
+)
+
+// Firewall backends compiled into this binary
+var compiledBackends = []string {"iptables", "nftables"}
+
+// What -version prints and admin-path/capabilities replies
+// Fields are only ever added, never renamed or removed, so scripts can rely on those they know
+type capabilities struct {
+	Version				string		`json:"version"`
+	Commit				string		`json:"commit"`
+	BuildDate			string		`json:"build_date"`
+	Backends			[]string	`json:"backends"`
+	// The rest describes the running configuration, -version has none
+	FirewallBackend		string		`json:"firewall_backend,omitempty"`
+	Features			[]string	`json:"features,omitempty"`
+	// Counts the configurations loaded, 1 at startup and one more with every SIGHUP reload applied
+	ConfigGeneration	uint64		`json:"config_generation,omitempty"`
+	// Such as "enforcing (landlock ABI 4, seccomp)", once the daemon serves
+	Sandbox				string		`json:"sandbox,omitempty"`
+}
+
+// Return the build metadata, and what conf enables unless it is nil
+func newCapabilities(conf *config) capabilities {
+	c := capabilities {
+		Version:	version,
+		Commit:		gitCommit,
+		BuildDate:	buildDate,
+		Backends:	compiledBackends,
+	}
+	if conf == nil {
+		return c
+	}
+	c.FirewallBackend = conf.Daemon.FirewallBackend
+	c.Features = []string {}
+	for _, feature := range []struct {
+		name	string
+		enabled	bool
+	}{
+		{ "acme", len(conf.Daemon.ACMEDomains) != 0 },
+		{ "admin-api", conf.Daemon.AdminPath != "" },
+		{ "admin-grants", conf.Daemon.AdminPath != "" },
+		{ "audit-log", conf.Daemon.AuditLog != "" },
+		{ "authz", conf.Authz != nil },
+		{ "auto-rekey-ipv6", conf.Daemon.AutoRekeyIPv6 },
+		{ "bundles", len(conf.bundles()) != 0 },
+		{ "control-socket", conf.Daemon.ControlSocket != "" },
+		{ "defense", conf.Defense != nil },
+		{ "device-keys", len(conf.DeviceKeys) != 0 },
+		{ "geoip", conf.Daemon.GeoIPDatabase != "" },
+		{ "knock", len(conf.Knock) != 0 },
+		{ "ldap", conf.Auth.LDAP != nil },
+		{ "lockdown", len(conf.lockdownGroups()) != 0 },
+		{ "metrics", conf.Daemon.MetricsListen != "" },
+		{ "notify", conf.Notify != nil },
+		{ "oidc", conf.Auth.OIDC != nil },
+		{ "probation", conf.probationEnabled() },
+		{ "proxy-protocol", conf.Daemon.ProxyProtocol },
+		{ "read-only", conf.readOnly },
+		{ "sandbox", conf.Daemon.Sandbox != "off" },
+		{ "session-socket", conf.Daemon.SessionSocket != "" },
+		{ "share-links", conf.Daemon.AllowShareLinks },
+		{ "key-logins", conf.Daemon.AllowKeyLogins },
+		{ "shared-cache", conf.Daemon.CacheBackend == "sqlite" || conf.Daemon.CacheBackend == "redis" },
+		{ "tls", conf.Daemon.TLSCert != "" || len(conf.Daemon.ACMEDomains) != 0 },
+		{ "totp", len(conf.totpKeys) != 0 },
+	} {
+		if feature.enabled {
+			c.Features = append(c.Features, feature.name)
+		}
+	}
+	c.ConfigGeneration = conf.generation
+	c.Sandbox = sandboxState
+	return c
+}
+
+func (c capabilities) String() string {
+	s := fmt.Sprintf("portknob %s\ncommit: %s\nbuilt: %s\nbackends: %s\n", c.Version, c.Commit, c.BuildDate, strings.Join(c.Backends, ", "))
+	if c.Features != nil {
+		s += fmt.Sprintf("firewall backend: %s\nfeatures: %s\nconfig generation: %d\n", c.FirewallBackend, strings.Join(c.Features, ", "), c.ConfigGeneration)
+	}
+	if c.Sandbox != "" {
+		s += fmt.Sprintf("sandbox: %s\n", c.Sandbox)
+	}
+	return s
+}
+
+func versionString() string {
+	return newCapabilities(nil).String()
+}
@@ -0,0 +1,67 @@
+/*
+    portknob -- Port knocking daemon with web interface
+    Copyright (C) 2017 Star Brilliant <m13253@hotmail.com>
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The reply of admin-path/capabilities may gain fields, but scripts rely on the ones in the golden files
+func TestCapabilities(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func (v, c, b string) { version, gitCommit, buildDate = v, c, b }(version, gitCommit, buildDate)
+	version, gitCommit, buildDate = "1.2.3", "0123abc", "2026-01-02T03:04:05Z"
+	tests := []struct {
+		name	string
+		config	string
+		golden	string
+	}{
+		{ "minimal", "", "capabilities-minimal.txt" },
+		{ "features", "metrics-listen = \"127.0.0.1:9706\"\naudit-log = " + strconv.Quote(filepath.Join(t.TempDir(), "audit.log")) + "\nproxy-protocol = true\ntrusted-proxies = [\"192.0.2.10\"]\n", "capabilities-features.txt" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func (t *testing.T) {
+			s, _ := newTestServer(t, "admin-path = \"/admin\"\nadmin-allow = [\"192.0.2.0/24\"]\n" + tt.config)
+			r := httptest.NewRequest("GET", "/admin/capabilities", nil)
+			r.RemoteAddr = "192.0.2.1:5000"
+			w := httptest.NewRecorder()
+			s.adminHandlerFunc(w, r)
+			checkGolden(t, tt.golden, w)
+
+			// The admin page and -version show the same
+			w = httptest.NewRecorder()
+			s.adminPage(w)
+			if !strings.Contains(w.Body.String(), newCapabilities(s.conf).String()) {
+				t.Errorf("admin page lacks the capabilities:\n%s", w.Body.String())
+			}
+			if !strings.HasPrefix(newCapabilities(s.conf).String(), versionString()) {
+				t.Errorf("-version prints %q", versionString())
+			}
+		})
+	}
+}